@@ -0,0 +1,13 @@
+// Command cpio2tar converts a newc CPIO archive, such as an initramfs, into
+// a tar archive. It is equivalent to "ember cpio to-tar".
+package main
+
+import (
+	"os"
+
+	"github.com/hxtk/ember/internal/cli"
+)
+
+func main() {
+	os.Exit(cli.Run(os.Args[0], "cpio to-tar", os.Args[1:]))
+}
@@ -0,0 +1,12 @@
+// Command ember builds and inspects initramfs archives from OCI images.
+package main
+
+import (
+	"os"
+
+	"github.com/hxtk/ember/internal/cli"
+)
+
+func main() {
+	os.Exit(cli.Main("ember", os.Args[1:]))
+}
@@ -0,0 +1,16 @@
+//go:build linux && fuse
+
+// Command embermount mounts the merged filesystem of an OCI image read-only
+// via FUSE for interactive inspection. It is equivalent to "ember mount",
+// and like it is built only with the fuse build tag.
+package main
+
+import (
+	"os"
+
+	"github.com/hxtk/ember/internal/cli"
+)
+
+func main() {
+	os.Exit(cli.Run(os.Args[0], "mount", os.Args[1:]))
+}
@@ -4,4 +4,4 @@ go 1.25.5
 
 require github.com/opencontainers/image-spec v1.1.1
 
-require github.com/opencontainers/go-digest v1.0.0 // indirect
+require github.com/opencontainers/go-digest v1.0.0
@@ -0,0 +1,122 @@
+package cli
+
+import (
+	"io"
+	"log"
+	"os"
+	"time"
+	"unsafe"
+)
+
+// directAlign is the alignment, in memory and on the device, of the writes
+// of a deviceWriter: the largest logical block size of disks.
+const directAlign = 4096
+
+// directBufferSize is the size of the writes of a deviceWriter.
+const directBufferSize = 1 << 20
+
+// progressInterval is how often a deviceWriter logs how far it has got.
+var progressInterval = 5 * time.Second
+
+// openDirect opens the block device name for writing, with direct I/O
+// where the platform has it, so that writing a disk doesn't fill the page
+// cache with it. clearDirect turns direct I/O off again, for a write of
+// less than a block.
+var (
+	openDirect = func(name string) (*os.File, error) {
+		return os.OpenFile(name, os.O_WRONLY, 0)
+	}
+	clearDirect = func(*os.File) error { return nil }
+)
+
+// isBlockDevice reports whether fi is of a block device, such as a disk.
+func isBlockDevice(fi os.FileInfo) bool {
+	return fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0
+}
+
+// deviceSize returns the size of the block device name.
+func deviceSize(name string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.Seek(0, io.SeekEnd)
+}
+
+// deviceWriter writes to a block device opened by openDirect in aligned
+// writes of directBufferSize, logging its progress, and syncs it once it
+// is closed.
+type deviceWriter struct {
+	f       *os.File
+	dst     io.Writer // f, where the blocks go
+	buf     []byte    // aligned to directAlign
+	n       int       // bytes in buf
+	written int64
+	start   time.Time
+	logged  time.Time
+}
+
+func newDeviceWriter(f *os.File) *deviceWriter {
+	b := make([]byte, directBufferSize+directAlign)
+	off := int(-uintptr(unsafe.Pointer(&b[0])) & (directAlign - 1))
+	now := time.Now()
+	return &deviceWriter{f: f, dst: f, buf: b[off : off+directBufferSize], start: now, logged: now}
+}
+
+func (w *deviceWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[w.n:], p)
+		w.n += n
+		written += n
+		p = p[n:]
+		if w.n == len(w.buf) {
+			if err := w.flush(w.n); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush writes the first n bytes of buf and moves the rest to its start.
+func (w *deviceWriter) flush(n int) error {
+	if _, err := w.dst.Write(w.buf[:n]); err != nil {
+		return err
+	}
+	w.written += int64(n)
+	w.n = copy(w.buf, w.buf[n:w.n])
+	if now := time.Now(); now.Sub(w.logged) >= progressInterval {
+		w.logged = now
+		log.Printf("wrote %s to %s, %s/s", humanSize(w.written), w.f.Name(), humanSize(int64(float64(w.written)/now.Sub(w.start).Seconds())))
+	}
+	return nil
+}
+
+// Close writes what is left, the blocks of it directly and the rest, which
+// direct I/O can't write, through the page cache, and syncs the device.
+func (w *deviceWriter) Close() error {
+	return outputError(w.finish())
+}
+
+func (w *deviceWriter) finish() error {
+	if whole := w.n &^ (directAlign - 1); whole > 0 {
+		if err := w.flush(whole); err != nil {
+			return err
+		}
+	}
+	if w.n > 0 {
+		if err := clearDirect(w.f); err != nil {
+			return err
+		}
+		if err := w.flush(w.n); err != nil {
+			return err
+		}
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	log.Printf("wrote %s to %s in %s", humanSize(w.written), w.f.Name(), time.Since(w.start).Round(time.Millisecond))
+	return nil
+}
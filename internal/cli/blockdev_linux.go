@@ -0,0 +1,25 @@
+//go:build linux
+
+package cli
+
+import (
+	"os"
+	"syscall"
+)
+
+func init() {
+	// O_EXCL fails with EBUSY if the device is mounted.
+	openDirect = func(name string) (*os.File, error) {
+		return os.OpenFile(name, os.O_WRONLY|os.O_EXCL|syscall.O_DIRECT, 0)
+	}
+	clearDirect = func(f *os.File) error {
+		flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_GETFL, 0)
+		if errno == 0 {
+			_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETFL, flags&^syscall.O_DIRECT)
+		}
+		if errno != 0 {
+			return &os.SyscallError{Syscall: "fcntl", Err: errno}
+		}
+		return nil
+	}
+}
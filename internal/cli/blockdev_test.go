@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// recorder records the sizes of the writes to a deviceWriter's file and
+// when direct I/O was turned off between them.
+type recorder struct {
+	w         io.Writer
+	writes    []string
+	unaligned int // writes from memory direct I/O can't write from
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.writes = append(r.writes, fmt.Sprint(len(p)))
+	if uintptr(unsafe.Pointer(&p[0]))%directAlign != 0 {
+		r.unaligned++
+	}
+	return r.w.Write(p)
+}
+
+func TestDeviceWriter(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "disk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := newDeviceWriter(f)
+	rec := &recorder{w: f}
+	w.dst = rec
+
+	defer func(clear func(*os.File) error, interval time.Duration) {
+		clearDirect, progressInterval = clear, interval
+	}(clearDirect, progressInterval)
+	clearDirect = func(*os.File) error {
+		rec.writes = append(rec.writes, "clear")
+		return nil
+	}
+	progressInterval = 0
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	want := bytes.Repeat([]byte("0123456789abcdef"), (directBufferSize+3*directAlign+100)/16)
+	want = append(want, "tail"...)
+	// In many small writes, so that the blocks are gathered from them.
+	for p := want; len(p) > 0; {
+		n := min(len(p), 1000)
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tail := len(want) % directAlign
+	wantWrites := []string{
+		fmt.Sprint(directBufferSize),
+		fmt.Sprint(len(want) - directBufferSize - tail),
+		"clear",
+		fmt.Sprint(tail),
+	}
+	if strings.Join(rec.writes, " ") != strings.Join(wantWrites, " ") {
+		t.Errorf("writes %v, want %v", rec.writes, wantWrites)
+	}
+	if rec.unaligned > 0 {
+		t.Errorf("%d writes from unaligned memory", rec.unaligned)
+	}
+	got, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("wrote %d bytes that differ from the %d given", len(got), len(want))
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("logged %q, want a line for each write and one at the end", lines)
+	}
+	for _, l := range lines[:3] {
+		if !strings.Contains(l, "wrote ") || !strings.Contains(l, "/s") {
+			t.Errorf("progress line %q has no amount and rate", l)
+		}
+	}
+	if l := lines[3]; !strings.Contains(l, "wrote "+humanSize(int64(len(want)))+" to "+f.Name()+" in ") {
+		t.Errorf("last line %q doesn't say how much was written", l)
+	}
+}
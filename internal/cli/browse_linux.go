@@ -0,0 +1,246 @@
+//go:build linux
+
+package cli
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hxtk/ember/pkg/cpio"
+	"github.com/hxtk/ember/pkg/oci"
+)
+
+func init() {
+	commands = append(commands, browseCommand)
+}
+
+var browseCommand = &command{
+	name:  "browse",
+	args:  "<oci-layout-path | newc-archive>",
+	short: "Browse the merged filesystem of an image, or a CPIO archive, in the terminal and mark paths to exclude.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		var image imageFlags
+		image.register(fs)
+		excludeFile := fs.String("exclude-file", "ember-exclude.txt", "read marked paths from and write them to the exclude list `file`, for build -exclude-from")
+		return func(args []string) error {
+			if err := wantArgs(args, 1); err != nil {
+				return err
+			}
+			if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+				return errors.New("browse needs a terminal")
+			}
+			t, err := loadTree(args[0], &image)
+			if err != nil {
+				return err
+			}
+			defer t.close()
+			var patterns []string
+			if _, err := os.Stat(*excludeFile); err == nil {
+				if patterns, err = readExcludeList(*excludeFile); err != nil {
+					return err
+				}
+			}
+			b := newBrowser(t, args[0], *excludeFile, patterns)
+			return b.run(os.Stdin, os.Stdout)
+		}
+	},
+}
+
+// treeNode is an entry of the tree being browsed.
+type treeNode struct {
+	name     string // full path, "." for the root
+	hdr      *tar.Header
+	parent   *treeNode
+	children []*treeNode // sorted by name, for directories
+	open     func() (io.Reader, error)
+}
+
+// tree is the filesystem being browsed: the merged view of an image, or
+// the entries of an archive.
+type tree struct {
+	root  *treeNode
+	nodes map[string]*treeNode
+	close func() error
+}
+
+func newTree() *tree {
+	root := &treeNode{name: ".", hdr: &tar.Header{Typeflag: tar.TypeDir, Name: ".", Mode: 0o755, ModTime: time.Unix(0, 0)}}
+	return &tree{root: root, nodes: map[string]*treeNode{".": root}, close: func() error { return nil }}
+}
+
+// loadTree loads the image layout or newc archive at name.
+func loadTree(name string, image *imageFlags) (*tree, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return loadImageTree(name, image)
+	}
+	return loadArchiveTree(name)
+}
+
+func loadImageTree(layoutPath string, image *imageFlags) (*tree, error) {
+	r, err := image.open(layoutPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	fsys, err := oci.NewFS(r)
+	if err != nil {
+		return nil, err
+	}
+	t := newTree()
+	t.close = fsys.Close
+	err = fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == "." {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		n := t.add(p, fi.Sys().(*tar.Header))
+		if n.hdr.Typeflag == tar.TypeReg {
+			n.open = func() (io.Reader, error) { return fsys.Open(p) }
+		}
+		return nil
+	})
+	if err != nil {
+		fsys.Close()
+		return nil, err
+	}
+	t.sort()
+	return t, nil
+}
+
+// loadArchiveTree indexes the uncompressed newc archive in file, reading
+// contents from it on demand.
+func loadArchiveTree(file string) (*tree, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	var magic [6]byte
+	if _, err := io.ReadFull(f, magic[:]); err != nil || !bytes.HasPrefix(magic[:], []byte("07070")) {
+		f.Close()
+		return nil, fmt.Errorf("%s is neither an OCI layout directory nor an uncompressed newc archive", file)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	t := newTree()
+	t.close = f.Close
+	links := make(map[[3]int]*treeNode)
+	cr := cpio.NewReader(f)
+	for {
+		h, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		hdr := cpio.TarHeader(h)
+		if hdr == nil {
+			continue // a socket
+		}
+		name := path.Clean(strings.TrimLeft(h.Name, "/"))
+		if name == "." {
+			t.root.hdr = hdr
+			continue
+		}
+		content := io.NewSectionReader(f, cr.Offset(), h.Size)
+		if hdr.Typeflag == tar.TypeSymlink {
+			target, err := io.ReadAll(content)
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			hdr.Linkname = string(target)
+		}
+		n := t.add(name, hdr)
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		open := func() (io.Reader, error) { return io.NewSectionReader(content, 0, h.Size), nil }
+		if h.Links < 2 {
+			n.open = open
+			continue
+		}
+		// The content of a hard-linked file is on one of its entries,
+		// usually the last.
+		key := [3]int{h.DevMajor, h.DevMinor, h.Inode}
+		first := links[key]
+		if first == nil {
+			links[key] = n
+			n.open = open
+			continue
+		}
+		n.hdr.Typeflag, n.hdr.Linkname, n.hdr.Size = tar.TypeLink, first.name, 0
+		if h.Size > 0 {
+			first.hdr.Size, first.open = h.Size, open
+		}
+	}
+	t.sort()
+	return t, nil
+}
+
+// add adds the entry hdr at the cleaned path p, and any missing
+// directories above it, replacing what was there.
+func (t *tree) add(p string, hdr *tar.Header) *treeNode {
+	if n := t.nodes[p]; n != nil {
+		n.hdr, n.open = hdr, nil
+		return n
+	}
+	parent := t.nodes[path.Dir(p)]
+	if parent == nil {
+		parent = t.add(path.Dir(p), &tar.Header{Typeflag: tar.TypeDir, Name: path.Dir(p), Mode: 0o755, ModTime: time.Unix(0, 0)})
+	}
+	n := &treeNode{name: p, hdr: hdr, parent: parent}
+	parent.children = append(parent.children, n)
+	t.nodes[p] = n
+	return n
+}
+
+func (t *tree) sort() {
+	for _, n := range t.nodes {
+		slices.SortFunc(n.children, func(a, b *treeNode) int { return strings.Compare(a.name, b.name) })
+	}
+}
+
+// resolve follows the symbolic and hard link n to what it points to, if
+// that is in the tree.
+func (t *tree) resolve(n *treeNode) *treeNode {
+	for i := 0; i < maxLinks && n != nil; i++ {
+		switch n.hdr.Typeflag {
+		case tar.TypeLink:
+			n = t.nodes[inTree(n.hdr.Linkname)]
+		case tar.TypeSymlink:
+			target := n.hdr.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(n.name), target)
+			}
+			n = t.nodes[inTree(target)]
+		default:
+			return n
+		}
+	}
+	return nil
+}
+
+// maxLinks bounds how many links resolve follows.
+const maxLinks = 40
@@ -0,0 +1,446 @@
+//go:build linux
+
+package cli
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+	"unicode"
+	"unicode/utf8"
+)
+
+// viewLimit is how much of a file the browser shows.
+const viewLimit = 64 << 10
+
+const browseHelp = "↑↓ move  → open  ← back  space mark  w write exclude list  q quit"
+
+// browser is the state of the browse command's screen.
+type browser struct {
+	t           *tree
+	source      string
+	excludeFile string
+	patterns    []string // the exclude list, in order
+	dirty       bool     // whether patterns changed since the last write
+
+	dir         *treeNode
+	cursor, top int
+
+	view    []string // lines of the file being viewed, if any
+	viewOf  *treeNode
+	viewTop int
+
+	msg           string
+	quitting      bool // q was pressed once with unwritten marks
+	width, height int
+}
+
+func newBrowser(t *tree, source, excludeFile string, patterns []string) *browser {
+	return &browser{t: t, source: source, excludeFile: excludeFile, patterns: patterns, dir: t.root}
+}
+
+// run shows the browser on the terminal until the user quits.
+func (b *browser) run(in, out *os.File) error {
+	restore, err := makeRaw(in)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	// Use the alternate screen, so the shell's screen comes back on exit.
+	io.WriteString(out, "\x1b[?1049h\x1b[?25l")
+	defer io.WriteString(out, "\x1b[?25h\x1b[?1049l")
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+	keys := make(chan []string)
+	errc := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := in.Read(buf)
+			if err != nil {
+				errc <- err
+				return
+			}
+			keys <- parseKeys(buf[:n])
+		}
+	}()
+
+	for {
+		if b.width, b.height, err = terminalSize(out); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(out, b.draw()); err != nil {
+			return err
+		}
+		select {
+		case <-winch:
+		case err := <-errc:
+			return err
+		case ks := <-keys:
+			for _, k := range ks {
+				if b.key(k) {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// parseKeys splits terminal input into keys: printable characters, and
+// names such as "up" for the escape sequences of special keys.
+func parseKeys(in []byte) []string {
+	seqs := []struct{ seq, key string }{
+		{"\x1b[A", "up"}, {"\x1bOA", "up"},
+		{"\x1b[B", "down"}, {"\x1bOB", "down"},
+		{"\x1b[C", "right"}, {"\x1bOC", "right"},
+		{"\x1b[D", "left"}, {"\x1bOD", "left"},
+		{"\x1b[5~", "pgup"}, {"\x1b[6~", "pgdn"},
+		{"\x1b[H", "home"}, {"\x1b[1~", "home"}, {"\x1bOH", "home"},
+		{"\x1b[F", "end"}, {"\x1b[4~", "end"}, {"\x1bOF", "end"},
+		{"\r", "enter"}, {"\n", "enter"},
+		{"\x7f", "backspace"}, {"\b", "backspace"},
+	}
+	var keys []string
+next:
+	for len(in) > 0 {
+		for _, s := range seqs {
+			if bytes.HasPrefix(in, []byte(s.seq)) {
+				keys = append(keys, s.key)
+				in = in[len(s.seq):]
+				continue next
+			}
+		}
+		if in[0] == 0x1b {
+			// An unknown sequence, or Escape on its own: skip what follows
+			// it up to the end of the sequence.
+			keys = append(keys, "esc")
+			i := 1
+			if i < len(in) && (in[i] == '[' || in[i] == 'O') {
+				for i++; i < len(in) && (in[i] < 0x40 || in[i] > 0x7e); i++ {
+				}
+				i++
+			}
+			in = in[min(i, len(in)):]
+			continue
+		}
+		r, size := utf8.DecodeRune(in)
+		keys = append(keys, string(r))
+		in = in[size:]
+	}
+	return keys
+}
+
+// key handles a key press and reports whether to quit.
+func (b *browser) key(k string) bool {
+	if b.view != nil {
+		b.viewKey(k)
+		return false
+	}
+	b.msg = ""
+	if k != "q" {
+		b.quitting = false
+	}
+	entries := b.dir.children
+	page := max(b.rows()-1, 1)
+	switch k {
+	case "up", "k":
+		b.cursor--
+	case "down", "j":
+		b.cursor++
+	case "pgup":
+		b.cursor -= page
+	case "pgdn":
+		b.cursor += page
+	case "home", "g":
+		b.cursor = 0
+	case "end", "G":
+		b.cursor = len(entries) - 1
+	case "right", "l", "enter":
+		if len(entries) > 0 {
+			b.open(entries[b.cursor])
+		}
+	case "left", "h", "backspace":
+		if b.dir.parent != nil {
+			from := b.dir
+			b.dir = b.dir.parent
+			b.cursor = slices.Index(b.dir.children, from)
+		}
+	case " ", "x":
+		if len(entries) > 0 {
+			b.toggle(entries[b.cursor])
+			b.cursor++
+		}
+	case "w":
+		b.write()
+	case "q":
+		if !b.dirty || b.quitting {
+			return true
+		}
+		b.quitting = true
+		b.msg = "The marks have changed since they were written: w writes them to " + b.excludeFile + ", q quits anyway."
+	case "?":
+		b.msg = browseHelp
+	}
+	b.cursor = max(min(b.cursor, len(b.dir.children)-1), 0)
+	return false
+}
+
+// open enters a directory, or views a file, following links.
+func (b *browser) open(n *treeNode) {
+	target := b.t.resolve(n)
+	switch {
+	case target == nil:
+		b.msg = fmt.Sprintf("%s points to %s, which isn't in the tree.", n.name, n.hdr.Linkname)
+	case target.hdr.Typeflag == tar.TypeDir:
+		b.dir, b.cursor, b.top = target, 0, 0
+	case target.open == nil:
+		b.msg = fmt.Sprintf("%s is not a regular file.", target.name)
+	default:
+		lines, err := viewLines(target)
+		if err != nil {
+			b.msg = fmt.Sprintf("%s: %v", target.name, err)
+			return
+		}
+		b.view, b.viewOf, b.viewTop = lines, target, 0
+	}
+}
+
+// viewLines returns the start of the content of n as lines of text, or as
+// a hex dump if it isn't text.
+func viewLines(n *treeNode) ([]string, error) {
+	r, err := n.open()
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	content, err := io.ReadAll(io.LimitReader(r, viewLimit))
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	if utf8.Valid(content) && bytes.IndexByte(content, 0) < 0 {
+		lines = strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+		for i, l := range lines {
+			lines[i] = sanitize(strings.ReplaceAll(l, "\t", "        "))
+		}
+	} else {
+		lines = strings.Split(strings.TrimSuffix(hex.Dump(content), "\n"), "\n")
+	}
+	if n.hdr.Size > viewLimit {
+		lines = append(lines, fmt.Sprintf("-- the first %s of %s --", humanSize(viewLimit), humanSize(n.hdr.Size)))
+	}
+	return lines, nil
+}
+
+func (b *browser) viewKey(k string) {
+	page := max(b.rows()-1, 1)
+	switch k {
+	case "up", "k":
+		b.viewTop--
+	case "down", "j", "enter":
+		b.viewTop++
+	case "pgup", "b":
+		b.viewTop -= page
+	case "pgdn", " ":
+		b.viewTop += page
+	case "home", "g":
+		b.viewTop = 0
+	case "end", "G":
+		b.viewTop = len(b.view)
+	case "q", "left", "h", "esc", "backspace":
+		b.view, b.viewOf = nil, nil
+		return
+	}
+	b.viewTop = max(min(b.viewTop, len(b.view)-b.rows()), 0)
+}
+
+// toggle marks n for exclusion, or unmarks it.
+func (b *browser) toggle(n *treeNode) {
+	p := quotePath(n.name)
+	if i := slices.Index(b.patterns, p); i >= 0 {
+		b.patterns = slices.Delete(b.patterns, i, i+1)
+	} else {
+		b.patterns = append(b.patterns, p)
+	}
+	b.dirty = true
+}
+
+// excludedBy returns the exclude pattern that matches n, or a directory
+// above it, if there is one.
+func (b *browser) excludedBy(n *treeNode) string {
+	for p := n.name; p != "."; p = path.Dir(p) {
+		for _, pat := range b.patterns {
+			if ok, _ := path.Match(pat, p); ok {
+				return pat
+			}
+		}
+	}
+	return ""
+}
+
+func (b *browser) write() {
+	f, err := os.Create(b.excludeFile)
+	if err == nil {
+		header := fmt.Sprintf("Paths to leave out of %s, marked in ember browse.\nUse with: ember build -exclude-from %s", b.source, b.excludeFile)
+		err = writeExcludeList(f, header, b.patterns)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		b.msg = err.Error()
+		return
+	}
+	b.dirty = false
+	b.msg = fmt.Sprintf("Wrote %d patterns to %s.", len(b.patterns), b.excludeFile)
+}
+
+// rows returns how many rows of entries or content fit between the title
+// line and the two status lines.
+func (b *browser) rows() int {
+	return max(b.height-3, 1)
+}
+
+// draw returns the escape sequences that redraw the screen.
+func (b *browser) draw() string {
+	var s strings.Builder
+	s.WriteString("\x1b[H")
+	line := func(attr, text string) {
+		if s.Len() > len("\x1b[H") {
+			s.WriteString("\r\n")
+		}
+		s.WriteString(attr + fit(text, b.width) + "\x1b[K\x1b[m")
+	}
+
+	if b.view != nil {
+		n := b.viewOf
+		line("\x1b[7m", fmt.Sprintf(" %s: /%s (%s)", b.source, displayName(n), humanSize(n.hdr.Size)))
+		for i := range b.rows() {
+			l := ""
+			if b.viewTop+i < len(b.view) {
+				l = b.view[b.viewTop+i]
+			}
+			line("", l)
+		}
+		line("", "")
+		last := min(b.viewTop+b.rows(), len(b.view))
+		line("\x1b[2m", fmt.Sprintf("lines %d-%d of %d  ↑↓ scroll  q back", min(b.viewTop+1, last), last, len(b.view)))
+		return s.String()
+	}
+
+	entries := b.dir.children
+	rows := b.rows()
+	if b.cursor < b.top {
+		b.top = b.cursor
+	} else if b.cursor >= b.top+rows {
+		b.top = b.cursor - rows + 1
+	}
+	line("\x1b[7m", fmt.Sprintf(" %s: /%s", b.source, displayName(b.dir)))
+	for i := range rows {
+		j := b.top + i
+		switch {
+		case len(entries) == 0 && i == 0:
+			line("\x1b[2m", "  (empty)")
+		case j >= len(entries):
+			line("", "")
+		default:
+			attr := ""
+			if b.excludedBy(entries[j]) != "" {
+				attr = "\x1b[2m"
+			}
+			if j == b.cursor {
+				attr += "\x1b[7m"
+			}
+			line(attr, b.entryLine(entries[j]))
+		}
+	}
+	if len(entries) > 0 {
+		line("", b.details(entries[b.cursor]))
+	} else {
+		line("", "")
+	}
+	if b.msg != "" {
+		line("\x1b[1m", b.msg)
+	} else {
+		line("\x1b[2m", browseHelp)
+	}
+	return s.String()
+}
+
+// entryLine describes n in the listing of its directory.
+func (b *browser) entryLine(n *treeNode) string {
+	mark := "  "
+	switch {
+	case slices.Contains(b.patterns, quotePath(n.name)):
+		mark = "x "
+	case b.excludedBy(n) != "":
+		mark = "- "
+	}
+	size := ""
+	if n.hdr.Typeflag == tar.TypeReg {
+		size = humanSize(n.hdr.Size)
+	}
+	name := sanitize(path.Base(n.name))
+	switch n.hdr.Typeflag {
+	case tar.TypeDir:
+		name += "/"
+	case tar.TypeSymlink:
+		name += " -> " + sanitize(n.hdr.Linkname)
+	case tar.TypeLink:
+		name += " => /" + sanitize(n.hdr.Linkname)
+	}
+	return fmt.Sprintf("%s%s %8s  %s", mark, n.hdr.FileInfo().Mode(), size, name)
+}
+
+// details describes the metadata of n.
+func (b *browser) details(n *treeNode) string {
+	h := n.hdr
+	d := fmt.Sprintf("%s  uid %d gid %d  %s", h.FileInfo().Mode(), h.Uid, h.Gid, h.ModTime.UTC().Format("2006-01-02 15:04:05"))
+	switch h.Typeflag {
+	case tar.TypeReg:
+		d += fmt.Sprintf("  %d bytes", h.Size)
+	case tar.TypeChar, tar.TypeBlock:
+		d += fmt.Sprintf("  device %d,%d", h.Devmajor, h.Devminor)
+	}
+	if pat := b.excludedBy(n); pat != "" {
+		d += "  excluded by " + pat
+	}
+	return d
+}
+
+func displayName(n *treeNode) string {
+	if n.name == "." {
+		return ""
+	}
+	return sanitize(n.name)
+}
+
+// sanitize replaces the characters of s that would upset the terminal.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || !unicode.IsPrint(r) {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// fit truncates s to w characters.
+func fit(s string, w int) string {
+	if utf8.RuneCountInString(s) <= w {
+		return s
+	}
+	return string([]rune(s)[:max(w, 0)])
+}
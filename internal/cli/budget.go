@@ -0,0 +1,166 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/cpio"
+)
+
+// defaultTrims are the trim strategies of -size-budget by default, in the
+// order they are tried: those that lose least first.
+const defaultTrims = "locales,docs,modules,strip"
+
+// trimStrategies are what -trim can name. Each sets o to trim the archive
+// as a build flag does, and reports whether that trims anything the flags
+// didn't already.
+var trimStrategies = map[string]func(o *buildOptions, modulesList string) bool{
+	// -preset locales, keeping -keep-locale and -keep-tz.
+	"locales": func(o *buildOptions, _ string) bool {
+		if slices.Contains(o.presets, convert.PresetLocales) {
+			return false
+		}
+		o.presets = append(slices.Clip(o.presets), convert.PresetLocales)
+		return true
+	},
+	// -preset minimal: documentation, package databases and caches.
+	"docs": func(o *buildOptions, _ string) bool {
+		if slices.Contains(o.presets, convert.PresetMinimal) {
+			return false
+		}
+		o.presets = append(slices.Clip(o.presets), convert.PresetMinimal)
+		return true
+	},
+	// -host-modules-list, which the budget holds back until it is needed.
+	"modules": func(o *buildOptions, modulesList string) bool {
+		if modulesList == "" || o.hostModulesList != "" {
+			return false
+		}
+		o.hostModulesList = modulesList
+		return true
+	},
+	// -strip-binaries.
+	"strip": func(o *buildOptions, _ string) bool {
+		if o.stripBinaries {
+			return false
+		}
+		o.stripBinaries = true
+		return true
+	},
+}
+
+// budgetReport is what -size-budget did, for the build report.
+type budgetReport struct {
+	Budget  int64    `json:"budget"`
+	Size    int64    `json:"size"`    // of the archive as written
+	Trimmed []string `json:"trimmed"` // the strategies applied, in order
+}
+
+// fitBudget applies the trim strategies of -trim to o in order, as few as
+// it takes for the archive of the image of the layout at layoutPath to fit
+// -size-budget, by converting the image to count the bytes each time, and
+// fails if all of them are not enough.
+func (o *buildOptions) fitBudget(layoutPath string) error {
+	budget, err := parseSize(o.sizeBudget)
+	if err != nil {
+		return usageError(fmt.Sprintf("invalid -size-budget %q", o.sizeBudget))
+	}
+	switch {
+	case o.genInitCPIO != "":
+		return usageError("-size-budget cannot be combined with -gen-init-cpio")
+	case len(o.plugins) > 0:
+		return usageError("-size-budget cannot be combined with -plugin, whose output it can't predict")
+	}
+	names := strings.Split(o.trim, ",")
+	for _, name := range names {
+		if trimStrategies[name] == nil {
+			return usageError(fmt.Sprintf("unknown -trim strategy %q; want %s", name, strings.Join(slices.Sorted(maps.Keys(trimStrategies)), ", ")))
+		}
+	}
+	modulesList := o.hostModulesList
+	if slices.Contains(names, "modules") {
+		o.hostModulesList = ""
+	}
+
+	rep := &budgetReport{Budget: budget, Trimmed: []string{}}
+	for {
+		if rep.Size, err = o.trialSize(layoutPath); err != nil {
+			return err
+		}
+		if rep.Size <= budget {
+			break
+		}
+		for len(names) > 0 && !trimStrategies[names[0]](o, modulesList) {
+			names = names[1:]
+		}
+		if len(names) == 0 {
+			msg := fmt.Sprintf("the archive is %s, over the -size-budget of %s", humanSize(rep.Size), humanSize(budget))
+			if len(rep.Trimmed) == 0 {
+				return verificationError(fmt.Errorf("%s, and none of -trim %s trims it", msg, o.trim))
+			}
+			return verificationError(fmt.Errorf("%s even trimmed by %s", msg, strings.Join(rep.Trimmed, ", ")))
+		}
+		rep.Trimmed = append(rep.Trimmed, names[0])
+		names = names[1:]
+	}
+	if len(rep.Trimmed) > 0 {
+		log.Printf("trimmed the archive by %s to %s, within the -size-budget of %s", strings.Join(rep.Trimmed, ", "), humanSize(rep.Size), humanSize(budget))
+	}
+	o.budget = rep
+	return nil
+}
+
+// trialSize converts the image of the layout at layoutPath as o says into
+// nothing, and returns the size of the archive that would be written:
+// compressed as -compress says, after the -dracut-base file.
+func (o *buildOptions) trialSize(layoutPath string) (int64, error) {
+	// The trial's messages would repeat those of the build.
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(out)
+
+	r, err := o.image.open(layoutPath, o.readerOptions()...)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	opts, cleanup, err := o.convertOptions()
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+	defer func() { o.stripped, o.strippedBytes = 0, 0 }()
+	comp, err := o.compress.compression()
+	if err != nil {
+		return 0, err
+	}
+	n := &offsetWriter{w: io.Discard}
+	zw, err := comp.writer(n)
+	if err != nil {
+		return 0, err
+	}
+	w := cpio.NewWriter(zw)
+	if err := convert.Convert(r, w, opts...); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	if o.dracutBase != "" {
+		fi, err := os.Stat(o.dracutBase)
+		if err != nil {
+			return 0, err
+		}
+		n.n += fi.Size()
+	}
+	return n.n, nil
+}
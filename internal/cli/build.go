@@ -0,0 +1,1230 @@
+package cli
+
+import (
+	"archive/tar"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/cpio"
+	"github.com/hxtk/ember/pkg/efisign"
+	"github.com/hxtk/ember/pkg/measure"
+	"github.com/hxtk/ember/pkg/mtree"
+	"github.com/hxtk/ember/pkg/netboot"
+	"github.com/hxtk/ember/pkg/oci"
+	"github.com/opencontainers/go-digest"
+)
+
+var buildCommand = &command{
+	name:  "build",
+	args:  "<oci-layout-path>",
+	short: "Convert an OCI image layout into a CPIO initramfs archive.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		var o buildOptions
+		o.register(fs)
+		return func(args []string) error {
+			if err := wantArgs(args, 1); err != nil {
+				return err
+			}
+			o.given = make(map[string]bool)
+			fs.Visit(func(f *flag.Flag) { o.given[f.Name] = true })
+			if o.platforms != "" {
+				return buildPlatforms(args[0], &o)
+			}
+			return build(args[0], &o)
+		}
+	},
+}
+
+// register registers the flags of the build command, which set o.
+func (o *buildOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.output, "o", "", "write the archive to `path`, or to stdout if - or unset; with -split-size, the prefix for volume names. A block device, such as a VM disk, is written with direct I/O, logging progress")
+	fs.StringVar(&o.tarOutput, "tar", "", "also write the archive's entries, as they are converted, to the tar archive `file`, so that one read of the image yields both, e.g. a CPIO archive to boot and a tar archive to keep")
+	fs.BoolVar(&o.locked, "locked", false, "fail unless the image is one that -lock-file pins for the layout, so that a build doesn't silently pick up an image whose tag moved")
+	fs.StringVar(&o.lockFile, "lock-file", defaultLockFile, "with -locked, the lock `file` ember lock wrote")
+	fs.BoolVar(&o.force, "force", false, "write the archive to stdout even if it is a terminal")
+	fs.StringVar(&o.sizeBudget, "size-budget", "", "fit the archive as written, compressed and after -dracut-base, within `size` bytes (e.g. 48M), trimming it with as few of the -trim strategies as it takes, or fail")
+	fs.StringVar(&o.trim, "trim", defaultTrims, "with -size-budget, the comma-separated trim `strategies` to apply in turn until the archive fits: locales (-preset locales), docs (-preset minimal), modules (-host-modules-list, held back until needed), and strip (-strip-binaries)")
+	fs.IntVar(&o.spaceMargin, "space-margin", defaultSpaceMargin, "before writing, check that the filesystems of the outputs have room for the image's layers, as their descriptors size them, and `percent` more, or skip the check if negative")
+	o.compress.register(fs)
+	fs.StringVar(&o.copyBuffer, "copy-buffer", "", "copy entry content through reusable buffers of `size` bytes (e.g. 1M; default 256K)")
+	fs.StringVar(&o.splitSize, "split-size", "", "split the archive into volumes of at most `size` bytes (e.g. 64M), written to <o>.000, <o>.001, ...")
+	fs.StringVar(&o.chunkStore, "chunk-store", "", "also split the archive into content-defined chunks stored in the casync-compatible chunk store `dir`; -o becomes optional")
+	fs.StringVar(&o.chunkIndex, "chunk-index", "", "with -chunk-store, write the casync blob index (.caibx) of the archive to `file`")
+	fs.StringVar(&o.genInitCPIO, "gen-init-cpio", "", "instead of an archive at -o, write a usr/gen_init_cpio description, initramfs.list, and the content it names below root, into `dir`, for the kernel build to assemble as CONFIG_INITRAMFS_SOURCE")
+	o.image.register(fs)
+	fs.BoolVar(&o.keepGoing, "keep-going", false, "skip the rest of layers that fail to read, emit everything else, and report the failures (the exit status is still 1)")
+	fs.BoolVar(&o.skipUnsupported, "skip-unsupported-layers", false, "leave out layers of media types ember can't decode, such as foreign or bzip2 layers, emit everything else, and report them (the exit status is 8, degraded)")
+	fs.StringVar(&o.report, "report", "", "write a JSON build report to `file` (- for stdout)")
+	fs.StringVar(&o.comparePayload, "compare-payload", "", "with -report, record whether the archive is byte for byte the one of the earlier build report `file`, however either was compressed")
+	fs.BoolVar(&o.reportDeleted, "report-deleted", false, "with -report, list every lower-layer path that a whiteout or opaque marker deleted, and the layer that deleted it")
+	fs.StringVar(&o.scanSecrets, "scan-secrets", "", "scan the files written for private keys, AWS credentials, and npm tokens; `mode` warn reports them, fail also fails the build")
+	fs.StringVar(&o.failOn, "fail-on", "", "fail if the image has entries of the comma-separated `classes` devices (character and block), setuid (setuid or setgid bits), or sockets (of -overlay-dir, which are left out)")
+	fs.StringVar(&o.vulnList, "vuln-list", "", "fail if a package in the image's apk or dpkg database matches an advisory in the JSON vulnerability list `file`")
+	fs.StringVar(&o.pxe, "pxe", "", "write a netboot bundle (kernel, initramfs, iPXE and PXELINUX configs) into the TFTP/HTTP root `dir` instead of an archive at -o")
+	fs.StringVar(&o.kernel, "kernel", "", "with -pxe, the kernel image `file` to boot")
+	fs.StringVar(&o.cmdline, "cmdline", "", "with -pxe, the kernel command line")
+	fs.StringVar(&o.pxeClass, "pxe-class", netboot.DefaultClass, "with -pxe, the DHCP `class` the bundle serves; names its directory and PXELINUX config")
+	fs.StringVar(&o.signKey, "sign-key", "", "with -pxe, sign the EFI kernel for Secure Boot with sbsign using the PEM key in `file` (requires -sign-cert)")
+	fs.StringVar(&o.signCert, "sign-cert", "", "with -sign-key, the PEM certificate `file` to sign with")
+	fs.StringVar(&o.signCommand, "sign-command", "", "with -pxe, sign the EFI kernel by running `command`, which reads {in} and writes the signed image to {out}")
+	fs.StringVar(&o.measure, "measure", "", "with -pxe, write the predicted TPM PCR 4, 9, and 11 measurements of the bundle as JSON to `file`")
+	fs.StringVar(&o.pxeBaseURL, "pxe-base-url", "", "with -pxe, the `URL` the bundle directory is served at, for iPXE to fetch over HTTP")
+	fs.Func("inject", "add the local file src to the archive as dst, given as `dst=src`, replacing any image file there (repeatable)", func(s string) error {
+		dst, src, ok := strings.Cut(s, "=")
+		if !ok || dst == "" || src == "" {
+			return fmt.Errorf("want dst=src, got %q", s)
+		}
+		o.inject = append(o.inject, [2]string{dst, src})
+		return nil
+	})
+	fs.StringVar(&o.release, "image-release", "", "add a file at `path`, e.g. /etc/image-release, that says in os-release format what image the archive was built from: its name, digest, platform, and annotations, and when, at SOURCE_DATE_EPOCH if set")
+	fs.Func("template", "render the file at `path` in the output through text/template (repeatable)", func(s string) error {
+		o.templates = append(o.templates, s)
+		return nil
+	})
+	fs.StringVar(&o.genInit, "gen-init", "", "generate the files of an init `profile`: systemd, busybox, or custom (with -init-template)")
+	fs.StringVar(&o.checkInit, "check-init", "", "warn if the init at `path` needs an interpreter or shared library the archive lacks; with -gen-init, the init rdinit= of -cmdline names, or /init, is checked")
+	fs.StringVar(&o.initTemplate, "init-template", "", "with -gen-init custom, render /init from the text/template in `file`")
+	fs.Func("dracut-hook", "install the shell script `hook=file` at a dracut hook point, e.g. pre-mount=10-unlock.sh (repeatable)", func(s string) error {
+		o.dracutHooks = append(o.dracutHooks, s)
+		return nil
+	})
+	fs.StringVar(&o.dracutBase, "dracut-base", "", "write the existing (e.g. dracut-generated) initramfs `file` first and the image's archive after it, so the kernel unpacks the image on top")
+	fs.StringVar(&o.hostModules, "host-modules", "", "copy the host's module tree for kernel `version` into lib/modules")
+	fs.StringVar(&o.hostModulesDir, "host-modules-dir", "/lib/modules", "`directory` holding the host's module trees")
+	fs.StringVar(&o.hostModulesList, "host-modules-list", "", "with -host-modules, keep only the modules named in `file` and their dependencies")
+	fs.Func("exclude", "leave out image paths matching the `glob`, and everything below them (repeatable)", func(s string) error {
+		o.exclude = append(o.exclude, s)
+		return nil
+	})
+	fs.Func("exclude-from", "leave out the paths matching the globs in `file`, one per line, as ember browse writes them (repeatable)", func(s string) error {
+		patterns, err := readExcludeList(s)
+		o.exclude = append(o.exclude, patterns...)
+		return err
+	})
+	fs.BoolVar(&o.stripPkgDB, "strip-pkgdb", false, "leave out the apk, dpkg, and rpm package databases")
+	fs.BoolVar(&o.stripBinaries, "strip-binaries", false, "remove the debug sections of the image's ELF files, as strip --strip-debug does")
+	fs.Func("strip-exclude", "with -strip-binaries, leave the ELF files matching the `glob`, and everything below them, as they are (repeatable)", func(s string) error {
+		o.stripExclude = append(o.stripExclude, s)
+		return nil
+	})
+	fs.Func("normalize", "make files that differ between builds of the same image the same: `name` is one of "+strings.Join(convert.NormalizerNames(), ", ")+" (repeatable)", func(s string) error {
+		o.normalize = append(o.normalize, s)
+		return nil
+	})
+	fs.Func("preset", "leave out a curated set of paths: `name` minimal drops package databases, documentation, and package caches; locales drops time zones and compiled locales but those of -keep-tz and -keep-locale (repeatable)", func(s string) error {
+		o.presets = append(o.presets, s)
+		return nil
+	})
+	fs.Func("keep-locale", "with -preset locales, keep the compiled locale `name`, e.g. en_US.UTF-8 (repeatable)", func(s string) error {
+		o.keepLocales = append(o.keepLocales, s)
+		return nil
+	})
+	fs.Func("keep-tz", "with -preset locales, keep the time `zone`, e.g. UTC or Europe/Berlin (repeatable)", func(s string) error {
+		o.keepZones = append(o.keepZones, s)
+		return nil
+	})
+	fs.Var(&o.vars, "var", "set the template variable `key=value`, available as .Vars.key (repeatable)")
+	fs.Func("rename", "rewrite entry paths and symlink targets with a `pattern:replacement` regexp rule (repeatable, applied in order)", func(s string) error {
+		rule, err := convert.ParseRenameRule(s)
+		if err != nil {
+			return err
+		}
+		o.rename = append(o.rename, rule)
+		return nil
+	})
+	fs.Func("substitute", "replace the content of image files that has the digest with that of the local file, given as `digest=file` (repeatable)", func(s string) error {
+		d, file, ok := strings.Cut(s, "=")
+		if !ok || file == "" {
+			return fmt.Errorf("want digest=file, got %q", s)
+		}
+		dgst, err := digest.Parse(d)
+		if err != nil {
+			return err
+		}
+		if o.substitutes == nil {
+			o.substitutes = make(map[digest.Digest]string)
+		}
+		o.substitutes[dgst] = file
+		return nil
+	})
+	fs.Func("policy", "apply the drop, fail, and set rules of the policy `file` to every image entry; see convert.Policy for the language (repeatable)", func(s string) error {
+		b, err := os.ReadFile(s)
+		if err != nil {
+			return err
+		}
+		p, err := convert.ParsePolicy(string(b))
+		if err != nil {
+			return fmt.Errorf("%s: %w", s, err)
+		}
+		o.policies = append(o.policies, p)
+		return nil
+	})
+	fs.Func("mtree", "take the mode, owner, time, and xattrs of the paths the mtree(8) specification `file` lists from it, and create the directories, device nodes, fifos, and symlinks it lists that the image lacks (repeatable)", func(s string) error {
+		f, err := os.Open(s)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		spec, err := mtree.Parse(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s, err)
+		}
+		o.specs = append(o.specs, spec)
+		return nil
+	})
+	fs.Func("device-table", "create the device nodes, directories, and fifos of the buildroot and makedevs device table `file`, device_table.txt, with its modes, owners, and major and minor numbers, which a rootless image build can't make, and take the modes and owners it gives files (repeatable)", func(s string) error {
+		f, err := os.Open(s)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		spec, err := mtree.ParseDeviceTable(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s, err)
+		}
+		o.specs = append(o.specs, spec)
+		return nil
+	})
+	fs.Func("plugin", "pass the image's entries through the filter `program`, which speaks the framed protocol of convert.Plugin on stdin and stdout (repeatable, applied in order)", func(s string) error {
+		o.plugins = append(o.plugins, s)
+		return nil
+	})
+	fs.BoolVar(&o.dotPrefix, "dot-prefix", false, "start every entry name with ./, as find . | cpio does")
+	fs.BoolVar(&o.dirSlash, "dir-slash", false, "end the names of directories with a slash")
+	fs.BoolVar(&o.dirLinks, "dir-links", false, "give directories a link count of 2 and one for each directory in them, as real filesystems do, instead of 2, for tools that check it; the archive is spooled to a temporary file to count them")
+	fs.StringVar(&o.rootEntry, "root-entry", "", "start the archive with a root directory entry of `mode:uid:gid`, e.g. 0755:0:0, in place of any the image has, or none to leave out the image's")
+	fs.StringVar(&o.inodes, "inodes", "sequential", "number the entries' inodes by `scheme` sequential (in archive order), path-hash (by path, stable across builds), or content-hash (regular files by content, which holds each until it is hashed, and the rest by path)")
+	fs.StringVar(&o.inodeMap, "inode-map", "", "number the paths listed in `file`, one \"inode path\" per line, as it says, for example to match an earlier archive, and the rest by -inodes")
+	fs.StringVar(&o.timestamps, "timestamps", "truncate", "fit modification times newc can't hold with the comma-separated `policies` truncate (sub-second times toward the past), round (to the nearest second), and clamp (times before 1970 or after 2106 to the ends of the range instead of wrapping them)")
+	fs.StringVar(&o.usrLayout, "usr-layout", "", "normalise bin, sbin, and lib* to `layout` merged (moved into usr, with symlinks such as bin -> usr/bin) or split (moved out of usr)")
+	fs.StringVar(&o.backslashes, "backslash-names", "keep", "what to do with an entry whose name has a backslash, as broken Windows tooling writes for path separators: `policy` keep, slash (take them for separators), skip, or fail")
+	fs.StringVar(&o.namePolicy, "name-policy", "fail", "what to do with an entry whose name is over the limits: `policy` fail, skip, or shorten (overlong components get a hash suffix)")
+	fs.IntVar(&o.names.MaxPath, "max-path", 0, "limit entry paths and symlink targets to `n` bytes (default: the kernel's PATH_MAX)")
+	fs.IntVar(&o.names.MaxComponent, "max-name", 0, "limit each path component to `n` bytes (default: the kernel's NAME_MAX, 255)")
+	fs.IntVar(&o.names.MaxDepth, "max-depth", 0, "limit entry paths to `n` components (default: unlimited)")
+	fs.BoolVar(&o.ignoreHints, "ignore-hints", false, "don't take flags from the image's ember.<flag> annotations, such as ember.compress or ember.exclude")
+	fs.StringVar(&o.platforms, "platforms", "", "build an archive for each of the comma-separated `platforms` of the index, e.g. linux/amd64,linux/arm64, each named after -o with the platform, and one report for all")
+}
+
+// buildOptions holds the flags of the build command.
+type buildOptions struct {
+	image      imageFlags
+	output     string
+	tarOutput  string
+	report     string
+	keepGoing  bool
+	force      bool
+	splitSize  string
+	copyBuffer string
+	rename     []convert.RenameRule
+	inject     [][2]string // dst, src
+	release    string      // -image-release
+	templates  []string
+	vars       labelFlag
+
+	skipUnsupported bool // -skip-unsupported-layers
+
+	compress compressFlags
+
+	spaceMargin int // percent, see checkSpace
+
+	sizeBudget string
+	trim       string
+	budget     *budgetReport // what -size-budget did
+
+	locked   bool
+	lockFile string
+
+	chunkStore string
+	chunkIndex string
+
+	genInitCPIO string
+
+	exclude    []string
+	stripPkgDB bool
+
+	stripBinaries bool
+	stripExclude  []string
+	stripped      int   // ELF files -strip-binaries stripped
+	strippedBytes int64 // and the bytes it saved
+	presets       []string
+	normalize     []string
+
+	keepLocales []string
+	keepZones   []string
+
+	names       convert.NameLimits
+	namePolicy  string
+	backslashes string
+	plugins     []string
+	usrLayout   string
+	timestamps  string
+	rootEntry   string
+	inodes      string
+	inodeMap    string
+	dotPrefix   bool
+	dirSlash    bool
+	dirLinks    bool
+	policies    []*convert.Policy
+	specs       []*mtree.Spec
+
+	substitutes map[digest.Digest]string
+
+	genInit      string
+	initTemplate string
+	checkInit    string
+
+	dracutHooks []string
+	dracutBase  string
+
+	hostModules     string
+	hostModulesDir  string
+	hostModulesList string
+
+	pxe        string
+	kernel     string
+	cmdline    string
+	pxeClass   string
+	pxeBaseURL string
+
+	signKey     string
+	signCert    string
+	signCommand string
+
+	measure string
+
+	reportDeleted  bool
+	comparePayload string
+	scanSecrets    string
+	failOn         string
+	vulnList       string
+
+	// platforms is the -platforms list; onReport, if set, takes the report
+	// of each build instead of it being written to -report.
+	platforms string
+	onReport  func(*buildReport)
+
+	// given are the flags of the command line and the environment, which
+	// the image's hints don't override.
+	given       map[string]bool
+	ignoreHints bool
+}
+
+// convertOptions translates the flags into convert.Convert options.
+// The returned cleanup function releases temporary files and must be called
+// once the conversion is done.
+func (o *buildOptions) convertOptions() ([]convert.Option, func(), error) {
+	opts, err := o.imageOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+	if o.hostModules == "" {
+		if o.hostModulesList != "" {
+			return nil, nil, usageError("-host-modules-list requires -host-modules")
+		}
+		return opts, func() {}, nil
+	}
+	modOpts, cleanup, err := hostModuleOptions(o.hostModulesDir, o.hostModules, o.hostModulesList)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(opts, modOpts...), cleanup, nil
+}
+
+func (o *buildOptions) imageOptions() ([]convert.Option, error) {
+	var opts []convert.Option
+	if len(o.rename) > 0 {
+		opts = append(opts, convert.WithRename(o.rename...))
+	}
+	switch o.namePolicy {
+	case "fail":
+		o.names.Policy = convert.NameFail
+	case "skip":
+		o.names.Policy = convert.NameSkip
+	case "shorten":
+		o.names.Policy = convert.NameShorten
+	default:
+		return nil, usageError(fmt.Sprintf("unknown -name-policy %q", o.namePolicy))
+	}
+	o.names.Report = func(name, newName, reason string) {
+		if newName == "" {
+			log.Printf("left out %q: %s", name, reason)
+		} else {
+			log.Printf("renamed %q to %q: %s", name, newName, reason)
+		}
+	}
+	opts = append(opts, convert.WithNameLimits(o.names))
+	if o.copyBuffer != "" {
+		n, err := parseSize(o.copyBuffer)
+		if err != nil || n <= 0 || n > 1<<30 {
+			return nil, usageError(fmt.Sprintf("invalid -copy-buffer %q", o.copyBuffer))
+		}
+		opts = append(opts, convert.WithCopyBufferSize(int(n)))
+	}
+	var ts convert.Timestamps
+	for _, p := range strings.Split(o.timestamps, ",") {
+		switch p {
+		case "truncate":
+			ts.Round = false
+		case "round":
+			ts.Round = true
+		case "clamp":
+			ts.Clamp = true
+		default:
+			return nil, usageError(fmt.Sprintf("unknown -timestamps policy %q", p))
+		}
+	}
+	opts = append(opts, convert.WithTimestamps(ts))
+	backslashes := map[string]convert.BackslashPolicy{
+		"keep":  convert.BackslashKeep,
+		"slash": convert.BackslashSlash,
+		"skip":  convert.BackslashSkip,
+		"fail":  convert.BackslashFail,
+	}
+	bp, ok := backslashes[o.backslashes]
+	if !ok {
+		return nil, usageError(fmt.Sprintf("unknown -backslash-names %q", o.backslashes))
+	}
+	opts = append(opts, convert.WithBackslashes(bp, func(name, newName string) {
+		if newName == "" {
+			log.Printf("left out %q: its name has a backslash", name)
+		} else {
+			log.Printf("renamed %q to %q: backslashes taken for path separators", name, newName)
+		}
+	}))
+	var names []cpio.NameOption
+	if o.dotPrefix {
+		names = append(names, cpio.WithDotPrefix())
+	}
+	if o.dirSlash {
+		names = append(names, cpio.WithDirSlash())
+	}
+	if len(names) > 0 {
+		opts = append(opts, convert.WithNameOptions(names...))
+	}
+	if o.dirLinks {
+		opts = append(opts, convert.WithDirLinks())
+	}
+	if o.image.memoryLimit > 0 {
+		opts = append(opts, convert.WithMemoryLimit(max(o.image.memoryLimit/2, 1)))
+	}
+	if o.rootEntry == "none" {
+		opts = append(opts, convert.WithoutRootEntry())
+	} else if o.rootEntry != "" {
+		e, err := parseRootEntry(o.rootEntry)
+		if err != nil {
+			return nil, usageError("-root-entry: " + err.Error())
+		}
+		opts = append(opts, convert.WithRootEntry(e))
+	}
+	inodes, err := o.inodeAllocator()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, convert.WithInodes(inodes))
+	if inodes.WantsContent() && (o.image.verify || o.image.verifyDiffID) {
+		// The reader is busy hashing blobs too; hash files on every core.
+		opts = append(opts, convert.WithHashWorkers(runtime.GOMAXPROCS(0)))
+	}
+	switch o.usrLayout {
+	case "":
+	case "merged":
+		opts = append(opts, convert.WithUsrLayout(convert.UsrMerged))
+	case "split":
+		opts = append(opts, convert.WithUsrLayout(convert.UsrSplit))
+	default:
+		return nil, usageError(fmt.Sprintf("unknown -usr-layout %q", o.usrLayout))
+	}
+	for _, spec := range o.specs {
+		opts = append(opts, convert.WithMetadata(spec))
+	}
+	for _, p := range o.policies {
+		opts = append(opts, convert.WithPolicy(p))
+	}
+	if len(o.substitutes) > 0 {
+		opt, err := convert.WithSubstitutes(o.substitutes, func(name string, d digest.Digest, file string) {
+			log.Printf("substituted %s for %s (%s)", file, name, d)
+		})
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+	if len(o.exclude) > 0 {
+		opt, err := convert.WithExclude(o.exclude...)
+		if err != nil {
+			return nil, usageError(err.Error())
+		}
+		opts = append(opts, opt)
+	}
+	if o.stripPkgDB {
+		opt, _ := convert.WithExcludePreset(convert.PresetPkgDB)
+		opts = append(opts, opt)
+	}
+	if o.stripBinaries {
+		opt, err := convert.WithStripDebug(o.stripExclude, func(name string, before, after int64) {
+			o.stripped++
+			o.strippedBytes += before - after
+		})
+		if err != nil {
+			return nil, usageError(err.Error())
+		}
+		opts = append(opts, opt)
+	} else if len(o.stripExclude) > 0 {
+		return nil, usageError("-strip-exclude requires -strip-binaries")
+	}
+	for _, name := range o.normalize {
+		opt, err := convert.WithNormalize(name)
+		if err != nil {
+			return nil, usageError(err.Error())
+		}
+		opts = append(opts, opt)
+	}
+	locales := false
+	for _, name := range o.presets {
+		if name == convert.PresetLocales {
+			locales = true
+			opts = append(opts, convert.WithLocales(o.keepLocales, o.keepZones))
+			continue
+		}
+		opt, err := convert.WithExcludePreset(name)
+		if err != nil {
+			return nil, usageError(err.Error())
+		}
+		opts = append(opts, opt)
+	}
+	if !locales && (len(o.keepLocales) > 0 || len(o.keepZones) > 0) {
+		return nil, usageError("-keep-locale and -keep-tz require -preset locales")
+	}
+	for _, in := range o.inject {
+		content, err := os.ReadFile(in[1])
+		if err != nil {
+			return nil, fmt.Errorf("inject %s: %w", in[0], err)
+		}
+		fi, err := os.Stat(in[1])
+		if err != nil {
+			return nil, fmt.Errorf("inject %s: %w", in[0], err)
+		}
+		opts = append(opts, convert.WithEntry(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     in[0],
+			Mode:     int64(fi.Mode().Perm()),
+			ModTime:  time.Unix(0, 0),
+		}, content))
+	}
+	switch o.genInit {
+	case "":
+		if o.initTemplate != "" {
+			return nil, usageError("-init-template requires -gen-init custom")
+		}
+	case "custom":
+		if o.initTemplate == "" {
+			return nil, usageError("-gen-init custom requires -init-template")
+		}
+		tmpl, err := os.ReadFile(o.initTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("read init template: %w", err)
+		}
+		opts = append(opts, convert.WithInitTemplate(tmpl))
+	default:
+		opt, err := convert.WithInitProfile(o.genInit)
+		if err != nil {
+			return nil, usageError(err.Error())
+		}
+		opts = append(opts, opt)
+	}
+	for _, h := range o.dracutHooks {
+		opt, err := dracutHookOption(h)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+	if len(o.templates) > 0 {
+		vars := make(map[string]string, len(o.vars))
+		for _, v := range o.vars {
+			vars[v[0]] = v[1]
+		}
+		env := make(map[string]string)
+		for _, kv := range os.Environ() {
+			k, v, _ := strings.Cut(kv, "=")
+			env[k] = v
+		}
+		opts = append(opts, convert.WithTemplates(o.templates, vars, env))
+	}
+	return opts, nil
+}
+
+// archiveOptions returns the options converting the image r, of the layout
+// at layoutPath, into the content of the archive as the flags of o say:
+// those of convertOptions, the -image-release entry, and the filters of
+// -plugin, whose processes it starts. Close the plugins returned for how
+// they exited once the conversion is done; cleanup stops them otherwise.
+func (o *buildOptions) archiveOptions(layoutPath string, r *oci.Reader) ([]convert.Option, []*convert.Plugin, func(), error) {
+	opts, cleanupOpts, err := o.convertOptions()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var plugins []*convert.Plugin
+	cleanup := func() {
+		for _, p := range plugins {
+			_ = p.Close()
+		}
+		cleanupOpts()
+	}
+	if o.release != "" {
+		t, err := conversionTime()
+		if err != nil {
+			cleanup()
+			return nil, nil, nil, err
+		}
+		opts = append(opts, convert.WithEntry(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     o.release,
+			Mode:     0o644,
+			ModTime:  time.Unix(0, 0),
+		}, imageRelease(layoutPath, r, t)))
+	}
+	for _, name := range o.plugins {
+		p, err := convert.StartPlugin(name)
+		if err != nil {
+			cleanup()
+			return nil, nil, nil, err
+		}
+		plugins = append(plugins, p)
+		opts = append(opts, convert.WithPlugin(p))
+	}
+	return opts, plugins, cleanup, nil
+}
+
+// entryWriter is the subset of the CPIO writers used by build, satisfied by
+// both cpio.Writer and cpio.VolumeWriter.
+type entryWriter interface {
+	convert.Writer
+	Close() error
+}
+
+// readerOptions returns the options of the reader of the image that the
+// flags of o call for, for both the build and the trials of -size-budget.
+func (o *buildOptions) readerOptions() []oci.Option {
+	var opts []oci.Option
+	if o.keepGoing {
+		opts = append(opts, oci.WithKeepGoing())
+	}
+	if o.skipUnsupported {
+		opts = append(opts, oci.WithSkipUnsupportedLayers())
+	}
+	if len(o.plugins) == 0 {
+		// Hard links share an inode, but plugins take only copies.
+		opts = append(opts, oci.WithHardLinks())
+	}
+	return opts
+}
+
+func build(layoutPath string, o *buildOptions) error {
+	// Open OCI reader (handles layer merge + whiteouts internally)
+	readerOpts := o.readerOptions()
+	if o.comparePayload != "" && o.report == "" {
+		return usageError("-compare-payload requires -report")
+	}
+	if o.reportDeleted {
+		if o.report == "" {
+			return usageError("-report-deleted requires -report")
+		}
+		readerOpts = append(readerOpts, oci.WithDeletions())
+	}
+	ociReader, err := o.image.open(layoutPath, readerOpts...)
+	if err != nil {
+		return err
+	}
+	defer ociReader.Close()
+	if o.locked {
+		if err := checkLocked(o.lockFile, layoutPath, ociReader); err != nil {
+			return err
+		}
+	}
+	if err := o.applyHints(ociReader); err != nil {
+		return err
+	}
+	if o.sizeBudget != "" {
+		if err := o.fitBudget(layoutPath); err != nil {
+			return err
+		}
+	}
+
+	convertOpts, plugins, cleanup, err := o.archiveOptions(layoutPath, ociReader)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	scanner, err := newSecretScanner(o.scanSecrets)
+	if err != nil {
+		return err
+	}
+	if scanner != nil {
+		convertOpts = append(convertOpts, convert.WithEntryHook(scanner.hook))
+	}
+	gate, err := newVulnGate(o.vulnList)
+	if err != nil {
+		return err
+	}
+	if gate != nil {
+		convertOpts = append(convertOpts, convert.WithEntryHook(gate.hook))
+	}
+	stats, err := newEntryStats(o.failOn)
+	if err != nil {
+		return err
+	}
+	convertOpts = append(convertOpts, convert.WithEntryHook(stats.hook))
+	checker := newInitChecker(o.initPath())
+	if checker != nil {
+		convertOpts = append(convertOpts, convert.WithEntryHook(checker.hook))
+	}
+	var finder initFinder
+	if o.report != "" {
+		convertOpts = append(convertOpts, convert.WithEntryHook(finder.hook))
+	}
+	output := o.output
+	var bundle *netboot.Bundle
+	if o.pxe != "" {
+		if bundle, output, err = o.netbootBundle(); err != nil {
+			return err
+		}
+	} else if o.kernel != "" || o.cmdline != "" || o.measure != "" {
+		return usageError("-kernel, -cmdline, and -measure require -pxe")
+	}
+	signer, err := o.signer()
+	if err != nil {
+		return err
+	}
+
+	if o.report == "-" && o.chunkStore == "" && o.genInitCPIO == "" && (output == "" || output == "-") {
+		return usageError("-report - needs -o, since the archive goes to stdout")
+	}
+	comp, err := o.compress.compression()
+	if err != nil {
+		return err
+	}
+	var need int64
+	for _, l := range ociReader.Manifest().Layers {
+		need += l.Size
+	}
+	for _, p := range []string{output, o.tarOutput, o.genInitCPIO, o.chunkStore} {
+		if err := checkSpace(p, need, o.spaceMargin); err != nil {
+			return err
+		}
+	}
+	// The digest of the archive as written, before any compression,
+	// identifies builds of the same content.
+	payload := digest.Canonical.Digester()
+	var cpioWriter entryWriter
+	switch {
+	case o.genInitCPIO != "":
+		if o.output != "" || bundle != nil || o.splitSize != "" || o.chunkStore != "" || o.dracutBase != "" || comp != nil {
+			return usageError("-gen-init-cpio cannot be combined with -o, -pxe, -split-size, -chunk-store, -dracut-base, or -compress")
+		}
+		cpioWriter, err = openSpecOutput(o.genInitCPIO, payload.Hash())
+	case o.chunkStore == "":
+		if o.chunkIndex != "" {
+			return usageError("-chunk-index requires -chunk-store")
+		}
+		cpioWriter, err = openOutput(output, o.splitSize, o.force, o.dracutBase, comp, payload.Hash())
+	case o.splitSize != "" || bundle != nil || o.dracutBase != "" || comp != nil:
+		return usageError("-chunk-store cannot be combined with -split-size, -pxe, -dracut-base, or -compress")
+	default:
+		cpioWriter, err = openChunkedOutput(output, o.chunkStore, o.chunkIndex, payload.Hash())
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = cpioWriter.Close()
+	}()
+
+	var tarWriter io.Closer = closers{}
+	if o.tarOutput != "" {
+		f, err := os.Create(o.tarOutput)
+		if err != nil {
+			return outputError(fmt.Errorf("create tar output: %w", err))
+		}
+		defer f.Close()
+		tw := tar.NewWriter(&outputFile{f})
+		tarWriter = closers{tw, &outputFile{f}}
+		convertOpts = append(convertOpts, convert.WithEntryHook(convert.TarHook(tw)))
+	}
+
+	warnings := collectWarnings(ociReader)
+	if err := convert.Convert(ociReader, cpioWriter, convertOpts...); err != nil {
+		return err
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	for _, p := range plugins {
+		if err := p.Close(); err != nil {
+			return err
+		}
+	}
+	lost := <-warnings
+	logWarnings(lost)
+	if o.stripped > 0 {
+		log.Printf("stripped debug sections from %d ELF files, saving %s", o.stripped, humanSize(o.strippedBytes))
+	}
+	stats.addWarnings(lost)
+	checker.warn()
+	if err := cpioWriter.Close(); err != nil {
+		return err
+	}
+	if err := o.finishReport(ociReader, lost, stats, scanner, gate, finder.found, payload.Digest()); err != nil {
+		return err
+	}
+
+	if bundle == nil {
+		return nil
+	}
+	bundle.Initrds = []string{path.Base(output)}
+	if vw, ok := cpioWriter.(*cpio.VolumeWriter); ok {
+		bundle.Initrds = bundle.Initrds[:0]
+		for i := 0; i < vw.Volumes(); i++ {
+			bundle.Initrds = append(bundle.Initrds, fmt.Sprintf("%s.%03d", path.Base(output), i))
+		}
+	}
+	if err := bundle.Write(o.pxe, o.kernel); err != nil {
+		return err
+	}
+	dir, _ := bundle.Dir(o.pxe)
+	if signer != nil {
+		if err := efisign.SignFile(signer, filepath.Join(dir, "vmlinuz")); err != nil {
+			return err
+		}
+	}
+	if o.measure != "" {
+		return writeMeasurements(o.measure, dir, bundle)
+	}
+	return nil
+}
+
+// collectWarnings gathers the warnings of r, delivering them once r is
+// read to the end.
+func collectWarnings(r *oci.Reader) <-chan []oci.Warning {
+	done := make(chan []oci.Warning, 1)
+	go func() {
+		var all []oci.Warning
+		for w := range r.Warnings() {
+			all = append(all, w)
+		}
+		done <- all
+	}()
+	return done
+}
+
+// logWarnings logs lost xattrs and skipped sockets one by one, as they may
+// break the system booted, and only counts truncated timestamps, of which
+// an image has many.
+func logWarnings(warnings []oci.Warning) {
+	truncated := make(map[string]bool)
+	for _, w := range warnings {
+		if w.Kind == oci.WarnTruncatedTimestamp {
+			truncated[w.Name] = true
+			continue
+		}
+		log.Printf("warning: %s", w)
+	}
+	if n := len(truncated); n > 0 {
+		log.Printf("warning: fitted the modification times of %d entries to what newc holds (-report lists them)", n)
+	}
+}
+
+// writeMeasurements predicts the PCR values of booting the bundle in dir
+// and writes them to name.
+func writeMeasurements(name, dir string, bundle *netboot.Bundle) error {
+	in := &measure.Input{Cmdline: bundle.Cmdline}
+	var err error
+	if in.Kernel, err = os.ReadFile(filepath.Join(dir, "vmlinuz")); err != nil {
+		return err
+	}
+	for _, initrd := range bundle.Initrds {
+		b, err := os.ReadFile(filepath.Join(dir, initrd))
+		if err != nil {
+			return err
+		}
+		in.Initrd = append(in.Initrd, b...)
+	}
+	p, err := measure.Predict(in)
+	if err != nil {
+		return fmt.Errorf("predict measurements: %w", err)
+	}
+	b, err := p.JSON()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, b, 0o644)
+}
+
+// signer returns the Secure Boot signer selected by the -sign flags, or nil
+// if signing was not requested.
+func (o *buildOptions) signer() (efisign.Signer, error) {
+	if o.signKey == "" && o.signCert == "" && o.signCommand == "" {
+		return nil, nil
+	}
+	if o.pxe == "" {
+		return nil, usageError("signing requires -pxe, which produces the EFI kernel")
+	}
+	if o.signCommand != "" {
+		if o.signKey != "" || o.signCert != "" {
+			return nil, usageError("-sign-command and -sign-key are mutually exclusive")
+		}
+		return efisign.ParseCommand(o.signCommand)
+	}
+	if o.signKey == "" || o.signCert == "" {
+		return nil, usageError("-sign-key and -sign-cert must be used together")
+	}
+	return efisign.SBSign{Key: o.signKey, Cert: o.signCert}, nil
+}
+
+// finishReport writes the build report, if requested, and turns tolerated
+// layer failures, entries stats counted that -fail-on forbids, secrets
+// found by scanner, vulnerable packages found by gate, and layers left out
+// by -skip-unsupported-layers, if any, into the command's error. hasInit, whether the archive
+// has an /init, goes into the suggested kernel command line, and payload is
+// the digest of the archive. The report lists warnings one by one.
+func (o *buildOptions) finishReport(r *oci.Reader, warnings []oci.Warning, stats *entryStats, scanner *secretScanner, gate *vulnGate, hasInit bool, payload digest.Digest) error {
+	rep := newBuildReport(r)
+	rep.Payload = payload
+	rep.Entries = stats
+	for _, w := range warnings {
+		rep.Warnings = append(rep.Warnings, reportWarning{Kind: w.Kind.String(), Name: w.Name, Detail: w.Detail})
+	}
+	rep.Cmdline = o.suggestCmdline(r.Config(), hasInit)
+	rep.Budget = o.budget
+	if o.comparePayload != "" {
+		if err := rep.comparePayload(o.comparePayload); err != nil {
+			return err
+		}
+	}
+	if scanner != nil {
+		rep.Secrets = scanner.findings
+	}
+	gateErr := gate.check()
+	if gate != nil {
+		rep.Vulnerabilities = gate.matches
+	}
+	if o.onReport != nil {
+		o.onReport(rep)
+	} else if o.report != "" {
+		if err := rep.write(o.report); err != nil {
+			return outputError(fmt.Errorf("write report: %w", err))
+		}
+	}
+	if n := len(rep.Failures); n > 0 {
+		printFailures(os.Stderr, rep.Failures)
+		return fmt.Errorf("the output is incomplete: %d layer failure(s)", n)
+	}
+	if err := errors.Join(stats.err(), scanner.err(), gateErr); err != nil {
+		return err
+	}
+	if n := len(rep.Skipped); n > 0 {
+		printSkipped(os.Stderr, rep.Skipped)
+		return degradedError(fmt.Errorf("the output is degraded: -skip-unsupported-layers left out %d layer(s)", n))
+	}
+	return nil
+}
+
+// netbootBundle describes the bundle requested by the -pxe flags and
+// returns it together with the path its initramfs is written to.
+func (o *buildOptions) netbootBundle() (*netboot.Bundle, string, error) {
+	if o.output != "" {
+		return nil, "", usageError("-pxe and -o are mutually exclusive")
+	}
+	if o.kernel == "" {
+		return nil, "", usageError("-pxe requires -kernel")
+	}
+	b := &netboot.Bundle{Class: o.pxeClass, Cmdline: o.cmdline, BaseURL: o.pxeBaseURL}
+	dir, err := b.Dir(o.pxe)
+	if err != nil {
+		return nil, "", usageError(err.Error())
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, "", err
+	}
+	return b, filepath.Join(dir, "initrd.img"), nil
+}
+
+// openOutput creates the CPIO writer for the requested destination: stdout
+// (output "" or "-"), a single file, or a sequence of size-bounded volumes.
+// Unless force is set, it refuses to write to stdout if that is a terminal.
+// If base is set, the initramfs in that file is written first. The archive
+// itself, without base, is also written to payload.
+func openOutput(output, splitSize string, force bool, base string, comp *compression, payload io.Writer) (entryWriter, error) {
+	if splitSize != "" {
+		if output == "" || output == "-" {
+			return nil, usageError("-split-size requires -o to name the volumes")
+		}
+		if base != "" {
+			return nil, usageError("-dracut-base cannot be combined with -split-size")
+		}
+		limit, err := parseSize(splitSize)
+		if err != nil {
+			return nil, fmt.Errorf("parse -split-size: %w", err)
+		}
+		// Each volume is compressed on its own, as the kernel unpacks
+		// concatenated compressed archives; the limit is on the archive
+		// before compression.
+		return cpio.NewVolumeWriter(limit, func(index int) (io.WriteCloser, error) {
+			f, err := os.Create(fmt.Sprintf("%s.%03d", output, index))
+			if err != nil {
+				return nil, outputError(err)
+			}
+			of := &outputFile{f}
+			zw, err := comp.writer(of)
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			return struct {
+				io.Writer
+				io.Closer
+			}{io.MultiWriter(zw, payload), closers{zw, of}}, nil
+		}), nil
+	}
+
+	var f *os.File
+	var dev *deviceWriter
+	if output == "" || output == "-" {
+		if !force && isTerminal(os.Stdout) {
+			return nil, errors.New("refusing to write a binary archive to a terminal; redirect stdout, use -o, or pass -force")
+		}
+	} else if fi, err := os.Stat(output); err == nil && isBlockDevice(fi) {
+		if f, err = openDirect(output); err != nil {
+			return nil, outputError(fmt.Errorf("open output: %w", err))
+		}
+		dev = newDeviceWriter(f)
+	} else {
+		if f, err = os.Create(output); err != nil {
+			return nil, outputError(fmt.Errorf("create output: %w", err))
+		}
+	}
+	dst := outputWriter{os.Stdout}
+	switch {
+	case dev != nil:
+		dst = outputWriter{dev}
+	case f != nil:
+		dst = outputWriter{f}
+	}
+	if base != "" {
+		if err := writeBase(dst, base); err != nil {
+			closeFile(f)
+			return nil, err
+		}
+	}
+	zw, err := comp.writer(dst)
+	if err != nil {
+		closeFile(f)
+		return nil, err
+	}
+	z := io.Closer(zw)
+	if dev != nil {
+		z = closers{zw, dev}
+	}
+	return &fileWriter{Writer: cpio.NewWriter(io.MultiWriter(zw, payload)), z: z, f: f}, nil
+}
+
+// openSpecOutput creates the gen_init_cpio description of -gen-init-cpio
+// in dir, with the content of files below dir/root. The archive it
+// describes, as build would write it, goes to payload.
+func openSpecOutput(dir string, payload io.Writer) (entryWriter, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, outputError(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "initramfs.list"))
+	if err != nil {
+		return nil, outputError(fmt.Errorf("create output: %w", err))
+	}
+	sw, err := cpio.NewSpecWriter(outputWriter{f}, filepath.Join(dir, "root"))
+	if err != nil {
+		f.Close()
+		return nil, outputError(err)
+	}
+	return &specOutput{sw: sw, tw: cpio.NewWriter(payload), f: &outputFile{f}}, nil
+}
+
+// specOutput writes each entry both to a gen_init_cpio description and to
+// the archive of the payload digest.
+type specOutput struct {
+	sw *cpio.SpecWriter
+	tw *cpio.Writer
+	f  io.Closer
+}
+
+func (s *specOutput) WriteHeader(hdr *cpio.Header) error {
+	if err := s.sw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	return s.tw.WriteHeader(hdr)
+}
+
+func (s *specOutput) Write(b []byte) (int, error) {
+	if n, err := s.sw.Write(b); err != nil {
+		return n, err
+	}
+	return s.tw.Write(b)
+}
+
+func (s *specOutput) Close() error {
+	return closers{s.sw, s.tw, s.f}.Close()
+}
+
+// isTerminal reports whether f is a character device, as terminals are.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// fileWriter closes the output file after finishing the archive.
+type fileWriter struct {
+	*cpio.Writer
+	z io.Closer // finishes the compression
+	f *os.File  // nil for stdout
+}
+
+func (w *fileWriter) Close() error {
+	err := w.Writer.Close()
+	if cerr := w.z.Close(); err == nil {
+		err = cerr
+	}
+	if w.f != nil {
+		if cerr := w.f.Close(); err == nil {
+			err = outputError(cerr)
+		}
+	}
+	return err
+}
+
+// closeFile closes f, if it is not nil, after a failure.
+func closeFile(f *os.File) {
+	if f != nil {
+		f.Close()
+	}
+}
+
+// closers closes each of its closers in order, returning the first error.
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var err error
+	for _, c := range cs {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// parseRootEntry parses the mode:uid:gid of -root-entry, with the mode in
+// octal.
+func parseRootEntry(s string) (convert.RootEntry, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return convert.RootEntry{}, fmt.Errorf("want mode:uid:gid, got %q", s)
+	}
+	mode, err := strconv.ParseInt(parts[0], 8, 64)
+	if err != nil || mode&^07777 != 0 {
+		return convert.RootEntry{}, fmt.Errorf("invalid mode %q", parts[0])
+	}
+	uid, err := strconv.Atoi(parts[1])
+	if err != nil || uid < 0 {
+		return convert.RootEntry{}, fmt.Errorf("invalid uid %q", parts[1])
+	}
+	gid, err := strconv.Atoi(parts[2])
+	if err != nil || gid < 0 {
+		return convert.RootEntry{}, fmt.Errorf("invalid gid %q", parts[2])
+	}
+	return convert.RootEntry{Mode: mode, Uid: uid, Gid: gid}, nil
+}
+
+// inodeAllocator returns the allocator of -inodes and -inode-map.
+func (o *buildOptions) inodeAllocator() (cpio.InodeAllocator, error) {
+	var a cpio.InodeAllocator
+	switch o.inodes {
+	case "sequential":
+		a = cpio.SequentialInodes(1)
+	case "path-hash":
+		a = cpio.PathHashInodes()
+	case "content-hash":
+		a = cpio.ContentHashInodes()
+	default:
+		return nil, usageError(fmt.Sprintf("unknown -inodes %q", o.inodes))
+	}
+	if o.inodeMap == "" {
+		return a, nil
+	}
+	m, err := readInodeMap(o.inodeMap)
+	if err != nil {
+		return nil, fmt.Errorf("-inode-map: %w", err)
+	}
+	return cpio.InodeMap(m, a), nil
+}
+
+// readInodeMap reads lines of an inode number and a path, which may have
+// spaces, skipping blank lines and # comments.
+func readInodeMap(name string) (map[string]int, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]int)
+	byInode := make(map[int]string)
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		num, p, _ := strings.Cut(line, " ")
+		n, err := strconv.ParseUint(num, 10, 32)
+		p = strings.TrimSpace(p)
+		if err != nil || n == 0 || p == "" {
+			return nil, fmt.Errorf("line %d: want an inode number and a path, got %q", i+1, line)
+		}
+		if other, ok := byInode[int(n)]; ok {
+			return nil, fmt.Errorf("line %d: inode %d is also %s's", i+1, n, other)
+		}
+		m[p], byInode[int(n)] = int(n), p
+	}
+	return m, nil
+}
+
+// parseSize parses a byte count with an optional binary K, M, or G suffix.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("size must be positive")
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/hxtk/ember/pkg/castore"
+	"github.com/hxtk/ember/pkg/cpio"
+)
+
+// chunkedWriter writes the archive into a casync chunk store, and to a file
+// too if one is named, for -chunk-store. Closing it writes the index.
+type chunkedWriter struct {
+	*cpio.Writer
+	chunks *castore.Writer
+	f      *os.File // nil without -o
+	index  string
+}
+
+// openChunkedOutput creates the CPIO writer for -chunk-store, writing the
+// blob index to index and, unless output is empty, the archive itself to
+// output. The archive is also written to payload.
+func openChunkedOutput(output, store, index string, payload io.Writer) (entryWriter, error) {
+	if index == "" {
+		return nil, usageError("-chunk-store requires -chunk-index")
+	}
+	chunks, err := castore.NewWriter(castore.Store{Dir: store}, castore.DefaultMinSize, castore.DefaultAvgSize, castore.DefaultMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	w := &chunkedWriter{chunks: chunks, index: index}
+	var dst io.Writer = chunks
+	if output != "" && output != "-" {
+		if w.f, err = os.Create(output); err != nil {
+			return nil, outputError(fmt.Errorf("create output: %w", err))
+		}
+		dst = io.MultiWriter(w.f, chunks)
+	}
+	w.Writer = cpio.NewWriter(io.MultiWriter(outputWriter{dst}, payload))
+	return w, nil
+}
+
+func (w *chunkedWriter) Close() error {
+	if w.chunks == nil {
+		return nil // already closed
+	}
+	err := w.Writer.Close()
+	if w.f != nil {
+		if cerr := w.f.Close(); err == nil {
+			err = outputError(cerr)
+		}
+	}
+	if cerr := w.chunks.Close(); err == nil {
+		err = outputError(cerr)
+	}
+	if err == nil {
+		err = w.writeIndex()
+	}
+	w.chunks = nil
+	return err
+}
+
+func (w *chunkedWriter) writeIndex() error {
+	f, err := os.Create(w.index)
+	if err != nil {
+		return outputError(fmt.Errorf("create chunk index: %w", err))
+	}
+	err = w.chunks.WriteIndex(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return outputError(fmt.Errorf("write chunk index: %w", err))
+	}
+	total, added := w.chunks.Chunks()
+	log.Printf("stored %d chunk(s), %d new, in %s", total, added, w.index)
+	return nil
+}
@@ -0,0 +1,134 @@
+// Package cli implements the ember command line.
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// command is a single ember subcommand.
+type command struct {
+	name  string
+	args  string // synopsis of the positional arguments
+	short string // one-line description
+
+	// setFlags registers the command's flags and returns the function that
+	// runs it with the remaining positional arguments.
+	setFlags func(fs *flag.FlagSet) func(args []string) error
+}
+
+var commands = []*command{
+	buildCommand,
+	deltaCommand,
+	applyDeltaCommand,
+	estimateCommand,
+	flattenCommand,
+	mtreeCommand,
+	transcodeCommand,
+	copyCommand,
+	lockCommand,
+	cpioToTarCommand,
+	cpioVerifyCommand,
+	cpioEqualCommand,
+	cpioTestVectorsCommand,
+	layoutFsckCommand,
+	layoutGCCommand,
+	historyCommand,
+	verifyReproducibleCommand,
+	verifyDirCommand,
+	verifySignatureCommand,
+	testBootCommand,
+}
+
+// Main runs the ember command line with args (excluding the program name)
+// and returns the process exit code.
+func Main(prog string, args []string) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		usage(os.Stderr, prog)
+		return exitUsage
+	}
+	for _, c := range commands {
+		// Commands such as "layout gc" are named by several words.
+		words := strings.Fields(c.name)
+		if len(args) >= len(words) && slices.Equal(args[:len(words)], words) {
+			return Run(prog+" "+c.name, c.name, args[len(words):])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%s: unknown command %q\n", prog, args[0])
+	usage(os.Stderr, prog)
+	return exitUsage
+}
+
+// Run runs the named subcommand directly. It lets single-purpose binaries
+// such as oci2cpio share the implementation of an ember subcommand.
+func Run(prog, name string, args []string) int {
+	var c *command
+	for _, cc := range commands {
+		if cc.name == name {
+			c = cc
+		}
+	}
+	if c == nil {
+		panic("cli: no command " + name)
+	}
+
+	fs := flag.NewFlagSet(prog, flag.ContinueOnError)
+	run := c.setFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [flags] %s\n\n%s\n\n", prog, c.args, c.short)
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "\nEach flag can also be set with the environment variable %s_<FLAG>, or EMBER_<FLAG>.\n",
+			strings.TrimSuffix(envNames(c.name, "")[0], "_"))
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if err := setFromEnv(fs, c.name); err != nil {
+		fmt.Fprintf(fs.Output(), "%s: %v\n", prog, err)
+		return exitUsage
+	}
+
+	if err := run(fs.Args()); err != nil {
+		if _, ok := err.(usageError); ok {
+			fmt.Fprintf(fs.Output(), "%s: %v\n", prog, err)
+			fs.Usage()
+			return exitUsage
+		}
+		log.Printf("error: %v", err)
+		return exitCode(err)
+	}
+	return exitOK
+}
+
+func usage(w io.Writer, prog string) {
+	fmt.Fprintf(w, "usage: %s <command> [flags] [args]\n\ncommands:\n", prog)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-20s %s\n", c.name, c.short)
+	}
+	fmt.Fprintf(w, "\nexit status:\n")
+	for _, e := range exitCodes {
+		fmt.Fprintf(w, "  %d  %s\n", e.code, e.desc)
+	}
+}
+
+// usageError reports invalid arguments; Run prints the command's usage
+// after the message.
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// wantArgs returns a usageError unless args has exactly n elements.
+func wantArgs(args []string, n int) error {
+	if len(args) != n {
+		return usageError(fmt.Sprintf("expected %d argument(s), got %d", n, len(args)))
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package cli
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/hxtk/ember/pkg/convert"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// serialConsoles are the console= arguments of the first serial port of
+// the usual machines of each architecture: PCs and QEMU's virt machines.
+var serialConsoles = map[string]string{
+	"386":     "ttyS0,115200",
+	"amd64":   "ttyS0,115200",
+	"arm":     "ttyAMA0,115200",
+	"arm64":   "ttyAMA0,115200",
+	"ppc64le": "hvc0",
+	"riscv64": "ttyS0,115200",
+	"s390x":   "ttysclp0",
+}
+
+// cmdlineSuggestion is the kernel command line fragment the build report
+// suggests booting the archive with, and why.
+type cmdlineSuggestion struct {
+	Cmdline string   `json:"cmdline"`
+	Notes   []string `json:"notes,omitempty"`
+}
+
+// initFinder is a convert.EntryHook noting whether the archive has an
+// /init, which the kernel runs unless rdinit= names another.
+type initFinder struct {
+	found bool
+}
+
+func (f *initFinder) hook(hdr *tar.Header, _ io.Reader) error {
+	if path.Clean("/"+hdr.Name) == "/init" {
+		f.found = hdr.Typeflag != tar.TypeDir
+	}
+	return nil
+}
+
+// suggestCmdline suggests the root=, rdinit=, and console= arguments to
+// boot the archive with, from the init mode of the flags and the image
+// config cfg, which may be nil. hasInit reports whether the archive has
+// an /init.
+func (o *buildOptions) suggestCmdline(cfg *specs.Image, hasInit bool) *cmdlineSuggestion {
+	s := &cmdlineSuggestion{}
+	var args, initArgs []string
+	note := func(format string, a ...any) {
+		s.Notes = append(s.Notes, fmt.Sprintf(format, a...))
+	}
+
+	switch {
+	case o.genInit == convert.InitSystemd:
+		args = append(args, "root=")
+		note("the systemd profile mounts the root file system root= names and switches to it; complete root= with the device, e.g. root=LABEL=root")
+	case o.genInit == convert.InitBusybox:
+		note("the busybox profile keeps the initramfs as the root file system, so no root= is needed")
+	case o.genInit != "":
+		note("the custom /init decides which root= and other arguments it needs")
+	case o.dracutBase != "":
+		note("the dracut base archive provides /init; add the root= and rd. arguments its modules expect")
+	case hasInit:
+		note("the archive has an /init, which the kernel runs by default")
+	default:
+		var rdinit string
+		rdinit, initArgs = entrypointArgs(cfg, note)
+		if rdinit != "" {
+			args = append(args, "rdinit="+rdinit)
+		}
+	}
+
+	arch := ""
+	if cfg != nil {
+		arch = cfg.Architecture
+	}
+	if console, ok := serialConsoles[arch]; ok {
+		args = append(args, "console="+console)
+	} else {
+		note("no serial console is known for architecture %q; add console= for the port of the board", arch)
+	}
+	// The kernel passes whatever follows "--" to init as arguments.
+	if len(initArgs) > 0 {
+		args = append(append(args, "--"), initArgs...)
+	}
+	s.Cmdline = strings.Join(args, " ")
+	return s
+}
+
+// entrypointArgs returns the program of the entrypoint and command of cfg,
+// for rdinit=, and the arguments to pass it, if the kernel command line
+// can pass them.
+func entrypointArgs(cfg *specs.Image, note func(string, ...any)) (string, []string) {
+	var argv []string
+	if cfg != nil {
+		argv = append(append(argv, cfg.Config.Entrypoint...), cfg.Config.Cmd...)
+	}
+	if len(argv) == 0 {
+		note("the archive has no /init and the image config no entrypoint or command; set rdinit= to the program to run as init")
+		return "", nil
+	}
+	if !path.IsAbs(argv[0]) {
+		note("the entrypoint %q is not an absolute path, which rdinit= needs", argv[0])
+		return "", nil
+	}
+	note("the archive has no /init, so rdinit= runs the entrypoint of the image config")
+	for _, a := range argv[1:] {
+		if a == "" || strings.ContainsAny(a, " \t\n\"") {
+			note("the arguments of the entrypoint cannot all be passed on the kernel command line, which splits them at spaces; wrap it in a script")
+			return argv[0], nil
+		}
+	}
+	return argv[0], argv[1:]
+}
@@ -0,0 +1,162 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hxtk/ember/pkg/ocitest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testImage is a small image with files of every kind build handles,
+// whose files have the modification time mtime.
+func testImage(mtime time.Time) *ocitest.Image {
+	t := ocitest.ModTime(mtime)
+	return ocitest.New(ocitest.NewLayer().
+		Dir("bin", t).
+		File("bin/busybox", strings.Repeat("B", 1000), ocitest.Mode(0o755), t).
+		Hardlink("bin/sh", "bin/busybox", t).
+		Symlink("bin/ls", "busybox", t).
+		Dir("etc", t).
+		File("etc/hostname", "hostname-of-the-image", t).
+		Dir("dev", t).
+		CharDevice("dev/console", 5, 1, t))
+}
+
+// TestCommands runs the commands on a layout and the archives built from
+// it, checking that their flags take effect and that they exit with the
+// code of the outcome.
+func TestCommands(t *testing.T) {
+	tmp := t.TempDir()
+	layout := ocitest.Layout(t, testImage(time.Unix(1e9, 0)))
+	later := ocitest.Layout(t, testImage(time.Unix(2e9, 0)))
+	files := map[string]string{"layout": layout, "later": later}
+	for name, args := range map[string][]string{
+		"a.cpio":      {layout},
+		"later.cpio":  {later},
+		"noetc.cpio":  {"-exclude", "etc", layout},
+		"inodes.cpio": {"-inodes", "path-hash", layout},
+	} {
+		files[name] = filepath.Join(tmp, name)
+		if code, _ := run(t, append([]string{"build", "-o", files[name]}, args...)...); code != exitOK {
+			t.Fatalf("build -o %s %s exited %d", name, strings.Join(args, " "), code)
+		}
+	}
+	a, err := os.ReadFile(files["a.cpio"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["truncated.cpio"] = filepath.Join(tmp, "truncated.cpio")
+	if err := os.WriteFile(files["truncated.cpio"], a[:len(a)-700], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	files["file"] = files["a.cpio"]
+	files["missing"] = filepath.Join(tmp, "missing")
+	files["out"] = filepath.Join(tmp, "out")
+
+	for _, tc := range []struct {
+		args   string // with $name for files[name]
+		code   int
+		stdout string // a substring of what is printed, with runs of spaces as one
+	}{
+		{"build -o $out $layout", exitOK, ""},
+		{"build -o - -force -compress none $layout", exitOK, "hostname-of-the-image"},
+		{"build -o $out", exitUsage, ""},
+		{"build -o $out $layout $later", exitUsage, ""},
+		{"build -no-such-flag -o $out $layout", exitUsage, ""},
+		{"build -compress nonsense -o $out $layout", exitUsage, ""},
+		{"build -o $out $missing", exitNotFound, ""},
+		{"build -o $out -platform linux/s390x $layout", exitFailure, ""},
+		{"build -o $file/initrd $layout", exitOutput, ""},
+		{"build -o $out -size-budget 100 $layout", exitVerification, ""},
+
+		{"verify-reproducible $layout", exitOK, "reproducible: "},
+		{"verify-reproducible -inodes content-hash -vary-schedule $layout", exitOK, "reproducible: "},
+		{"verify-reproducible -o $out $layout", exitUsage, ""},
+		{"verify-reproducible", exitUsage, ""},
+		{"verify-reproducible $missing", exitNotFound, ""},
+		{"cpio verify $a.cpio", exitOK, "8 entries, 0 problems"},
+		{"cpio verify $truncated.cpio", exitVerification, ""},
+		{"cpio verify $a.cpio $later.cpio", exitUsage, ""},
+		{"cpio verify $missing", exitNotFound, ""},
+
+		{"cpio equal $a.cpio $a.cpio", exitOK, ""},
+		{"cpio equal $a.cpio $later.cpio", exitVerification, ""},
+		{"cpio equal -ignore-mtimes $a.cpio $later.cpio", exitOK, ""},
+		{"cpio equal $a.cpio $noetc.cpio", exitVerification, ""},
+		{"cpio equal $a.cpio $inodes.cpio", exitVerification, ""},
+		{"cpio equal -ignore-inodes $a.cpio $inodes.cpio", exitOK, ""},
+		{"cpio equal $a.cpio", exitUsage, ""},
+		{"cpio equal $a.cpio $missing", exitNotFound, ""},
+
+		{"flatten $layout $out", exitOK, "sha256:"},
+		{"flatten $layout", exitUsage, ""},
+		{"flatten $missing $out", exitNotFound, ""},
+		{"flatten $layout $file", exitOutput, ""},
+
+		{"estimate $layout", exitOK, "entries: 8"},
+		{"estimate -platform linux/amd64 $layout", exitOK, "entries: 8"},
+		{"estimate -platform linux/s390x $layout", exitFailure, ""},
+		{"estimate -memory-limit lots $layout", exitUsage, ""},
+		{"estimate $layout $later", exitUsage, ""},
+		{"estimate $missing", exitNotFound, ""},
+	} {
+		t.Run(tc.args, func(t *testing.T) {
+			files["out"] = filepath.Join(t.TempDir(), "out")
+			var args []string
+			for _, a := range strings.Fields(tc.args) {
+				if name, ok := strings.CutPrefix(a, "$"); ok {
+					dir, rest, _ := strings.Cut(name, "/")
+					a = filepath.Join(files[dir], rest)
+				}
+				args = append(args, a)
+			}
+			code, stdout := run(t, args...)
+			if code != tc.code {
+				t.Errorf("exited %d, want %d", code, tc.code)
+			}
+			if !strings.Contains(strings.Join(strings.Fields(stdout), " "), tc.stdout) {
+				t.Errorf("printed\n%s\nwant %q in it", stdout, tc.stdout)
+			}
+		})
+	}
+}
+
+// A flattened image builds the archive of the image and is listed under
+// the reference of -tag.
+func TestFlatten(t *testing.T) {
+	layout := ocitest.Layout(t, ocitest.New(
+		ocitest.NewLayer().Dir("etc").File("etc/hostname", "old").File("etc/motd", "hi"),
+		ocitest.NewLayer().File("etc/hostname", "new").Whiteout("etc/motd")))
+	flat := filepath.Join(t.TempDir(), "flat")
+	code, stdout := run(t, "flatten", "-tag", "v1", layout, flat)
+	if code != exitOK {
+		t.Fatalf("flatten exited %d", code)
+	}
+	var index specs.Index
+	readJSON(t, filepath.Join(flat, "index.json"), &index)
+	if len(index.Manifests) != 1 || index.Manifests[0].Digest.String() != strings.TrimSpace(stdout) ||
+		index.Manifests[0].Annotations[specs.AnnotationRefName] != "v1" {
+		t.Fatalf("flatten printed %s and listed %+v, want the one manifest tagged v1", stdout, index.Manifests)
+	}
+	var m specs.Manifest
+	readJSON(t, filepath.Join(flat, "blobs", "sha256", index.Manifests[0].Digest.Encoded()), &m)
+	if len(m.Layers) != 1 {
+		t.Errorf("flattened image has %d layers, want 1", len(m.Layers))
+	}
+
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.cpio"), filepath.Join(dir, "b.cpio")
+	if code, _ := run(t, "build", "-o", a, layout); code != exitOK {
+		t.Fatalf("build of the image exited %d", code)
+	}
+	if code, _ := run(t, "build", "-o", b, flat); code != exitOK {
+		t.Fatalf("build of the flattened image exited %d", code)
+	}
+	if code, _ := run(t, "cpio", "equal", a, b); code != exitOK {
+		t.Errorf("the archives of the image and the flattened image differ")
+	}
+}
@@ -0,0 +1,262 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+func init() {
+	commands = append(commands, completionCommand, manCommand)
+}
+
+var completionCommand = &command{
+	name:  "completion",
+	args:  "bash|zsh|fish",
+	short: "Print the shell completion script for ember, generated from its commands and flags.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		return func(args []string) error {
+			if err := wantArgs(args, 1); err != nil {
+				return err
+			}
+			switch args[0] {
+			case "bash":
+				return writeBashCompletion(os.Stdout)
+			case "zsh":
+				return writeZshCompletion(os.Stdout)
+			case "fish":
+				return writeFishCompletion(os.Stdout)
+			}
+			return usageError(fmt.Sprintf("unknown shell %q", args[0]))
+		}
+	},
+}
+
+// flagDoc describes a flag of a command, for completions and man pages.
+type flagDoc struct {
+	name       string
+	arg        string // name of the value, or empty for a boolean flag
+	usage      string
+	def        string // default value, if it isn't the zero value
+	repeatable bool
+}
+
+// takesFile reports whether the flag's value is a path, going by the name
+// its usage gives the value.
+func (f flagDoc) takesFile() bool {
+	switch f.arg {
+	case "path", "file", "dir", "directory", "output-dir":
+		return true
+	}
+	return false
+}
+
+// commandFlags returns the flags of c, in the order of their names.
+func commandFlags(c *command) []flagDoc {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	c.setFlags(fs)
+	var docs []flagDoc
+	fs.VisitAll(func(f *flag.Flag) {
+		arg, usage := flag.UnquoteUsage(f)
+		d := flagDoc{name: f.Name, arg: arg, usage: usage, repeatable: strings.Contains(usage, "(repeatable)")}
+		switch f.DefValue {
+		case "", "0", "false", "[]":
+		default:
+			d.def = f.DefValue
+		}
+		docs = append(docs, d)
+	})
+	return docs
+}
+
+// commandTree lists the first words of the commands, and for commands
+// named by several words, such as "layout gc", the second words that
+// follow each first word.
+func commandTree() ([]string, map[string][]string) {
+	var first []string
+	second := make(map[string][]string)
+	for _, c := range commands {
+		w := strings.Fields(c.name)
+		if !slices.Contains(first, w[0]) {
+			first = append(first, w[0])
+		}
+		if len(w) > 1 {
+			second[w[0]] = append(second[w[0]], w[1])
+		}
+	}
+	return first, second
+}
+
+func writeBashCompletion(w io.Writer) error {
+	first, second := commandTree()
+	var b strings.Builder
+	b.WriteString("# bash completion for ember\n\n_ember() {\n")
+	b.WriteString("\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	b.WriteString("\tlocal cmd=\"${COMP_WORDS[1]}\" n=1\n")
+	b.WriteString("\tcase \"$cmd\" in\n")
+	for _, w := range first {
+		if sub := second[w]; sub != nil {
+			fmt.Fprintf(&b, "\t%s)\n\t\tif ((COMP_CWORD == 2)); then\n\t\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\t\t\treturn\n\t\tfi\n", w, strings.Join(sub, " "))
+			b.WriteString("\t\tcmd=\"$cmd ${COMP_WORDS[2]}\" n=2\n\t\t;;\n")
+		}
+	}
+	b.WriteString("\tesac\n")
+	fmt.Fprintf(&b, "\tif ((COMP_CWORD == 1)); then\n\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\t\treturn\n\tfi\n", strings.Join(first, " "))
+	b.WriteString("\tlocal flags=\"\" files=\"\" values=\"\"\n\tcase \"$cmd\" in\n")
+	for _, c := range commands {
+		var flags, files, values []string
+		for _, f := range commandFlags(c) {
+			flags = append(flags, "-"+f.name)
+			switch {
+			case f.takesFile():
+				files = append(files, "-"+f.name)
+			case f.arg != "":
+				values = append(values, "-"+f.name)
+			}
+		}
+		fmt.Fprintf(&b, "\t%q)\n\t\tflags=%q files=%q values=%q\n\t\t;;\n", c.name, strings.Join(flags, " "), strings.Join(files, " "), strings.Join(values, " "))
+	}
+	b.WriteString("\t*)\n\t\treturn\n\t\t;;\n\tesac\n")
+	b.WriteString(`	if ((COMP_CWORD > n + 1)); then
+		if [[ " $files " == *" $prev "* ]]; then
+			COMPREPLY=($(compgen -f -- "$cur"))
+			return
+		elif [[ " $values " == *" $prev "* ]]; then
+			COMPREPLY=()
+			return
+		fi
+	fi
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+	else
+		COMPREPLY=($(compgen -f -- "$cur"))
+	fi
+}
+
+complete -o filenames -F _ember ember
+`)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeZshCompletion(w io.Writer) error {
+	first, second := commandTree()
+	short := make(map[string]string)
+	for _, c := range commands {
+		short[c.name] = c.short
+	}
+	describe := func(names []string, prefix string) string {
+		var items []string
+		for _, n := range names {
+			d, ok := short[strings.TrimSpace(prefix+" "+n)]
+			if !ok {
+				d = n + " commands"
+			}
+			items = append(items, zshQuote(strings.ReplaceAll(n, ":", `\:`)+":"+d))
+		}
+		return strings.Join(items, " ")
+	}
+
+	var b strings.Builder
+	b.WriteString("#compdef ember\n\n_ember() {\n\tlocal -a cmds\n\tlocal cmd\n")
+	fmt.Fprintf(&b, "\tif ((CURRENT == 2)); then\n\t\tcmds=(%s)\n\t\t_describe -t commands 'ember command' cmds\n\t\treturn\n\tfi\n", describe(first, ""))
+	b.WriteString("\tcase $words[2] in\n")
+	for _, w := range first {
+		if sub := second[w]; sub != nil {
+			fmt.Fprintf(&b, "\t%s)\n\t\tif ((CURRENT == 3)); then\n\t\t\tcmds=(%s)\n\t\t\t_describe -t commands 'ember %s command' cmds\n\t\t\treturn\n\t\tfi\n", w, describe(sub, w), w)
+			b.WriteString("\t\tcmd=\"$words[2] $words[3]\"\n\t\tshift 2 words\n\t\t((CURRENT -= 2))\n\t\t;;\n")
+		}
+	}
+	b.WriteString("\t*)\n\t\tcmd=$words[2]\n\t\tshift words\n\t\t((CURRENT--))\n\t\t;;\n\tesac\n")
+	b.WriteString("\tcase $cmd in\n")
+	for _, c := range commands {
+		var specs []string
+		for _, f := range commandFlags(c) {
+			s := "-" + f.name + "[" + zshEscape(firstSentence(f.usage)) + "]"
+			switch {
+			case f.takesFile():
+				s += ":" + zshEscape(f.arg) + ":_files"
+			case f.arg != "":
+				s += ":" + zshEscape(f.arg) + ": "
+			}
+			if f.repeatable {
+				s = "*" + s
+			}
+			specs = append(specs, zshQuote(s))
+		}
+		specs = append(specs, "'*:file:_files'")
+		fmt.Fprintf(&b, "\t%s)\n\t\t_arguments \\\n\t\t\t%s\n\t\t;;\n", zshQuote(c.name), strings.Join(specs, " \\\n\t\t\t"))
+	}
+	b.WriteString("\tesac\n}\n\nif [[ $funcstack[1] == _ember ]]; then\n\t_ember \"$@\"\nelse\n\tcompdef _ember ember\nfi\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeFishCompletion(w io.Writer) error {
+	first, second := commandTree()
+	short := make(map[string]string)
+	for _, c := range commands {
+		short[c.name] = c.short
+	}
+	var b strings.Builder
+	b.WriteString("# fish completion for ember\n\ncomplete -c ember -f -n __fish_use_subcommand\n")
+	for _, w := range first {
+		d, ok := short[w]
+		if !ok {
+			d = w + " commands"
+		}
+		fmt.Fprintf(&b, "complete -c ember -n __fish_use_subcommand -a %s -d %s\n", w, fishQuote(d))
+		if sub := second[w]; sub != nil {
+			cond := fmt.Sprintf("__fish_seen_subcommand_from %s; and not __fish_seen_subcommand_from %s", w, strings.Join(sub, " "))
+			for _, s := range sub {
+				fmt.Fprintf(&b, "complete -c ember -f -n %s -a %s -d %s\n", fishQuote(cond), s, fishQuote(short[w+" "+s]))
+			}
+		}
+	}
+	for _, c := range commands {
+		words := strings.Fields(c.name)
+		cond := "__fish_seen_subcommand_from " + words[0]
+		if len(words) > 1 {
+			cond += "; and __fish_seen_subcommand_from " + words[1]
+		}
+		b.WriteByte('\n')
+		for _, f := range commandFlags(c) {
+			opt := ""
+			switch {
+			case f.takesFile():
+				opt = " -r -F"
+			case f.arg != "":
+				opt = " -x"
+			}
+			fmt.Fprintf(&b, "complete -c ember -n %s -o %s%s -d %s\n", fishQuote(cond), f.name, opt, fishQuote(firstSentence(f.usage)))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// firstSentence returns the usage of a flag up to its first semicolon, to
+// keep completion menus short.
+func firstSentence(usage string) string {
+	s, _, _ := strings.Cut(usage, "; ")
+	return s
+}
+
+// zshQuote quotes s in single quotes for zsh.
+func zshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// zshEscape escapes the characters that end the description of an
+// _arguments option.
+func zshEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+// fishQuote quotes s in single quotes for fish.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
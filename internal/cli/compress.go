@@ -0,0 +1,190 @@
+package cli
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/hxtk/ember/pkg/lz4"
+	"github.com/hxtk/ember/pkg/xz"
+	"github.com/hxtk/ember/pkg/zstd"
+)
+
+// compressFlags select the compression of the archive.
+type compressFlags struct {
+	codec    string
+	level    int
+	zstdDict string
+	xzBCJ    string
+	xzDict   string
+	kernelXZ bool
+	lz4Frame string
+}
+
+func (f *compressFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.codec, "compress", "", "compress the archive with `codec` gzip, lz4, xz, or zstd, as the kernel's initramfs decompressors read it; with -split-size, each volume")
+	fs.IntVar(&f.level, "compress-level", 0, "with -compress, the compression `level`: gzip 1 to 9, lz4 1 to 12, xz 1 to 9, zstd 1 to 19 (default: the codec's, 6, 1, 6, and 3)")
+	fs.StringVar(&f.zstdDict, "zstd-dict", "", "with -compress zstd, compress with the dictionary `file`, as zstd --train writes it or raw content; the kernel cannot decompress such archives, boot loaders given the dictionary can")
+	fs.StringVar(&f.xzBCJ, "xz-bcj", "", "with -compress xz, filter the archive for machine code of `arch` x86 or arm64 first; smaller for archives mostly of binaries, and needs the kernel's matching CONFIG_XZ_DEC option")
+	fs.StringVar(&f.xzDict, "xz-dict", "", "with -compress xz, the LZMA2 dictionary `size` (e.g. 1M), 4K to 64M, which the kernel allocates to decompress (default: the level's, at most 8M)")
+	fs.StringVar(&f.lz4Frame, "lz4-frame", "", "with -compress lz4, the `format` legacy, of lz4 -l, which is the only one the kernel decompresses, or normal, of lz4 and boot loaders (default legacy)")
+	fs.BoolVar(&f.kernelXZ, "kernel-xz", false, "compress the archive with xz as the kernel's documentation recommends for an initramfs: a CRC32 check and a 1M dictionary (-compress xz -xz-dict 1M)")
+}
+
+// compression is the compression of the archive that -compress selects.
+type compression struct {
+	codec string
+	level int // 0 for the codec's default
+	dict  *zstd.Dict
+	xz    xz.WriterConfig
+	lz4   lz4.WriterConfig
+}
+
+// The kernel allocates the dictionary while it unpacks the initramfs, so a
+// large one can fail on small machines. The default is at most
+// defaultXZDict, as xz's levels 7 to 9 would more, and -xz-dict at most
+// maxXZDict.
+const (
+	defaultXZDict = 8 << 20
+	maxXZDict     = 64 << 20
+)
+
+// compression returns the compression the flags select, or nil for none.
+func (f *compressFlags) compression() (*compression, error) {
+	codec := f.codec
+	if f.kernelXZ {
+		if codec != "" && codec != "xz" {
+			return nil, usageError(fmt.Sprintf("-kernel-xz cannot be combined with -compress %s", codec))
+		}
+		if f.xzDict != "" {
+			return nil, usageError("-kernel-xz sets the dictionary size; leave out -xz-dict")
+		}
+		codec = "xz"
+	}
+	c := &compression{codec: codec, level: f.level}
+	switch codec {
+	case "", "none":
+		if f.level != 0 || f.zstdDict != "" || f.xzBCJ != "" || f.xzDict != "" || f.lz4Frame != "" {
+			return nil, usageError("-compress-level, -zstd-dict, -xz-bcj, -xz-dict, and -lz4-frame require -compress")
+		}
+		return nil, nil
+	case "gzip":
+		if f.level != 0 && (f.level < gzip.BestSpeed || f.level > gzip.BestCompression) {
+			return nil, usageError(fmt.Sprintf("-compress-level %d: gzip levels are %d to %d", f.level, gzip.BestSpeed, gzip.BestCompression))
+		}
+	case "lz4":
+		if f.level != 0 && (f.level < lz4.MinLevel || f.level > lz4.MaxLevel) {
+			return nil, usageError(fmt.Sprintf("-compress-level %d: lz4 levels are %d to %d", f.level, lz4.MinLevel, lz4.MaxLevel))
+		}
+		c.lz4.Level = f.level
+		switch f.lz4Frame {
+		case "", "legacy":
+			c.lz4.Frame = lz4.FrameLegacy
+		case "normal":
+			c.lz4.Frame = lz4.FrameNormal
+			log.Printf("warning: -lz4-frame normal: the kernel cannot decompress the archive, only lz4 and boot loaders that unpack it themselves")
+		default:
+			return nil, usageError(fmt.Sprintf("unknown -lz4-frame %q; want legacy or normal", f.lz4Frame))
+		}
+	case "xz":
+		if f.level != 0 && (f.level < xz.MinLevel || f.level > xz.MaxLevel) {
+			return nil, usageError(fmt.Sprintf("-compress-level %d: xz levels are %d to %d", f.level, xz.MinLevel, xz.MaxLevel))
+		}
+	case "zstd":
+		if f.level != 0 && (f.level < zstd.MinLevel || f.level > zstd.MaxLevel) {
+			return nil, usageError(fmt.Sprintf("-compress-level %d: zstd levels are %d to %d", f.level, zstd.MinLevel, zstd.MaxLevel))
+		}
+	default:
+		return nil, usageError(fmt.Sprintf("unknown -compress %q; want gzip, lz4, xz, or zstd", codec))
+	}
+	if codec != "lz4" && f.lz4Frame != "" {
+		return nil, usageError("-lz4-frame requires -compress lz4")
+	}
+	if codec != "xz" && (f.xzBCJ != "" || f.xzDict != "") {
+		return nil, usageError("-xz-bcj and -xz-dict require -compress xz")
+	}
+	if codec == "xz" {
+		if err := f.configureXZ(&c.xz); err != nil {
+			return nil, err
+		}
+	}
+	if f.zstdDict != "" {
+		if codec != "zstd" {
+			return nil, usageError("-zstd-dict requires -compress zstd")
+		}
+		b, err := os.ReadFile(f.zstdDict)
+		if err != nil {
+			return nil, err
+		}
+		if c.dict, err = zstd.ParseDict(b); err != nil {
+			return nil, fmt.Errorf("-zstd-dict: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// configureXZ sets cfg up for the kernel's decompressor, which knows no
+// check but CRC32, and the flags.
+func (f *compressFlags) configureXZ(cfg *xz.WriterConfig) error {
+	*cfg = xz.WriterConfig{Level: f.level, Check: xz.CheckCRC32, DictSize: defaultXZDict}
+	if f.level != 0 && f.level < xz.DefaultLevel {
+		cfg.DictSize = 0 // the level's, which is smaller
+	}
+	if f.kernelXZ {
+		*cfg = xz.KernelConfig
+		cfg.Level = f.level
+	}
+	switch f.xzBCJ {
+	case "":
+	case "x86":
+		cfg.BCJ = xz.BCJX86
+	case "arm64":
+		cfg.BCJ = xz.BCJARM64
+	default:
+		return usageError(fmt.Sprintf("unknown -xz-bcj %q; want x86 or arm64", f.xzBCJ))
+	}
+	if f.xzDict != "" {
+		n, err := parseSize(f.xzDict)
+		if err != nil || n < xz.MinDictSize || n > maxXZDict {
+			return usageError(fmt.Sprintf("invalid -xz-dict %q; want 4K to 64M", f.xzDict))
+		}
+		cfg.DictSize = int(n)
+	}
+	return nil
+}
+
+// writer returns a writer compressing into w, which closing finishes
+// without closing w, or w itself, with a no-op Close, if c is nil.
+func (c *compression) writer(w io.Writer) (io.WriteCloser, error) {
+	if c == nil {
+		return nopWriteCloser{w}, nil
+	}
+	switch c.codec {
+	case "gzip":
+		level := c.level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case "lz4":
+		return lz4.NewWriterConfig(w, c.lz4)
+	case "xz":
+		return xz.NewWriterConfig(w, c.xz)
+	default:
+		level := c.level
+		if level == 0 {
+			level = zstd.DefaultLevel
+		}
+		if c.dict != nil {
+			return zstd.NewWriterDict(w, level, c.dict)
+		}
+		return zstd.NewWriterLevel(w, level)
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
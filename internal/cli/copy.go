@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hxtk/ember/pkg/registry"
+	"github.com/hxtk/ember/pkg/transfer"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var copyCommand = &command{
+	name:  "copy",
+	args:  "<source> <destination>",
+	short: "Copy an image between layouts (oci:), layout archives (oci-archive:), and registries (docker://), keeping its digest.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		var reg registryFlags
+		reg.register(fs)
+		timeout := fs.Duration("timeout", 0, "give up on the whole copy after `duration` (e.g. 1h)")
+		spaceMargin := fs.Int("space-margin", defaultSpaceMargin, "before copying into a layout, check that its filesystem has room for the blobs it lacks and `percent` more, or skip the check if negative")
+		return func(args []string) error {
+			if err := wantArgs(args, 2); err != nil {
+				return err
+			}
+			c, err := reg.client(args)
+			if err != nil {
+				return err
+			}
+			src, err := transfer.OpenSource(args[0], c)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			dst, err := transfer.OpenDestination(args[1], c)
+			if err != nil {
+				return err
+			}
+			ctx := context.Background()
+			if *timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, *timeout)
+				defer cancel()
+			}
+			var desc specs.Descriptor
+			if p := transfer.LocalPath(args[1]); p != "" && *spaceMargin >= 0 {
+				var need int64
+				if need, err = transfer.Missing(ctx, dst, src); err == nil {
+					err = checkSpace(p, need, *spaceMargin)
+				}
+			}
+			if err == nil {
+				desc, err = transfer.Copy(ctx, dst, src)
+			}
+			if cerr := dst.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Println(desc.Digest)
+			return nil
+		}
+	},
+}
+
+// registryFlags configure the client of the commands that talk to
+// registries.
+type registryFlags struct {
+	plainHTTP   bool
+	authFile    string
+	login       string
+	limitRate   string
+	retries     int
+	blobTimeout time.Duration
+}
+
+func (f *registryFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.plainHTTP, "plain-http", false, "talk to registries over HTTP instead of HTTPS")
+	fs.StringVar(&f.authFile, "authfile", "", "also read registry logins from the docker config.json or podman auth.json `file`, in preference to the default ones")
+	fs.StringVar(&f.limitRate, "limit-rate", "", "fetch blobs from registries at no more than `rate` bytes per second in all (e.g. 2M), as curl --limit-rate does")
+	fs.IntVar(&f.retries, "retries", 2, "retry registry requests that fail in ways that may pass, such as network errors and 5xx responses, `n` times, with jittered exponential backoff; blob fetches resume where they broke off")
+	fs.DurationVar(&f.blobTimeout, "blob-timeout", 0, "give up on a blob that takes longer than `duration` to fetch or push from or to a registry, retries included (e.g. 10m)")
+	fs.StringVar(&f.login, "creds", "", "log in to the registries of the images named as `user:password`, in preference to any stored login")
+}
+
+// client returns a client configured by the flags, logging in to the
+// registries of the docker:// names with -creds.
+func (f *registryFlags) client(names []string) (*registry.Client, error) {
+	creds, err := registry.LoadCredentials()
+	if err == nil && f.authFile != "" {
+		err = creds.ReadAuthFile(f.authFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load registry logins: %w", err)
+	}
+	if f.login != "" {
+		user, password, ok := strings.Cut(f.login, ":")
+		if !ok {
+			return nil, usageError("-creds must be user:password")
+		}
+		for _, name := range names {
+			if s, ok := strings.CutPrefix(name, "docker://"); ok {
+				if ref, err := registry.ParseReference(s); err == nil {
+					creds[ref.Registry] = registry.Login{Username: user, Password: password}
+				}
+			}
+		}
+	}
+	if f.retries < 0 {
+		return nil, usageError("-retries must not be negative")
+	}
+	c := &registry.Client{
+		Credentials: creds,
+		PlainHTTP:   f.plainHTTP,
+		Retry:       registry.RetryPolicy{Attempts: f.retries + 1, BlobTimeout: f.blobTimeout},
+	}
+	if f.limitRate != "" {
+		rate, err := parseSize(f.limitRate)
+		if err != nil {
+			return nil, usageError(fmt.Sprintf("invalid -limit-rate %q", f.limitRate))
+		}
+		c.Limit = registry.NewLimiter(rate)
+	}
+	return c, nil
+}
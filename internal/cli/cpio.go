@@ -0,0 +1,130 @@
+package cli
+
+import (
+	"archive/tar"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/hxtk/ember/pkg/cpio"
+)
+
+var cpioToTarCommand = &command{
+	name:  "cpio to-tar",
+	args:  "[<archive.cpio>]",
+	short: "Convert a newc CPIO archive, such as an initramfs, into a tar archive.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		output := fs.String("o", "", "write the tar archive to `path`, or to stdout if - or unset")
+		force := fs.Bool("force", false, "write the archive to stdout even if it is a terminal")
+		return func(args []string) error {
+			if len(args) > 1 {
+				return usageError(fmt.Sprintf("expected at most 1 argument, got %d", len(args)))
+			}
+			in := io.Reader(os.Stdin)
+			if len(args) == 1 && args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				in = f
+			}
+
+			out := os.Stdout
+			if *output != "" && *output != "-" {
+				f, err := os.Create(*output)
+				if err != nil {
+					return outputError(fmt.Errorf("create output: %w", err))
+				}
+				defer f.Close()
+				out = f
+			} else if !*force && isTerminal(os.Stdout) {
+				return errors.New("refusing to write a binary archive to a terminal; redirect stdout, use -o, or pass -force")
+			}
+
+			tw := tar.NewWriter(outputWriter{out})
+			skipped, err := cpio.ToTar(tw, cpio.NewReader(in))
+			if err != nil {
+				return err
+			}
+			if skipped > 0 {
+				log.Printf("skipped %d sockets, which tar cannot hold", skipped)
+			}
+			if err := tw.Close(); err != nil {
+				return err
+			}
+			if out != os.Stdout {
+				return outputError(out.Close())
+			}
+			return nil
+		}
+	},
+}
+
+var cpioVerifyCommand = &command{
+	name:  "cpio verify",
+	args:  "[<archive.cpio>]",
+	short: "Check a newc CPIO archive for malformed headers, padding, names, duplicates, and inconsistent hard links.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		return func(args []string) error {
+			if len(args) > 1 {
+				return usageError(fmt.Sprintf("expected at most 1 argument, got %d", len(args)))
+			}
+			in := io.Reader(os.Stdin)
+			if len(args) == 1 && args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				in = f
+			}
+			v := cpio.Verify(in)
+			for _, p := range v.Problems {
+				fmt.Println(p)
+			}
+			fmt.Printf("%d entries, %d problems\n", v.Entries, len(v.Problems))
+			if !v.OK() {
+				return verificationError(errors.New("archive has problems"))
+			}
+			return nil
+		}
+	},
+}
+
+var cpioEqualCommand = &command{
+	name:  "cpio equal",
+	args:  "<a.cpio> <b.cpio>",
+	short: "Check that two newc CPIO archives hold the same entries, as an extractor sees them, optionally whatever their inode numbers, modification times, or order.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		var opts cpio.EqualOptions
+		fs.BoolVar(&opts.IgnoreInodes, "ignore-inodes", false, "compare which entries are hard links of each other instead of inode numbers")
+		fs.BoolVar(&opts.IgnoreModTimes, "ignore-mtimes", false, "leave out modification times")
+		fs.BoolVar(&opts.IgnoreOrder, "ignore-order", false, "compare the entries by name instead of in order")
+		return func(args []string) error {
+			if err := wantArgs(args, 2); err != nil {
+				return err
+			}
+			var in [2]io.Reader
+			for i, name := range args {
+				f, err := os.Open(name)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				in[i] = f
+			}
+			d, err := cpio.Difference(in[0], in[1], opts)
+			if err != nil {
+				return err
+			}
+			if d != "" {
+				return verificationError(fmt.Errorf("%s and %s differ: %s", args[0], args[1], d))
+			}
+			return nil
+		}
+	},
+}
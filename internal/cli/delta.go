@@ -0,0 +1,104 @@
+package cli
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hxtk/ember/pkg/delta"
+)
+
+var deltaCommand = &command{
+	name:  "delta",
+	args:  "<old-artifact> <new-artifact>",
+	short: "Compute an A/B update payload that turns one artifact into another.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		output := fs.String("o", "", "write the payload to `path` (required)")
+		manifest := fs.String("manifest", "", "write the update manifest to `path` (default <o>.json)")
+		return func(args []string) error {
+			if err := wantArgs(args, 2); err != nil {
+				return err
+			}
+			if *output == "" {
+				return usageError("-o is required")
+			}
+			if *manifest == "" {
+				*manifest = *output + ".json"
+			}
+			return writeDelta(args[0], args[1], *output, *manifest)
+		}
+	},
+}
+
+var applyDeltaCommand = &command{
+	name:  "apply-delta",
+	args:  "<old-artifact> <payload>",
+	short: "Apply an update payload made by ember delta, verifying the result.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		output := fs.String("o", "", "write the updated artifact to `path` (required)")
+		return func(args []string) error {
+			if err := wantArgs(args, 2); err != nil {
+				return err
+			}
+			if *output == "" {
+				return usageError("-o is required")
+			}
+			return applyDelta(args[0], args[1], *output)
+		}
+	},
+}
+
+func writeDelta(oldPath, newPath, output, manifest string) error {
+	old, err := os.ReadFile(oldPath)
+	if err != nil {
+		return err
+	}
+	updated, err := os.ReadFile(newPath)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := delta.Diff(&buf, old, updated); err != nil {
+		return err
+	}
+	if err := os.WriteFile(output, buf.Bytes(), 0o644); err != nil {
+		return outputError(err)
+	}
+
+	h, err := delta.ReadHeader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	m, err := delta.NewManifest(h, output)
+	if err != nil {
+		return err
+	}
+	b, err := m.JSON()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(manifest, b, 0o644); err != nil {
+		return outputError(err)
+	}
+	fmt.Fprintf(os.Stderr, "delta: %d bytes for a %d byte target (%.1f%%)\n",
+		m.Payload.Size, m.Target.Size, 100*float64(m.Payload.Size)/float64(max(m.Target.Size, 1)))
+	return nil
+}
+
+func applyDelta(oldPath, payload, output string) error {
+	old, err := os.ReadFile(oldPath)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(payload)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	if err := delta.Patch(&buf, old, f); err != nil {
+		return err
+	}
+	return outputError(os.WriteFile(output, buf.Bytes(), 0o644))
+}
@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hxtk/ember/pkg/convert"
+)
+
+// dracutHookOption parses a -dracut-hook flag, hook=file, into a
+// convert.Option. A file named NN-name.sh keeps its priority NN; others get
+// priority 50.
+func dracutHookOption(s string) (convert.Option, error) {
+	hook, file, ok := strings.Cut(s, "=")
+	if !ok || hook == "" || file == "" {
+		return nil, usageError(fmt.Sprintf("-dracut-hook: want hook=file, got %q", s))
+	}
+	script, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("dracut hook: %w", err)
+	}
+	name := strings.TrimSuffix(filepath.Base(file), ".sh")
+	priority := 50
+	if p, rest, ok := strings.Cut(name, "-"); ok && len(p) == 2 {
+		if n, err := strconv.Atoi(p); err == nil {
+			priority, name = n, rest
+		}
+	}
+	opt, err := convert.WithDracutHook(hook, priority, name, script)
+	if err != nil {
+		return nil, usageError(err.Error())
+	}
+	return opt, nil
+}
+
+// writeBase copies the initramfs in the file base to w, padded with zeros
+// to a multiple of 4 bytes, so that the archive written after it extends
+// it: the kernel unpacks concatenated archives in order, compressed or not,
+// but only recognises an uncompressed one at a 4-byte aligned offset.
+func writeBase(w io.Writer, base string) error {
+	f, err := os.Open(base)
+	if err != nil {
+		return fmt.Errorf("base initramfs: %w", err)
+	}
+	defer f.Close()
+	n, err := io.Copy(w, f)
+	if err != nil {
+		return fmt.Errorf("base initramfs: %w", err)
+	}
+	if pad := -n & 3; pad > 0 {
+		_, err = w.Write(make([]byte, pad))
+	}
+	return err
+}
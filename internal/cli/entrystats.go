@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/hxtk/ember/pkg/oci"
+)
+
+// failOnClasses are the classes of entries -fail-on can forbid.
+var failOnClasses = map[string]bool{"devices": true, "setuid": true, "sockets": true}
+
+// entryStats counts the entries build writes by type, for the report, and
+// collects those of the classes -fail-on forbids.
+type entryStats struct {
+	Types   map[string]int `json:"types"`   // as estimate names them
+	Setuid  int            `json:"setuid"`  // entries with the setuid or setgid bit
+	Sockets int            `json:"sockets"` // left out of the archive
+
+	failOn    map[string]bool
+	forbidden []string // the entries, with their class
+}
+
+// newEntryStats returns stats failing the build on the comma-separated
+// classes of -fail-on.
+func newEntryStats(failOn string) (*entryStats, error) {
+	s := &entryStats{Types: make(map[string]int), failOn: make(map[string]bool)}
+	if failOn == "" {
+		return s, nil
+	}
+	for _, c := range strings.Split(failOn, ",") {
+		if !failOnClasses[c] {
+			return nil, usageError(fmt.Sprintf("-fail-on: unknown class %q; want devices, setuid, or sockets", c))
+		}
+		s.failOn[c] = true
+	}
+	return s, nil
+}
+
+// hook is a convert.EntryHook counting every entry.
+func (s *entryStats) hook(hdr *tar.Header, _ io.Reader) error {
+	s.Types[typeName(hdr.Typeflag)]++
+	if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+		s.forbid("devices", hdr.Name)
+	}
+	if hdr.Mode&06000 != 0 {
+		s.Setuid++
+		s.forbid("setuid", hdr.Name)
+	}
+	return nil
+}
+
+// addWarnings counts the sockets the conversion left out.
+func (s *entryStats) addWarnings(warnings []oci.Warning) {
+	for _, w := range warnings {
+		if w.Kind == oci.WarnSkippedSocket {
+			s.Sockets++
+			s.forbid("sockets", w.Name)
+		}
+	}
+}
+
+func (s *entryStats) forbid(class, name string) {
+	if s.failOn[class] {
+		s.forbidden = append(s.forbidden, fmt.Sprintf("%s (%s)", name, class))
+	}
+}
+
+// err returns the error failing the build, if -fail-on forbids any of the
+// entries, logging each of them.
+func (s *entryStats) err() error {
+	if len(s.forbidden) == 0 {
+		return nil
+	}
+	for _, f := range s.forbidden {
+		log.Printf("error: %s is forbidden by -fail-on", f)
+	}
+	return verificationError(fmt.Errorf("the image has %d entries -fail-on forbids", len(s.forbidden)))
+}
@@ -0,0 +1,56 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Every flag of a command can also be set in the environment, for CI
+// systems where the command line is awkward to change: -split-size of
+// build is read from EMBER_BUILD_SPLIT_SIZE, or else EMBER_SPLIT_SIZE,
+// which sets it for every command that has it. The command line takes
+// precedence, and empty variables are ignored. A repeatable flag takes one
+// value per line of the variable.
+
+// envNames returns the variables that set the flag of command cmd, most
+// specific first.
+func envNames(cmd, flag string) []string {
+	name := func(words ...string) string {
+		s := strings.Join(append([]string{"ember"}, words...), "_")
+		return strings.ToUpper(strings.ReplaceAll(s, "-", "_"))
+	}
+	return []string{name(append(strings.Fields(cmd), flag)...), name(flag)}
+}
+
+// setFromEnv sets the flags of fs that weren't given on the command line
+// from the environment.
+func setFromEnv(fs *flag.FlagSet, cmd string) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+		for _, name := range envNames(cmd, f.Name) {
+			v := os.Getenv(name)
+			if v == "" {
+				continue
+			}
+			values := []string{v}
+			if strings.Contains(f.Usage, "(repeatable)") {
+				values = strings.FieldsFunc(v, func(r rune) bool { return r == '\n' || r == '\r' })
+			}
+			for _, v := range values {
+				if serr := fs.Set(f.Name, v); serr != nil {
+					err = usageError(fmt.Sprintf("invalid value %q for %s: %v", v, name, serr))
+					return
+				}
+			}
+			return
+		}
+	})
+	return err
+}
@@ -0,0 +1,120 @@
+package cli
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/hxtk/ember/pkg/cpio"
+	"github.com/hxtk/ember/pkg/oci"
+)
+
+var estimateCommand = &command{
+	name:  "estimate",
+	args:  "<oci-layout-path>",
+	short: "Estimate the size of the archive build would produce, reading only entry headers.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		var image imageFlags
+		image.register(fs)
+		return func(args []string) error {
+			if err := wantArgs(args, 1); err != nil {
+				return err
+			}
+			// As build opens it, so that hard links come as links,
+			// without the copy of the content that newc gives only the
+			// first name of a file.
+			r, err := image.open(args[0], oci.WithHardLinks())
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			est, err := estimate(r)
+			if err != nil {
+				return err
+			}
+			return est.print(os.Stdout)
+		}
+	},
+}
+
+// sizeEstimate summarises the merged view of an image.
+type sizeEstimate struct {
+	entries   int
+	bytes     int64 // encoded archive size
+	content   int64 // file content bytes
+	byType    map[string]int
+	layers    int
+	layerSize int64 // compressed size of all layer blobs
+}
+
+// estimate walks the headers of r, opened WithHardLinks as build opens
+// it, without copying file content. The layers
+// are still read through, and decompressed, to skip the content between
+// headers, as the Reader buffers them and so can't seek past it, but
+// nothing is written.
+//
+// The result covers the image only: files added by build flags such as
+// -inject or -gen-init are not counted.
+func estimate(r *oci.Reader) (*sizeEstimate, error) {
+	est := &sizeEstimate{byType: make(map[string]int), bytes: cpio.TrailerSize}
+	for _, l := range r.Manifest().Layers {
+		est.layers++
+		est.layerSize += l.Size
+	}
+	for hdr := range r.Entries() {
+		ch := cpio.HeaderFromTar(hdr, 0)
+		est.entries++
+		est.bytes += cpio.EncodedSize(ch)
+		if hdr.Typeflag == tar.TypeReg {
+			est.content += hdr.Size
+		}
+		est.byType[typeName(hdr.Typeflag)]++
+	}
+	if err := r.Err(); err != nil {
+		return nil, fmt.Errorf("read OCI entry: %w", err)
+	}
+	return est, nil
+}
+
+func (est *sizeEstimate) print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "layers:\t%d (%s compressed)\n", est.layers, humanSize(est.layerSize))
+	fmt.Fprintf(tw, "entries:\t%d\n", est.entries)
+	types := make([]string, 0, len(est.byType))
+	for t := range est.byType {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Fprintf(tw, "  %s:\t%d\n", t, est.byType[t])
+	}
+	fmt.Fprintf(tw, "file content:\t%s\n", humanSize(est.content))
+	fmt.Fprintf(tw, "archive size:\t%s (%d bytes, uncompressed)\n", humanSize(est.bytes), est.bytes)
+	return tw.Flush()
+}
+
+// typeName names the entry types a converted archive can hold.
+func typeName(t byte) string {
+	switch t {
+	case tar.TypeReg, tar.TypeRegA:
+		return "regular files"
+	case tar.TypeLink:
+		return "hard links"
+	case tar.TypeDir:
+		return "directories"
+	case tar.TypeSymlink:
+		return "symlinks"
+	case tar.TypeChar:
+		return "character devices"
+	case tar.TypeBlock:
+		return "block devices"
+	case tar.TypeFifo:
+		return "fifos"
+	default:
+		return fmt.Sprintf("type %q", t)
+	}
+}
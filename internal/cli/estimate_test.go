@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+// The estimate is the size of the archive build writes, to the byte, with
+// the content of a file with hard links counted once.
+func TestEstimateIsBuiltSize(t *testing.T) {
+	dir := ocitest.Layout(t, ocitest.New(ocitest.NewLayer().
+		Dir("bin").
+		File("bin/busybox", strings.Repeat("B", 1000)).
+		Hardlink("bin/sh", "bin/busybox").
+		Hardlink("bin/ls", "bin/busybox").
+		Symlink("bin/cat", "busybox").
+		Dir("etc").
+		File("etc/hostname", "host")))
+	out := filepath.Join(t.TempDir(), "initrd.cpio")
+	if code, _ := run(t, "build", "-o", out, dir); code != exitOK {
+		t.Fatalf("build exited %d", code)
+	}
+	fi, err := os.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, stdout := run(t, "estimate", dir)
+	if code != exitOK {
+		t.Fatalf("estimate exited %d", code)
+	}
+	var lines []string
+	for _, l := range strings.Split(stdout, "\n") {
+		lines = append(lines, strings.Join(strings.Fields(l), " "))
+	}
+	for _, want := range []string{
+		"entries: 7",
+		"hard links: 2",
+		"regular files: 2",
+		fmt.Sprintf("archive size: %s (%d bytes, uncompressed)", humanSize(fi.Size()), fi.Size()),
+	} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("estimate printed\n%s\nwant the line %q", stdout, want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// An exclude list is a file of -exclude globs, one per line. Blank lines
+// and everything from a # to the end of the line are ignored, and
+// surrounding spaces are trimmed, so a literal #, or a space at either end
+// of a path, is escaped with a backslash, as are the glob metacharacters.
+
+// readExcludeList reads the globs of the exclude list in file.
+func readExcludeList(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var patterns []string
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(cutComment(s.Text()))
+		if line == "" {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: pattern %q: %w", file, n, line, err)
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, s.Err()
+}
+
+// cutComment returns line up to its first # that isn't escaped.
+func cutComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// writeExcludeList writes patterns to w as an exclude list, after a
+// comment header.
+func writeExcludeList(w io.Writer, header string, patterns []string) error {
+	bw := bufio.NewWriter(w)
+	for _, line := range strings.Split(header, "\n") {
+		fmt.Fprintf(bw, "# %s\n", line)
+	}
+	for _, p := range patterns {
+		fmt.Fprintln(bw, p)
+	}
+	return bw.Flush()
+}
+
+// quotePath returns the glob that matches exactly the image path p.
+func quotePath(p string) string {
+	var b strings.Builder
+	for i, c := range p {
+		switch {
+		case strings.ContainsRune(`*?[]\#`, c),
+			(c == ' ' || c == '\t') && (i == 0 || i == len(p)-1):
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
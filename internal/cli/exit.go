@@ -0,0 +1,115 @@
+package cli
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/delta"
+	"github.com/hxtk/ember/pkg/oci"
+	"github.com/hxtk/ember/pkg/qemuboot"
+	"github.com/hxtk/ember/pkg/registry"
+)
+
+// Exit codes of ember commands. They are part of the interface: scripts
+// branch on them, so a code must keep its meaning once released.
+const (
+	exitOK             = 0
+	exitFailure        = 1 // any failure without a more specific code
+	exitUsage          = 2
+	exitNotFound       = 3
+	exitUnsupported    = 4
+	exitDigestMismatch = 5
+	exitOutput         = 6
+	exitVerification   = 7
+	exitDegraded       = 8
+)
+
+// exitCodes documents the exit codes, for usage and the man page.
+var exitCodes = []struct {
+	code int
+	desc string
+}{
+	{exitOK, "success"},
+	{exitFailure, "any other failure"},
+	{exitUsage, "invalid flags or arguments"},
+	{exitNotFound, "an input, such as a layout, blob, file, or registry image, does not exist"},
+	{exitUnsupported, "an input is of an unsupported media type or format"},
+	{exitDigestMismatch, "content does not match its digest"},
+	{exitOutput, "writing an output failed"},
+	{exitVerification, "a check the command was asked to make failed, such as verify-reproducible, cpio verify, cpio equal, layout fsck, -scan-secrets fail, -vuln-list, -size-budget, a -policy fail rule, or test-boot"},
+	{exitDegraded, "the output was written, but lacks parts of the input left out on request, such as the layers of build -skip-unsupported-layers"},
+}
+
+// exitError gives an error an exit code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// outputError marks err as a failure to write an output.
+func outputError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{exitOutput, err}
+}
+
+// verificationError marks err as a failed check.
+func verificationError(err error) error {
+	return &exitError{exitVerification, err}
+}
+
+// degradedError marks err as an output written without parts of the input.
+func degradedError(err error) error {
+	return &exitError{exitDegraded, err}
+}
+
+// unsupportedError marks err as an input of an unsupported format.
+func unsupportedError(err error) error {
+	return &exitError{exitUnsupported, err}
+}
+
+// exitCode returns the exit code for the error a command failed with.
+func exitCode(err error) int {
+	var e *exitError
+	switch {
+	case errors.As(err, &e):
+		return e.code
+	case errors.Is(err, convert.ErrPolicy), errors.Is(err, qemuboot.ErrFailed):
+		return exitVerification
+	case errors.Is(err, oci.ErrDigestMismatch), errors.Is(err, registry.ErrDigestMismatch),
+		errors.Is(err, delta.ErrSourceMismatch), errors.Is(err, delta.ErrTargetMismatch):
+		return exitDigestMismatch
+	case errors.Is(err, oci.ErrUnsupportedMediaType):
+		return exitUnsupported
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, registry.ErrNotFound):
+		return exitNotFound
+	}
+	return exitFailure
+}
+
+// outputWriter marks the errors of writing to w as output failures, so
+// that they aren't mistaken for failures to read the input.
+type outputWriter struct {
+	w io.Writer
+}
+
+func (o outputWriter) Write(b []byte) (int, error) {
+	n, err := o.w.Write(b)
+	return n, outputError(err)
+}
+
+// outputFile is an outputWriter for a file that also marks the error of
+// closing it.
+type outputFile struct {
+	f *os.File
+}
+
+func (o *outputFile) Write(b []byte) (int, error) { return outputWriter{o.f}.Write(b) }
+func (o *outputFile) Close() error                { return outputError(o.f.Close()) }
@@ -0,0 +1,51 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+
+	"github.com/hxtk/ember/pkg/oci"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var flattenCommand = &command{
+	name:  "flatten",
+	args:  "<oci-layout-path> <output-layout-path>",
+	short: "Write the merged filesystem of an image as a single-layer image into a layout.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		var image imageFlags
+		image.register(fs)
+		tag := fs.String("tag", "", "list the flattened image under reference `name` instead of the source's")
+		return func(args []string) error {
+			if err := wantArgs(args, 2); err != nil {
+				return err
+			}
+			r, err := image.open(args[0])
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			w, err := oci.CreateLayout(args[1])
+			if err != nil {
+				return outputError(fmt.Errorf("create output layout: %w", err))
+			}
+			desc, err := oci.Flatten(r, w)
+			if err != nil {
+				return err
+			}
+			if *tag != "" {
+				desc.Annotations = maps.Clone(desc.Annotations)
+				if desc.Annotations == nil {
+					desc.Annotations = make(map[string]string)
+				}
+				desc.Annotations[specs.AnnotationRefName] = *tag
+			}
+			if err := w.AddManifest(desc); err != nil {
+				return err
+			}
+			fmt.Println(desc.Digest)
+			return nil
+		}
+	},
+}
@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/hxtk/ember/pkg/oci"
+)
+
+// An image can suggest the build flags it is best converted with in
+// annotations of its manifest, or of its descriptor in the index, named
+// ember.<flag>: ember.compression=zstd, or ember.exclude with one glob per
+// line, as a repeatable flag takes them from the environment. The command
+// line and the environment take precedence, and -ignore-hints leaves the
+// annotations alone.
+
+// hintPrefix starts the names of the annotations that suggest flags.
+const hintPrefix = "ember."
+
+// hintFlags are the flags an image can suggest: those that shape the
+// archive. Flags that name local files or programs, or where the archive
+// goes, are left to whoever runs the build.
+var hintFlags = map[string]bool{
+	"backslash-names": true,
+	"compress":        true,
+	"compress-level":  true,
+	"dir-slash":       true,
+	"dot-prefix":      true,
+	"exclude":         true,
+	"inodes":          true,
+	"keep-locale":     true,
+	"keep-tz":         true,
+	"kernel-xz":       true,
+	"lz4-frame":       true,
+	"max-depth":       true,
+	"max-name":        true,
+	"max-path":        true,
+	"name-policy":     true,
+	"normalize":       true,
+	"preset":          true,
+	"rename":          true,
+	"root-entry":      true,
+	"strip-binaries":  true,
+	"strip-exclude":   true,
+	"strip-pkgdb":     true,
+	"timestamps":      true,
+	"usr-layout":      true,
+	"xz-bcj":          true,
+	"xz-dict":         true,
+}
+
+// hintAliases are other names of flags that read better as annotations.
+var hintAliases = map[string]string{
+	"compression": "compress",
+}
+
+// applyHints sets the flags that r's annotations suggest and that weren't
+// given, logging each.
+func (o *buildOptions) applyHints(r *oci.Reader) error {
+	if o.ignoreHints {
+		return nil
+	}
+	annotations := maps.Clone(r.Descriptor().Annotations)
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	maps.Copy(annotations, r.Manifest().Annotations)
+
+	// A second set of the flags, bound to o as it is now.
+	saved := *o
+	fs := flag.NewFlagSet("hints", flag.ContinueOnError)
+	o.register(fs)
+	*o = saved
+
+	for _, key := range slices.Sorted(maps.Keys(annotations)) {
+		name, ok := strings.CutPrefix(key, hintPrefix)
+		if !ok {
+			continue
+		}
+		if alias, ok := hintAliases[name]; ok {
+			name = alias
+		}
+		if !hintFlags[name] {
+			log.Printf("warning: ignoring the image's %s annotation: -%s is not a flag images can suggest", key, name)
+			continue
+		}
+		if o.given[name] {
+			continue
+		}
+		v := annotations[key]
+		values := []string{v}
+		if strings.Contains(fs.Lookup(name).Usage, "(repeatable") {
+			values = strings.FieldsFunc(v, func(r rune) bool { return r == '\n' || r == '\r' })
+		}
+		for _, v := range values {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("invalid value %q for -%s in the image's %s annotation: %v", v, name, key, err)
+			}
+		}
+		log.Printf("using -%s %q from the image's %s annotation", name, v, key)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var historyCommand = &command{
+	name:  "history",
+	args:  "<oci-layout-path>",
+	short: "Show the build history of an image alongside its layers.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		var image imageFlags
+		image.register(fs)
+		noTrunc := fs.Bool("no-trunc", false, "don't truncate digests and commands")
+		return func(args []string) error {
+			if err := wantArgs(args, 1); err != nil {
+				return err
+			}
+			r, err := image.open(args[0])
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			var history []specs.History
+			if c := r.Config(); c != nil {
+				history = c.History
+			}
+			return printHistory(os.Stdout, history, r.Manifest().Layers, *noTrunc)
+		}
+	},
+}
+
+// printHistory prints history entries newest first, like docker history.
+// Entries that created a filesystem diff are paired with the manifest
+// layers in order; empty-layer entries show no layer. Layers without a
+// matching history entry are still listed.
+func printHistory(w io.Writer, history []specs.History, layers []specs.Descriptor, noTrunc bool) error {
+	type row struct {
+		layer   *specs.Descriptor
+		history *specs.History
+	}
+	var rows []row
+	next := 0
+	for i := range history {
+		h := &history[i]
+		if h.EmptyLayer {
+			rows = append(rows, row{history: h})
+			continue
+		}
+		var l *specs.Descriptor
+		if next < len(layers) {
+			l = &layers[next]
+			next++
+		}
+		rows = append(rows, row{layer: l, history: h})
+	}
+	for ; next < len(layers); next++ {
+		rows = append(rows, row{layer: &layers[next]})
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tCREATED\tCREATED BY\tSIZE\tCOMMENT")
+	for i := len(rows) - 1; i >= 0; i-- {
+		r := rows[i]
+		layer, size := "<empty>", "0B"
+		if r.layer != nil {
+			layer = r.layer.Digest.String()
+			if !noTrunc {
+				layer = r.layer.Digest.Encoded()[:12]
+			}
+			size = humanSize(r.layer.Size)
+		}
+		created, createdBy, comment := "<missing>", "<missing>", ""
+		if h := r.history; h != nil {
+			if h.Created != nil {
+				created = h.Created.UTC().Format(time.RFC3339)
+			}
+			createdBy = strings.Join(strings.Fields(h.CreatedBy), " ")
+			if r := []rune(createdBy); !noTrunc && len(r) > 45 {
+				createdBy = string(r[:44]) + "…"
+			}
+			comment = h.Comment
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", layer, created, createdBy, size, comment)
+	}
+	return tw.Flush()
+}
+
+// humanSize formats n bytes with a decimal unit, as container tools do.
+func humanSize(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.3g%cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
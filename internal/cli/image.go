@@ -0,0 +1,183 @@
+package cli
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/hxtk/ember/pkg/oci"
+	"github.com/hxtk/ember/pkg/transfer"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// imageFlags selects which image of a layout a command operates on.
+type imageFlags struct {
+	artifactType string
+	labels       labelFlag
+	platform     *specs.Platform
+	mmap         bool
+	readAhead    int
+	verify       bool
+	verifyDiffID bool
+	overlayDir   string
+	typeChanges  bool
+	memoryLimit  int64
+
+	archives map[string]*transfer.Archive // opened by open
+}
+
+func (f *imageFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.artifactType, "artifact-type", "", "use the first manifest of artifact `type` instead of the first image")
+	fs.Var(&f.labels, "select-label", "use the first image whose config has the label `key=value` (repeatable)")
+	fs.Func("platform", "use the first image for the `platform` os/architecture[/variant], e.g. linux/arm64, as its index descriptor or config gives it", func(s string) error {
+		p, err := oci.ParsePlatform(s)
+		f.platform = &p
+		return err
+	})
+	fs.BoolVar(&f.mmap, "mmap", false, "memory-map layer blobs instead of reading them, to lower memory use on huge layers")
+	fs.BoolVar(&f.verify, "verify", false, "check layer blobs against their descriptor digests while reading")
+	fs.BoolVar(&f.verifyDiffID, "verify-diff-ids", false, "check decompressed layers against the diff IDs in the image config while reading")
+	fs.Func("memory-limit", "keep what grows with the number of files while merging layers, and converting them, within about `size` bytes (e.g. 16M), half for each, spilling the rest to temporary files", func(s string) error {
+		n, err := parseSize(s)
+		f.memoryLimit = n
+		return err
+	})
+	fs.StringVar(&f.overlayDir, "overlay-dir", "", "put the files of the local `directory` on top of the image as one more layer, honouring .wh. whiteout files")
+	fs.BoolVar(&f.typeChanges, "overlay-type-changes", false, "merge layers like overlayfs when a path changes type: a non-directory replaces a lower directory and everything below it")
+	fs.IntVar(&f.readAhead, "read-ahead", 0, "keep `n` 1 MiB reads of each layer blob in flight ahead of decompression, for slow or high-latency storage")
+}
+
+// options translates the flags into oci.Open options.
+func (f *imageFlags) options() []oci.Option {
+	var opts []oci.Option
+	if f.artifactType != "" {
+		opts = append(opts, oci.WithArtifactType(f.artifactType))
+	}
+	for _, l := range f.labels {
+		opts = append(opts, oci.WithLabel(l[0], l[1]))
+	}
+	if f.platform != nil {
+		opts = append(opts, oci.WithPlatform(*f.platform))
+	}
+	if f.mmap {
+		opts = append(opts, oci.WithMmap())
+	}
+	if f.verifyDiffID {
+		opts = append(opts, oci.WithDiffIDVerify())
+	}
+	if f.verify {
+		opts = append(opts, oci.WithVerify())
+	}
+	if f.typeChanges {
+		opts = append(opts, oci.WithTypeChangeReplacement())
+	}
+	if f.memoryLimit > 0 {
+		opts = append(opts, oci.WithMemoryLimit(max(f.memoryLimit/2, 1))) // the other half converts
+	}
+	if f.readAhead > 0 {
+		opts = append(opts, oci.WithReadAhead(f.readAhead))
+	}
+	return opts
+}
+
+// open opens the selected image of the layout at layoutPath, a directory
+// or a tar archive of one, with extra options on top of those set by the
+// flags.
+func (f *imageFlags) open(layoutPath string, extra ...oci.Option) (*oci.Reader, error) {
+	archive, err := checkLayoutPath(layoutPath)
+	if err != nil {
+		return nil, err
+	}
+	opts := append(f.options(), extra...)
+	var r *oci.Reader
+	if archive {
+		var a *transfer.Archive
+		if a, err = f.archive(layoutPath); err != nil {
+			return nil, err
+		}
+		r, err = oci.OpenFS(a, opts...)
+	} else {
+		r, err = oci.Open(layoutPath, opts...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open OCI layout: %w", err)
+	}
+	if f.overlayDir != "" {
+		if fi, err := os.Stat(f.overlayDir); err != nil || !fi.IsDir() {
+			r.Close()
+			return nil, fmt.Errorf("-overlay-dir %s is not a directory", f.overlayDir)
+		}
+		return oci.Overlay(r, os.DirFS(f.overlayDir))
+	}
+	return r, nil
+}
+
+// archive returns the opened layout archive file. An archive is opened,
+// and decompressed, once however often the command opens its image; it
+// stays open while the command runs, since the readers of it share it.
+func (f *imageFlags) archive(file string) (*transfer.Archive, error) {
+	if a := f.archives[file]; a != nil {
+		return a, nil
+	}
+	a, err := transfer.OpenArchive(file)
+	if err != nil {
+		return nil, fmt.Errorf("open OCI layout: %w", err)
+	}
+	if f.archives == nil {
+		f.archives = make(map[string]*transfer.Archive)
+	}
+	f.archives[file] = a
+	return a, nil
+}
+
+// checkLayoutPath reports whether name is a tar archive of a layout,
+// compressed with gzip or zstd or not, rather than a layout directory. It
+// catches the common mistake of passing another kind of file, such as an
+// xz-compressed archive or a cpio archive, and says what to do instead.
+func checkLayoutPath(name string) (archive bool, err error) {
+	fi, err := os.Stat(name)
+	if err != nil || fi.IsDir() {
+		return false, nil // let oci.Open report it
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return false, nil
+	}
+	defer f.Close()
+	var head [512]byte
+	n, _ := io.ReadFull(f, head[:])
+	switch b := head[:n]; {
+	case bytes.HasPrefix(b, []byte{0x1f, 0x8b}), bytes.HasPrefix(b, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return true, nil
+	case len(b) >= 262 && string(b[257:262]) == "ustar":
+		return true, nil
+	case bytes.HasPrefix(b, []byte{0xfd, '7', 'z', 'X', 'Z', 0}):
+		return false, unsupportedError(fmt.Errorf("%s is an xz-compressed archive, which ember can't read a layout from; decompress it first, e.g. xz -d %s", name, name))
+	case bytes.HasPrefix(b, []byte("070701")):
+		return false, unsupportedError(fmt.Errorf("%s is a cpio archive, not an OCI layout; to read its entries as a tar archive, convert it with ember cpio to-tar", name))
+	}
+	return false, unsupportedError(fmt.Errorf("%s is a file, not an OCI layout directory", name))
+}
+
+// labelFlag collects repeated key=value flags.
+type labelFlag [][2]string
+
+func (f *labelFlag) String() string {
+	var parts []string
+	for _, l := range *f {
+		parts = append(parts, l[0]+"="+l[1])
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *labelFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("want key=value, got %q", s)
+	}
+	*f = append(*f, [2]string{k, v})
+	return nil
+}
@@ -0,0 +1,96 @@
+package cli
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hxtk/ember/pkg/oci"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// imageRelease returns the content of the file -image-release writes into
+// the archive: shell variable assignments, in the format of os-release, of
+// the image read from the layout at layoutPath, its manifest digest and
+// platform, its annotations, and when it was converted, so that a running
+// system can say which image it booted from.
+func imageRelease(layoutPath string, r *oci.Reader, converted time.Time) []byte {
+	desc := r.Descriptor()
+	name := layoutPath
+	if ref := desc.Annotations[specs.AnnotationRefName]; ref != "" {
+		name += ":" + ref
+	}
+	var b strings.Builder
+	b.WriteString("# The image this archive was built from, written by ember build -image-release.\n")
+	assign := func(k, v string) {
+		fmt.Fprintf(&b, "%s=%s\n", k, shellQuote(v))
+	}
+	assign("IMAGE_NAME", name)
+	assign("IMAGE_DIGEST", desc.Digest.String())
+	if c := r.Config(); c != nil && c.OS != "" {
+		assign("IMAGE_PLATFORM", oci.PlatformString(c.Platform))
+	}
+	assign("IMAGE_CONVERTED", converted.UTC().Format(time.RFC3339))
+
+	// The manifest's annotations, such as org.opencontainers.image.created
+	// and .revision, take precedence over those of its descriptor.
+	annotations := make(map[string]string)
+	maps.Copy(annotations, desc.Annotations)
+	maps.Copy(annotations, r.Manifest().Annotations)
+	delete(annotations, specs.AnnotationRefName) // in IMAGE_NAME
+	for _, k := range slices.Sorted(maps.Keys(annotations)) {
+		assign("IMAGE_ANNOTATION_"+variableName(k), annotations[k])
+	}
+	return []byte(b.String())
+}
+
+// conversionTime returns the time to record a conversion at: that of
+// SOURCE_DATE_EPOCH, as reproducible builds set it, or now.
+func conversionTime() (time.Time, error) {
+	s := os.Getenv("SOURCE_DATE_EPOCH")
+	if s == "" {
+		return time.Now(), nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q", s)
+	}
+	return time.Unix(n, 0), nil
+}
+
+// variableName spells an annotation key as a shell variable name: upper
+// case, with _ for what else it has.
+func variableName(k string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, k)
+}
+
+// shellQuote quotes s in double quotes, as os-release values are, escaping
+// what the shell would otherwise expand.
+func shellQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\', '$', '`':
+			b.WriteByte('\\')
+		case '\n':
+			b.WriteString(`\n`)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"archive/tar"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/hxtk/ember/pkg/elfdeps"
+)
+
+// initChecker records the entries build writes to check, once they are
+// all written, that the init the kernel runs has the interpreter and
+// shared libraries it needs, for -gen-init and -check-init.
+type initChecker struct {
+	path string
+	tree *elfdeps.Tree
+}
+
+// newInitChecker returns a checker for the init at path, or nil if path is
+// empty.
+func newInitChecker(path string) *initChecker {
+	if path == "" {
+		return nil
+	}
+	return &initChecker{path: path, tree: elfdeps.NewTree()}
+}
+
+// initPath returns the path of the init to check: that of -check-init, or
+// with -gen-init the one the kernel runs, rdinit= of -cmdline or /init.
+func (o *buildOptions) initPath() string {
+	if o.checkInit != "" || o.genInit == "" {
+		return o.checkInit
+	}
+	for _, arg := range strings.Fields(o.cmdline) {
+		if p, ok := strings.CutPrefix(arg, "rdinit="); ok {
+			return p
+		}
+	}
+	return "/init"
+}
+
+// hook is a convert.EntryHook recording every entry.
+func (c *initChecker) hook(hdr *tar.Header, content io.Reader) error {
+	return c.tree.Add(hdr, content)
+}
+
+// warn logs what the init needs that the archive lacks.
+func (c *initChecker) warn() {
+	if c == nil {
+		return
+	}
+	missing, err := c.tree.Check(c.path)
+	if err != nil {
+		log.Printf("warning: init %v; the kernel will fail to start it", err)
+		return
+	}
+	for _, m := range missing {
+		log.Printf("warning: init %s: %s; the kernel will fail to start it", c.path, m)
+	}
+}
@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/hxtk/ember/pkg/oci"
+)
+
+var layoutFsckCommand = &command{
+	name:  "layout fsck",
+	args:  "<oci-layout-path>",
+	short: "Check a layout for missing, damaged, and unreferenced blobs.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		digests := fs.Bool("digests", false, "also check every blob against its digest, reading the whole layout")
+		return func(args []string) error {
+			if err := wantArgs(args, 1); err != nil {
+				return err
+			}
+			r, err := oci.CheckLayout(args[0], *digests)
+			if err != nil {
+				return err
+			}
+			for _, d := range r.Missing {
+				fmt.Printf("missing %s (%s)\n", d.Digest, d.MediaType)
+			}
+			for _, e := range r.Corrupt {
+				fmt.Printf("corrupt %v\n", e)
+			}
+			var garbage int64
+			for _, b := range r.Unreferenced {
+				fmt.Printf("unreferenced %s (%d bytes)\n", b.Digest, b.Size)
+				garbage += b.Size
+			}
+			for _, p := range r.Temporary {
+				fmt.Printf("temporary %s\n", p)
+			}
+			fmt.Printf("%d blobs referenced, %d missing, %d corrupt, %d unreferenced (%d bytes), %d temporary files\n",
+				r.Referenced, len(r.Missing), len(r.Corrupt), len(r.Unreferenced), garbage, len(r.Temporary))
+			if !r.OK() {
+				return verificationError(fmt.Errorf("layout %s is damaged", args[0]))
+			}
+			return nil
+		}
+	},
+}
+
+var layoutGCCommand = &command{
+	name:  "layout gc",
+	args:  "<oci-layout-path>",
+	short: "Remove the blobs of a layout that no manifest in its index references.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		dryRun := fs.Bool("n", false, "only list what would be removed")
+		return func(args []string) error {
+			if err := wantArgs(args, 1); err != nil {
+				return err
+			}
+			r, err := oci.GCLayout(args[0], *dryRun)
+			if err != nil {
+				return err
+			}
+			verb := "removed"
+			if *dryRun {
+				verb = "would remove"
+			}
+			var freed int64
+			for _, b := range r.Unreferenced {
+				fmt.Printf("%s %s (%d bytes)\n", verb, b.Digest, b.Size)
+				freed += b.Size
+			}
+			for _, p := range r.Temporary {
+				fmt.Printf("%s %s\n", verb, p)
+			}
+			fmt.Printf("%s %d blobs (%d bytes) and %d temporary files\n", verb, len(r.Unreferenced), freed, len(r.Temporary))
+			return nil
+		}
+	},
+}
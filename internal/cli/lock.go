@@ -0,0 +1,203 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hxtk/ember/pkg/oci"
+	"github.com/hxtk/ember/pkg/registry"
+	"github.com/hxtk/ember/pkg/transfer"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// defaultLockFile is where ember lock writes, and build -locked reads,
+// unless told otherwise.
+const defaultLockFile = "ember.lock"
+
+// lockFile pins image names, as ember copy takes them, to the digests of
+// their manifests or indexes.
+type lockFile struct {
+	LockVersion int           `json:"lockVersion"`
+	Images      []lockedImage `json:"images"`
+}
+
+// lockedImage is an image name and what it resolved to.
+type lockedImage struct {
+	Name      string        `json:"name"`
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType,omitempty"`
+	Size      int64         `json:"size,omitempty"`
+}
+
+// readLockFile reads and checks a lock file.
+func readLockFile(name string) (*lockFile, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var lf lockFile
+	if err := json.Unmarshal(b, &lf); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if lf.LockVersion != 1 {
+		return nil, unsupportedError(fmt.Errorf("%s: unsupported lockVersion %d", name, lf.LockVersion))
+	}
+	for _, img := range lf.Images {
+		if err := img.Digest.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", name, img.Name, err)
+		}
+	}
+	return &lf, nil
+}
+
+var lockCommand = &command{
+	name:  "lock",
+	args:  "[<image>...]",
+	short: "Resolve image names, including registry tags, to the digests they name now, and pin them in a lock file for build -locked.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		var reg registryFlags
+		reg.register(fs)
+		file := fs.String("lock-file", defaultLockFile, "the lock `file` to update, or to check")
+		check := fs.Bool("check", false, "instead of updating the lock file, check that its images, or those named, still resolve to the digests it pins, and fail listing those that drifted")
+		return func(args []string) error {
+			lf, err := readLockFile(*file)
+			switch {
+			case errors.Is(err, os.ErrNotExist) && !*check:
+				lf = &lockFile{LockVersion: 1}
+			case err != nil:
+				return err
+			}
+			names := args
+			if len(names) == 0 {
+				for _, img := range lf.Images {
+					names = append(names, img.Name)
+				}
+				if len(names) == 0 {
+					return usageError("name the images to lock")
+				}
+			}
+			c, err := reg.client(names)
+			if err != nil {
+				return err
+			}
+
+			pinned := make(map[string]lockedImage)
+			for _, img := range lf.Images {
+				pinned[img.Name] = img
+			}
+			var drifted []string
+			for _, name := range names {
+				img, err := resolveImage(c, name)
+				if err != nil {
+					return err
+				}
+				old, ok := pinned[name]
+				switch {
+				case *check && !ok:
+					drifted = append(drifted, fmt.Sprintf("%s: not in %s", name, *file))
+				case *check && old.Digest != img.Digest:
+					drifted = append(drifted, fmt.Sprintf("%s: pinned to %s, now %s", name, old.Digest, img.Digest))
+				case !*check && ok && old.Digest != img.Digest:
+					fmt.Printf("%s: %s -> %s\n", name, old.Digest, img.Digest)
+				case !*check && !ok:
+					fmt.Printf("%s: %s\n", name, img.Digest)
+				}
+				pinned[name] = img
+			}
+			if *check {
+				if len(drifted) > 0 {
+					return verificationError(fmt.Errorf("%d of %d images drifted from %s:\n  %s", len(drifted), len(names), *file, strings.Join(drifted, "\n  ")))
+				}
+				return nil
+			}
+
+			lf.Images = lf.Images[:0]
+			for _, img := range pinned {
+				lf.Images = append(lf.Images, img)
+			}
+			sort.Slice(lf.Images, func(i, j int) bool { return lf.Images[i].Name < lf.Images[j].Name })
+			return outputError(writeJSON(*file, lf))
+		}
+	},
+}
+
+// resolveImage returns what the image called name is now.
+func resolveImage(c *registry.Client, name string) (lockedImage, error) {
+	src, err := transfer.OpenSource(name, c)
+	if err != nil {
+		return lockedImage{}, err
+	}
+	defer src.Close()
+	_, desc, err := src.Root(context.Background())
+	if err != nil {
+		return lockedImage{}, fmt.Errorf("resolve %s: %w", name, err)
+	}
+	return lockedImage{Name: name, Digest: desc.Digest, MediaType: desc.MediaType, Size: desc.Size}, nil
+}
+
+// checkLocked fails unless the image r reads from the layout at
+// layoutPath is one the lock file pins for that layout: an image whose
+// name is the layout, given as a path or as oci:<path>[:<ref>], or an
+// image of an index it pins.
+func checkLocked(file, layoutPath string, r *oci.Reader) error {
+	lf, err := readLockFile(file)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Clean(layoutPath)
+	var pins []digest.Digest
+	for _, img := range lf.Images {
+		if !strings.Contains(img.Name, "://") && !strings.HasPrefix(img.Name, "oci-archive:") &&
+			filepath.Clean(transfer.LocalPath(img.Name)) == dir {
+			pins = append(pins, img.Digest)
+		}
+	}
+	if len(pins) == 0 {
+		return verificationError(fmt.Errorf("%s pins no image of %s; run ember lock %s", file, layoutPath, layoutPath))
+	}
+	got := r.Descriptor().Digest
+	for _, d := range pins {
+		if ok, err := reaches(dir, d, got); err != nil || ok {
+			return err
+		}
+	}
+	return verificationError(fmt.Errorf("%s: the image is %s, which %s doesn't pin (it pins %s); the image changed since it was locked, or run ember lock to pin it", layoutPath, got, file, pins[0]))
+}
+
+// reaches reports whether the manifest want is root, or listed by the
+// index root, in the layout dir.
+func reaches(dir string, root, want digest.Digest) (bool, error) {
+	if root == want {
+		return true, nil
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "blobs", root.Algorithm().String(), root.Encoded()))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if root.Algorithm().Available() && root.Algorithm().FromBytes(b) != root {
+		return false, fmt.Errorf("%s: index %s: %w", dir, root, oci.ErrDigestMismatch)
+	}
+	var idx specs.Index
+	if json.Unmarshal(b, &idx) != nil {
+		return false, nil
+	}
+	for _, m := range idx.Manifests {
+		if registry.IsManifest(m.MediaType) {
+			if ok, err := reaches(dir, m.Digest, want); err != nil || ok {
+				return ok, err
+			}
+		}
+	}
+	return false, nil
+}
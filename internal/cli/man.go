@@ -0,0 +1,117 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var manCommand = &command{
+	name:  "man",
+	args:  "<output-dir>",
+	short: "Write man pages for ember and each of its commands, generated from their flags, into a directory.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		section := fs.String("section", "1", "the manual `section` of the pages")
+		return func(args []string) error {
+			if err := wantArgs(args, 1); err != nil {
+				return err
+			}
+			return writeManPages(args[0], *section)
+		}
+	},
+}
+
+// manName returns the name of the page for the command c, as git names
+// its pages: "ember-layout-gc" for "layout gc".
+func manName(c *command) string {
+	return "ember-" + strings.Join(strings.Fields(c.name), "-")
+}
+
+// writeManPages writes ember.<section> and a page per command into dir.
+// The pages carry no date, so that they are reproducible.
+func writeManPages(dir, section string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	var all []string
+	for _, c := range commands {
+		all = append(all, manName(c))
+	}
+
+	var b strings.Builder
+	manHeader(&b, "ember", section)
+	b.WriteString(".SH NAME\nember \\- build initramfs archives from OCI images\n")
+	b.WriteString(".SH SYNOPSIS\n.B ember\n.I command\n[\\fIflags\\fR] [\\fIargs\\fR]\n")
+	b.WriteString(".SH DESCRIPTION\nEmber builds and inspects initramfs archives from OCI images.\n")
+	b.WriteString("Run\n.B ember \\fIcommand\\fP \\-h\nfor the flags of a command, or see its page.\n")
+	b.WriteString(".SH COMMANDS\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, ".TP\n.B %s\n%s\n", roffEscape(c.name), roffEscape(c.short))
+	}
+	b.WriteString(".SH EXIT STATUS\n")
+	for _, e := range exitCodes {
+		fmt.Fprintf(&b, ".TP\n.B %d\n%s\n", e.code, roffEscape(e.desc))
+	}
+	b.WriteString(".SH ENVIRONMENT\n")
+	b.WriteString("Every flag of a command can also be set with an environment variable, for CI systems where the command line is awkward to change:\n")
+	b.WriteString(".B \\-split\\-size\nof\n.B build\nis read from\n.BR EMBER_BUILD_SPLIT_SIZE ,\nor else from\n.BR EMBER_SPLIT_SIZE ,\nwhich sets it for every command that has it.\n")
+	b.WriteString("The command line takes precedence, and empty variables are ignored.\nA repeatable flag takes one value per line of the variable.\n")
+	manSeeAlso(&b, all, section)
+	if err := os.WriteFile(filepath.Join(dir, "ember."+section), []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+
+	for _, c := range commands {
+		name := manName(c)
+		b.Reset()
+		manHeader(&b, name, section)
+		fmt.Fprintf(&b, ".SH NAME\n%s \\- %s\n", roffEscape(name), roffEscape(strings.TrimSuffix(c.short, ".")))
+		fmt.Fprintf(&b, ".SH SYNOPSIS\n.B ember %s\n[\\fIflags\\fR] %s\n", roffEscape(c.name), roffEscape(c.args))
+		fmt.Fprintf(&b, ".SH DESCRIPTION\n%s\n", roffEscape(c.short))
+		if flags := commandFlags(c); len(flags) > 0 {
+			b.WriteString(".SH OPTIONS\n")
+			for _, f := range flags {
+				if f.arg == "" {
+					fmt.Fprintf(&b, ".TP\n.B \\-%s\n", roffEscape(f.name))
+				} else {
+					fmt.Fprintf(&b, ".TP\n.BI \\-%s \" %s\"\n", roffEscape(f.name), roffEscape(f.arg))
+				}
+				b.WriteString(roffEscape(f.usage))
+				if f.def != "" {
+					fmt.Fprintf(&b, " (default: %s)", roffEscape(f.def))
+				}
+				b.WriteByte('\n')
+			}
+			fmt.Fprintf(&b, ".SH ENVIRONMENT\nEach option can also be set with the variable\n.BI %s_ OPTION\nor\n.BI EMBER_ OPTION\n(the name in upper case, with _ for \\-), as\n.BR ember (%s)\ndescribes.\n",
+				roffEscape(strings.TrimSuffix(envNames(c.name, "")[0], "_")), section)
+		}
+		manSeeAlso(&b, []string{"ember"}, section)
+		if err := os.WriteFile(filepath.Join(dir, name+"."+section), []byte(b.String()), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func manHeader(b *strings.Builder, name, section string) {
+	fmt.Fprintf(b, ".TH %s %s \"\" \"ember\" \"Ember Manual\"\n", strings.ToUpper(roffEscape(name)), section)
+}
+
+func manSeeAlso(b *strings.Builder, pages []string, section string) {
+	b.WriteString(".SH SEE ALSO\n")
+	for i, p := range pages {
+		sep := ","
+		if i == len(pages)-1 {
+			sep = ""
+		}
+		fmt.Fprintf(b, ".BR %s (%s)%s\n", roffEscape(p), section, sep)
+	}
+}
+
+// roffEscape escapes s for use as text in a roff line that doesn't start
+// with it.
+func roffEscape(s string) string {
+	return strings.NewReplacer(`\`, `\e`, "-", `\-`, "\n", " ").Replace(s)
+}
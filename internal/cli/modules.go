@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/modules"
+)
+
+// hostModuleOptions injects the host's module tree dir/kver at
+// lib/modules/<kver>. If listFile is set, the tree is pruned to the modules
+// it names (one per line, # comments allowed) plus their dependencies. The
+// returned cleanup function must be called once the conversion is done.
+func hostModuleOptions(dir, kver, listFile string) ([]convert.Option, func(), error) {
+	root := filepath.Join(dir, kver)
+	cleanup := func() {}
+	if listFile != "" {
+		names, err := readModuleList(listFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		if root, cleanup, err = modules.Prune(root, names); err != nil {
+			return nil, nil, fmt.Errorf("prune modules: %w", err)
+		}
+	}
+
+	files, err := modules.Collect(root)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("collect modules: %w", err)
+	}
+	opts := make([]convert.Option, 0, len(files))
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:    path.Join("lib/modules", kver, f.Path),
+			Mode:    int64(f.Info.Mode().Perm()),
+			ModTime: time.Unix(0, 0),
+		}
+		switch {
+		case f.Info.IsDir():
+			hdr.Typeflag = tar.TypeDir
+		case f.Info.Mode()&fs.ModeSymlink != 0:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = f.Link
+		case f.Info.Mode().IsRegular():
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = f.Info.Size()
+		default:
+			continue
+		}
+		src := f.Source
+		opts = append(opts, convert.WithEntryFrom(hdr, func() (io.ReadCloser, error) {
+			return os.Open(src)
+		}))
+	}
+	return opts, cleanup, nil
+}
+
+func readModuleList(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var names []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			names = append(names, line)
+		}
+	}
+	return names, s.Err()
+}
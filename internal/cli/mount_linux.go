@@ -0,0 +1,59 @@
+//go:build linux && fuse
+
+package cli
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/hxtk/ember/internal/fuse"
+	"github.com/hxtk/ember/pkg/oci"
+)
+
+func init() {
+	commands = append(commands, mountCommand)
+}
+
+var mountCommand = &command{
+	name:  "mount",
+	args:  "<oci-layout-path> <mountpoint>",
+	short: "Mount the merged filesystem of an image read-only via FUSE, until interrupted.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		var image imageFlags
+		image.register(fs)
+		allowOther := fs.Bool("allow-other", false, "let other users access the mount (needs user_allow_other in /etc/fuse.conf when not root)")
+		return func(args []string) error {
+			if err := wantArgs(args, 2); err != nil {
+				return err
+			}
+			r, err := image.open(args[0])
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			fsys, err := oci.NewFS(r)
+			if err != nil {
+				return err
+			}
+			defer fsys.Close()
+
+			srv, err := fuse.Mount(args[1], fsys, fuse.Options{Name: args[0], AllowOther: *allowOther})
+			if err != nil {
+				return err
+			}
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-sig
+				if err := srv.Unmount(); err != nil {
+					log.Printf("unmount %s: %v", args[1], err)
+				}
+			}()
+			log.Printf("mounted %s on %s; interrupt to unmount", args[0], args[1])
+			return srv.Serve()
+		}
+	},
+}
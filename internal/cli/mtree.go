@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hxtk/ember/pkg/mtree"
+	"github.com/hxtk/ember/pkg/oci"
+)
+
+var mtreeCommand = &command{
+	name:  "mtree",
+	args:  "<oci-layout-path>",
+	short: "Write an mtree(8) specification of the merged filesystem of an image, with types, modes, owners, sha256 digests, link targets, and link counts.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		var image imageFlags
+		image.register(fs)
+		output := fs.String("o", "", "write the specification to `path`, or to stdout if - or unset")
+		return func(args []string) error {
+			if err := wantArgs(args, 1); err != nil {
+				return err
+			}
+			r, err := image.open(args[0], oci.WithHardLinks())
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			out := os.Stdout
+			if *output != "" && *output != "-" {
+				f, err := os.Create(*output)
+				if err != nil {
+					return outputError(fmt.Errorf("create output: %w", err))
+				}
+				defer f.Close()
+				out = f
+			}
+
+			mw := mtree.NewWriter(out)
+			for hdr, content := range r.Entries() {
+				if err := mw.WriteEntry(hdr, content); err != nil {
+					return err
+				}
+			}
+			if err := r.Err(); err != nil {
+				return fmt.Errorf("read OCI entry: %w", err)
+			}
+			if err := mw.Close(); err != nil {
+				return outputError(err)
+			}
+			if out != os.Stdout {
+				return outputError(out.Close())
+			}
+			return nil
+		}
+	},
+}
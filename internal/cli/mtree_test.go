@@ -0,0 +1,30 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+// The names of a hard-linked file are one inode in the specification, not
+// independent files.
+func TestMtreeHardLinks(t *testing.T) {
+	dir := ocitest.Layout(t, ocitest.New(ocitest.NewLayer().
+		Dir("bin").
+		File("bin/busybox", "BB").
+		Hardlink("bin/sh", "bin/busybox")))
+	code, stdout := run(t, "mtree", dir)
+	if code != exitOK {
+		t.Fatalf("mtree exited %d", code)
+	}
+	keywords := make(map[string]string)
+	for _, l := range strings.Split(stdout, "\n") {
+		if p, kw, ok := strings.Cut(l, " "); ok {
+			keywords[p] = kw
+		}
+	}
+	if kw := keywords["./bin/sh"]; kw != keywords["./bin/busybox"] || !strings.Contains(kw, " nlink=2 ") {
+		t.Errorf("mtree wrote\n%s\nwant bin/sh and bin/busybox with the same keywords and nlink=2", stdout)
+	}
+}
@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/hxtk/ember/pkg/oci"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// platformsReport is the JSON document build writes with -report and
+// -platforms.
+type platformsReport struct {
+	Platforms []platformReport `json:"platforms"`
+}
+
+// platformReport is the report of the build for one platform.
+type platformReport struct {
+	Platform string `json:"platform"`
+	Output   string `json:"output"`
+	Error    string `json:"error,omitempty"` // if the build failed
+	*buildReport
+}
+
+// buildPlatforms builds an archive for each platform of -platforms, one
+// after the other, going on past those that fail.
+func buildPlatforms(layoutPath string, o *buildOptions) error {
+	switch {
+	case o.image.platform != nil:
+		return usageError("-platform and -platforms are mutually exclusive")
+	case o.output == "" || o.output == "-":
+		return usageError("-platforms requires -o, since each platform gets an archive of its own")
+	case o.pxe != "":
+		return usageError("-platforms cannot be combined with -pxe")
+	}
+	var platforms []specs.Platform
+	for _, s := range strings.Split(o.platforms, ",") {
+		p, err := oci.ParsePlatform(strings.TrimSpace(s))
+		if err != nil {
+			return usageError("-platforms: " + err.Error())
+		}
+		platforms = append(platforms, p)
+	}
+
+	var all platformsReport
+	var errs []error
+	for _, p := range platforms {
+		po := *o
+		po.image.platform = &p
+		po.output = platformOutput(o.output, p)
+		if o.chunkIndex != "" {
+			po.chunkIndex = platformOutput(o.chunkIndex, p)
+		}
+		if o.tarOutput != "" {
+			po.tarOutput = platformOutput(o.tarOutput, p)
+		}
+		rep := platformReport{Platform: oci.PlatformString(p), Output: po.output}
+		po.onReport = func(r *buildReport) { rep.buildReport = r }
+		err := build(layoutPath, &po)
+		var usage usageError
+		if errors.As(err, &usage) {
+			return err
+		}
+		if err != nil {
+			rep.Error = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %w", rep.Platform, err))
+		}
+		all.Platforms = append(all.Platforms, rep)
+	}
+	if o.report != "" {
+		if err := writeJSON(o.report, all); err != nil {
+			return outputError(fmt.Errorf("write report: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// platformOutput names the output name for platform p: name with the
+// platform, as in initrd-linux-arm64.cpio, put before its extension.
+func platformOutput(name string, p specs.Platform) string {
+	suffix := "-" + strings.ReplaceAll(oci.PlatformString(p), "/", "-")
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + suffix + ext
+}
@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hxtk/ember/pkg/oci"
+	"github.com/hxtk/ember/pkg/secrets"
+	"github.com/hxtk/ember/pkg/vuln"
+	"github.com/opencontainers/go-digest"
+)
+
+// buildReport is the JSON document build writes with -report.
+type buildReport struct {
+	Manifest string              `json:"manifest"` // digest of the converted manifest
+	Payload  digest.Digest       `json:"payload"`  // of the archive before compression, without -dracut-base
+	Layers   []oci.LayerProgress `json:"layers"`   // media type, bytes, entries, and time per layer
+	Entries  *entryStats         `json:"entries"`  // counts by type
+	Failures []oci.LayerFailure  `json:"failures,omitempty"`
+	Skipped  []oci.SkippedLayer  `json:"skipped,omitempty"` // with -skip-unsupported-layers
+	Deleted  []oci.Deletion      `json:"deleted,omitempty"` // with -report-deleted
+	Secrets  []secrets.Finding   `json:"secrets,omitempty"` // with -scan-secrets
+
+	Vulnerabilities []vuln.Match `json:"vulnerabilities,omitempty"` // with -vuln-list
+
+	// Warnings are what the archive lost of the image's entries, such as
+	// xattrs and the parts of timestamps newc can't hold.
+	Warnings []reportWarning `json:"warnings,omitempty"`
+
+	// Cmdline is the kernel command line the archive is likely to boot with.
+	Cmdline *cmdlineSuggestion `json:"cmdline,omitempty"`
+
+	// Previous is the payload comparison of -compare-payload.
+	Previous *payloadComparison `json:"previous,omitempty"`
+
+	// Budget is what -size-budget trimmed to fit the archive.
+	Budget *budgetReport `json:"budget,omitempty"`
+}
+
+func newBuildReport(r *oci.Reader) *buildReport {
+	return &buildReport{
+		Manifest: r.Descriptor().Digest.String(),
+		Layers:   r.LayerProgress(),
+		Failures: r.Failures(),
+		Skipped:  r.Skipped(),
+		Deleted:  r.Deletions(),
+	}
+}
+
+// reportWarning is an oci.Warning in a build report.
+type reportWarning struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// payloadComparison tells whether an archive holds the same bytes as that
+// of an earlier build, so that builds differing only in compression can be
+// told apart from those differing in content.
+type payloadComparison struct {
+	Report    string        `json:"report"`
+	Payload   digest.Digest `json:"payload"`
+	Identical bool          `json:"identical"`
+}
+
+// comparePayload compares the payload of rep with that of the build report
+// in the file name.
+func (rep *buildReport) comparePayload(name string) error {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("-compare-payload: %w", err)
+	}
+	var prev struct {
+		Payload digest.Digest `json:"payload"`
+	}
+	if err := json.Unmarshal(b, &prev); err != nil {
+		return fmt.Errorf("-compare-payload: parse %s: %w", name, err)
+	}
+	if prev.Payload == "" {
+		return fmt.Errorf("-compare-payload: %s records no payload digest", name)
+	}
+	if err := prev.Payload.Validate(); err != nil {
+		return fmt.Errorf("-compare-payload: %s: %w", name, err)
+	}
+	rep.Previous = &payloadComparison{Report: name, Payload: prev.Payload, Identical: prev.Payload == rep.Payload}
+	return nil
+}
+
+// write writes the report to name, or to stdout if name is "-".
+func (rep *buildReport) write(name string) error {
+	return writeJSON(name, rep)
+}
+
+// writeJSON writes v as indented JSON to name, or to stdout if name is "-".
+func writeJSON(name string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if name == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(name, b, 0o644)
+}
+
+// printFailures summarises layer failures for humans.
+func printFailures(w io.Writer, failures []oci.LayerFailure) {
+	for _, f := range failures {
+		fmt.Fprintf(w, "layer %d (%s) failed after %d entries", f.Index, f.Digest, f.Entries)
+		if f.Entry != "" {
+			fmt.Fprintf(w, ", truncating %s", f.Entry)
+		}
+		fmt.Fprintf(w, ": %s\n", f.Error)
+	}
+}
+
+// printSkipped lists the layers -skip-unsupported-layers left out, loudly:
+// the archive may boot, but not as the image would.
+func printSkipped(w io.Writer, skipped []oci.SkippedLayer) {
+	fmt.Fprintf(w, "WARNING: the archive lacks %d layer(s) of the image, and whatever they add, change, or delete:\n", len(skipped))
+	for _, s := range skipped {
+		fmt.Fprintf(w, "  layer %d (%s): unsupported media type %s\n", s.Index, s.Digest, s.MediaType)
+	}
+}
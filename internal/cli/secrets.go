@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/hxtk/ember/pkg/secrets"
+)
+
+// secretScanner looks for secrets in the files build writes, for
+// -scan-secrets.
+type secretScanner struct {
+	fail     bool // fail the build instead of warning
+	matchers []secrets.Matcher
+	findings []secrets.Finding
+}
+
+// newSecretScanner returns a scanner for the -scan-secrets mode, or nil if
+// scanning is off.
+func newSecretScanner(mode string) (*secretScanner, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case "warn", "fail":
+		return &secretScanner{fail: mode == "fail", matchers: secrets.Builtin()}, nil
+	}
+	return nil, usageError(fmt.Sprintf("-scan-secrets must be warn or fail, not %q", mode))
+}
+
+// hook is a convert.EntryHook scanning regular files.
+func (s *secretScanner) hook(hdr *tar.Header, content io.Reader) error {
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	found, err := secrets.Scan(hdr.Name, content, s.matchers)
+	if err != nil {
+		return err
+	}
+	for _, f := range found {
+		log.Printf("warning: %s: likely secret (%s)", f.Path, f.Rule)
+	}
+	s.findings = append(s.findings, found...)
+	return nil
+}
+
+// err returns the error failing the build, if secrets were found and the
+// scanner is set to fail.
+func (s *secretScanner) err() error {
+	if s == nil || !s.fail || len(s.findings) == 0 {
+		return nil
+	}
+	return verificationError(fmt.Errorf("the archive contains %d likely secret(s)", len(s.findings)))
+}
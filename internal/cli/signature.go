@@ -0,0 +1,346 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/hxtk/ember/pkg/cosign"
+	"github.com/hxtk/ember/pkg/registry"
+	"github.com/hxtk/ember/pkg/transfer"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// trust is what to trust signatures by, as the signature flags or an
+// authority of a policy give it: files to read keys and roots from.
+type trust struct {
+	keys        []string
+	trustedRoot string
+	fulcioRoots string
+	rekorKeys   []string
+	rekorURL    string
+	identities  []cosign.Identity
+}
+
+// verifier reads the files t names into a verifier.
+func (t *trust) verifier() (*cosign.Verifier, error) {
+	v := &cosign.Verifier{Identities: t.identities}
+	for _, name := range t.keys {
+		k, err := readPublicKey(name)
+		if err != nil {
+			return nil, err
+		}
+		v.Keys = append(v.Keys, k)
+	}
+	if t.trustedRoot != "" {
+		b, err := os.ReadFile(t.trustedRoot)
+		if err != nil {
+			return nil, err
+		}
+		tr, err := cosign.ParseTrustedRoot(b)
+		if err != nil {
+			return nil, err
+		}
+		v.Roots, v.Intermediates, v.RekorKeys = tr.Roots, tr.Intermediates, tr.RekorKeys
+	}
+	if t.fulcioRoots != "" {
+		var err error
+		if v.Roots, v.Intermediates, err = readCertPools(t.fulcioRoots); err != nil {
+			return nil, err
+		}
+	}
+	if len(t.rekorKeys) > 0 {
+		v.RekorKeys = nil
+		for _, name := range t.rekorKeys {
+			k, err := readPublicKey(name)
+			if err != nil {
+				return nil, err
+			}
+			v.RekorKeys = append(v.RekorKeys, k)
+		}
+	}
+	if t.rekorURL != "" {
+		v.Rekor = &cosign.Rekor{URL: t.rekorURL}
+	}
+	return v, nil
+}
+
+// signatureFlags say which signatures of an image to trust.
+type signatureFlags struct {
+	trust
+	identity, identityRegexp string
+	issuer, issuerRegexp     string
+
+	policy string
+}
+
+func (f *signatureFlags) register(fs *flag.FlagSet) {
+	fs.Func("key", "trust signatures made with the PEM public key in `file`, as cosign generate-key-pair writes cosign.pub (repeatable)", func(s string) error {
+		f.keys = append(f.keys, s)
+		return nil
+	})
+	fs.StringVar(&f.trustedRoot, "trusted-root", "", "trust the Fulcio certificate authorities and Rekor logs of the Sigstore trusted root `file`, trusted_root.json, for keyless signatures")
+	fs.StringVar(&f.fulcioRoots, "fulcio-roots", "", "trust keyless signing certificates that chain to the PEM certificates in `file`, roots and intermediates, in place of those of -trusted-root")
+	fs.Func("rekor-key", "trust the Rekor log whose PEM public key is in `file`, in place of those of -trusted-root (repeatable)", func(s string) error {
+		f.rekorKeys = append(f.rekorKeys, s)
+		return nil
+	})
+	fs.StringVar(&f.rekorURL, "rekor-url", "", "also check the inclusion proofs of the signatures' entries, fetched from the Rekor log at `URL`, e.g. https://rekor.sigstore.dev")
+	fs.StringVar(&f.identity, "certificate-identity", "", "trust keyless signatures whose certificate was issued for the email or URI `identity`")
+	fs.StringVar(&f.identityRegexp, "certificate-identity-regexp", "", "trust keyless signatures whose certificate was issued for an email or URI matching `regexp`")
+	fs.StringVar(&f.issuer, "certificate-oidc-issuer", "", "with -certificate-identity or -certificate-identity-regexp, the OIDC `issuer` the identity must be of, e.g. https://token.actions.githubusercontent.com")
+	fs.StringVar(&f.issuerRegexp, "certificate-oidc-issuer-regexp", "", "with -certificate-identity or -certificate-identity-regexp, a `regexp` the OIDC issuer of the identity must match, in place of -certificate-oidc-issuer")
+	fs.StringVar(&f.policy, "policy", "", "instead of the other signature flags, require the signatures that the policies of the JSON `file` set for where the image comes from")
+}
+
+// given reports whether any flag but -policy is set.
+func (f *signatureFlags) given() bool {
+	return len(f.keys) > 0 || f.trustedRoot != "" || f.fulcioRoots != "" || len(f.rekorKeys) > 0 || f.rekorURL != "" ||
+		f.identity != "" || f.identityRegexp != "" || f.issuer != "" || f.issuerRegexp != ""
+}
+
+// verifier returns the verifier the flags describe.
+func (f *signatureFlags) verifier() (*cosign.Verifier, error) {
+	id, err := newIdentity(f.identity, f.identityRegexp, f.issuer, f.issuerRegexp)
+	if err != nil {
+		return nil, err
+	}
+	if id != nil {
+		f.identities = []cosign.Identity{*id}
+	}
+	v, err := f.trust.verifier()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(v.Keys) == 0 && id == nil:
+		return nil, usageError("give -key, or -certificate-identity or -certificate-identity-regexp for keyless signatures")
+	case id != nil && v.Roots == nil:
+		return nil, usageError("keyless signatures need -trusted-root or -fulcio-roots")
+	case id != nil && len(v.RekorKeys) == 0:
+		return nil, usageError("keyless signatures need -trusted-root or -rekor-key")
+	}
+	return v, nil
+}
+
+// newIdentity returns the identity of a subject and issuer given exactly
+// or by regexp, or nil if neither subject is given. A subject needs an
+// issuer, as any OIDC provider Fulcio trusts can vouch for an email address
+// or URI.
+func newIdentity(subject, subjectRegexp, issuer, issuerRegexp string) (*cosign.Identity, error) {
+	if subject == "" && subjectRegexp == "" {
+		if issuer != "" || issuerRegexp != "" {
+			return nil, usageError("an OIDC issuer constrains a certificate identity, which is not given")
+		}
+		return nil, nil
+	}
+	if issuer == "" && issuerRegexp == "" {
+		return nil, usageError("a certificate identity needs -certificate-oidc-issuer or -certificate-oidc-issuer-regexp, or any OIDC issuer could vouch for it")
+	}
+	id := &cosign.Identity{Subject: subject, Issuer: issuer}
+	var err error
+	if subjectRegexp != "" {
+		if id.SubjectRegexp, err = regexp.Compile(subjectRegexp); err != nil {
+			return nil, usageError(fmt.Sprintf("identity regexp: %v", err))
+		}
+	}
+	if issuerRegexp != "" {
+		if id.IssuerRegexp, err = regexp.Compile(issuerRegexp); err != nil {
+			return nil, usageError(fmt.Sprintf("issuer regexp: %v", err))
+		}
+	}
+	return id, nil
+}
+
+func readPublicKey(name string) (crypto.PublicKey, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	k, err := cosign.ParsePublicKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return k, nil
+}
+
+// verifySignatures checks that the image called name has a signature v
+// trusts, and returns what each of those shows. c talks to registries.
+func verifySignatures(ctx context.Context, c *registry.Client, name string, v *cosign.Verifier) (digest.Digest, []*cosign.Result, error) {
+	d, sigs, err := imageSignatures(ctx, c, name)
+	if err != nil {
+		return d, nil, err
+	}
+	results, reasons := trusted(ctx, v, sigs, d)
+	if len(results) == 0 {
+		return d, nil, verificationError(untrusted(fmt.Sprintf("%s (%s) has no trusted signature", name, d), reasons))
+	}
+	return d, results, nil
+}
+
+// imageSignatures returns the digest of the image called name and the
+// signatures attached to it.
+func imageSignatures(ctx context.Context, c *registry.Client, name string) (digest.Digest, []*cosign.Signature, error) {
+	src, err := transfer.OpenSource(name, c)
+	if err != nil {
+		return "", nil, err
+	}
+	_, desc, err := src.Root(ctx)
+	src.Close()
+	if err != nil {
+		return "", nil, err
+	}
+	sigs, err := readSignatures(ctx, c, name, desc.Digest)
+	return desc.Digest, sigs, err
+}
+
+// trusted returns what the signatures of the image with digest d that v
+// trusts show, and why each of the others is not trusted.
+func trusted(ctx context.Context, v *cosign.Verifier, sigs []*cosign.Signature, d digest.Digest) ([]*cosign.Result, []string) {
+	var results []*cosign.Result
+	var reasons []string
+	for _, sig := range sigs {
+		res, err := v.Verify(ctx, sig, d)
+		if err != nil {
+			reasons = append(reasons, err.Error())
+			continue
+		}
+		results = append(results, res)
+	}
+	return results, reasons
+}
+
+// untrusted returns the error msg, listing the reasons signatures were not
+// trusted.
+func untrusted(msg string, reasons []string) error {
+	if len(reasons) > 0 {
+		msg += ":\n  " + strings.Join(reasons, "\n  ")
+	}
+	return errors.New(msg)
+}
+
+// readSignatures reads the signatures cosign attached to the image with
+// digest d, called name.
+func readSignatures(ctx context.Context, c *registry.Client, name string, d digest.Digest) ([]*cosign.Signature, error) {
+	sigName, err := transfer.Retag(name, cosign.SignatureTag(d))
+	if err != nil {
+		return nil, err
+	}
+	src, err := transfer.OpenSource(sigName, c)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	b, _, err := src.Root(ctx)
+	if err != nil {
+		return nil, verificationError(fmt.Errorf("%s has no signatures: %w", name, err))
+	}
+	return cosign.Signatures(b, func(desc specs.Descriptor) ([]byte, error) {
+		r, err := src.Open(ctx, desc)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(io.LimitReader(r, desc.Size+1))
+	})
+}
+
+// describeResult says what a verified signature shows, for humans.
+func describeResult(res *cosign.Result) string {
+	var s string
+	if res.Key != nil {
+		s = "signed with a trusted key"
+	} else {
+		s = fmt.Sprintf("signed by %s (issuer %s)", res.Subject, res.Issuer)
+	}
+	if res.Logged {
+		s += fmt.Sprintf(", in Rekor entry %d logged %s", res.LogIndex, res.LogTime.UTC().Format("2006-01-02T15:04:05Z"))
+		if res.Included {
+			s += ", inclusion proven"
+		}
+	}
+	return s
+}
+
+var verifySignatureCommand = &command{
+	name:  "verify-signature",
+	args:  "<image>",
+	short: "Check that an image has a cosign signature made with a trusted key, or keyless by a trusted identity and logged in Rekor, or those a policy file requires of where it comes from.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		var reg registryFlags
+		reg.register(fs)
+		var sig signatureFlags
+		sig.register(fs)
+		return func(args []string) error {
+			if err := wantArgs(args, 1); err != nil {
+				return err
+			}
+			if sig.policy != "" {
+				if sig.given() {
+					return usageError("-policy replaces the other signature flags")
+				}
+				pf, err := readSignaturePolicy(sig.policy)
+				if err != nil {
+					return err
+				}
+				c, err := reg.client(args)
+				if err != nil {
+					return err
+				}
+				return pf.verify(context.Background(), c, args[0])
+			}
+			v, err := sig.verifier()
+			if err != nil {
+				return err
+			}
+			c, err := reg.client(args)
+			if err != nil {
+				return err
+			}
+			d, results, err := verifySignatures(context.Background(), c, args[0], v)
+			if err != nil {
+				return err
+			}
+			for _, res := range results {
+				fmt.Printf("%s: %s\n", d, describeResult(res))
+			}
+			return nil
+		}
+	},
+}
+
+// readCertPools reads the PEM certificates of file into pools of the self
+// signed roots and of the rest.
+func readCertPools(file string) (roots, intermediates *x509.CertPool, err error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	certs, err := cosign.ParseCertificates(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", file, err)
+	}
+	roots, intermediates = x509.NewCertPool(), x509.NewCertPool()
+	n := 0
+	for _, c := range certs {
+		if bytes.Equal(c.RawIssuer, c.RawSubject) && c.CheckSignatureFrom(c) == nil {
+			roots.AddCert(c)
+			n++
+		} else {
+			intermediates.AddCert(c)
+		}
+	}
+	if n == 0 {
+		return nil, nil, fmt.Errorf("%s has no root certificates", file)
+	}
+	return roots, intermediates, nil
+}
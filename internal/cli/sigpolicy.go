@@ -0,0 +1,273 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/hxtk/ember/pkg/cosign"
+	"github.com/hxtk/ember/pkg/registry"
+	"github.com/hxtk/ember/pkg/transfer"
+)
+
+// A signature policy file says which signatures to require of images by
+// where they come from, as the ClusterImagePolicy resources of the Sigstore
+// policy-controller do, in JSON:
+//
+//	{
+//	  "policyVersion": 1,
+//	  "noMatchPolicy": "deny",
+//	  "policies": [{
+//	    "name": "release",
+//	    "images": ["ghcr.io/example", "registry.example.com/*/release"],
+//	    "authorities": [
+//	      {"name": "ci", "key": "keys/ci.pub"},
+//	      {
+//	        "name": "actions",
+//	        "trustedRoot": "trusted_root.json",
+//	        "identities": [{
+//	          "subjectRegExp": "^https://github.com/example/",
+//	          "issuer": "https://token.actions.githubusercontent.com"
+//	        }],
+//	        "rekorURL": "https://rekor.sigstore.dev"
+//	      }
+//	    ]
+//	  }]
+//	}
+//
+// The images of a policy are path.Match globs of the registry host and
+// repository of registry images, or the paths of layouts and archives; a
+// glob matching a parent of a repository matches it too. An image must meet
+// every policy that matches it, by having a signature one of the policy's
+// authorities trusts. An authority takes what the signature flags do: a key,
+// or identities, each of a subject and an OIDC issuer, and the roots and
+// logs to trust them by; files are relative to the policy file.
+// noMatchPolicy says what becomes of an image that no policy matches: deny,
+// the default, allow, or warn, to allow it but say so.
+
+// signaturePolicyFile is the JSON of a signature policy file.
+type signaturePolicyFile struct {
+	PolicyVersion int               `json:"policyVersion"`
+	NoMatchPolicy string            `json:"noMatchPolicy,omitempty"`
+	Policies      []signaturePolicy `json:"policies"`
+}
+
+type signaturePolicy struct {
+	Name        string      `json:"name"`
+	Images      []string    `json:"images"`
+	Authorities []authority `json:"authorities"`
+}
+
+// authority is what a policy trusts signatures by.
+type authority struct {
+	Name        string           `json:"name,omitempty"`
+	Key         string           `json:"key,omitempty"`
+	TrustedRoot string           `json:"trustedRoot,omitempty"`
+	FulcioRoots string           `json:"fulcioRoots,omitempty"`
+	RekorKeys   []string         `json:"rekorKeys,omitempty"`
+	RekorURL    string           `json:"rekorURL,omitempty"`
+	Identities  []policyIdentity `json:"identities,omitempty"`
+
+	verifier *cosign.Verifier
+}
+
+type policyIdentity struct {
+	Subject       string `json:"subject,omitempty"`
+	SubjectRegExp string `json:"subjectRegExp,omitempty"`
+	Issuer        string `json:"issuer,omitempty"`
+	IssuerRegExp  string `json:"issuerRegExp,omitempty"`
+}
+
+// readSignaturePolicy reads and checks a signature policy file, and the
+// keys and roots its authorities name.
+func readSignaturePolicy(name string) (*signaturePolicyFile, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var pf signaturePolicyFile
+	if err := json.Unmarshal(b, &pf); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if pf.PolicyVersion != 1 {
+		return nil, unsupportedError(fmt.Errorf("%s: unsupported policyVersion %d", name, pf.PolicyVersion))
+	}
+	switch pf.NoMatchPolicy {
+	case "":
+		pf.NoMatchPolicy = "deny"
+	case "deny", "allow", "warn":
+	default:
+		return nil, fmt.Errorf("%s: noMatchPolicy is %q, not deny, allow, or warn", name, pf.NoMatchPolicy)
+	}
+	dir := filepath.Dir(name)
+	for i := range pf.Policies {
+		p := &pf.Policies[i]
+		if err := p.load(dir); err != nil {
+			return nil, fmt.Errorf("%s: policy %q: %w", name, p.Name, err)
+		}
+	}
+	return &pf, nil
+}
+
+func (p *signaturePolicy) load(dir string) error {
+	if p.Name == "" {
+		return errors.New("no name")
+	}
+	if len(p.Images) == 0 {
+		return errors.New("no images")
+	}
+	for _, pat := range p.Images {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("image glob %q: %w", pat, err)
+		}
+	}
+	if len(p.Authorities) == 0 {
+		return errors.New("no authorities")
+	}
+	for i := range p.Authorities {
+		a := &p.Authorities[i]
+		if a.Name == "" {
+			a.Name = fmt.Sprintf("authority-%d", i)
+		}
+		if err := a.load(dir); err != nil {
+			return fmt.Errorf("authority %q: %w", a.Name, err)
+		}
+	}
+	return nil
+}
+
+func (a *authority) load(dir string) error {
+	rel := func(name string) string {
+		if name == "" || filepath.IsAbs(name) {
+			return name
+		}
+		return filepath.Join(dir, name)
+	}
+	t := trust{trustedRoot: rel(a.TrustedRoot), fulcioRoots: rel(a.FulcioRoots), rekorURL: a.RekorURL}
+	if a.Key != "" {
+		t.keys = []string{rel(a.Key)}
+	}
+	for _, k := range a.RekorKeys {
+		t.rekorKeys = append(t.rekorKeys, rel(k))
+	}
+	for _, pid := range a.Identities {
+		id, err := pid.identity()
+		if err != nil {
+			return err
+		}
+		t.identities = append(t.identities, *id)
+	}
+	v, err := t.verifier()
+	if err != nil {
+		return err
+	}
+	switch {
+	case (len(v.Keys) == 0) == (len(v.Identities) == 0):
+		return errors.New("give either a key or identities")
+	case len(v.Identities) > 0 && v.Roots == nil:
+		return errors.New("identities need a trustedRoot or fulcioRoots")
+	case len(v.Identities) > 0 && len(v.RekorKeys) == 0:
+		return errors.New("identities need a trustedRoot or rekorKeys")
+	}
+	a.verifier = v
+	return nil
+}
+
+func (pid policyIdentity) identity() (*cosign.Identity, error) {
+	if pid.Subject == "" && pid.SubjectRegExp == "" {
+		return nil, errors.New("identity has no subject or subjectRegExp")
+	}
+	if pid.Issuer == "" && pid.IssuerRegExp == "" {
+		return nil, errors.New("identity has no issuer or issuerRegExp")
+	}
+	id := &cosign.Identity{Subject: pid.Subject, Issuer: pid.Issuer}
+	var err error
+	if pid.SubjectRegExp != "" {
+		if id.SubjectRegexp, err = regexp.Compile(pid.SubjectRegExp); err != nil {
+			return nil, fmt.Errorf("subjectRegExp: %w", err)
+		}
+	}
+	if pid.IssuerRegExp != "" {
+		if id.IssuerRegexp, err = regexp.Compile(pid.IssuerRegExp); err != nil {
+			return nil, fmt.Errorf("issuerRegExp: %w", err)
+		}
+	}
+	return id, nil
+}
+
+// matches reports whether one of the images globs of p matches the
+// repository repo, or one of its parents.
+func (p *signaturePolicy) matches(repo string) bool {
+	for _, pat := range p.Images {
+		for r := repo; ; {
+			if ok, _ := path.Match(pat, r); ok {
+				return true
+			}
+			i := strings.LastIndexByte(r, '/')
+			if i <= 0 {
+				break
+			}
+			r = r[:i]
+		}
+	}
+	return false
+}
+
+// verify checks that the image called name meets the policies that match
+// it, printing which authority each was met by. c talks to registries.
+func (pf *signaturePolicyFile) verify(ctx context.Context, c *registry.Client, name string) error {
+	repo, err := transfer.Repository(name)
+	if err != nil {
+		return err
+	}
+	var matched []*signaturePolicy
+	for i := range pf.Policies {
+		if p := &pf.Policies[i]; p.matches(repo) {
+			matched = append(matched, p)
+		}
+	}
+	if len(matched) == 0 {
+		switch pf.NoMatchPolicy {
+		case "allow":
+			return nil
+		case "warn":
+			log.Printf("warning: %s matches no signature policy, and is allowed unverified", name)
+			return nil
+		}
+		return verificationError(fmt.Errorf("%s matches no signature policy", name))
+	}
+
+	d, sigs, err := imageSignatures(ctx, c, name)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, p := range matched {
+		var reasons []string
+		met := false
+		for _, a := range p.Authorities {
+			results, why := trusted(ctx, a.verifier, sigs, d)
+			for _, res := range results {
+				fmt.Printf("%s: policy %s, authority %s: %s\n", d, p.Name, a.Name, describeResult(res))
+			}
+			met = met || len(results) > 0
+			for _, r := range why {
+				reasons = append(reasons, a.Name+": "+r)
+			}
+		}
+		if !met {
+			errs = append(errs, untrusted(fmt.Sprintf("%s (%s) fails signature policy %s", name, d, p.Name), reasons))
+		}
+	}
+	if len(errs) > 0 {
+		return verificationError(errors.Join(errs...))
+	}
+	return nil
+}
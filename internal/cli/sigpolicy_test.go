@@ -0,0 +1,404 @@
+package cli
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hxtk/ember/pkg/cosign"
+	"github.com/hxtk/ember/pkg/ocitest"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// signer signs the image with digest d, returning the simple signing
+// layer of the signature and its payload.
+type signer func(t *testing.T, d digest.Digest) (specs.Descriptor, []byte)
+
+// signedLayout writes a layout of an image tagged latest, signed by each
+// of signers in a signature manifest tagged beside it as cosign tags it,
+// and returns the layout's directory.
+func signedLayout(t *testing.T, signers ...signer) string {
+	t.Helper()
+	dir := ocitest.Layout(t, ocitest.New(ocitest.NewLayer().File("etc/hostname", "host")))
+	if len(signers) == 0 {
+		return dir
+	}
+	var idx specs.Index
+	readJSON(t, filepath.Join(dir, "index.json"), &idx)
+	addBlob := func(mediaType string, b []byte) specs.Descriptor {
+		d := digest.FromBytes(b)
+		if err := os.WriteFile(filepath.Join(dir, "blobs", "sha256", d.Encoded()), b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return specs.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(b))}
+	}
+	m := specs.Manifest{MediaType: specs.MediaTypeImageManifest, Config: addBlob(specs.MediaTypeImageConfig, []byte("{}"))}
+	m.SchemaVersion = 2
+	for _, sign := range signers {
+		l, payload := sign(t, idx.Manifests[0].Digest)
+		addBlob(l.MediaType, payload)
+		m.Layers = append(m.Layers, l)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := addBlob(specs.MediaTypeImageManifest, b)
+	desc.Annotations = map[string]string{specs.AnnotationRefName: cosign.SignatureTag(idx.Manifests[0].Digest)}
+	idx.Manifests = append(idx.Manifests, desc)
+	if err := writeJSON(filepath.Join(dir, "index.json"), idx); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func readJSON(t *testing.T, name string, v any) {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func sign(t *testing.T, k *ecdsa.PrivateKey, msg []byte) []byte {
+	t.Helper()
+	sum := sha256.Sum256(msg)
+	sig, err := ecdsa.SignASN1(rand.Reader, k, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// writeKey writes the PEM public key of k, as cosign.pub, to name.
+func writeKey(t *testing.T, name string, k *ecdsa.PrivateKey) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// simpleSigning returns the layer of the signature sig of payload.
+func simpleSigning(payload, sig []byte) specs.Descriptor {
+	return specs.Descriptor{
+		MediaType:   cosign.MediaTypeSimpleSigning,
+		Digest:      digest.FromBytes(payload),
+		Size:        int64(len(payload)),
+		Annotations: map[string]string{cosign.AnnotationSignature: base64.StdEncoding.EncodeToString(sig)},
+	}
+}
+
+func payload(d digest.Digest) []byte {
+	return fmt.Appendf(nil, `{"critical":{"identity":{"docker-reference":""},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, d)
+}
+
+// keyed signs with k.
+func keyed(k *ecdsa.PrivateKey) signer {
+	return func(t *testing.T, d digest.Digest) (specs.Descriptor, []byte) {
+		p := payload(d)
+		return simpleSigning(p, sign(t, k, p)), p
+	}
+}
+
+// sigstore is a Fulcio root and a Rekor log, to make keyless signatures
+// under.
+type sigstore struct {
+	root    *x509.Certificate
+	rootKey *ecdsa.PrivateKey
+	log     *ecdsa.PrivateKey
+}
+
+func newSigstore(t *testing.T) *sigstore {
+	t.Helper()
+	s := &sigstore{rootKey: newKey(t), log: newKey(t)}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fulcio"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &s.rootKey.PublicKey, s.rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.root, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// write writes the root, as fulcio.pem, and the key of the log, as
+// rekor.pub, to dir.
+func (s *sigstore) write(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, "fulcio.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.root.Raw}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	writeKey(t, filepath.Join(dir, "rekor.pub"), s.log)
+}
+
+// keyless signs with a certificate the root issues for email, from the
+// OIDC issuer, logged in the log.
+func (s *sigstore) keyless(email, issuer string) signer {
+	return func(t *testing.T, d digest.Digest) (specs.Descriptor, []byte) {
+		k := newKey(t)
+		iss, err := asn1.MarshalWithParams(issuer, "utf8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:    big.NewInt(2),
+			NotBefore:       time.Now().Add(-time.Minute),
+			NotAfter:        time.Now().Add(10 * time.Minute),
+			KeyUsage:        x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+			EmailAddresses:  []string{email},
+			ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}, Value: iss}},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, s.root, &k.PublicKey, s.rootKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+		p := payload(d)
+		sig := sign(t, k, p)
+		sum := sha256.Sum256(p)
+		body, err := json.Marshal(map[string]any{
+			"apiVersion": "0.0.1",
+			"kind":       "hashedrekord",
+			"spec": map[string]any{
+				"data":      map[string]any{"hash": map[string]string{"algorithm": "sha256", "value": hex.EncodeToString(sum[:])}},
+				"signature": map[string]any{"content": sig, "publicKey": map[string]any{"content": cert}},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := cosign.LogID(&s.log.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := cosign.Bundle{Payload: cosign.BundlePayload{
+			Body:           base64.StdEncoding.EncodeToString(body),
+			IntegratedTime: time.Now().Unix(),
+			LogIndex:       7,
+			LogID:          id,
+		}}
+		// The log signs the entry as canonical JSON.
+		entry, err := json.Marshal(struct {
+			Body           string `json:"body"`
+			IntegratedTime int64  `json:"integratedTime"`
+			LogID          string `json:"logID"`
+			LogIndex       int64  `json:"logIndex"`
+		}{b.Payload.Body, b.Payload.IntegratedTime, id, b.Payload.LogIndex})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.SignedEntryTimestamp = sign(t, s.log, entry)
+		bundle, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l := simpleSigning(p, sig)
+		l.Annotations[cosign.AnnotationCertificate] = string(cert)
+		l.Annotations[cosign.AnnotationBundle] = string(bundle)
+		return l, p
+	}
+}
+
+func TestSignaturePolicy(t *testing.T) {
+	ci, other := newKey(t), newKey(t)
+	store := newSigstore(t)
+	const (
+		email  = "builder@example.com"
+		issuer = "https://issuer.example.com"
+	)
+	key := func(name string) map[string]any { return map[string]any{"name": name, "key": name + ".pub"} }
+	identity := map[string]any{
+		"name":        "actions",
+		"fulcioRoots": "fulcio.pem",
+		"rekorKeys":   []string{"rekor.pub"},
+		"identities":  []map[string]string{{"subject": email, "issuer": issuer}},
+	}
+	// image stands for the repository of the image, the layout directory,
+	// in the globs of images.
+	const image = "IMAGE"
+
+	for _, tc := range []struct {
+		name          string
+		signers       []signer
+		noMatchPolicy string
+		policies      []map[string]any
+		want          int
+		out           []string // lines of the output
+	}{
+		{
+			name:     "key",
+			signers:  []signer{keyed(ci)},
+			policies: []map[string]any{{"name": "release", "images": []string{image}, "authorities": []any{key("ci")}}},
+			out:      []string{"policy release, authority ci: signed with a trusted key"},
+		},
+		{
+			name:     "other key",
+			signers:  []signer{keyed(other)},
+			policies: []map[string]any{{"name": "release", "images": []string{image}, "authorities": []any{key("ci")}}},
+			want:     exitVerification,
+		},
+		{
+			name:     "unsigned",
+			policies: []map[string]any{{"name": "release", "images": []string{image}, "authorities": []any{key("ci")}}},
+			want:     exitVerification,
+		},
+		{
+			name:     "identity",
+			signers:  []signer{store.keyless(email, issuer)},
+			policies: []map[string]any{{"name": "release", "images": []string{image}, "authorities": []any{identity}}},
+			out:      []string{"policy release, authority actions: signed by " + email + " (issuer " + issuer + "), in Rekor entry 7"},
+		},
+		{
+			name:     "wrong identity",
+			signers:  []signer{store.keyless("mallory@example.com", issuer)},
+			policies: []map[string]any{{"name": "release", "images": []string{image}, "authorities": []any{identity}}},
+			want:     exitVerification,
+		},
+		{
+			name:     "wrong issuer",
+			signers:  []signer{store.keyless(email, "https://other.example.com")},
+			policies: []map[string]any{{"name": "release", "images": []string{image}, "authorities": []any{identity}}},
+			want:     exitVerification,
+		},
+		{
+			name:     "keyless signature for a key",
+			signers:  []signer{store.keyless(email, issuer)},
+			policies: []map[string]any{{"name": "release", "images": []string{image}, "authorities": []any{key("ci")}}},
+			want:     exitVerification,
+		},
+		{
+			name:    "one of the authorities",
+			signers: []signer{keyed(ci)},
+			policies: []map[string]any{
+				{"name": "release", "images": []string{image}, "authorities": []any{key("other"), identity, key("ci")}},
+			},
+			out: []string{"policy release, authority ci: signed with a trusted key"},
+		},
+		{
+			name:    "one of the signatures",
+			signers: []signer{keyed(other), store.keyless("mallory@example.com", issuer), keyed(ci)},
+			policies: []map[string]any{
+				{"name": "release", "images": []string{image}, "authorities": []any{key("ci")}},
+			},
+			out: []string{"policy release, authority ci: signed with a trusted key"},
+		},
+		{
+			// A glob of the parent of a repository matches it too.
+			name:    "one signature for several policies",
+			signers: []signer{keyed(ci)},
+			policies: []map[string]any{
+				{"name": "release", "images": []string{image}, "authorities": []any{key("ci")}},
+				{"name": "parent", "images": []string{"PARENT"}, "authorities": []any{identity, key("ci")}},
+				{"name": "elsewhere", "images": []string{"/nowhere/*"}, "authorities": []any{key("other")}},
+			},
+			out: []string{
+				"policy release, authority ci: signed with a trusted key",
+				"policy parent, authority ci: signed with a trusted key",
+			},
+		},
+		{
+			name:    "one signature, one policy unmet",
+			signers: []signer{keyed(ci)},
+			policies: []map[string]any{
+				{"name": "release", "images": []string{image}, "authorities": []any{key("ci")}},
+				{"name": "parent", "images": []string{"PARENT"}, "authorities": []any{key("other")}},
+			},
+			want: exitVerification,
+			out:  []string{"policy release, authority ci: signed with a trusted key"},
+		},
+		{
+			name:     "no match",
+			signers:  []signer{keyed(ci)},
+			policies: []map[string]any{{"name": "elsewhere", "images": []string{"/nowhere/*"}, "authorities": []any{key("ci")}}},
+			want:     exitVerification,
+		},
+		{
+			name:          "no match allowed",
+			noMatchPolicy: "allow",
+			policies:      []map[string]any{{"name": "elsewhere", "images": []string{"/nowhere/*"}, "authorities": []any{key("ci")}}},
+		},
+		{
+			name:     "no authorities",
+			signers:  []signer{keyed(ci)},
+			policies: []map[string]any{{"name": "release", "images": []string{image}}},
+			want:     exitFailure,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := signedLayout(t, tc.signers...)
+			keys := t.TempDir()
+			writeKey(t, filepath.Join(keys, "ci.pub"), ci)
+			writeKey(t, filepath.Join(keys, "other.pub"), other)
+			store.write(t, keys)
+			for _, p := range tc.policies {
+				globs := p["images"].([]string)
+				for i, g := range globs {
+					globs[i] = strings.NewReplacer(image, dir, "PARENT", path.Dir(dir)).Replace(g)
+				}
+			}
+			policy := filepath.Join(keys, "policy.json")
+			if err := writeJSON(policy, map[string]any{"policyVersion": 1, "noMatchPolicy": tc.noMatchPolicy, "policies": tc.policies}); err != nil {
+				t.Fatal(err)
+			}
+
+			code, stdout := run(t, "verify-signature", "-policy", policy, "oci:"+dir+":latest")
+			if code != tc.want {
+				t.Fatalf("verify-signature exited %d, want %d; printed\n%s", code, tc.want, stdout)
+			}
+			lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+			if len(tc.out) == 0 && stdout != "" || len(tc.out) > 0 && len(lines) != len(tc.out) {
+				t.Fatalf("verify-signature printed\n%s\nwant %d lines", stdout, len(tc.out))
+			}
+			for i, want := range tc.out {
+				if _, rest, _ := strings.Cut(lines[i], ": "); !strings.HasPrefix(rest, want) {
+					t.Errorf("line %d is %q, want %q after the digest", i, lines[i], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// defaultSpaceMargin is the headroom, in percent of the estimate, that
+// checkSpace asks for by default.
+const defaultSpaceMargin = 10
+
+// freeSpace returns the bytes unprivileged users can still write to the
+// filesystem of the directory dir. It is nil where ember can't tell.
+var freeSpace func(dir string) (int64, error)
+
+// checkSpace fails early, before anything is written, if the filesystem
+// that path is on, or would be created on, or the block device it is, has
+// less room than need bytes and margin percent more. A negative margin
+// skips the check, as does a filesystem whose free space can't be told.
+func checkSpace(path string, need int64, margin int) error {
+	if margin < 0 || need <= 0 || path == "" || path == "-" {
+		return nil
+	}
+	dir := existingDir(path)
+	var free int64
+	var err error
+	if fi, serr := os.Stat(path); serr == nil && isBlockDevice(fi) {
+		dir = path
+		free, err = deviceSize(path)
+	} else if freeSpace != nil {
+		free, err = freeSpace(dir)
+	} else {
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	want := need + need*int64(margin)/100
+	if free < want {
+		return outputError(fmt.Errorf("%s has %s free, but about %s is needed (%s and a %d%% margin); free some space, or skip this check with -space-margin -1",
+			dir, humanSize(free), humanSize(want), humanSize(need), margin))
+	}
+	return nil
+}
+
+// existingDir returns the nearest directory of path and its parents that
+// exists: where path is, or would be created.
+func existingDir(path string) string {
+	for p := filepath.Clean(path); ; {
+		if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+			return p
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return p
+		}
+		p = parent
+	}
+}
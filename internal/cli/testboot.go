@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"flag"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/hxtk/ember/pkg/qemuboot"
+)
+
+var testBootCommand = &command{
+	name:  "test-boot",
+	args:  "<initramfs>",
+	short: "Boot an initramfs under QEMU and check that init starts.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		var o testBootOptions
+		fs.StringVar(&o.kernel, "kernel", "", "the kernel image `file` to boot (required)")
+		fs.StringVar(&o.arch, "arch", runtime.GOARCH, "the `architecture` to emulate, as GOARCH names it")
+		fs.StringVar(&o.qemu, "qemu", "", "the QEMU system emulator `program` to run (default: the one for -arch)")
+		fs.StringVar(&o.memory, "memory", "512M", "the guest's memory `size`, as QEMU's -m takes it")
+		fs.StringVar(&o.append, "append", "", "more kernel command line `arguments`, after the console, panic=-1, and loglevel=7 that test-boot sets")
+		fs.Func("qemu-arg", "pass the `argument` to QEMU (repeatable)", func(s string) error {
+			o.qemuArgs = append(o.qemuArgs, s)
+			return nil
+		})
+		fs.StringVar(&o.script, "script", "", "check the serial console with the expect, send, wait, timeout, and fail steps of the script `file`; see qemuboot.Script (default: init runs and the kernel does not panic within 5s)")
+		fs.StringVar(&o.console, "console", "", "copy what the serial console prints to `file` (- for stderr)")
+		return func(args []string) error {
+			if err := wantArgs(args, 1); err != nil {
+				return err
+			}
+			return testBoot(args[0], &o)
+		}
+	},
+}
+
+type testBootOptions struct {
+	kernel   string
+	arch     string
+	qemu     string
+	memory   string
+	append   string
+	qemuArgs []string
+	script   string
+	console  string
+}
+
+func testBoot(initrd string, o *testBootOptions) error {
+	if o.kernel == "" {
+		return usageError("-kernel is required")
+	}
+	for _, name := range []string{o.kernel, initrd} {
+		if _, err := os.Stat(name); err != nil {
+			return err
+		}
+	}
+	m, err := qemuboot.MachineFor(o.arch)
+	if err != nil {
+		return usageError(err.Error())
+	}
+	if o.qemu != "" {
+		m.QEMU = o.qemu
+	}
+
+	src := io.Reader(strings.NewReader(qemuboot.DefaultScript))
+	if o.script != "" {
+		f, err := os.Open(o.script)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	}
+	script, err := qemuboot.ParseScript(src)
+	if err != nil {
+		return usageError("-script: " + err.Error())
+	}
+
+	cfg := qemuboot.Config{
+		Machine: m,
+		Kernel:  o.kernel,
+		Initrd:  initrd,
+		Memory:  o.memory,
+		Cmdline: o.append,
+		Args:    o.qemuArgs,
+	}
+	switch o.console {
+	case "":
+	case "-":
+		cfg.Console = os.Stderr
+	default:
+		f, err := os.Create(o.console)
+		if err != nil {
+			return outputError(err)
+		}
+		defer f.Close()
+		cfg.Console = f
+	}
+	return qemuboot.Boot(cfg, script)
+}
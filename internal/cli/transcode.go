@@ -0,0 +1,48 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/hxtk/ember/pkg/oci"
+)
+
+var transcodeCommand = &command{
+	name:  "transcode",
+	args:  "<oci-layout-path> [<output-layout-path>]",
+	short: "Re-compress the layers of the images in a layout, in place or into another layout.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		compression := fs.String("compression", "zstd", "layer compression: `gzip`, zstd, or none")
+		level := fs.Int("level", 0, "compression level (gzip 1-9, zstd 1-19; 0 for the default)")
+		return func(args []string) error {
+			if len(args) != 1 && len(args) != 2 {
+				return usageError(fmt.Sprintf("expected 1 or 2 arguments, got %d", len(args)))
+			}
+			c := oci.Compression(*compression)
+			switch c {
+			case oci.Gzip, oci.Zstd, oci.Uncompressed:
+			default:
+				return usageError(fmt.Sprintf("unknown -compression %q", *compression))
+			}
+			out := args[0]
+			if len(args) == 2 {
+				out = args[1]
+			}
+			w, err := oci.CreateLayout(out)
+			if err != nil {
+				return outputError(fmt.Errorf("create output layout: %w", err))
+			}
+			idx, err := oci.Transcode(args[0], w, c, *level)
+			if err != nil {
+				return err
+			}
+			if err := w.WriteIndex(idx); err != nil {
+				return err
+			}
+			for _, d := range idx.Manifests {
+				fmt.Println(d.Digest)
+			}
+			return nil
+		}
+	},
+}
@@ -0,0 +1,224 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hxtk/ember/pkg/cpio"
+	"github.com/hxtk/ember/pkg/lz4"
+	"github.com/hxtk/ember/pkg/xz"
+)
+
+var cpioTestVectorsCommand = &command{
+	name:  "cpio test-vectors",
+	args:  "<dir>",
+	short: "Write a tiny reference archive of every entry type in each format variant, with hex dumps, as conformance vectors for extractors.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		return func(args []string) error {
+			if err := wantArgs(args, 1); err != nil {
+				return err
+			}
+			return writeTestVectors(args[0])
+		}
+	},
+}
+
+// vectorEntry is an entry of the reference archive, as vectors.json
+// describes it for extractors to check against.
+type vectorEntry struct {
+	Name      string `json:"name"` // as in the newc variant
+	Mode      string `json:"mode"` // octal, with the file type bits
+	Uid       int    `json:"uid"`
+	Gid       int    `json:"gid"`
+	Links     int    `json:"nlink"`
+	ModTime   int64  `json:"mtime"`
+	Inode     int    `json:"inode"`
+	RdevMajor int    `json:"rdevmajor,omitempty"`
+	RdevMinor int    `json:"rdevminor,omitempty"`
+	Content   string `json:"content,omitempty"` // of files, or the target of symlinks
+}
+
+// vectorEpoch is the modification time of every entry, which
+// writeTestVectors sets.
+var vectorEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+// vectorEntries covers every type newc holds, contents that do and don't
+// need padding, names whose header does and doesn't, ownership, the
+// setuid bit, and a hard link, which carries its content on the last of
+// its names as GNU cpio writes them and the kernel expects.
+var vectorEntries = []vectorEntry{
+	{Name: ".", Mode: "040755", Inode: 1, Links: 2},
+	{Name: "bin", Mode: "040755", Inode: 2, Links: 2},
+	{Name: "bin/sh", Mode: "0100755", Inode: 3, Links: 2},
+	{Name: "bin/ash", Mode: "0100755", Inode: 3, Links: 2, Content: "#!/bin/sh\necho hello\n"},
+	{Name: "bin/su", Mode: "0104755", Inode: 4, Links: 1, Content: "su\n"},
+	{Name: "bin/link", Mode: "0120777", Inode: 5, Links: 1, Content: "ash"},
+	{Name: "dev", Mode: "040755", Inode: 6, Links: 2},
+	{Name: "dev/console", Mode: "020600", Inode: 7, Links: 1, RdevMajor: 5, RdevMinor: 1},
+	{Name: "dev/sda", Mode: "060660", Inode: 8, Links: 1, RdevMajor: 8},
+	{Name: "empty", Mode: "0100644", Inode: 9, Links: 1},
+	{Name: "home", Mode: "040755", Inode: 10, Links: 2},
+	{Name: "home/user", Mode: "040700", Uid: 1000, Gid: 1000, Inode: 11, Links: 2},
+	{Name: "home/user/notes.txt", Mode: "0100600", Uid: 1000, Gid: 1000, Inode: 12, Links: 1, Content: "four"},
+	{Name: "run", Mode: "040755", Inode: 13, Links: 2},
+	{Name: "run/fifo", Mode: "010644", Inode: 14, Links: 1},
+	{Name: "run/socket", Mode: "0140755", Inode: 15, Links: 1},
+}
+
+// vectorNames are the naming variants of the archive.
+var vectorNames = []struct {
+	variant string
+	name    func(e *vectorEntry) string
+}{
+	{"newc", func(e *vectorEntry) string { return e.Name }},
+	{"newc-dot-prefix", func(e *vectorEntry) string {
+		if e.Name == "." {
+			return e.Name
+		}
+		return "./" + e.Name
+	}},
+	{"newc-dir-slash", func(e *vectorEntry) string {
+		if e.Name != "." && strings.HasPrefix(e.Mode, "04") {
+			return e.Name + "/"
+		}
+		return e.Name
+	}},
+}
+
+// vectorCompressions are the compressions of the newc variant, as build
+// writes them.
+var vectorCompressions = []struct {
+	ext string
+	c   *compression
+}{
+	{".gz", &compression{codec: "gzip"}},
+	{".lz4", &compression{codec: "lz4", lz4: lz4.WriterConfig{Frame: lz4.FrameLegacy}}},
+	{".frame.lz4", &compression{codec: "lz4", lz4: lz4.WriterConfig{Frame: lz4.FrameNormal}}},
+	{".xz", &compression{codec: "xz", xz: xz.KernelConfig}},
+	{".zst", &compression{codec: "zstd"}},
+}
+
+// vectorFile is a file of the vectors, as vectors.json lists it.
+type vectorFile struct {
+	File        string `json:"file"`
+	Variant     string `json:"variant"`
+	Compression string `json:"compression,omitempty"`
+	Size        int    `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+// writeTestVectors writes the variants of the reference archive into dir,
+// each with a hex dump of it, and vectors.json describing them all.
+func writeTestVectors(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return outputError(err)
+	}
+	var files []vectorFile
+	write := func(name, variant, codec string, b []byte) error {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			return outputError(err)
+		}
+		if err := os.WriteFile(path+".hex", []byte(hex.Dump(b)), 0o644); err != nil {
+			return outputError(err)
+		}
+		files = append(files, vectorFile{File: name, Variant: variant, Compression: codec, Size: len(b), SHA256: fmt.Sprintf("%x", sha256.Sum256(b))})
+		return nil
+	}
+
+	for i := range vectorEntries {
+		vectorEntries[i].ModTime = vectorEpoch
+	}
+	var newc []byte
+	for _, n := range vectorNames {
+		var buf bytes.Buffer
+		if err := writeVector(&buf, vectorEntries, n.name); err != nil {
+			return err
+		}
+		if n.variant == "newc" {
+			newc = buf.Bytes()
+		}
+		if err := write(n.variant+".cpio", n.variant, "", buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	// The kernel unpacks archives concatenated after a trailer, with zero
+	// padding between them, as the volumes of -split-size and -dracut-base
+	// give it.
+	var buf bytes.Buffer
+	half := len(vectorEntries) / 2
+	plain := func(e *vectorEntry) string { return e.Name }
+	if err := writeVector(&buf, vectorEntries[:half], plain); err != nil {
+		return err
+	}
+	buf.Write(make([]byte, 512-buf.Len()%512))
+	if err := writeVector(&buf, vectorEntries[half:], plain); err != nil {
+		return err
+	}
+	if err := write("newc-concatenated.cpio", "newc-concatenated", "", buf.Bytes()); err != nil {
+		return err
+	}
+
+	for _, vc := range vectorCompressions {
+		var buf bytes.Buffer
+		zw, err := vc.c.writer(&buf)
+		if err != nil {
+			return err
+		}
+		if _, err := zw.Write(newc); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		codec := vc.c.codec
+		if vc.c.codec == "lz4" {
+			codec += " " + vc.c.lz4.Frame.String()
+		}
+		if err := write("newc.cpio"+vc.ext, "newc", codec, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return outputError(writeJSON(filepath.Join(dir, "vectors.json"), struct {
+		Entries []vectorEntry `json:"entries"`
+		Files   []vectorFile  `json:"files"`
+	}{vectorEntries, files}))
+}
+
+// writeVector writes an archive of entries, named by name, to buf.
+func writeVector(buf *bytes.Buffer, entries []vectorEntry, name func(*vectorEntry) string) error {
+	w := cpio.NewWriter(buf)
+	for i := range entries {
+		e := &entries[i]
+		mode, _ := strconv.ParseInt(e.Mode, 8, 64)
+		hdr := &cpio.Header{
+			Name:      name(e),
+			Mode:      mode,
+			Uid:       e.Uid,
+			Gid:       e.Gid,
+			Links:     e.Links,
+			ModTime:   time.Unix(e.ModTime, 0),
+			Size:      int64(len(e.Content)),
+			RdevMajor: e.RdevMajor,
+			RdevMinor: e.RdevMinor,
+			Inode:     e.Inode,
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(e.Content)); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
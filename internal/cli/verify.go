@@ -0,0 +1,269 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/cpio"
+	"github.com/hxtk/ember/pkg/oci"
+)
+
+var verifyReproducibleCommand = &command{
+	name:  "verify-reproducible",
+	args:  "<oci-layout-path>",
+	short: "Convert an image twice as build would and check that the archives are identical.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		var o buildOptions
+		o.register(fs)
+		vary := fs.Bool("vary-schedule", false, "run the second conversion on another goroutine schedule: hashing files for -inodes content on one goroutine instead of all cores, and yielding the processor at every entry")
+		return func(args []string) error {
+			if err := wantArgs(args, 1); err != nil {
+				return err
+			}
+			var output []string
+			fs.Visit(func(f *flag.Flag) {
+				if slices.Contains(buildOutputFlags, f.Name) {
+					output = append(output, "-"+f.Name)
+				}
+			})
+			if len(output) > 0 {
+				return usageError(fmt.Sprintf("verify-reproducible writes no output; leave out %s", strings.Join(output, ", ")))
+			}
+			return verifyReproducible(args[0], &o, *vary)
+		}
+	},
+}
+
+// buildOutputFlags are the build flags about where and how the archive is
+// written, which verify-reproducible, writing nothing, refuses.
+var buildOutputFlags = []string{
+	"o", "tar", "force", "size-budget", "trim", "space-margin", "split-size", "chunk-store", "chunk-index",
+	"gen-init-cpio", "report", "compare-payload", "report-deleted", "pxe", "kernel", "cmdline", "pxe-class",
+	"sign-key", "sign-cert", "sign-command", "measure", "pxe-base-url", "dracut-base",
+}
+
+// verifyReproducible runs two independent conversions of the layout
+// concurrently, each with a Reader of its own, through the pipeline build
+// runs with the flags of o, and compares their output streams byte by
+// byte, so neither archive has to be held in memory or written to disk.
+// With -compress, the compressed archives are compared too, by digest. If
+// vary is set, the second conversion runs on another goroutine schedule.
+func verifyReproducible(layoutPath string, o *buildOptions, vary bool) error {
+	ra, err := o.image.open(layoutPath, o.readerOptions()...)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+	if o.locked {
+		if err := checkLocked(o.lockFile, layoutPath, ra); err != nil {
+			return err
+		}
+	}
+	if err := o.applyHints(ra); err != nil {
+		return err
+	}
+	rb, err := ra.Clone()
+	if err != nil {
+		return fmt.Errorf("open OCI layout: %w", err)
+	}
+	defer rb.Close()
+	comp, err := o.compress.compression()
+	if err != nil {
+		return err
+	}
+	a, err := o.startConversion(layoutPath, ra, comp, false)
+	if err != nil {
+		return err
+	}
+	b, err := o.startConversion(layoutPath, rb, comp, vary)
+	if err != nil {
+		a.pr.Close()
+		<-a.done
+		return err
+	}
+
+	h := sha256.New()
+	bufA := make([]byte, 32*1024)
+	bufB := make([]byte, 32*1024)
+	var off int64
+	diverged := int64(-1)
+	for {
+		na, errA := io.ReadFull(a.pr, bufA)
+		nb, errB := io.ReadFull(b.pr, bufB[:na])
+		// A failed run fails the pipe with its error, which done delivers
+		// too once both runs have stopped.
+		if errA != nil && errA != io.EOF && errA != io.ErrUnexpectedEOF ||
+			errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			break
+		}
+		if i := mismatch(bufA[:na], bufB[:nb]); i >= 0 {
+			diverged = off + int64(i)
+			break
+		}
+		h.Write(bufA[:na])
+		off += int64(na)
+		if errA != nil {
+			// Run A ended; run B must end at the same offset.
+			if n, _ := b.pr.Read(bufB[:1]); n > 0 {
+				diverged = off
+			}
+			break
+		}
+	}
+
+	// Unblock whichever conversion is still writing, then collect results.
+	a.pr.Close()
+	b.pr.Close()
+	errA, errB := <-a.done, <-b.done
+
+	if diverged >= 0 {
+		return verificationError(fmt.Errorf("not reproducible: outputs diverge at offset %d in entry %q (second run: %q)",
+			diverged, a.entryAt(diverged), b.entryAt(diverged)))
+	}
+	if errA != nil {
+		return errA
+	}
+	if errB != nil {
+		return errB
+	}
+	if comp != nil && !bytes.Equal(a.compressed, b.compressed) {
+		return verificationError(fmt.Errorf("not reproducible: the archives are identical, but compress to different bytes (sha256:%x and sha256:%x)", a.compressed, b.compressed))
+	}
+	fmt.Printf("reproducible: %d bytes, %d entries, sha256:%x\n", off, len(a.entries), h.Sum(nil))
+	if comp != nil {
+		fmt.Printf("compressed: sha256:%x\n", a.compressed)
+	}
+	return nil
+}
+
+// mismatch returns the index of the first differing byte of a and b,
+// treating a length difference as a mismatch, or -1 if they are equal.
+func mismatch(a, b []byte) int {
+	if bytes.Equal(a, b) {
+		return -1
+	}
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// conversion is one run of the conversion streaming into a pipe.
+type conversion struct {
+	pr   *io.PipeReader
+	done chan error
+
+	// entries records where each entry's header starts; it is only safe
+	// to read after done has delivered.
+	entries    []entryOffset
+	compressed []byte // SHA-256 of the archive compressed as -compress says
+}
+
+type entryOffset struct {
+	name string
+	off  int64
+}
+
+// startConversion starts converting r, of the layout at layoutPath, as the
+// flags of o say. If vary is set, it runs on another schedule than build's.
+func (o *buildOptions) startConversion(layoutPath string, r *oci.Reader, comp *compression, vary bool) (*conversion, error) {
+	opts, plugins, cleanup, err := o.archiveOptions(layoutPath, r)
+	if err != nil {
+		return nil, err
+	}
+	if vary {
+		opts = append(opts, convert.WithHashWorkers(1))
+	} else {
+		opts = append(opts, convert.WithHashWorkers(runtime.GOMAXPROCS(0)))
+	}
+	pr, pw := io.Pipe()
+	c := &conversion{pr: pr, done: make(chan error, 1)}
+	go func() {
+		defer cleanup()
+		err := c.run(r, pw, opts, plugins, comp, vary)
+		pw.CloseWithError(err)
+		c.done <- err
+	}()
+	return c, nil
+}
+
+func (c *conversion) run(r *oci.Reader, w io.Writer, opts []convert.Option, plugins []*convert.Plugin, comp *compression, yield bool) error {
+	cw := &offsetWriter{w: w}
+	h := sha256.New()
+	zw, err := comp.writer(h)
+	if err != nil {
+		return err
+	}
+	tw := cpio.NewWriter(io.MultiWriter(cw, zw))
+	rw := &recordingWriter{Writer: tw, cw: cw, c: c, yield: yield}
+	if err := convert.Convert(r, rw, opts...); err != nil {
+		return err
+	}
+	for _, p := range plugins {
+		if err := p.Close(); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	c.compressed = h.Sum(nil)
+	return nil
+}
+
+// entryAt names the entry whose encoding contains offset off.
+func (c *conversion) entryAt(off int64) string {
+	i := sort.Search(len(c.entries), func(i int) bool { return c.entries[i].off > off })
+	if i == 0 {
+		return "<none>"
+	}
+	return c.entries[i-1].name
+}
+
+type offsetWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (o *offsetWriter) Write(b []byte) (int, error) {
+	n, err := o.w.Write(b)
+	o.n += int64(n)
+	return n, err
+}
+
+// recordingWriter notes the offset of every header it writes, and with
+// yield set, yields the processor before each.
+type recordingWriter struct {
+	*cpio.Writer
+	cw    *offsetWriter
+	c     *conversion
+	yield bool
+}
+
+func (r *recordingWriter) WriteHeader(hdr *cpio.Header) error {
+	if r.yield {
+		runtime.Gosched()
+	}
+	if err := r.Writer.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// The header start is its aligned length before the current offset;
+	// measuring before the call would include the previous entry's padding.
+	hdrLen := (110 + int64(len(hdr.Name)) + 1 + 3) &^ 3
+	r.c.entries = append(r.c.entries, entryOffset{name: hdr.Name, off: r.cw.n - hdrLen})
+	return nil
+}
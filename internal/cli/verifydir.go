@@ -0,0 +1,312 @@
+package cli
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/hxtk/ember/pkg/oci"
+)
+
+var verifyDirCommand = &command{
+	name:  "verify-dir",
+	args:  "<oci-layout-path> <directory>",
+	short: "Check an extracted root filesystem, or a live one such as /proc/1/root, against the merged view of an image and report drift.",
+	setFlags: func(fs *flag.FlagSet) func([]string) error {
+		var image imageFlags
+		image.register(fs)
+		var o dirCheck
+		fs.Func("exclude", "skip image and directory paths matching the `glob`, and everything below them, such as proc and sys of a live system (repeatable)", func(s string) error {
+			if _, err := path.Match(s, ""); err != nil {
+				return fmt.Errorf("exclude pattern %q: %w", s, err)
+			}
+			o.exclude = append(o.exclude, s)
+			return nil
+		})
+		fs.Func("exclude-from", "skip the paths matching the globs in `file`, one per line, as ember browse writes them (repeatable)", func(s string) error {
+			patterns, err := readExcludeList(s)
+			o.exclude = append(o.exclude, patterns...)
+			return err
+		})
+		fs.BoolVar(&o.metadataOnly, "metadata-only", false, "compare types, modes, owners, sizes, devices, and symlink targets, but not file content")
+		fs.BoolVar(&o.ignoreOwner, "ignore-owner", false, "don't compare owners, for a directory extracted without root")
+		fs.BoolVar(&o.modTimes, "mtime", false, "also compare modification times, which extraction does not always keep")
+		report := fs.String("report", "", "write the differences as JSON to `file` (- for stdout)")
+		return func(args []string) error {
+			if err := wantArgs(args, 2); err != nil {
+				return err
+			}
+			r, err := image.open(args[0])
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			root, err := os.OpenRoot(args[1])
+			if err != nil {
+				return err
+			}
+			defer root.Close()
+
+			rep, err := o.run(r, root)
+			if err != nil {
+				return err
+			}
+			if *report != "" {
+				if err := writeJSON(*report, rep); err != nil {
+					return outputError(err)
+				}
+			}
+			if *report != "-" {
+				for _, d := range rep.Drift {
+					fmt.Println(d)
+				}
+				fmt.Printf("%d entries, %d differences\n", rep.Entries, len(rep.Drift))
+			}
+			if len(rep.Drift) > 0 {
+				return verificationError(fmt.Errorf("%s has drifted from the image", args[1]))
+			}
+			return nil
+		}
+	},
+}
+
+// dirCheck compares the merged view of an image with a directory.
+type dirCheck struct {
+	exclude      []string // path.Match patterns
+	metadataOnly bool
+	ignoreOwner  bool
+	modTimes     bool
+}
+
+// dirReport is the outcome of a dirCheck, as -report writes it.
+type dirReport struct {
+	Image   string  `json:"image"` // manifest digest
+	Entries int     `json:"entries"`
+	Drift   []drift `json:"drift"`
+}
+
+// drift is one difference between the image and the directory. Image and
+// Dir hold the differing values, and are empty for missing and extra
+// entries.
+type drift struct {
+	Path  string `json:"path"`
+	Kind  string `json:"kind"` // missing, extra, type, mode, owner, size, content, target, device, mtime, or error
+	Image string `json:"image,omitempty"`
+	Dir   string `json:"dir,omitempty"`
+}
+
+func (d drift) String() string {
+	switch d.Kind {
+	case "missing":
+		return fmt.Sprintf("%s: missing from the directory", d.Path)
+	case "extra":
+		return fmt.Sprintf("%s: not in the image", d.Path)
+	case "error":
+		return fmt.Sprintf("%s: %s", d.Path, d.Dir)
+	}
+	return fmt.Sprintf("%s: %s differs: image %s, directory %s", d.Path, d.Kind, d.Image, d.Dir)
+}
+
+// run compares every entry of r with its counterpart in root, then walks
+// root for entries the image doesn't have. Extra directories are reported
+// once, without what is below them.
+func (o *dirCheck) run(r *oci.Reader, root *os.Root) (*dirReport, error) {
+	rep := &dirReport{Image: r.Descriptor().Digest.String(), Drift: []drift{}}
+	seen := make(map[string]bool)
+	for hdr, content := range r.Entries() {
+		name := inTree(hdr.Name)
+		if o.excluded(name) {
+			continue
+		}
+		seen[name] = true
+		rep.Entries++
+		if err := o.compare(rep, root, name, hdr, content); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.Err(); err != nil {
+		return nil, fmt.Errorf("read OCI entry: %w", err)
+	}
+
+	err := fs.WalkDir(root.FS(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			rep.add(name, "error", "", err.Error())
+			return nil
+		}
+		if name == "." {
+			return nil
+		}
+		switch {
+		case o.excluded(name):
+		case !seen[name]:
+			rep.add(name, "extra", "", "")
+		default:
+			return nil
+		}
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	return rep, err
+}
+
+func (rep *dirReport) add(name, kind, image, dir string) {
+	rep.Drift = append(rep.Drift, drift{Path: name, Kind: kind, Image: image, Dir: dir})
+}
+
+// excluded reports whether p or one of its parents matches an exclude
+// pattern.
+func (o *dirCheck) excluded(p string) bool {
+	for ; p != "."; p = path.Dir(p) {
+		for _, pat := range o.exclude {
+			if ok, _ := path.Match(pat, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compare checks the entry name of root against hdr, reading the content of
+// regular files from content.
+func (o *dirCheck) compare(rep *dirReport, root *os.Root, name string, hdr *tar.Header, content io.Reader) error {
+	fi, err := root.Lstat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		rep.add(name, "missing", "", "")
+		return nil
+	}
+	if err != nil {
+		rep.add(name, "error", "", err.Error())
+		return nil
+	}
+	want, got := entryKind(hdr.Typeflag), fileKind(fi.Mode())
+	if want != got {
+		rep.add(name, "type", want, got)
+		return nil
+	}
+	var link string
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		if link, err = root.Readlink(name); err != nil {
+			rep.add(name, "error", "", err.Error())
+			return nil
+		}
+	}
+	dh, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		rep.add(name, "error", "", err.Error())
+		return nil
+	}
+
+	if want, got := hdr.Mode&0o7777, dh.Mode&0o7777; want != got && hdr.Typeflag != tar.TypeSymlink {
+		rep.add(name, "mode", fmt.Sprintf("%04o", want), fmt.Sprintf("%04o", got))
+	}
+	if !o.ignoreOwner && (hdr.Uid != dh.Uid || hdr.Gid != dh.Gid) {
+		rep.add(name, "owner", fmt.Sprintf("%d:%d", hdr.Uid, hdr.Gid), fmt.Sprintf("%d:%d", dh.Uid, dh.Gid))
+	}
+	if o.modTimes && hdr.ModTime.Unix() != dh.ModTime.Unix() {
+		rep.add(name, "mtime", hdr.ModTime.UTC().Format("2006-01-02T15:04:05Z"), dh.ModTime.UTC().Format("2006-01-02T15:04:05Z"))
+	}
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		if hdr.Linkname != link {
+			rep.add(name, "target", strconv.Quote(hdr.Linkname), strconv.Quote(link))
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		if hdr.Devmajor != dh.Devmajor || hdr.Devminor != dh.Devminor {
+			rep.add(name, "device", fmt.Sprintf("%d,%d", hdr.Devmajor, hdr.Devminor), fmt.Sprintf("%d,%d", dh.Devmajor, dh.Devminor))
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		if hdr.Size != fi.Size() {
+			rep.add(name, "size", strconv.FormatInt(hdr.Size, 10), strconv.FormatInt(fi.Size(), 10))
+			return nil
+		}
+		if o.metadataOnly {
+			return nil
+		}
+		return compareContent(rep, root, name, hdr.Size, content)
+	}
+	return nil
+}
+
+// compareContent compares the sha256 of the file name of root with that of
+// the size bytes of content.
+func compareContent(rep *dirReport, root *os.Root, name string, size int64, content io.Reader) error {
+	hi := sha256.New()
+	if _, err := io.CopyN(hi, content, size); err != nil {
+		return fmt.Errorf("read %q from the image: %w", name, err)
+	}
+	f, err := root.Open(name)
+	if err != nil {
+		rep.add(name, "error", "", err.Error())
+		return nil
+	}
+	defer f.Close()
+	hd := sha256.New()
+	if _, err := io.Copy(hd, f); err != nil {
+		rep.add(name, "error", "", err.Error())
+		return nil
+	}
+	if si, sd := hi.Sum(nil), hd.Sum(nil); string(si) != string(sd) {
+		rep.add(name, "content", fmt.Sprintf("sha256:%x", si), fmt.Sprintf("sha256:%x", sd))
+	}
+	return nil
+}
+
+// entryKind names the type of a tar entry as fileKind names file modes.
+func entryKind(t byte) string {
+	switch t {
+	case tar.TypeReg, tar.TypeRegA:
+		return "file"
+	case tar.TypeDir:
+		return "directory"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeChar:
+		return "char device"
+	case tar.TypeBlock:
+		return "block device"
+	case tar.TypeFifo:
+		return "fifo"
+	default:
+		return fmt.Sprintf("type %q", t)
+	}
+}
+
+func fileKind(m fs.FileMode) string {
+	switch {
+	case m.IsRegular():
+		return "file"
+	case m.IsDir():
+		return "directory"
+	case m&fs.ModeSymlink != 0:
+		return "symlink"
+	case m&fs.ModeCharDevice != 0:
+		return "char device"
+	case m&fs.ModeDevice != 0:
+		return "block device"
+	case m&fs.ModeNamedPipe != 0:
+		return "fifo"
+	case m&fs.ModeSocket != 0:
+		return "socket"
+	default:
+		return "irregular file"
+	}
+}
+
+// inTree cleans a path, relative to the root or absolute, that may climb
+// above the root, which ".." can't.
+func inTree(p string) string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return "."
+	}
+	return p[1:]
+}
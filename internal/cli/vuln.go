@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/hxtk/ember/pkg/pkgdb"
+	"github.com/hxtk/ember/pkg/vuln"
+)
+
+// vulnGate collects the packages recorded in the package databases build
+// writes and checks them against a vulnerability list, for -vuln-list.
+type vulnGate struct {
+	advisories []vuln.Advisory
+	pkgs       []pkgdb.Package
+	databases  int // package databases read
+	matches    []vuln.Match
+}
+
+// newVulnGate returns a gate for the vulnerability list in the file name,
+// or nil if name is empty.
+func newVulnGate(name string) (*vulnGate, error) {
+	if name == "" {
+		return nil, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	advs, err := vuln.Read(f)
+	if err != nil {
+		return nil, err
+	}
+	return &vulnGate{advisories: advs}, nil
+}
+
+// hook is a convert.EntryHook reading package databases.
+func (g *vulnGate) hook(hdr *tar.Header, content io.Reader) error {
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	manager := pkgdb.Manager(hdr.Name)
+	if manager == "" {
+		return nil
+	}
+	pkgs, err := pkgdb.Parse(manager, content)
+	if errors.Is(err, pkgdb.ErrUnsupported) {
+		log.Printf("warning: %s: %v; its packages are not checked", hdr.Name, err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read package database %s: %w", hdr.Name, err)
+	}
+	g.pkgs = append(g.pkgs, pkgs...)
+	g.databases++
+	return nil
+}
+
+// check matches the packages against the list once the archive is
+// written. It fails if any package is affected.
+func (g *vulnGate) check() error {
+	if g == nil {
+		return nil
+	}
+	if g.databases == 0 {
+		log.Printf("warning: -vuln-list: the image has no readable package database")
+	}
+	g.matches = vuln.Check(g.pkgs, g.advisories)
+	for _, m := range g.matches {
+		log.Printf("%s: %s %s (%s)", m.Advisory, m.Package.Name, m.Package.Version, m.Package.Manager)
+	}
+	if n := len(g.matches); n > 0 {
+		return verificationError(fmt.Errorf("%d installed package(s) match the vulnerability list", n))
+	}
+	return nil
+}
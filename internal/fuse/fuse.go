@@ -0,0 +1,564 @@
+//go:build linux && fuse
+
+// Package fuse serves an fs.FS read-only through the Linux FUSE protocol.
+//
+// It speaks the kernel protocol directly over /dev/fuse and implements only
+// the requests a read-only filesystem needs; everything else fails with
+// ENOSYS, which the kernel treats as "not supported" and stops sending.
+//
+// It is built only with the fuse build tag, as are ember mount and
+// embermount: go build -tags fuse, or bazel build
+// --@rules_go//go/config:tags=fuse.
+package fuse
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Options configure a mount.
+type Options struct {
+	Name       string // shown as the mount's source, e.g. in /proc/mounts
+	AllowOther bool   // let users other than the one mounting access it
+}
+
+// Server serves an fs.FS on a mount point.
+type Server struct {
+	dir  string
+	dev  *os.File
+	fsys fs.FS
+
+	// The inode cache. The filesystem is immutable, so an inode and its
+	// attributes, once looked up, stay valid for as long as it is mounted
+	// and are never evicted: FORGET requests are ignored.
+	inodes []*inode          // by node ID - 1
+	byPath map[string]uint64 // node IDs
+
+	handles map[uint64]any // open files and directory listings
+	nextFH  uint64
+
+	unmount sync.Once
+}
+
+type inode struct {
+	path string
+	attr []byte // encoded fuse_attr
+	mode fs.FileMode
+}
+
+// cacheTimeout is how long the kernel may cache entries and attributes.
+const cacheTimeout = time.Hour
+
+const (
+	maxWrite = 128 << 10
+	bufSize  = maxWrite + 4096
+)
+
+// Mount mounts fsys read-only on dir. fsys must implement fs.ReadLinkFS for
+// symbolic links to be listed as such. Mounting needs CAP_SYS_ADMIN or
+// the fusermount3 helper.
+func Mount(dir string, fsys fs.FS, opts Options) (*Server, error) {
+	if opts.Name == "" {
+		opts.Name = "ember"
+	}
+	dev, err := mount(dir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("mount %s: %w", dir, err)
+	}
+	s := &Server{
+		dir:     dir,
+		dev:     dev,
+		fsys:    fsys,
+		byPath:  make(map[string]uint64),
+		handles: make(map[uint64]any),
+	}
+	if _, err := s.lookup("."); err != nil {
+		s.Unmount()
+		return nil, err
+	}
+	return s, nil
+}
+
+// mount mounts the FUSE filesystem and returns the /dev/fuse connection.
+func mount(dir string, opts Options) (*os.File, error) {
+	dev, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	data := fmt.Sprintf("fd=%d,rootmode=40000,user_id=%d,group_id=%d,default_permissions", dev.Fd(), os.Getuid(), os.Getgid())
+	if opts.AllowOther {
+		data += ",allow_other"
+	}
+	err = syscall.Mount(opts.Name, dir, "fuse.ember", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, data)
+	if err == nil {
+		return dev, nil
+	}
+	dev.Close()
+	if err != syscall.EPERM {
+		return nil, err
+	}
+	return fusermount(dir, opts)
+}
+
+// fusermount mounts through the setuid fusermount3 helper, which passes
+// the /dev/fuse connection back over a socket.
+func fusermount(dir string, opts Options) (*os.File, error) {
+	bin, err := exec.LookPath("fusermount3")
+	if err != nil {
+		return nil, errors.New("permission denied, and fusermount3 is not installed")
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	local, remote := os.NewFile(uintptr(fds[0]), "fusermount"), os.NewFile(uintptr(fds[1]), "fusermount")
+	defer local.Close()
+
+	o := "ro,nosuid,nodev,default_permissions,subtype=ember,fsname=" + opts.Name
+	if opts.AllowOther {
+		o += ",allow_other"
+	}
+	cmd := exec.Command(bin, "-o", o, "--", dir)
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	remote.Close()
+	if err != nil {
+		return nil, fmt.Errorf("fusermount3: %w", err)
+	}
+
+	buf, oob := make([]byte, 1), make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(fds[0], buf, oob, 0)
+	if err != nil {
+		return nil, fmt.Errorf("fusermount3: %w", err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) == 0 {
+		return nil, errors.New("fusermount3 did not pass a connection")
+	}
+	rights, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(rights) == 0 {
+		return nil, errors.New("fusermount3 did not pass a connection")
+	}
+	return os.NewFile(uintptr(rights[0]), "/dev/fuse"), nil
+}
+
+// Unmount unmounts the filesystem, which makes Serve return. It is safe to
+// call more than once and from another goroutine.
+func (s *Server) Unmount() error {
+	var err error
+	s.unmount.Do(func() {
+		if err = syscall.Unmount(s.dir, 0); err == syscall.EPERM {
+			err = exec.Command("fusermount3", "-u", "--", s.dir).Run()
+		}
+	})
+	return err
+}
+
+// Serve answers kernel requests until the filesystem is unmounted.
+func (s *Server) Serve() error {
+	defer s.dev.Close()
+	buf := make([]byte, bufSize)
+	for {
+		n, err := s.dev.Read(buf)
+		switch {
+		case errors.Is(err, syscall.ENODEV):
+			return nil // unmounted
+		case errors.Is(err, syscall.EINTR), errors.Is(err, syscall.ENOENT):
+			continue // the request was interrupted
+		case err != nil:
+			return err
+		}
+		if n < inHeaderLen {
+			return fmt.Errorf("short request of %d bytes", n)
+		}
+		if err := s.handle(buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+// Request opcodes, from linux/fuse.h.
+const (
+	opLookup      = 1
+	opForget      = 2
+	opGetattr     = 3
+	opReadlink    = 5
+	opOpen        = 14
+	opRead        = 15
+	opStatfs      = 17
+	opRelease     = 18
+	opInit        = 26
+	opOpendir     = 27
+	opReaddir     = 28
+	opReleasedir  = 29
+	opInterrupt   = 36
+	opDestroy     = 38
+	opBatchForget = 42
+)
+
+const (
+	inHeaderLen  = 40
+	outHeaderLen = 16
+
+	protoMajor = 7
+	protoMinor = 31
+
+	fopenKeepCache = 1 << 1
+)
+
+var le = binary.LittleEndian
+
+// handle answers the request in buf.
+func (s *Server) handle(buf []byte) error {
+	op := le.Uint32(buf[4:])
+	unique := le.Uint64(buf[8:])
+	node := le.Uint64(buf[16:])
+	in := buf[inHeaderLen:]
+
+	var out []byte
+	var errno syscall.Errno
+	switch op {
+	case opForget, opBatchForget, opInterrupt:
+		return nil // these get no reply
+	case opInit:
+		out, errno = s.init(in)
+	case opLookup:
+		out, errno = s.opLookup(node, in)
+	case opGetattr:
+		out, errno = s.getattr(node)
+	case opReadlink:
+		out, errno = s.readlink(node)
+	case opOpen, opOpendir:
+		out, errno = s.open(node, op == opOpendir)
+	case opRead:
+		out, errno = s.read(in)
+	case opReaddir:
+		out, errno = s.readdir(node, in)
+	case opRelease, opReleasedir:
+		s.release(le.Uint64(in))
+	case opStatfs:
+		out = make([]byte, 80)
+		le.PutUint32(out[40:], 4096) // bsize
+		le.PutUint32(out[44:], 255)  // namelen
+		le.PutUint32(out[48:], 4096) // frsize
+	case opDestroy:
+	default:
+		errno = syscall.ENOSYS
+	}
+	return s.reply(unique, out, errno)
+}
+
+func (s *Server) reply(unique uint64, out []byte, errno syscall.Errno) error {
+	if errno != 0 {
+		out = nil
+	}
+	msg := make([]byte, outHeaderLen+len(out))
+	le.PutUint32(msg[0:], uint32(len(msg)))
+	le.PutUint32(msg[4:], uint32(-int32(errno)))
+	le.PutUint64(msg[8:], unique)
+	copy(msg[outHeaderLen:], out)
+	_, err := s.dev.Write(msg)
+	if errors.Is(err, syscall.ENOENT) {
+		return nil // the request was interrupted in the meantime
+	}
+	return err
+}
+
+func (s *Server) init(in []byte) ([]byte, syscall.Errno) {
+	if len(in) < 16 || le.Uint32(in) != protoMajor {
+		return nil, syscall.EPROTO
+	}
+	out := make([]byte, 64)
+	le.PutUint32(out[0:], protoMajor)
+	le.PutUint32(out[4:], protoMinor)
+	le.PutUint32(out[8:], le.Uint32(in[8:])) // max_readahead
+	le.PutUint32(out[20:], maxWrite)
+	le.PutUint32(out[24:], 1) // time_gran
+	return out, 0
+}
+
+// lookup returns the node ID of p, adding it to the inode cache.
+func (s *Server) lookup(p string) (uint64, error) {
+	if id, ok := s.byPath[p]; ok {
+		return id, nil
+	}
+	fi, err := fs.Lstat(s.fsys, p)
+	if err != nil {
+		return 0, err
+	}
+	s.inodes = append(s.inodes, &inode{path: p, mode: fi.Mode()})
+	id := uint64(len(s.inodes))
+	s.inodes[id-1].attr = encodeAttr(id, fi)
+	s.byPath[p] = id
+	return id, nil
+}
+
+func (s *Server) inode(id uint64) *inode {
+	if id == 0 || id > uint64(len(s.inodes)) {
+		return nil
+	}
+	return s.inodes[id-1]
+}
+
+func (s *Server) opLookup(parent uint64, in []byte) ([]byte, syscall.Errno) {
+	dir := s.inode(parent)
+	if dir == nil {
+		return nil, syscall.ESTALE
+	}
+	name := string(in)
+	if i := len(name) - 1; i >= 0 && name[i] == 0 {
+		name = name[:i]
+	}
+	out := make([]byte, 40+attrLen)
+	putTimeout(out[16:], out[32:]) // entry_valid
+	putTimeout(out[24:], out[36:]) // attr_valid
+	id, err := s.lookup(path.Join(dir.path, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return out, 0 // node ID 0 lets the kernel cache the absence
+	}
+	if err != nil {
+		return nil, errno(err)
+	}
+	le.PutUint64(out[0:], id)
+	copy(out[40:], s.inode(id).attr)
+	return out, 0
+}
+
+func (s *Server) getattr(id uint64) ([]byte, syscall.Errno) {
+	n := s.inode(id)
+	if n == nil {
+		return nil, syscall.ESTALE
+	}
+	out := make([]byte, 16+attrLen)
+	putTimeout(out[0:], out[8:])
+	copy(out[16:], n.attr)
+	return out, 0
+}
+
+func (s *Server) readlink(id uint64) ([]byte, syscall.Errno) {
+	n := s.inode(id)
+	if n == nil {
+		return nil, syscall.ESTALE
+	}
+	target, err := fs.ReadLink(s.fsys, n.path)
+	if err != nil {
+		return nil, errno(err)
+	}
+	return []byte(target), 0
+}
+
+// dirHandle is an open directory: its listing, taken at OPENDIR.
+type dirHandle struct {
+	entries []fs.DirEntry
+}
+
+func (s *Server) open(id uint64, dir bool) ([]byte, syscall.Errno) {
+	n := s.inode(id)
+	if n == nil {
+		return nil, syscall.ESTALE
+	}
+	var h any
+	if dir {
+		entries, err := fs.ReadDir(s.fsys, n.path)
+		if err != nil {
+			return nil, errno(err)
+		}
+		h = &dirHandle{entries}
+	} else {
+		f, err := s.fsys.Open(n.path)
+		if err != nil {
+			return nil, errno(err)
+		}
+		h = f
+	}
+	s.nextFH++
+	s.handles[s.nextFH] = h
+	out := make([]byte, 16)
+	le.PutUint64(out[0:], s.nextFH)
+	le.PutUint32(out[8:], fopenKeepCache)
+	return out, 0
+}
+
+func (s *Server) release(fh uint64) {
+	if f, ok := s.handles[fh].(fs.File); ok {
+		f.Close()
+	}
+	delete(s.handles, fh)
+}
+
+func (s *Server) read(in []byte) ([]byte, syscall.Errno) {
+	if len(in) < 24 {
+		return nil, syscall.EINVAL
+	}
+	fh, off, size := le.Uint64(in[0:]), int64(le.Uint64(in[8:])), min(le.Uint32(in[16:]), maxWrite)
+	f, ok := s.handles[fh].(fs.File)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	buf := make([]byte, size)
+	var n int
+	var err error
+	switch f := f.(type) {
+	case io.ReaderAt:
+		n, err = f.ReadAt(buf, off)
+	case io.ReadSeeker:
+		if _, err = f.Seek(off, io.SeekStart); err == nil {
+			n, err = io.ReadFull(f, buf)
+		}
+	default:
+		return nil, syscall.ENOSYS
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, errno(err)
+	}
+	return buf[:n], 0
+}
+
+func (s *Server) readdir(id uint64, in []byte) ([]byte, syscall.Errno) {
+	if len(in) < 24 {
+		return nil, syscall.EINVAL
+	}
+	fh, off, size := le.Uint64(in[0:]), le.Uint64(in[8:]), int(le.Uint32(in[16:]))
+	d, ok := s.handles[fh].(*dirHandle)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	dir := s.inode(id)
+	if dir == nil {
+		return nil, syscall.ESTALE
+	}
+
+	// Offsets 0 and 1 are "." and "..", then the entries in order.
+	var out []byte
+	for i := off; i < uint64(len(d.entries))+2; i++ {
+		var name string
+		var ino uint64
+		var mode fs.FileMode
+		switch i {
+		case 0:
+			name, ino, mode = ".", id, fs.ModeDir
+		case 1:
+			name, ino, mode = "..", 0, fs.ModeDir
+			if pid, ok := s.byPath[path.Dir(dir.path)]; ok && dir.path != "." {
+				ino = pid
+			}
+		default:
+			e := d.entries[i-2]
+			name, mode = e.Name(), e.Type()
+			ino, _ = s.lookup(path.Join(dir.path, name))
+		}
+		rec := make([]byte, (24+len(name)+7)&^7)
+		if len(out)+len(rec) > size {
+			break
+		}
+		le.PutUint64(rec[0:], ino)
+		le.PutUint64(rec[8:], i+1)
+		le.PutUint32(rec[16:], uint32(len(name)))
+		le.PutUint32(rec[20:], unixMode(mode)>>12)
+		copy(rec[24:], name)
+		out = append(out, rec...)
+	}
+	return out, 0
+}
+
+const attrLen = 88
+
+// encodeAttr encodes fi as a fuse_attr. Ownership and device numbers come
+// from fi.Sys if it is a *tar.Header; otherwise files belong to root.
+func encodeAttr(id uint64, fi fs.FileInfo) []byte {
+	b := make([]byte, attrLen)
+	var size int64
+	h, _ := fi.Sys().(*tar.Header)
+	switch {
+	case fi.Mode().IsRegular():
+		size = fi.Size()
+	case fi.Mode()&fs.ModeSymlink != 0 && h != nil:
+		size = int64(len(h.Linkname))
+	}
+	mtime := fi.ModTime()
+	le.PutUint64(b[0:], id)
+	le.PutUint64(b[8:], uint64(size))
+	le.PutUint64(b[16:], uint64((size+511)/512))
+	for _, off := range []int{24, 32, 40} { // atime, mtime, ctime
+		le.PutUint64(b[off:], uint64(mtime.Unix()))
+		le.PutUint32(b[48+(off-24)/2:], uint32(mtime.Nanosecond()))
+	}
+	le.PutUint32(b[60:], unixMode(fi.Mode()))
+	nlink := uint32(1)
+	if fi.IsDir() {
+		nlink = 2
+	}
+	le.PutUint32(b[64:], nlink)
+	if h != nil {
+		le.PutUint32(b[68:], uint32(h.Uid))
+		le.PutUint32(b[72:], uint32(h.Gid))
+		major, minor := uint32(h.Devmajor), uint32(h.Devminor)
+		le.PutUint32(b[76:], minor&0xff|major<<8|(minor&^0xff)<<12)
+	}
+	le.PutUint32(b[80:], 4096) // blksize
+	return b
+}
+
+func putTimeout(sec, nsec []byte) {
+	le.PutUint64(sec, uint64(cacheTimeout/time.Second))
+	le.PutUint32(nsec, 0)
+}
+
+// unixMode converts m to a st_mode.
+func unixMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	switch {
+	case m.IsDir():
+		mode |= syscall.S_IFDIR
+	case m&fs.ModeSymlink != 0:
+		mode |= syscall.S_IFLNK
+	case m&fs.ModeCharDevice != 0:
+		mode |= syscall.S_IFCHR
+	case m&fs.ModeDevice != 0:
+		mode |= syscall.S_IFBLK
+	case m&fs.ModeNamedPipe != 0:
+		mode |= syscall.S_IFIFO
+	case m&fs.ModeSocket != 0:
+		mode |= syscall.S_IFSOCK
+	default:
+		mode |= syscall.S_IFREG
+	}
+	return mode
+}
+
+// errno maps err to the errno to reply with.
+func errno(err error) syscall.Errno {
+	var e syscall.Errno
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, fs.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, fs.ErrPermission):
+		return syscall.EACCES
+	case errors.Is(err, fs.ErrInvalid):
+		return syscall.EINVAL
+	}
+	return syscall.EIO
+}
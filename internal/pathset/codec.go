@@ -0,0 +1,49 @@
+package pathset
+
+import (
+	"encoding/binary"
+	"encoding/json"
+)
+
+// Strings is the Codec of string values.
+var Strings = Codec[string]{
+	Append: func(b []byte, v string) []byte { return append(b, v...) },
+	Decode: func(b []byte) (string, error) { return string(b), nil },
+	Size:   func(v string) int64 { return int64(len(v)) },
+}
+
+// Ints is the Codec of int values.
+var Ints = Codec[int]{
+	Append: func(b []byte, v int) []byte { return binary.AppendVarint(b, int64(v)) },
+	Decode: func(b []byte) (int, error) {
+		v, n := binary.Varint(b)
+		if n <= 0 {
+			return 0, errCorrupt
+		}
+		return int(v), nil
+	},
+}
+
+// JSON returns a Codec writing values as JSON, and counting the memory of
+// each as twice its length in JSON, for values such as structs of strings
+// and maps whose memory is hard to tell otherwise.
+func JSON[V any]() Codec[V] {
+	return Codec[V]{
+		Append: func(b []byte, v V) []byte {
+			j, err := json.Marshal(v)
+			if err != nil {
+				panic(err) // the values are of types that always marshal
+			}
+			return append(b, j...)
+		},
+		Decode: func(b []byte) (V, error) {
+			var v V
+			err := json.Unmarshal(b, &v)
+			return v, err
+		},
+		Size: func(v V) int64 {
+			j, _ := json.Marshal(v)
+			return 2 * int64(len(j))
+		},
+	}
+}
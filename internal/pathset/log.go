@@ -0,0 +1,144 @@
+package pathset
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"iter"
+	"os"
+)
+
+// Log is a list of values of type V, appended to and read in order, with
+// its memory use bounded by a Budget: once the budget makes it spill, what
+// it holds in memory is appended to a temporary file.
+//
+// The zero Log is not usable; use NewLog.
+type Log[V any] struct {
+	budget *Budget
+	codec  Codec[V]
+	mem    []V
+	size   int64 // approximate memory used by mem
+	f      *os.File
+	off    int64 // end of what is in f
+	n      int
+}
+
+// logOverhead approximates the per-value cost of the slice of a Log beyond
+// what its codec counts.
+const logOverhead = 16
+
+// NewLog returns an empty list under b, whose values c writes to its file.
+// A nil b keeps the list in memory.
+func NewLog[V any](b *Budget, c Codec[V]) *Log[V] {
+	if b == nil {
+		b = NewBudget(0)
+	}
+	l := &Log[V]{budget: b, codec: c}
+	b.join(l)
+	return l
+}
+
+// Append appends v to the list.
+func (l *Log[V]) Append(v V) {
+	l.mem = append(l.mem, v)
+	l.n++
+	if l.budget.limit == 0 {
+		return // nothing to count against
+	}
+	n := l.codec.size(v) + logOverhead
+	l.size += n
+	l.budget.grow(n)
+}
+
+// Len returns the number of values in the list.
+func (l *Log[V]) Len() int {
+	return l.n
+}
+
+// All returns the values of the list in the order they were appended. A
+// value that fails to read back stops the sequence; Err tells of it.
+// Values appended while the sequence is read are not in it.
+func (l *Log[V]) All() iter.Seq[V] {
+	f, end, mem := l.f, l.off, l.mem
+	return func(yield func(V) bool) {
+		if f != nil {
+			br := bufio.NewReader(io.NewSectionReader(f, 0, end))
+			for {
+				n, err := binary.ReadUvarint(br)
+				if err == io.EOF {
+					break
+				}
+				b := make([]byte, n)
+				if err == nil {
+					_, err = io.ReadFull(br, b)
+				}
+				var v V
+				if err == nil {
+					v, err = l.codec.Decode(b)
+				}
+				if err != nil {
+					l.budget.fail(errors.Join(errCorrupt, err))
+					return
+				}
+				if !yield(v) {
+					return
+				}
+			}
+		}
+		for _, v := range mem {
+			if !yield(v) {
+				return
+			}
+		}
+	}
+}
+
+// Err returns the first failure of the list's budget, see Budget.Err.
+func (l *Log[V]) Err() error {
+	return l.budget.Err()
+}
+
+// Close removes the list's temporary file and takes it out of its budget.
+// The list is empty afterwards.
+func (l *Log[V]) Close() error {
+	var err error
+	if l.f != nil {
+		err = l.f.Close()
+	}
+	l.budget.leave(l, l.size)
+	l.f, l.off, l.mem, l.size, l.n = nil, 0, nil, 0, 0
+	return err
+}
+
+func (l *Log[V]) memSize() int64 { return l.size }
+
+// spill appends the values in memory to the file.
+func (l *Log[V]) spill() error {
+	if l.f == nil {
+		f, err := os.CreateTemp("", "ember-list-")
+		if err != nil {
+			return err
+		}
+		os.Remove(f.Name()) // see newRunWriter
+		l.f = f
+	}
+	bw := bufio.NewWriter(io.NewOffsetWriter(l.f, l.off))
+	var buf []byte
+	var off int64
+	for _, v := range l.mem {
+		buf = l.codec.Append(buf[:0], v)
+		var n [binary.MaxVarintLen64]byte
+		m := binary.PutUvarint(n[:], uint64(len(buf)))
+		bw.Write(n[:m])
+		bw.Write(buf)
+		off += int64(m + len(buf))
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	l.off += off
+	l.budget.used -= l.size
+	l.mem, l.size = nil, 0
+	return nil
+}
@@ -0,0 +1,370 @@
+package pathset
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+)
+
+// Map maps paths to values of type V, with its memory use bounded by a
+// Budget.
+//
+// Entries are kept in a Go map until the budget makes the Map spill. The
+// map is then written out, sorted, as a run in a temporary file and
+// cleared. Each run keeps only a Bloom filter of about 10 bits per path
+// and a sparse index of one key per runBlock paths in memory, so lookups
+// that miss every filter cost nothing and the others read a single block
+// from disk. Runs are merged as they pile up, the last two whenever the
+// newer holds as many paths as the older, so that a map holds
+// logarithmically many open files and filters to probe. A path put again
+// after it was spilled takes the new value.
+//
+// The zero Map is not usable; use NewMap.
+type Map[V any] struct {
+	budget *Budget
+	codec  Codec[V]
+	mem    map[string]V
+	size   int64 // approximate memory used by mem
+	runs   []*run
+}
+
+// Codec writes the values of a Map or Log to its files and reads them
+// back, and tells about how much memory a value takes, beyond the size of
+// the value type itself, which Size may leave nil if that is nothing.
+type Codec[V any] struct {
+	Append func(b []byte, v V) []byte
+	Decode func(b []byte) (V, error)
+	Size   func(v V) int64
+}
+
+func (c Codec[V]) size(v V) int64 {
+	if c.Size == nil {
+		return 0
+	}
+	return c.Size(v)
+}
+
+// runBlock is the number of paths per index entry of a run.
+const runBlock = 64
+
+// pathOverhead approximates the per-entry cost of a Go map[string]V
+// beyond the key's bytes and those a codec counts.
+const pathOverhead = 48
+
+// NewMap returns an empty map under b, whose values c writes to its files.
+// A nil b keeps the map in memory.
+func NewMap[V any](b *Budget, c Codec[V]) *Map[V] {
+	if b == nil {
+		b = NewBudget(0)
+	}
+	m := &Map[V]{budget: b, codec: c, mem: make(map[string]V)}
+	b.join(m)
+	return m
+}
+
+// Put sets the value of p to v.
+func (m *Map[V]) Put(p string, v V) {
+	old, ok := m.mem[p]
+	m.mem[p] = v
+	if m.budget.limit == 0 {
+		return // nothing to count against
+	}
+	n := m.codec.size(v)
+	if ok {
+		n -= m.codec.size(old)
+	} else {
+		n += int64(len(p)) + pathOverhead
+	}
+	m.size += n
+	m.budget.grow(n)
+}
+
+// Get returns the value of p, if it has one.
+func (m *Map[V]) Get(p string) (v V, ok bool) {
+	if v, ok := m.mem[p]; ok {
+		return v, true
+	}
+	for i := len(m.runs) - 1; i >= 0; i-- {
+		b, ok, err := m.runs[i].get(p)
+		if err != nil {
+			m.budget.fail(err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		v, err := m.codec.Decode(b)
+		if err != nil {
+			m.budget.fail(err)
+			continue
+		}
+		return v, true
+	}
+	return v, false
+}
+
+// Err returns the first failure of the map's budget, see Budget.Err.
+func (m *Map[V]) Err() error {
+	return m.budget.Err()
+}
+
+// Close removes the map's temporary files and takes it out of its budget.
+// The map is empty afterwards.
+func (m *Map[V]) Close() error {
+	var errs []error
+	for _, r := range m.runs {
+		errs = append(errs, r.f.Close())
+	}
+	m.budget.leave(m, m.size)
+	m.runs, m.mem, m.size = nil, make(map[string]V), 0
+	return errors.Join(errs...)
+}
+
+func (m *Map[V]) memSize() int64 { return m.size }
+
+// spill moves the in-memory entries to a new run, and merges runs.
+func (m *Map[V]) spill() error {
+	keys := make([]string, 0, len(m.mem))
+	for k := range m.mem {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w, err := newRunWriter(len(keys))
+	if err != nil {
+		return err
+	}
+	var buf []byte
+	for _, k := range keys {
+		buf = m.codec.Append(buf[:0], m.mem[k])
+		w.add(k, buf)
+	}
+	r, err := w.finish()
+	if err != nil {
+		return err
+	}
+	m.runs = append(m.runs, r)
+	m.budget.used -= m.size
+	m.mem = make(map[string]V)
+	m.size = 0
+
+	for n := len(m.runs); n >= 2 && m.runs[n-2].n <= m.runs[n-1].n; n = len(m.runs) {
+		r, err := merge(m.runs[n-2], m.runs[n-1])
+		if err != nil {
+			return err // both runs still serve lookups
+		}
+		m.runs[n-2].f.Close()
+		m.runs[n-1].f.Close()
+		m.runs = append(m.runs[:n-2], r)
+	}
+	return nil
+}
+
+// run is a sorted run of entries on disk. Entries are a uvarint length
+// followed by the path, and another followed by the value.
+type run struct {
+	f       *os.File
+	n       int // paths in the run
+	bloom   []uint64
+	index   []string // first path of each block
+	offsets []int64  // file offset of each block, plus the end of the file
+}
+
+// runWriter writes a run of entries given in path order.
+type runWriter struct {
+	r   *run
+	w   *bufio.Writer
+	off int64
+	buf [binary.MaxVarintLen64]byte
+}
+
+// newRunWriter starts a run for at most n paths, which size its filter.
+func newRunWriter(n int) (*runWriter, error) {
+	f, err := os.CreateTemp("", "ember-paths-")
+	if err != nil {
+		return nil, err
+	}
+	// The file is only reached through f; unlinking it now means it is
+	// cleaned up even if the process dies.
+	os.Remove(f.Name())
+	return &runWriter{r: &run{f: f, bloom: make([]uint64, (n*10+63)/64+1)}, w: bufio.NewWriter(f)}, nil
+}
+
+func (w *runWriter) add(k string, v []byte) {
+	r := w.r
+	if r.n%runBlock == 0 {
+		r.index = append(r.index, k)
+		r.offsets = append(r.offsets, w.off)
+	}
+	r.n++
+	r.addBloom(k)
+	w.write([]byte(k))
+	w.write(v)
+}
+
+func (w *runWriter) write(b []byte) {
+	n := binary.PutUvarint(w.buf[:], uint64(len(b)))
+	w.w.Write(w.buf[:n])
+	w.w.Write(b)
+	w.off += int64(n + len(b))
+}
+
+func (w *runWriter) finish() (*run, error) {
+	w.r.offsets = append(w.r.offsets, w.off)
+	if err := w.w.Flush(); err != nil {
+		w.r.f.Close()
+		return nil, err
+	}
+	return w.r, nil
+}
+
+// merge writes the entries of a and b to a new run, once each, with the
+// values of b, the newer, for the paths both have.
+func merge(a, b *run) (*run, error) {
+	w, err := newRunWriter(a.n + b.n)
+	if err != nil {
+		return nil, err
+	}
+	ra, rb := a.reader(), b.reader()
+	ka, va, okA, err := ra.next()
+	if err != nil {
+		w.r.f.Close()
+		return nil, err
+	}
+	kb, vb, okB, err := rb.next()
+	if err != nil {
+		w.r.f.Close()
+		return nil, err
+	}
+	for okA || okB {
+		switch {
+		case !okB || okA && ka < kb:
+			w.add(ka, va)
+			ka, va, okA, err = ra.next()
+		case !okA || kb < ka:
+			w.add(kb, vb)
+			kb, vb, okB, err = rb.next()
+		default: // both have it
+			w.add(kb, vb)
+			if ka, va, okA, err = ra.next(); err == nil {
+				kb, vb, okB, err = rb.next()
+			}
+		}
+		if err != nil {
+			w.r.f.Close()
+			return nil, err
+		}
+	}
+	return w.finish()
+}
+
+// runReader reads the entries of a run in order.
+type runReader struct {
+	br *bufio.Reader
+}
+
+func (r *run) reader() *runReader {
+	return &runReader{bufio.NewReader(io.NewSectionReader(r.f, 0, r.offsets[len(r.offsets)-1]))}
+}
+
+// next returns the next entry, or false at the end of the run.
+func (r *runReader) next() (string, []byte, bool, error) {
+	k, err := r.read()
+	if err == io.EOF {
+		return "", nil, false, nil
+	}
+	if err != nil {
+		return "", nil, false, err
+	}
+	v, err := r.read()
+	if err != nil {
+		return "", nil, false, errCorrupt
+	}
+	return string(k), v, true, nil
+}
+
+func (r *runReader) read() ([]byte, error) {
+	n, err := binary.ReadUvarint(r.br)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.br, b); err != nil {
+		return nil, errCorrupt
+	}
+	return b, nil
+}
+
+// bloomHashes derives the filter positions of p by double hashing.
+func (r *run) bloomHashes(p string, fn func(bit uint64)) {
+	h := fnv.New64a()
+	io.WriteString(h, p)
+	h1 := h.Sum64()
+	h2 := h1>>33 | h1<<31 | 1
+	bits := uint64(len(r.bloom)) * 64
+	for i := uint64(0); i < 7; i++ {
+		fn((h1 + i*h2) % bits)
+	}
+}
+
+func (r *run) addBloom(p string) {
+	r.bloomHashes(p, func(bit uint64) { r.bloom[bit/64] |= 1 << (bit % 64) })
+}
+
+// get returns the value of p in the run, if it has p.
+func (r *run) get(p string) ([]byte, bool, error) {
+	in := true
+	r.bloomHashes(p, func(bit uint64) {
+		if r.bloom[bit/64]&(1<<(bit%64)) == 0 {
+			in = false
+		}
+	})
+	if !in {
+		return nil, false, nil
+	}
+
+	// Find the last block starting at or before p.
+	i := sort.SearchStrings(r.index, p)
+	if i == len(r.index) || r.index[i] != p {
+		i--
+	}
+	if i < 0 {
+		return nil, false, nil
+	}
+	start, end := r.offsets[i], r.offsets[i+1]
+	block := make([]byte, end-start)
+	if _, err := r.f.ReadAt(block, start); err != nil {
+		return nil, false, err
+	}
+	for len(block) > 0 {
+		k, rest, ok := cut(block)
+		if !ok {
+			return nil, false, errCorrupt
+		}
+		v, rest, ok := cut(rest)
+		if !ok {
+			return nil, false, errCorrupt
+		}
+		if string(k) == p {
+			return v, true, nil
+		}
+		if string(k) > p {
+			break
+		}
+		block = rest
+	}
+	return nil, false, nil
+}
+
+// cut splits the uvarint-length-prefixed field at the start of b from the
+// rest.
+func cut(b []byte) (field, rest []byte, ok bool) {
+	n, m := binary.Uvarint(b)
+	if m <= 0 || uint64(len(b)-m) < n {
+		return nil, nil, false
+	}
+	return b[m : m+int(n)], b[m+int(n):], true
+}
@@ -0,0 +1,119 @@
+// Package pathset provides sets, maps, and lists keyed by or holding the
+// paths of an image, whose memory use can be bounded together, for
+// tracking every path of an image while merging or converting it.
+package pathset
+
+import (
+	"errors"
+)
+
+// Budget is the memory that a group of sets, maps, and lists share. When
+// what they hold in memory together grows past its limit, the largest of
+// them spills to temporary files until they fit again. The amounts are
+// estimates of per-entry costs, not measurements; what a spilled map keeps
+// in memory to find its entries on disk, about 2 bytes per entry, isn't
+// counted.
+//
+// A nil Budget, like a limit of 0, keeps everything in memory.
+type Budget struct {
+	limit   int64
+	used    int64
+	members map[member]struct{}
+	err     error // first spill or read failure of a member
+}
+
+// member is a set, map, or list under a Budget.
+type member interface {
+	memSize() int64 // bytes held in memory, 0 if it can't spill now
+	spill() error   // moves what is in memory to disk
+}
+
+// NewBudget returns a budget of about limit bytes.
+func NewBudget(limit int64) *Budget {
+	return &Budget{limit: limit, members: make(map[member]struct{})}
+}
+
+// Err returns the first failure of a member of b to spill to or read from
+// its temporary files. Entries a member failed to spill stay in memory,
+// but a failed read may have made a lookup miss an entry.
+func (b *Budget) Err() error {
+	if b == nil {
+		return nil
+	}
+	return b.err
+}
+
+func (b *Budget) join(m member) {
+	b.members[m] = struct{}{}
+}
+
+func (b *Budget) leave(m member, size int64) {
+	delete(b.members, m)
+	b.used -= size
+}
+
+// grow accounts for n more bytes in memory, spilling members until they
+// fit. Once a spill has failed, the members keep what they have in memory.
+func (b *Budget) grow(n int64) {
+	b.used += n
+	for b.limit > 0 && b.used > b.limit && b.err == nil {
+		var largest member
+		var size int64
+		for m := range b.members {
+			if s := m.memSize(); s > size {
+				largest, size = m, s
+			}
+		}
+		if largest == nil {
+			return
+		}
+		if err := largest.spill(); err != nil {
+			b.fail(err)
+		}
+	}
+}
+
+func (b *Budget) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Set is a set of paths whose memory use can be bounded by a Budget.
+type Set struct {
+	m *Map[struct{}]
+}
+
+// New returns an empty set under b.
+func New(b *Budget) *Set {
+	return &Set{NewMap(b, Codec[struct{}]{
+		Append: func(buf []byte, _ struct{}) []byte { return buf },
+		Decode: func([]byte) (struct{}, error) { return struct{}{}, nil },
+	})}
+}
+
+// Add adds p to the set.
+func (s *Set) Add(p string) {
+	if _, ok := s.m.mem[p]; !ok {
+		s.m.Put(p, struct{}{})
+	}
+}
+
+// Has reports whether p is in the set.
+func (s *Set) Has(p string) bool {
+	_, ok := s.m.Get(p)
+	return ok
+}
+
+// Err returns the first failure of the set's budget, see Budget.Err.
+func (s *Set) Err() error {
+	return s.m.Err()
+}
+
+// Close removes the set's temporary files and takes it out of its budget.
+// The set is empty afterwards.
+func (s *Set) Close() error {
+	return s.m.Close()
+}
+
+var errCorrupt = errors.New("corrupt path run")
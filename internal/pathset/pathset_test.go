@@ -0,0 +1,161 @@
+package pathset_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/internal/pathset"
+)
+
+func TestSet(t *testing.T) {
+	for _, limit := range []int64{0, 1 << 10} {
+		t.Run(fmt.Sprintf("limit=%d", limit), func(t *testing.T) {
+			s := pathset.New(pathset.NewBudget(limit))
+			defer s.Close()
+			const n = 5000
+			for i := 0; i < n; i++ {
+				s.Add(fmt.Sprintf("usr/lib/f%05d", i))
+				if i%7 == 0 {
+					s.Add(fmt.Sprintf("usr/lib/f%05d", i/2)) // again, maybe spilled
+				}
+			}
+			for i := 0; i < n; i++ {
+				if p := fmt.Sprintf("usr/lib/f%05d", i); !s.Has(p) {
+					t.Errorf("Has(%q) = false, want true", p)
+				}
+				if p := fmt.Sprintf("usr/lib/g%05d", i); s.Has(p) {
+					t.Errorf("Has(%q) = true, want false", p)
+				}
+			}
+			if err := s.Err(); err != nil {
+				t.Errorf("Err() = %v", err)
+			}
+		})
+	}
+}
+
+func TestSetClose(t *testing.T) {
+	s := pathset.New(pathset.NewBudget(1 << 10))
+	for i := 0; i < 1000; i++ {
+		s.Add(fmt.Sprintf("f%04d", i))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has("f0001") {
+		t.Error("Has(f0001) = true after Close, want false")
+	}
+}
+
+// A value put again replaces the one before it, spilled or not.
+func TestMap(t *testing.T) {
+	for _, limit := range []int64{0, 1 << 10} {
+		t.Run(fmt.Sprintf("limit=%d", limit), func(t *testing.T) {
+			m := pathset.NewMap(pathset.NewBudget(limit), pathset.Strings)
+			defer m.Close()
+			const n = 3000
+			for round := 0; round < 3; round++ {
+				for i := round; i < n; i += round + 1 {
+					m.Put(fmt.Sprintf("f%04d", i), fmt.Sprintf("v%d-%d", round, i))
+				}
+			}
+			for i := 0; i < n; i++ {
+				want := fmt.Sprintf("v0-%d", i)
+				for round := 1; round < 3; round++ {
+					if i >= round && (i-round)%(round+1) == 0 {
+						want = fmt.Sprintf("v%d-%d", round, i)
+					}
+				}
+				if v, ok := m.Get(fmt.Sprintf("f%04d", i)); !ok || v != want {
+					t.Errorf("Get(f%04d) = %q, %v, want %q", i, v, ok, want)
+				}
+			}
+			if _, ok := m.Get("g0001"); ok {
+				t.Error("Get(g0001) found a value")
+			}
+			if err := m.Err(); err != nil {
+				t.Errorf("Err() = %v", err)
+			}
+		})
+	}
+}
+
+func TestLog(t *testing.T) {
+	for _, limit := range []int64{0, 1 << 10} {
+		t.Run(fmt.Sprintf("limit=%d", limit), func(t *testing.T) {
+			type rec struct {
+				Name string
+				N    int
+			}
+			l := pathset.NewLog(pathset.NewBudget(limit), pathset.JSON[rec]())
+			defer l.Close()
+			var want []rec
+			for i := 0; i < 2000; i++ {
+				r := rec{fmt.Sprintf("f%d", i), i}
+				l.Append(r)
+				want = append(want, r)
+			}
+			if got := slices.Collect(l.All()); !slices.Equal(got, want) {
+				t.Errorf("All() gave %d values differing from the %d appended", len(got), len(want))
+			}
+			if l.Len() != len(want) {
+				t.Errorf("Len() = %d, want %d", l.Len(), len(want))
+			}
+			if err := l.Err(); err != nil {
+				t.Errorf("Err() = %v", err)
+			}
+		})
+	}
+}
+
+// The members of a budget spill so that together they keep within it, and
+// Close removes what they spilled.
+func TestBudget(t *testing.T) {
+	b := pathset.NewBudget(4 << 10)
+	small, large := pathset.New(b), pathset.New(b)
+	defer small.Close()
+	defer large.Close()
+	small.Add("small")
+	for i := 0; i < 5000; i++ {
+		large.Add(fmt.Sprintf("usr/share/large/f%05d", i))
+	}
+	files := openRuns(t)
+	for i := 0; i < 5000; i++ {
+		if !large.Has(fmt.Sprintf("usr/share/large/f%05d", i)) {
+			t.Fatalf("large lost f%05d", i)
+		}
+	}
+	if !small.Has("small") {
+		t.Error("small lost its path")
+	}
+	if files == 0 {
+		t.Error("nothing spilled")
+	}
+	small.Close()
+	large.Close()
+	if n := openRuns(t); n != 0 {
+		t.Errorf("%d run files open after Close", n)
+	}
+}
+
+// openRuns returns the number of temporary files of the package the
+// process has open, or skips the test where that can't be told.
+func openRuns(t *testing.T) int {
+	t.Helper()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("no /proc/self/fd")
+	}
+	n := 0
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		if err == nil && strings.Contains(target, "ember-") {
+			n++
+		}
+	}
+	return n
+}
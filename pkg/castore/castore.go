@@ -0,0 +1,247 @@
+// Package castore splits blobs into content-defined chunks, stores them in
+// a casync-compatible chunk store, and writes a casync blob index (.caibx)
+// describing how to reassemble them, so that similar archives share most of
+// their chunks in storage and in transfer.
+//
+// The store and index can be read by casync and desync, for example with
+// "desync extract -s <store> <index> <output>". Chunk boundaries are chosen
+// with a rolling hash over a 48-byte window, like casync, but with a hash
+// table of this package's own, so chunks dedupe against stores written by
+// this package rather than by casync.
+package castore
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+)
+
+// Default chunk sizes, the same as casync's.
+const (
+	DefaultMinSize = 16 << 10
+	DefaultAvgSize = 64 << 10
+	DefaultMaxSize = 256 << 10
+)
+
+// window is the number of bytes the rolling hash covers.
+const window = 48
+
+// ChunkID identifies a chunk by the SHA-512/256 digest of its content.
+type ChunkID [32]byte
+
+func (id ChunkID) String() string { return hex.EncodeToString(id[:]) }
+
+// Store is a casync chunk store in a local directory: chunk <id> is kept
+// zstd-framed in <dir>/<first 4 hex digits of id>/<id>.cacnk.
+type Store struct {
+	Dir string
+}
+
+// Path returns the file holding the chunk id.
+func (s Store) Path(id ChunkID) string {
+	h := id.String()
+	return filepath.Join(s.Dir, h[:4], h+".cacnk")
+}
+
+// put stores data as the chunk id unless the store already has it. It
+// reports whether the chunk was new.
+func (s Store) put(id ChunkID, data []byte) (bool, error) {
+	name := s.Path(id)
+	if _, err := os.Stat(name); err == nil {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return false, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return false, err
+	}
+	_, err = f.Write(zstdFrame(data))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return false, err
+	}
+	return true, nil
+}
+
+// zstdFrame wraps data in a zstd frame of uncompressed (raw) blocks, which
+// every zstd decoder reads, so the store needs no compressor.
+func zstdFrame(data []byte) []byte {
+	const maxBlock = 128 << 10
+	b := binary.LittleEndian.AppendUint32(nil, 0xFD2FB528)
+	// Frame header: single segment with an 8-byte content size, so no
+	// window descriptor is needed.
+	b = append(b, 0xE0)
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(data)))
+	for {
+		n := min(len(data), maxBlock)
+		hdr := uint32(n) << 3 // block type 0: raw
+		if n == len(data) {
+			hdr |= 1 // last block
+		}
+		b = append(b, byte(hdr), byte(hdr>>8), byte(hdr>>16))
+		b = append(b, data[:n]...)
+		data = data[n:]
+		if hdr&1 != 0 {
+			return b
+		}
+	}
+}
+
+// buzhash is the rolling hash's byte table, derived deterministically.
+var buzhash = func() (t [256]uint32) {
+	for i := range t {
+		sum := sha256.Sum256([]byte{'e', 'm', 'b', 'e', 'r', byte(i)})
+		t[i] = binary.LittleEndian.Uint32(sum[:])
+	}
+	return t
+}()
+
+// Writer chunks the blob written to it into a Store. Close flushes the
+// last chunk; the index is then available from WriteIndex.
+type Writer struct {
+	store         Store
+	min, avg, max int
+	discriminator uint32
+
+	buf    []byte // the current chunk
+	hash   uint32
+	chunks []indexEntry
+	size   uint64
+	new    int // chunks the store didn't have
+	err    error
+	closed bool
+}
+
+type indexEntry struct {
+	end uint64 // offset just past the chunk
+	id  ChunkID
+}
+
+// NewWriter returns a Writer cutting chunks of at least minSize and at most
+// maxSize bytes, averaging about avgSize.
+func NewWriter(store Store, minSize, avgSize, maxSize int) (*Writer, error) {
+	if minSize < window || minSize > avgSize || avgSize > maxSize {
+		return nil, fmt.Errorf("castore: want %d <= min <= avg <= max chunk size, got %d, %d, %d", window, minSize, avgSize, maxSize)
+	}
+	return &Writer{
+		store:         store,
+		min:           minSize,
+		avg:           avgSize,
+		max:           maxSize,
+		discriminator: discriminator(avgSize),
+		buf:           make([]byte, 0, maxSize),
+	}, nil
+}
+
+// discriminator is casync's modulus for chunk boundaries, chosen so that
+// chunks average avg bytes despite the minimum and maximum sizes.
+func discriminator(avg int) uint32 {
+	return uint32(float64(avg) / (-1.42888852e-7*float64(avg) + 1.33237515))
+}
+
+// Write implements io.Writer.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	for i, c := range p {
+		w.buf = append(w.buf, c)
+		n := len(w.buf)
+		w.hash = bits.RotateLeft32(w.hash, 1) ^ buzhash[c]
+		if n > window {
+			w.hash ^= bits.RotateLeft32(buzhash[w.buf[n-1-window]], window)
+		}
+		if n >= w.max || n >= w.min && w.hash%w.discriminator == w.discriminator-1 {
+			if err := w.cut(); err != nil {
+				return i + 1, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// cut stores the current chunk and starts the next one.
+func (w *Writer) cut() error {
+	id := ChunkID(sha512.Sum512_256(w.buf))
+	isNew, err := w.store.put(id, w.buf)
+	if err != nil {
+		w.err = fmt.Errorf("castore: store chunk %s: %w", id, err)
+		return w.err
+	}
+	if isNew {
+		w.new++
+	}
+	w.size += uint64(len(w.buf))
+	w.chunks = append(w.chunks, indexEntry{end: w.size, id: id})
+	w.buf, w.hash = w.buf[:0], 0
+	return nil
+}
+
+// Close stores the final chunk.
+func (w *Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.err == nil && len(w.buf) > 0 {
+		return w.cut()
+	}
+	return w.err
+}
+
+// Chunks returns the number of chunks in the blob and how many of them the
+// store did not already have.
+func (w *Writer) Chunks() (total, added int) {
+	return len(w.chunks), w.new
+}
+
+// casync format constants.
+const (
+	formatIndex      = 0x96824d9c7b129ff9
+	formatTable      = 0xe75b9e112f17417d
+	formatTableTail  = 0x4b4f050e5549ecd1
+	formatSHA512_256 = 0x2000000000000000
+)
+
+// WriteIndex writes the casync blob index (.caibx) of the blob to out. The
+// Writer must be closed.
+func (w *Writer) WriteIndex(out io.Writer) error {
+	if !w.closed {
+		return errors.New("castore: WriteIndex before Close")
+	}
+	if w.err != nil {
+		return w.err
+	}
+	le := binary.LittleEndian
+	var b []byte
+	for _, v := range []uint64{48, formatIndex, formatSHA512_256, uint64(w.min), uint64(w.avg), uint64(w.max)} {
+		b = le.AppendUint64(b, v)
+	}
+	b = le.AppendUint64(b, ^uint64(0)) // the table's size is unknown up front
+	b = le.AppendUint64(b, formatTable)
+	for _, c := range w.chunks {
+		b = le.AppendUint64(b, c.end)
+		b = append(b, c.id[:]...)
+	}
+	tableSize := 16 + 40*uint64(len(w.chunks)) + 40
+	for _, v := range []uint64{0, 0, 48, tableSize, formatTableTail} {
+		b = le.AppendUint64(b, v)
+	}
+	_, err := out.Write(b)
+	return err
+}
@@ -0,0 +1,208 @@
+package castore_test
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/castore"
+	"github.com/hxtk/ember/pkg/zstd"
+)
+
+// chunk is an entry of a blob index.
+type chunk struct {
+	end uint64
+	id  castore.ChunkID
+}
+
+// readIndex parses a casync blob index as casync reads it, checking the
+// header and the tail.
+func readIndex(t *testing.T, b []byte) (minSize, avgSize, maxSize uint64, chunks []chunk) {
+	t.Helper()
+	le := binary.LittleEndian
+	u := func(off int) uint64 { return le.Uint64(b[off:]) }
+	if len(b) < 64+40 || u(0) != 48 || u(8) != 0x96824d9c7b129ff9 || u(16) != 0x2000000000000000 {
+		t.Fatalf("index of %d bytes has no caibx header with SHA-512/256", len(b))
+	}
+	if u(48) != ^uint64(0) || u(56) != 0xe75b9e112f17417d {
+		t.Fatalf("index has no table after its header")
+	}
+	table := b[64 : len(b)-40]
+	if len(table)%40 != 0 {
+		t.Fatalf("index table of %d bytes is not of 40-byte entries", len(table))
+	}
+	for i := 0; i < len(table); i += 40 {
+		var c chunk
+		c.end = le.Uint64(table[i:])
+		copy(c.id[:], table[i+8:i+40])
+		chunks = append(chunks, c)
+	}
+	tail := b[len(b)-40:]
+	if le.Uint64(tail[16:]) != 48 || le.Uint64(tail[24:]) != uint64(16+len(table)+40) || le.Uint64(tail[32:]) != 0x4b4f050e5549ecd1 {
+		t.Errorf("index tail %x does not give the table", tail)
+	}
+	return u(24), u(32), u(40), chunks
+}
+
+// extract reassembles the blob of an index from the store, checking that
+// each chunk has the digest it is stored under.
+func extract(t *testing.T, store castore.Store, chunks []chunk) []byte {
+	t.Helper()
+	var blob []byte
+	for _, c := range chunks {
+		f, err := os.Open(store.Path(c.id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(zstd.NewReader(f))
+		f.Close()
+		if err != nil {
+			t.Fatalf("chunk %s: %v", c.id, err)
+		}
+		if castore.ChunkID(sha512.Sum512_256(data)) != c.id {
+			t.Errorf("chunk %s has another digest", c.id)
+		}
+		blob = append(blob, data...)
+		if uint64(len(blob)) != c.end {
+			t.Fatalf("chunk %s ends at %d, want %d", c.id, len(blob), c.end)
+		}
+	}
+	return blob
+}
+
+// write chunks blob into store in writes of n bytes, and returns the index
+// and the chunks the store didn't have.
+func write(t *testing.T, store castore.Store, blob []byte, n, minSize, avgSize, maxSize int) ([]byte, int) {
+	t.Helper()
+	w, err := castore.NewWriter(store, minSize, avgSize, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for b := blob; len(b) > 0; b = b[min(n, len(b)):] {
+		if _, err := w.Write(b[:min(n, len(b))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var index bytes.Buffer
+	if err := w.WriteIndex(&index); err != nil {
+		t.Fatal(err)
+	}
+	total, added := w.Chunks()
+	if _, _, _, chunks := readIndex(t, index.Bytes()); len(chunks) != total {
+		t.Errorf("index has %d chunks, Chunks() %d", len(chunks), total)
+	}
+	return index.Bytes(), added
+}
+
+func random(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// A blob comes back from its index and the store whole, in chunks within
+// the sizes asked for, however it was written.
+func TestRoundTrip(t *testing.T) {
+	blob := random(1, 2<<20)
+	for _, n := range []int{1 << 20, 4093, 1} {
+		store := castore.Store{Dir: t.TempDir()}
+		index, added := write(t, store, blob, n, 1<<10, 4<<10, 16<<10)
+		minSize, avgSize, maxSize, chunks := readIndex(t, index)
+		if minSize != 1<<10 || avgSize != 4<<10 || maxSize != 16<<10 {
+			t.Errorf("index gives chunk sizes %d, %d, %d, want those of the Writer", minSize, avgSize, maxSize)
+		}
+		if added != len(chunks) {
+			t.Errorf("an empty store added %d of the %d chunks, want all", added, len(chunks))
+		}
+		if avg := len(blob) / len(chunks); avg < 2<<10 || avg > 8<<10 {
+			t.Errorf("chunks average %d bytes, want about 4 KiB", avg)
+		}
+		var start uint64
+		for i, c := range chunks {
+			size := c.end - start
+			if size > 16<<10 || size < 1<<10 && i < len(chunks)-1 {
+				t.Errorf("chunk %d has %d bytes, want 1 to 16 KiB", i, size)
+			}
+			start = c.end
+		}
+		if got := extract(t, store, chunks); !bytes.Equal(got, blob) {
+			t.Errorf("writes of %d bytes: extracted %d bytes, not the blob", n, len(got))
+		}
+	}
+}
+
+// Chunks larger than a zstd block, and empty blobs, round trip too.
+func TestRoundTripSizes(t *testing.T) {
+	for _, size := range []int{0, 1, 47, 300 << 10} {
+		store := castore.Store{Dir: t.TempDir()}
+		blob := random(2, size)
+		index, _ := write(t, store, blob, 1<<20, castore.DefaultMinSize, castore.DefaultAvgSize, 1<<20)
+		_, _, _, chunks := readIndex(t, index)
+		if got := extract(t, store, chunks); !bytes.Equal(got, blob) {
+			t.Errorf("extracted %d bytes, want the blob of %d", len(got), size)
+		}
+	}
+}
+
+// Content-defined boundaries let a blob with an insertion share nearly all
+// of its chunks with the original, and the store keeps each chunk once.
+func TestDedupe(t *testing.T) {
+	store := castore.Store{Dir: t.TempDir()}
+	blob := random(3, 1<<20)
+	index, _ := write(t, store, blob, 1<<20, 1<<10, 4<<10, 16<<10)
+	_, _, _, chunks := readIndex(t, index)
+	if _, added := write(t, store, blob, 1<<20, 1<<10, 4<<10, 16<<10); added != 0 {
+		t.Errorf("writing the blob again added %d chunks, want 0", added)
+	}
+
+	edited := append(append(append([]byte(nil), blob[:300<<10]...), "inserted"...), blob[300<<10:]...)
+	index, added := write(t, store, edited, 1<<20, 1<<10, 4<<10, 16<<10)
+	if added == 0 || added > 3 {
+		t.Errorf("an insertion added %d chunks, want 1 to 3 of %d", added, len(chunks))
+	}
+	_, _, _, chunks = readIndex(t, index)
+	if got := extract(t, store, chunks); !bytes.Equal(got, edited) {
+		t.Error("extracted the edited blob wrong")
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	store := castore.Store{Dir: t.TempDir()}
+	for _, sizes := range [][3]int{{0, 4, 16}, {47, 64, 128}, {64, 32, 128}, {64, 128, 96}} {
+		if _, err := castore.NewWriter(store, sizes[0], sizes[1], sizes[2]); err == nil {
+			t.Errorf("NewWriter(%v) = nil error, want the sizes rejected", sizes)
+		}
+	}
+
+	w, err := castore.NewWriter(store, 64, 128, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteIndex(io.Discard); err == nil || !strings.Contains(err.Error(), "before Close") {
+		t.Errorf("WriteIndex() before Close = %v, want an error", err)
+	}
+
+	file := store.Dir + "/file"
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w, err = castore.NewWriter(castore.Store{Dir: file}, 64, 128, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(random(4, 1024))
+	if err == nil || !strings.Contains(err.Error(), "store chunk") {
+		t.Errorf("Write() to a store that is a file = %v, want an error", err)
+	}
+	if cerr := w.Close(); cerr != err {
+		t.Errorf("Close() = %v, want the error of Write %v", cerr, err)
+	}
+}
@@ -0,0 +1,67 @@
+package convert
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ErrBackslash is wrapped by the error for an entry whose name has a
+// backslash in a conversion with the BackslashFail policy.
+var ErrBackslash = errors.New("name has a backslash")
+
+// BackslashPolicy says what a conversion does with an entry whose name has
+// a backslash. Broken tooling on Windows writes them for path separators,
+// and unpacked as they are they give files literally named with them, such
+// as "usr\bin\tool" in the root instead of usr/bin/tool.
+type BackslashPolicy int
+
+const (
+	// BackslashKeep keeps backslashes as part of the name, as they are
+	// valid in a Linux file name. It is the default.
+	BackslashKeep BackslashPolicy = iota
+	// BackslashSlash takes backslashes in names and symlink targets for
+	// path separators, writing the directories the entry then needs.
+	BackslashSlash
+	// BackslashSkip leaves the entry out.
+	BackslashSkip
+	// BackslashFail fails the conversion.
+	BackslashFail
+)
+
+// WithBackslashes sets what to do with entries whose names have
+// backslashes. report, if not nil, is told of every entry renamed or left
+// out, with its new name or "" if it was left out.
+func WithBackslashes(p BackslashPolicy, report func(name, newName string)) Option {
+	return func(c *config) { c.backslashes, c.reportBackslash = p, report }
+}
+
+// fixBackslashes applies the BackslashPolicy to hdr, writing the parents a
+// renamed entry needs. It reports false if the entry is to be left out.
+func (c *converter) fixBackslashes(hdr *tar.Header) (bool, error) {
+	p := c.cfg.backslashes
+	name := cleanPath(hdr.Name)
+	if p == BackslashKeep || !strings.Contains(hdr.Name, `\`) {
+		return true, nil
+	}
+	report := c.cfg.reportBackslash
+	switch p {
+	case BackslashFail:
+		return false, fmt.Errorf("%q: %w", name, ErrBackslash)
+	case BackslashSkip:
+		if report != nil {
+			report(name, "")
+		}
+		return false, nil
+	}
+	hdr.Name = cleanPath(strings.ReplaceAll(hdr.Name, `\`, "/"))
+	if hdr.Typeflag == tar.TypeSymlink {
+		hdr.Linkname = strings.ReplaceAll(hdr.Linkname, `\`, "/")
+	}
+	if report != nil {
+		report(name, hdr.Name)
+	}
+	return true, c.mkdirAll(path.Dir(hdr.Name))
+}
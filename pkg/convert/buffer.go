@@ -0,0 +1,41 @@
+package convert
+
+import "sync"
+
+// defaultCopyBufferSize is the size of the buffers payloads are copied
+// through unless WithCopyBufferSize says otherwise.
+const defaultCopyBufferSize = 256 << 10
+
+// copyBuffers pools copy buffers by size, so that conversions run one
+// after another, or side by side, reuse them.
+var copyBuffers sync.Map // int -> *sync.Pool of *[]byte
+
+// getCopyBuffer returns a buffer of n bytes from the pool.
+func getCopyBuffer(n int) *[]byte {
+	p, _ := copyBuffers.LoadOrStore(n, &sync.Pool{
+		New: func() any {
+			b := make([]byte, n)
+			return &b
+		},
+	})
+	return p.(*sync.Pool).Get().(*[]byte)
+}
+
+// putCopyBuffer returns a buffer from getCopyBuffer to the pool.
+func putCopyBuffer(b *[]byte) {
+	if p, ok := copyBuffers.Load(len(*b)); ok {
+		p.(*sync.Pool).Put(b)
+	}
+}
+
+// WithCopyBufferSize copies entry payloads through buffers of n bytes,
+// taken from a pool shared by all conversions, instead of the 256 KiB
+// default. Larger buffers mean fewer writes on output that is slow to
+// write to, such as a network filesystem.
+func WithCopyBufferSize(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.copyBufferSize = n
+		}
+	}
+}
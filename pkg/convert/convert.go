@@ -0,0 +1,459 @@
+// Package convert turns the merged filesystem view of an OCI image into a
+// CPIO archive.
+package convert
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/hxtk/ember/internal/pathset"
+	"github.com/hxtk/ember/pkg/cpio"
+	"github.com/hxtk/ember/pkg/mtree"
+	"github.com/hxtk/ember/pkg/oci"
+)
+
+// Writer is the destination of a conversion. It is satisfied by both
+// cpio.Writer and cpio.VolumeWriter.
+type Writer interface {
+	WriteHeader(*cpio.Header) error
+	io.Writer
+}
+
+// EntryHook observes an entry as it is converted. content yields the
+// entry's payload (file data, or the target of a symlink) and is a TeeReader
+// over the archive writer: every byte the hook reads is written to the
+// archive as it goes, so hashes or signatures can be computed inline without
+// a second pass. Whatever the hook leaves unread is copied after it returns.
+// The hook must not retain content.
+type EntryHook func(hdr *tar.Header, content io.Reader) error
+
+// Option configures a conversion.
+type Option func(*config)
+
+type config struct {
+	onEntry  []EntryHook
+	rename   []RenameRule
+	exclude  []string // path.Match patterns
+	names    NameLimits
+	plugins  []*Plugin
+	policies []*Policy
+	metadata map[string]*mtree.Entry // by path, see WithMetadata
+
+	substitutes *substituter
+	strip       *stripper     // see WithStripDebug
+	normalize   []*normalizer // see WithNormalize
+	usrLayout   UsrLayout
+
+	stripLocales bool
+	keepLocales  []string
+	keepZones    []string
+
+	inject   []injection
+	injected map[string]bool // cleaned names of injected entries
+
+	templates    map[string]bool // cleaned names of entries to render
+	templateVars map[string]string
+	templateEnv  map[string]string
+
+	root     *RootEntry // written first, see WithRootEntry
+	dropRoot bool       // leave out the image's root entries
+
+	nameOpts        []cpio.NameOption
+	inodes          cpio.InodeAllocator
+	backslashes     BackslashPolicy
+	reportBackslash func(name, newName string)
+	timestamps      Timestamps
+	copyBufferSize  int
+	hashWorkers     int   // see WithHashWorkers
+	dirLinks        bool  // see WithDirLinks
+	memoryLimit     int64 // see WithMemoryLimit
+}
+
+// WithEntryHook calls hook for every entry written to the archive. It may
+// be given several times; the hooks then run concurrently, each reading all
+// of the content.
+func WithEntryHook(hook EntryHook) Option {
+	return func(c *config) { c.onEntry = append(c.onEntry, hook) }
+}
+
+// WithNameOptions spells the names of the archive's entries as opts say,
+// such as with a ./ prefix. Without it, entries are named as in the image.
+func WithNameOptions(opts ...cpio.NameOption) Option {
+	return func(c *config) { c.nameOpts = append(c.nameOpts, opts...) }
+}
+
+// WithInodes numbers the archive's entries with a. Without it, they are
+// numbered sequentially from 1. If a wants the content of regular files,
+// each is held in memory, or in a temporary file if it is large, until it
+// is hashed.
+func WithInodes(a cpio.InodeAllocator) Option {
+	return func(c *config) { c.inodes = a }
+}
+
+// Convert copies every entry of r into w, numbering their inodes as
+// WithInodes says. It does not close w.
+func Convert(r *oci.Reader, w Writer, opts ...Option) error {
+	cfg := config{injected: make(map[string]bool), copyBufferSize: defaultCopyBufferSize}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.inodes == nil {
+		cfg.inodes = cpio.SequentialInodes(1)
+	}
+
+	buf := getCopyBuffer(cfg.copyBufferSize)
+	defer putCopyBuffer(buf)
+	b := cfg.newBudget()
+	c := &converter{r: r, w: w, cfg: &cfg, budget: b, dirs: pathset.New(b), dropped: pathset.New(b), metaSeen: make(map[string]bool), linked: make(map[string]*linkedFile), unlinked: pathset.NewMap(b, pathset.Strings), usrMerger: newUsrMerger(cfg.usrLayout, b), buf: *buf}
+	defer c.spool.close()
+	defer c.closePaths()
+	if cfg.dirLinks {
+		if err := c.spoolForDirLinks(); err != nil {
+			return err
+		}
+		defer c.links.close()
+	}
+	if cfg.hashWorkers > 1 && cfg.inodes.WantsContent() {
+		c.hashes = newHashPool(cfg.hashWorkers)
+		defer c.hashes.close()
+	}
+	tmpl := newTemplater(&cfg, r)
+	defer cfg.substitutes.close()
+
+	if err := c.emitRoot(); err != nil {
+		return err
+	}
+	for {
+		// Read next merged OCI entry
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read OCI entry: %w", err)
+		}
+		if cfg.excluded(cleanPath(hdr.Name)) || (cfg.dropRoot && cleanPath(hdr.Name) == ".") {
+			continue
+		}
+		if ok, err := c.renameEntry(hdr); !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if ok, err := c.fixBackslashes(hdr); !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if ok, err := c.moveUsr(hdr); !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if hdr.Typeflag == tar.TypeDir && c.dirs.Has(cleanPath(hdr.Name)) {
+			continue // Written already, as the parent of a moved entry
+		}
+		if cfg.injected[cleanPath(hdr.Name)] {
+			continue // Replaced by an injected entry
+		}
+		if err := c.applyMetadata(hdr); err != nil {
+			return err
+		}
+		if ok, err := c.applyPolicies(hdr, r.Layer()); !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		body, done, err := cfg.substitutes.apply(hdr, r)
+		if err != nil {
+			return err
+		}
+		if tmpl.matches(hdr) {
+			if body, err = tmpl.render(hdr, body); err != nil {
+				done()
+				return err
+			}
+		}
+		if body, err = cfg.strip.apply(hdr, body); err != nil {
+			done()
+			return err
+		}
+		if body, err = cfg.normalizeContent(hdr, body); err != nil {
+			done()
+			return err
+		}
+		err = c.filter(cfg.plugins, hdr, body)
+		done()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := c.usrLinks(); err != nil {
+		return err
+	}
+	if err := c.createMetadata(); err != nil {
+		return err
+	}
+	if err := c.inject(tmpl); err != nil {
+		return err
+	}
+	if err := c.drain(-1); err != nil {
+		return err
+	}
+	if err := c.pathsErr(); err != nil {
+		return err
+	}
+	if c.links != nil {
+		return c.copyDirLinks()
+	}
+	return nil
+}
+
+// converter holds the state of a single conversion.
+type converter struct {
+	r   *oci.Reader
+	w   Writer
+	cfg *config
+
+	usrMerger *usrMerger // nil without WithUsrLayout
+	buf       []byte     // for copying payloads, see WithCopyBufferSize
+	spool     spool      // for hashing content the inode allocator wants
+	hashes    *hashPool  // nil without WithHashWorkers
+	links     *dirLinks  // nil without WithDirLinks
+	out       Writer     // the writer given, if w is the spool of links
+
+	// budget bounds what grows with the paths of the image, see
+	// WithMemoryLimit.
+	budget *pathset.Budget
+
+	// dirs records the directories written so far, and symlinks that may
+	// stand in for them, so injected entries can be given the parents they
+	// need without shadowing a symlinked directory such as /lib.
+	dirs *pathset.Set
+
+	// dropped are the directories a policy dropped, with what is under
+	// them.
+	dropped *pathset.Set
+
+	metaSeen map[string]bool // paths of WithMetadata the image had
+
+	// linked are the files written with hard links still to come, by path,
+	// and unlinked the files left out whose first link was written as a
+	// copy, by path, to the path of the copy, which the others link to
+	// instead.
+	linked   map[string]*linkedFile
+	unlinked *pathset.Map[string]
+}
+
+// filter passes an entry of the image through plugins, in order, and
+// writes what comes out.
+func (c *converter) filter(plugins []*Plugin, hdr *tar.Header, body io.Reader) error {
+	if len(plugins) == 0 {
+		warnLosses(c.r, hdr)
+		c.cfg.timestamps.fit(c.r, hdr)
+		return c.emit(hdr, body)
+	}
+	return plugins[0].filter(hdr, body, func(hdr *tar.Header, body io.Reader) error {
+		return c.filter(plugins[1:], hdr, body)
+	})
+}
+
+// emit writes hdr to the archive, reading the payload of regular files
+// from body.
+func (c *converter) emit(hdr *tar.Header, body io.Reader) error {
+	if ok, err := c.cfg.names.apply(hdr); !ok {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeDir || hdr.Typeflag == tar.TypeSymlink {
+		c.dirs.Add(cleanPath(hdr.Name))
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		// The file comes first: it may be waiting to be hashed.
+		if err := c.drain(-1); err != nil {
+			return err
+		}
+		if c.linkTarget(hdr) != nil {
+			return c.write(hdr, nil, nil)
+		}
+		var err error
+		if body, err = c.unlink(hdr); err != nil {
+			return err
+		}
+	}
+
+	wantsContent := c.cfg.inodes.WantsContent() && (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA)
+	if c.hashes != nil {
+		if wantsContent && hdr.Size <= maxMemorySpool || !wantsContent && hdr.Size == 0 {
+			return c.queue(hdr, body, wantsContent)
+		}
+		if err := c.drain(-1); err != nil {
+			return err
+		}
+	}
+	var sum []byte
+	if wantsContent {
+		h := sha256.New()
+		var err error
+		if body, err = c.spool.hold(hdr.Name, hdr.Size, body, h); err != nil {
+			return err
+		}
+		sum = h.Sum(nil)
+	}
+	return c.write(hdr, sum, body)
+}
+
+// write writes hdr to the archive, numbered with the sum of its content if
+// the inode allocator wants it, reading the payload of regular files from
+// body.
+func (c *converter) write(hdr *tar.Header, sum []byte, body io.Reader) error {
+	var target *linkedFile
+	if hdr.Typeflag == tar.TypeLink {
+		target = c.linkTarget(hdr)
+		hdr.Linkname = target.name
+	}
+
+	// Translate OCI header → CPIO header
+	cpioHdr := cpio.HeaderFromTar(hdr, c.cfg.inodes.Inode(hdr, sum), c.cfg.nameOpts...)
+	switch {
+	case target != nil:
+		// One inode: whatever was done to the names since, it has the
+		// metadata of the file.
+		t := target.hdr
+		cpioHdr.Mode, cpioHdr.Uid, cpioHdr.Gid, cpioHdr.ModTime, cpioHdr.Links = t.Mode, t.Uid, t.Gid, t.ModTime, t.Links
+		if target.left--; target.left == 0 {
+			delete(c.linked, cleanPath(target.name))
+		}
+	case cpioHdr.Links > 1 && hdr.Typeflag != tar.TypeDir:
+		h := *cpioHdr
+		c.linked[cleanPath(hdr.Name)] = &linkedFile{name: hdr.Name, hdr: &h, left: h.Links - 1}
+	}
+	if c.links != nil && hdr.Typeflag == tar.TypeDir {
+		c.links.countDir(cpioHdr.Name)
+	}
+
+	// Write CPIO header
+	if err := c.w.WriteHeader(cpioHdr); err != nil {
+		return fmt.Errorf("write CPIO header for %q: %w", hdr.Name, err)
+	}
+
+	// Stream file payload (if any)
+	if len(c.cfg.onEntry) > 0 {
+		return copyWithHook(c.w, body, hdr, fanOut(c.cfg.onEntry, len(c.buf)), c.buf)
+	}
+	if hdr.Size > 0 {
+		n, err := io.CopyBuffer(c.w, io.LimitReader(body, hdr.Size), c.buf)
+		if err == nil && n < hdr.Size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return fmt.Errorf("copy payload for %q: %w", hdr.Name, err)
+		}
+	} else if hdr.Typeflag == tar.TypeSymlink {
+		_, err := c.w.Write([]byte(hdr.Linkname))
+		if err != nil {
+			return fmt.Errorf("write linkname for %q: %w", hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+// warnLosses gives r a warning for each xattr of hdr, which newc can't
+// hold.
+func warnLosses(r *oci.Reader, hdr *tar.Header) {
+	name := cleanPath(hdr.Name)
+	var xattrs []string
+	for k := range hdr.PAXRecords {
+		if after, ok := strings.CutPrefix(k, "SCHILY.xattr."); ok {
+			xattrs = append(xattrs, after)
+		}
+	}
+	sort.Strings(xattrs)
+	for _, x := range xattrs {
+		r.Warn(oci.Warning{Kind: oci.WarnLostXattr, Name: name, Detail: x})
+	}
+}
+
+// copyWithHook writes the payload of hdr to w while hook observes it,
+// copying what the hook leaves unread through buf.
+func copyWithHook(w io.Writer, r io.Reader, hdr *tar.Header, hook EntryHook, buf []byte) error {
+	var src io.Reader
+	var size int64
+	switch {
+	case hdr.Size > 0:
+		src, size = io.LimitReader(r, hdr.Size), hdr.Size
+	case hdr.Typeflag == tar.TypeSymlink:
+		src, size = strings.NewReader(hdr.Linkname), int64(len(hdr.Linkname))
+	default:
+		src = strings.NewReader("")
+	}
+
+	cw := &countingWriter{w: w}
+	if err := hook(hdr, io.TeeReader(src, cw)); err != nil {
+		return fmt.Errorf("entry hook for %q: %w", hdr.Name, err)
+	}
+	if _, err := io.CopyBuffer(cw, src, buf); err != nil {
+		return fmt.Errorf("copy payload for %q: %w", hdr.Name, err)
+	}
+	if cw.n != size {
+		return fmt.Errorf("copy payload for %q: %w", hdr.Name, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// fanOut combines hooks into one, feeding each hook its own copy of the
+// content through a pipe, copied through a pooled buffer of bufSize bytes.
+// Whatever a hook leaves unread is discarded, so that it doesn't hold up
+// the others.
+func fanOut(hooks []EntryHook, bufSize int) EntryHook {
+	if len(hooks) == 1 {
+		return hooks[0]
+	}
+	return func(hdr *tar.Header, content io.Reader) error {
+		pws := make([]*io.PipeWriter, len(hooks))
+		ws := make([]io.Writer, len(hooks))
+		errc := make(chan error, len(hooks))
+		for i, hook := range hooks {
+			pr, pw := io.Pipe()
+			pws[i], ws[i] = pw, pw
+			go func() {
+				err := hook(hdr, pr)
+				_, _ = io.Copy(io.Discard, pr)
+				errc <- err
+			}()
+		}
+		buf := getCopyBuffer(bufSize)
+		_, err := io.CopyBuffer(io.MultiWriter(ws...), content, *buf)
+		putCopyBuffer(buf)
+		for _, pw := range pws {
+			pw.CloseWithError(err)
+		}
+		for range hooks {
+			if herr := <-errc; err == nil {
+				err = herr
+			}
+		}
+		return err
+	}
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,149 @@
+package convert_test
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/cpio"
+	"github.com/hxtk/ember/pkg/oci"
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+// convertAll converts img with opts, reading it as build does, checks the
+// archive with cpio.Verify, and returns its entries as one line each, as
+// describe makes them.
+func convertAll(t *testing.T, img *ocitest.Image, opts ...convert.Option) []string {
+	t.Helper()
+	var entries []string
+	for _, e := range archiveEntries(t, img, opts...) {
+		entries = append(entries, describe(e.hdr, e.content))
+	}
+	return entries
+}
+
+// convertArchive converts img with opts, reading it as build does, and
+// returns the archive and the error of Convert.
+func convertArchive(t *testing.T, img *ocitest.Image, opts ...convert.Option) ([]byte, error) {
+	t.Helper()
+	r, err := oci.Open(ocitest.Layout(t, img), oci.WithHardLinks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var buf bytes.Buffer
+	w := cpio.NewWriter(&buf)
+	if err := convert.Convert(r, w, opts...); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// archiveEntry is an entry of an archive, with its content.
+type archiveEntry struct {
+	hdr     *cpio.Header
+	content []byte
+}
+
+// archiveEntries converts img with opts, checks the archive with
+// cpio.Verify, and returns its entries in order.
+func archiveEntries(t *testing.T, img *ocitest.Image, opts ...convert.Option) []archiveEntry {
+	t.Helper()
+	b, err := convertArchive(t, img, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := cpio.Verify(bytes.NewReader(b)); !v.OK() {
+		t.Errorf("Verify: %v", v.Problems)
+	}
+	var entries []archiveEntry
+	tr := cpio.NewReader(bytes.NewReader(b))
+	for hdr, body := range tr.Entries() {
+		b, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("%s: %v", hdr.Name, err)
+		}
+		entries = append(entries, archiveEntry{hdr, b})
+	}
+	if err := tr.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// describe gives the name of an entry and its type, with what the type
+// makes of the rest, such as the content of a regular file.
+func describe(hdr *cpio.Header, content []byte) string {
+	switch hdr.Mode & 0o170000 {
+	case 0o040000:
+		return hdr.Name + "/"
+	case 0o120000:
+		return hdr.Name + " -> " + string(content)
+	case 0o100000:
+		s := fmt.Sprintf("%s %q", hdr.Name, content)
+		if hdr.Links > 1 {
+			s += fmt.Sprintf(" ino=%d nlink=%d", hdr.Inode, hdr.Links)
+		}
+		return s
+	}
+	return fmt.Sprintf("%s mode %o", hdr.Name, hdr.Mode)
+}
+
+func checkEntries(t *testing.T, got, want []string) {
+	t.Helper()
+	if !slices.Equal(got, want) {
+		t.Errorf("got entries\n\t%s\nwant\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+}
+
+// elfWithDebug returns a relocatable ELF object with a .text section and a
+// .debug_info section of debug bytes, as a compiler without -g0 leaves
+// them.
+func elfWithDebug(debug int) []byte {
+	text := []byte{0xc3} // ret
+	shstrtab := []byte("\x00.text\x00.debug_info\x00.shstrtab\x00")
+	le := binary.LittleEndian
+	var b []byte
+	b = append(b, elf.ELFMAG...)
+	b = append(b, byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT))
+	b = append(b, make([]byte, elf.EI_NIDENT-len(b))...)
+	textOff := uint64(64)
+	debugOff := textOff + uint64(len(text))
+	strOff := debugOff + uint64(debug)
+	shoff := (strOff + uint64(len(shstrtab)) + 7) &^ 7
+	b = le.AppendUint16(b, uint16(elf.ET_REL))
+	b = le.AppendUint16(b, uint16(elf.EM_X86_64))
+	b = le.AppendUint32(b, uint32(elf.EV_CURRENT))
+	b = le.AppendUint64(b, 0) // entry
+	b = le.AppendUint64(b, 0) // phoff
+	b = le.AppendUint64(b, shoff)
+	b = le.AppendUint32(b, 0)  // flags
+	b = le.AppendUint16(b, 64) // ehsize
+	b = le.AppendUint16(b, 0)  // phentsize
+	b = le.AppendUint16(b, 0)  // phnum
+	b = le.AppendUint16(b, 64) // shentsize
+	b = le.AppendUint16(b, 4)  // shnum
+	b = le.AppendUint16(b, 3)  // shstrndx
+	b = append(b, text...)
+	b = append(b, bytes.Repeat([]byte{0xdb}, debug)...)
+	b = append(b, shstrtab...)
+	b = append(b, make([]byte, shoff-uint64(len(b)))...)
+	for _, sh := range []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR), Off: textOff, Size: uint64(len(text)), Addralign: 1},
+		{Name: 7, Type: uint32(elf.SHT_PROGBITS), Off: debugOff, Size: uint64(debug), Addralign: 1},
+		{Name: 19, Type: uint32(elf.SHT_STRTAB), Off: strOff, Size: uint64(len(shstrtab)), Addralign: 1},
+	} {
+		b, _ = binary.Append(b, le, sh)
+	}
+	return b
+}
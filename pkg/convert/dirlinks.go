@@ -0,0 +1,96 @@
+package convert
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/hxtk/ember/internal/pathset"
+	"github.com/hxtk/ember/pkg/cpio"
+)
+
+// WithDirLinks gives every directory a link count of 2 and one more for
+// each directory in it, as real filesystems count the . and .. entries,
+// instead of 2 for all of them, for verification tools that check the
+// counts. A directory is written before what is in it, so the archive is
+// then written to a temporary file first, and copied into the writer with
+// the counts once it is complete.
+func WithDirLinks() Option {
+	return func(c *config) { c.dirLinks = true }
+}
+
+// dirLinks counts the subdirectories of the directories written.
+type dirLinks struct {
+	f       *os.File
+	bw      *bufio.Writer
+	seen    *pathset.Set      // directories written
+	subdirs *pathset.Map[int] // by directory
+}
+
+// spoolForDirLinks makes c write to a temporary file, for copyDirLinks to
+// copy into the writer.
+func (c *converter) spoolForDirLinks() error {
+	f, err := os.CreateTemp("", "ember-dirlinks-")
+	if err != nil {
+		return err
+	}
+	os.Remove(f.Name())
+	c.links = &dirLinks{f: f, bw: bufio.NewWriter(f), seen: pathset.New(c.budget), subdirs: pathset.NewMap(c.budget, pathset.Ints)}
+	c.out, c.w = c.w, cpio.NewWriter(c.links.bw)
+	return nil
+}
+
+// countDir counts the directory of the archive called name.
+func (l *dirLinks) countDir(name string) {
+	p := cleanPath(name)
+	if l.seen.Has(p) {
+		return
+	}
+	l.seen.Add(p)
+	if p != "." {
+		n, _ := l.subdirs.Get(path.Dir(p))
+		l.subdirs.Put(path.Dir(p), n+1)
+	}
+}
+
+// copyDirLinks copies the archive written to the temporary file into the
+// writer of the conversion, with the link counts of its directories.
+func (c *converter) copyDirLinks() error {
+	if err := c.w.(*cpio.Writer).Close(); err != nil {
+		return fmt.Errorf("spool for directory links: %w", err)
+	}
+	if err := c.links.bw.Flush(); err != nil {
+		return fmt.Errorf("spool for directory links: %w", err)
+	}
+	if _, err := c.links.f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("spool for directory links: %w", err)
+	}
+	tr := cpio.NewReader(bufio.NewReader(c.links.f))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return c.pathsErr()
+		}
+		if err != nil {
+			return fmt.Errorf("spool for directory links: %w", err)
+		}
+		if hdr.Mode&0xf000 == 0x4000 { // S_IFDIR
+			n, _ := c.links.subdirs.Get(cleanPath(hdr.Name))
+			hdr.Links = 2 + n
+		}
+		if err := c.out.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("write CPIO header for %q: %w", hdr.Name, err)
+		}
+		if _, err := io.CopyBuffer(c.out, tr, c.buf); err != nil {
+			return fmt.Errorf("copy payload for %q: %w", hdr.Name, err)
+		}
+	}
+}
+
+func (l *dirLinks) close() {
+	if l != nil {
+		l.f.Close()
+	}
+}
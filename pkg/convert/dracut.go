@@ -0,0 +1,55 @@
+package convert
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"slices"
+	"time"
+)
+
+// DracutHooks are the hook points of dracut's initramfs, in the order its
+// init runs them. The initqueue hooks are polled in a loop: initqueue
+// scripts run until their job is done, initqueue/finished scripts are the
+// conditions for leaving the loop, and initqueue/settled, online, and
+// timeout scripts run when udev settles, a network interface comes up, or
+// the loop times out.
+var DracutHooks = []string{
+	"cmdline",
+	"pre-udev",
+	"pre-trigger",
+	"initqueue",
+	"initqueue/settled",
+	"initqueue/online",
+	"initqueue/finished",
+	"initqueue/timeout",
+	"pre-mount",
+	"mount",
+	"pre-pivot",
+	"cleanup",
+	"emergency",
+	"shutdown-emergency",
+	"shutdown",
+}
+
+// WithDracutHook installs script as the hook name at the dracut hook point
+// hook, in lib/dracut/hooks/<hook>/<priority>-<name>.sh, the way a dracut
+// module's install script would. Hooks at the same point run in order of
+// priority, from 00 to 99; dracut's own modules mostly use 10 to 99.
+func WithDracutHook(hook string, priority int, name string, script []byte) (Option, error) {
+	if !slices.Contains(DracutHooks, hook) {
+		return nil, fmt.Errorf("unknown dracut hook %q", hook)
+	}
+	if priority < 0 || priority > 99 {
+		return nil, fmt.Errorf("dracut hook %s: priority %d is not between 0 and 99", name, priority)
+	}
+	if name == "" || path.Base(name) != name {
+		return nil, fmt.Errorf("dracut hook %q: want a plain file name", name)
+	}
+	return WithEntry(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     fmt.Sprintf("lib/dracut/hooks/%s/%02d-%s.sh", hook, priority, name),
+		Mode:     0o755,
+		ModTime:  time.Unix(0, 0),
+	}, script), nil
+}
@@ -0,0 +1,94 @@
+package convert
+
+import (
+	"fmt"
+	"path"
+)
+
+// Built-in exclude presets accepted by WithExcludePreset.
+const (
+	// PresetPkgDB drops the package databases of apk, dpkg, and rpm, which
+	// nothing in an initramfs reads.
+	PresetPkgDB = "pkgdb"
+
+	// PresetMinimal drops the package databases together with
+	// documentation, man and info pages, and package manager caches.
+	PresetMinimal = "minimal"
+
+	// PresetLocales drops time zones and compiled locales, as WithLocales
+	// does when it keeps none. Use WithLocales to keep some.
+	PresetLocales = "locales"
+)
+
+var pkgDBExcludes = []string{
+	"lib/apk/db",
+	"var/lib/dpkg",
+	"var/lib/rpm",
+	"usr/lib/sysimage/rpm",
+	"var/lib/apt",
+	"var/lib/dnf",
+	"var/lib/yum",
+}
+
+var excludePresets = map[string][]string{
+	PresetPkgDB: pkgDBExcludes,
+	PresetMinimal: append([]string{
+		"usr/share/doc",
+		"usr/share/man",
+		"usr/share/info",
+		"usr/share/lintian",
+		"usr/share/gtk-doc",
+		"var/cache/apk",
+		"var/cache/apt",
+		"var/cache/dnf",
+		"var/cache/yum",
+		"var/cache/ldconfig",
+		"etc/apk/cache",
+	}, pkgDBExcludes...),
+}
+
+// WithExclude leaves out every image entry whose path, or the path of one
+// of its parent directories, matches one of the path.Match patterns, so
+// "usr/share/doc" drops the directory and everything below it. Paths are
+// matched as they are in the image, before renaming, without a leading "/"
+// or "./". Injected entries are never excluded.
+func WithExclude(patterns ...string) (Option, error) {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("exclude pattern %q: %w", p, err)
+		}
+	}
+	return func(c *config) { c.exclude = append(c.exclude, patterns...) }, nil
+}
+
+// WithExcludePreset excludes the paths of a built-in preset, see
+// PresetPkgDB, PresetMinimal, and PresetLocales.
+func WithExcludePreset(name string) (Option, error) {
+	if name == PresetLocales {
+		return WithLocales(nil, nil), nil
+	}
+	patterns, ok := excludePresets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown exclude preset %q", name)
+	}
+	return WithExclude(patterns...)
+}
+
+// excluded reports whether the cleaned path p or one of its parents
+// matches an exclude pattern, or WithLocales strips it.
+func (c *config) excluded(p string) bool {
+	if c.localeExcluded(p) {
+		return true
+	}
+	if len(c.exclude) == 0 {
+		return false
+	}
+	for ; p != "."; p = path.Dir(p) {
+		for _, pat := range c.exclude {
+			if ok, _ := path.Match(pat, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package convert
+
+import (
+	"archive/tar"
+	"io"
+	"maps"
+	"strconv"
+
+	"github.com/hxtk/ember/pkg/cpio"
+)
+
+// linkedFile is a file written with hard links to come: its name as the
+// links name it, which is that of the tar header written, its header in
+// the archive, which the links share, and the number of links to come.
+type linkedFile struct {
+	name string
+	hdr  *cpio.Header
+	left int
+}
+
+// linkTarget returns the file written that the hard link hdr names, or nil
+// if it wasn't written.
+func (c *converter) linkTarget(hdr *tar.Header) *linkedFile {
+	p := cleanPath(hdr.Linkname)
+	if moved, ok := c.unlinked.Get(p); ok {
+		p = moved
+	}
+	return c.linked[p]
+}
+
+// unlink turns the hard link hdr, of a file that was left out, into a copy
+// of the file, which the other links of the file then name, and returns
+// its content.
+func (c *converter) unlink(hdr *tar.Header) (io.Reader, error) {
+	th, err := c.r.CopyLink()
+	if err != nil {
+		return nil, err
+	}
+	c.unlinked.Put(cleanPath(hdr.Linkname), cleanPath(hdr.Name))
+	hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeReg, "", th.Size
+
+	// The file left out was one of the names.
+	hdr.PAXRecords = maps.Clone(hdr.PAXRecords)
+	if n, _ := strconv.Atoi(hdr.PAXRecords[nlinkRecord]); n > 2 {
+		hdr.PAXRecords[nlinkRecord] = strconv.Itoa(n - 1)
+	} else {
+		delete(hdr.PAXRecords, nlinkRecord)
+	}
+	return c.r, nil
+}
+
+// nlinkRecord is the PAX record of the link count that oci.WithHardLinks
+// gives files with hard links.
+const nlinkRecord = "SCHILY.nlink"
@@ -0,0 +1,57 @@
+package convert_test
+
+import (
+	"testing"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/cpio"
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+func busybox() *ocitest.Image {
+	return ocitest.New(ocitest.NewLayer().
+		Dir("bin").
+		File("bin/busybox", "BB", ocitest.Mode(0o4755)).
+		Hardlink("bin/sh", "bin/busybox").
+		Hardlink("bin/ls", "bin/busybox"))
+}
+
+func TestHardLinksShareInode(t *testing.T) {
+	checkEntries(t, convertAll(t, busybox()), []string{
+		`bin/`,
+		`bin/busybox "BB" ino=2 nlink=3`,
+		`bin/sh "" ino=2 nlink=3`,
+		`bin/ls "" ino=2 nlink=3`,
+	})
+}
+
+func TestHardLinksByContentHash(t *testing.T) {
+	got := convertAll(t, busybox(), convert.WithInodes(cpio.ContentHashInodes()), convert.WithHashWorkers(4))
+	if len(got) != 4 || got[1][len(`bin/busybox "BB"`):] != got[2][len(`bin/sh ""`):] {
+		t.Errorf("links don't share the inode of the file: %q", got)
+	}
+}
+
+func TestHardLinksFollowRename(t *testing.T) {
+	got := convertAll(t, busybox(), convert.WithRename(renameRule(t, `^bin/busybox$:bin/bb`)))
+	checkEntries(t, got, []string{
+		`bin/`,
+		`bin/bb "BB" ino=2 nlink=3`,
+		`bin/sh "" ino=2 nlink=3`,
+		`bin/ls "" ino=2 nlink=3`,
+	})
+}
+
+// A link to a file left out becomes a copy of it, which the other links
+// share.
+func TestHardLinkToExcludedFile(t *testing.T) {
+	exclude, err := convert.WithExclude("bin/busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, convertAll(t, busybox(), exclude), []string{
+		`bin/`,
+		`bin/sh "BB" ino=2 nlink=2`,
+		`bin/ls "" ino=2 nlink=2`,
+	})
+}
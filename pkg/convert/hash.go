@@ -0,0 +1,92 @@
+package convert
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// WithHashWorkers hashes the content of the regular files that the inode
+// allocator of WithInodes wants on n goroutines, so that hashing keeps up
+// with reading the image when there is a lot of it to do, such as with
+// blobs being verified as they are read too. Up to 2n entries of up to
+// 1 MiB are held in memory ahead of the archive, which still gets every
+// entry in order; larger files are hashed in turn, as without it.
+func WithHashWorkers(n int) Option {
+	return func(c *config) { c.hashWorkers = n }
+}
+
+// hashJob is an entry queued to be written once its content is hashed.
+type hashJob struct {
+	hdr  tar.Header
+	body []byte
+	sum  []byte
+	done chan struct{} // closed once sum is set, or nil if there's no sum
+}
+
+// hashPool hashes the content of queued entries on worker goroutines, fed
+// by a channel with a slot for each.
+type hashPool struct {
+	jobs    chan *hashJob
+	pending []*hashJob // in archive order
+	max     int        // of pending
+}
+
+func newHashPool(n int) *hashPool {
+	p := &hashPool{jobs: make(chan *hashJob, n), max: 2 * n}
+	for range n {
+		go func() {
+			for j := range p.jobs {
+				sum := sha256.Sum256(j.body)
+				j.sum = sum[:]
+				close(j.done)
+			}
+		}()
+	}
+	return p
+}
+
+// close stops the workers once they finish the jobs they have.
+func (p *hashPool) close() { close(p.jobs) }
+
+// queue reads the payload of hdr from body, and queues the entry to be
+// written after those queued before it, once its content is hashed if
+// wantsContent. The oldest entry is written if too many are queued.
+func (c *converter) queue(hdr *tar.Header, body io.Reader, wantsContent bool) error {
+	j := &hashJob{hdr: *hdr}
+	if wantsContent {
+		j.body = make([]byte, hdr.Size)
+		if _, err := io.ReadFull(body, j.body); err != nil {
+			return fmt.Errorf("read %q: %w", hdr.Name, err)
+		}
+		j.done = make(chan struct{})
+		c.hashes.jobs <- j
+	}
+	c.hashes.pending = append(c.hashes.pending, j)
+	if len(c.hashes.pending) > c.hashes.max {
+		return c.drain(1)
+	}
+	return nil
+}
+
+// drain writes the n oldest queued entries, or all of them if n is
+// negative.
+func (c *converter) drain(n int) error {
+	if c.hashes == nil {
+		return nil
+	}
+	for ; n != 0 && len(c.hashes.pending) > 0; n-- {
+		j := c.hashes.pending[0]
+		c.hashes.pending[0] = nil
+		c.hashes.pending = c.hashes.pending[1:]
+		if j.done != nil {
+			<-j.done
+		}
+		if err := c.write(&j.hdr, j.sum, bytes.NewReader(j.body)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package convert
+
+import (
+	"archive/tar"
+	"fmt"
+	"time"
+)
+
+// Built-in init profiles accepted by WithInitProfile.
+const (
+	// InitSystemd lays out the image for systemd running in the initrd:
+	// /init execs systemd, /etc/initrd-release marks the initrd, and
+	// default.target points at initrd.target.
+	InitSystemd = "systemd"
+
+	// InitBusybox sets up BusyBox init: /init execs /sbin/init, which reads
+	// /etc/inittab and runs /etc/init.d/rcS to mount the API filesystems.
+	InitBusybox = "busybox"
+)
+
+// profileEntry is a file generated by an init profile.
+type profileEntry struct {
+	hdr      tar.Header
+	content  string
+	template bool // render content through text/template
+}
+
+// initrdRelease is an os-release(5) file identifying the image the initrd
+// was built from.
+const initrdRelease = `{{- $title := or (index .Annotations "org.opencontainers.image.title") "ember" -}}
+NAME="{{ $title }}"
+PRETTY_NAME="{{ $title }} (initrd)"
+IMAGE_ID="{{ .Digest }}"
+{{- with index .Annotations "org.opencontainers.image.version" }}
+IMAGE_VERSION="{{ . }}"
+{{- end }}
+`
+
+const busyboxInittab = `::sysinit:/etc/init.d/rcS
+::askfirst:-/bin/sh
+::ctrlaltdel:/sbin/reboot
+::shutdown:/bin/umount -a -r
+`
+
+const busyboxRcS = `#!/bin/sh
+# Generated by ember. Mount the API filesystems, then run the S??* scripts.
+mount -t proc proc /proc
+mount -t sysfs sysfs /sys
+mount -t devtmpfs devtmpfs /dev
+mkdir -p /dev/pts /dev/shm
+mount -t devpts devpts /dev/pts
+mount -t tmpfs tmpfs /run
+for s in /etc/init.d/S??*; do
+	[ -x "$s" ] && "$s" start
+done
+`
+
+var initProfiles = map[string][]profileEntry{
+	InitSystemd: {
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "init", Linkname: "/usr/lib/systemd/systemd", Mode: 0o777}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/initrd-release", Mode: 0o644}, content: initrdRelease, template: true},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "etc/systemd/system/default.target", Linkname: "/usr/lib/systemd/system/initrd.target", Mode: 0o777}},
+	},
+	InitBusybox: {
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "init", Linkname: "/sbin/init", Mode: 0o777}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/inittab", Mode: 0o644}, content: busyboxInittab},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/init.d/rcS", Mode: 0o755}, content: busyboxRcS},
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "proc", Mode: 0o555}},
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "sys", Mode: 0o555}},
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "dev", Mode: 0o755}},
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "run", Mode: 0o755}},
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "tmp", Mode: 0o1777}},
+	},
+}
+
+// WithInitProfile adds the files the named init system expects to find in
+// an initramfs, replacing any the image already has. See InitSystemd and
+// InitBusybox for the available profiles.
+func WithInitProfile(name string) (Option, error) {
+	entries, ok := initProfiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown init profile %q", name)
+	}
+	return func(c *config) {
+		for _, e := range entries {
+			hdr := e.hdr
+			hdr.ModTime = time.Unix(0, 0)
+			WithEntry(&hdr, []byte(e.content))(c)
+			if e.template {
+				c.addTemplate(hdr.Name)
+			}
+		}
+	}, nil
+}
+
+// WithInitTemplate installs /init from a user-provided text/template,
+// rendered with the same data as WithTemplates, for boot flows that need a
+// custom init contract.
+func WithInitTemplate(tmpl []byte) Option {
+	return func(c *config) {
+		WithEntry(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     "init",
+			Mode:     0o755,
+			ModTime:  time.Unix(0, 0),
+		}, tmpl)(c)
+		c.addTemplate("init")
+	}
+}
@@ -0,0 +1,111 @@
+package convert
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"time"
+)
+
+// injection is an entry added to the archive by the caller.
+type injection struct {
+	hdr     *tar.Header
+	content []byte
+	open    func() (io.ReadCloser, error) // streams content instead, if set
+}
+
+// WithEntry adds an entry that isn't part of the image, such as a
+// generated configuration file. The entry replaces any image entry at the
+// same path (after renaming) and is written after all image entries, so the
+// image's directories exist by then; missing parent directories are created
+// with mode 0755. Only regular files carry content. An injected directory
+// is only created if the image lacks it, so the image's entries below it
+// keep their parent.
+func WithEntry(hdr *tar.Header, content []byte) Option {
+	return func(c *config) {
+		h := *hdr
+		h.Name = cleanPath(h.Name)
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(content))
+		} else {
+			content = nil
+		}
+		c.addInjection(injection{hdr: &h, content: content})
+	}
+}
+
+// WithEntryFrom is like WithEntry, but the content of a regular file is
+// streamed from open when the entry is written, so large files need not be
+// held in memory. hdr.Size must be the size of the content.
+func WithEntryFrom(hdr *tar.Header, open func() (io.ReadCloser, error)) Option {
+	return func(c *config) {
+		h := *hdr
+		h.Name = cleanPath(h.Name)
+		if h.Typeflag != tar.TypeReg {
+			open = nil
+		}
+		c.addInjection(injection{hdr: &h, open: open})
+	}
+}
+
+func (c *config) addInjection(in injection) {
+	c.inject = append(c.inject, in)
+	if in.hdr.Typeflag != tar.TypeDir {
+		c.injected[in.hdr.Name] = true
+	}
+}
+
+// inject writes the injected entries, preceded by any parent directories
+// the archive doesn't have yet.
+func (c *converter) inject(tmpl *templater) error {
+	for _, in := range c.cfg.inject {
+		if in.hdr.Typeflag == tar.TypeDir && c.dirs.Has(in.hdr.Name) {
+			continue
+		}
+		if err := c.mkdirAll(path.Dir(in.hdr.Name)); err != nil {
+			return err
+		}
+		if err := c.injectOne(in, tmpl); err != nil {
+			return fmt.Errorf("inject %q: %w", in.hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+func (c *converter) injectOne(in injection, tmpl *templater) error {
+	hdr := *in.hdr
+	var body io.Reader = bytes.NewReader(in.content)
+	if in.open != nil {
+		rc, err := in.open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		body = rc
+	}
+	if tmpl.matches(&hdr) {
+		var err error
+		if body, err = tmpl.render(&hdr, body); err != nil {
+			return err
+		}
+	}
+	return c.emit(&hdr, body)
+}
+
+// mkdirAll writes directory entries for dir and its missing parents.
+func (c *converter) mkdirAll(dir string) error {
+	if dir == "." || c.dirs.Has(dir) {
+		return nil
+	}
+	if err := c.mkdirAll(path.Dir(dir)); err != nil {
+		return err
+	}
+	return c.emit(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     dir,
+		Mode:     0o755,
+		ModTime:  time.Unix(0, 0),
+	}, nil)
+}
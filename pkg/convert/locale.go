@@ -0,0 +1,92 @@
+package convert
+
+import (
+	"path"
+	"strings"
+)
+
+// Directories that WithLocales strips.
+const (
+	zoneinfoDir = "usr/share/zoneinfo"
+	localeDir   = "usr/lib/locale"
+)
+
+// WithLocales leaves out the time zones of usr/share/zoneinfo and the
+// compiled locales of usr/lib/locale but those named, which in glibc images
+// take up more room than anything else an initramfs could do without.
+//
+// Zones are named as under zoneinfo, such as UTC or Europe/Berlin; naming
+// a directory keeps all of its zones. A zone is also kept in Etc, where
+// tzdata has UTC and the like and links the top-level names to, but other
+// links are not followed: a zone linking to another needs that one named
+// too. Locales are named as in LANG, such as en_US.UTF-8, and match their
+// directories however the codeset is spelled, en_US.utf8 included; C.UTF-8
+// is always kept. The locale-archive, which holds every locale compiled
+// into it, is left out: images that need a locale should compile it into
+// a directory of its own with localedef --no-archive.
+func WithLocales(locales, zones []string) Option {
+	return func(c *config) {
+		c.stripLocales = true
+		c.keepLocales = append(c.keepLocales, locales...)
+		c.keepZones = append(c.keepZones, zones...)
+	}
+}
+
+// localeExcluded reports whether WithLocales strips the cleaned path p.
+func (c *config) localeExcluded(p string) bool {
+	if !c.stripLocales {
+		return false
+	}
+	if rel, ok := strings.CutPrefix(p, zoneinfoDir+"/"); ok {
+		for _, z := range c.keepZones {
+			z = strings.Trim(path.Clean(z), "/")
+			if keepsPath(z, rel) || keepsPath("Etc/"+z, rel) {
+				return false
+			}
+		}
+		return true
+	}
+	if rel, ok := strings.CutPrefix(p, localeDir+"/"); ok {
+		name, _, _ := strings.Cut(rel, "/")
+		if normalizeLocale(name) == normalizeLocale("C.UTF-8") {
+			return false
+		}
+		for _, l := range c.keepLocales {
+			if normalizeLocale(name) == normalizeLocale(l) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// keepsPath reports whether keeping kept, a path relative to a stripped
+// directory, keeps rel: kept itself, what is below it, and the
+// directories above it.
+func keepsPath(kept, rel string) bool {
+	return rel == kept || strings.HasPrefix(rel, kept+"/") || strings.HasPrefix(kept, rel+"/")
+}
+
+// normalizeLocale spells the codeset of a locale name the way glibc names
+// locale directories: "en_US.UTF-8@euro" becomes "en_US.utf8@euro".
+func normalizeLocale(name string) string {
+	lang, rest, ok := strings.Cut(name, ".")
+	if !ok {
+		return name
+	}
+	codeset, modifier, hasModifier := strings.Cut(rest, "@")
+	var b strings.Builder
+	b.WriteString(lang)
+	b.WriteByte('.')
+	for _, r := range strings.ToLower(codeset) {
+		if 'a' <= r && r <= 'z' || '0' <= r && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	if hasModifier {
+		b.WriteByte('@')
+		b.WriteString(modifier)
+	}
+	return b.String()
+}
@@ -0,0 +1,87 @@
+package convert_test
+
+import (
+	"testing"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+func localeImage() *ocitest.Image {
+	return ocitest.New(ocitest.NewLayer().
+		Dir("usr").
+		Dir("usr/share").
+		Dir("usr/share/zoneinfo").
+		File("usr/share/zoneinfo/UTC", "utc").
+		Dir("usr/share/zoneinfo/Etc").
+		File("usr/share/zoneinfo/Etc/UTC", "etc utc").
+		File("usr/share/zoneinfo/Etc/GMT", "gmt").
+		Dir("usr/share/zoneinfo/Europe").
+		File("usr/share/zoneinfo/Europe/Berlin", "berlin").
+		File("usr/share/zoneinfo/Europe/Paris", "paris").
+		Dir("usr/share/zoneinfo/America").
+		File("usr/share/zoneinfo/America/New_York", "new york").
+		Symlink("usr/share/zoneinfo/America/Detroit", "New_York").
+		Dir("usr/lib").
+		Dir("usr/lib/locale").
+		File("usr/lib/locale/locale-archive", "archive").
+		Dir("usr/lib/locale/C.utf8").
+		File("usr/lib/locale/C.utf8/LC_CTYPE", "c").
+		Dir("usr/lib/locale/en_US.utf8").
+		File("usr/lib/locale/en_US.utf8/LC_CTYPE", "en").
+		Dir("usr/lib/locale/de_DE.utf8@euro").
+		File("usr/lib/locale/de_DE.utf8@euro/LC_CTYPE", "de").
+		Dir("usr/lib/locale/fr_FR.utf8").
+		File("usr/lib/locale/fr_FR.utf8/LC_CTYPE", "fr").
+		File("usr/lib/libc.so.6", "libc"))
+}
+
+// WithLocales keeps the zones named, with their directories and their
+// copies in Etc, and the locales named however their codesets are spelled,
+// with C.UTF-8, but not the links of other zones or the locale-archive.
+func TestWithLocales(t *testing.T) {
+	entries := convertAll(t, localeImage(), convert.WithLocales(
+		[]string{"en_US.UTF-8", "de_DE.UTF-8@euro"},
+		[]string{"UTC", "/Europe/", "America/Detroit"},
+	))
+	checkEntries(t, entries, []string{
+		`usr/`,
+		`usr/share/`,
+		`usr/share/zoneinfo/`,
+		`usr/share/zoneinfo/UTC "utc"`,
+		`usr/share/zoneinfo/Etc/`,
+		`usr/share/zoneinfo/Etc/UTC "etc utc"`,
+		`usr/share/zoneinfo/Europe/`,
+		`usr/share/zoneinfo/Europe/Berlin "berlin"`,
+		`usr/share/zoneinfo/Europe/Paris "paris"`,
+		`usr/share/zoneinfo/America/`,
+		`usr/share/zoneinfo/America/Detroit -> New_York`,
+		`usr/lib/`,
+		`usr/lib/locale/`,
+		`usr/lib/locale/C.utf8/`,
+		`usr/lib/locale/C.utf8/LC_CTYPE "c"`,
+		`usr/lib/locale/en_US.utf8/`,
+		`usr/lib/locale/en_US.utf8/LC_CTYPE "en"`,
+		`usr/lib/locale/de_DE.utf8@euro/`,
+		`usr/lib/locale/de_DE.utf8@euro/LC_CTYPE "de"`,
+		`usr/lib/libc.so.6 "libc"`,
+	})
+}
+
+// Naming nothing keeps C.UTF-8 and the directories themselves only, and
+// not using WithLocales keeps everything.
+func TestWithLocalesNone(t *testing.T) {
+	checkEntries(t, convertAll(t, localeImage(), convert.WithLocales(nil, nil)), []string{
+		`usr/`,
+		`usr/share/`,
+		`usr/share/zoneinfo/`,
+		`usr/lib/`,
+		`usr/lib/locale/`,
+		`usr/lib/locale/C.utf8/`,
+		`usr/lib/locale/C.utf8/LC_CTYPE "c"`,
+		`usr/lib/libc.so.6 "libc"`,
+	})
+	if got := convertAll(t, localeImage()); len(got) != 25 {
+		t.Errorf("got %d entries without WithLocales, want all 25", len(got))
+	}
+}
@@ -0,0 +1,59 @@
+package convert
+
+import (
+	"fmt"
+
+	"github.com/hxtk/ember/internal/pathset"
+)
+
+// WithMemoryLimit bounds the memory of the conversion that grows with the
+// image to about n bytes, spilling to temporary files as
+// oci.WithMemoryLimit does for the paths of the merged view: the
+// directories and symlinks written, WithUsrLayout, the entries moved,
+// WithDirLinks, the directories counted and their counts of
+// subdirectories, and the files left out whose links were written as
+// copies. WithStripDebug then reads at most a quarter of n into memory to
+// strip, with its output, instead of files of up to 256 MiB; larger ones
+// are written as they are. A limit of 0 keeps all paths in memory.
+//
+// What is left grows with the image too, but with parts of it that are
+// smaller by far: the files with hard links still to come, and what
+// options such as WithMetadata and WithEntry were given.
+func WithMemoryLimit(n int64) Option {
+	return func(c *config) { c.memoryLimit = n }
+}
+
+// newBudget returns the budget for the paths of a conversion with cfg:
+// the memory limit less what WithStripDebug reads into memory, which it
+// limits first.
+func (cfg *config) newBudget() *pathset.Budget {
+	limit := cfg.memoryLimit
+	if limit > 0 && cfg.strip != nil {
+		cfg.strip.max = min(maxStripSize, limit/4)
+		limit -= 2 * cfg.strip.max // the file and its stripped copy
+	}
+	return pathset.NewBudget(limit)
+}
+
+// pathsErr reports a failure of the paths of c to spill to or read from
+// their temporary files.
+func (c *converter) pathsErr() error {
+	if err := c.budget.Err(); err != nil {
+		return fmt.Errorf("track converted paths: %w", err)
+	}
+	return nil
+}
+
+// closePaths removes the temporary files of the paths of c.
+func (c *converter) closePaths() {
+	c.dirs.Close()
+	c.dropped.Close()
+	c.unlinked.Close()
+	if c.usrMerger != nil {
+		c.usrMerger.moved.Close()
+	}
+	if c.links != nil {
+		c.links.seen.Close()
+		c.links.subdirs.Close()
+	}
+}
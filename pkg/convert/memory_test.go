@@ -0,0 +1,153 @@
+package convert_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"slices"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/cpio"
+	"github.com/hxtk/ember/pkg/oci"
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+// heapWriter writes an archive to nowhere, and samples the live heap every
+// sampleEvery entries, for the most it grew beyond base.
+type heapWriter struct {
+	*cpio.Writer
+	entries int
+	base    uint64
+	peak    uint64
+}
+
+const sampleEvery = 5000
+
+func (w *heapWriter) WriteHeader(hdr *cpio.Header) error {
+	if w.entries++; w.entries%sampleEvery == 0 {
+		if n := liveHeap(); n > w.base && n-w.base > w.peak {
+			w.peak = n - w.base
+		}
+	}
+	return w.Writer.WriteHeader(hdr)
+}
+
+func liveHeap() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// manyPaths returns the layout of an image of n empty files in bin, in
+// directories of 100, for usr-merging to move.
+func manyPaths(t *testing.T, n int) string {
+	t.Helper()
+	l := ocitest.NewLayer().Dir("bin")
+	for i := 0; i < n; i++ {
+		if i%100 == 0 {
+			l.Dir(fmt.Sprintf("bin/d%04d", i/100))
+		}
+		l.File(fmt.Sprintf("bin/d%04d/some-longer-file-name-%06d", i/100, i), "")
+	}
+	return ocitest.Layout(t, ocitest.New(l))
+}
+
+// peakHeap converts the image at layout with a memory limit of limit, and
+// returns how much the live heap grew during the conversion at most.
+func peakHeap(t *testing.T, layout string, limit int64) uint64 {
+	t.Helper()
+	r, err := oci.Open(layout, oci.WithMemoryLimit(limit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w := &heapWriter{Writer: cpio.NewWriter(io.Discard), base: liveHeap()}
+	if err := convert.Convert(r, w, convert.WithMemoryLimit(limit), convert.WithUsrLayout(convert.UsrMerged)); err != nil {
+		t.Fatal(err)
+	}
+	if w.entries < 2*sampleEvery {
+		t.Fatalf("converted %d entries, want enough to sample", w.entries)
+	}
+	return w.peak
+}
+
+func TestMemoryLimitBoundsHeap(t *testing.T) {
+	if testing.Short() {
+		t.Skip("converts an image of many paths")
+	}
+	layout := manyPaths(t, 50000)
+	unbounded := peakHeap(t, layout, 0)
+	bounded := peakHeap(t, layout, 64<<10)
+	t.Logf("live heap grew by %d bytes without a limit, %d with one", unbounded, bounded)
+
+	// The paths, of about 40 bytes, are kept twice: among those seen in
+	// merging, and those moved into usr. Spilled, about 2 bytes a path are
+	// left in memory for the filters and indexes of the runs.
+	const want = 1 << 20
+	if bounded > want {
+		t.Errorf("live heap grew by %d bytes with a limit of 64 KiB, want at most %d", bounded, want)
+	}
+	if unbounded < 2*bounded {
+		t.Errorf("live heap grew by %d bytes without a limit and %d bytes with one, want the limit to halve it", unbounded, bounded)
+	}
+}
+
+// Under a memory limit, the directories counted WithDirLinks and the
+// entries moved WithUsrLayout spill without changing the archive.
+func TestMemoryLimitSpillsNothingOfTheArchive(t *testing.T) {
+	l := ocitest.NewLayer().Dir("bin").Dir("usr").Dir("usr/bin")
+	for i := 0; i < 300; i++ {
+		l.Dir(fmt.Sprintf("bin/d%03d", i)).File(fmt.Sprintf("bin/d%03d/f", i), "f")
+		l.Dir(fmt.Sprintf("usr/bin/e%03d", i))
+	}
+	img := ocitest.New(l)
+	opts := []convert.Option{convert.WithDirLinks(), convert.WithUsrLayout(convert.UsrMerged)}
+	want := convertAll(t, img, opts...)
+	if got := convertAll(t, img, append(opts, convert.WithMemoryLimit(1<<10))...); !slices.Equal(got, want) {
+		t.Errorf("under a memory limit, converted\n%q\nwant\n%q", got, want)
+	}
+}
+
+// Under a memory limit, WithStripDebug leaves the ELF files of more than a
+// quarter of it as they are.
+func TestMemoryLimitBoundsStrip(t *testing.T) {
+	b := elfWithDebug(1 << 20)
+	layout := ocitest.Layout(t, ocitest.New(ocitest.NewLayer().File("exe.o", string(b))))
+	size := func(opts ...convert.Option) int64 {
+		strip, err := convert.WithStripDebug(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := oci.Open(layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		var buf bytes.Buffer
+		w := cpio.NewWriter(&buf)
+		if err := convert.Convert(r, w, append(opts, strip)...); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		tr := cpio.NewReader(&buf)
+		for hdr := range tr.Entries() {
+			if hdr.Name == "exe.o" {
+				return hdr.Size
+			}
+		}
+		t.Fatalf("no exe.o in the archive: %v", tr.Err())
+		return 0
+	}
+	n := int64(len(b))
+	if got := size(); got >= n {
+		t.Fatalf("stripped the object of %d bytes to %d, want it smaller", n, got)
+	}
+	if got := size(convert.WithMemoryLimit(3 * n)); got != n {
+		t.Errorf("stripped %d bytes to %d under a limit of three times that, want them as they are", n, got)
+	}
+}
@@ -0,0 +1,67 @@
+package convert
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/hxtk/ember/pkg/mtree"
+)
+
+// WithMetadata makes the mtree(8) specification spec authoritative for the
+// metadata of the paths it lists, as buildroot and gen_init_cpio workflows
+// give ownership and device nodes without building as root: an image entry
+// at such a path, after renaming, takes the mode, owner, time, xattrs, and
+// link or device of the spec entry, which must not give a different type.
+// The directories, symlinks, device nodes, and fifos it lists that the
+// image lacks are created after the image's entries, with missing parent
+// directories; regular files it lists must be in the image. Policies see
+// entries as the spec leaves them. Injected entries are not subject to it.
+func WithMetadata(spec *mtree.Spec) Option {
+	return func(c *config) {
+		if c.metadata == nil {
+			c.metadata = make(map[string]*mtree.Entry)
+		}
+		for _, e := range spec.Entries {
+			c.metadata[e.Path] = e
+		}
+	}
+}
+
+// applyMetadata overrides the metadata of hdr with its spec entry, if it
+// has one.
+func (c *converter) applyMetadata(hdr *tar.Header) error {
+	e, ok := c.cfg.metadata[cleanPath(hdr.Name)]
+	if !ok {
+		return nil
+	}
+	c.metaSeen[e.Path] = true
+	return e.Apply(hdr)
+}
+
+// createMetadata writes the spec entries the image didn't have, in the
+// order of their paths so that directories come first.
+func (c *converter) createMetadata() error {
+	paths := make([]string, 0, len(c.cfg.metadata))
+	for p := range c.cfg.metadata {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if c.metaSeen[p] || c.cfg.injected[p] || c.dirs.Has(p) || c.cfg.excluded(p) || (p == "." && c.cfg.dropRoot) {
+			continue
+		}
+		hdr, err := c.cfg.metadata[p].Header()
+		if err != nil {
+			return err
+		}
+		if err := c.mkdirAll(path.Dir(p)); err != nil {
+			return err
+		}
+		if err := c.emit(hdr, nil); err != nil {
+			return fmt.Errorf("create %q from the metadata spec: %w", p, err)
+		}
+	}
+	return nil
+}
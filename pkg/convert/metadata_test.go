@@ -0,0 +1,103 @@
+package convert_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/mtree"
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+func parseSpec(t *testing.T, src string) *mtree.Spec {
+	t.Helper()
+	spec, err := mtree.Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+// devices lists the entries of an archive by name, mode, owner, and device
+// numbers.
+func devices(entries []archiveEntry) []string {
+	var s []string
+	for _, e := range entries {
+		s = append(s, fmt.Sprintf("%s %o %d:%d %d,%d", describe(e.hdr, e.content), e.hdr.Mode, e.hdr.Uid, e.hdr.Gid, e.hdr.RdevMajor, e.hdr.RdevMinor))
+	}
+	return s
+}
+
+// The spec overrides the metadata of the image entries it lists, and the
+// device nodes and directories it lists that the image lacks come after
+// them, with their parents.
+func TestWithMetadata(t *testing.T) {
+	img := ocitest.New(ocitest.NewLayer().
+		Dir("bin").
+		File("bin/su", "su").
+		Symlink("bin/sh", "busybox").
+		Dir("dev").
+		File("etc/shadow", "root::"))
+	spec := parseSpec(t, `
+./bin/su type=file mode=4755 uid=0 gid=0
+./bin/sh type=link link=dash
+./etc/shadow mode=0600 uid=0 gid=42 time=1700000000.0
+./dev/console type=char mode=0600 device=linux,5,1
+./dev/initctl type=fifo mode=0600
+./dev/pts type=dir mode=0755
+./dev/block/sda type=block mode=0660 gid=6 device=linux,8,0
+`)
+	checkEntries(t, devices(archiveEntries(t, img, convert.WithMetadata(spec))), []string{
+		`bin/ 40755 0:0 0,0`,
+		`bin/su "su" 104755 0:0 0,0`,
+		`bin/sh -> dash 120777 0:0 0,0`,
+		`dev/ 40755 0:0 0,0`,
+		`etc/ 40755 0:0 0,0`,
+		`etc/shadow "root::" 100600 0:42 0,0`,
+		`dev/block/ 40755 0:0 0,0`,
+		`dev/block/sda mode 60660 60660 0:6 8,0`,
+		`dev/console mode 20600 20600 0:0 5,1`,
+		`dev/initctl mode 10600 10600 0:0 0,0`,
+		`dev/pts/ 40755 0:0 0,0`,
+	})
+}
+
+// A device table gives device nodes the same way.
+func TestWithMetadataDeviceTable(t *testing.T) {
+	spec, err := mtree.ParseDeviceTable(strings.NewReader(`
+/dev	d	755	0	0	-	-	-	-	-
+/dev/ttyS	c	660	0	5	4	64	0	1	2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := ocitest.New(ocitest.NewLayer().Dir("etc"))
+	checkEntries(t, devices(archiveEntries(t, img, convert.WithMetadata(spec))), []string{
+		`etc/ 40755 0:0 0,0`,
+		`dev/ 40755 0:0 0,0`,
+		`dev/ttyS0 mode 20660 20660 0:5 4,64`,
+		`dev/ttyS1 mode 20660 20660 0:5 4,65`,
+	})
+}
+
+// The conversion fails if the spec gives an image entry another type, or
+// lists a regular file the image doesn't have.
+func TestWithMetadataErrors(t *testing.T) {
+	img := ocitest.New(ocitest.NewLayer().Dir("bin").File("bin/sh", "sh"))
+	for _, tc := range []struct {
+		spec, want string
+	}{
+		{`./bin/sh type=link link=busybox`, "has type link, but the image has a different type"},
+		{`./bin/missing type=file mode=0755`, "a file, which a specification can't give the content of"},
+		{`./dev/null type=char`, "a device without a device keyword"},
+		{`./bin/sh mode=u+x`, "symbolic modes are not supported"},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			_, err := convertArchive(t, img, convert.WithMetadata(parseSpec(t, tc.spec)))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Convert() = %v, want an error: %s", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package convert
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits the kernel puts on names, from linux/limits.h.
+const (
+	pathMax = 4096 // bytes of a path, including its NUL
+	nameMax = 255  // bytes of a path component
+)
+
+// ErrNameLimit is wrapped by the error for an entry whose name exceeds the
+// limits of a conversion with the NameFail policy.
+var ErrNameLimit = errors.New("name exceeds the limits")
+
+// NamePolicy says what a conversion does with an entry whose name exceeds
+// its NameLimits.
+type NamePolicy int
+
+const (
+	// NameFail fails the conversion. It is the default.
+	NameFail NamePolicy = iota
+	// NameSkip leaves the entry out.
+	NameSkip
+	// NameShorten shortens every path component, and symlink target
+	// component, longer than MaxComponent to a prefix of it followed by
+	// "~" and a hash of the whole component, so names stay distinct and
+	// the same component is shortened alike wherever it appears. Entries
+	// still over a limit are left out.
+	NameShorten
+)
+
+// NameLimits bounds the names of archive entries. Zero fields take the
+// kernel's limits, which initramfs unpacking enforces by skipping or
+// failing on entries; MaxDepth is unlimited by default.
+type NameLimits struct {
+	MaxPath      int // bytes of a path, or of a symlink target
+	MaxComponent int // bytes of a component of a path
+	MaxDepth     int // components of a path
+	Policy       NamePolicy
+
+	// Report, if set, is told of every entry that the policy renamed or
+	// left out, with its new name or "" if it was left out, and why.
+	Report func(name, newName, reason string)
+}
+
+// WithNameLimits sets the limits on entry names and what to do with
+// entries over them. Without it, names are held to the kernel's limits
+// and a name over them fails the conversion.
+func WithNameLimits(l NameLimits) Option {
+	return func(c *config) { c.names = l }
+}
+
+func (l NameLimits) maxPath() int {
+	if l.MaxPath > 0 {
+		return l.MaxPath
+	}
+	// Leave room for the "./" prefix and "/" suffix the archive adds.
+	return pathMax - 1 - len("./") - len("/")
+}
+
+func (l NameLimits) maxComponent() int {
+	if l.MaxComponent > 0 {
+		return l.MaxComponent
+	}
+	return nameMax
+}
+
+// apply holds hdr to the limits, shortening its name and symlink target
+// if the policy says so. It reports false if the entry is to be left out.
+func (l NameLimits) apply(hdr *tar.Header) (bool, error) {
+	name := cleanPath(hdr.Name)
+	if name == "." {
+		return true, nil
+	}
+	if l.Policy == NameShorten {
+		short := l.shorten(name)
+		if hdr.Typeflag == tar.TypeSymlink {
+			hdr.Linkname = l.shorten(hdr.Linkname)
+		}
+		if short != name {
+			hdr.Name = short
+			if l.Report != nil {
+				l.Report(name, short, fmt.Sprintf("a component is longer than %d bytes", l.maxComponent()))
+			}
+			name = short
+		}
+	}
+
+	reason := l.check(name, hdr)
+	if reason == "" {
+		return true, nil
+	}
+	if l.Policy == NameFail {
+		return false, fmt.Errorf("%q: %w: %s", name, ErrNameLimit, reason)
+	}
+	if l.Report != nil {
+		l.Report(name, "", reason)
+	}
+	return false, nil
+}
+
+// check returns what is wrong with the cleaned name of hdr, if anything.
+func (l NameLimits) check(name string, hdr *tar.Header) string {
+	if n := len(name); n > l.maxPath() {
+		return fmt.Sprintf("path of %d bytes exceeds the limit of %d", n, l.maxPath())
+	}
+	parts := strings.Split(name, "/")
+	if l.MaxDepth > 0 && len(parts) > l.MaxDepth {
+		return fmt.Sprintf("path of %d components exceeds the limit of %d", len(parts), l.MaxDepth)
+	}
+	for _, p := range parts {
+		if len(p) > l.maxComponent() {
+			return fmt.Sprintf("component of %d bytes exceeds the limit of %d", len(p), l.maxComponent())
+		}
+	}
+	if n := len(hdr.Linkname); hdr.Typeflag == tar.TypeSymlink && n > l.maxPath() {
+		return fmt.Sprintf("symlink target of %d bytes exceeds the limit of %d", n, l.maxPath())
+	}
+	return ""
+}
+
+// shorten shortens the overlong components of the slash-separated path p.
+func (l NameLimits) shorten(p string) string {
+	limit := l.maxComponent()
+	parts := strings.Split(p, "/")
+	changed := false
+	for i, c := range parts {
+		if len(c) <= limit {
+			continue
+		}
+		sum := sha256.Sum256([]byte(c))
+		suffix := "~" + hex.EncodeToString(sum[:4])
+		keep := max(limit-len(suffix), 0)
+		for keep > 0 && !utf8.RuneStart(c[keep]) {
+			keep--
+		}
+		parts[i] = c[:keep] + suffix
+		changed = true
+	}
+	if !changed {
+		return p
+	}
+	return strings.Join(parts, "/")
+}
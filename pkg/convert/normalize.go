@@ -0,0 +1,166 @@
+package convert
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Built-in content normalizers accepted by WithNormalize. Each makes
+// files that differ from build to build of the same image, even with
+// fixed timestamps, the same in every archive.
+const (
+	// NormalizeLdconfig drops ldconfig's auxiliary cache, which records
+	// the inodes and change times of the libraries it scanned. ldconfig
+	// rebuilds it when it is missing.
+	NormalizeLdconfig = "ldconfig"
+
+	// NormalizePycache rewrites the headers of the compiled Python 3.7+
+	// modules in __pycache__ directories that record the modification
+	// time of their source as unchecked hash-based ones, as py_compile
+	// writes with --invalidation-mode unchecked-hash, with the hash
+	// zeroed. Python loads them without looking at the source, which an
+	// archive doesn't change.
+	NormalizePycache = "pycache"
+
+	// NormalizeLogs empties the files below var/log, keeping them and
+	// their metadata, and drops the systemd journal.
+	NormalizeLogs = "logs"
+
+	// NormalizeMachineID empties etc/machine-id and
+	// var/lib/dbus/machine-id, which systemd then fills in at boot, and
+	// drops the random seeds that systemd and sysvinit carry over
+	// between boots.
+	NormalizeMachineID = "machine-id"
+
+	// NormalizeAll applies every normalizer.
+	NormalizeAll = "all"
+)
+
+// normalizer makes the content of the regular files that match the same
+// from build to build, and leaves out the paths of exclude.
+type normalizer struct {
+	exclude []string
+	match   func(p string) bool
+	// rewrite returns the reader to write the content of hdr from, which
+	// it reads from body, adjusting hdr.Size to match.
+	rewrite func(hdr *tar.Header, body io.Reader) (io.Reader, error)
+}
+
+var normalizers = map[string]*normalizer{
+	NormalizeLdconfig: {
+		exclude: []string{"var/cache/ldconfig/aux-cache"},
+	},
+	NormalizePycache: {
+		match: func(p string) bool {
+			return strings.HasSuffix(p, ".pyc") && path.Base(path.Dir(p)) == "__pycache__"
+		},
+		rewrite: normalizePyc,
+	},
+	NormalizeLogs: {
+		exclude: []string{"var/log/journal/*"},
+		match:   func(p string) bool { return strings.HasPrefix(p, "var/log/") },
+		rewrite: empty,
+	},
+	NormalizeMachineID: {
+		exclude: []string{
+			"var/lib/systemd/random-seed",
+			"var/lib/urandom/random-seed",
+		},
+		match:   func(p string) bool { return p == "etc/machine-id" || p == "var/lib/dbus/machine-id" },
+		rewrite: empty,
+	},
+}
+
+// NormalizerNames returns the names WithNormalize accepts, sorted.
+func NormalizerNames() []string {
+	names := []string{NormalizeAll}
+	for name := range normalizers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithNormalize applies a built-in content normalizer, see
+// NormalizeLdconfig, NormalizePycache, NormalizeLogs, NormalizeMachineID,
+// and NormalizeAll, to the image's entries. Injected entries are not
+// normalized.
+func WithNormalize(name string) (Option, error) {
+	var ns []*normalizer
+	if name == NormalizeAll {
+		for _, n := range NormalizerNames() {
+			if n != NormalizeAll {
+				ns = append(ns, normalizers[n])
+			}
+		}
+	} else if n, ok := normalizers[name]; ok {
+		ns = append(ns, n)
+	} else {
+		return nil, fmt.Errorf("unknown normalizer %q", name)
+	}
+	return func(c *config) {
+		for _, n := range ns {
+			c.exclude = append(c.exclude, n.exclude...)
+			if n.rewrite != nil {
+				c.normalize = append(c.normalize, n)
+			}
+		}
+	}, nil
+}
+
+// normalizeContent returns the reader to write the content of hdr from,
+// which is body itself unless a normalizer rewrites it, adjusting hdr.Size
+// to match.
+func (c *config) normalizeContent(hdr *tar.Header, body io.Reader) (io.Reader, error) {
+	if len(c.normalize) == 0 || (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA) {
+		return body, nil
+	}
+	name := cleanPath(hdr.Name)
+	for _, n := range c.normalize {
+		if n.match(name) {
+			return n.rewrite(hdr, body)
+		}
+	}
+	return body, nil
+}
+
+// empty gives hdr no content.
+func empty(hdr *tar.Header, body io.Reader) (io.Reader, error) {
+	hdr.Size = 0
+	return bytes.NewReader(nil), nil
+}
+
+// pycHashMagic is the first magic number of the compiled modules whose
+// headers have flags, from Python 3.7 on (PEP 552). Python 2 numbers are
+// above 20000.
+const pycHashMagic = 3392
+
+// normalizePyc rewrites a compiled Python module's header of magic,
+// flags, source modification time, and source size as an unchecked
+// hash-based one with a zero hash. Other modules are left as they are.
+func normalizePyc(hdr *tar.Header, body io.Reader) (io.Reader, error) {
+	if hdr.Size < 16 {
+		return body, nil
+	}
+	h := make([]byte, 16)
+	if _, err := io.ReadFull(body, h); err != nil {
+		return nil, fmt.Errorf("read %q: %w", hdr.Name, err)
+	}
+	content := io.MultiReader(bytes.NewReader(h), io.LimitReader(body, hdr.Size-16))
+	magic := binary.LittleEndian.Uint16(h)
+	if h[2] != '\r' || h[3] != '\n' || magic < pycHashMagic || magic >= 20000 {
+		return content, nil
+	}
+	if binary.LittleEndian.Uint32(h[4:]) != 0 {
+		return content, nil // hash-based already
+	}
+	binary.LittleEndian.PutUint32(h[4:], 1)
+	clear(h[8:])
+	return content, nil
+}
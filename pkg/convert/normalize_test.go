@@ -0,0 +1,125 @@
+package convert_test
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+func normalize(t *testing.T, name string) convert.Option {
+	t.Helper()
+	opt, err := convert.WithNormalize(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opt
+}
+
+// pyc is the header of a compiled Python module of magic number magic,
+// with flags, the modification time 0x11223344, and the size 0x0a, and then
+// code.
+func pyc(magic uint16, flags byte) string {
+	return string([]byte{byte(magic), byte(magic >> 8), '\r', '\n', flags, 0, 0, 0, 0x44, 0x33, 0x22, 0x11, 0x0a, 0, 0, 0}) + "code"
+}
+
+func normalizeImage() *ocitest.Image {
+	return ocitest.New(ocitest.NewLayer().
+		Dir("etc").
+		File("etc/machine-id", "0123456789abcdef\n").
+		File("etc/hostname", "host").
+		Dir("usr").
+		Dir("usr/lib").
+		Dir("usr/lib/__pycache__").
+		File("usr/lib/__pycache__/os.cpython-312.pyc", pyc(3531, 0)).
+		File("usr/lib/__pycache__/hashed.cpython-312.pyc", pyc(3531, 3)).
+		File("usr/lib/__pycache__/old.pyc", pyc(62211, 0)).
+		File("usr/lib/__pycache__/short.pyc", "\x03\xf3\r\n").
+		File("usr/lib/os.pyc", pyc(3531, 0)).
+		Dir("var").
+		Dir("var/cache").
+		Dir("var/cache/ldconfig").
+		File("var/cache/ldconfig/aux-cache", "inodes").
+		Dir("var/lib").
+		Dir("var/lib/systemd").
+		File("var/lib/systemd/random-seed", "seed").
+		Dir("var/log").
+		File("var/log/dpkg.log", "installed", ocitest.Mode(0o640)).
+		Dir("var/log/journal").
+		File("var/log/journal/system.journal", "journal"))
+}
+
+// NormalizeAll applies every normalizer: the files that change from build
+// to build are emptied or left out, and compiled modules that record the
+// time of their source get unchecked hash-based headers.
+func TestNormalizeAll(t *testing.T) {
+	var got []string
+	for _, e := range archiveEntries(t, normalizeImage(), normalize(t, convert.NormalizeAll)) {
+		got = append(got, describe(e.hdr, e.content))
+	}
+	checkEntries(t, got, []string{
+		`etc/`,
+		`etc/machine-id ""`,
+		`etc/hostname "host"`,
+		`usr/`,
+		`usr/lib/`,
+		`usr/lib/__pycache__/`,
+		`usr/lib/__pycache__/os.cpython-312.pyc "\xcb\r\r\n\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00code"`,
+		`usr/lib/__pycache__/hashed.cpython-312.pyc "\xcb\r\r\n\x03\x00\x00\x00D3\"\x11\n\x00\x00\x00code"`,
+		`usr/lib/__pycache__/old.pyc "\x03\xf3\r\n\x00\x00\x00\x00D3\"\x11\n\x00\x00\x00code"`,
+		`usr/lib/__pycache__/short.pyc "\x03\xf3\r\n"`,
+		`usr/lib/os.pyc "\xcb\r\r\n\x00\x00\x00\x00D3\"\x11\n\x00\x00\x00code"`,
+		`var/`,
+		`var/cache/`,
+		`var/cache/ldconfig/`,
+		`var/lib/`,
+		`var/lib/systemd/`,
+		`var/log/`,
+		`var/log/dpkg.log ""`,
+		`var/log/journal/`,
+	})
+}
+
+// Each normalizer alone changes only its own files.
+func TestNormalize(t *testing.T) {
+	all := convertAll(t, normalizeImage())
+	for _, tc := range []struct {
+		name    string
+		changed []string
+	}{
+		{convert.NormalizeLdconfig, []string{`var/cache/ldconfig/aux-cache "inodes"`}},
+		{convert.NormalizePycache, []string{`usr/lib/__pycache__/os.cpython-312.pyc`}},
+		{convert.NormalizeLogs, []string{`var/log/dpkg.log "installed"`, `var/log/journal/system.journal "journal"`}},
+		{convert.NormalizeMachineID, []string{`etc/machine-id "0123456789abcdef\n"`, `var/lib/systemd/random-seed "seed"`}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := convertAll(t, normalizeImage(), normalize(t, tc.name))
+			var changed []string
+			for _, e := range all {
+				if !slices.Contains(got, e) {
+					changed = append(changed, e)
+				}
+			}
+			if len(changed) != len(tc.changed) {
+				t.Fatalf("changed %q, want %q", changed, tc.changed)
+			}
+			for i, e := range changed {
+				if !strings.HasPrefix(e, tc.changed[i]) {
+					t.Errorf("changed %q, want %q", changed, tc.changed)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizerNames(t *testing.T) {
+	want := []string{"all", "ldconfig", "logs", "machine-id", "pycache"}
+	if got := convert.NormalizerNames(); !slices.Equal(got, want) {
+		t.Errorf("NormalizerNames() = %q, want %q", got, want)
+	}
+	if _, err := convert.WithNormalize("timestamps"); err == nil || !strings.Contains(err.Error(), `unknown normalizer "timestamps"`) {
+		t.Errorf("WithNormalize(timestamps) = %v, want an unknown normalizer error", err)
+	}
+}
@@ -0,0 +1,249 @@
+package convert
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// A Plugin is an external program that filters and transforms the image's
+// entries, so that users can extend a conversion in any language.
+//
+// The protocol is a sequence of frames over the plugin's stdin and stdout.
+// A frame is a line holding a JSON object, followed by exactly "size"
+// bytes of content:
+//
+//	{"name":"etc/hostname","type":"file","mode":420,"uid":0,"gid":0,"mtime":0,"size":6}
+//	ember
+//
+// "type" is one of file, dir, symlink, char, block, and fifo; "linkname"
+// holds a symlink's target, "devmajor" and "devminor" a device's numbers,
+// and "xattrs" maps extended attribute names to their base64-encoded
+// values. Names are relative to the root, without a leading "./" or "/".
+//
+// For every entry of the image, the plugin is sent its frame and answers
+// with the frames of the entries to write in its place, none to drop it,
+// followed by the line {"end":true}. It may change any field, the content
+// included, and add entries, but must read each frame it is sent in full
+// and flush its answer before waiting for the next one. When the image is
+// done, its stdin is closed and it must exit with status 0. Its stderr is
+// ember's.
+type Plugin struct {
+	name   string
+	cmd    *exec.Cmd
+	in     io.WriteCloser
+	out    *bufio.Reader
+	failed bool
+
+	closed   bool
+	closeErr error
+}
+
+// StartPlugin starts the plugin program name with args.
+func StartPlugin(name string, args ...string) (*Plugin, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start plugin %s: %w", name, err)
+	}
+	return &Plugin{name: name, cmd: cmd, in: in, out: bufio.NewReader(out)}, nil
+}
+
+// Close ends the plugin's input and waits for it to exit. A plugin that
+// failed to follow the protocol is killed instead. Closing again returns
+// the same error.
+func (p *Plugin) Close() error {
+	if p.closed {
+		return p.closeErr
+	}
+	p.closed = true
+	if p.failed {
+		p.cmd.Process.Kill()
+	}
+	p.in.Close()
+	if err := p.cmd.Wait(); err != nil && !p.failed {
+		p.closeErr = fmt.Errorf("plugin %s: %w", p.name, err)
+	}
+	return p.closeErr
+}
+
+// WithPlugin passes the image's entries, after excluding, renaming, and
+// template rendering, through p before writing them. It may be given
+// several times; each plugin then sees the entries the one before it
+// wrote. Injected entries don't pass through plugins. The caller closes p
+// once the conversion is done.
+func WithPlugin(p *Plugin) Option {
+	return func(c *config) { c.plugins = append(c.plugins, p) }
+}
+
+// pluginFrame is the JSON line that starts a frame.
+type pluginFrame struct {
+	Name     string            `json:"name,omitempty"`
+	Type     string            `json:"type,omitempty"`
+	Mode     int64             `json:"mode"`
+	Uid      int               `json:"uid"`
+	Gid      int               `json:"gid"`
+	ModTime  int64             `json:"mtime"`
+	Size     int64             `json:"size"`
+	Linkname string            `json:"linkname,omitempty"`
+	Devmajor int64             `json:"devmajor,omitempty"`
+	Devminor int64             `json:"devminor,omitempty"`
+	Xattrs   map[string][]byte `json:"xattrs,omitempty"`
+	End      bool              `json:"end,omitempty"`
+}
+
+var pluginTypes = map[byte]string{
+	tar.TypeReg:     "file",
+	tar.TypeDir:     "dir",
+	tar.TypeSymlink: "symlink",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+	tar.TypeFifo:    "fifo",
+}
+
+// filter sends hdr and its content to the plugin and calls write for each
+// entry it answers with.
+func (p *Plugin) filter(hdr *tar.Header, body io.Reader, write func(*tar.Header, io.Reader) error) error {
+	sent := make(chan error, 1)
+	go func() { sent <- p.send(hdr, body) }()
+
+	for {
+		h, err := p.receive()
+		if err != nil {
+			p.failed = true
+			return fmt.Errorf("plugin %s, answering for %q: %w", p.name, hdr.Name, err)
+		}
+		if h == nil {
+			break
+		}
+		content := io.LimitReader(p.out, h.Size)
+		if err := write(h, content); err != nil {
+			p.failed = true
+			return err
+		}
+		if _, err := io.Copy(io.Discard, content); err != nil {
+			p.failed = true
+			return fmt.Errorf("plugin %s: read content of %q: %w", p.name, h.Name, err)
+		}
+	}
+	if err := <-sent; err != nil {
+		p.failed = true
+		return fmt.Errorf("plugin %s: send %q: %w", p.name, hdr.Name, err)
+	}
+	return nil
+}
+
+// send writes the frame of hdr to the plugin.
+func (p *Plugin) send(hdr *tar.Header, body io.Reader) error {
+	t := hdr.Typeflag
+	if t == tar.TypeRegA {
+		t = tar.TypeReg
+	}
+	typ, ok := pluginTypes[t]
+	if !ok {
+		return fmt.Errorf("unsupported entry type %q", hdr.Typeflag)
+	}
+	f := pluginFrame{
+		Name:     cleanPath(hdr.Name),
+		Type:     typ,
+		Mode:     hdr.Mode & 07777,
+		Uid:      hdr.Uid,
+		Gid:      hdr.Gid,
+		ModTime:  hdr.ModTime.Unix(),
+		Linkname: hdr.Linkname,
+		Devmajor: hdr.Devmajor,
+		Devminor: hdr.Devminor,
+	}
+	if t == tar.TypeReg {
+		f.Size = hdr.Size
+	}
+	for k, v := range hdr.PAXRecords {
+		if after, ok := strings.CutPrefix(k, "SCHILY.xattr."); ok {
+			if f.Xattrs == nil {
+				f.Xattrs = make(map[string][]byte)
+			}
+			f.Xattrs[after] = []byte(v)
+		}
+	}
+	line, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if _, err := p.in.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if f.Size > 0 {
+		if _, err := io.CopyN(p.in, body, f.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receive reads the next entry the plugin answers with, or nil at the end
+// of its answer.
+func (p *Plugin) receive() (*tar.Header, error) {
+	line, err := p.out.ReadBytes('\n')
+	if err == io.EOF {
+		return nil, errors.New("plugin exited before the end of its answer")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f pluginFrame
+	if err := json.Unmarshal(line, &f); err != nil {
+		return nil, fmt.Errorf("bad frame: %w", err)
+	}
+	if f.End {
+		return nil, nil
+	}
+	if f.Name == "" {
+		return nil, errors.New("frame without a name")
+	}
+	if f.Size < 0 || (f.Size > 0 && f.Type != "file") {
+		return nil, fmt.Errorf("frame for %q has size %d", f.Name, f.Size)
+	}
+	hdr := &tar.Header{
+		Name:     cleanPath(f.Name),
+		Mode:     f.Mode & 07777,
+		Uid:      f.Uid,
+		Gid:      f.Gid,
+		Size:     f.Size,
+		ModTime:  time.Unix(f.ModTime, 0),
+		Linkname: f.Linkname,
+		Devmajor: f.Devmajor,
+		Devminor: f.Devminor,
+		Format:   tar.FormatPAX,
+	}
+	known := false
+	for t, name := range pluginTypes {
+		if name == f.Type {
+			hdr.Typeflag, known = t, true
+		}
+	}
+	if !known {
+		return nil, fmt.Errorf("frame for %q has unknown type %q", f.Name, f.Type)
+	}
+	for k, v := range f.Xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords["SCHILY.xattr."+k] = string(v)
+	}
+	return hdr, nil
+}
@@ -0,0 +1,181 @@
+package convert_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+// pluginEnv names the behavior of the test binary run as a plugin.
+const pluginEnv = "EMBER_TEST_PLUGIN"
+
+// TestMain runs the test binary as the plugin pluginEnv names, if it does.
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(pluginEnv); mode != "" {
+		os.Exit(runPlugin(mode))
+	}
+	os.Exit(m.Run())
+}
+
+// runPlugin answers the frames of stdin as mode says, and returns the exit
+// status.
+func runPlugin(mode string) int {
+	in, out := bufio.NewReader(os.Stdin), bufio.NewWriter(os.Stdout)
+	answer := func(f map[string]any, content []byte) {
+		f["size"] = len(content)
+		line, _ := json.Marshal(f)
+		out.Write(append(line, '\n'))
+		out.Write(content)
+	}
+	for {
+		line, err := in.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		var f map[string]any
+		if err := json.Unmarshal(line, &f); err != nil {
+			return 2
+		}
+		content := make([]byte, int(f["size"].(float64)))
+		if _, err := io.ReadFull(in, content); err != nil {
+			return 2
+		}
+		name := f["name"].(string)
+
+		switch mode {
+		case "echo", "exit3":
+			answer(f, content)
+		case "transform":
+			switch {
+			case strings.HasPrefix(name, "etc/drop"):
+			case f["type"] == "file":
+				f["mode"] = 0o600
+				answer(f, []byte(strings.ToUpper(string(content))))
+				answer(map[string]any{"name": name + ".size", "type": "file", "mode": 0o644}, fmt.Appendf(nil, "%d", len(content)))
+			default:
+				answer(f, content)
+			}
+		case "suffix":
+			if f["type"] == "file" {
+				content = append(content, '!')
+			}
+			answer(f, content)
+		case "xattrs":
+			if f["type"] == "file" {
+				content, _ = json.Marshal(f["xattrs"])
+			}
+			answer(f, content)
+		case "garbage":
+			out.WriteString("not a frame\n")
+		case "eof":
+			return 0
+		case "dir size":
+			out.WriteString(`{"name":"d","type":"dir","size":3}` + "\nabc")
+		case "socket":
+			out.WriteString(`{"name":"s","type":"socket"}` + "\n")
+		case "no name":
+			out.WriteString(`{"type":"file"}` + "\n")
+		}
+		out.WriteString(`{"end":true}` + "\n")
+		out.Flush()
+	}
+	if mode == "exit3" {
+		return 3
+	}
+	return 0
+}
+
+// startPlugin starts the test binary as the plugin mode, to be closed when
+// the test ends.
+func startPlugin(t *testing.T, mode string) *convert.Plugin {
+	t.Helper()
+	t.Setenv(pluginEnv, mode)
+	p, err := convert.StartPlugin(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func pluginImage() *ocitest.Image {
+	return ocitest.New(ocitest.NewLayer().
+		Dir("etc").
+		File("etc/hostname", "host", ocitest.Xattr("user.origin", "image")).
+		File("etc/drop-me", "x").
+		Symlink("etc/localtime", "/usr/share/zoneinfo/UTC"))
+}
+
+// A plugin may change, drop, and add entries, and each of several sees
+// what the one before it wrote.
+func TestPluginTransforms(t *testing.T) {
+	transform, suffix := startPlugin(t, "transform"), startPlugin(t, "suffix")
+	entries := archiveEntries(t, pluginImage(), convert.WithPlugin(transform), convert.WithPlugin(suffix))
+	if err := transform.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := suffix.Close(); err != nil {
+		t.Error(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, fmt.Sprintf("%s %o", describe(e.hdr, e.content), e.hdr.Mode&0o7777))
+	}
+	checkEntries(t, got, []string{
+		`etc/ 755`,
+		`etc/hostname "HOST!" 600`,
+		`etc/hostname.size "4!" 644`,
+		`etc/localtime -> /usr/share/zoneinfo/UTC 777`,
+	})
+}
+
+// Plugins see the extended attributes of entries, base64 encoded.
+func TestPluginXattrs(t *testing.T) {
+	entries := convertAll(t, pluginImage(), convert.WithPlugin(startPlugin(t, "xattrs")))
+	checkEntries(t, entries[1:2], []string{`etc/hostname "{\"user.origin\":\"aW1hZ2U=\"}"`})
+}
+
+// The conversion fails, and Close doesn't wait on the plugin, when it
+// breaks the protocol.
+func TestPluginProtocolErrors(t *testing.T) {
+	for _, tc := range []struct {
+		mode, want string
+	}{
+		{"garbage", "bad frame"},
+		{"eof", "plugin exited before the end of its answer"},
+		{"dir size", `frame for "d" has size 3`},
+		{"socket", `frame for "s" has unknown type "socket"`},
+		{"no name", "frame without a name"},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			p := startPlugin(t, tc.mode)
+			_, err := convertArchive(t, pluginImage(), convert.WithPlugin(p))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Convert() = %v, want an error: %s", err, tc.want)
+			}
+			if err := p.Close(); err != nil {
+				t.Errorf("Close() of a failed plugin = %v, want it killed", err)
+			}
+		})
+	}
+}
+
+// A plugin that exits with a failure fails Close, every time.
+func TestPluginExitStatus(t *testing.T) {
+	p := startPlugin(t, "exit3")
+	convertAll(t, pluginImage(), convert.WithPlugin(p))
+	err := p.Close()
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("Close() = %v, want exit status 3", err)
+	}
+	if again := p.Close(); again != err {
+		t.Errorf("second Close() = %v, want %v", again, err)
+	}
+}
@@ -0,0 +1,563 @@
+package convert
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrPolicy is wrapped by the error for an entry that a fail rule of a
+// Policy matched.
+var ErrPolicy = errors.New("policy violation")
+
+// A Policy is a list of rules evaluated in order for every entry of the
+// image, so that organisation-wide rules for what an initramfs may hold
+// can be kept as code. A rule is one line:
+//
+//	drop if path under "usr/share/doc"
+//	fail "setuid binaries need review" if type == "file" and mode & 04000 != 0
+//	set uid = 0, gid = 0 if path under "home"
+//	set mode = mode & 0755 if layer > 0
+//
+// drop leaves the entry out, and with a directory what is under it, fail
+// fails the conversion with the message, and set assigns the fields mode,
+// uid, gid, or mtime, after which the later rules see the new values. A
+// rule without an "if" applies to every entry. Rules after a drop or fail
+// that applied are not evaluated. "#" starts a comment.
+//
+// Conditions compare the fields of the entry, combined with and, or, not,
+// and parentheses:
+//
+//	path      the path, without a leading "/" or "./"
+//	name      its last element
+//	type      file, dir, symlink, char, block, or fifo
+//	linkname  the symlink target
+//	mode      the permission bits, such as 0755
+//	uid, gid  the owner
+//	size      the size of a file, in bytes
+//	mtime     the modification time, in seconds since the epoch
+//	layer     the position in the manifest of the layer it came from, base first
+//
+// with ==, !=, <, <=, >, and >=; numbers with & and |; and paths with
+// "matches", a path.Match glob, and "under", which holds for the path
+// itself and everything below it. Numbers may be decimal, octal with a
+// leading 0, or hexadecimal, and take the suffixes K, M, and G for powers
+// of 1024; strings are Go string literals.
+type Policy struct {
+	rules []policyRule
+}
+
+// ParsePolicy parses the rules of a policy, one per line.
+func ParsePolicy(src string) (*Policy, error) {
+	p := &Policy{}
+	for i, line := range strings.Split(src, "\n") {
+		toks, err := lexPolicy(line)
+		if err != nil {
+			return nil, fmt.Errorf("policy line %d: %w", i+1, err)
+		}
+		if len(toks) == 0 {
+			continue
+		}
+		ps := &policyParser{toks: toks}
+		rule, err := ps.rule()
+		if err != nil {
+			return nil, fmt.Errorf("policy line %d: %w", i+1, err)
+		}
+		rule.line = i + 1
+		p.rules = append(p.rules, rule)
+	}
+	return p, nil
+}
+
+// WithPolicy applies the rules of p to every image entry, after excluding
+// and renaming. Injected entries are not subject to it.
+func WithPolicy(p *Policy) Option {
+	return func(c *config) { c.policies = append(c.policies, p) }
+}
+
+// applyPolicies applies the policies of c to hdr, read from layer. What is
+// under a directory they dropped is dropped with it, as the archive can't
+// hold it without its parent.
+func (c *converter) applyPolicies(hdr *tar.Header, layer int) (bool, error) {
+	if len(c.cfg.policies) == 0 {
+		return true, nil
+	}
+	name := cleanPath(hdr.Name)
+	for d := path.Dir(name); d != "."; d = path.Dir(d) {
+		if c.dropped.Has(d) {
+			return false, nil
+		}
+	}
+	for _, p := range c.cfg.policies {
+		if ok, err := p.apply(hdr, layer); !ok {
+			if err == nil && hdr.Typeflag == tar.TypeDir {
+				c.dropped.Add(name)
+			}
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// apply evaluates the rules for hdr, read from layer, updating it for set
+// rules. It reports false if the entry is to be dropped.
+func (p *Policy) apply(hdr *tar.Header, layer int) (bool, error) {
+	e := policyEntry{hdr: hdr, layer: layer}
+	for _, r := range p.rules {
+		if r.cond != nil && !r.cond.eval(e).b {
+			continue
+		}
+		switch r.action {
+		case "drop":
+			return false, nil
+		case "fail":
+			return false, fmt.Errorf("%q: %w: %s (policy line %d)", cleanPath(hdr.Name), ErrPolicy, r.message, r.line)
+		case "set":
+			for _, a := range r.assign {
+				e.set(a.field, a.value.eval(e).n)
+			}
+		}
+	}
+	return true, nil
+}
+
+type policyRule struct {
+	line    int
+	action  string // drop, fail, or set
+	message string // of fail
+	assign  []policyAssign
+	cond    policyExpr // nil if unconditional
+}
+
+type policyAssign struct {
+	field string
+	value policyExpr
+}
+
+// policyEntry is an entry as policy expressions see it.
+type policyEntry struct {
+	hdr   *tar.Header
+	layer int
+}
+
+// policyValue is the value of an expression, of the type its kind says.
+type policyValue struct {
+	n int64
+	s string
+	b bool
+}
+
+type policyKind int
+
+const (
+	kindNumber policyKind = iota
+	kindString
+	kindBool
+)
+
+func (k policyKind) String() string {
+	return [...]string{"number", "string", "boolean"}[k]
+}
+
+var policyFields = map[string]policyKind{
+	"path": kindString, "name": kindString, "type": kindString, "linkname": kindString,
+	"mode": kindNumber, "uid": kindNumber, "gid": kindNumber, "size": kindNumber,
+	"mtime": kindNumber, "layer": kindNumber,
+}
+
+// settable are the fields set rules may assign.
+var settable = map[string]bool{"mode": true, "uid": true, "gid": true, "mtime": true}
+
+func (e policyEntry) field(name string) policyValue {
+	h := e.hdr
+	switch name {
+	case "path":
+		return policyValue{s: cleanPath(h.Name)}
+	case "name":
+		return policyValue{s: path.Base(cleanPath(h.Name))}
+	case "type":
+		t := h.Typeflag
+		if t == tar.TypeRegA {
+			t = tar.TypeReg
+		}
+		return policyValue{s: pluginTypes[t]}
+	case "linkname":
+		return policyValue{s: h.Linkname}
+	case "mode":
+		return policyValue{n: h.Mode & 07777}
+	case "uid":
+		return policyValue{n: int64(h.Uid)}
+	case "gid":
+		return policyValue{n: int64(h.Gid)}
+	case "size":
+		return policyValue{n: h.Size}
+	case "mtime":
+		return policyValue{n: h.ModTime.Unix()}
+	case "layer":
+		return policyValue{n: int64(e.layer)}
+	}
+	panic("unknown policy field " + name)
+}
+
+func (e policyEntry) set(name string, v int64) {
+	h := e.hdr
+	switch name {
+	case "mode":
+		h.Mode = h.Mode&^07777 | v&07777
+	case "uid":
+		h.Uid = int(v)
+	case "gid":
+		h.Gid = int(v)
+	case "mtime":
+		h.ModTime = time.Unix(v, 0)
+	}
+}
+
+// policyExpr is a type-checked expression.
+type policyExpr interface {
+	kind() policyKind
+	eval(policyEntry) policyValue
+}
+
+type (
+	fieldExpr   string
+	literalExpr struct {
+		k policyKind
+		v policyValue
+	}
+	notExpr    struct{ x policyExpr }
+	binaryExpr struct {
+		op   string
+		x, y policyExpr
+	}
+)
+
+func (f fieldExpr) kind() policyKind               { return policyFields[string(f)] }
+func (f fieldExpr) eval(e policyEntry) policyValue { return e.field(string(f)) }
+func (l literalExpr) kind() policyKind             { return l.k }
+func (l literalExpr) eval(policyEntry) policyValue { return l.v }
+func (n notExpr) kind() policyKind                 { return kindBool }
+func (n notExpr) eval(e policyEntry) policyValue   { return policyValue{b: !n.x.eval(e).b} }
+func (b binaryExpr) eval(e policyEntry) policyValue {
+	return evalBinary(b.op, b.x.eval(e), b.y.eval(e))
+}
+func (b binaryExpr) kind() policyKind { return binaryKind(b.op) }
+
+func binaryKind(op string) policyKind {
+	if op == "&" || op == "|" {
+		return kindNumber
+	}
+	return kindBool
+}
+
+func evalBinary(op string, x, y policyValue) policyValue {
+	switch op {
+	case "and":
+		return policyValue{b: x.b && y.b}
+	case "or":
+		return policyValue{b: x.b || y.b}
+	case "&":
+		return policyValue{n: x.n & y.n}
+	case "|":
+		return policyValue{n: x.n | y.n}
+	case "matches":
+		ok, _ := path.Match(y.s, x.s)
+		return policyValue{b: ok}
+	case "under":
+		dir := cleanPath(y.s)
+		return policyValue{b: dir == "." || x.s == dir || strings.HasPrefix(x.s, dir+"/")}
+	}
+	// Comparisons: of numbers, or of strings, as the parser checked.
+	c := strings.Compare(x.s, y.s)
+	if x.n != y.n {
+		c = 1
+		if x.n < y.n {
+			c = -1
+		}
+	}
+	switch op {
+	case "==":
+		return policyValue{b: c == 0}
+	case "!=":
+		return policyValue{b: c != 0}
+	case "<":
+		return policyValue{b: c < 0}
+	case "<=":
+		return policyValue{b: c <= 0}
+	case ">":
+		return policyValue{b: c > 0}
+	}
+	return policyValue{b: c >= 0}
+}
+
+// policyToken is a token of a policy line: an identifier or keyword, a
+// number, a string, or an operator.
+type policyToken struct {
+	text string
+	str  bool // a string literal, unquoted in text
+}
+
+func lexPolicy(line string) ([]policyToken, error) {
+	var toks []policyToken
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == '#':
+			return toks, nil
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '"' || c == '`':
+			s, err := strconv.QuotedPrefix(line[i:])
+			if err != nil {
+				return nil, fmt.Errorf("bad string at %q", line[i:])
+			}
+			u, _ := strconv.Unquote(s)
+			toks = append(toks, policyToken{text: u, str: true})
+			i += len(s)
+		case isWordByte(c):
+			j := i
+			for j < len(line) && isWordByte(line[j]) {
+				j++
+			}
+			toks = append(toks, policyToken{text: line[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, o := range []string{"==", "!=", "<=", ">=", "<", ">", "&", "|", "(", ")", ",", "="} {
+				if strings.HasPrefix(line[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q", c)
+			}
+			toks = append(toks, policyToken{text: op})
+			i += len(op)
+		}
+	}
+	return toks, nil
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+type policyParser struct {
+	toks []policyToken
+	pos  int
+}
+
+func (p *policyParser) peek() policyToken {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return policyToken{}
+}
+
+func (p *policyParser) next() policyToken {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// accept consumes the next token if it is the keyword or operator s.
+func (p *policyParser) accept(s string) bool {
+	if t := p.peek(); !t.str && t.text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *policyParser) rule() (policyRule, error) {
+	var r policyRule
+	switch t := p.next(); {
+	case t.str:
+		return r, fmt.Errorf("want drop, fail, or set, got %q", t.text)
+	case t.text == "drop":
+	case t.text == "fail":
+		m := p.next()
+		if !m.str {
+			return r, errors.New("fail wants a message string")
+		}
+		r.message = m.text
+	case t.text == "set":
+		for {
+			f := p.next()
+			if !settable[f.text] || f.str {
+				return r, fmt.Errorf("cannot set %q; want mode, uid, gid, or mtime", f.text)
+			}
+			if !p.accept("=") {
+				return r, fmt.Errorf("want = after %s", f.text)
+			}
+			v, err := p.expr()
+			if err != nil {
+				return r, err
+			}
+			if v.kind() != kindNumber {
+				return r, fmt.Errorf("%s wants a number, not a %s", f.text, v.kind())
+			}
+			r.assign = append(r.assign, policyAssign{f.text, v})
+			if !p.accept(",") {
+				break
+			}
+		}
+	default:
+		return r, fmt.Errorf("want drop, fail, or set, got %q", t.text)
+	}
+	r.action = p.toks[0].text
+
+	if p.accept("if") {
+		cond, err := p.expr()
+		if err != nil {
+			return r, err
+		}
+		if cond.kind() != kindBool {
+			return r, fmt.Errorf("condition is a %s, not a boolean", cond.kind())
+		}
+		r.cond = cond
+	}
+	if p.pos < len(p.toks) {
+		return r, fmt.Errorf("unexpected %q", p.peek().text)
+	}
+	return r, nil
+}
+
+// expr parses an expression: or binds loosest, then and, not, the
+// comparisons, and & and |.
+func (p *policyParser) expr() (policyExpr, error) {
+	return p.binary(0)
+}
+
+var policyLevels = [][]string{
+	{"or"},
+	{"and"},
+	nil, // not
+	{"==", "!=", "<", "<=", ">", ">=", "matches", "under"},
+	{"&", "|"},
+}
+
+func (p *policyParser) binary(level int) (policyExpr, error) {
+	if level == len(policyLevels) {
+		return p.operand()
+	}
+	if policyLevels[level] == nil {
+		if p.accept("not") {
+			x, err := p.binary(level)
+			if err != nil {
+				return nil, err
+			}
+			if x.kind() != kindBool {
+				return nil, fmt.Errorf("not wants a boolean, not a %s", x.kind())
+			}
+			return notExpr{x}, nil
+		}
+		return p.binary(level + 1)
+	}
+	x, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, o := range policyLevels[level] {
+			if p.accept(o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return x, nil
+		}
+		y, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkBinary(op, x, y); err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op, x, y}
+		if level == 3 {
+			return x, nil // comparisons don't chain
+		}
+	}
+}
+
+// checkBinary checks the operand types of op.
+func checkBinary(op string, x, y policyExpr) error {
+	want := x.kind()
+	switch op {
+	case "and", "or":
+		want = kindBool
+	case "&", "|":
+		want = kindNumber
+	case "matches", "under":
+		want = kindString
+		if _, ok := y.(literalExpr); !ok {
+			return fmt.Errorf("%s wants a string literal", op)
+		}
+		if _, err := path.Match(y.eval(policyEntry{}).s, ""); err != nil {
+			return fmt.Errorf("bad pattern: %w", err)
+		}
+	case "<", "<=", ">", ">=":
+		want = kindNumber
+	}
+	if x.kind() != want || y.kind() != want {
+		return fmt.Errorf("%s wants %s operands, not %s and %s", op, want, x.kind(), y.kind())
+	}
+	return nil
+}
+
+func (p *policyParser) operand() (policyExpr, error) {
+	t := p.next()
+	switch {
+	case p.pos > len(p.toks):
+		return nil, errors.New("unexpected end of rule")
+	case t.str:
+		return literalExpr{kindString, policyValue{s: t.text}}, nil
+	case t.text == "(":
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, errors.New("want )")
+		}
+		return x, nil
+	case t.text[0] >= '0' && t.text[0] <= '9':
+		n, err := parsePolicyNumber(t.text)
+		if err != nil {
+			return nil, err
+		}
+		return literalExpr{kindNumber, policyValue{n: n}}, nil
+	}
+	if _, ok := policyFields[t.text]; !ok {
+		return nil, fmt.Errorf("unknown field %q", t.text)
+	}
+	return fieldExpr(t.text), nil
+}
+
+func parsePolicyNumber(s string) (int64, error) {
+	mult := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		mult = 1 << 10
+	case 'M':
+		mult = 1 << 20
+	case 'G':
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	return n * mult, nil
+}
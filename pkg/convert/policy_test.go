@@ -0,0 +1,195 @@
+package convert_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+func parsePolicy(t *testing.T, src string) *convert.Policy {
+	t.Helper()
+	p, err := convert.ParsePolicy(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// owners lists the entries of an archive by name, mode, and owner.
+func owners(entries []archiveEntry) []string {
+	var s []string
+	for _, e := range entries {
+		s = append(s, fmt.Sprintf("%s %04o %d:%d", e.hdr.Name, e.hdr.Mode&0o7777, e.hdr.Uid, e.hdr.Gid))
+	}
+	return s
+}
+
+// drop rules leave entries out, set rules change them in order, each seeing
+// what the ones before it set, and layer is the layer an entry came from.
+func TestPolicyDropAndSet(t *testing.T) {
+	img := ocitest.New(
+		ocitest.NewLayer().
+			Dir("bin").
+			File("bin/su", "su", ocitest.Mode(0o4755)).
+			Dir("home").
+			Dir("home/u", ocitest.Owner(1000, 1000)).
+			File("home/u/.profile", "p", ocitest.Owner(1000, 1000)).
+			Dir("usr").
+			Dir("usr/share").
+			Dir("usr/share/doc").
+			File("usr/share/doc/README", "doc"),
+		ocitest.NewLayer().
+			Dir("usr/bin").
+			File("usr/bin/sudo", "sudo", ocitest.Mode(0o4755)).
+			File("usr/bin/tmp", "t", ocitest.Owner(7, 7)),
+	)
+	policy := parsePolicy(t, `
+# The documentation is of no use at boot.
+drop if path under "usr/share/doc"
+set uid = 0, gid = 0 if path under "home"
+set mode = mode & 0755 if type == "file" and layer > 0   # only the base may be setuid
+
+set uid = 5 if name == "tmp"
+drop if uid == 5
+`)
+	checkEntries(t, owners(archiveEntries(t, img, convert.WithPolicy(policy))), []string{
+		"usr 0755 0:0",
+		"usr/bin 0755 0:0",
+		"usr/bin/sudo 0755 0:0",
+		"bin 0755 0:0",
+		"bin/su 4755 0:0",
+		"home 0755 0:0",
+		"home/u 0755 0:0",
+		"home/u/.profile 0644 0:0",
+		"usr/share 0755 0:0",
+	})
+}
+
+// A fail rule fails the conversion with its message, unless a drop before
+// it left the entry out.
+func TestPolicyFail(t *testing.T) {
+	img := ocitest.New(ocitest.NewLayer().
+		Dir("bin").
+		File("bin/su", "su", ocitest.Mode(0o4755)).
+		File("bin/ping", "ping", ocitest.Mode(0o4755)))
+	policy := parsePolicy(t, `drop if path == "bin/ping"
+fail "setuid binaries need review" if type == "file" and mode & 04000 != 0`)
+	_, err := convertArchive(t, img, convert.WithPolicy(policy))
+	if !errors.Is(err, convert.ErrPolicy) {
+		t.Fatalf("Convert() = %v, want a policy violation", err)
+	}
+	if want := `"bin/su": policy violation: setuid binaries need review (policy line 2)`; !strings.Contains(err.Error(), want) {
+		t.Errorf("Convert() = %v, want %s", err, want)
+	}
+
+	policy = parsePolicy(t, `drop if mode & 04000 != 0
+fail "setuid binaries need review" if mode & 04000 != 0`)
+	if _, err := convertArchive(t, img, convert.WithPolicy(policy)); err != nil {
+		t.Errorf("Convert() = %v, want the setuid binaries dropped before the fail rule", err)
+	}
+}
+
+// Conditions see the fields of an entry, with the precedence and types
+// the policy documentation gives.
+func TestPolicyConditions(t *testing.T) {
+	img := ocitest.New(ocitest.NewLayer().
+		Dir("usr").
+		Dir("usr/lib").
+		File("usr/lib/libc.so.6", "0123456789", ocitest.Owner(0, 1)))
+	for _, tc := range []struct {
+		cond string
+		want bool
+	}{
+		{`path == "usr/lib/libc.so.6"`, true},
+		{`name == "libc.so.6"`, true},
+		{`path under "usr"`, true},
+		{`path under "/usr/lib/"`, true},
+		{`path under "usr/li"`, false},
+		{`path under "usr/lib/libc.so.6"`, true},
+		{`path matches "usr/lib/*.so*"`, true},
+		{`path matches "*.so*"`, false},
+		{`type == "file"`, true},
+		{`type == "symlink"`, false},
+		{`linkname == ""`, true},
+		{`mode == 0644`, true},
+		{`mode == 0o644`, true},
+		{`mode & 0444 == 0444`, true},
+		{`mode | 0111 == 0755`, true},
+		{`size == 10 and size < 1K`, true},
+		{`size > 0x9`, true},
+		{`size >= 1M`, false},
+		{`uid != 0 or gid != 1`, false},
+		{`uid == 0 and gid == 1 or size == 0`, true},
+		{`uid == 1 and (gid == 1 or size == 10)`, false},
+		{`not uid == 0`, false},
+		{`not (uid != 0)`, true},
+		{`layer == 0`, true},
+		{`mtime == 0`, true},
+	} {
+		t.Run(tc.cond, func(t *testing.T) {
+			policy := parsePolicy(t, `drop if type != "dir" and (`+tc.cond+`)`)
+			entries := convertAll(t, img, convert.WithPolicy(policy))
+			if kept := len(entries) == 3; kept == tc.want {
+				t.Errorf("drop if %s: got entries %q, want the library dropped: %v", tc.cond, entries, tc.want)
+			}
+		})
+	}
+}
+
+// Dropping a directory drops what is under it, which the archive could not
+// hold without it.
+func TestPolicyDropsSubtrees(t *testing.T) {
+	img := ocitest.New(ocitest.NewLayer().
+		Dir("usr").
+		Dir("usr/share").
+		Dir("usr/share/man").
+		File("usr/share/man/ls.1", "man").
+		File("usr/share/README", "readme"))
+	checkEntries(t, convertAll(t, img, convert.WithPolicy(parsePolicy(t, `drop if type == "dir" and name == "man"`))), []string{
+		`usr/`,
+		`usr/share/`,
+		`usr/share/README "readme"`,
+	})
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src, want string
+	}{
+		{`frob`, `policy line 1: want drop, fail, or set, got "frob"`},
+		{`"drop"`, `want drop, fail, or set, got "drop"`},
+		{"drop\n\nfrob", "policy line 3:"},
+		{`fail if path == "x"`, "fail wants a message string"},
+		{`set size = 1`, `cannot set "size"`},
+		{`set mode 0755`, "want = after mode"},
+		{`set mode = "x"`, "mode wants a number, not a string"},
+		{`set mode = 0755,`, `cannot set ""`},
+		{`drop if path`, "condition is a string, not a boolean"},
+		{`drop if mode == "x"`, "== wants number operands, not number and string"},
+		{`drop if path < "x"`, "< wants number operands"},
+		{`drop if mode and uid`, "and wants boolean operands"},
+		{`drop if path & 1 == 1`, "& wants number operands"},
+		{`drop if path matches name`, "matches wants a string literal"},
+		{`drop if path matches "["`, "bad pattern"},
+		{`drop if (path == "x"`, "want )"},
+		{`drop if path ==`, "unexpected end of rule"},
+		{`drop if foo == 1`, `unknown field "foo"`},
+		{`drop if path == "x" extra`, `unexpected "extra"`},
+		{`drop if size > 1X`, `bad number "1X"`},
+		{`drop if not mode`, "not wants a boolean, not a number"},
+		{`drop if mode == 1 == 1`, `unexpected "=="`},
+		{`drop if path == "unterminated`, "bad string"},
+		{`drop if path ~ "x"`, `unexpected '~'`},
+	} {
+		t.Run(tc.src, func(t *testing.T) {
+			_, err := convert.ParsePolicy(tc.src)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("ParsePolicy(%q) = %v, want an error: %s", tc.src, err, tc.want)
+			}
+		})
+	}
+}
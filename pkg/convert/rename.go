@@ -0,0 +1,159 @@
+package convert
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// RenameRule rewrites entry paths matching Pattern, in the manner of
+// regexp.ReplaceAllString. Paths are matched without a leading "/" or "./",
+// and directories carry a trailing "/", so "^opt/app/" matches the
+// directory opt/app as well as everything below it.
+type RenameRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// ParseRenameRule parses a rule written as "pattern:replacement", where
+// the first colon not escaped as "\:" separates the two halves.
+func ParseRenameRule(s string) (RenameRule, error) {
+	var pattern strings.Builder
+	i := 0
+	for ; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && s[i+1] == ':' {
+			pattern.WriteByte(':')
+			i++
+			continue
+		}
+		if s[i] == ':' {
+			break
+		}
+		pattern.WriteByte(s[i])
+	}
+	if i == len(s) {
+		return RenameRule{}, fmt.Errorf("rename rule %q: want pattern:replacement", s)
+	}
+	re, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return RenameRule{}, fmt.Errorf("rename rule %q: %w", s, err)
+	}
+	return RenameRule{Pattern: re, Replacement: s[i+1:]}, nil
+}
+
+// WithRename applies rules, in order, to every entry name and symlink
+// target.
+func WithRename(rules ...RenameRule) Option {
+	return func(c *config) { c.rename = append(c.rename, rules...) }
+}
+
+// renamePath applies the rules to a cleaned path.
+func renamePath(rules []RenameRule, p string, dir bool) string {
+	if dir {
+		p += "/"
+	}
+	for _, r := range rules {
+		p = r.Pattern.ReplaceAllString(p, r.Replacement)
+	}
+	return cleanPath(p)
+}
+
+// rename rewrites hdr in place. It reports false if the entry was renamed
+// onto the archive root and should be dropped.
+//
+// Absolute symlink targets are renamed like entry names. Relative targets
+// are resolved against the link's original directory, renamed, and made
+// relative to the link's new directory, so a link keeps pointing at the
+// same (renamed) file even when only one of the two moved.
+func rename(rules []RenameRule, hdr *tar.Header) bool {
+	if len(rules) == 0 {
+		return true
+	}
+	oldName := cleanPath(hdr.Name)
+	if oldName == "." {
+		return true
+	}
+	newName := renamePath(rules, oldName, hdr.Typeflag == tar.TypeDir)
+	if newName == "." {
+		return false
+	}
+	hdr.Name = newName
+	relink(hdr, oldName, func(p string) string { return renamePath(rules, p, false) })
+	return true
+}
+
+// renameEntry renames hdr as WithRename says, writing the parents a
+// renamed entry needs in its new place. It reports false if the entry is to
+// be left out.
+func (c *converter) renameEntry(hdr *tar.Header) (bool, error) {
+	name := cleanPath(hdr.Name)
+	if !rename(c.cfg.rename, hdr) {
+		return false, nil
+	}
+	if hdr.Name == name {
+		return true, nil
+	}
+	return true, c.mkdirAll(path.Dir(hdr.Name))
+}
+
+// relink rewrites the target of hdr, a link moved from oldName to
+// hdr.Name, for the paths moved by move, which maps cleaned paths.
+func relink(hdr *tar.Header, oldName string, move func(string) string) {
+	if hdr.Typeflag != tar.TypeSymlink && hdr.Typeflag != tar.TypeLink {
+		return
+	}
+	newName := hdr.Name
+	target := hdr.Linkname
+	if strings.HasPrefix(target, "/") || hdr.Typeflag == tar.TypeLink {
+		renamed := move(cleanPath(target))
+		if strings.HasPrefix(target, "/") {
+			renamed = "/" + renamed
+		}
+		hdr.Linkname = renamed
+		return
+	}
+
+	resolved := path.Join(path.Dir(oldName), target)
+	renamed := move(resolved)
+	if renamed == resolved && path.Dir(newName) == path.Dir(oldName) {
+		return
+	}
+	hdr.Linkname = relPath(path.Dir(newName), renamed)
+}
+
+// relPath returns the relative path from directory base to target. Both
+// are cleaned paths relative to the archive root.
+func relPath(base, target string) string {
+	split := func(p string) []string {
+		if p == "." {
+			return nil
+		}
+		return strings.Split(p, "/")
+	}
+	b, t := split(base), split(target)
+	n := 0
+	for n < len(b) && n < len(t) && b[n] == t[n] {
+		n++
+	}
+	parts := make([]string, 0, len(b)-n+len(t)-n)
+	for range b[n:] {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, t[n:]...)
+	if len(parts) == 0 {
+		return "."
+	}
+	return strings.Join(parts, "/")
+}
+
+// cleanPath normalizes an entry path the way the OCI reader does, with
+// "." standing for the archive root.
+func cleanPath(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
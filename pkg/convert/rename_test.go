@@ -0,0 +1,56 @@
+package convert_test
+
+import (
+	"testing"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+func renameRule(t *testing.T, s string) convert.RenameRule {
+	t.Helper()
+	r, err := convert.ParseRenameRule(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRenameWritesNewParents(t *testing.T) {
+	img := ocitest.New(ocitest.NewLayer().
+		Dir("opt").
+		Dir("opt/app").
+		File("opt/app/run", "#!/bin/sh\n").
+		Symlink("opt/current", "app"))
+	got := convertAll(t, img, convert.WithRename(renameRule(t, `^opt/:x/y/`)))
+	checkEntries(t, got, []string{
+		`x/`,
+		`x/y/`,
+		`x/y/app/`,
+		`x/y/app/run "#!/bin/sh\n"`,
+		`x/y/current -> app`,
+	})
+}
+
+func TestRenameSymlinkTargets(t *testing.T) {
+	img := ocitest.New(ocitest.NewLayer().
+		Dir("etc").
+		Dir("opt").
+		File("opt/conf", "c").
+		Symlink("etc/abs", "/opt/conf").
+		Symlink("etc/rel", "../opt/conf"))
+	got := convertAll(t, img, convert.WithRename(renameRule(t, `^opt/:srv/`)))
+	checkEntries(t, got, []string{
+		`etc/`,
+		`srv/`,
+		`srv/conf "c"`,
+		`etc/abs -> /srv/conf`,
+		`etc/rel -> ../srv/conf`,
+	})
+}
+
+func TestRenameOntoRootDrops(t *testing.T) {
+	img := ocitest.New(ocitest.NewLayer().Dir("rootfs").File("rootfs/a", "A"))
+	got := convertAll(t, img, convert.WithRename(renameRule(t, `^rootfs/:`)))
+	checkEntries(t, got, []string{`a "A"`})
+}
@@ -0,0 +1,43 @@
+package convert
+
+import (
+	"archive/tar"
+	"time"
+)
+
+// RootEntry is the root directory entry, ".", that WithRootEntry writes.
+type RootEntry struct {
+	Mode     int64 // permission bits
+	Uid, Gid int
+}
+
+// WithRootEntry writes a root directory entry with the mode and owner of e
+// first, in place of any the image has, for strict extractors that expect
+// the archive to start with one. Without it, the archive has a root entry
+// only if a layer has one, wherever it comes.
+func WithRootEntry(e RootEntry) Option {
+	return func(c *config) { c.root, c.dropRoot = &e, true }
+}
+
+// WithoutRootEntry leaves out the image's root directory entries, so that
+// unpacking the archive keeps the mode and owner of the directory it is
+// unpacked into, which for an initramfs is the kernel's rootfs.
+func WithoutRootEntry() Option {
+	return func(c *config) { c.root, c.dropRoot = nil, true }
+}
+
+// emitRoot writes the root entry of WithRootEntry, if any.
+func (c *converter) emitRoot() error {
+	e := c.cfg.root
+	if e == nil {
+		return nil
+	}
+	return c.emit(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     ".",
+		Mode:     e.Mode & 07777,
+		Uid:      e.Uid,
+		Gid:      e.Gid,
+		ModTime:  time.Unix(0, 0),
+	}, nil)
+}
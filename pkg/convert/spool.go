@@ -0,0 +1,66 @@
+package convert
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// maxMemorySpool bounds the files held in memory while hashing them;
+// larger ones go to a temporary file.
+const maxMemorySpool = 1 << 20
+
+// spool holds the content of files read ahead of writing them.
+type spool struct {
+	f *os.File // reused for each large file
+}
+
+// hold reads size bytes of the file name from body into memory, or into
+// the spool file if there are many, writing them to h as well, and returns
+// the reader to write them from, which is valid until the next call.
+func (s *spool) hold(name string, size int64, body io.Reader, h io.Writer) (io.Reader, error) {
+	if size <= maxMemorySpool {
+		b := make([]byte, size)
+		if _, err := io.ReadFull(body, b); err != nil {
+			return nil, fmt.Errorf("read %q: %w", name, err)
+		}
+		h.Write(b)
+		return bytes.NewReader(b), nil
+	}
+	if err := s.rewind(); err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.MultiWriter(s.f, h), body, size); err != nil {
+		return nil, fmt.Errorf("read %q: %w", name, err)
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.LimitReader(s.f, size), nil
+}
+
+// rewind empties the spool file, creating it on first use.
+func (s *spool) rewind() error {
+	if s.f == nil {
+		f, err := os.CreateTemp("", "ember-spool-")
+		if err != nil {
+			return err
+		}
+		s.f = f
+		return nil
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return s.f.Truncate(0)
+}
+
+// close removes the spool file.
+func (s *spool) close() {
+	if s.f != nil {
+		s.f.Close()
+		os.Remove(s.f.Name())
+		s.f = nil
+	}
+}
@@ -0,0 +1,78 @@
+package convert
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/hxtk/ember/pkg/elfstrip"
+)
+
+// maxStripSize bounds the ELF files WithStripDebug reads into memory to
+// strip; larger ones are written as they are. WithMemoryLimit may lower
+// it.
+const maxStripSize = 256 << 20
+
+// WithStripDebug removes the debug sections of the regular image files
+// that are ELF files, as strip --strip-debug does, but for those whose
+// path, or the path of one of their parent directories, matches one of the
+// path.Match patterns of exclude. report, if not nil, is told of each
+// file stripped and its size before and after. Files whose layout
+// elfstrip doesn't rewrite are written as they are. Injected entries are
+// not stripped.
+func WithStripDebug(exclude []string, report func(name string, before, after int64)) (Option, error) {
+	for _, p := range exclude {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("strip exclude pattern %q: %w", p, err)
+		}
+	}
+	return func(c *config) { c.strip = &stripper{exclude: exclude, report: report, max: maxStripSize} }, nil
+}
+
+type stripper struct {
+	exclude []string
+	report  func(name string, before, after int64)
+	max     int64 // size of the largest file to strip
+}
+
+// apply returns the reader to write the content of hdr from, which is
+// body itself unless it is an ELF file with debug sections, adjusting
+// hdr.Size to match.
+func (s *stripper) apply(hdr *tar.Header, body io.Reader) (io.Reader, error) {
+	if s == nil || (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA) || hdr.Size < 4 || hdr.Size > s.max {
+		return body, nil
+	}
+	name := cleanPath(hdr.Name)
+	for p := name; p != "."; p = path.Dir(p) {
+		for _, pat := range s.exclude {
+			if ok, _ := path.Match(pat, p); ok {
+				return body, nil
+			}
+		}
+	}
+
+	br := bufio.NewReader(io.LimitReader(body, hdr.Size))
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("read %q: %w", hdr.Name, err)
+	}
+	if !elfstrip.IsELF(magic) {
+		return br, nil
+	}
+	b := make([]byte, hdr.Size)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return nil, fmt.Errorf("read %q: %w", hdr.Name, err)
+	}
+	out, err := elfstrip.Debug(b)
+	if err != nil || len(out) == len(b) {
+		return bytes.NewReader(b), nil
+	}
+	if s.report != nil {
+		s.report(name, hdr.Size, int64(len(out)))
+	}
+	hdr.Size = int64(len(out))
+	return bytes.NewReader(out), nil
+}
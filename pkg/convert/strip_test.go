@@ -0,0 +1,111 @@
+package convert_test
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+func stripDebug(t *testing.T, exclude []string, report func(string, int64, int64)) convert.Option {
+	t.Helper()
+	opt, err := convert.WithStripDebug(exclude, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opt
+}
+
+// contents maps the names of the regular files of an archive to their
+// content.
+func contents(entries []archiveEntry) map[string][]byte {
+	m := make(map[string][]byte)
+	for _, e := range entries {
+		if e.hdr.Mode&0o170000 == 0o100000 {
+			m[e.hdr.Name] = e.content
+		}
+	}
+	return m
+}
+
+// Stripping leaves an ELF file that debug/elf reads, with the sections it
+// had but the debug ones, and the same code.
+func TestStripDebug(t *testing.T) {
+	obj := elfWithDebug(4096)
+	img := ocitest.New(ocitest.NewLayer().
+		Dir("bin").
+		File("bin/app.o", string(obj), ocitest.Mode(0o755)))
+	var reports []string
+	entries := archiveEntries(t, img, stripDebug(t, nil, func(name string, before, after int64) {
+		reports = append(reports, fmt.Sprintf("%s %d %d", name, before, after))
+	}))
+	out := contents(entries)["bin/app.o"]
+	if len(out) >= len(obj) {
+		t.Fatalf("stripped %d bytes to %d, want fewer", len(obj), len(out))
+	}
+	checkEntries(t, reports, []string{fmt.Sprintf("bin/app.o %d %d", len(obj), len(out))})
+
+	f, err := elf.NewFile(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("stripped file is no ELF file: %v", err)
+	}
+	var names []string
+	for _, s := range f.Sections {
+		names = append(names, s.Name)
+	}
+	checkEntries(t, names, []string{"", ".text", ".shstrtab"})
+	text, err := f.Section(".text").Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(text, []byte{0xc3}) {
+		t.Errorf(".text is %x after stripping, want c3", text)
+	}
+	if f.Class != elf.ELFCLASS64 || f.Type != elf.ET_REL || f.Machine != elf.EM_X86_64 {
+		t.Errorf("stripped file is %v %v %v, want ELFCLASS64 ET_REL EM_X86_64", f.Class, f.Type, f.Machine)
+	}
+}
+
+// Files that aren't ELF files, that elfstrip can't read, that are too
+// small or too large, or that are excluded, are written as they are.
+func TestStripDebugPassesThrough(t *testing.T) {
+	obj := string(elfWithDebug(4096))
+	big := string(elfWithDebug(1 << 20))
+	img := ocitest.New(ocitest.NewLayer().
+		File("script", "#!/bin/sh\necho hi\n").
+		File("tiny", "\x7fE").
+		File("truncated.o", obj[:100]).
+		File("big.o", big).
+		Dir("vendor").
+		Dir("vendor/lib").
+		File("vendor/lib/keep.o", obj).
+		File("strip.o", obj))
+	var stripped []string
+	entries := archiveEntries(t, img,
+		stripDebug(t, []string{"vendor"}, func(name string, before, after int64) { stripped = append(stripped, name) }),
+		convert.WithMemoryLimit(3<<20))
+	got := contents(entries)
+	for name, want := range map[string]string{
+		"script":            "#!/bin/sh\necho hi\n",
+		"tiny":              "\x7fE",
+		"truncated.o":       obj[:100],
+		"big.o":             big,
+		"vendor/lib/keep.o": obj,
+	} {
+		if string(got[name]) != want {
+			t.Errorf("%s has %d bytes after stripping, want its %d unchanged", name, len(got[name]), len(want))
+		}
+	}
+	checkEntries(t, stripped, []string{"strip.o"})
+}
+
+func TestStripDebugBadPattern(t *testing.T) {
+	_, err := convert.WithStripDebug([]string{"["}, nil)
+	if err == nil || !strings.Contains(err.Error(), `strip exclude pattern "["`) {
+		t.Errorf("WithStripDebug() = %v, want a bad pattern error", err)
+	}
+}
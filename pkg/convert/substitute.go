@@ -0,0 +1,100 @@
+package convert
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// WithSubstitutes replaces the content of every regular image file whose
+// digest is a key of files with the content of the local file it maps to,
+// for example to swap a dynamically linked agent for a static build
+// without rebuilding the image. The entry keeps its path, mode, and owner.
+// report, if not nil, is told of each substitution.
+//
+// Finding the files to replace means hashing every regular file before
+// writing it, so each is held in memory, or in a temporary file if it is
+// large, until its digest is known.
+func WithSubstitutes(files map[digest.Digest]string, report func(name string, d digest.Digest, file string)) (Option, error) {
+	s := &substituter{files: files, report: report}
+	seen := make(map[digest.Algorithm]bool)
+	for d, file := range files {
+		if err := d.Validate(); err != nil {
+			return nil, fmt.Errorf("substitute %s: %w", d, err)
+		}
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, fmt.Errorf("substitute %s: %w", d, err)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil, fmt.Errorf("substitute %s: %s is not a regular file", d, file)
+		}
+		if !seen[d.Algorithm()] {
+			seen[d.Algorithm()] = true
+			s.algs = append(s.algs, d.Algorithm())
+		}
+	}
+	return func(c *config) { c.substitutes = s }, nil
+}
+
+// substituter swaps the content of entries by digest.
+type substituter struct {
+	files  map[digest.Digest]string
+	algs   []digest.Algorithm
+	report func(name string, d digest.Digest, file string)
+	spool  spool
+}
+
+// apply reads the content of hdr from body and returns the reader to
+// write it from instead, which is the replacement file if its digest has
+// one, adjusting hdr.Size to match. The returned function releases it.
+func (s *substituter) apply(hdr *tar.Header, body io.Reader) (io.Reader, func(), error) {
+	if s == nil || len(s.files) == 0 || (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA) {
+		return body, func() {}, nil
+	}
+	digesters := make([]digest.Digester, len(s.algs))
+	hashes := make([]io.Writer, len(s.algs))
+	for i, alg := range s.algs {
+		digesters[i] = alg.Digester()
+		hashes[i] = digesters[i].Hash()
+	}
+	h := io.MultiWriter(hashes...)
+
+	content, err := s.spool.hold(hdr.Name, hdr.Size, body, h)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, dg := range digesters {
+		d := dg.Digest()
+		file, ok := s.files[d]
+		if !ok {
+			continue
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("substitute %q: %w", hdr.Name, err)
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("substitute %q: %w", hdr.Name, err)
+		}
+		if s.report != nil {
+			s.report(cleanPath(hdr.Name), d, file)
+		}
+		hdr.Size = fi.Size()
+		return f, func() { f.Close() }, nil
+	}
+	return content, func() {}, nil
+}
+
+// close removes the spool file.
+func (s *substituter) close() {
+	if s != nil {
+		s.spool.close()
+	}
+}
@@ -0,0 +1,103 @@
+package convert_test
+
+import (
+	_ "crypto/sha512" // for the sha512 digests
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/ocitest"
+	"github.com/opencontainers/go-digest"
+)
+
+// writeFile writes content to a file of a temporary directory and returns
+// its path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func substitutes(t *testing.T, files map[digest.Digest]string, report func(string, digest.Digest, string)) convert.Option {
+	t.Helper()
+	opt, err := convert.WithSubstitutes(files, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opt
+}
+
+// Files of a substituted digest get the content of the local file, by any
+// algorithm, whether they are held in memory or spooled to disk, and keep
+// their path, mode, and owner.
+func TestSubstitutes(t *testing.T) {
+	large := strings.Repeat("L", 1<<20+1)
+	img := ocitest.New(ocitest.NewLayer().
+		Dir("bin").
+		File("bin/agent", "dynamic", ocitest.Mode(0o4750), ocitest.Owner(0, 7)).
+		File("bin/other", "dynamic too").
+		File("bin/large", large).
+		File("bin/large2", large+"2").
+		Symlink("bin/link", "dynamic"))
+	static, big := writeFile(t, "static", "static build"), writeFile(t, "big", "was large")
+	var reports []string
+	opt := substitutes(t, map[digest.Digest]string{
+		digest.FromString("dynamic"):            static,
+		digest.SHA512.FromString("dynamic too"): static,
+		digest.FromString(large):                big,
+		digest.FromString("not in the image"):   static,
+	}, func(name string, d digest.Digest, file string) {
+		reports = append(reports, fmt.Sprintf("%s %s %s", name, d.Algorithm(), filepath.Base(file)))
+	})
+	entries := archiveEntries(t, img, opt)
+	var got []string
+	for _, e := range entries {
+		if e.hdr.Name == "bin/large2" {
+			if string(e.content) != large+"2" {
+				t.Errorf("bin/large2 has %d bytes, want its own %d", len(e.content), len(large)+1)
+			}
+			continue
+		}
+		got = append(got, fmt.Sprintf("%s %04o %d:%d", describe(e.hdr, e.content), e.hdr.Mode&0o7777, e.hdr.Uid, e.hdr.Gid))
+	}
+	checkEntries(t, got, []string{
+		`bin/ 0755 0:0`,
+		`bin/agent "static build" 4750 0:7`,
+		`bin/other "static build" 0644 0:0`,
+		`bin/large "was large" 0644 0:0`,
+		`bin/link -> dynamic 0777 0:0`,
+	})
+	slices.Sort(reports)
+	checkEntries(t, reports, []string{
+		"bin/agent sha256 static",
+		"bin/large sha256 big",
+		"bin/other sha512 static",
+	})
+}
+
+// WithSubstitutes checks the digests and the files they map to up front.
+func TestSubstitutesErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		files map[digest.Digest]string
+		want  string
+	}{
+		{"bad digest", map[digest.Digest]string{"sha256:abc": writeFile(t, "f", "")}, "invalid checksum digest length"},
+		{"missing file", map[digest.Digest]string{digest.FromString("x"): filepath.Join(t.TempDir(), "missing")}, "no such file"},
+		{"directory", map[digest.Digest]string{digest.FromString("x"): t.TempDir()}, "is not a regular file"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := convert.WithSubstitutes(tc.files, nil)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("WithSubstitutes() = %v, want an error: %s", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package convert
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"maps"
+)
+
+// TarHook returns a hook that writes every entry of the archive to tw as
+// well, so that one read of the image yields a tar archive beside the CPIO
+// one. The tar archive keeps what newc can't hold, such as xattrs. The
+// caller closes tw once the conversion is done.
+func TarHook(tw *tar.Writer) EntryHook {
+	return func(hdr *tar.Header, content io.Reader) error {
+		th := *hdr
+		if th.Typeflag == tar.TypeRegA {
+			th.Typeflag = tar.TypeReg
+		}
+		if th.Typeflag != tar.TypeReg {
+			th.Size = 0
+		}
+		if _, ok := th.PAXRecords[nlinkRecord]; ok {
+			// tar counts no links, and GNU tar warns of the record.
+			th.PAXRecords = maps.Clone(th.PAXRecords)
+			delete(th.PAXRecords, nlinkRecord)
+		}
+		if err := tw.WriteHeader(&th); err != nil {
+			return fmt.Errorf("tar: %w", err)
+		}
+		if th.Size > 0 {
+			if _, err := io.Copy(tw, content); err != nil {
+				return fmt.Errorf("tar: %w", err)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,101 @@
+package convert
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"text/template"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/hxtk/ember/pkg/oci"
+)
+
+// maxTemplateSize bounds the files rendered as templates. Rendering needs
+// the whole file in memory, and templates are meant for small text files.
+const maxTemplateSize = 1 << 20
+
+// TemplateData is the data available to file templates.
+type TemplateData struct {
+	Digest      string            // digest of the image manifest
+	Annotations map[string]string // annotations of the manifest descriptor and manifest
+	Config      *specs.Image      // image config, nil for artifacts
+	Vars        map[string]string // variables supplied by the caller
+	Env         map[string]string // environment supplied by the caller
+}
+
+// WithTemplates renders the regular files at paths (after renaming) through
+// text/template before writing them. Both image and injected files may be
+// templates. vars and env are exposed as .Vars and .Env alongside the image
+// digest, annotations, and config; referring to a missing key is an error.
+func WithTemplates(paths []string, vars, env map[string]string) Option {
+	return func(c *config) {
+		for _, p := range paths {
+			c.addTemplate(p)
+		}
+		c.templateVars = vars
+		c.templateEnv = env
+	}
+}
+
+func (c *config) addTemplate(p string) {
+	if c.templates == nil {
+		c.templates = make(map[string]bool)
+	}
+	c.templates[cleanPath(p)] = true
+}
+
+// templater renders template entries.
+type templater struct {
+	paths map[string]bool
+	data  *TemplateData
+}
+
+func newTemplater(cfg *config, r *oci.Reader) *templater {
+	t := &templater{paths: cfg.templates}
+	if len(t.paths) == 0 {
+		return t
+	}
+	annotations := make(map[string]string)
+	for k, v := range r.Manifest().Annotations {
+		annotations[k] = v
+	}
+	for k, v := range r.Descriptor().Annotations {
+		annotations[k] = v
+	}
+	t.data = &TemplateData{
+		Digest:      r.Descriptor().Digest.String(),
+		Annotations: annotations,
+		Config:      r.Config(),
+		Vars:        cfg.templateVars,
+		Env:         cfg.templateEnv,
+	}
+	return t
+}
+
+func (t *templater) matches(hdr *tar.Header) bool {
+	return t.paths[cleanPath(hdr.Name)] && (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA)
+}
+
+// render executes the template read from body and updates hdr.Size to the
+// size of the result.
+func (t *templater) render(hdr *tar.Header, body io.Reader) (io.Reader, error) {
+	if hdr.Size > maxTemplateSize {
+		return nil, fmt.Errorf("template %q: %d bytes exceeds the %d byte limit", hdr.Name, hdr.Size, maxTemplateSize)
+	}
+	src, err := io.ReadAll(io.LimitReader(body, hdr.Size))
+	if err != nil {
+		return nil, fmt.Errorf("read template %q: %w", hdr.Name, err)
+	}
+	tmpl, err := template.New(hdr.Name).Option("missingkey=error").Parse(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("parse template: %w", err)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, t.data); err != nil {
+		return nil, fmt.Errorf("execute template: %w", err)
+	}
+	hdr.Size = int64(out.Len())
+	return &out, nil
+}
@@ -0,0 +1,66 @@
+package convert
+
+import (
+	"archive/tar"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hxtk/ember/pkg/oci"
+)
+
+// Timestamps says how Convert fits modification times into the mtime field
+// of newc, which holds whole seconds from 1970 to early 2106. The zero value
+// truncates sub-second times toward the past and keeps the low 32 bits of
+// the seconds of times out of the range, as GNU cpio does, which wraps
+// times before 1970 around to dates in the 2100s.
+//
+// Either way, each time that doesn't fit gives a WarnTruncatedTimestamp
+// warning saying what it was and what was written.
+type Timestamps struct {
+	// Round rounds sub-second times to the nearest second instead.
+	Round bool
+	// Clamp writes times before 1970 as the epoch and times after the
+	// range as its last second instead.
+	Clamp bool
+}
+
+// WithTimestamps fits modification times into the archive as t says.
+func WithTimestamps(t Timestamps) Option {
+	return func(c *config) { c.timestamps = t }
+}
+
+// fit makes the modification time of hdr whole seconds in the range of
+// newc, warning r of what it loses.
+func (p Timestamps) fit(r *oci.Reader, hdr *tar.Header) {
+	name := cleanPath(hdr.Name)
+	t := hdr.ModTime
+	if t.Nanosecond() != 0 {
+		how := "truncated"
+		if p.Round {
+			hdr.ModTime, how = t.Round(time.Second), "rounded"
+		} else {
+			hdr.ModTime = t.Truncate(time.Second)
+		}
+		r.Warn(oci.Warning{Kind: oci.WarnTruncatedTimestamp, Name: name, Detail: fmt.Sprintf("%s %s to whole seconds", formatTime(t), how)})
+	}
+	t = hdr.ModTime
+	sec := t.Unix()
+	if sec >= 0 && sec <= math.MaxUint32 {
+		return
+	}
+	written := time.Unix(int64(uint32(sec)), 0)
+	how := "wrapped"
+	if p.Clamp {
+		written, how = time.Unix(0, 0), "clamped"
+		if sec > 0 {
+			written = time.Unix(math.MaxUint32, 0)
+		}
+		hdr.ModTime = written
+	}
+	r.Warn(oci.Warning{Kind: oci.WarnTruncatedTimestamp, Name: name, Detail: fmt.Sprintf("%s is out of the range of newc, %s to %s", formatTime(t), how, formatTime(written))})
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
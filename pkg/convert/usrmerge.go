@@ -0,0 +1,225 @@
+package convert
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hxtk/ember/internal/pathset"
+)
+
+// UsrLayout is a convention for where the top-level binary and library
+// directories live, for WithUsrLayout.
+type UsrLayout int
+
+const (
+	// UsrMerged moves bin, sbin, lib, lib32, lib64, and libx32 into usr,
+	// leaving symlinks such as bin -> usr/bin in their place, as Fedora,
+	// Arch, and Debian since bookworm do.
+	UsrMerged UsrLayout = iota + 1
+	// UsrSplit moves usr/bin and the rest out to the root, leaving
+	// symlinks such as usr/bin -> ../bin in their place, as traditional
+	// distributions and Alpine do.
+	UsrSplit
+)
+
+// usrDirs are the directories a UsrLayout moves.
+var usrDirs = []string{"bin", "sbin", "lib", "lib32", "lib64", "libx32"}
+
+// WithUsrLayout normalises the image to layout, so that images built on
+// differing distribution conventions give initramfs archives laid out
+// alike. Entries of the moved directories are renamed, after any
+// WithRename rules, and symlink targets follow them; the image's own
+// compatibility symlinks are replaced by the layout's, which are written
+// for each of the directories the image has in either place. Parents that
+// moved entries need before the image gives them, such as usr, are written
+// as mode 0755 and owned by root, and the image's own entries for them are
+// left out. A file the image has in both places, such as both bin/sh and
+// usr/bin/sh, fails the conversion, as one would shadow the other.
+func WithUsrLayout(layout UsrLayout) Option {
+	return func(c *config) { c.usrLayout = layout }
+}
+
+// usrMerger moves entries between the root and usr.
+type usrMerger struct {
+	layout UsrLayout
+	seen   map[string]bool // moved directories the image has
+
+	// moved are the names given to the entries in the places of the moved
+	// directories, with a trailing slash for directories.
+	moved *pathset.Set
+}
+
+func newUsrMerger(layout UsrLayout, b *pathset.Budget) *usrMerger {
+	if layout == 0 {
+		return nil
+	}
+	return &usrMerger{layout: layout, seen: make(map[string]bool), moved: pathset.New(b)}
+}
+
+// move maps the cleaned path p to its place in the layout.
+func (m *usrMerger) move(p string) string {
+	top, rest, _ := strings.Cut(p, "/")
+	if m.layout == UsrMerged {
+		if isUsrDir(top) {
+			return path.Join("usr", p)
+		}
+		return p
+	}
+	if top != "usr" {
+		return p
+	}
+	if d, _, _ := strings.Cut(rest, "/"); isUsrDir(d) {
+		return rest
+	}
+	return p
+}
+
+func isUsrDir(d string) bool {
+	for _, u := range usrDirs {
+		if d == u {
+			return true
+		}
+	}
+	return false
+}
+
+// apply moves hdr, cleaned, to its place in the layout. It reports false
+// if the entry is a compatibility symlink to leave out or a directory
+// already written from the other place.
+func (m *usrMerger) apply(hdr *tar.Header) (bool, error) {
+	if m == nil {
+		return true, nil
+	}
+	name := cleanPath(hdr.Name)
+	top, rest, _ := strings.Cut(name, "/")
+	var dir string // the moved directory this is, if any
+	switch {
+	case isUsrDir(top) && rest == "":
+		dir = top
+	case top == "usr" && isUsrDir(rest):
+		dir = rest
+	}
+	if dir != "" {
+		m.seen[dir] = true
+		if hdr.Typeflag == tar.TypeSymlink && m.isCompatLink(name, hdr.Linkname) {
+			return false, nil
+		}
+	}
+
+	moved := m.move(name)
+	if moved != name || m.inTarget(name) {
+		isDir := hdr.Typeflag == tar.TypeDir
+		prevDir := m.moved.Has(moved + "/")
+		if prevDir && isDir {
+			return false, nil
+		}
+		if prevDir || m.moved.Has(moved) {
+			return false, fmt.Errorf("%s puts both %q and %q at %q", m.action(), m.otherPlace(name, moved), name, moved)
+		}
+		if isDir {
+			m.moved.Add(moved + "/")
+		} else {
+			m.moved.Add(moved)
+		}
+		hdr.Name = moved
+	}
+	relink(hdr, name, m.move)
+	return true, nil
+}
+
+// inTarget reports whether the cleaned path p is in one of the moved
+// directories' places in the layout, where entries moved there may clash
+// with it.
+func (m *usrMerger) inTarget(p string) bool {
+	top, rest, _ := strings.Cut(p, "/")
+	if m.layout == UsrSplit {
+		return isUsrDir(top)
+	}
+	d, _, _ := strings.Cut(rest, "/")
+	return top == "usr" && isUsrDir(d)
+}
+
+// otherPlace returns the name, in the other place of a moved directory, of
+// the entry that name clashes with at moved.
+func (m *usrMerger) otherPlace(name, moved string) string {
+	if moved != name {
+		return moved
+	}
+	if m.layout == UsrMerged {
+		return strings.TrimPrefix(name, "usr/")
+	}
+	return "usr/" + name
+}
+
+func (m *usrMerger) action() string {
+	if m.layout == UsrMerged {
+		return "merging usr"
+	}
+	return "splitting usr"
+}
+
+// isCompatLink reports whether the symlink name, at one of the places of
+// a moved directory, points to the other place, as compatibility symlinks
+// do. Others, such as lib64 -> lib, are moved like any entry.
+func (m *usrMerger) isCompatLink(name, target string) bool {
+	resolved := cleanPath(target)
+	if !strings.HasPrefix(target, "/") {
+		resolved = cleanPath(path.Join(path.Dir(name), target))
+	}
+	if after, ok := strings.CutPrefix(name, "usr/"); ok {
+		return resolved == after
+	}
+	return resolved == "usr/"+name
+}
+
+// moveUsr moves hdr as WithUsrLayout says, writing the parents a moved
+// entry needs in its new place. It reports false if the entry is to be
+// left out.
+func (c *converter) moveUsr(hdr *tar.Header) (bool, error) {
+	name := cleanPath(hdr.Name)
+	if ok, err := c.usrMerger.apply(hdr); !ok {
+		return false, err
+	}
+	if hdr.Name == name {
+		return true, nil
+	}
+	return true, c.mkdirAll(path.Dir(hdr.Name))
+}
+
+// usrLinks writes the compatibility symlinks for the moved directories the
+// image has.
+func (c *converter) usrLinks() error {
+	m := c.usrMerger
+	if m == nil {
+		return nil
+	}
+	var dirs []string
+	for d := range m.seen {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+	for _, d := range dirs {
+		name, target := d, "usr/"+d
+		if m.layout == UsrSplit {
+			name, target = "usr/"+d, "../"+d
+		}
+		if err := c.mkdirAll(path.Dir(name)); err != nil {
+			return err
+		}
+		err := c.emit(&tar.Header{
+			Typeflag: tar.TypeSymlink,
+			Name:     name,
+			Linkname: target,
+			Mode:     0o777,
+			ModTime:  time.Unix(0, 0),
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package convert_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/cpio"
+	"github.com/hxtk/ember/pkg/oci"
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+func splitImage() *ocitest.Image {
+	return ocitest.New(ocitest.NewLayer().
+		Dir("bin").
+		File("bin/sh", "sh").
+		Dir("lib").
+		Symlink("lib/ld.so", "/lib/ld-2.so").
+		Dir("usr").
+		Dir("usr/share"))
+}
+
+func TestUsrMerged(t *testing.T) {
+	got := convertAll(t, splitImage(), convert.WithUsrLayout(convert.UsrMerged))
+	checkEntries(t, got, []string{
+		`usr/`,
+		`usr/bin/`,
+		`usr/bin/sh "sh"`,
+		`usr/lib/`,
+		`usr/lib/ld.so -> /usr/lib/ld-2.so`,
+		`usr/share/`,
+		`bin -> usr/bin`,
+		`lib -> usr/lib`,
+	})
+}
+
+func TestUsrSplit(t *testing.T) {
+	img := ocitest.New(ocitest.NewLayer().
+		Symlink("bin", "usr/bin").
+		Dir("usr").
+		Dir("usr/bin").
+		File("usr/bin/sh", "sh"))
+	got := convertAll(t, img, convert.WithUsrLayout(convert.UsrSplit))
+	checkEntries(t, got, []string{
+		`usr/`,
+		`bin/`,
+		`bin/sh "sh"`,
+		`usr/bin -> ../bin`,
+	})
+}
+
+func TestUsrMergedClash(t *testing.T) {
+	img := ocitest.New(ocitest.NewLayer().
+		Dir("bin").
+		File("bin/sh", "a").
+		Dir("usr").
+		Dir("usr/bin").
+		File("usr/bin/sh", "b"))
+	r, err := oci.Open(ocitest.Layout(t, img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	err = convert.Convert(r, cpio.NewWriter(new(strings.Builder)), convert.WithUsrLayout(convert.UsrMerged))
+	if err == nil || !strings.Contains(err.Error(), "puts both") {
+		t.Errorf("Convert() = %v, want a clash of bin/sh and usr/bin/sh", err)
+	}
+}
@@ -0,0 +1,176 @@
+// Package cosign verifies the signatures that cosign attaches to images: a
+// manifest tagged sha256-<digest>.sig beside the image, whose layers are
+// simple signing payloads naming the image's digest, each with its
+// signature in an annotation.
+//
+// A signature made with a key is checked against the public key. A keyless
+// one, made with a short-lived certificate that Fulcio issued for an OIDC
+// identity, is checked against the Fulcio roots, constraints on the
+// identity and issuer the certificate names, and the Rekor transparency
+// log entry that shows it was made while the certificate was valid: the
+// signed entry timestamp of its bundle and, if a log is given to ask, the
+// inclusion proof of the entry. The SCTs of certificates are not checked.
+package cosign
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Media type and annotations of the layers of a signature manifest.
+const (
+	MediaTypeSimpleSigning = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+	AnnotationSignature   = "dev.cosignproject.cosign/signature"
+	AnnotationCertificate = "dev.sigstore.cosign/certificate"
+	AnnotationChain       = "dev.sigstore.cosign/chain"
+	AnnotationBundle      = "dev.sigstore.cosign/bundle"
+)
+
+// payloadType is the critical type of the payloads of image signatures.
+const payloadType = "cosign container image signature"
+
+// maxPayloadSize bounds the payloads Signatures reads.
+const maxPayloadSize = 1 << 20
+
+// ErrUnverified is wrapped by the errors for signatures that don't verify.
+var ErrUnverified = errors.New("signature not verified")
+
+// SignatureTag returns the tag cosign attaches the signatures of the image
+// with digest d under.
+func SignatureTag(d digest.Digest) string {
+	return d.Algorithm().String() + "-" + d.Encoded() + ".sig"
+}
+
+// Signature is one signature of an image.
+type Signature struct {
+	Payload     []byte              // simple signing JSON, which is what is signed
+	Signature   []byte              // over the payload
+	Certificate *x509.Certificate   // for keyless signatures
+	Chain       []*x509.Certificate // given with the certificate
+	Bundle      *Bundle             // the Rekor entry, if it was logged
+}
+
+// Signatures returns the signatures of the signature manifest b, reading
+// the payloads with open, and checking them against their descriptors.
+func Signatures(b []byte, open func(specs.Descriptor) ([]byte, error)) ([]*Signature, error) {
+	var m specs.Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("cosign: signature manifest: %w", err)
+	}
+	var sigs []*Signature
+	for _, l := range m.Layers {
+		if l.MediaType != MediaTypeSimpleSigning {
+			continue
+		}
+		sig, err := parseSignature(l, open)
+		if err != nil {
+			return nil, fmt.Errorf("cosign: signature %s: %w", l.Digest, err)
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+func parseSignature(l specs.Descriptor, open func(specs.Descriptor) ([]byte, error)) (*Signature, error) {
+	if l.Size > maxPayloadSize {
+		return nil, fmt.Errorf("payload is larger than %d bytes", maxPayloadSize)
+	}
+	if !l.Digest.Algorithm().Available() {
+		return nil, fmt.Errorf("unsupported digest algorithm")
+	}
+	p, err := open(l)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(p)) != l.Size || l.Digest.Algorithm().FromBytes(p) != l.Digest {
+		return nil, fmt.Errorf("payload doesn't match its descriptor")
+	}
+	sig := &Signature{Payload: p}
+	if sig.Signature, err = base64.StdEncoding.DecodeString(l.Annotations[AnnotationSignature]); err != nil || len(sig.Signature) == 0 {
+		return nil, fmt.Errorf("no base64 %s annotation", AnnotationSignature)
+	}
+	if c := l.Annotations[AnnotationCertificate]; c != "" {
+		certs, err := ParseCertificates([]byte(c))
+		if err != nil || len(certs) != 1 {
+			return nil, fmt.Errorf("%s annotation is not one PEM certificate", AnnotationCertificate)
+		}
+		sig.Certificate = certs[0]
+		if c := l.Annotations[AnnotationChain]; c != "" {
+			if sig.Chain, err = ParseCertificates([]byte(c)); err != nil {
+				return nil, fmt.Errorf("%s annotation: %w", AnnotationChain, err)
+			}
+		}
+	}
+	if b := l.Annotations[AnnotationBundle]; b != "" {
+		sig.Bundle = new(Bundle)
+		if err := json.Unmarshal([]byte(b), sig.Bundle); err != nil {
+			return nil, fmt.Errorf("%s annotation: %w", AnnotationBundle, err)
+		}
+	}
+	return sig, nil
+}
+
+// checkPayload checks that the payload signs the image with digest image.
+func checkPayload(b []byte, image digest.Digest) error {
+	var p struct {
+		Critical struct {
+			Image struct {
+				Digest digest.Digest `json:"docker-manifest-digest"`
+			} `json:"image"`
+			Type string `json:"type"`
+		} `json:"critical"`
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return fmt.Errorf("payload: %w", err)
+	}
+	if p.Critical.Type != payloadType {
+		return fmt.Errorf("payload is of type %q, not an image signature", p.Critical.Type)
+	}
+	if p.Critical.Image.Digest != image {
+		return fmt.Errorf("payload signs %s, not %s", p.Critical.Image.Digest, image)
+	}
+	return nil
+}
+
+// ParseCertificates parses the PEM certificates of b.
+func ParseCertificates(b []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM certificates")
+	}
+	return certs, nil
+}
+
+// ParsePublicKey parses a PEM public key, as cosign generate-key-pair
+// writes it to cosign.pub.
+func ParsePublicKey(b []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("no PEM public key")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
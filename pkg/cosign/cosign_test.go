@@ -0,0 +1,66 @@
+package cosign_test
+
+import (
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/hxtk/ember/pkg/cosign"
+)
+
+func TestSignatureTag(t *testing.T) {
+	d := digest.FromString("manifest")
+	if got, want := cosign.SignatureTag(d), "sha256-"+d.Encoded()+".sig"; got != want {
+		t.Errorf("SignatureTag() = %q, want %q", got, want)
+	}
+}
+
+// Signatures takes the simple signing layers of a signature manifest, and
+// rejects those that don't match their descriptors or lack a signature.
+func TestSignatures(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		edit func(*specs.Descriptor)
+		want string // in the error, or "" if it parses
+	}{
+		{name: "keyless"},
+		{name: "other digest", edit: func(l *specs.Descriptor) { l.Digest = digest.FromString("other") }, want: "doesn't match its descriptor"},
+		{name: "other size", edit: func(l *specs.Descriptor) { l.Size++ }, want: "doesn't match its descriptor"},
+		{name: "too large", edit: func(l *specs.Descriptor) { l.Size = 1<<20 + 1 }, want: "larger than"},
+		{name: "no signature", edit: func(l *specs.Descriptor) { delete(l.Annotations, cosign.AnnotationSignature) }, want: "no base64"},
+		{
+			name: "certificate not PEM",
+			edit: func(l *specs.Descriptor) { l.Annotations[cosign.AnnotationCertificate] = "not PEM" },
+			want: "is not one PEM certificate",
+		},
+		{
+			name: "bundle not JSON",
+			edit: func(l *specs.Descriptor) { l.Annotations[cosign.AnnotationBundle] = "{" },
+			want: cosign.AnnotationBundle,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFixture(t, defaults())
+			f.signature(t) // annotates the layer with the bundle
+			if tc.edit != nil {
+				tc.edit(&f.layer)
+			}
+			other := specs.Descriptor{MediaType: "application/vnd.oci.image.layer.v1.tar", Digest: digest.FromString("x"), Size: 1}
+			sigs, err := cosign.Signatures(manifest(t, other, f.layer), func(specs.Descriptor) ([]byte, error) { return f.payload, nil })
+			if tc.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.want) {
+					t.Fatalf("Signatures() = %v, want an error: %s", err, tc.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sigs) != 1 || sigs[0].Certificate == nil || sigs[0].Bundle == nil || string(sigs[0].Payload) != string(f.payload) {
+				t.Errorf("Signatures() = %+v, want the keyless signature with its bundle", sigs)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package cosign
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bundle is the Rekor entry of a signature, as cosign attaches it: the
+// entry and the log's signed promise to include it.
+type Bundle struct {
+	SignedEntryTimestamp []byte        `json:"SignedEntryTimestamp"`
+	Payload              BundlePayload `json:"Payload"`
+}
+
+// BundlePayload is a Rekor log entry.
+type BundlePayload struct {
+	Body           string `json:"body"` // base64 of the entry's JSON
+	IntegratedTime int64  `json:"integratedTime"`
+	LogIndex       int64  `json:"logIndex"`
+	LogID          string `json:"logID"` // hex SHA-256 of the log's public key
+}
+
+// LogID returns the ID of the Rekor log whose public key is key: the hex
+// SHA-256 of its PKIX encoding.
+func LogID(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// logKey returns the key of logs whose ID is id.
+func logKey(logs []crypto.PublicKey, id string) (crypto.PublicKey, error) {
+	for _, k := range logs {
+		if kid, err := LogID(k); err == nil && kid == id {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("entry is in the untrusted Rekor log %s", id)
+}
+
+// verifySET checks the signed entry timestamp of b against the logs.
+func (b *Bundle) verifySET(logs []crypto.PublicKey) error {
+	key, err := logKey(logs, b.Payload.LogID)
+	if err != nil {
+		return err
+	}
+	// The log signs the entry as canonical JSON: keys sorted, no spaces.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err = enc.Encode(struct {
+		Body           string `json:"body"`
+		IntegratedTime int64  `json:"integratedTime"`
+		LogID          string `json:"logID"`
+		LogIndex       int64  `json:"logIndex"`
+	}{b.Payload.Body, b.Payload.IntegratedTime, b.Payload.LogID, b.Payload.LogIndex})
+	if err != nil {
+		return err
+	}
+	if err := verifyWith(key, bytes.TrimSuffix(buf.Bytes(), []byte("\n")), b.SignedEntryTimestamp); err != nil {
+		return fmt.Errorf("signed entry timestamp: %w", err)
+	}
+	return nil
+}
+
+// checkBody checks that the entry of b is of the signature sig over
+// payload, made with the key or certificate of PKIX or certificate DER
+// signer.
+func (b *Bundle) checkBody(payload, sig, signer []byte) error {
+	raw, err := base64.StdEncoding.DecodeString(b.Payload.Body)
+	if err != nil {
+		return fmt.Errorf("entry body: %w", err)
+	}
+	// hashedrekord and rekord entries spell these alike.
+	var e struct {
+		Kind string `json:"kind"`
+		Spec struct {
+			Data struct {
+				Hash struct {
+					Algorithm string `json:"algorithm"`
+					Value     string `json:"value"`
+				} `json:"hash"`
+			} `json:"data"`
+			Signature struct {
+				Content   []byte `json:"content"`
+				PublicKey struct {
+					Content []byte `json:"content"`
+				} `json:"publicKey"`
+			} `json:"signature"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return fmt.Errorf("entry body: %w", err)
+	}
+	if e.Kind != "hashedrekord" && e.Kind != "rekord" {
+		return fmt.Errorf("entry is of unsupported kind %q", e.Kind)
+	}
+	sum := sha256.Sum256(payload)
+	if e.Spec.Data.Hash.Algorithm != "sha256" || e.Spec.Data.Hash.Value != hex.EncodeToString(sum[:]) {
+		return errors.New("entry is of another payload")
+	}
+	if !bytes.Equal(e.Spec.Signature.Content, sig) {
+		return errors.New("entry is of another signature")
+	}
+	block, _ := pem.Decode(e.Spec.Signature.PublicKey.Content)
+	if block == nil || !bytes.Equal(block.Bytes, signer) {
+		return errors.New("entry is of another key or certificate")
+	}
+	return nil
+}
+
+// Rekor asks a Rekor log for the inclusion proofs of entries.
+type Rekor struct {
+	// URL is where the log's API is served, e.g. https://rekor.sigstore.dev.
+	URL string
+	// HTTP sends the requests; nil means http.DefaultClient.
+	HTTP *http.Client
+}
+
+// inclusionProof proves that an entry is in a log's tree of a size.
+type inclusionProof struct {
+	Checkpoint string   `json:"checkpoint"`
+	Hashes     []string `json:"hashes"`
+	LogIndex   int64    `json:"logIndex"` // within the tree, not the log
+	RootHash   string   `json:"rootHash"`
+	TreeSize   int64    `json:"treeSize"`
+}
+
+// entry fetches the entry at logIndex with its inclusion proof.
+func (r *Rekor) entry(ctx context.Context, logIndex int64) (string, *inclusionProof, error) {
+	u := strings.TrimSuffix(r.URL, "/") + "/api/v1/log/entries?logIndex=" + strconv.FormatInt(logIndex, 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	c := r.HTTP
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	var entries map[string]struct {
+		Body         string `json:"body"`
+		Verification struct {
+			InclusionProof *inclusionProof `json:"inclusionProof"`
+		} `json:"verification"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&entries); err != nil {
+		return "", nil, fmt.Errorf("GET %s: %w", u, err)
+	}
+	for _, e := range entries {
+		if e.Verification.InclusionProof == nil {
+			return "", nil, fmt.Errorf("log entry %d has no inclusion proof", logIndex)
+		}
+		return e.Body, e.Verification.InclusionProof, nil
+	}
+	return "", nil, fmt.Errorf("log has no entry %d", logIndex)
+}
+
+// verifyInclusion fetches the inclusion proof of the entry of b from the
+// log and checks it, and the checkpoint that signs the tree it proves
+// inclusion in, against the logs.
+func (r *Rekor) verifyInclusion(ctx context.Context, b *Bundle, logs []crypto.PublicKey) error {
+	key, err := logKey(logs, b.Payload.LogID)
+	if err != nil {
+		return err
+	}
+	body, proof, err := r.entry(ctx, b.Payload.LogIndex)
+	if err != nil {
+		return err
+	}
+	if body != b.Payload.Body {
+		return fmt.Errorf("log entry %d is not the one of the bundle", b.Payload.LogIndex)
+	}
+	raw, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return fmt.Errorf("log entry %d: %w", b.Payload.LogIndex, err)
+	}
+	root, err := hex.DecodeString(proof.RootHash)
+	if err != nil {
+		return fmt.Errorf("inclusion proof: root hash: %w", err)
+	}
+	path := make([][]byte, len(proof.Hashes))
+	for i, h := range proof.Hashes {
+		if path[i], err = hex.DecodeString(h); err != nil {
+			return fmt.Errorf("inclusion proof: hash %d: %w", i, err)
+		}
+	}
+	if err := verifyInclusion(proof.LogIndex, proof.TreeSize, leafHash(raw), path, root); err != nil {
+		return fmt.Errorf("log entry %d: %w", b.Payload.LogIndex, err)
+	}
+	if err := verifyCheckpoint(proof.Checkpoint, proof.TreeSize, root, key); err != nil {
+		return fmt.Errorf("log entry %d: %w", b.Payload.LogIndex, err)
+	}
+	return nil
+}
+
+// leafHash and nodeHash are the hashes of RFC 6962 Merkle trees.
+func leafHash(b []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+func nodeHash(l, r []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(l)
+	h.Write(r)
+	return h.Sum(nil)
+}
+
+// verifyInclusion checks the inclusion proof path of the leaf at index of
+// a tree of size with root, as RFC 9162 section 2.1.3.2 does.
+func verifyInclusion(index, size int64, leaf []byte, path [][]byte, root []byte) error {
+	if index < 0 || index >= size {
+		return fmt.Errorf("inclusion proof: index %d is outside a tree of %d", index, size)
+	}
+	fn, sn := index, size-1
+	r := leaf
+	for _, p := range path {
+		if sn == 0 {
+			return errors.New("inclusion proof is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(r, root) {
+		return errors.New("inclusion proof doesn't lead to the root")
+	}
+	return nil
+}
+
+// verifyCheckpoint checks that the signed note cp commits the log of key
+// to a tree of size with root. The signature must be under the name the
+// note's origin gives, which Rekor spells as its host name, " - ", and the
+// ID of the tree.
+func verifyCheckpoint(cp string, size int64, root []byte, key crypto.PublicKey) error {
+	text, sigs, ok := strings.Cut(cp, "\n\n")
+	if !ok {
+		return errors.New("checkpoint is not a signed note")
+	}
+	text += "\n"
+	lines := strings.Split(text, "\n")
+	if len(lines) < 4 || lines[1] != strconv.FormatInt(size, 10) || lines[2] != base64.StdEncoding.EncodeToString(root) {
+		return errors.New("checkpoint is of another tree")
+	}
+	origin := lines[0]
+	name, _, _ := strings.Cut(origin, " - ")
+	for _, line := range strings.Split(sigs, "\n") {
+		f := strings.Fields(strings.TrimPrefix(line, "— "))
+		if len(f) != 2 || !strings.HasPrefix(line, "— ") || f[0] != name && f[0] != origin {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(f[1])
+		if err != nil || len(sig) < 5 {
+			continue
+		}
+		// A key hint of four bytes comes before the signature.
+		if verifyWith(key, []byte(text), sig[4:]) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("checkpoint is not signed by the log as %s", origin)
+}
+
+// integratedTime returns when the entry of b was logged.
+func (b *Bundle) integratedTime() time.Time {
+	return time.Unix(b.Payload.IntegratedTime, 0)
+}
@@ -0,0 +1,160 @@
+package cosign_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+// treeHash and auditPath are the Merkle tree hash and the audit path of
+// the leaf at m of RFC 6962 section 2.1.
+func treeHash(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		return hash(0, leaves[0])
+	}
+	k := split(len(leaves))
+	return hash(1, treeHash(leaves[:k]), treeHash(leaves[k:]))
+}
+
+func auditPath(m int, leaves [][]byte) [][]byte {
+	if len(leaves) == 1 {
+		return nil
+	}
+	k := split(len(leaves))
+	if m < k {
+		return append(auditPath(m, leaves[:k]), treeHash(leaves[k:]))
+	}
+	return append(auditPath(m-k, leaves[k:]), treeHash(leaves[:k]))
+}
+
+// split returns the largest power of two less than n.
+func split(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+func hash(prefix byte, parts ...[]byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{prefix})
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func TestVerifyInclusion(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		edit func(*fixture)
+		want string // in the error, or "" if it verifies
+	}{
+		{name: "valid"},
+		{
+			name: "wrong proof hash",
+			edit: func(f *fixture) {
+				h, _ := hex.DecodeString(f.proof.Hashes[1])
+				h[0] ^= 1
+				f.proof.Hashes[1] = hex.EncodeToString(h)
+			},
+			want: "inclusion proof doesn't lead to the root",
+		},
+		{
+			name: "proof too short",
+			edit: func(f *fixture) { f.proof.Hashes = f.proof.Hashes[:2] },
+			want: "inclusion proof doesn't lead to the root",
+		},
+		{
+			name: "proof too long",
+			edit: func(f *fixture) { f.proof.Hashes = append(f.proof.Hashes, f.proof.Hashes[0]) },
+			want: "inclusion proof is too long",
+		},
+		{
+			name: "wrong index",
+			edit: func(f *fixture) { f.proof.LogIndex = 3 },
+			want: "inclusion proof doesn't lead to the root",
+		},
+		{
+			name: "index outside the tree",
+			edit: func(f *fixture) { f.proof.LogIndex = 5 },
+			want: "index 5 is outside a tree of 5",
+		},
+		{
+			name: "wrong tree size",
+			edit: func(f *fixture) {
+				f.proof.TreeSize = 4
+				root, _ := hex.DecodeString(f.proof.RootHash)
+				f.proof.Checkpoint = f.checkpoint(t, f.log, origin, logName, 4, root)
+			},
+			want: "inclusion proof",
+		},
+		{
+			name: "checkpoint of another root",
+			edit: func(f *fixture) {
+				f.proof.Checkpoint = f.checkpoint(t, f.log, origin, logName, 5, treeHash(f.leaves[:4]))
+			},
+			want: "checkpoint is of another tree",
+		},
+		{
+			name: "checkpoint of another size",
+			edit: func(f *fixture) {
+				root, _ := hex.DecodeString(f.proof.RootHash)
+				f.proof.Checkpoint = f.checkpoint(t, f.log, origin, logName, 4, root)
+			},
+			want: "checkpoint is of another tree",
+		},
+		{
+			name: "checkpoint of another origin",
+			edit: func(f *fixture) {
+				root, _ := hex.DecodeString(f.proof.RootHash)
+				f.proof.Checkpoint = f.checkpoint(t, f.log, "other.example.com - 42", logName, 5, root)
+			},
+			want: "not signed by the log as other.example.com - 42",
+		},
+		{
+			name: "checkpoint named as the origin",
+			edit: func(f *fixture) {
+				root, _ := hex.DecodeString(f.proof.RootHash)
+				f.proof.Checkpoint = f.checkpoint(t, f.log, logName, logName, 5, root)
+			},
+		},
+		{
+			name: "checkpoint signed by another key",
+			edit: func(f *fixture) {
+				root, _ := hex.DecodeString(f.proof.RootHash)
+				f.proof.Checkpoint = f.checkpoint(t, newKey(t), origin, logName, 5, root)
+			},
+			want: "not signed by the log",
+		},
+		{
+			name: "checkpoint not a note",
+			edit: func(f *fixture) { f.proof.Checkpoint = origin + "\n5\n" },
+			want: "not a signed note",
+		},
+		{
+			name: "another entry",
+			edit: func(f *fixture) { f.body = base64.StdEncoding.EncodeToString([]byte("entry 2")) },
+			want: "not the one of the bundle",
+		},
+		{
+			name: "log failure",
+			edit: func(f *fixture) { f.status = http.StatusInternalServerError },
+			want: "500 Internal Server Error",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFixture(t, defaults())
+			f.serve(t)
+			if tc.edit != nil {
+				tc.edit(f)
+			}
+			if res := f.verify(t, tc.want); res != nil && !res.Included {
+				t.Errorf("Verify() = %+v, want the inclusion proof checked", res)
+			}
+		})
+	}
+}
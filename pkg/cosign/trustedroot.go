@@ -0,0 +1,71 @@
+package cosign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// TrustedRoot is what a Sigstore instance's trusted root, the
+// trusted_root.json of its TUF repository that cosign verify --trusted-root
+// takes, says to trust.
+type TrustedRoot struct {
+	Roots, Intermediates *x509.CertPool // of Fulcio
+	RekorKeys            []crypto.PublicKey
+}
+
+// ParseTrustedRoot parses the JSON of a trusted root: the certificate
+// chains of its certificate authorities and the public keys of its
+// transparency logs. The periods they are valid for are not checked.
+func ParseTrustedRoot(b []byte) (*TrustedRoot, error) {
+	var tr struct {
+		Tlogs []struct {
+			PublicKey struct {
+				RawBytes []byte `json:"rawBytes"`
+			} `json:"publicKey"`
+		} `json:"tlogs"`
+		CertificateAuthorities []struct {
+			CertChain struct {
+				Certificates []struct {
+					RawBytes []byte `json:"rawBytes"`
+				} `json:"certificates"`
+			} `json:"certChain"`
+		} `json:"certificateAuthorities"`
+	}
+	if err := json.Unmarshal(b, &tr); err != nil {
+		return nil, fmt.Errorf("cosign: trusted root: %w", err)
+	}
+	root := &TrustedRoot{Roots: x509.NewCertPool(), Intermediates: x509.NewCertPool()}
+	roots := 0
+	for _, ca := range tr.CertificateAuthorities {
+		for _, raw := range ca.CertChain.Certificates {
+			c, err := x509.ParseCertificate(raw.RawBytes)
+			if err != nil {
+				return nil, fmt.Errorf("cosign: trusted root: %w", err)
+			}
+			if bytes.Equal(c.RawIssuer, c.RawSubject) && c.CheckSignatureFrom(c) == nil {
+				root.Roots.AddCert(c)
+				roots++
+			} else {
+				root.Intermediates.AddCert(c)
+			}
+		}
+	}
+	for _, l := range tr.Tlogs {
+		k, err := x509.ParsePKIXPublicKey(l.PublicKey.RawBytes)
+		if err != nil {
+			return nil, fmt.Errorf("cosign: trusted root: transparency log key: %w", err)
+		}
+		root.RekorKeys = append(root.RekorKeys, k)
+	}
+	if roots == 0 && len(root.RekorKeys) == 0 {
+		return nil, errors.New("cosign: trusted root has no certificate authorities or transparency logs")
+	}
+	if roots == 0 {
+		root.Roots = nil
+	}
+	return root, nil
+}
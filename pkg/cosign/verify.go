@@ -0,0 +1,264 @@
+package cosign
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Fulcio certificate extensions naming the OIDC issuer of the identity: the
+// first holds the raw string, the second, which replaces it, a DER
+// UTF8String.
+var (
+	oidIssuerV1 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// Identity constrains the identity a keyless signing certificate was
+// issued for, as cosign verify's --certificate-identity and
+// --certificate-oidc-issuer flags do. Each of the fields that is set must
+// match: the subject, an email address or URI of the certificate's
+// subject alternative names, exactly or by unanchored regexp, and the
+// issuer likewise.
+type Identity struct {
+	Subject       string
+	SubjectRegexp *regexp.Regexp
+	Issuer        string
+	IssuerRegexp  *regexp.Regexp
+}
+
+func (id Identity) String() string {
+	var parts []string
+	if id.Subject != "" {
+		parts = append(parts, "subject "+id.Subject)
+	}
+	if id.SubjectRegexp != nil {
+		parts = append(parts, "subject ~ "+id.SubjectRegexp.String())
+	}
+	if id.Issuer != "" {
+		parts = append(parts, "issuer "+id.Issuer)
+	}
+	if id.IssuerRegexp != nil {
+		parts = append(parts, "issuer ~ "+id.IssuerRegexp.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// matches reports whether the identity of a certificate for the subjects
+// and issuer matches id, and the subject that does.
+func (id Identity) matches(subjects []string, issuer string) (string, bool) {
+	if id.Issuer != "" && issuer != id.Issuer || id.IssuerRegexp != nil && !id.IssuerRegexp.MatchString(issuer) {
+		return "", false
+	}
+	for _, s := range subjects {
+		if (id.Subject == "" || s == id.Subject) && (id.SubjectRegexp == nil || id.SubjectRegexp.MatchString(s)) {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+// Verifier checks the signatures of images.
+type Verifier struct {
+	// Keys are the public keys that signatures made with a key are
+	// checked against.
+	Keys []crypto.PublicKey
+
+	// Roots are the Fulcio root certificates that the certificates of
+	// keyless signatures must chain to, through Intermediates or the
+	// chain given with the signature.
+	Roots, Intermediates *x509.CertPool
+	// Identities are what the certificates of keyless signatures may be
+	// issued for: they must match one. Keyless signatures are rejected
+	// if there are none.
+	Identities []Identity
+
+	// RekorKeys are the public keys of the trusted Rekor logs. Keyless
+	// signatures must have a bundle of one of them; a bundle of a
+	// signature made with a key is checked if there are any.
+	RekorKeys []crypto.PublicKey
+	// Rekor, if not nil, is asked for the inclusion proofs of the
+	// entries of bundles, which are checked too.
+	Rekor *Rekor
+}
+
+// Result is what a verified signature shows.
+type Result struct {
+	Key      crypto.PublicKey // that signed, for a signature made with a key
+	Subject  string           // of the certificate, for a keyless signature
+	Issuer   string           // of the identity, for a keyless signature
+	Logged   bool             // whether the signature has a verified Rekor entry
+	LogIndex int64            // of the entry
+	LogTime  time.Time        // when the entry was logged
+	Included bool             // whether the entry's inclusion proof was checked
+}
+
+// Verify checks that sig is a valid signature of the image whose manifest
+// or index has digest image. The error wraps ErrUnverified if the
+// signature is not one the verifier trusts.
+func (v *Verifier) Verify(ctx context.Context, sig *Signature, image digest.Digest) (*Result, error) {
+	res, err := v.verify(ctx, sig, image)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnverified, err)
+	}
+	return res, nil
+}
+
+func (v *Verifier) verify(ctx context.Context, sig *Signature, image digest.Digest) (*Result, error) {
+	if err := checkPayload(sig.Payload, image); err != nil {
+		return nil, err
+	}
+	if sig.Certificate == nil {
+		return v.verifyKeyed(ctx, sig)
+	}
+	return v.verifyKeyless(ctx, sig)
+}
+
+func (v *Verifier) verifyKeyed(ctx context.Context, sig *Signature) (*Result, error) {
+	if len(v.Keys) == 0 {
+		return nil, errors.New("signature was made with a key, and no keys are trusted")
+	}
+	var key crypto.PublicKey
+	for _, k := range v.Keys {
+		if verifyWith(k, sig.Payload, sig.Signature) == nil {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		return nil, errors.New("signature was made with none of the trusted keys")
+	}
+	res := &Result{Key: key}
+	if sig.Bundle != nil && len(v.RekorKeys) > 0 {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := v.verifyBundle(ctx, sig, der, res); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (v *Verifier) verifyKeyless(ctx context.Context, sig *Signature) (*Result, error) {
+	switch {
+	case v.Roots == nil:
+		return nil, errors.New("signature is keyless, and no Fulcio roots are trusted")
+	case len(v.Identities) == 0:
+		return nil, errors.New("signature is keyless, and no identities are trusted")
+	case sig.Bundle == nil:
+		return nil, errors.New("keyless signature has no Rekor bundle to show when it was made")
+	}
+	res := new(Result)
+	if err := v.verifyBundle(ctx, sig, sig.Certificate.Raw, res); err != nil {
+		return nil, err
+	}
+
+	cert := sig.Certificate
+	inter := x509.NewCertPool()
+	if v.Intermediates != nil {
+		inter = v.Intermediates.Clone()
+	}
+	for _, c := range sig.Chain {
+		inter.AddCert(c)
+	}
+	// Fulcio certificates are valid for minutes; the log shows the
+	// signature was made within them.
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         v.Roots,
+		Intermediates: inter,
+		CurrentTime:   res.LogTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("certificate: %w", err)
+	}
+	if err := verifyWith(cert.PublicKey, sig.Payload, sig.Signature); err != nil {
+		return nil, fmt.Errorf("signature doesn't match its certificate: %w", err)
+	}
+
+	subjects := cert.EmailAddresses
+	for _, u := range cert.URIs {
+		subjects = append(subjects, u.String())
+	}
+	res.Issuer = certIssuer(cert)
+	for _, id := range v.Identities {
+		if s, ok := id.matches(subjects, res.Issuer); ok {
+			res.Subject = s
+			return res, nil
+		}
+	}
+	return nil, fmt.Errorf("certificate for %s from issuer %s is of none of the trusted identities", strings.Join(subjects, ", "), res.Issuer)
+}
+
+// verifyBundle checks the bundle of sig, whose signer has the PKIX or
+// certificate DER signer, and records it in res.
+func (v *Verifier) verifyBundle(ctx context.Context, sig *Signature, signer []byte, res *Result) error {
+	b := sig.Bundle
+	if err := b.verifySET(v.RekorKeys); err != nil {
+		return fmt.Errorf("rekor bundle: %w", err)
+	}
+	if err := b.checkBody(sig.Payload, sig.Signature, signer); err != nil {
+		return fmt.Errorf("rekor bundle: %w", err)
+	}
+	res.Logged, res.LogIndex, res.LogTime = true, b.Payload.LogIndex, b.integratedTime()
+	if v.Rekor != nil {
+		if err := v.Rekor.verifyInclusion(ctx, b, v.RekorKeys); err != nil {
+			return fmt.Errorf("rekor: %w", err)
+		}
+		res.Included = true
+	}
+	return nil
+}
+
+// certIssuer returns the OIDC issuer a Fulcio certificate names.
+func certIssuer(c *x509.Certificate) string {
+	var v1 string
+	for _, e := range c.Extensions {
+		switch {
+		case e.Id.Equal(oidIssuerV2):
+			var s string
+			if _, err := asn1.Unmarshal(e.Value, &s); err == nil {
+				return s
+			}
+		case e.Id.Equal(oidIssuerV1):
+			v1 = string(e.Value)
+		}
+	}
+	return v1
+}
+
+// verifyWith checks the signature sig of msg made with the private key of
+// key, as sigstore signs: SHA-256 and ASN.1 for ECDSA, PKCS #1 v1.5 with
+// SHA-256 for RSA, and the message itself for Ed25519.
+func verifyWith(key crypto.PublicKey, msg, sig []byte) error {
+	sum := sha256.Sum256(msg)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, sum[:], sig) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, msg, sig) {
+			return errors.New("invalid Ed25519 signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
@@ -0,0 +1,479 @@
+package cosign_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/hxtk/ember/pkg/cosign"
+)
+
+const (
+	email    = "builder@example.com"
+	issuer   = "https://issuer.example.com"
+	origin   = "rekor.example.com - 42"
+	logName  = "rekor.example.com"
+	logIndex = 1002 // of the entry in the log; it is leaf 2 of the tree
+)
+
+// logTime is when the entries of the fixtures were logged: an hour ago, so
+// that their certificates, valid minutes around it, have expired.
+var logTime = time.Now().Add(-time.Hour).Truncate(time.Second)
+
+// params are what a fixture is built from.
+type params struct {
+	keyed               bool // signed with a key, not a certificate
+	image               digest.Digest
+	email, issuer       string
+	notBefore, notAfter time.Time
+	logged              bool // whether the signature has a bundle
+}
+
+func defaults() params {
+	return params{
+		image:     digest.FromString("manifest"),
+		email:     email,
+		issuer:    issuer,
+		notBefore: logTime.Add(-5 * time.Minute),
+		notAfter:  logTime.Add(10 * time.Minute),
+		logged:    true,
+	}
+}
+
+// fixture is a signature of an image, with what a verifier needs to trust
+// it: the key or Fulcio root it was made under, and the Rekor log it was
+// entered in, whose inclusion proof of the entry serve serves.
+type fixture struct {
+	image    digest.Digest
+	payload  []byte
+	layer    specs.Descriptor
+	bundle   *cosign.Bundle
+	signer   *ecdsa.PrivateKey
+	log      *ecdsa.PrivateKey
+	leaves   [][]byte // of the log's tree
+	proof    proof
+	body     string // of the entry the log serves
+	status   int    // of the log's responses
+	verifier cosign.Verifier
+}
+
+// proof is an inclusion proof as Rekor serves it.
+type proof struct {
+	Checkpoint string   `json:"checkpoint"`
+	Hashes     []string `json:"hashes"`
+	LogIndex   int64    `json:"logIndex"`
+	RootHash   string   `json:"rootHash"`
+	TreeSize   int64    `json:"treeSize"`
+}
+
+func newFixture(t *testing.T, p params) *fixture {
+	t.Helper()
+	f := &fixture{image: digest.FromString("manifest"), signer: newKey(t), log: newKey(t), status: http.StatusOK}
+	f.payload = payload(p.image)
+	sig := sign(t, f.signer, f.payload)
+	f.layer = specs.Descriptor{
+		MediaType:   cosign.MediaTypeSimpleSigning,
+		Digest:      digest.FromBytes(f.payload),
+		Size:        int64(len(f.payload)),
+		Annotations: map[string]string{cosign.AnnotationSignature: base64.StdEncoding.EncodeToString(sig)},
+	}
+	f.verifier.RekorKeys = append(f.verifier.RekorKeys, &f.log.PublicKey)
+
+	var signer []byte // PEM, as the entry gives it
+	if p.keyed {
+		der, err := x509.MarshalPKIXPublicKey(&f.signer.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+		f.verifier.Keys = append(f.verifier.Keys, &f.signer.PublicKey)
+	} else {
+		root, rootKey := newRoot(t)
+		cert := issue(t, root, rootKey, &f.signer.PublicKey, p)
+		signer = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		f.layer.Annotations[cosign.AnnotationCertificate] = string(signer)
+		f.verifier.Roots = x509.NewCertPool()
+		f.verifier.Roots.AddCert(root)
+		f.verifier.Identities = []cosign.Identity{{Subject: email, Issuer: issuer}}
+	}
+	if !p.logged {
+		return f
+	}
+
+	sum := sha256.Sum256(f.payload)
+	raw, err := json.Marshal(map[string]any{
+		"apiVersion": "0.0.1",
+		"kind":       "hashedrekord",
+		"spec": map[string]any{
+			"data":      map[string]any{"hash": map[string]string{"algorithm": "sha256", "value": hex.EncodeToString(sum[:])}},
+			"signature": map[string]any{"content": sig, "publicKey": map[string]any{"content": signer}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := cosign.LogID(&f.log.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.body = base64.StdEncoding.EncodeToString(raw)
+	f.bundle = &cosign.Bundle{Payload: cosign.BundlePayload{
+		Body:           f.body,
+		IntegratedTime: logTime.Unix(),
+		LogIndex:       logIndex,
+		LogID:          id,
+	}}
+	// The log signs the entry as canonical JSON.
+	set, err := json.Marshal(struct {
+		Body           string `json:"body"`
+		IntegratedTime int64  `json:"integratedTime"`
+		LogID          string `json:"logID"`
+		LogIndex       int64  `json:"logIndex"`
+	}{f.body, logTime.Unix(), id, logIndex})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.bundle.SignedEntryTimestamp = sign(t, f.log, set)
+
+	f.leaves = [][]byte{[]byte("entry 0"), []byte("entry 1"), raw, []byte("entry 3"), []byte("entry 4")}
+	root := treeHash(f.leaves)
+	f.proof = proof{
+		LogIndex:   2,
+		TreeSize:   int64(len(f.leaves)),
+		RootHash:   hex.EncodeToString(root),
+		Checkpoint: f.checkpoint(t, f.log, origin, logName, int64(len(f.leaves)), root),
+	}
+	for _, h := range auditPath(2, f.leaves) {
+		f.proof.Hashes = append(f.proof.Hashes, hex.EncodeToString(h))
+	}
+	return f
+}
+
+// checkpoint returns a signed note committing to the tree of size with
+// root, signed by key under name.
+func (f *fixture) checkpoint(t *testing.T, key *ecdsa.PrivateKey, origin, name string, size int64, root []byte) string {
+	t.Helper()
+	text := fmt.Sprintf("%s\n%d\n%s\n", origin, size, base64.StdEncoding.EncodeToString(root))
+	sig := append([]byte{0, 0, 0, 0}, sign(t, key, []byte(text))...) // a key hint, then the signature
+	return text + "\n— " + name + " " + base64.StdEncoding.EncodeToString(sig) + "\n"
+}
+
+// serve serves the log from an httptest server, and has the verifier ask
+// it for inclusion proofs.
+func (f *fixture) serve(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v1/log/entries" || req.URL.Query().Get("logIndex") != fmt.Sprint(logIndex) {
+			http.NotFound(w, req)
+			return
+		}
+		if f.status != http.StatusOK {
+			w.WriteHeader(f.status)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"uuid": map[string]any{
+			"body":         f.body,
+			"verification": map[string]any{"inclusionProof": f.proof},
+		}})
+	}))
+	t.Cleanup(srv.Close)
+	f.verifier.Rekor = &cosign.Rekor{URL: srv.URL, HTTP: srv.Client()}
+}
+
+// signature returns the signature of the fixture as Signatures parses it
+// from a signature manifest.
+func (f *fixture) signature(t *testing.T) *cosign.Signature {
+	t.Helper()
+	if f.bundle != nil {
+		b, err := json.Marshal(f.bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.layer.Annotations[cosign.AnnotationBundle] = string(b)
+	}
+	sigs, err := cosign.Signatures(manifest(t, f.layer), func(specs.Descriptor) ([]byte, error) { return f.payload, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sigs) != 1 {
+		t.Fatalf("%d signatures, want 1", len(sigs))
+	}
+	return sigs[0]
+}
+
+// verify checks the signature of f, and that it verifies, or fails with an
+// error wrapping ErrUnverified and containing want.
+func (f *fixture) verify(t *testing.T, want string) *cosign.Result {
+	t.Helper()
+	res, err := f.verifier.Verify(context.Background(), f.signature(t), f.image)
+	if want == "" {
+		if err != nil {
+			t.Fatalf("Verify() = %v", err)
+		}
+		return res
+	}
+	if !errors.Is(err, cosign.ErrUnverified) || !strings.Contains(err.Error(), want) {
+		t.Fatalf("Verify() = %v, want an unverified signature: %s", err, want)
+	}
+	return nil
+}
+
+func manifest(t *testing.T, layers ...specs.Descriptor) []byte {
+	t.Helper()
+	b, err := json.Marshal(specs.Manifest{Layers: layers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func payload(image digest.Digest) []byte {
+	return fmt.Appendf(nil, `{"critical":{"identity":{"docker-reference":"registry.example.com/app"},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, image)
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func sign(t *testing.T, k *ecdsa.PrivateKey, msg []byte) []byte {
+	t.Helper()
+	sum := sha256.Sum256(msg)
+	sig, err := ecdsa.SignASN1(rand.Reader, k, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func newRoot(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	k := newKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fulcio"},
+		NotBefore:             logTime.Add(-24 * time.Hour),
+		NotAfter:              logTime.Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, k
+}
+
+// issue issues a Fulcio code signing certificate for key, for the email
+// and issuer of p, valid from p.notBefore to p.notAfter.
+func issue(t *testing.T, root *x509.Certificate, rootKey *ecdsa.PrivateKey, key *ecdsa.PublicKey, p params) *x509.Certificate {
+	t.Helper()
+	iss, err := asn1.MarshalWithParams(p.issuer, "utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       p.notBefore,
+		NotAfter:        p.notAfter,
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses:  []string{p.email},
+		ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}, Value: iss}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, root, key, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestVerifyKeyless(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		params func(*params)
+		edit   func(*fixture)
+		want   string // in the error, or "" if it verifies
+	}{
+		// The certificate has expired, but was valid when the entry was logged.
+		{name: "valid"},
+		{name: "subject regexp", edit: func(f *fixture) {
+			f.verifier.Identities = []cosign.Identity{{SubjectRegexp: regexp.MustCompile(`@example\.com$`), Issuer: issuer}}
+		}},
+		{name: "second identity", edit: func(f *fixture) {
+			f.verifier.Identities = []cosign.Identity{{Subject: "other@example.com"}, {Subject: email}}
+		}},
+		{
+			name: "flipped SET byte",
+			edit: func(f *fixture) { f.bundle.SignedEntryTimestamp[len(f.bundle.SignedEntryTimestamp)/2] ^= 1 },
+			want: "signed entry timestamp",
+		},
+		{
+			name: "untrusted log",
+			edit: func(f *fixture) { f.verifier.RekorKeys = nil },
+			want: "untrusted Rekor log",
+		},
+		{
+			name: "entry of another signature",
+			edit: func(f *fixture) {
+				f.layer.Annotations[cosign.AnnotationSignature] = base64.StdEncoding.EncodeToString(sign(t, f.signer, f.payload))
+			},
+			want: "entry is of another signature",
+		},
+		{
+			name: "other subject",
+			edit: func(f *fixture) {
+				f.verifier.Identities = []cosign.Identity{{Subject: "mallory@example.com", Issuer: issuer}}
+			},
+			want: "none of the trusted identities",
+		},
+		{
+			name: "other issuer",
+			edit: func(f *fixture) {
+				f.verifier.Identities = []cosign.Identity{{Subject: email, Issuer: "https://other.example.com"}}
+			},
+			want: "none of the trusted identities",
+		},
+		{
+			name:   "certificate of another issuer",
+			params: func(p *params) { p.issuer = "https://other.example.com" },
+			want:   "from issuer https://other.example.com is of none",
+		},
+		{
+			name: "no identities",
+			edit: func(f *fixture) { f.verifier.Identities = nil },
+			want: "no identities are trusted",
+		},
+		{
+			name: "untrusted root",
+			edit: func(f *fixture) {
+				root, _ := newRoot(t)
+				f.verifier.Roots = x509.NewCertPool()
+				f.verifier.Roots.AddCert(root)
+			},
+			want: "certificate",
+		},
+		{
+			name: "expired at the log time",
+			params: func(p *params) {
+				p.notBefore, p.notAfter = logTime.Add(-20*time.Minute), logTime.Add(-10*time.Minute)
+			},
+			want: "certificate",
+		},
+		{
+			// Valid now, but not yet when the entry was logged.
+			name: "not yet valid at the log time",
+			params: func(p *params) {
+				p.notBefore, p.notAfter = logTime.Add(time.Minute), time.Now().Add(time.Hour)
+			},
+			want: "certificate",
+		},
+		{
+			name:   "not logged",
+			params: func(p *params) { p.logged = false },
+			want:   "no Rekor bundle",
+		},
+		{
+			name:   "of another image",
+			params: func(p *params) { p.image = digest.FromString("other") },
+			want:   "payload signs",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := defaults()
+			if tc.params != nil {
+				tc.params(&p)
+			}
+			f := newFixture(t, p)
+			if tc.edit != nil {
+				tc.edit(f)
+			}
+			res := f.verify(t, tc.want)
+			if res == nil {
+				return
+			}
+			if res.Issuer != issuer || res.Subject != email || !res.Logged || res.LogIndex != logIndex || !res.LogTime.Equal(logTime) || res.Included {
+				t.Errorf("Verify() = %+v, want %s from %s, logged at %d at %v and not checked for inclusion", res, email, issuer, logIndex, logTime)
+			}
+		})
+	}
+}
+
+func TestVerifyKeyed(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		logged bool
+		edit   func(*fixture)
+		want   string
+	}{
+		{name: "valid"},
+		{name: "valid and logged", logged: true},
+		{name: "logged, no log trusted", logged: true, edit: func(f *fixture) { f.verifier.RekorKeys = nil }},
+		{
+			name: "other key",
+			edit: func(f *fixture) { f.verifier.Keys = []crypto.PublicKey{&newKey(t).PublicKey} },
+			want: "none of the trusted keys",
+		},
+		{
+			name: "no keys",
+			edit: func(f *fixture) { f.verifier.Keys = nil },
+			want: "no keys are trusted",
+		},
+		{
+			name:   "flipped SET byte",
+			logged: true,
+			edit:   func(f *fixture) { f.bundle.SignedEntryTimestamp[len(f.bundle.SignedEntryTimestamp)/2] ^= 1 },
+			want:   "signed entry timestamp",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := defaults()
+			p.keyed, p.logged = true, tc.logged
+			f := newFixture(t, p)
+			if tc.edit != nil {
+				tc.edit(f)
+			}
+			res := f.verify(t, tc.want)
+			if res == nil {
+				return
+			}
+			if !res.Key.(*ecdsa.PublicKey).Equal(&f.signer.PublicKey) || res.Logged != (tc.logged && f.verifier.RekorKeys != nil) {
+				t.Errorf("Verify() = %+v", res)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package cpio
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EqualOptions says what Equal leaves out of the comparison.
+type EqualOptions struct {
+	// IgnoreInodes compares which entries share an inode instead of the
+	// inode numbers, and devices, that say so.
+	IgnoreInodes bool
+	// IgnoreModTimes leaves out modification times.
+	IgnoreModTimes bool
+	// IgnoreOrder compares the entries by name instead of in order.
+	IgnoreOrder bool
+}
+
+// Equal reports whether the newc archives a and b hold the same entries,
+// as Difference compares them.
+func Equal(a, b io.Reader, opts EqualOptions) (bool, error) {
+	d, err := Difference(a, b, opts)
+	return d == "" && err == nil, err
+}
+
+// Difference compares the newc archives a and b as an extractor sees them,
+// not byte for byte, and returns how the first entry that differs does, or
+// "" if none does. The entries of archives concatenated to either are
+// compared too, so split volumes compare equal to the archive they were
+// split from. Names are compared cleaned, so ./bin and bin/ are the same,
+// content is compared by its SHA-256, and the other header fields one by
+// one, but for those opts says to ignore.
+func Difference(a, b io.Reader, opts EqualOptions) (string, error) {
+	ea, err := readEntries(a, opts)
+	if err != nil {
+		return "", fmt.Errorf("first archive: %w", err)
+	}
+	eb, err := readEntries(b, opts)
+	if err != nil {
+		return "", fmt.Errorf("second archive: %w", err)
+	}
+	for i := range min(len(ea), len(eb)) {
+		if d := ea[i].diff(&eb[i]); d != "" {
+			return d, nil
+		}
+	}
+	switch {
+	case len(ea) > len(eb):
+		return fmt.Sprintf("%q: only in the first archive", ea[len(eb)].name), nil
+	case len(eb) > len(ea):
+		return fmt.Sprintf("%q: only in the second archive", eb[len(ea)].name), nil
+	}
+	return "", nil
+}
+
+// comparedEntry is what Difference compares of an entry.
+type comparedEntry struct {
+	name string
+	hdr  Header
+	link string // with IgnoreInodes, the first entry sharing the inode
+	sum  [sha256.Size]byte
+}
+
+// inodeKey says which inode of which device an entry is.
+func (e *comparedEntry) inodeKey() [3]int {
+	return [3]int{e.hdr.Inode, e.hdr.DevMajor, e.hdr.DevMinor}
+}
+
+func readEntries(r io.Reader, opts EqualOptions) ([]comparedEntry, error) {
+	tr := NewReader(r)
+	var entries []comparedEntry
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return nil, err
+		}
+		e := comparedEntry{name: cleanName(hdr.Name), hdr: *hdr}
+		h.Sum(e.sum[:0])
+		e.hdr.Name = ""
+		if opts.IgnoreModTimes {
+			e.hdr.ModTime = time.Time{}
+		}
+		entries = append(entries, e)
+	}
+	if opts.IgnoreOrder {
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	}
+	if opts.IgnoreInodes {
+		firsts := make(map[[3]int]string)
+		for i := range entries {
+			e := &entries[i]
+			if first, ok := firsts[e.inodeKey()]; ok && e.hdr.Links > 1 {
+				e.link = first
+			} else {
+				firsts[e.inodeKey()] = e.name
+			}
+		}
+		for i := range entries {
+			e := &entries[i].hdr
+			e.Inode, e.DevMajor, e.DevMinor = 0, 0, 0
+		}
+	}
+	return entries, nil
+}
+
+// diff says how e differs from f, in the names of the header fields, or
+// returns "".
+func (e *comparedEntry) diff(f *comparedEntry) string {
+	if e.name != f.name {
+		return fmt.Sprintf("%q in the first archive where the second has %q", e.name, f.name)
+	}
+	var fields []string
+	a, b := &e.hdr, &f.hdr
+	check := func(name string, differ bool) {
+		if differ {
+			fields = append(fields, name)
+		}
+	}
+	check("mode", a.Mode != b.Mode)
+	check("owner", a.Uid != b.Uid || a.Gid != b.Gid)
+	check("size", a.Size != b.Size)
+	check("mtime", !a.ModTime.Equal(b.ModTime))
+	check("device", a.DevMajor != b.DevMajor || a.DevMinor != b.DevMinor)
+	check("rdev", a.RdevMajor != b.RdevMajor || a.RdevMinor != b.RdevMinor)
+	check("nlink", a.Links != b.Links)
+	check("inode", a.Inode != b.Inode)
+	check("hard link", e.link != f.link)
+	check("content", a.Size == b.Size && e.sum != f.sum)
+	if len(fields) == 0 {
+		return ""
+	}
+	verb := "differs"
+	if len(fields) > 1 {
+		verb = "differ"
+	}
+	return fmt.Sprintf("%q: %s %s", e.name, strings.Join(fields, ", "), verb)
+}
+
+// cleanName spells the name of an entry as extractors take it.
+func cleanName(name string) string {
+	p := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
@@ -0,0 +1,94 @@
+package cpio_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hxtk/ember/pkg/cpio"
+)
+
+// archive writes entries, numbered from 1, as a newc archive.
+func archive(t *testing.T, entries ...entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	write(t, cpio.NewWriter(&buf), entries)
+	return buf.Bytes()
+}
+
+func TestDifference(t *testing.T) {
+	base := []entry{file("a", "A"), file("b", "B")}
+	touched := file("b", "B")
+	touched.hdr.ModTime = time.Unix(1, 0)
+	owned := file("b", "B")
+	owned.hdr.Uid = 1000
+	dotted := file("./a", "A")
+
+	for _, tc := range []struct {
+		name  string
+		other []entry
+		opts  cpio.EqualOptions
+		want  string // in the difference, or "" if equal
+	}{
+		{"same", base, cpio.EqualOptions{}, ""},
+		{"dot prefix", []entry{dotted, file("b", "B")}, cpio.EqualOptions{}, ""},
+		{"content", []entry{file("a", "A"), file("b", "C")}, cpio.EqualOptions{}, `"b": content differs`},
+		{"size", []entry{file("a", "A"), file("b", "BB")}, cpio.EqualOptions{}, `"b": size differs`},
+		{"owner", []entry{file("a", "A"), owned}, cpio.EqualOptions{}, `"b": owner differs`},
+		{"mtime", []entry{file("a", "A"), touched}, cpio.EqualOptions{}, `"b": mtime differs`},
+		{"mtime ignored", []entry{file("a", "A"), touched}, cpio.EqualOptions{IgnoreModTimes: true}, ""},
+		{"order", []entry{file("b", "B"), file("a", "A")}, cpio.EqualOptions{}, `"a" in the first archive where the second has "b"`},
+		{"order ignored", []entry{file("b", "B"), file("a", "A")}, cpio.EqualOptions{IgnoreOrder: true, IgnoreInodes: true}, ""},
+		{"inodes", []entry{file("b", "B"), file("a", "A")}, cpio.EqualOptions{IgnoreOrder: true}, `"a": inode differs`},
+		{"missing", base[:1], cpio.EqualOptions{}, `"b": only in the first archive`},
+		{"extra", append(base, file("c", "")), cpio.EqualOptions{}, `"c": only in the second archive`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := cpio.Difference(bytes.NewReader(archive(t, base...)), bytes.NewReader(archive(t, tc.other...)), tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.want == "" && d != "" || !strings.Contains(d, tc.want) {
+				t.Errorf("Difference() = %q, want %q", d, tc.want)
+			}
+			eq, err := cpio.Equal(bytes.NewReader(archive(t, base...)), bytes.NewReader(archive(t, tc.other...)), tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if eq != (tc.want == "") {
+				t.Errorf("Equal() = %v, want %v", eq, tc.want == "")
+			}
+		})
+	}
+}
+
+// With IgnoreInodes, archives compare by which entries share an inode.
+func TestDifferenceOfHardLinks(t *testing.T) {
+	linked := func(inodes ...int) []byte {
+		var buf bytes.Buffer
+		tw := cpio.NewWriter(&buf)
+		for i, name := range []string{"a", "b", "c"} {
+			hdr := cpio.Header{Name: name, Mode: 0o100644, Links: 1, Inode: inodes[i]}
+			for j, n := range inodes {
+				if j != i && n == inodes[i] {
+					hdr.Links++
+				}
+			}
+			if err := tw.WriteHeader(&hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	opts := cpio.EqualOptions{IgnoreInodes: true}
+	if d, err := cpio.Difference(bytes.NewReader(linked(1, 1, 2)), bytes.NewReader(linked(7, 7, 9)), opts); d != "" || err != nil {
+		t.Errorf("Difference of renumbered links = %q, %v, want none", d, err)
+	}
+	if d, _ := cpio.Difference(bytes.NewReader(linked(1, 1, 2)), bytes.NewReader(linked(1, 2, 2)), opts); d == "" {
+		t.Error("Difference of other links is none")
+	}
+}
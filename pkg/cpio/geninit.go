@@ -0,0 +1,213 @@
+package cpio
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SpecWriter writes entries as a description for the kernel's
+// usr/gen_init_cpio, as CONFIG_INITRAMFS_SOURCE takes it, instead of as an
+// archive: one line per entry, with the content of regular files extracted
+// into a directory that the file lines name.
+//
+// gen_init_cpio gives files the modification times of their extracted
+// content, which SpecWriter sets, and everything else the time of the
+// build. It numbers inodes itself, so Header.Inode only tells which regular
+// files of more than one link are hard links of each other, which the
+// description gives on one line, at its end. Names can't hold whitespace,
+// and the root entry is left out.
+type SpecWriter struct {
+	list *bufio.Writer
+	dir  string // absolute, where content goes
+
+	hdr  *Header  // current entry
+	name string   // its name in the description, with a leading /
+	f    *os.File // content of the current regular file
+	link []byte   // target of the current symlink
+
+	// linked are the lines of the files with hard links, by inode, which
+	// Close writes once it has all their names.
+	linked    map[int]*linkedSpec
+	linkOrder []int
+
+	err    error
+	closed bool
+}
+
+// linkedSpec is the line of a file with hard links, and the names of the
+// links.
+type linkedSpec struct {
+	line  string
+	names []string
+}
+
+// NewSpecWriter creates a SpecWriter writing the description to list and
+// the content of regular files into dir, which it creates if need be.
+func NewSpecWriter(list io.Writer, dir string) (*SpecWriter, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(abs, " \t\n") {
+		return nil, fmt.Errorf("cpio: gen_init_cpio can't read content from %q, which has whitespace", abs)
+	}
+	if err := os.MkdirAll(abs, 0o755); err != nil {
+		return nil, err
+	}
+	sw := &SpecWriter{list: bufio.NewWriter(list), dir: abs, linked: make(map[int]*linkedSpec)}
+	fmt.Fprintf(sw.list, "# gen_init_cpio description; content is below %s\n", abs)
+	return sw, nil
+}
+
+// WriteHeader finishes the current entry and starts hdr.
+func (sw *SpecWriter) WriteHeader(hdr *Header) error {
+	if sw.closed {
+		return fmt.Errorf("cpio: writer is closed")
+	}
+	if sw.err != nil {
+		return sw.err
+	}
+	if sw.err = sw.finish(); sw.err != nil {
+		return sw.err
+	}
+
+	p := path.Clean("/" + hdr.Name)
+	if p == "/" {
+		return nil
+	}
+	if strings.ContainsAny(p, " \t\n\r\v\f") {
+		sw.err = fmt.Errorf("cpio: gen_init_cpio can't hold %q, which has whitespace", hdr.Name)
+		return sw.err
+	}
+	h := *hdr
+	sw.hdr, sw.name = &h, p
+	if hdr.Mode&0xf000 == s_IFREG && sw.linkOf(hdr) == nil {
+		sw.err = sw.create()
+	}
+	return sw.err
+}
+
+// linkOf returns the line of the file that hdr, a regular file, is a hard
+// link of, or nil.
+func (sw *SpecWriter) linkOf(hdr *Header) *linkedSpec {
+	if hdr.Links < 2 {
+		return nil
+	}
+	return sw.linked[hdr.Inode]
+}
+
+// create creates the file for the content of the current entry.
+func (sw *SpecWriter) create() error {
+	name := filepath.Join(sw.dir, filepath.FromSlash(sw.name))
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	sw.f = f
+	return err
+}
+
+// Write writes to the content of the current entry: the file of a regular
+// file, or the target of a symlink.
+func (sw *SpecWriter) Write(b []byte) (int, error) {
+	if sw.closed {
+		return 0, fmt.Errorf("cpio: write to closed writer")
+	}
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	switch {
+	case sw.f != nil:
+		n, err := sw.f.Write(b)
+		if err != nil {
+			sw.err = err
+		}
+		return n, err
+	case sw.hdr != nil && sw.hdr.Mode&0xf000 == s_IFLNK:
+		sw.link = append(sw.link, b...)
+	}
+	return len(b), nil
+}
+
+// finish writes the line of the current entry.
+func (sw *SpecWriter) finish() error {
+	h := sw.hdr
+	if h == nil {
+		return nil
+	}
+	sw.hdr = nil
+	perm := h.Mode & 07777
+	switch h.Mode & 0xf000 {
+	case s_IFREG:
+		if l := sw.linkOf(h); l != nil {
+			l.names = append(l.names, sw.name)
+			return nil
+		}
+		location := sw.f.Name()
+		err := sw.f.Close()
+		sw.f = nil
+		if err != nil {
+			return err
+		}
+		if err := os.Chtimes(location, h.ModTime, h.ModTime); err != nil {
+			return err
+		}
+		line := fmt.Sprintf("file %s %s %o %d %d", sw.name, location, perm, h.Uid, h.Gid)
+		if h.Links > 1 {
+			sw.linked[h.Inode] = &linkedSpec{line: line}
+			sw.linkOrder = append(sw.linkOrder, h.Inode)
+			return nil
+		}
+		fmt.Fprintln(sw.list, line)
+	case s_IFDIR:
+		fmt.Fprintf(sw.list, "dir %s %o %d %d\n", sw.name, perm, h.Uid, h.Gid)
+	case s_IFLNK:
+		target := string(sw.link)
+		sw.link = sw.link[:0]
+		if target == "" || strings.ContainsAny(target, " \t\n\r\v\f") {
+			return fmt.Errorf("cpio: gen_init_cpio can't hold the target %q of %q", target, sw.name)
+		}
+		fmt.Fprintf(sw.list, "slink %s %s %o %d %d\n", sw.name, target, perm, h.Uid, h.Gid)
+	case s_IFCHR, s_IFBLK:
+		kind := "c"
+		if h.Mode&0xf000 == s_IFBLK {
+			kind = "b"
+		}
+		fmt.Fprintf(sw.list, "nod %s %o %d %d %s %d %d\n", sw.name, perm, h.Uid, h.Gid, kind, h.RdevMajor, h.RdevMinor)
+	case s_IFIFO:
+		fmt.Fprintf(sw.list, "pipe %s %o %d %d\n", sw.name, perm, h.Uid, h.Gid)
+	case s_IFSOCK:
+		fmt.Fprintf(sw.list, "sock %s %o %d %d\n", sw.name, perm, h.Uid, h.Gid)
+	default:
+		return fmt.Errorf("cpio: %q has unknown mode %o", sw.name, h.Mode)
+	}
+	return nil
+}
+
+// Close finishes the last entry, writes the lines of files with hard links,
+// and flushes the description. It does not close the underlying writer.
+func (sw *SpecWriter) Close() error {
+	if sw.closed {
+		return sw.err
+	}
+	sw.closed = true
+	if sw.err == nil {
+		sw.err = sw.finish()
+	}
+	if sw.f != nil {
+		sw.f.Close()
+	}
+	for _, ino := range sw.linkOrder {
+		l := sw.linked[ino]
+		fmt.Fprintln(sw.list, strings.Join(append([]string{l.line}, l.names...), " "))
+	}
+	if sw.err == nil {
+		sw.err = sw.list.Flush()
+	}
+	return sw.err
+}
@@ -0,0 +1,44 @@
+package cpio_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/cpio"
+)
+
+func TestSpecWriterHardLinks(t *testing.T) {
+	dir := t.TempDir()
+	var list strings.Builder
+	sw, err := cpio.NewSpecWriter(&list, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []entry{
+		{cpio.Header{Name: "bin", Mode: 0o40755, Links: 2, Inode: 1}, ""},
+		{cpio.Header{Name: "bin/busybox", Mode: 0o100755, Links: 3, Inode: 2, Size: 2}, "BB"},
+		{cpio.Header{Name: "bin/sh", Mode: 0o100755, Links: 3, Inode: 2}, ""},
+		file("etc", ""),
+		{cpio.Header{Name: "bin/ls", Mode: 0o100755, Links: 3, Inode: 2}, ""},
+	}
+	for _, e := range entries {
+		if err := sw.WriteHeader(&e.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	abs, _ := filepath.Abs(dir)
+	want := "# gen_init_cpio description; content is below " + abs + "\n" +
+		"dir /bin 755 0 0\n" +
+		"file /etc " + filepath.Join(abs, "etc") + " 644 0 0\n" +
+		"file /bin/busybox " + filepath.Join(abs, "bin/busybox") + " 755 0 0 /bin/sh /bin/ls\n"
+	if got := list.String(); got != want {
+		t.Errorf("description is\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,156 @@
+package cpio
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"hash/fnv"
+	"path"
+	"strings"
+)
+
+// InodeAllocator assigns the inode numbers of an archive's entries for
+// HeaderFromTar. Extractors take regular files sharing a number for hard
+// links of each other, so an allocator must not give out a number twice,
+// but to the hard links of a file: a TypeLink entry gets the number of the
+// file it names, which must have come before it with a SCHILY.nlink PAX
+// record above one, as oci.WithHardLinks gives them.
+type InodeAllocator interface {
+	// Inode returns the number of the entry th. For regular files, sum is
+	// the SHA-256 of the content if WantsContent reports true, and nil
+	// otherwise; for other entries it is nil.
+	Inode(th *tar.Header, sum []byte) int
+	// WantsContent reports whether Inode uses the sum of regular files,
+	// which means hashing each before its header is written.
+	WantsContent() bool
+}
+
+// SequentialInodes numbers entries in the order they are written, from
+// first. An entry's number then changes whenever one is added or removed
+// before it.
+func SequentialInodes(first int) InodeAllocator {
+	return &sequentialInodes{next: first, links: make(linkedInodes)}
+}
+
+type sequentialInodes struct {
+	next  int
+	links linkedInodes
+}
+
+func (a *sequentialInodes) Inode(th *tar.Header, _ []byte) int {
+	if n, ok := a.links.of(th); ok {
+		return n
+	}
+	a.next++
+	return a.links.add(th, a.next-1)
+}
+
+func (a *sequentialInodes) WantsContent() bool { return false }
+
+// PathHashInodes numbers entries by a hash of their path, so that an
+// entry keeps its number across builds however the others change. A
+// number already taken, which is rare, goes to the next free one.
+func PathHashInodes() InodeAllocator {
+	return &hashInodes{used: make(map[uint32]bool), links: make(linkedInodes)}
+}
+
+// ContentHashInodes numbers regular files by a hash of their content, and
+// other entries by a hash of their path, so that a file keeps its number
+// when it moves. Files with the same content get consecutive free numbers,
+// in the order they are written.
+func ContentHashInodes() InodeAllocator {
+	return &hashInodes{content: true, used: make(map[uint32]bool), links: make(linkedInodes)}
+}
+
+type hashInodes struct {
+	content bool
+	used    map[uint32]bool
+	links   linkedInodes
+}
+
+func (a *hashInodes) Inode(th *tar.Header, sum []byte) int {
+	if n, ok := a.links.of(th); ok {
+		return n
+	}
+	var n uint32
+	if a.content && len(sum) >= 4 {
+		n = binary.BigEndian.Uint32(sum)
+	} else {
+		h := fnv.New32a()
+		h.Write([]byte(inodePath(th.Name)))
+		n = h.Sum32()
+	}
+	// 0 is left out, as some extractors take it for no inode.
+	for n == 0 || a.used[n] {
+		n++
+	}
+	a.used[n] = true
+	return a.links.add(th, int(n))
+}
+
+func (a *hashInodes) WantsContent() bool { return a.content }
+
+// linkedInodes are the numbers of the files with hard links, by path.
+type linkedInodes map[string]int
+
+// of returns the number of the file that th, if it is a hard link, names.
+func (l linkedInodes) of(th *tar.Header) (int, bool) {
+	if th.Typeflag != tar.TypeLink {
+		return 0, false
+	}
+	n, ok := l[inodePath(th.Linkname)]
+	return n, ok
+}
+
+// add remembers n as the number of th, if it has hard links, and returns
+// it.
+func (l linkedInodes) add(th *tar.Header, n int) int {
+	if th.Typeflag != tar.TypeLink && linkCount(th) > 1 {
+		l[inodePath(th.Name)] = n
+	}
+	return n
+}
+
+// inodePath spells name the same however HeaderFromTar is told to.
+func inodePath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// InodeMap numbers the entries whose paths are keys of m, and their hard
+// links, as m says, for example to match the numbers of an earlier
+// archive, and the others as rest does, skipping the numbers of m. m must
+// not give two paths the same number.
+func InodeMap(m map[string]int, rest InodeAllocator) InodeAllocator {
+	a := &mapInodes{paths: make(map[string]int, len(m)), taken: make(map[int]bool, len(m)), rest: rest}
+	for p, n := range m {
+		a.paths[inodePath(p)] = n
+		a.taken[n] = true
+	}
+	return a
+}
+
+type mapInodes struct {
+	paths map[string]int
+	taken map[int]bool
+	rest  InodeAllocator
+}
+
+func (a *mapInodes) Inode(th *tar.Header, sum []byte) int {
+	p := th.Name
+	if th.Typeflag == tar.TypeLink {
+		p = th.Linkname // rest numbers it if the file isn't in m
+	}
+	if n, ok := a.paths[inodePath(p)]; ok {
+		return n
+	}
+	for {
+		if n := a.rest.Inode(th, sum); !a.taken[n] {
+			return n
+		}
+	}
+}
+
+func (a *mapInodes) WantsContent() bool { return a.rest.WantsContent() }
@@ -0,0 +1,34 @@
+package cpio_test
+
+import (
+	"archive/tar"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/cpio"
+)
+
+func TestInodesOfHardLinks(t *testing.T) {
+	allocators := map[string]func() cpio.InodeAllocator{
+		"sequential":   func() cpio.InodeAllocator { return cpio.SequentialInodes(1) },
+		"path-hash":    cpio.PathHashInodes,
+		"content-hash": cpio.ContentHashInodes,
+		"map": func() cpio.InodeAllocator {
+			return cpio.InodeMap(map[string]int{"bin/busybox": 7}, cpio.SequentialInodes(1))
+		},
+	}
+	nlink := map[string]string{"SCHILY.nlink": "3"}
+	for name, newAllocator := range allocators {
+		a := newAllocator()
+		dir := a.Inode(&tar.Header{Name: "bin", Typeflag: tar.TypeDir}, nil)
+		file := a.Inode(&tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, PAXRecords: nlink}, []byte("sum of BB"))
+		other := a.Inode(&tar.Header{Name: "bin/true", Typeflag: tar.TypeReg}, []byte("sum of BB"))
+		for _, l := range []string{"bin/sh", "./bin/ls"} {
+			if n := a.Inode(&tar.Header{Name: l, Typeflag: tar.TypeLink, Linkname: "bin/busybox"}, nil); n != file {
+				t.Errorf("%s: link %s is inode %d, want that of its file, %d", name, l, n, file)
+			}
+		}
+		if dir == file || other == file {
+			t.Errorf("%s: inodes %d, %d, %d aren't distinct", name, dir, file, other)
+		}
+	}
+}
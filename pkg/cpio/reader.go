@@ -0,0 +1,256 @@
+package cpio
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"strconv"
+	"time"
+)
+
+// magicCRC is the magic of the newc variant with a checksum of the content,
+// which readers may ignore.
+const magicCRC = "070702"
+
+// ErrHeader is returned when an archive has an invalid header.
+var ErrHeader = errors.New("cpio: invalid header")
+
+// headerError is an ErrHeader at an offset.
+type headerError struct {
+	off int64
+	msg string
+}
+
+func (e *headerError) Error() string {
+	return fmt.Sprintf("%v at offset %d: %s", ErrHeader, e.off, e.msg)
+}
+
+func (e *headerError) Unwrap() error { return ErrHeader }
+
+// trailerName is the name of the entry that ends an archive.
+const trailerName = "TRAILER!!!"
+
+// Reader provides sequential access to the entries of a newc archive.
+//
+// Like the kernel, Reader carries on into archives concatenated after the
+// first one's trailer, skipping the zero padding between them, so the
+// volumes of a VolumeWriter read as one archive.
+type Reader struct {
+	r   *bufio.Reader
+	err error
+	off int64 // bytes consumed from r
+
+	remaining int64 // unread content of the current entry
+	pad       int64 // padding after the current entry's content
+
+	// warn, if set, is told of the irregularities that Reader tolerates,
+	// with the offset they are at.
+	warn func(off int64, msg string)
+}
+
+// NewReader creates a new Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Offset returns the offset in the input of the next byte to be read.
+func (tr *Reader) Offset() int64 {
+	return tr.off
+}
+
+// Next advances to the next entry and returns its header. It returns
+// io.EOF after the trailer of the last archive.
+func (tr *Reader) Next() (*Header, error) {
+	if tr.err != nil {
+		return nil, tr.err
+	}
+	hdr, err := tr.next()
+	if err != nil {
+		tr.err = err
+	}
+	return hdr, err
+}
+
+// Entries returns an iterator over the entries Next returns, each with
+// the reader of its content, which is valid until the iteration advances.
+// The iteration stops after the last entry or at the first error, which
+// Err then returns.
+func (tr *Reader) Entries() iter.Seq2[*Header, io.Reader] {
+	return func(yield func(*Header, io.Reader) bool) {
+		for {
+			hdr, err := tr.Next()
+			if err != nil || !yield(hdr, tr) {
+				return
+			}
+		}
+	}
+}
+
+// Err returns the error that stopped an iteration of Entries, or nil if it
+// reached the end of the archive.
+func (tr *Reader) Err() error {
+	if tr.err == io.EOF {
+		return nil
+	}
+	return tr.err
+}
+
+func (tr *Reader) next() (*Header, error) {
+	if err := tr.skip(tr.remaining); err != nil {
+		return nil, err
+	}
+	if err := tr.skipPadding(); err != nil {
+		return nil, err
+	}
+	tr.remaining, tr.pad = 0, 0
+	for {
+		hdr, err := tr.readHeader()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name != trailerName {
+			return hdr, nil
+		}
+		// Skip the padding up to the next archive, if there is one.
+		for {
+			b, err := tr.r.Peek(1)
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			if err != nil {
+				return nil, err
+			}
+			if b[0] != 0 {
+				break
+			}
+			tr.r.Discard(1)
+			tr.off++
+		}
+		if tr.off%4 != 0 && tr.warn != nil {
+			tr.warn(tr.off, "concatenated archive does not start at a multiple of 4 bytes")
+		}
+	}
+}
+
+func (tr *Reader) readHeader() (*Header, error) {
+	start := tr.off
+	var raw [110]byte
+	if err := tr.readFull(raw[:]); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("cpio: archive ends without a trailer")
+		}
+		return nil, err
+	}
+	if m := string(raw[:6]); m != magicNewc && m != magicCRC {
+		return nil, &headerError{start, fmt.Sprintf("bad magic %q", m)}
+	}
+	var f [13]int64
+	for i := range f {
+		v, err := strconv.ParseUint(string(raw[6+8*i:14+8*i]), 16, 32)
+		if err != nil {
+			return nil, &headerError{start, fmt.Sprintf("field %d is %q", i, raw[6+8*i:14+8*i])}
+		}
+		f[i] = int64(v)
+	}
+	nameSize := f[11]
+	if nameSize == 0 || nameSize > 1<<20 {
+		return nil, &headerError{start, fmt.Sprintf("name size %d", nameSize)}
+	}
+	name := make([]byte, nameSize+(align4(110+nameSize)-110-nameSize))
+	if err := tr.readFull(name); err != nil {
+		return nil, noEOF(err)
+	}
+	if name[nameSize-1] != 0 {
+		return nil, &headerError{start, "name is not NUL-terminated"}
+	}
+	if tr.warn != nil {
+		for _, c := range name[nameSize:] {
+			if c != 0 {
+				tr.warn(start+110+nameSize, "padding after the name is not zero")
+				break
+			}
+		}
+	}
+	hdr := &Header{
+		Inode:     int(f[0]),
+		Mode:      f[1],
+		Uid:       int(f[2]),
+		Gid:       int(f[3]),
+		Links:     int(f[4]),
+		ModTime:   time.Unix(f[5], 0),
+		Size:      f[6],
+		DevMajor:  int(f[7]),
+		DevMinor:  int(f[8]),
+		RdevMajor: int(f[9]),
+		RdevMinor: int(f[10]),
+		Name:      string(name[:nameSize-1]),
+	}
+	tr.remaining = hdr.Size
+	tr.pad = align4(hdr.Size) - hdr.Size
+	return hdr, nil
+}
+
+// Read reads from the content of the current entry. It returns io.EOF at
+// the end of the content.
+func (tr *Reader) Read(b []byte) (int, error) {
+	if tr.err != nil {
+		return 0, tr.err
+	}
+	if tr.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > tr.remaining {
+		b = b[:tr.remaining]
+	}
+	n, err := tr.r.Read(b)
+	tr.off += int64(n)
+	tr.remaining -= int64(n)
+	if err == io.EOF && tr.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		tr.err = err
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (tr *Reader) readFull(b []byte) error {
+	n, err := io.ReadFull(tr.r, b)
+	tr.off += int64(n)
+	return err
+}
+
+func (tr *Reader) skip(n int64) error {
+	m, err := tr.r.Discard(int(n))
+	tr.off += int64(m)
+	return noEOF(err)
+}
+
+// skipPadding skips the padding after the current entry, which should be
+// zeros.
+func (tr *Reader) skipPadding() error {
+	if tr.warn == nil {
+		return tr.skip(tr.pad)
+	}
+	var b [4]byte
+	off := tr.off
+	if err := tr.readFull(b[:tr.pad]); err != nil {
+		return noEOF(err)
+	}
+	if b != [4]byte{} {
+		tr.warn(off, "padding is not zero")
+	}
+	return nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package cpio_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hxtk/ember/pkg/cpio"
+)
+
+// every is an entry of each type, with every field of the header set and
+// names and content of lengths that need each amount of padding.
+func every() []entry {
+	mtime := time.Unix(1700000000, 0)
+	hdr := func(name string, mode int64, size int) cpio.Header {
+		return cpio.Header{
+			Name: name, Mode: mode, Uid: 1000, Gid: 100, Size: int64(size), ModTime: mtime,
+			DevMajor: 8, DevMinor: 1, Links: 1,
+		}
+	}
+	dev := hdr("dev/sda", 0o060660, 0)
+	dev.RdevMajor, dev.RdevMinor = 8, 0
+	dir := hdr("etc", 0o040755, 0)
+	dir.Links = 2
+	return []entry{
+		{dir, ""},
+		{hdr("etc/hostname", 0o100644, 5), "host\n"},
+		{hdr("etc/a", 0o100600, 1), "x"},
+		{hdr("etc/ab", 0o100600, 2), "xy"},
+		{hdr("etc/abc", 0o104755, 3), "xyz"},
+		{hdr("bin/sh", 0o120777, 7), "busybox"},
+		{dev, ""},
+		{hdr("run/initctl", 0o010600, 0), ""},
+		{hdr(strings.Repeat("long/", 60)+"name", 0o100644, 0), ""},
+	}
+}
+
+func TestReaderRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	write(t, cpio.NewWriter(&buf), every())
+
+	tr := cpio.NewReader(&buf)
+	for i, want := range every() {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("entry %d: %v", i, err)
+		}
+		want.hdr.Inode = i + 1
+		if !hdr.ModTime.Equal(want.hdr.ModTime) {
+			t.Errorf("%s: mtime %v, want %v", hdr.Name, hdr.ModTime, want.hdr.ModTime)
+		}
+		hdr.ModTime = want.hdr.ModTime
+		if *hdr != want.hdr {
+			t.Errorf("header\n\t%+v\nwant\n\t%+v", *hdr, want.hdr)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want.content {
+			t.Errorf("%s: content %q, want %q", hdr.Name, b, want.content)
+		}
+	}
+	if hdr, err := tr.Next(); err != io.EOF {
+		t.Errorf("Next() after the entries = %v, %v, want EOF", hdr, err)
+	}
+}
+
+func TestReaderRejectsCorrupt(t *testing.T) {
+	var buf bytes.Buffer
+	write(t, cpio.NewWriter(&buf), every())
+	b := buf.Bytes()
+	b[0] = 'x' // the magic
+	if _, err := cpio.NewReader(bytes.NewReader(b)).Next(); err == nil {
+		t.Error("Next() of a corrupt header succeeded")
+	}
+}
+
+func TestReaderTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	write(t, cpio.NewWriter(&buf), every())
+	tr := cpio.NewReader(bytes.NewReader(buf.Bytes()[:200]))
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			t.Fatal("a truncated archive read to its end")
+		}
+		if err != nil {
+			return
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return
+		}
+	}
+}
@@ -2,32 +2,55 @@ package cpio
 
 import (
 	"archive/tar"
+	"strconv"
+	"strings"
 )
 
 // Standard Unix file type bits (S_IFMT)
 const (
-	s_IFLNK = 0xa000
-	s_IFREG = 0x8000
-	s_IFBLK = 0x6000
-	s_IFDIR = 0x4000
-	s_IFCHR = 0x2000
-	s_IFIFO = 0x1000
+	s_IFSOCK = 0xc000
+	s_IFLNK  = 0xa000
+	s_IFREG  = 0x8000
+	s_IFBLK  = 0x6000
+	s_IFDIR  = 0x4000
+	s_IFCHR  = 0x2000
+	s_IFIFO  = 0x1000
 )
 
+// NameOption changes how HeaderFromTar spells entry names.
+type NameOption func(*nameOptions)
+
+type nameOptions struct {
+	dotPrefix bool
+	dirSlash  bool
+}
+
+// WithDotPrefix starts every name with ./, as find . | cpio writes them,
+// dropping any leading slashes; the root directory is named ".".
+func WithDotPrefix() NameOption {
+	return func(o *nameOptions) { o.dotPrefix = true }
+}
+
+// WithDirSlash ends the names of directories with a slash.
+func WithDirSlash() NameOption {
+	return func(o *nameOptions) { o.dirSlash = true }
+}
+
 // HeaderFromTar converts a tar.Header to a cpio.Header.
 // It maps the file mode, ownership, and device numbers.
 // Note: CPIO 'newc' format handles file names differently (no separate prefix),
-// so this joins the Name to the Header.
-func HeaderFromTar(th *tar.Header, inode int) *Header {
+// so this joins the Name to the Header. The name is kept as tar has it
+// unless opts say otherwise. inode is usually from an InodeAllocator. The
+// link count is 2 for directories, and for regular files and hard links
+// that of their SCHILY.nlink PAX record, if they have one.
+func HeaderFromTar(th *tar.Header, inode int, opts ...NameOption) *Header {
 	// 1. Basic Fields
 	h := &Header{
-		Name:     th.Name,
-		Uid:      th.Uid,
-		Gid:      th.Gid,
-		Size:     th.Size,
-		ModTime:  th.ModTime,
-		DevMajor: int(th.Devmajor),
-		DevMinor: int(th.Devminor),
+		Name:    entryName(th, opts),
+		Uid:     th.Uid,
+		Gid:     th.Gid,
+		Size:    th.Size,
+		ModTime: th.ModTime,
 	}
 
 	// 2. Translate File Type (Typeflag -> Mode bits)
@@ -46,17 +69,21 @@ func HeaderFromTar(th *tar.Header, inode int) *Header {
 	case tar.TypeChar:
 		mode |= s_IFCHR
 		h.Size = 0 // Device files have 0 size
+		// The kernel makes the node from the rdev fields; the dev fields
+		// are of the file system holding the entry, which has none.
+		h.RdevMajor, h.RdevMinor = int(th.Devmajor), int(th.Devminor)
 	case tar.TypeBlock:
 		mode |= s_IFBLK
 		h.Size = 0
+		h.RdevMajor, h.RdevMinor = int(th.Devmajor), int(th.Devminor)
 	case tar.TypeFifo:
 		mode |= s_IFIFO
 		h.Size = 0
 	case tar.TypeReg, tar.TypeRegA:
 		mode |= s_IFREG
 	// Hard links are special in Tar (they share content).
-	// In CPIO, they are just files with the same Inode number.
-	// You must handle inode mapping externally if you want true hard links.
+	// In CPIO, they are just files with the same Inode number, which
+	// the InodeAllocators give them.
 	case tar.TypeLink:
 		mode |= s_IFREG
 		h.Size = 0 // Hard links in tar usually have size 0 in the header
@@ -76,6 +103,96 @@ func HeaderFromTar(th *tar.Header, inode int) *Header {
 	// or let the caller assign a unique one.
 	// Using a simple hash or counter is common if th.Xattrs["inode"] is missing.
 	h.Inode = inode
+	h.Links = linkCount(th)
 
 	return h
 }
+
+// nlinkRecord is the PAX record giving the link count of an entry, as star
+// and oci.WithHardLinks write it.
+const nlinkRecord = "SCHILY.nlink"
+
+// linkCount returns the link count of th: 2 for a directory, that of its
+// nlinkRecord for a regular file or hard link with one, and 1 otherwise.
+func linkCount(th *tar.Header) int {
+	switch th.Typeflag {
+	case tar.TypeDir:
+		return 2
+	case tar.TypeReg, tar.TypeRegA, tar.TypeLink:
+		if n, err := strconv.Atoi(th.PAXRecords[nlinkRecord]); err == nil && n > 1 {
+			return n
+		}
+	}
+	return 1
+}
+
+// entryName spells the name of th as opts say.
+func entryName(th *tar.Header, opts []NameOption) string {
+	if len(opts) == 0 {
+		return th.Name
+	}
+	var o nameOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	name := th.Name
+	if o.dotPrefix {
+		name = strings.TrimLeft(strings.TrimPrefix(strings.TrimLeft(name, "/"), "./"), "/")
+		if name == "" || name == "." {
+			name = "."
+		} else {
+			name = "./" + name
+		}
+	}
+	if o.dirSlash && th.Typeflag == tar.TypeDir && name != "." && !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	return name
+}
+
+// TarHeader converts a cpio.Header to a tar.Header, reversing
+// HeaderFromTar. The content of a symlink entry is its target, which the
+// caller reads and stores in Linkname; the returned header has Size 0.
+// Device numbers are taken from the rdev fields, where newc keeps them,
+// or from the dev fields if those are unset, as in archives earlier
+// versions of HeaderFromTar produced. Hard links are left to the caller, which can recognise them
+// by their shared inode. Sockets, which tar can't hold, give nil.
+func TarHeader(h *Header) *tar.Header {
+	if h.Mode&0xf000 == s_IFSOCK {
+		return nil
+	}
+	th := &tar.Header{
+		Name:    h.Name,
+		Mode:    h.Mode & 07777,
+		Uid:     h.Uid,
+		Gid:     h.Gid,
+		Size:    h.Size,
+		ModTime: h.ModTime,
+	}
+	major, minor := h.RdevMajor, h.RdevMinor
+	if major == 0 && minor == 0 {
+		major, minor = h.DevMajor, h.DevMinor
+	}
+	switch h.Mode & 0xf000 {
+	case s_IFDIR:
+		th.Typeflag = tar.TypeDir
+		th.Size = 0
+	case s_IFLNK:
+		th.Typeflag = tar.TypeSymlink
+		th.Size = 0
+	case s_IFCHR:
+		th.Typeflag = tar.TypeChar
+		th.Devmajor, th.Devminor = int64(major), int64(minor)
+		th.Size = 0
+	case s_IFBLK:
+		th.Typeflag = tar.TypeBlock
+		th.Devmajor, th.Devminor = int64(major), int64(minor)
+		th.Size = 0
+	case s_IFIFO:
+		th.Typeflag = tar.TypeFifo
+		th.Size = 0
+	default:
+		th.Typeflag = tar.TypeReg
+	}
+	return th
+}
@@ -0,0 +1,119 @@
+package cpio_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hxtk/ember/pkg/cpio"
+)
+
+func TestTarHeaderRoundTrip(t *testing.T) {
+	mtime := time.Unix(1700000000, 0)
+	for _, th := range []tar.Header{
+		{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, Uid: 1, Gid: 2, Size: 5, ModTime: mtime},
+		{Typeflag: tar.TypeReg, Name: "bin/su", Mode: 0o4755, Size: 3, ModTime: mtime},
+		{Typeflag: tar.TypeDir, Name: "etc", Mode: 0o755, ModTime: mtime},
+		{Typeflag: tar.TypeSymlink, Name: "bin/sh", Linkname: "busybox", Mode: 0o777, ModTime: mtime},
+		{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3, ModTime: mtime},
+		{Typeflag: tar.TypeBlock, Name: "dev/sda", Mode: 0o660, Devmajor: 8, ModTime: mtime},
+		{Typeflag: tar.TypeFifo, Name: "run/initctl", Mode: 0o600, ModTime: mtime},
+	} {
+		got := cpio.TarHeader(cpio.HeaderFromTar(&th, 1))
+		want := th
+		want.Linkname = "" // the content of the cpio entry, for the caller
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("round trip of\n\t%+v\ngave\n\t%+v", th, *got)
+		}
+	}
+}
+
+func TestHeaderFromTarLinkCount(t *testing.T) {
+	for _, tc := range []struct {
+		th   tar.Header
+		want int
+	}{
+		{tar.Header{Typeflag: tar.TypeReg, Name: "a"}, 1},
+		{tar.Header{Typeflag: tar.TypeDir, Name: "d"}, 2},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "a", PAXRecords: map[string]string{"SCHILY.nlink": "3"}}, 3},
+		{tar.Header{Typeflag: tar.TypeLink, Name: "b", Linkname: "a", PAXRecords: map[string]string{"SCHILY.nlink": "3"}}, 3},
+		{tar.Header{Typeflag: tar.TypeSymlink, Name: "l", PAXRecords: map[string]string{"SCHILY.nlink": "3"}}, 1},
+	} {
+		if got := cpio.HeaderFromTar(&tc.th, 1).Links; got != tc.want {
+			t.Errorf("HeaderFromTar(%s %c).Links = %d, want %d", tc.th.Name, tc.th.Typeflag, got, tc.want)
+		}
+	}
+}
+
+func TestToTar(t *testing.T) {
+	var buf bytes.Buffer
+	tw := cpio.NewWriter(&buf)
+	for _, e := range []struct {
+		hdr     cpio.Header
+		content string
+	}{
+		{cpio.Header{Name: "bin", Mode: 0o040755, Links: 2, Inode: 1}, ""},
+		{cpio.Header{Name: "bin/busybox", Mode: 0o100755, Links: 2, Inode: 2, Size: 2}, "BB"},
+		{cpio.Header{Name: "bin/sh", Mode: 0o100755, Links: 2, Inode: 2}, ""},
+		{cpio.Header{Name: "bin/ls", Mode: 0o120777, Links: 1, Inode: 3, Size: 7}, "busybox"},
+		{cpio.Header{Name: "run/sock", Mode: 0o140755, Links: 1, Inode: 4}, ""},
+	} {
+		if err := tw.WriteHeader(&e.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, e.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	w := tar.NewWriter(&out)
+	skipped, err := cpio.ToTar(w, cpio.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 1 {
+		t.Errorf("skipped %d entries, want the socket", skipped)
+	}
+
+	var got []string
+	tr := tar.NewReader(&out)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(tr)
+		got = append(got, string(th.Typeflag)+" "+th.Name+" "+th.Linkname+" "+string(b))
+	}
+	checkLines(t, got, []string{
+		"5 bin  ",
+		"0 bin/busybox  BB",
+		"1 bin/sh bin/busybox ",
+		"2 bin/ls busybox ",
+	})
+}
+
+func checkLines(t *testing.T, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("line %d is %q, want %q", i, got[i], want[i])
+		}
+	}
+}
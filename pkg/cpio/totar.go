@@ -0,0 +1,111 @@
+package cpio
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxLinkTarget bounds the symlink targets ToTar reads, as PATH_MAX does.
+const maxLinkTarget = 4096
+
+// ToTar writes the entries of the newc archive r to tw, converting their
+// headers with TarHeader, and returns the number of sockets it skipped.
+//
+// Regular files that share an inode become tar hard links to the entry
+// holding their content. Archivers differ in which of the entries for an
+// inode carries the content, GNU cpio putting it on the last, so names
+// seen before it are written empty and then again as links, which
+// extraction resolves in the archive's favour.
+func ToTar(tw *tar.Writer, r *Reader) (int, error) {
+	type inode struct {
+		name  string      // the entry with the content
+		empty []string    // names written before it
+		first *tar.Header // the first entry
+	}
+	inodes := make(map[[3]int]*inode)
+	var order []*inode // inodes in archive order, for deterministic output
+	skipped := 0
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return skipped, err
+		}
+		th := TarHeader(hdr)
+		if th == nil {
+			skipped++
+			continue
+		}
+		th.Name = strings.TrimPrefix(th.Name, "/")
+		if th.Name == "." || th.Name == "" {
+			continue
+		}
+		if th.Typeflag == tar.TypeSymlink {
+			if hdr.Size > maxLinkTarget {
+				return skipped, fmt.Errorf("cpio: symlink %q has a %d-byte target", hdr.Name, hdr.Size)
+			}
+			b := make([]byte, hdr.Size)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return skipped, err
+			}
+			th.Linkname = string(b)
+		}
+
+		var in *inode
+		if th.Typeflag == tar.TypeReg && hdr.Links > 1 {
+			key := [3]int{hdr.DevMajor, hdr.DevMinor, hdr.Inode}
+			if in = inodes[key]; in == nil {
+				in = &inode{first: th}
+				inodes[key] = in
+				order = append(order, in)
+			} else if in.name != "" {
+				th.Typeflag, th.Linkname, th.Size = tar.TypeLink, in.name, 0
+			}
+		}
+		if err := tw.WriteHeader(th); err != nil {
+			return skipped, err
+		}
+		if th.Size > 0 {
+			if _, err := io.Copy(tw, r); err != nil {
+				return skipped, err
+			}
+		}
+		if in == nil || th.Typeflag == tar.TypeLink {
+			continue
+		}
+		if th.Size == 0 {
+			in.empty = append(in.empty, th.Name)
+			continue
+		}
+		in.name = th.Name
+		if err := writeLinks(tw, th, in.empty); err != nil {
+			return skipped, err
+		}
+		in.empty = nil
+	}
+
+	// Inodes that never had content are empty files linked together.
+	for _, in := range order {
+		if in.name == "" && len(in.empty) > 1 {
+			if err := writeLinks(tw, in.first, in.empty[1:]); err != nil {
+				return skipped, err
+			}
+		}
+	}
+	return skipped, nil
+}
+
+// writeLinks writes names as hard links to the entry th.
+func writeLinks(tw *tar.Writer, th *tar.Header, names []string) error {
+	for _, n := range names {
+		link := &tar.Header{Typeflag: tar.TypeLink, Name: n, Linkname: th.Name, Mode: th.Mode, Uid: th.Uid, Gid: th.Gid, ModTime: th.ModTime}
+		if err := tw.WriteHeader(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
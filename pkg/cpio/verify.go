@@ -0,0 +1,210 @@
+package cpio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// pathMax is the kernel's PATH_MAX, which bounds names and symlink targets
+// including their NUL terminator.
+const pathMax = 4096
+
+// Problem is an irregularity Verify found in an archive.
+type Problem struct {
+	Offset int64  // of the entry's header, or of the bytes at fault
+	Name   string // of the entry, if there is one
+	Msg    string
+}
+
+func (p Problem) String() string {
+	if p.Name == "" {
+		return fmt.Sprintf("offset %d: %s", p.Offset, p.Msg)
+	}
+	return fmt.Sprintf("offset %d: %q: %s", p.Offset, p.Name, p.Msg)
+}
+
+// Verification is the result of Verify.
+type Verification struct {
+	Entries  int // entries read, not counting trailers
+	Problems []Problem
+}
+
+// OK reports whether Verify found no problems.
+func (v *Verification) OK() bool { return len(v.Problems) == 0 }
+
+// Verify reads the newc archive r, and any archives concatenated to it, and
+// checks what the kernel and other extractors rely on:
+//
+//   - headers are well-formed and 4-byte aligned, and the archive ends in a
+//     trailer;
+//   - the padding after names and contents is zero;
+//   - names are relative, free of empty, "." and ".." components, shorter
+//     than PATH_MAX, and come after their parent directory;
+//   - no name appears twice;
+//   - only regular files and symlinks have content, and symlink targets fit
+//     in PATH_MAX;
+//   - entries sharing an inode are regular files with nlink above one that
+//     agree on mode, owner and link count, number no more than that count,
+//     and carry the content at most once.
+//
+// Verify stops at the first malformed header, which it reports as the last
+// problem; a misaligned header usually means that the entry before it was
+// padded wrongly.
+func Verify(r io.Reader) *Verification {
+	v := &Verification{}
+	tr := NewReader(r)
+	tr.warn = func(off int64, msg string) {
+		v.Problems = append(v.Problems, Problem{Offset: off, Msg: msg})
+	}
+
+	type inode struct {
+		first   *Header
+		off     int64 // of the first entry
+		entries int
+		content int // entries with content
+	}
+	inodes := make(map[[3]int]*inode)
+	var order []*inode
+	names := make(map[string]int64)
+	dirs := map[string]bool{".": true}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			p := Problem{Offset: tr.Offset(), Msg: err.Error()}
+			var he *headerError
+			if errors.As(err, &he) {
+				p = Problem{Offset: he.off, Msg: "invalid header: " + he.msg}
+			}
+			v.Problems = append(v.Problems, p)
+			break
+		}
+		v.Entries++
+		off := tr.Offset() - align4(int64(110+len(hdr.Name)+1))
+		problem := func(format string, args ...any) {
+			v.Problems = append(v.Problems, Problem{Offset: off, Name: hdr.Name, Msg: fmt.Sprintf(format, args...)})
+		}
+
+		raw := hdr.Name
+		if hdr.Mode&0xf000 == s_IFDIR && len(raw) > 1 {
+			raw = strings.TrimSuffix(raw, "/") // as WithDirSlash writes them
+		}
+		name, msg := checkName(raw)
+		if msg != "" {
+			problem("%s", msg)
+		}
+		if prev, ok := names[name]; ok {
+			problem("duplicate of the entry at offset %d", prev)
+		} else {
+			names[name] = off
+		}
+		if dir := path.Dir(name); !dirs[dir] {
+			if prev, ok := names[dir]; ok {
+				problem("its parent %q, at offset %d, is not a directory", dir, prev)
+			} else {
+				problem("its directory %q does not come before it", dir)
+			}
+		}
+
+		mode := hdr.Mode & 0xf000
+		switch mode {
+		case s_IFDIR:
+			dirs[name] = true
+			fallthrough
+		case s_IFCHR, s_IFBLK, s_IFIFO, s_IFSOCK:
+			if hdr.Size != 0 {
+				problem("a %s with %d bytes of content", typeName(mode), hdr.Size)
+			}
+		case s_IFLNK:
+			if hdr.Size == 0 || hdr.Size >= pathMax {
+				problem("symlink target of %d bytes", hdr.Size)
+			}
+		case s_IFREG:
+		default:
+			problem("unknown file type %#o", mode)
+		}
+
+		key := [3]int{hdr.DevMajor, hdr.DevMinor, hdr.Inode}
+		in := inodes[key]
+		if in == nil {
+			in = &inode{first: hdr, off: off}
+			inodes[key] = in
+			order = append(order, in)
+		} else {
+			f := in.first
+			switch {
+			case mode != s_IFREG || f.Mode&0xf000 != s_IFREG:
+				problem("shares its inode %d with the entry at offset %d, but only regular files can be hard links", hdr.Inode, in.off)
+			case hdr.Links < 2 || f.Links < 2:
+				problem("shares its inode %d with the entry at offset %d, but has a link count of %d", hdr.Inode, in.off, min(hdr.Links, f.Links))
+			case hdr.Mode != f.Mode || hdr.Uid != f.Uid || hdr.Gid != f.Gid || hdr.Links != f.Links:
+				problem("is a hard link to the entry at offset %d with a different mode, owner, or link count", in.off)
+			}
+		}
+		in.entries++
+		if hdr.Size > 0 && mode == s_IFREG {
+			in.content++
+		}
+	}
+
+	for _, in := range order {
+		f := in.first
+		if in.entries == 1 || f.Mode&0xf000 != s_IFREG || f.Links < 2 {
+			continue
+		}
+		if in.entries > f.Links {
+			v.Problems = append(v.Problems, Problem{Offset: in.off, Name: f.Name, Msg: fmt.Sprintf("%d entries share inode %d, which has a link count of %d", in.entries, f.Inode, f.Links)})
+		}
+		if in.content > 1 {
+			v.Problems = append(v.Problems, Problem{Offset: in.off, Name: f.Name, Msg: fmt.Sprintf("%d of the hard links to inode %d carry the content", in.content, f.Inode)})
+		}
+	}
+	return v
+}
+
+// checkName returns the canonical form of an entry name, with any leading
+// "./" removed, and what is wrong with it, if anything.
+func checkName(name string) (string, string) {
+	if len(name)+1 > pathMax {
+		return name, fmt.Sprintf("name of %d bytes exceeds PATH_MAX", len(name))
+	}
+	if name == "" {
+		return ".", "empty name"
+	}
+	if strings.HasPrefix(name, "/") {
+		return path.Clean(strings.TrimLeft(name, "/")), "absolute name"
+	}
+	rel := strings.TrimPrefix(name, "./")
+	if name == "." || rel == "" {
+		return ".", ""
+	}
+	for _, c := range strings.Split(rel, "/") {
+		switch c {
+		case "":
+			return path.Clean(rel), "empty path component"
+		case ".", "..":
+			return path.Clean(rel), fmt.Sprintf("%q path component", c)
+		}
+	}
+	return rel, ""
+}
+
+func typeName(mode int64) string {
+	switch mode {
+	case s_IFDIR:
+		return "directory"
+	case s_IFCHR:
+		return "character device"
+	case s_IFBLK:
+		return "block device"
+	case s_IFIFO:
+		return "FIFO"
+	}
+	return "socket"
+}
@@ -0,0 +1,166 @@
+package cpio
+
+import (
+	"fmt"
+	"io"
+)
+
+// trailerLen is the encoded size of the "TRAILER!!!" entry that ends every
+// archive: the 110-byte fixed header plus the 11-byte name, 4-byte aligned.
+const trailerLen = 124
+
+// VolumeWriter writes a CPIO archive split across a sequence of volumes of
+// bounded size.
+//
+// Every volume is a complete newc archive ending in its own trailer, so the
+// kernel (and boot loaders that pass several initrds) can consume the
+// volumes concatenated in order. Entries are never split: a volume is closed
+// as soon as the next entry would not fit.
+type VolumeWriter struct {
+	open  func(index int) (io.WriteCloser, error)
+	limit int64
+
+	index   int            // index of the current volume
+	entries int            // entries written to the current volume
+	vol     io.WriteCloser // current volume, nil before the first entry
+	cw      *countingWriter
+	tw      *Writer
+	err     error
+	closed  bool
+}
+
+// NewVolumeWriter creates a VolumeWriter producing volumes of at most limit
+// bytes. open is called with 0, 1, 2, ... to create each volume; the
+// VolumeWriter closes volumes once they are complete.
+func NewVolumeWriter(limit int64, open func(index int) (io.WriteCloser, error)) *VolumeWriter {
+	return &VolumeWriter{open: open, limit: limit}
+}
+
+// Volumes returns the number of volumes created so far.
+func (vw *VolumeWriter) Volumes() int {
+	if vw.vol == nil {
+		return vw.index
+	}
+	return vw.index + 1
+}
+
+// WriteHeader writes hdr to the current volume, first starting a new
+// volume if the entry would not fit in the remaining space.
+// It fails if the entry cannot fit even in an empty volume.
+func (vw *VolumeWriter) WriteHeader(hdr *Header) error {
+	if vw.closed {
+		return fmt.Errorf("cpio: writer is closed")
+	}
+	if vw.err != nil {
+		return vw.err
+	}
+
+	size := entryLen(hdr.Name, hdr.Size)
+	if size+trailerLen > vw.limit {
+		return fmt.Errorf("cpio: entry %q needs %d bytes, exceeding the volume size of %d", hdr.Name, size+trailerLen, vw.limit)
+	}
+
+	if vw.vol != nil && vw.entries > 0 && vw.cw.n+size+trailerLen > vw.limit {
+		if err := vw.finish(); err != nil {
+			return err
+		}
+		vw.index++
+	}
+	if vw.vol == nil {
+		vol, err := vw.open(vw.index)
+		if err != nil {
+			vw.err = err
+			return err
+		}
+		vw.vol = vol
+		vw.cw = &countingWriter{w: vol}
+		vw.tw = NewWriter(vw.cw)
+		vw.entries = 0
+	}
+
+	if err := vw.tw.WriteHeader(hdr); err != nil {
+		vw.err = err
+		return err
+	}
+	vw.entries++
+	return nil
+}
+
+// Write writes to the current entry.
+func (vw *VolumeWriter) Write(b []byte) (int, error) {
+	if vw.err != nil {
+		return 0, vw.err
+	}
+	if vw.tw == nil {
+		return 0, fmt.Errorf("cpio: write before header")
+	}
+	return vw.tw.Write(b)
+}
+
+// Close finishes the current volume. An archive with no entries still
+// produces one volume holding only the trailer.
+func (vw *VolumeWriter) Close() error {
+	if vw.closed {
+		return nil
+	}
+	vw.closed = true
+	if vw.err != nil {
+		return vw.err
+	}
+	if vw.vol == nil {
+		vol, err := vw.open(vw.index)
+		if err != nil {
+			return err
+		}
+		vw.vol = vol
+		vw.tw = NewWriter(vol)
+	}
+	err := vw.finish()
+	vw.index++ // count the finished volume in Volumes
+	return err
+}
+
+// finish writes the trailer of the current volume and closes it.
+func (vw *VolumeWriter) finish() error {
+	err := vw.tw.Close()
+	if cerr := vw.vol.Close(); err == nil {
+		err = cerr
+	}
+	vw.vol, vw.cw, vw.tw = nil, nil, nil
+	if err != nil {
+		vw.err = err
+	}
+	return err
+}
+
+// TrailerSize is the number of bytes the trailer adds to an archive.
+const TrailerSize = trailerLen
+
+// EncodedSize returns the number of bytes the entry for hdr, including its
+// content and padding, occupies in a newc archive.
+func EncodedSize(hdr *Header) int64 {
+	return entryLen(hdr.Name, hdr.Size)
+}
+
+// entryLen returns the number of bytes an entry occupies in a newc archive,
+// including the alignment padding after its name and its body.
+func entryLen(name string, size int64) int64 {
+	hdr := int64(110 + len(name) + 1)
+	return align4(hdr) + align4(size)
+}
+
+func align4(n int64) int64 {
+	return (n + 3) &^ 3
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,86 @@
+package cpio_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/cpio"
+)
+
+// volumes collects the volumes of a VolumeWriter in memory.
+type volumes []*bytes.Buffer
+
+func (v *volumes) open(index int) (io.WriteCloser, error) {
+	b := new(bytes.Buffer)
+	*v = append(*v, b)
+	return nopCloser{b}, nil
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func TestVolumeWriterSplits(t *testing.T) {
+	var entries []entry
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		entries = append(entries, file(name, strings.Repeat(name, 100)))
+	}
+	var whole bytes.Buffer
+	write(t, cpio.NewWriter(&whole), entries)
+
+	// Each entry needs 212 bytes, so that 2 fit in a volume with the trailer.
+	const limit = 600
+	var vols volumes
+	vw := cpio.NewVolumeWriter(limit, vols.open)
+	for i, e := range entries {
+		hdr := e.hdr
+		hdr.Inode = i + 1
+		if err := vw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(vw, e.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := vw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if vw.Volumes() != 4 || len(vols) != 4 {
+		t.Fatalf("wrote %d volumes, reporting %d, want 4", len(vols), vw.Volumes())
+	}
+
+	var joined bytes.Buffer
+	for i, v := range vols {
+		if v.Len() > limit {
+			t.Errorf("volume %d is of %d bytes, over the limit of %d", i, v.Len(), limit)
+		}
+		if res := cpio.Verify(bytes.NewReader(v.Bytes())); !res.OK() {
+			t.Errorf("Verify(volume %d): %v", i, res.Problems)
+		}
+		joined.Write(v.Bytes())
+	}
+	if d, err := cpio.Difference(&whole, &joined, cpio.EqualOptions{}); d != "" || err != nil {
+		t.Errorf("the volumes differ from the whole archive: %q, %v", d, err)
+	}
+}
+
+func TestVolumeWriterEmpty(t *testing.T) {
+	var vols volumes
+	vw := cpio.NewVolumeWriter(1<<20, vols.open)
+	if err := vw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(vols) != 1 || vols[0].Len() != cpio.TrailerSize {
+		t.Errorf("an empty archive gave %d volumes, want one of only the trailer", len(vols))
+	}
+}
+
+func TestVolumeWriterRejectsTooLarge(t *testing.T) {
+	var vols volumes
+	vw := cpio.NewVolumeWriter(256, vols.open)
+	if err := vw.WriteHeader(&cpio.Header{Name: "a", Mode: 0o100644, Size: 200}); err == nil {
+		t.Error("WriteHeader of an entry larger than a volume succeeded")
+	}
+}
@@ -19,8 +19,8 @@ type Header struct {
 	Gid       int       // Group ID of owner
 	Size      int64     // Logical file size in bytes
 	ModTime   time.Time // Modification time (seconds since Unix epoch)
-	DevMajor  int       // Major number of character or block device
-	DevMinor  int       // Minor number of character or block device
+	DevMajor  int       // Major number of the device holding the entry
+	DevMinor  int       // Minor number of the device holding the entry
 	RdevMajor int       // Major number of the device node (if this is a device)
 	RdevMinor int       // Minor number of the device node (if this is a device)
 	Links     int       // Number of hard links
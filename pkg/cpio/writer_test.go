@@ -0,0 +1,68 @@
+package cpio_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/cpio"
+)
+
+type entry struct {
+	hdr     cpio.Header
+	content string
+}
+
+func file(name, content string) entry {
+	return entry{cpio.Header{Name: name, Mode: 0o100644, Links: 1, Size: int64(len(content))}, content}
+}
+
+// write writes entries with tw, numbered from 1, and closes it.
+func write(t *testing.T, tw *cpio.Writer, entries []entry) {
+	t.Helper()
+	for i, e := range entries {
+		hdr := e.hdr
+		hdr.Inode = i + 1
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Names and contents of every length mod 4 are padded so that each header
+// starts on a 4-byte boundary.
+func TestWriterPads(t *testing.T) {
+	entries := []entry{file("a", ""), file("bb", "x"), file("ccc", "xy"), file("dddd", "xyz"), file("eeeee", "wxyz")}
+	var buf bytes.Buffer
+	write(t, cpio.NewWriter(&buf), entries)
+	if buf.Len()%4 != 0 {
+		t.Errorf("archive of %d bytes, want a multiple of 4", buf.Len())
+	}
+	if v := cpio.Verify(bytes.NewReader(buf.Bytes())); !v.OK() {
+		t.Errorf("Verify: %v", v.Problems)
+	}
+	tr := cpio.NewReader(&buf)
+	var i int
+	for hdr, body := range tr.Entries() {
+		b, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(entries) || hdr.Name != entries[i].hdr.Name || string(b) != entries[i].content {
+			t.Errorf("entry %d is %s %q", i, hdr.Name, b)
+		}
+		i++
+	}
+	if err := tr.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(entries) {
+		t.Errorf("read %d entries, want %d", i, len(entries))
+	}
+}
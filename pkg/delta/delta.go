@@ -0,0 +1,267 @@
+// Package delta computes and applies binary deltas between two versions of
+// a boot artifact, so that devices holding the old version can be updated
+// by downloading only what changed.
+//
+// A delta starts with a fixed header identifying the source and target
+// by size and SHA-256 digest, followed by a gzip stream of operations that
+// either copy a range of the source or insert literal bytes. Matches are
+// found with a rolling hash over fixed-size blocks, in the style of rsync,
+// which suits initramfs archives: most files survive between versions
+// unchanged but shifted.
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const magic = "EMBERDL1"
+
+// blockSize is the granularity of matches. Smaller blocks find more
+// matches at the cost of a larger index.
+const blockSize = 64
+
+const (
+	opCopy   = 'C'
+	opInsert = 'I'
+	opEnd    = 'E'
+)
+
+// Header identifies the two versions a delta connects.
+type Header struct {
+	SourceSize   int64
+	SourceDigest [sha256.Size]byte
+	TargetSize   int64
+	TargetDigest [sha256.Size]byte
+}
+
+// ErrSourceMismatch is returned by Patch when the source is not the one
+// the delta was computed against.
+var ErrSourceMismatch = errors.New("delta: source does not match")
+
+// ErrTargetMismatch is returned by Patch when the result doesn't match the
+// target the delta was made for.
+var ErrTargetMismatch = errors.New("delta: result does not match target digest")
+
+// Diff writes the delta that turns source into target to w.
+func Diff(w io.Writer, source, target []byte) error {
+	h := Header{
+		SourceSize:   int64(len(source)),
+		SourceDigest: sha256.Sum256(source),
+		TargetSize:   int64(len(target)),
+		TargetDigest: sha256.Sum256(target),
+	}
+	if err := h.write(w); err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(w)
+	bw := bufio.NewWriter(zw)
+	e := &encoder{w: bw}
+	diff(e, source, target)
+	e.op(opEnd)
+	if e.err != nil {
+		return e.err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// diff emits the operations building target from source.
+func diff(e *encoder, source, target []byte) {
+	index := make(map[uint64]int, len(source)/blockSize)
+	for off := len(source) - blockSize; off >= 0; off -= blockSize {
+		index[hashBlock(source[off:off+blockSize])] = off
+	}
+
+	var pow uint64 = 1
+	for i := 0; i < blockSize-1; i++ {
+		pow *= hashBase
+	}
+
+	lit := 0 // start of the pending literal run in target
+	p := 0
+	var h uint64
+	if len(target) >= blockSize {
+		h = hashBlock(target[:blockSize])
+	}
+	for p+blockSize <= len(target) {
+		off, ok := index[h]
+		if ok && bytes.Equal(source[off:off+blockSize], target[p:p+blockSize]) {
+			// Grow the match in both directions.
+			start, src := p, off
+			for start > lit && src > 0 && target[start-1] == source[src-1] {
+				start--
+				src--
+			}
+			end := p + blockSize
+			for end < len(target) && src+(end-start) < len(source) && target[end] == source[src+(end-start)] {
+				end++
+			}
+			e.insert(target[lit:start])
+			e.copy(src, end-start)
+			lit, p = end, end
+			if p+blockSize <= len(target) {
+				h = hashBlock(target[p : p+blockSize])
+			}
+			continue
+		}
+		if p+blockSize < len(target) {
+			h = (h-uint64(target[p])*pow)*hashBase + uint64(target[p+blockSize])
+		}
+		p++
+	}
+	e.insert(target[lit:])
+}
+
+const hashBase = 1099511628211
+
+func hashBlock(b []byte) uint64 {
+	var h uint64
+	for _, c := range b {
+		h = h*hashBase + uint64(c)
+	}
+	return h
+}
+
+// encoder writes operations, remembering the first error.
+type encoder struct {
+	w   *bufio.Writer
+	err error
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (e *encoder) op(op byte, args ...int) {
+	if e.err != nil {
+		return
+	}
+	e.err = e.w.WriteByte(op)
+	for _, a := range args {
+		if e.err == nil {
+			_, e.err = e.w.Write(binary.AppendUvarint(e.buf[:0], uint64(a)))
+		}
+	}
+}
+
+func (e *encoder) copy(off, n int) {
+	e.op(opCopy, off, n)
+}
+
+func (e *encoder) insert(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	e.op(opInsert, len(b))
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+func (h *Header) write(w io.Writer) error {
+	b := make([]byte, 0, len(magic)+2*(8+sha256.Size))
+	b = append(b, magic...)
+	b = binary.BigEndian.AppendUint64(b, uint64(h.SourceSize))
+	b = append(b, h.SourceDigest[:]...)
+	b = binary.BigEndian.AppendUint64(b, uint64(h.TargetSize))
+	b = append(b, h.TargetDigest[:]...)
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadHeader reads the header of a delta.
+func ReadHeader(r io.Reader) (*Header, error) {
+	b := make([]byte, len(magic)+2*(8+sha256.Size))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("delta: read header: %w", err)
+	}
+	if string(b[:len(magic)]) != magic {
+		return nil, errors.New("delta: not an ember delta")
+	}
+	b = b[len(magic):]
+	var h Header
+	h.SourceSize = int64(binary.BigEndian.Uint64(b))
+	copy(h.SourceDigest[:], b[8:])
+	b = b[8+sha256.Size:]
+	h.TargetSize = int64(binary.BigEndian.Uint64(b))
+	copy(h.TargetDigest[:], b[8:])
+	return &h, nil
+}
+
+// Patch applies the delta read from r to source and writes the result to w.
+// It verifies both source and the result against the digests in the delta.
+func Patch(w io.Writer, source []byte, r io.Reader) error {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(source)) != h.SourceSize || sha256.Sum256(source) != h.SourceDigest {
+		return ErrSourceMismatch
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("delta: %w", err)
+	}
+	br := bufio.NewReader(zr)
+
+	sum := sha256.New()
+	out := io.MultiWriter(w, sum)
+	var n int64
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return fmt.Errorf("delta: %w", noEOF(err))
+		}
+		switch op {
+		case opCopy:
+			off, err1 := binary.ReadUvarint(br)
+			size, err2 := binary.ReadUvarint(br)
+			if err := errors.Join(err1, err2); err != nil {
+				return fmt.Errorf("delta: %w", noEOF(err))
+			}
+			if off > uint64(len(source)) || size > uint64(len(source))-off {
+				return errors.New("delta: copy past end of source")
+			}
+			if int64(size) > h.TargetSize-n {
+				return errors.New("delta: copy past end of target")
+			}
+			if _, err := out.Write(source[off : off+size]); err != nil {
+				return err
+			}
+			n += int64(size)
+		case opInsert:
+			size, err := binary.ReadUvarint(br)
+			if err != nil {
+				return fmt.Errorf("delta: %w", noEOF(err))
+			}
+			if int64(size) > h.TargetSize-n {
+				return errors.New("delta: insert past end of target")
+			}
+			if _, err := io.CopyN(out, br, int64(size)); err != nil {
+				return fmt.Errorf("delta: %w", noEOF(err))
+			}
+			n += int64(size)
+		case opEnd:
+			if n != h.TargetSize || !bytes.Equal(sum.Sum(nil), h.TargetDigest[:]) {
+				return ErrTargetMismatch
+			}
+			return nil
+		default:
+			return fmt.Errorf("delta: unknown operation %q", op)
+		}
+	}
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,195 @@
+package delta_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/delta"
+)
+
+func random(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func diff(t *testing.T, source, target []byte) []byte {
+	t.Helper()
+	var d bytes.Buffer
+	if err := delta.Diff(&d, source, target); err != nil {
+		t.Fatal(err)
+	}
+	return d.Bytes()
+}
+
+// Patching the source with its delta gives the target, and the delta of
+// a target that mostly shifts the source is small.
+func TestRoundTrip(t *testing.T) {
+	source := random(1, 256<<10)
+	shifted := append(append(append([]byte("new header"), source[:100<<10]...), random(2, 1000)...), source[120<<10:]...)
+	for _, tc := range []struct {
+		name           string
+		source, target []byte
+		max            int // bytes of delta
+	}{
+		{"same", source, source, 200},
+		{"shifted", source, shifted, 2000},
+		{"unrelated", source, random(3, 64<<10), 64<<10 + 200},
+		{"empty source", nil, []byte("all new"), 200},
+		{"empty target", source, nil, 200},
+		{"short", []byte("abc"), []byte("abcd"), 200},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := diff(t, tc.source, tc.target)
+			if len(d) > tc.max {
+				t.Errorf("delta has %d bytes, want at most %d", len(d), tc.max)
+			}
+			h, err := delta.ReadHeader(bytes.NewReader(d))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := delta.Header{
+				SourceSize:   int64(len(tc.source)),
+				SourceDigest: sha256.Sum256(tc.source),
+				TargetSize:   int64(len(tc.target)),
+				TargetDigest: sha256.Sum256(tc.target),
+			}
+			if *h != want {
+				t.Errorf("ReadHeader() = %+v, want %+v", *h, want)
+			}
+			var out bytes.Buffer
+			if err := delta.Patch(&out, tc.source, bytes.NewReader(d)); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), tc.target) {
+				t.Errorf("Patch() gave %d bytes, not the target of %d", out.Len(), len(tc.target))
+			}
+		})
+	}
+}
+
+// craft makes a delta of the operations ops from source to a target of size
+// bytes with digest sum.
+func craft(source []byte, size int64, sum [sha256.Size]byte, ops ...[]byte) []byte {
+	b := []byte("EMBERDL1")
+	b = binary.BigEndian.AppendUint64(b, uint64(len(source)))
+	s := sha256.Sum256(source)
+	b = append(b, s[:]...)
+	b = binary.BigEndian.AppendUint64(b, uint64(size))
+	b = append(b, sum[:]...)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	for _, op := range ops {
+		zw.Write(op)
+	}
+	zw.Close()
+	return append(b, buf.Bytes()...)
+}
+
+func op(code byte, args ...uint64) []byte {
+	b := []byte{code}
+	for _, a := range args {
+		b = binary.AppendUvarint(b, a)
+	}
+	return b
+}
+
+// Patch checks the source and the result against the delta's digests and
+// rejects operations that reach past either.
+func TestPatchErrors(t *testing.T) {
+	source := []byte("0123456789")
+	target := []byte("456789abc")
+	good := diff(t, source, target)
+	long := diff(t, source, random(4, 1000))
+	sum := sha256.Sum256(target)
+	for _, tc := range []struct {
+		name   string
+		source []byte
+		delta  []byte
+		want   string
+	}{
+		{"other source", []byte("0123456788"), good, delta.ErrSourceMismatch.Error()},
+		{"shorter source", source[:9], good, delta.ErrSourceMismatch.Error()},
+		{"not a delta", source, []byte(strings.Repeat("x", 100)), "not an ember delta"},
+		{"short header", source, good[:20], "read header"},
+		{"truncated", source, long[:len(long)/2], "unexpected EOF"},
+		{"other target", source, craft(source, 9, sha256.Sum256([]byte("456789abd")), op('C', 4, 6), op('I', 3), []byte("abc"), op('E')), delta.ErrTargetMismatch.Error()},
+		{"short target", source, craft(source, 9, sum, op('C', 4, 6), op('E')), delta.ErrTargetMismatch.Error()},
+		{"copy past source", source, craft(source, 9, sum, op('C', 4, 7)), "copy past end of source"},
+		{"copy offset past source", source, craft(source, 9, sum, op('C', 11, 0)), "copy past end of source"},
+		{"copy past target", source, craft(source, 9, sum, op('C', 0, 10)), "copy past end of target"},
+		{"insert past target", source, craft(source, 9, sum, op('I', 10), []byte("0123456789")), "insert past end of target"},
+		{"short insert", source, craft(source, 9, sum, op('I', 3), []byte("ab")), "unexpected EOF"},
+		{"no end", source, craft(source, 9, sum, op('C', 4, 6), op('I', 3), []byte("abc")), "unexpected EOF"},
+		{"unknown operation", source, craft(source, 9, sum, op('X')), `unknown operation 'X'`},
+		{"not gzip", source, append(good[:len("EMBERDL1")+2*(8+sha256.Size)], "plain"...), "delta: "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := delta.Patch(io.Discard, tc.source, bytes.NewReader(tc.delta))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Patch() = %v, want an error: %s", err, tc.want)
+			}
+		})
+	}
+	if err := delta.Patch(io.Discard, source, bytes.NewReader(craft(source, 9, sum, op('C', 4, 6), op('I', 3), []byte("abc"), op('E')))); err != nil {
+		t.Errorf("Patch() of a crafted delta = %v, want it applied", err)
+	}
+	if err := delta.Patch(io.Discard, []byte("x"), bytes.NewReader(good)); !errors.Is(err, delta.ErrSourceMismatch) {
+		t.Errorf("Patch() = %v, want ErrSourceMismatch", err)
+	}
+}
+
+// The manifest describes the versions of the delta's header and the
+// payload as stored.
+func TestManifest(t *testing.T) {
+	source, target := []byte("old"), []byte("new")
+	d := diff(t, source, target)
+	payload := filepath.Join(t.TempDir(), "update.delta")
+	if err := os.WriteFile(payload, d, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := delta.ReadHeader(bytes.NewReader(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := delta.NewManifest(h, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := m.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got delta.Manifest
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	sha := func(b []byte) string { return fmt.Sprintf("sha256:%x", sha256.Sum256(b)) }
+	want := delta.Manifest{
+		Format:  delta.ManifestFormat,
+		Source:  delta.Blob{Size: 3, Digest: sha(source)},
+		Target:  delta.Blob{Size: 3, Digest: sha(target)},
+		Payload: delta.Blob{Path: "update.delta", Size: int64(len(d)), Digest: sha(d)},
+	}
+	if got != want {
+		t.Errorf("manifest %s, want %+v", b, want)
+	}
+	if !bytes.HasSuffix(b, []byte("\n}\n")) {
+		t.Errorf("manifest %q does not end in a newline", b)
+	}
+
+	if _, err := delta.NewManifest(h, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("NewManifest() of a missing payload = nil error")
+	}
+}
@@ -0,0 +1,64 @@
+package delta
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ManifestFormat identifies the version of the manifest and delta format.
+const ManifestFormat = "ember-delta/v1"
+
+// Manifest describes an update payload for A/B update agents: which
+// installed version the delta applies to, the version it produces, and the
+// payload to download.
+type Manifest struct {
+	Format  string `json:"format"`
+	Source  Blob   `json:"source"`
+	Target  Blob   `json:"target"`
+	Payload Blob   `json:"payload"`
+}
+
+// Blob identifies a file by size and digest.
+type Blob struct {
+	Path   string `json:"path,omitempty"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+}
+
+// NewManifest describes the delta stored at payload, whose header is h.
+// The payload is recorded by base name, for serving next to the manifest.
+func NewManifest(h *Header, payload string) (*Manifest, error) {
+	f, err := os.Open(payload)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	n, err := io.Copy(sum, f)
+	if err != nil {
+		return nil, err
+	}
+	return &Manifest{
+		Format:  ManifestFormat,
+		Source:  Blob{Size: h.SourceSize, Digest: digest(h.SourceDigest[:])},
+		Target:  Blob{Size: h.TargetSize, Digest: digest(h.TargetDigest[:])},
+		Payload: Blob{Path: filepath.Base(payload), Size: n, Digest: digest(sum.Sum(nil))},
+	}, nil
+}
+
+// JSON encodes the manifest, indented for humans.
+func (m *Manifest) JSON() ([]byte, error) {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func digest(sum []byte) string {
+	return "sha256:" + hex.EncodeToString(sum)
+}
@@ -0,0 +1,328 @@
+// Package elfdeps finds what an executable in a file tree needs at run time
+// that the tree lacks: the ELF interpreter and shared libraries of a
+// dynamically linked binary, or the interpreter of a script. An init that
+// needs something its initramfs lacks fails to start, and the kernel
+// panics with "Attempted to kill init!".
+package elfdeps
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// maxObjectSize bounds the ELF files that Add reads into memory to parse.
+const maxObjectSize = 256 << 20
+
+// maxLinks bounds the symlinks followed resolving a path, as the kernel's
+// limit does.
+const maxLinks = 40
+
+// Tree records the entries of a file tree, such as an initramfs being
+// written, and the dependencies of the executables in it.
+type Tree struct {
+	entries map[string]*entry
+	objects map[string]*object // parsed ELF files, by path
+	config  map[string]string  // loader configuration files, by path
+}
+
+type entry struct {
+	typ  byte
+	link string
+}
+
+// object is what the checks need of an ELF file or script.
+type object struct {
+	interp  string // PT_INTERP, or the interpreter of a script
+	needed  []string
+	runpath []string
+	class   elf.Class
+	machine elf.Machine
+	script  bool
+}
+
+// NewTree returns an empty tree.
+func NewTree() *Tree {
+	return &Tree{
+		entries: map[string]*entry{".": {typ: tar.TypeDir}},
+		objects: make(map[string]*object),
+		config:  make(map[string]string),
+	}
+}
+
+// Add records the entry hdr, reading content, if it is a regular file, to
+// find out whether it is an ELF file or a script. Its name is relative to
+// the root of the tree; a later entry of the same name replaces it.
+func (t *Tree) Add(hdr *tar.Header, content io.Reader) error {
+	name := cleanPath(hdr.Name)
+	typ := hdr.Typeflag
+	if typ == tar.TypeRegA {
+		typ = tar.TypeReg
+	}
+	delete(t.objects, name)
+	if typ == tar.TypeLink {
+		// A hard link is the file it links to.
+		target := cleanPath(hdr.Linkname)
+		if e, ok := t.entries[target]; ok {
+			t.entries[name] = e
+		}
+		if obj, ok := t.objects[target]; ok {
+			t.objects[name] = obj
+		}
+		return nil
+	}
+	t.entries[name] = &entry{typ: typ, link: hdr.Linkname}
+	if typ != tar.TypeReg {
+		return nil
+	}
+
+	if isLoaderConfig(name) && hdr.Size <= 1<<20 {
+		b, err := io.ReadAll(content)
+		if err != nil {
+			return err
+		}
+		t.config[name] = string(b)
+		return nil
+	}
+	br := bufio.NewReader(content)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte("#!")):
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if fields := strings.Fields(strings.TrimPrefix(line, "#!")); len(fields) > 0 {
+			t.objects[name] = &object{interp: fields[0], script: true}
+		}
+	case bytes.Equal(magic, []byte(elf.ELFMAG)) && hdr.Size <= maxObjectSize:
+		b, err := io.ReadAll(br)
+		if err != nil {
+			return err
+		}
+		if obj, err := parseELF(b); err == nil {
+			t.objects[name] = obj
+		}
+	}
+	return nil
+}
+
+func parseELF(b []byte) (*object, error) {
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	obj := &object{class: f.Class, machine: f.Machine}
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_INTERP {
+			continue
+		}
+		b, err := io.ReadAll(p.Open())
+		if err != nil {
+			return nil, err
+		}
+		obj.interp = string(bytes.TrimRight(b, "\x00"))
+	}
+	// A static binary has no dynamic section.
+	if obj.needed, err = f.DynString(elf.DT_NEEDED); err != nil {
+		return obj, nil
+	}
+	runpath, _ := f.DynString(elf.DT_RUNPATH)
+	if len(runpath) == 0 {
+		runpath, _ = f.DynString(elf.DT_RPATH)
+	}
+	for _, rp := range runpath {
+		obj.runpath = append(obj.runpath, strings.Split(rp, ":")...)
+	}
+	return obj, nil
+}
+
+// isLoaderConfig reports whether name configures where the glibc or musl
+// dynamic loader looks for libraries.
+func isLoaderConfig(name string) bool {
+	return name == "etc/ld.so.conf" ||
+		strings.HasPrefix(name, "etc/ld.so.conf.d/") ||
+		strings.HasPrefix(name, "etc/ld-musl-") && strings.HasSuffix(name, ".path")
+}
+
+// Missing is something an executable needs that the tree lacks.
+type Missing struct {
+	By   string // the executable or library that needs it
+	Name string // the interpreter's path, or the library's soname
+	Kind string // "interpreter" or "library"
+}
+
+func (m Missing) String() string {
+	return fmt.Sprintf("%s needs the %s %s, which is missing", m.By, m.Kind, m.Name)
+}
+
+// Check returns what the executable at name, after following symlinks,
+// needs that the tree lacks: its interpreter and shared libraries, and
+// theirs in turn. It reports an error if name does not resolve to a file.
+func (t *Tree) Check(name string) ([]Missing, error) {
+	target, ok := t.resolve(cleanPath(name))
+	if !ok || t.entries[target].typ != tar.TypeReg {
+		return nil, fmt.Errorf("%s does not resolve to a file", name)
+	}
+	dirs := t.searchDirs()
+	var missing []Missing
+	seen := map[string]bool{target: true}
+	queue := []string{target}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		obj := t.objects[p]
+		if obj == nil {
+			continue // not an executable Add could parse
+		}
+		add := func(dep string) {
+			if !seen[dep] {
+				seen[dep] = true
+				queue = append(queue, dep)
+			}
+		}
+		if obj.interp != "" {
+			if dep, ok := t.resolve(cleanPath(obj.interp)); ok && t.entries[dep].typ == tar.TypeReg {
+				add(dep)
+			} else {
+				missing = append(missing, Missing{By: p, Name: obj.interp, Kind: "interpreter"})
+			}
+		}
+		for _, lib := range obj.needed {
+			if dep, ok := t.findLibrary(lib, p, obj, dirs); ok {
+				add(dep)
+			} else {
+				missing = append(missing, Missing{By: p, Name: lib, Kind: "library"})
+			}
+		}
+	}
+	return missing, nil
+}
+
+// findLibrary finds the library the ELF object at p, obj, needs.
+func (t *Tree) findLibrary(lib, p string, obj *object, dirs []string) (string, bool) {
+	candidates := []string{lib}
+	if !strings.Contains(lib, "/") {
+		candidates = nil
+		var search []string
+		for _, rp := range obj.runpath {
+			rp = strings.ReplaceAll(rp, "$ORIGIN", "/"+path.Dir(p))
+			rp = strings.ReplaceAll(rp, "${ORIGIN}", "/"+path.Dir(p))
+			search = append(search, rp)
+		}
+		search = append(search, dirs...)
+		for _, d := range search {
+			candidates = append(candidates, path.Join(d, lib))
+		}
+	}
+	for _, c := range candidates {
+		dep, ok := t.resolve(cleanPath(c))
+		if !ok || t.entries[dep].typ != tar.TypeReg {
+			continue
+		}
+		// The loader skips libraries built for another machine.
+		if o := t.objects[dep]; o != nil && !o.script && (o.class != obj.class || o.machine != obj.machine) {
+			continue
+		}
+		return dep, true
+	}
+	return "", false
+}
+
+// searchDirs returns the directories the loaders search by default and
+// those their configuration files in the tree add.
+func (t *Tree) searchDirs() []string {
+	dirs := []string{"lib", "lib64", "usr/lib", "usr/lib64", "usr/local/lib"}
+	// Debian's multiarch directories, which its glibc searches by default.
+	var multiarch []string
+	for name, e := range t.entries {
+		if e.typ != tar.TypeDir && e.typ != tar.TypeSymlink {
+			continue
+		}
+		if d, ok := strings.CutPrefix(name, "lib/"); ok && isTriplet(d) {
+			multiarch = append(multiarch, name)
+		}
+		if d, ok := strings.CutPrefix(name, "usr/lib/"); ok && isTriplet(d) {
+			multiarch = append(multiarch, name)
+		}
+	}
+	sort.Strings(multiarch)
+	dirs = append(dirs, multiarch...)
+	var names []string
+	for name := range t.config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, line := range strings.FieldsFunc(t.config[name], func(r rune) bool { return r == '\n' || r == ':' }) {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "include ") {
+				continue // included files are read whether or not included
+			}
+			dirs = append(dirs, line)
+		}
+	}
+	return dirs
+}
+
+// isTriplet reports whether d is a multiarch tuple such as
+// x86_64-linux-gnu.
+func isTriplet(d string) bool {
+	return !strings.Contains(d, "/") && strings.Contains(d, "-linux-")
+}
+
+// resolve follows the symlinks of the cleaned path p, in every component,
+// and reports the path of the entry it names, if there is one.
+func (t *Tree) resolve(p string) (string, bool) {
+	links := 0
+	var walk func(p string) (string, bool)
+	walk = func(p string) (string, bool) {
+		if p == "." {
+			return p, true
+		}
+		parent, ok := walk(path.Dir(p))
+		if !ok {
+			return "", false
+		}
+		cur := path.Join(parent, path.Base(p))
+		for {
+			e := t.entries[cur]
+			if e == nil {
+				return "", false
+			}
+			if e.typ != tar.TypeSymlink {
+				return cur, true
+			}
+			if links++; links > maxLinks {
+				return "", false
+			}
+			target := e.link
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(cur), target)
+			}
+			resolved, ok := walk(cleanPath(target))
+			if !ok {
+				return "", false
+			}
+			cur = resolved
+		}
+	}
+	return walk(p)
+}
+
+// cleanPath cleans p, absolute or relative to the root, to a path
+// relative to the root, with "." for the root itself.
+func cleanPath(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
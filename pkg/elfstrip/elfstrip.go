@@ -0,0 +1,377 @@
+// Package elfstrip removes the debug sections of ELF files, as
+// strip --strip-debug does, so that images built without strip don't
+// carry debug information into an initramfs. Symbols, and everything the
+// program loader or the kernel's module loader reads, are kept.
+package elfstrip
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrUnsupported is returned for ELF files whose layout Debug doesn't
+// rewrite, such as relocatable objects with section groups.
+var ErrUnsupported = errors.New("elfstrip: unsupported layout")
+
+// IsELF reports whether b starts with the ELF magic.
+func IsELF(b []byte) bool {
+	return len(b) >= 4 && string(b[:4]) == elf.ELFMAG
+}
+
+// debugSection reports whether the section name is one that
+// strip --strip-debug removes.
+func debugSection(name string) bool {
+	switch name {
+	case ".stab", ".stabstr", ".line":
+		return true
+	}
+	return strings.HasPrefix(name, ".debug") || strings.HasPrefix(name, ".zdebug")
+}
+
+// section is a section header of either class.
+type section struct {
+	name, typ          uint32
+	flags, addr        uint64
+	off, size          uint64
+	link, info         uint32
+	addralign, entsize uint64
+	nameStr            string
+	newIndex           int
+	newOff             uint64
+	removed            bool
+}
+
+// file is an ELF file being rewritten.
+type file struct {
+	b    []byte
+	bo   binary.ByteOrder
+	is64 bool
+
+	typ                 elf.Type
+	phoff, shoff        uint64
+	phentsize, phnum    int
+	shentsize, shstrndx int
+	sections            []*section
+}
+
+// Debug returns the ELF file b without its debug sections. If it has none,
+// b is returned as it is. The sections that follow the loadable segments
+// are laid out anew behind them, and the section indices of the symbol
+// table are renumbered; symbols of removed sections become absolute.
+func Debug(b []byte) ([]byte, error) {
+	f, err := parse(b)
+	if err != nil {
+		return nil, err
+	}
+	if !f.mark() {
+		return b, nil
+	}
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	out, err := f.write()
+	if err != nil {
+		return nil, err
+	}
+	// Make sure what we wrote still parses as the same kind of file.
+	if _, err := elf.NewFile(bytes.NewReader(out)); err != nil {
+		return nil, fmt.Errorf("elfstrip: rewritten file does not parse: %w", err)
+	}
+	return out, nil
+}
+
+func parse(b []byte) (*file, error) {
+	if !IsELF(b) || len(b) < elf.EI_NIDENT {
+		return nil, errors.New("elfstrip: not an ELF file")
+	}
+	f := &file{b: b}
+	switch elf.Data(b[elf.EI_DATA]) {
+	case elf.ELFDATA2LSB:
+		f.bo = binary.LittleEndian
+	case elf.ELFDATA2MSB:
+		f.bo = binary.BigEndian
+	default:
+		return nil, errors.New("elfstrip: unknown byte order")
+	}
+	r := bytes.NewReader(b)
+	var shnum int
+	switch elf.Class(b[elf.EI_CLASS]) {
+	case elf.ELFCLASS64:
+		f.is64 = true
+		var h elf.Header64
+		if err := binary.Read(r, f.bo, &h); err != nil {
+			return nil, fmt.Errorf("elfstrip: read header: %w", err)
+		}
+		f.typ, f.phoff, f.shoff = elf.Type(h.Type), h.Phoff, h.Shoff
+		f.phentsize, f.phnum = int(h.Phentsize), int(h.Phnum)
+		f.shentsize, shnum, f.shstrndx = int(h.Shentsize), int(h.Shnum), int(h.Shstrndx)
+	case elf.ELFCLASS32:
+		var h elf.Header32
+		if err := binary.Read(r, f.bo, &h); err != nil {
+			return nil, fmt.Errorf("elfstrip: read header: %w", err)
+		}
+		f.typ, f.phoff, f.shoff = elf.Type(h.Type), uint64(h.Phoff), uint64(h.Shoff)
+		f.phentsize, f.phnum = int(h.Phentsize), int(h.Phnum)
+		f.shentsize, shnum, f.shstrndx = int(h.Shentsize), int(h.Shnum), int(h.Shstrndx)
+	default:
+		return nil, errors.New("elfstrip: unknown class")
+	}
+	if shnum == 0 || f.shstrndx == int(elf.SHN_UNDEF) || f.shstrndx >= shnum {
+		// No sections, or extended numbering, which Debug doesn't rewrite.
+		return nil, ErrUnsupported
+	}
+	shsize, phsize := 40, 32
+	if f.is64 {
+		shsize, phsize = 64, 56
+	}
+	if f.shentsize != shsize || (f.phnum > 0 && f.phentsize != phsize) {
+		return nil, errors.New("elfstrip: unexpected header sizes")
+	}
+	if f.shoff+uint64(shnum*f.shentsize) > uint64(len(b)) || f.phoff+uint64(f.phnum*f.phentsize) > uint64(len(b)) {
+		return nil, errors.New("elfstrip: headers out of range")
+	}
+
+	for i := 0; i < shnum; i++ {
+		r := bytes.NewReader(b[f.shoff+uint64(i*f.shentsize):])
+		s := &section{}
+		if f.is64 {
+			var sh elf.Section64
+			if err := binary.Read(r, f.bo, &sh); err != nil {
+				return nil, fmt.Errorf("elfstrip: read section %d: %w", i, err)
+			}
+			*s = section{name: sh.Name, typ: sh.Type, flags: sh.Flags, addr: sh.Addr, off: sh.Off, size: sh.Size,
+				link: sh.Link, info: sh.Info, addralign: sh.Addralign, entsize: sh.Entsize}
+		} else {
+			var sh elf.Section32
+			if err := binary.Read(r, f.bo, &sh); err != nil {
+				return nil, fmt.Errorf("elfstrip: read section %d: %w", i, err)
+			}
+			*s = section{name: sh.Name, typ: sh.Type, flags: uint64(sh.Flags), addr: uint64(sh.Addr), off: uint64(sh.Off),
+				size: uint64(sh.Size), link: sh.Link, info: sh.Info, addralign: uint64(sh.Addralign), entsize: uint64(sh.Entsize)}
+		}
+		if elf.SectionType(s.typ) != elf.SHT_NOBITS && s.off+s.size > uint64(len(b)) {
+			return nil, fmt.Errorf("elfstrip: section %d out of range", i)
+		}
+		f.sections = append(f.sections, s)
+	}
+	strtab := f.sections[f.shstrndx]
+	names := b[strtab.off : strtab.off+strtab.size]
+	for _, s := range f.sections {
+		if int(s.name) < len(names) {
+			n := names[s.name:]
+			if i := bytes.IndexByte(n, 0); i >= 0 {
+				s.nameStr = string(n[:i])
+			}
+		}
+	}
+	return f, nil
+}
+
+// mark marks the sections to remove, and reports whether there are any:
+// the debug sections, and relocations that apply to them.
+func (f *file) mark() bool {
+	found := false
+	for _, s := range f.sections {
+		if s.flags&uint64(elf.SHF_ALLOC) == 0 && debugSection(s.nameStr) {
+			s.removed, found = true, true
+		}
+	}
+	for _, s := range f.sections {
+		if t := elf.SectionType(s.typ); (t == elf.SHT_REL || t == elf.SHT_RELA) && int(s.info) < len(f.sections) && f.sections[s.info].removed {
+			s.removed = true
+		}
+	}
+	return found
+}
+
+// check refuses the layouts that removing the marked sections would break.
+func (f *file) check() error {
+	lastAlloc := -1
+	for i, s := range f.sections {
+		switch elf.SectionType(s.typ) {
+		case elf.SHT_GROUP, elf.SHT_SYMTAB_SHNDX:
+			return ErrUnsupported
+		}
+		if s.flags&uint64(elf.SHF_ALLOC) != 0 {
+			lastAlloc = i
+		}
+	}
+	for i, s := range f.sections {
+		if s.removed && i < lastAlloc && f.typ != elf.ET_REL {
+			// Renumbering the allocated sections would invalidate the
+			// dynamic symbol table, which is inside a segment.
+			return ErrUnsupported
+		}
+		if !s.removed && s.link != 0 && (int(s.link) >= len(f.sections) || f.sections[s.link].removed) {
+			return ErrUnsupported
+		}
+	}
+	if f.sections[f.shstrndx].removed {
+		return ErrUnsupported
+	}
+	end := f.segmentsEnd()
+	for _, s := range f.sections {
+		if s.removed && elf.SectionType(s.typ) != elf.SHT_NOBITS && s.size > 0 && s.off < end {
+			return ErrUnsupported
+		}
+	}
+	return nil
+}
+
+// segmentsEnd returns the end of the file header, program headers, and
+// the content of every segment, which stay where they are.
+func (f *file) segmentsEnd() uint64 {
+	end := uint64(52)
+	if f.is64 {
+		end = 64
+	}
+	if f.phnum > 0 {
+		end = max(end, f.phoff+uint64(f.phnum*f.phentsize))
+	}
+	for i := 0; i < f.phnum; i++ {
+		r := bytes.NewReader(f.b[f.phoff+uint64(i*f.phentsize):])
+		if f.is64 {
+			var ph elf.Prog64
+			if binary.Read(r, f.bo, &ph) == nil {
+				end = max(end, ph.Off+ph.Filesz)
+			}
+		} else {
+			var ph elf.Prog32
+			if binary.Read(r, f.bo, &ph) == nil {
+				end = max(end, uint64(ph.Off)+uint64(ph.Filesz))
+			}
+		}
+	}
+	if f.typ != elf.ET_REL {
+		// Sections of allocated memory stay put even if no segment covers
+		// them.
+		for _, s := range f.sections {
+			if s.flags&uint64(elf.SHF_ALLOC) != 0 && elf.SectionType(s.typ) != elf.SHT_NOBITS {
+				end = max(end, s.off+s.size)
+			}
+		}
+	}
+	return end
+}
+
+// write lays out the file without the removed sections.
+func (f *file) write() ([]byte, error) {
+	n := 0
+	for _, s := range f.sections {
+		if s.removed {
+			s.newIndex = int(elf.SHN_UNDEF)
+			continue
+		}
+		s.newIndex = n
+		n++
+	}
+
+	end := f.segmentsEnd()
+	out := bytes.NewBuffer(make([]byte, 0, len(f.b)))
+	out.Write(f.b[:end])
+
+	var tail []*section
+	for _, s := range f.sections {
+		switch {
+		case s.removed:
+		case s.off >= end:
+			tail = append(tail, s)
+		default:
+			s.newOff = s.off
+		}
+	}
+	sort.SliceStable(tail, func(i, j int) bool { return tail[i].off < tail[j].off })
+	for _, s := range tail {
+		cur := alignUp(uint64(out.Len()), s.addralign)
+		out.Write(make([]byte, cur-uint64(out.Len())))
+		s.newOff = cur
+		if elf.SectionType(s.typ) == elf.SHT_NOBITS {
+			continue
+		}
+		data := bytes.Clone(f.b[s.off : s.off+s.size])
+		if elf.SectionType(s.typ) == elf.SHT_SYMTAB {
+			f.renumberSymbols(data)
+		}
+		out.Write(data)
+	}
+
+	align := uint64(4)
+	if f.is64 {
+		align = 8
+	}
+	shoff := alignUp(uint64(out.Len()), align)
+	out.Write(make([]byte, shoff-uint64(out.Len())))
+	for _, s := range f.sections {
+		if s.removed {
+			continue
+		}
+		if err := f.writeSection(out, s); err != nil {
+			return nil, err
+		}
+	}
+
+	b := out.Bytes()
+	shstrndx := f.sections[f.shstrndx].newIndex
+	if f.is64 {
+		f.bo.PutUint64(b[0x28:], shoff)
+		f.bo.PutUint16(b[0x3c:], uint16(n))
+		f.bo.PutUint16(b[0x3e:], uint16(shstrndx))
+	} else {
+		f.bo.PutUint32(b[0x20:], uint32(shoff))
+		f.bo.PutUint16(b[0x30:], uint16(n))
+		f.bo.PutUint16(b[0x32:], uint16(shstrndx))
+	}
+	return b, nil
+}
+
+// remap returns the new index of the section at old.
+func (f *file) remap(old uint32) uint32 {
+	if old == 0 || int(old) >= len(f.sections) {
+		return old
+	}
+	return uint32(f.sections[old].newIndex)
+}
+
+func (f *file) writeSection(out *bytes.Buffer, s *section) error {
+	link, info := f.remap(s.link), s.info
+	if t := elf.SectionType(s.typ); t == elf.SHT_REL || t == elf.SHT_RELA || s.flags&uint64(elf.SHF_INFO_LINK) != 0 {
+		info = f.remap(s.info)
+	}
+	if f.is64 {
+		return binary.Write(out, f.bo, elf.Section64{Name: s.name, Type: s.typ, Flags: s.flags, Addr: s.addr, Off: s.newOff,
+			Size: s.size, Link: link, Info: info, Addralign: s.addralign, Entsize: s.entsize})
+	}
+	return binary.Write(out, f.bo, elf.Section32{Name: s.name, Type: s.typ, Flags: uint32(s.flags), Addr: uint32(s.addr),
+		Off: uint32(s.newOff), Size: uint32(s.size), Link: link, Info: info, Addralign: uint32(s.addralign), Entsize: uint32(s.entsize)})
+}
+
+// renumberSymbols rewrites the section indices of the symbol table data.
+func (f *file) renumberSymbols(data []byte) {
+	size, shndx := elf.Sym32Size, 14
+	if f.is64 {
+		size, shndx = elf.Sym64Size, 6
+	}
+	for off := 0; off+size <= len(data); off += size {
+		idx := f.bo.Uint16(data[off+shndx:])
+		if idx == uint16(elf.SHN_UNDEF) || idx >= uint16(elf.SHN_LORESERVE) || int(idx) >= len(f.sections) {
+			continue
+		}
+		if f.sections[idx].removed {
+			f.bo.PutUint16(data[off+shndx:], uint16(elf.SHN_ABS))
+			continue
+		}
+		f.bo.PutUint16(data[off+shndx:], uint16(f.sections[idx].newIndex))
+	}
+}
+
+func alignUp(n, align uint64) uint64 {
+	if align <= 1 {
+		return n
+	}
+	return (n + align - 1) &^ (align - 1)
+}
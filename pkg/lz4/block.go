@@ -0,0 +1,126 @@
+package lz4
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Constraints of the block format.
+const (
+	minMatch     = 4
+	lastLiterals = 5  // a block ends with at least this many literals
+	mfLimit      = 12 // and its last match starts at least this far from its end
+	maxOffset    = 1<<16 - 1
+
+	hashLog   = 16
+	chainMask = 1<<16 - 1 // the chain covers maxOffset
+)
+
+// compressor compresses independent blocks with a hash-chain match
+// finder.
+type compressor struct {
+	depth int            // hash chain candidates tried per position
+	head  []int32        // by hash: the latest position, or -1
+	chain [1 << 16]int32 // by position modulo the window: the previous one
+}
+
+func newCompressor(depth int) *compressor {
+	return &compressor{depth: depth, head: make([]int32, 1<<hashLog)}
+}
+
+func hash4(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b) * 2654435761 >> (32 - hashLog)
+}
+
+// block appends the compressed form of src to dst.
+func (c *compressor) block(dst, src []byte) []byte {
+	for i := range c.head {
+		c.head[i] = -1
+	}
+	anchor, next := 0, 0
+	insertTo := func(i int) {
+		for ; next < i; next++ {
+			h := hash4(src[next:])
+			c.chain[next&chainMask] = c.head[h]
+			c.head[h] = int32(next)
+		}
+	}
+	limit := len(src) - mfLimit
+	for i := 0; i < limit; {
+		insertTo(i)
+		end := len(src) - lastLiterals
+		length, cand := 0, int(c.head[hash4(src[i:])])
+		var offset int
+		for d := c.depth; d > 0 && cand >= 0 && i-cand <= maxOffset; d-- {
+			if n := matchLen(src[cand:], src[i:end]); n > length {
+				length, offset = n, i-cand
+			}
+			prev := int(c.chain[cand&chainMask])
+			if prev >= cand {
+				break
+			}
+			cand = prev
+		}
+		if length < minMatch {
+			insertTo(i + 1)
+			i++
+			continue
+		}
+		for i > anchor && i-offset > 0 && src[i-1] == src[i-offset-1] {
+			i--
+			length++
+		}
+		dst = appendSequence(dst, src[anchor:i], offset, length)
+		i += length
+		anchor = i
+		insertTo(min(i, limit))
+	}
+	return appendSequence(dst, src[anchor:], 0, 0)
+}
+
+// appendSequence appends literals followed by a match of length at
+// offset, or by nothing if length is 0, as at the end of a block.
+func appendSequence(dst, literals []byte, offset, length int) []byte {
+	token := byte(min(len(literals), 15)) << 4
+	if length > 0 {
+		token |= byte(min(length-minMatch, 15))
+	}
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = appendLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if length == 0 {
+		return dst
+	}
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(offset))
+	if length-minMatch >= 15 {
+		dst = appendLength(dst, length-minMatch-15)
+	}
+	return dst
+}
+
+// appendLength appends the rest of a length beyond a token's nibble: a
+// run of 255s and the remainder.
+func appendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// matchLen returns the length of the common prefix of a and b, with
+// len(a) >= len(b).
+func matchLen(a, b []byte) int {
+	n := 0
+	for len(b)-n >= 8 {
+		if x := binary.LittleEndian.Uint64(a[n:]) ^ binary.LittleEndian.Uint64(b[n:]); x != 0 {
+			return n + bits.TrailingZeros64(x)/8
+		}
+		n += 8
+	}
+	for n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
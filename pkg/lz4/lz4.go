@@ -0,0 +1,203 @@
+// Package lz4 writes LZ4-compressed data, in the frame format that lz4
+// writes by default or in the legacy format of lz4 -l, which is the only
+// one the Linux kernel's decompressor reads.
+//
+// The encoder is a hash-chain match finder with greedy parsing; at level 1
+// it compresses a little better and several times slower than lz4's fast
+// mode, and at the higher levels somewhat worse than lz4 -9. There is no
+// decoder.
+package lz4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Compression levels accepted by WriterConfig, as those of lz4.
+const (
+	MinLevel     = 1
+	MaxLevel     = 12
+	DefaultLevel = 1
+)
+
+// depths are the hash chain candidates tried per position at each level.
+var depths = [MaxLevel + 1]int{
+	1: 1, 2: 2, 3: 4, 4: 8, 5: 16, 6: 32, 7: 64, 8: 128, 9: 256, 10: 512, 11: 1024, 12: 4096,
+}
+
+// Frame is the container format of the output.
+type Frame int
+
+const (
+	// FrameNormal is the LZ4 frame format: 4 MiB blocks, each
+	// stored uncompressed if that is smaller, an end mark, and a
+	// checksum of the content.
+	FrameNormal Frame = iota
+	// FrameLegacy is the format of lz4 -l: 8 MiB blocks without a
+	// checksum or an end. The kernel reads no other.
+	FrameLegacy
+)
+
+func (f Frame) String() string {
+	switch f {
+	case FrameNormal:
+		return "normal"
+	case FrameLegacy:
+		return "legacy"
+	}
+	return "unknown"
+}
+
+const (
+	frameMagic  = 0x184D2204
+	legacyMagic = 0x184C2102
+
+	frameBlockSize  = 4 << 20
+	legacyBlockSize = 8 << 20
+
+	// frameBlockMax is the block maximum size code of frameBlockSize.
+	frameBlockMax = 7
+	// uncompressedBit marks a block of a frame stored as is.
+	uncompressedBit = 1 << 31
+)
+
+// WriterConfig configures a Writer.
+type WriterConfig struct {
+	// Level is from MinLevel (fastest) to MaxLevel (smallest), or 0 for
+	// DefaultLevel.
+	Level int
+	// Frame is the container format.
+	Frame Frame
+}
+
+// Writer compresses data into a single LZ4 frame. Its output depends only
+// on the input and the configuration.
+type Writer struct {
+	w   io.Writer
+	cfg WriterConfig
+	c   *compressor
+	err error
+
+	started bool
+	closed  bool
+
+	buf []byte // input of the next block
+	out []byte
+	xxh xxh32
+}
+
+// NewWriter returns a Writer compressing to w in the normal frame format
+// at DefaultLevel.
+func NewWriter(w io.Writer) *Writer {
+	z, _ := NewWriterConfig(w, WriterConfig{})
+	return z
+}
+
+// NewWriterConfig returns a Writer compressing to w as cfg says.
+func NewWriterConfig(w io.Writer, cfg WriterConfig) (*Writer, error) {
+	if cfg.Level == 0 {
+		cfg.Level = DefaultLevel
+	}
+	if cfg.Level < MinLevel || cfg.Level > MaxLevel {
+		return nil, fmt.Errorf("lz4: invalid compression level %d, want %d to %d", cfg.Level, MinLevel, MaxLevel)
+	}
+	if cfg.Frame != FrameNormal && cfg.Frame != FrameLegacy {
+		return nil, fmt.Errorf("lz4: unknown frame format %d", cfg.Frame)
+	}
+	z := &Writer{w: w, cfg: cfg, c: newCompressor(depths[cfg.Level])}
+	z.xxh.reset()
+	return z, nil
+}
+
+func (z *Writer) blockSize() int {
+	if z.cfg.Frame == FrameLegacy {
+		return legacyBlockSize
+	}
+	return frameBlockSize
+}
+
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.closed {
+		return 0, errors.New("lz4: write to closed Writer")
+	}
+	if z.err != nil {
+		return 0, z.err
+	}
+	if z.cfg.Frame == FrameNormal {
+		z.xxh.Write(p)
+	}
+	n := len(p)
+	for len(p) > 0 {
+		c := min(len(p), z.blockSize()-len(z.buf))
+		z.buf = append(z.buf, p[:c]...)
+		p = p[c:]
+		if len(z.buf) == z.blockSize() {
+			if z.err = z.block(); z.err != nil {
+				return 0, z.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close compresses the remaining input and ends the frame. It does not
+// close the underlying writer.
+func (z *Writer) Close() error {
+	if z.closed {
+		return z.err
+	}
+	z.closed = true
+	if z.err != nil {
+		return z.err
+	}
+	if len(z.buf) > 0 || !z.started {
+		if z.err = z.block(); z.err != nil {
+			return z.err
+		}
+	}
+	if z.cfg.Frame == FrameLegacy {
+		return nil
+	}
+	var end [8]byte
+	binary.LittleEndian.PutUint32(end[4:], z.xxh.sum())
+	_, z.err = z.w.Write(end[:])
+	return z.err
+}
+
+// block writes the frame header if it is the first, followed by buf as
+// a block, if there is any.
+func (z *Writer) block() error {
+	out := z.out[:0]
+	if !z.started {
+		z.started = true
+		out = z.header(out)
+	}
+	if len(z.buf) > 0 {
+		out = append(out, 0, 0, 0, 0)
+		n := len(out)
+		out = z.c.block(out, z.buf)
+		size := uint32(len(out) - n)
+		if z.cfg.Frame == FrameNormal && int(size) >= len(z.buf) {
+			out = append(out[:n], z.buf...)
+			size = uint32(len(z.buf)) | uncompressedBit
+		}
+		binary.LittleEndian.PutUint32(out[n-4:], size)
+	}
+	z.out, z.buf = out, z.buf[:0]
+	_, err := z.w.Write(out)
+	return err
+}
+
+// header appends the frame header.
+func (z *Writer) header(out []byte) []byte {
+	if z.cfg.Frame == FrameLegacy {
+		return binary.LittleEndian.AppendUint32(out, legacyMagic)
+	}
+	out = binary.LittleEndian.AppendUint32(out, frameMagic)
+	// Version 1 with independent blocks and a content checksum.
+	desc := []byte{1<<6 | 1<<5 | 1<<2, frameBlockMax << 4}
+	out = append(out, desc...)
+	return append(out, byte(xxSum32(desc)>>8))
+}
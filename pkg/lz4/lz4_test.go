@@ -0,0 +1,89 @@
+package lz4_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/lz4"
+)
+
+// inputs are what the round trips compress: nothing, text, runs that
+// compress well, noise that doesn't, stored uncompressed, and a mix
+// spanning blocks of both frame formats.
+func inputs() map[string][]byte {
+	rng := rand.New(rand.NewChaCha8([32]byte{}))
+	noise := make([]byte, 200<<10)
+	for i := range noise {
+		noise[i] = byte(rng.Uint32())
+	}
+	var mixed bytes.Buffer
+	for i := 0; mixed.Len() < 9<<20; i++ {
+		fmt.Fprintf(&mixed, "line %d of a file that repeats itself\n", i%700)
+		mixed.Write(noise[i%1000 : i%1000+i%37])
+	}
+	return map[string][]byte{
+		"empty": nil,
+		"text":  []byte("an initramfs holds the files the kernel needs to mount the root\n"),
+		"runs":  bytes.Repeat([]byte{'a'}, 300<<10),
+		"noise": noise,
+		"mixed": mixed.Bytes(),
+	}
+}
+
+// The Writer has no reader to round-trip with, so lz4 reads what it
+// writes.
+func TestRoundTrip(t *testing.T) {
+	if _, err := exec.LookPath("lz4"); err != nil {
+		t.Skip("lz4 is not installed")
+	}
+	configs := map[string]lz4.WriterConfig{
+		"default":  {},
+		"smallest": {Level: lz4.MaxLevel},
+		"legacy":   {Frame: lz4.FrameLegacy},
+		"legacy9":  {Level: 9, Frame: lz4.FrameLegacy},
+	}
+	for name, b := range inputs() {
+		for cname, cfg := range configs {
+			t.Run(name+"/"+cname, func(t *testing.T) {
+				var buf bytes.Buffer
+				z, err := lz4.NewWriterConfig(&buf, cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := z.Write(b); err != nil {
+					t.Fatal(err)
+				}
+				if err := z.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				cmd := exec.Command("lz4", "-d", "-c")
+				cmd.Stdin = &buf
+				var stderr strings.Builder
+				cmd.Stderr = &stderr
+				got, err := cmd.Output()
+				if err != nil {
+					t.Fatalf("lz4 -d: %v: %s", err, stderr.String())
+				}
+				if !bytes.Equal(got, b) {
+					t.Errorf("lz4 -d gave %d bytes differing from the %d compressed", len(got), len(b))
+				}
+			})
+		}
+	}
+}
+
+func TestWriterConfigRejectsInvalid(t *testing.T) {
+	for _, cfg := range []lz4.WriterConfig{
+		{Level: lz4.MaxLevel + 1},
+		{Frame: lz4.FrameLegacy + 1},
+	} {
+		if _, err := lz4.NewWriterConfig(new(bytes.Buffer), cfg); err == nil {
+			t.Errorf("NewWriterConfig(%+v) succeeded", cfg)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package lz4
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// xxh32 computes the XXH32 hash with seed 0, which frames use for their
+// header and content checksums.
+type xxh32 struct {
+	v     [4]uint32
+	buf   [16]byte
+	nbuf  int
+	total uint64
+}
+
+// The primes are variables so that arithmetic on them wraps.
+var (
+	xxPrime1 uint32 = 2654435761
+	xxPrime2 uint32 = 2246822519
+	xxPrime3 uint32 = 3266489917
+	xxPrime4 uint32 = 668265263
+	xxPrime5 uint32 = 374761393
+)
+
+func (h *xxh32) reset() {
+	*h = xxh32{}
+	h.v = [4]uint32{xxPrime1 + xxPrime2, xxPrime2, 0, -xxPrime1}
+}
+
+func xxRound(acc, lane uint32) uint32 {
+	return bits.RotateLeft32(acc+lane*xxPrime2, 13) * xxPrime1
+}
+
+func (h *xxh32) Write(p []byte) (int, error) {
+	n := len(p)
+	h.total += uint64(n)
+	if h.nbuf > 0 {
+		c := copy(h.buf[h.nbuf:], p)
+		h.nbuf += c
+		p = p[c:]
+		if h.nbuf < 16 {
+			return n, nil
+		}
+		h.stripe(h.buf[:])
+		h.nbuf = 0
+	}
+	for len(p) >= 16 {
+		h.stripe(p)
+		p = p[16:]
+	}
+	h.nbuf = copy(h.buf[:], p)
+	return n, nil
+}
+
+func (h *xxh32) stripe(p []byte) {
+	for i := range h.v {
+		h.v[i] = xxRound(h.v[i], binary.LittleEndian.Uint32(p[4*i:]))
+	}
+}
+
+func (h *xxh32) sum() uint32 {
+	var acc uint32
+	if h.total >= 16 {
+		v := h.v
+		acc = bits.RotateLeft32(v[0], 1) + bits.RotateLeft32(v[1], 7) + bits.RotateLeft32(v[2], 12) + bits.RotateLeft32(v[3], 18)
+	} else {
+		acc = xxPrime5
+	}
+	acc += uint32(h.total)
+	p := h.buf[:h.nbuf]
+	for ; len(p) >= 4; p = p[4:] {
+		acc += binary.LittleEndian.Uint32(p) * xxPrime3
+		acc = bits.RotateLeft32(acc, 17) * xxPrime4
+	}
+	for _, b := range p {
+		acc += uint32(b) * xxPrime5
+		acc = bits.RotateLeft32(acc, 11) * xxPrime1
+	}
+	acc ^= acc >> 15
+	acc *= xxPrime2
+	acc ^= acc >> 13
+	acc *= xxPrime3
+	acc ^= acc >> 16
+	return acc
+}
+
+// xxSum32 returns the XXH32 hash of p.
+func xxSum32(p []byte) uint32 {
+	var h xxh32
+	h.reset()
+	h.Write(p)
+	return h.sum()
+}
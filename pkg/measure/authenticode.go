@@ -0,0 +1,93 @@
+package measure
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Authenticode returns the SHA-256 Authenticode digest of the PE image b,
+// the digest firmware measures and Secure Boot checks signatures against.
+// It covers the whole file except the checksum, the certificate table
+// directory entry, and the certificate table itself, so it is the same
+// before and after signing.
+func Authenticode(b []byte) ([]byte, error) {
+	if len(b) < 64 || b[0] != 'M' || b[1] != 'Z' {
+		return nil, errors.New("authenticode: not a PE image")
+	}
+	pe := int(binary.LittleEndian.Uint32(b[0x3c:]))
+	if pe+24 > len(b) || string(b[pe:pe+4]) != "PE\x00\x00" {
+		return nil, errors.New("authenticode: not a PE image")
+	}
+	coff := pe + 4
+	nsections := int(binary.LittleEndian.Uint16(b[coff+2:]))
+	optSize := int(binary.LittleEndian.Uint16(b[coff+16:]))
+	opt := coff + 20
+	if opt+optSize > len(b) || optSize < 2 {
+		return nil, errors.New("authenticode: truncated optional header")
+	}
+
+	var dirs int // offset of the data directories in the optional header
+	switch magic := binary.LittleEndian.Uint16(b[opt:]); magic {
+	case 0x10b: // PE32
+		dirs = opt + 96
+	case 0x20b: // PE32+
+		dirs = opt + 112
+	default:
+		return nil, fmt.Errorf("authenticode: unknown optional header magic %#x", magic)
+	}
+	checksum := opt + 64
+	certDir := dirs + 4*8 // IMAGE_DIRECTORY_ENTRY_SECURITY
+	if certDir+8 > opt+optSize {
+		return nil, errors.New("authenticode: no certificate table directory")
+	}
+	headers := int(binary.LittleEndian.Uint32(b[opt+60:]))
+	certOff := int64(binary.LittleEndian.Uint32(b[certDir:]))
+	certSize := int64(binary.LittleEndian.Uint32(b[certDir+4:]))
+	if headers > len(b) {
+		return nil, errors.New("authenticode: truncated headers")
+	}
+
+	h := sha256.New()
+	h.Write(b[:checksum])
+	h.Write(b[checksum+4 : certDir])
+	h.Write(b[certDir+8 : headers])
+
+	type section struct{ off, size int64 }
+	var sections []section
+	table := opt + optSize
+	for i := 0; i < nsections; i++ {
+		s := table + 40*i
+		if s+40 > len(b) {
+			return nil, errors.New("authenticode: truncated section table")
+		}
+		size := int64(binary.LittleEndian.Uint32(b[s+16:]))
+		off := int64(binary.LittleEndian.Uint32(b[s+20:]))
+		if size == 0 {
+			continue
+		}
+		if off+size > int64(len(b)) {
+			return nil, errors.New("authenticode: section extends past end of file")
+		}
+		sections = append(sections, section{off, size})
+	}
+	sort.Slice(sections, func(i, j int) bool { return sections[i].off < sections[j].off })
+	hashed := int64(headers)
+	for _, s := range sections {
+		h.Write(b[s.off : s.off+s.size])
+		hashed += s.size
+	}
+
+	// Data past the sections, other than the certificate table, is covered
+	// too.
+	end := int64(len(b))
+	if certSize > 0 && certOff+certSize == end {
+		end = certOff
+	}
+	if hashed < end {
+		h.Write(b[hashed:end])
+	}
+	return h.Sum(nil), nil
+}
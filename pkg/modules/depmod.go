@@ -0,0 +1,330 @@
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrCompression is returned by ReadModule for module objects compressed
+// with a format this package cannot decode (xz and zstd).
+var ErrCompression = errors.New("unsupported module compression")
+
+// Module is the metadata of a module that depmod indexes.
+type Module struct {
+	Path     string   // slash-separated path relative to the tree root
+	Name     string   // canonical name, see Name
+	Depends  []string // names of the modules it needs loaded first
+	Aliases  []string // modalias patterns it handles
+	SoftDeps []string // softdep specifications, e.g. "pre: crc32c"
+}
+
+// ReadModule reads the metadata of the module at root/p from the .modinfo
+// section of its ELF object. Uncompressed and gzip-compressed modules are
+// supported; others fail with ErrCompression.
+func ReadModule(root, p string) (*Module, error) {
+	b, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(p)))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasSuffix(p, ".ko.gz"):
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("module %s: %w", p, err)
+		}
+		if b, err = io.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("module %s: %w", p, err)
+		}
+	case !strings.HasSuffix(p, ".ko"):
+		return nil, fmt.Errorf("module %s: %w", p, ErrCompression)
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("module %s: %w", p, err)
+	}
+	m := &Module{Path: p, Name: Name(p)}
+	sec := f.Section(".modinfo")
+	if sec == nil {
+		return m, nil
+	}
+	info, err := sec.Data()
+	if err != nil {
+		return nil, fmt.Errorf("module %s: read .modinfo: %w", p, err)
+	}
+	for _, kv := range bytes.Split(info, []byte{0}) {
+		key, value, ok := strings.Cut(string(kv), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "depends":
+			for _, d := range strings.Split(value, ",") {
+				if d != "" {
+					m.Depends = append(m.Depends, strings.ReplaceAll(d, "-", "_"))
+				}
+			}
+		case "alias":
+			m.Aliases = append(m.Aliases, value)
+		case "softdep":
+			m.SoftDeps = append(m.SoftDeps, value)
+		}
+	}
+	return m, nil
+}
+
+// ReadHostModule reconstructs the metadata of the module at p from the
+// depmod output already present in the tree at root, for modules that
+// ReadModule cannot decode. deps is the tree's modules.dep, as returned by
+// ReadDeps.
+func ReadHostModule(root, p string, deps map[string][]string) (*Module, error) {
+	m := &Module{Path: p, Name: Name(p)}
+	for _, d := range deps[p] {
+		m.Depends = append(m.Depends, Name(d))
+	}
+	err := scanLines(filepath.Join(root, "modules.alias"), func(fields []string) {
+		if len(fields) == 3 && fields[0] == "alias" && fields[2] == m.Name {
+			m.Aliases = append(m.Aliases, fields[1])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = scanLines(filepath.Join(root, "modules.softdep"), func(fields []string) {
+		if len(fields) > 2 && fields[0] == "softdep" && fields[1] == m.Name {
+			m.SoftDeps = append(m.SoftDeps, strings.Join(fields[2:], " "))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// scanLines calls fn with the fields of each non-comment line of the file
+// name. A missing file has no lines.
+func scanLines(name string, fn func(fields []string)) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		if line := s.Text(); !strings.HasPrefix(line, "#") {
+			fn(strings.Fields(line))
+		}
+	}
+	return s.Err()
+}
+
+// Depmod writes the metadata depmod would generate for mods into the tree
+// at root: modules.dep, modules.alias and modules.softdep with their binary
+// indexes, which kmod's modprobe requires, and the indexes of the modules
+// built into the kernel (from modules.builtin and modules.builtin.modinfo,
+// if the tree has them).
+//
+// Modules are prioritised in the order of root/modules.order, like depmod
+// does, so that the first of several modules handling an alias wins.
+func Depmod(root string, mods []*Module) error {
+	order, err := readOrder(root)
+	if err != nil {
+		return err
+	}
+	mods = append([]*Module(nil), mods...)
+	sort.SliceStable(mods, func(i, j int) bool {
+		oi, oj := order.index(mods[i].Path), order.index(mods[j].Path)
+		if oi != oj {
+			return oi < oj
+		}
+		return mods[i].Path < mods[j].Path
+	})
+	byName := make(map[string]*Module, len(mods))
+	for _, m := range mods {
+		if _, ok := byName[m.Name]; !ok {
+			byName[m.Name] = m
+		}
+	}
+
+	var dep, alias, softdep bytes.Buffer
+	var depIdx, aliasIdx index
+	alias.WriteString("# Aliases extracted from modules themselves.\n")
+	softdep.WriteString("# Soft dependencies extracted from modules themselves.\n")
+	for prio, m := range mods {
+		deps, err := loadOrder(m, byName)
+		if err != nil {
+			return err
+		}
+		line := m.Path + ":"
+		for _, d := range deps {
+			line += " " + d
+		}
+		dep.WriteString(line + "\n")
+		depIdx.add(m.Name, line, uint32(prio))
+
+		for _, a := range m.Aliases {
+			a = underscores(a)
+			fmt.Fprintf(&alias, "alias %s %s\n", a, m.Name)
+			aliasIdx.add(a, m.Name, uint32(prio))
+		}
+		for _, s := range m.SoftDeps {
+			fmt.Fprintf(&softdep, "softdep %s %s\n", m.Name, s)
+		}
+	}
+
+	builtinIdx, builtinAliasIdx, err := readBuiltinIndexes(root)
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name string
+		data func() ([]byte, error)
+	}{
+		{"modules.dep", text(&dep)},
+		{"modules.dep.bin", depIdx.bytes},
+		{"modules.alias", text(&alias)},
+		{"modules.alias.bin", aliasIdx.bytes},
+		{"modules.softdep", text(&softdep)},
+		{"modules.builtin.bin", builtinIdx.bytes},
+		{"modules.builtin.alias.bin", builtinAliasIdx.bytes},
+	}
+	for _, f := range files {
+		b, err := f.data()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		if err := os.WriteFile(filepath.Join(root, f.name), b, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func text(b *bytes.Buffer) func() ([]byte, error) {
+	return func() ([]byte, error) { return b.Bytes(), nil }
+}
+
+// loadOrder returns the paths of all modules m transitively depends on,
+// formatted as in modules.dep: modprobe loads them from last to first, so
+// every module is listed before the modules it needs.
+func loadOrder(m *Module, byName map[string]*Module) ([]string, error) {
+	var post []string
+	state := map[string]int{m.Name: 1} // 1: visiting, 2: done
+	var visit func(m *Module) error
+	visit = func(m *Module) error {
+		for _, n := range m.Depends {
+			d, ok := byName[n]
+			if !ok {
+				return fmt.Errorf("module %s depends on %s, which is not in the tree", m.Path, n)
+			}
+			switch state[n] {
+			case 1:
+				return fmt.Errorf("module %s: dependency cycle through %s", m.Path, n)
+			case 2:
+				continue
+			}
+			state[n] = 1
+			if err := visit(d); err != nil {
+				return err
+			}
+			state[n] = 2
+			post = append(post, d.Path)
+		}
+		return nil
+	}
+	if err := visit(m); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(post)-1; i < j; i, j = i+1, j-1 {
+		post[i], post[j] = post[j], post[i]
+	}
+	return post, nil
+}
+
+// underscores canonicalises an alias like depmod: dashes become
+// underscores, except inside bracket expressions.
+func underscores(s string) string {
+	b := []byte(s)
+	inBracket := false
+	for i, c := range b {
+		switch {
+		case c == '[':
+			inBracket = true
+		case c == ']':
+			inBracket = false
+		case c == '-' && !inBracket:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// moduleOrder maps module paths to their position in modules.order.
+type moduleOrder map[string]int
+
+func (o moduleOrder) index(p string) int {
+	if i, ok := o[p]; ok {
+		return i
+	}
+	return len(o)
+}
+
+func readOrder(root string) (moduleOrder, error) {
+	order := make(moduleOrder)
+	err := scanLines(filepath.Join(root, "modules.order"), func(fields []string) {
+		if len(fields) != 1 {
+			return
+		}
+		// modules.order names the uncompressed objects.
+		p := fields[0]
+		for _, ext := range []string{"", ".gz", ".xz", ".zst"} {
+			if _, ok := order[p+ext]; !ok {
+				order[p+ext] = len(order)
+			}
+		}
+	})
+	return order, err
+}
+
+// readBuiltinIndexes builds the indexes of built-in module names and of
+// their aliases.
+func readBuiltinIndexes(root string) (*index, *index, error) {
+	names, aliases := new(index), new(index)
+	builtin, err := readBuiltin(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	for n := range builtin {
+		names.add(n, "", 0)
+	}
+
+	b, err := os.ReadFile(filepath.Join(root, "modules.builtin.modinfo"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, rec := range bytes.Split(b, []byte{0}) {
+		key, value, ok := strings.Cut(string(rec), "=")
+		if !ok {
+			continue
+		}
+		mod, field, ok := strings.Cut(key, ".")
+		if ok && field == "alias" {
+			aliases.add(underscores(value), strings.ReplaceAll(mod, "-", "_"), 0)
+		}
+	}
+	return names, aliases, nil
+}
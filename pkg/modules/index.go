@@ -0,0 +1,128 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// kmod index file format (libkmod-index.c), as written by depmod for the
+// modules.*.bin files: a header followed by a trie of keys, every node
+// written after its children.
+const (
+	indexMagic   = 0xB007F457
+	indexVersion = 0x00020001
+
+	indexNodePrefix = 0x80000000
+	indexNodeValues = 0x40000000
+	indexNodeChilds = 0x20000000
+
+	indexChildMax = 128
+)
+
+type indexValue struct {
+	key, value string
+	priority   uint32
+}
+
+// index collects the key/value pairs of a kmod index.
+type index struct {
+	values []indexValue
+}
+
+func (x *index) add(key, value string, priority uint32) {
+	x.values = append(x.values, indexValue{key, value, priority})
+}
+
+// bytes encodes the index. Keys must be 7-bit ASCII; several values for
+// one key are kept in priority order and duplicates are dropped.
+func (x *index) bytes() ([]byte, error) {
+	vs := append([]indexValue(nil), x.values...)
+	sort.SliceStable(vs, func(i, j int) bool {
+		if vs[i].key != vs[j].key {
+			return vs[i].key < vs[j].key
+		}
+		return vs[i].priority < vs[j].priority
+	})
+	for _, v := range vs {
+		for i := 0; i < len(v.key); i++ {
+			if v.key[i] == 0 || v.key[i] >= indexChildMax {
+				return nil, fmt.Errorf("index key %q is not 7-bit ASCII", v.key)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write(binary.BigEndian.AppendUint32(nil, indexMagic))
+	buf.Write(binary.BigEndian.AppendUint32(nil, indexVersion))
+	buf.Write(make([]byte, 4)) // root offset, patched below
+	root := writeNode(&buf, vs, 0)
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b[8:], root)
+	return b, nil
+}
+
+// writeNode writes the trie node for vs, which are sorted and share the
+// first depth bytes of their keys, and returns its offset and flags.
+func writeNode(buf *bytes.Buffer, vs []indexValue, depth int) uint32 {
+	// The node's prefix is what all keys have in common past depth.
+	prefix := vs[0].key[depth:]
+	for _, v := range vs[1:] {
+		k := v.key[depth:]
+		n := 0
+		for n < len(prefix) && n < len(k) && prefix[n] == k[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	depth += len(prefix)
+
+	// Values end at this node; the rest continue in children keyed by
+	// their next byte. Sorting keeps both groups contiguous.
+	var here []indexValue
+	children := make(map[byte]uint32)
+	first, last := byte(indexChildMax), byte(0)
+	for i := 0; i < len(vs); {
+		if len(vs[i].key) == depth {
+			if len(here) == 0 || here[len(here)-1].value != vs[i].value {
+				here = append(here, vs[i])
+			}
+			i++
+			continue
+		}
+		c := vs[i].key[depth]
+		j := i + 1
+		for j < len(vs) && len(vs[j].key) > depth && vs[j].key[depth] == c {
+			j++
+		}
+		children[c] = writeNode(buf, vs[i:j], depth+1)
+		first, last = min(first, c), max(last, c)
+		i = j
+	}
+
+	offset := uint32(buf.Len())
+	if prefix != "" {
+		buf.WriteString(prefix)
+		buf.WriteByte(0)
+		offset |= indexNodePrefix
+	}
+	if len(children) > 0 {
+		buf.WriteByte(first)
+		buf.WriteByte(last)
+		for c := int(first); c <= int(last); c++ {
+			buf.Write(binary.BigEndian.AppendUint32(nil, children[byte(c)]))
+		}
+		offset |= indexNodeChilds
+	}
+	if len(here) > 0 {
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(here))))
+		for _, v := range here {
+			buf.Write(binary.BigEndian.AppendUint32(nil, v.priority))
+			buf.WriteString(v.value)
+			buf.WriteByte(0)
+		}
+		offset |= indexNodeValues
+	}
+	return offset
+}
@@ -0,0 +1,256 @@
+// Package modules collects Linux kernel module trees, such as
+// /lib/modules/<kver> on the build host, for inclusion in an initramfs.
+package modules
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// File is a file of a module tree.
+type File struct {
+	Path   string      // slash-separated path relative to the tree root
+	Source string      // path of the file on the host
+	Info   fs.FileInfo // Lstat of Source
+	Link   string      // target, if the file is a symlink
+}
+
+// Collect returns the files of the module tree at root in lexical order.
+// The build and source symlinks, which point at kernel build trees on the
+// host, are left out.
+func Collect(root string) ([]File, error) {
+	var files []File
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if rel == "build" || rel == "source" {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f := File{Path: rel, Source: p, Info: info}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if f.Link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Name returns the canonical name of the module stored at p, as modprobe
+// spells it: the base name without the .ko (and compression) extension,
+// with dashes replaced by underscores.
+func Name(p string) string {
+	base := path.Base(p)
+	if i := strings.Index(base, ".ko"); i >= 0 {
+		base = base[:i]
+	}
+	return strings.ReplaceAll(base, "-", "_")
+}
+
+// IsModule reports whether p names a module object, compressed or not.
+func IsModule(p string) bool {
+	base := path.Base(p)
+	for _, ext := range []string{".ko", ".ko.gz", ".ko.xz", ".ko.zst"} {
+		if strings.HasSuffix(base, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadDeps parses the modules.dep file of the tree at root into a map from
+// module path to the paths of the modules it depends on.
+func ReadDeps(root string) (map[string][]string, error) {
+	f, err := os.Open(filepath.Join(root, "modules.dep"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	deps := make(map[string][]string)
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		mod, rest, ok := strings.Cut(s.Text(), ":")
+		if !ok {
+			continue
+		}
+		deps[mod] = strings.Fields(rest)
+	}
+	return deps, s.Err()
+}
+
+// Closure resolves names to module paths using deps and returns them
+// together with everything they depend on, sorted. Names of modules built
+// into the kernel (listed in root/modules.builtin) are accepted and need no
+// files.
+func Closure(root string, deps map[string][]string, names []string) ([]string, error) {
+	byName := make(map[string]string, len(deps))
+	for p := range deps {
+		byName[Name(p)] = p
+	}
+	builtin, err := readBuiltin(root)
+	if err != nil {
+		return nil, err
+	}
+
+	keep := make(map[string]bool)
+	var visit func(p string)
+	visit = func(p string) {
+		if keep[p] {
+			return
+		}
+		keep[p] = true
+		for _, d := range deps[p] {
+			visit(d)
+		}
+	}
+	for _, n := range names {
+		n = strings.ReplaceAll(n, "-", "_")
+		p, ok := byName[n]
+		if !ok {
+			if builtin[n] {
+				continue
+			}
+			return nil, fmt.Errorf("module %q not found in %s", n, root)
+		}
+		visit(p)
+	}
+
+	paths := make([]string, 0, len(keep))
+	for p := range keep {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func readBuiltin(root string) (map[string]bool, error) {
+	b, err := os.ReadFile(filepath.Join(root, "modules.builtin"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	builtin := make(map[string]bool)
+	for _, line := range strings.Fields(string(b)) {
+		builtin[Name(line)] = true
+	}
+	return builtin, nil
+}
+
+// Prune copies the module tree at root, reduced to the named modules and
+// their dependencies, into a temporary directory and regenerates its depmod
+// metadata with Depmod. It returns the root of the pruned tree and a
+// function that removes it.
+//
+// Module metadata is read from the modules themselves; modules compressed
+// in a format ReadModule cannot decode fall back to the depmod output
+// shipped with the tree.
+func Prune(root string, names []string) (string, func(), error) {
+	deps, err := ReadDeps(root)
+	if err != nil {
+		return "", nil, fmt.Errorf("read module dependencies: %w", err)
+	}
+	keep, err := Closure(root, deps, names)
+	if err != nil {
+		return "", nil, err
+	}
+	mods := make([]*Module, 0, len(keep))
+	for _, p := range keep {
+		m, err := ReadModule(root, p)
+		if errors.Is(err, ErrCompression) {
+			m, err = ReadHostModule(root, p, deps)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		mods = append(mods, m)
+	}
+
+	tmp, err := os.MkdirTemp("", "ember-modules-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(tmp) }
+	dst := filepath.Join(tmp, filepath.Base(root))
+
+	// Copy the kept modules plus the top-level files Depmod reads as input,
+	// such as modules.order and modules.builtin.
+	var copies []string
+	copies = append(copies, keep...)
+	for _, name := range []string{"modules.order", "modules.builtin", "modules.builtin.modinfo"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err == nil {
+			copies = append(copies, name)
+		}
+	}
+	for _, p := range copies {
+		if err := copyFile(filepath.Join(root, filepath.FromSlash(p)), filepath.Join(dst, filepath.FromSlash(p))); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+	}
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if err := Depmod(dst, mods); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("depmod: %w", err)
+	}
+	return dst, cleanup, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
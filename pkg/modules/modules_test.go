@@ -0,0 +1,389 @@
+package modules_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/modules"
+)
+
+// moduleELF returns a relocatable ELF object with a .modinfo section of
+// the key=value records info, as the kernel build leaves in a .ko.
+func moduleELF(info ...string) []byte {
+	modinfo := []byte(strings.Join(info, "\x00") + "\x00")
+	shstrtab := []byte("\x00.modinfo\x00.shstrtab\x00")
+	le := binary.LittleEndian
+	var b []byte
+	b = append(b, elf.ELFMAG...)
+	b = append(b, byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT))
+	b = append(b, make([]byte, elf.EI_NIDENT-len(b))...)
+	infoOff := uint64(64)
+	strOff := infoOff + uint64(len(modinfo))
+	shoff := (strOff + uint64(len(shstrtab)) + 7) &^ 7
+	b = le.AppendUint16(b, uint16(elf.ET_REL))
+	b = le.AppendUint16(b, uint16(elf.EM_X86_64))
+	b = le.AppendUint32(b, uint32(elf.EV_CURRENT))
+	b = le.AppendUint64(b, 0) // entry
+	b = le.AppendUint64(b, 0) // phoff
+	b = le.AppendUint64(b, shoff)
+	b = le.AppendUint32(b, 0)  // flags
+	b = le.AppendUint16(b, 64) // ehsize
+	b = le.AppendUint16(b, 0)  // phentsize
+	b = le.AppendUint16(b, 0)  // phnum
+	b = le.AppendUint16(b, 64) // shentsize
+	b = le.AppendUint16(b, 3)  // shnum
+	b = le.AppendUint16(b, 2)  // shstrndx
+	b = append(b, modinfo...)
+	b = append(b, shstrtab...)
+	b = append(b, make([]byte, shoff-uint64(len(b)))...)
+	for _, sh := range []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC), Off: infoOff, Size: uint64(len(modinfo)), Addralign: 1},
+		{Name: 10, Type: uint32(elf.SHT_STRTAB), Off: strOff, Size: uint64(len(shstrtab)), Addralign: 1},
+	} {
+		b, _ = binary.Append(b, le, sh)
+	}
+	return b
+}
+
+func gzipped(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// writeTree writes files, by slash-separated path, under a temporary
+// directory and returns it.
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "6.1.0")
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// tree is a module tree as the kernel installs it: ext4 needs jbd2 and
+// mbcache, jbd2 needs crc32c, and virtio-blk, which has an alias and a
+// soft dependency, is gzip compressed.
+func tree(t *testing.T) string {
+	t.Helper()
+	return writeTree(t, map[string]string{
+		"kernel/fs/ext4/ext4.ko":                string(moduleELF("license=GPL", "depends=jbd2,mbcache", "alias=fs-ext4", "alias=ext3")),
+		"kernel/fs/jbd2/jbd2.ko":                string(moduleELF("depends=crc32c_generic")),
+		"kernel/fs/mbcache.ko":                  string(moduleELF("depends=")),
+		"kernel/crypto/crc32c_generic.ko":       string(moduleELF("alias=crypto-crc32c")),
+		"kernel/drivers/block/virtio_blk.ko.gz": string(gzipped(moduleELF("alias=virtio:d00000002v*", "softdep=pre: crc32c"))),
+		"kernel/drivers/net/e1000e.ko.xz":       "xz",
+		"kernel/drivers/net/unused.ko":          string(moduleELF()),
+		"modules.order":                         "kernel/crypto/crc32c_generic.ko\nkernel/fs/mbcache.ko\nkernel/fs/jbd2/jbd2.ko\nkernel/fs/ext4/ext4.ko\nkernel/drivers/block/virtio_blk.ko\nkernel/drivers/net/e1000e.ko\n",
+		"modules.builtin":                       "kernel/drivers/block/loop.ko\n",
+		"modules.builtin.modinfo":               "loop.alias=devname:loop-control\x00loop.license=GPL\x00",
+		"modules.alias":                         "# Aliases extracted from modules themselves.\nalias pci:v00008086d000010D3sv*sd*bc*sc*i* e1000e\n",
+		"modules.softdep":                       "softdep e1000e pre: ptp\n",
+		"modules.dep": `kernel/fs/ext4/ext4.ko: kernel/fs/jbd2/jbd2.ko kernel/fs/mbcache.ko kernel/crypto/crc32c_generic.ko
+kernel/fs/jbd2/jbd2.ko: kernel/crypto/crc32c_generic.ko
+kernel/fs/mbcache.ko:
+kernel/crypto/crc32c_generic.ko:
+kernel/drivers/block/virtio_blk.ko.gz:
+kernel/drivers/net/e1000e.ko.xz:
+kernel/drivers/net/unused.ko:
+`,
+	})
+}
+
+func TestName(t *testing.T) {
+	for p, want := range map[string]string{
+		"kernel/fs/ext4/ext4.ko":                "ext4",
+		"kernel/drivers/block/virtio-blk.ko.gz": "virtio_blk",
+		"crc32c-generic":                        "crc32c_generic",
+	} {
+		if got := modules.Name(p); got != want {
+			t.Errorf("Name(%q) = %q, want %q", p, got, want)
+		}
+	}
+	for p, want := range map[string]bool{
+		"ext4.ko": true, "ext4.ko.gz": true, "ext4.ko.xz": true, "ext4.ko.zst": true,
+		"ext4.ko.bz2": false, "ext4.o": false, "modules.dep": false,
+	} {
+		if got := modules.IsModule(p); got != want {
+			t.Errorf("IsModule(%q) = %v, want %v", p, got, want)
+		}
+	}
+}
+
+// Collect lists the tree in order, with its links, but not the links to
+// the kernel's build tree.
+func TestCollect(t *testing.T) {
+	root := writeTree(t, map[string]string{"kernel/a.ko": "a", "modules.dep": ""})
+	for _, link := range []string{"build", "source", "kernel/link.ko"} {
+		if err := os.Symlink("/usr/src/linux", filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := modules.Collect(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range files {
+		s := f.Path
+		if f.Link != "" {
+			s += " -> " + f.Link
+		}
+		if f.Source != filepath.Join(root, filepath.FromSlash(f.Path)) {
+			t.Errorf("%s has source %s", f.Path, f.Source)
+		}
+		got = append(got, s)
+	}
+	want := []string{"kernel", "kernel/a.ko", "kernel/link.ko -> /usr/src/linux", "modules.dep"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Collect() = %q, want %q", got, want)
+	}
+}
+
+// Closure adds the dependencies of the modules named, however their names
+// are spelled, and accepts built-in modules.
+func TestClosure(t *testing.T) {
+	root := tree(t)
+	deps, err := modules.ReadDeps(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := modules.Closure(root, deps, []string{"ext4", "virtio-blk", "loop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"kernel/crypto/crc32c_generic.ko",
+		"kernel/drivers/block/virtio_blk.ko.gz",
+		"kernel/fs/ext4/ext4.ko",
+		"kernel/fs/jbd2/jbd2.ko",
+		"kernel/fs/mbcache.ko",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Closure() = %q, want %q", got, want)
+	}
+	if _, err := modules.Closure(root, deps, []string{"btrfs"}); err == nil || !strings.Contains(err.Error(), `module "btrfs" not found`) {
+		t.Errorf("Closure(btrfs) = %v, want a not found error", err)
+	}
+}
+
+// ReadModule reads the .modinfo of plain and gzip compressed modules, and
+// ReadHostModule the metadata of others from the tree's depmod output.
+func TestReadModule(t *testing.T) {
+	root := tree(t)
+	m, err := modules.ReadModule(root, "kernel/fs/ext4/ext4.ko")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "ext4" || !slices.Equal(m.Depends, []string{"jbd2", "mbcache"}) || !slices.Equal(m.Aliases, []string{"fs-ext4", "ext3"}) {
+		t.Errorf("ReadModule(ext4) = %+v", m)
+	}
+	m, err = modules.ReadModule(root, "kernel/drivers/block/virtio_blk.ko.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "virtio_blk" || !slices.Equal(m.SoftDeps, []string{"pre: crc32c"}) {
+		t.Errorf("ReadModule(virtio_blk) = %+v", m)
+	}
+	if _, err := modules.ReadModule(root, "kernel/drivers/net/e1000e.ko.xz"); !errors.Is(err, modules.ErrCompression) {
+		t.Errorf("ReadModule(e1000e.ko.xz) = %v, want ErrCompression", err)
+	}
+	if _, err := modules.ReadModule(root, "modules.order"); !errors.Is(err, modules.ErrCompression) {
+		t.Errorf("ReadModule(modules.order) = %v, want ErrCompression", err)
+	}
+
+	deps, err := modules.ReadDeps(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = modules.ReadHostModule(root, "kernel/fs/jbd2/jbd2.ko", deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(m.Depends, []string{"crc32c_generic"}) {
+		t.Errorf("ReadHostModule(jbd2) = %+v", m)
+	}
+	m, err = modules.ReadHostModule(root, "kernel/drivers/net/e1000e.ko.xz", deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(m.Aliases, []string{"pci:v00008086d000010D3sv*sd*bc*sc*i*"}) || !slices.Equal(m.SoftDeps, []string{"pre: ptp"}) {
+		t.Errorf("ReadHostModule(e1000e) = %+v", m)
+	}
+}
+
+// lookup finds the values of key in a kmod index as libkmod does,
+// following the prefixes and children of its trie.
+func lookup(t *testing.T, b []byte, key string) []string {
+	t.Helper()
+	be := binary.BigEndian
+	if be.Uint32(b) != 0xB007F457 || be.Uint32(b[4:]) != 0x00020001 {
+		t.Fatalf("index has magic %x and version %x", be.Uint32(b), be.Uint32(b[4:]))
+	}
+	cstring := func(off int) (string, int) {
+		n := bytes.IndexByte(b[off:], 0)
+		return string(b[off : off+n]), off + n + 1
+	}
+	node := be.Uint32(b[8:])
+	for {
+		off := int(node & 0x0fffffff)
+		if node&0x80000000 != 0 {
+			var prefix string
+			prefix, off = cstring(off)
+			if !strings.HasPrefix(key, prefix) {
+				return nil
+			}
+			key = key[len(prefix):]
+		}
+		var children []uint32
+		var first byte
+		if node&0x20000000 != 0 {
+			first = b[off]
+			last := b[off+1]
+			for c := int(first); c <= int(last); c++ {
+				children = append(children, be.Uint32(b[off+2+4*(c-int(first)):]))
+			}
+			off += 2 + 4*len(children)
+		}
+		if key == "" {
+			if node&0x40000000 == 0 {
+				return nil
+			}
+			var values []string
+			n := int(be.Uint32(b[off:]))
+			off += 4
+			for i := 0; i < n; i++ {
+				var v string
+				v, off = cstring(off + 4) // past the priority
+				values = append(values, v)
+			}
+			return values
+		}
+		i := int(key[0]) - int(first)
+		if i < 0 || i >= len(children) || children[i] == 0 {
+			return nil
+		}
+		node, key = children[i], key[1:]
+	}
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// Prune copies the modules named and their dependencies, and writes depmod
+// metadata for them that lists dependencies in load order, canonicalizes
+// aliases, and indexes built-in modules.
+func TestPrune(t *testing.T) {
+	root := tree(t)
+	pruned, cleanup, err := modules.Prune(root, []string{"ext4", "virtio_blk", "e1000e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if filepath.Base(pruned) != "6.1.0" {
+		t.Errorf("pruned tree %s is not named for the kernel", pruned)
+	}
+	if _, err := os.Stat(filepath.Join(pruned, "kernel/drivers/net/unused.ko")); !os.IsNotExist(err) {
+		t.Errorf("pruned tree has unused.ko: %v", err)
+	}
+	if got := readFile(t, filepath.Join(pruned, "kernel/fs/ext4/ext4.ko")); got != string(moduleELF("license=GPL", "depends=jbd2,mbcache", "alias=fs-ext4", "alias=ext3")) {
+		t.Error("pruned tree has ext4.ko changed")
+	}
+
+	wantDep := `kernel/crypto/crc32c_generic.ko:
+kernel/fs/mbcache.ko:
+kernel/fs/jbd2/jbd2.ko: kernel/crypto/crc32c_generic.ko
+kernel/fs/ext4/ext4.ko: kernel/fs/mbcache.ko kernel/fs/jbd2/jbd2.ko kernel/crypto/crc32c_generic.ko
+kernel/drivers/block/virtio_blk.ko.gz:
+kernel/drivers/net/e1000e.ko.xz:
+`
+	if got := readFile(t, filepath.Join(pruned, "modules.dep")); got != wantDep {
+		t.Errorf("modules.dep:\n%s\nwant\n%s", got, wantDep)
+	}
+	wantAlias := `# Aliases extracted from modules themselves.
+alias crypto_crc32c crc32c_generic
+alias fs_ext4 ext4
+alias ext3 ext4
+alias virtio:d00000002v* virtio_blk
+alias pci:v00008086d000010D3sv*sd*bc*sc*i* e1000e
+`
+	if got := readFile(t, filepath.Join(pruned, "modules.alias")); got != wantAlias {
+		t.Errorf("modules.alias:\n%s\nwant\n%s", got, wantAlias)
+	}
+	wantSoftdep := `# Soft dependencies extracted from modules themselves.
+softdep virtio_blk pre: crc32c
+softdep e1000e pre: ptp
+`
+	if got := readFile(t, filepath.Join(pruned, "modules.softdep")); got != wantSoftdep {
+		t.Errorf("modules.softdep:\n%s\nwant\n%s", got, wantSoftdep)
+	}
+
+	index := func(name string) []byte { return []byte(readFile(t, filepath.Join(pruned, name))) }
+	for _, tc := range []struct {
+		index, key string
+		want       []string
+	}{
+		{"modules.dep.bin", "ext4", []string{"kernel/fs/ext4/ext4.ko: kernel/fs/mbcache.ko kernel/fs/jbd2/jbd2.ko kernel/crypto/crc32c_generic.ko"}},
+		{"modules.dep.bin", "mbcache", []string{"kernel/fs/mbcache.ko:"}},
+		{"modules.dep.bin", "e1000e", []string{"kernel/drivers/net/e1000e.ko.xz:"}},
+		{"modules.dep.bin", "ext", nil},
+		{"modules.dep.bin", "unused", nil},
+		{"modules.alias.bin", "ext3", []string{"ext4"}},
+		{"modules.alias.bin", "fs_ext4", []string{"ext4"}},
+		{"modules.alias.bin", "virtio:d00000002v*", []string{"virtio_blk"}},
+		{"modules.builtin.bin", "loop", []string{""}},
+		{"modules.builtin.alias.bin", "devname:loop_control", []string{"loop"}},
+	} {
+		if got := lookup(t, index(tc.index), tc.key); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: lookup(%q) = %q, want %q", tc.index, tc.key, got, tc.want)
+		}
+	}
+}
+
+// Depmod fails on dependencies that aren't in the tree or that form a
+// cycle, and on aliases an index can't hold.
+func TestDepmodErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		mods []*modules.Module
+		want string
+	}{
+		{"missing", []*modules.Module{{Path: "a.ko", Name: "a", Depends: []string{"b"}}}, "a.ko depends on b, which is not in the tree"},
+		{"cycle", []*modules.Module{
+			{Path: "a.ko", Name: "a", Depends: []string{"b"}},
+			{Path: "b.ko", Name: "b", Depends: []string{"a"}},
+		}, "dependency cycle"},
+		{"alias", []*modules.Module{{Path: "a.ko", Name: "a", Aliases: []string{"café"}}}, "modules.alias.bin"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := modules.Depmod(t.TempDir(), tc.mods)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Depmod() = %v, want an error: %s", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package mtree
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// devTableTypes maps the types of a device table to type keywords.
+var devTableTypes = map[string]string{
+	"f": "file",
+	"d": "dir",
+	"c": "char",
+	"b": "block",
+	"p": "fifo",
+}
+
+// ParseDeviceTable reads a device table, the device_table.txt of buildroot
+// and BusyBox makedevs, as a specification, so that device nodes can be
+// given to an archive built without root. Each line is
+//
+//	<name> <type> <mode> <uid> <gid> <major> <minor> <start> <inc> <count>
+//
+// with - for fields that don't apply. The types are f for a regular file,
+// which must exist, d for a directory, c and b for character and block
+// devices, and p for a fifo; modes are octal. A count makes count devices
+// named <name><start>, <name><start+1>, ..., whose minors go up by inc
+// from minor, as /dev/ttyS with 4 64 0 1 4 makes /dev/ttyS0 to ttyS3.
+func ParseDeviceTable(r io.Reader) (*Spec, error) {
+	byPath := make(map[string]*Entry)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 10 {
+			return nil, fmt.Errorf("device table: line %d: %d fields, not 10", n, len(fields))
+		}
+		entries, err := deviceTableLine(fields)
+		if err != nil {
+			return nil, fmt.Errorf("device table: line %d: %w", n, err)
+		}
+		for _, e := range entries {
+			e.Line = n
+			byPath[e.Path] = e
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("device table: %w", err)
+	}
+
+	spec := &Spec{Entries: make([]*Entry, 0, len(byPath))}
+	for _, e := range byPath {
+		spec.Entries = append(spec.Entries, e)
+	}
+	sort.Slice(spec.Entries, func(i, j int) bool { return spec.Entries[i].Path < spec.Entries[j].Path })
+	return spec, nil
+}
+
+// deviceTableLine returns the entries of the fields of a line of a device
+// table.
+func deviceTableLine(f []string) ([]*Entry, error) {
+	typ, ok := devTableTypes[f[1]]
+	if !ok {
+		return nil, fmt.Errorf("%s has unsupported type %q", f[0], f[1])
+	}
+	mode, err := strconv.ParseUint(f[2], 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%s has mode %q, which is not octal", f[0], f[2])
+	}
+	var n [7]int64 // uid, gid, major, minor, start, inc, count
+	for i, v := range f[3:] {
+		if v == "-" {
+			continue
+		}
+		if n[i], err = strconv.ParseInt(v, 10, 64); err != nil || n[i] < 0 {
+			return nil, fmt.Errorf("%s has bad field %d %q", f[0], i+4, v)
+		}
+	}
+	uid, gid, major, minor, start, inc, count := n[0], n[1], n[2], n[3], n[4], n[5], n[6]
+	device := typ == "char" || typ == "block"
+	if count > 0 && !device {
+		return nil, fmt.Errorf("%s has a count, which only devices take", f[0])
+	}
+
+	entry := func(name string, minor int64) *Entry {
+		e := &Entry{Path: cleanPath(name), Keywords: map[string]string{
+			"type": typ,
+			"mode": fmt.Sprintf("%#o", mode&0o7777),
+			"uid":  strconv.FormatInt(uid, 10),
+			"gid":  strconv.FormatInt(gid, 10),
+		}}
+		if device {
+			e.Keywords["device"] = fmt.Sprintf("native,%d,%d", major, minor)
+		}
+		return e
+	}
+	if count == 0 {
+		return []*Entry{entry(f[0], minor)}, nil
+	}
+	entries := make([]*Entry, count)
+	for i := range count {
+		entries[i] = entry(f[0]+strconv.FormatInt(start+i, 10), minor+i*inc)
+	}
+	return entries, nil
+}
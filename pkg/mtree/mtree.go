@@ -0,0 +1,126 @@
+// Package mtree writes mtree(8) specifications of file trees, such as the
+// merged view of an image, in the form BSD mtree -C and libarchive write:
+// one line per entry, with its full path and every keyword spelled out, so
+// that two specifications can be compared with diff.
+package mtree
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Writer collects the entries of a specification and writes them, sorted
+// by path, when it is closed.
+type Writer struct {
+	w       io.Writer
+	entries map[string]string // path → keywords
+	closed  bool
+}
+
+// NewWriter creates a new Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, entries: make(map[string]string)}
+}
+
+// WriteEntry adds the entry hdr, reading the content of a regular file from
+// content to take its sha256. An entry of a path given before replaces the
+// earlier one.
+//
+// A regular file with a SCHILY.nlink PAX record of more than 1, as an
+// oci.Reader opened WithHardLinks returns the first name of an inode, gets
+// an nlink keyword, and a hard link to it, which must come after it, is
+// written with the same keywords, as mtree -C writes the names of one
+// inode.
+func (mw *Writer) WriteEntry(hdr *tar.Header, content io.Reader) error {
+	if mw.closed {
+		return fmt.Errorf("mtree: writer is closed")
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		kw, ok := mw.entries[specPath(hdr.Linkname)]
+		if !ok {
+			return fmt.Errorf("mtree: %q links to %q, which comes after it or not at all", hdr.Name, hdr.Linkname)
+		}
+		mw.entries[specPath(hdr.Name)] = kw
+		return nil
+	}
+	var kw strings.Builder
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		h := sha256.New()
+		if _, err := io.CopyN(h, content, hdr.Size); err != nil {
+			return fmt.Errorf("mtree: read %q: %w", hdr.Name, err)
+		}
+		fmt.Fprintf(&kw, "type=file size=%d sha256digest=%x", hdr.Size, h.Sum(nil))
+		if n, err := strconv.Atoi(hdr.PAXRecords["SCHILY.nlink"]); err == nil && n > 1 {
+			fmt.Fprintf(&kw, " nlink=%d", n)
+		}
+	case tar.TypeDir:
+		kw.WriteString("type=dir")
+	case tar.TypeSymlink:
+		fmt.Fprintf(&kw, "type=link link=%s", Escape(hdr.Linkname))
+	case tar.TypeChar:
+		fmt.Fprintf(&kw, "type=char device=native,%d,%d", hdr.Devmajor, hdr.Devminor)
+	case tar.TypeBlock:
+		fmt.Fprintf(&kw, "type=block device=native,%d,%d", hdr.Devmajor, hdr.Devminor)
+	case tar.TypeFifo:
+		kw.WriteString("type=fifo")
+	default:
+		return fmt.Errorf("mtree: %q has unsupported type %q", hdr.Name, hdr.Typeflag)
+	}
+	fmt.Fprintf(&kw, " uid=%d gid=%d mode=%#o", hdr.Uid, hdr.Gid, hdr.Mode&0o7777)
+	mw.entries[specPath(hdr.Name)] = kw.String()
+	return nil
+}
+
+// Close writes the specification. It does not close the underlying
+// writer.
+func (mw *Writer) Close() error {
+	if mw.closed {
+		return nil
+	}
+	mw.closed = true
+	paths := make([]string, 0, len(mw.entries))
+	for p := range mw.entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	bw := bufio.NewWriter(mw.w)
+	bw.WriteString("#mtree\n")
+	for _, p := range paths {
+		fmt.Fprintf(bw, "%s %s\n", Escape(p), mw.entries[p])
+	}
+	return bw.Flush()
+}
+
+// specPath spells name as a path of the specification, relative to "."
+// and starting with it.
+func specPath(name string) string {
+	p := path.Clean("/" + name)
+	if p == "/" {
+		return "."
+	}
+	return "." + p
+}
+
+// Escape encodes s as a path or link target of a specification: spaces,
+// control characters, bytes outside ASCII, and the #, =, and \ that
+// mtree gives a meaning are written as a backslash and three octal digits.
+func Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || c == '#' || c == '=' || c == '\\' {
+			fmt.Fprintf(&b, "\\%03o", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
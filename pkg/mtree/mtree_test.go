@@ -0,0 +1,47 @@
+package mtree_test
+
+import (
+	"archive/tar"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/mtree"
+)
+
+// The names of one inode have the same keywords, with its link count.
+func TestWriterHardLinks(t *testing.T) {
+	var out strings.Builder
+	mw := mtree.NewWriter(&out)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeReg, Name: "bin/busybox", Mode: 0o755, Size: 2, PAXRecords: map[string]string{"SCHILY.nlink": "2"}},
+		{Typeflag: tar.TypeLink, Name: "bin/sh", Linkname: "bin/busybox"},
+		{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, Size: 2, PAXRecords: map[string]string{"SCHILY.nlink": "1"}},
+	} {
+		if err := mw.WriteEntry(hdr, strings.NewReader("BB")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	const bb = "type=file size=2 sha256digest=" +
+		"fc686c314491e1f68bf1899fc54b2327353c44dd1ab4ed56538ef623edd1e866" +
+		" nlink=2 uid=0 gid=0 mode=0755"
+	want := "#mtree\n" +
+		"./bin/busybox " + bb + "\n" +
+		"./bin/sh " + bb + "\n" +
+		"./etc/hostname type=file size=2 sha256digest=" +
+		"fc686c314491e1f68bf1899fc54b2327353c44dd1ab4ed56538ef623edd1e866" +
+		" uid=0 gid=0 mode=0644\n"
+	if out.String() != want {
+		t.Errorf("wrote\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+// A hard link must come after the file it links to.
+func TestWriterLinkBeforeTarget(t *testing.T) {
+	mw := mtree.NewWriter(new(strings.Builder))
+	if err := mw.WriteEntry(&tar.Header{Typeflag: tar.TypeLink, Name: "bin/sh", Linkname: "bin/busybox"}, nil); err == nil {
+		t.Error("WriteEntry of a link to nothing succeeded")
+	}
+}
@@ -0,0 +1,336 @@
+package mtree
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spec is a parsed specification: its entries, each with the keywords that
+// apply to it, sorted so that every directory comes before what is below
+// it.
+type Spec struct {
+	Entries []*Entry
+}
+
+// Entry is an entry of a specification.
+type Entry struct {
+	Path     string            // cleaned, without a leading "./"; "." for the root
+	Keywords map[string]string // including those of /set, with values unescaped
+	Line     int               // where the entry was given
+}
+
+// Parse reads a specification in either of the forms mtree(5) describes:
+// lines of full paths, as Writer and mtree -C write, or the default form
+// where a name without a slash is relative to the directory last entered
+// and ".." leaves it. /set and /unset lines are honoured, comments and
+// blank lines are skipped, and lines are continued with a backslash.
+// Keywords Parse doesn't know are kept as they are. If a path is given
+// more than once, the last of its keywords win.
+func Parse(r io.Reader) (*Spec, error) {
+	byPath := make(map[string]*Entry)
+	defaults := make(map[string]string)
+	cwd := "."
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	var line string
+	start := 0
+	for n := 1; s.Scan(); n++ {
+		if line == "" {
+			start = n
+		}
+		text := s.Text()
+		if strings.HasSuffix(text, "\\") && !strings.HasSuffix(text, "\\\\") {
+			line += text[:len(text)-1] + " "
+			continue
+		}
+		line += text
+		fields := strings.Fields(line)
+		line = ""
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch fields[0] {
+		case "/set":
+			for _, f := range fields[1:] {
+				k, v, err := keyword(f)
+				if err != nil {
+					return nil, fmt.Errorf("mtree: line %d: %w", start, err)
+				}
+				defaults[k] = v
+			}
+			continue
+		case "/unset":
+			for _, k := range fields[1:] {
+				if k == "all" {
+					clear(defaults)
+				}
+				delete(defaults, k)
+			}
+			continue
+		case "..":
+			if cwd == "." {
+				return nil, fmt.Errorf("mtree: line %d: .. above the root", start)
+			}
+			cwd = path.Dir(cwd)
+			continue
+		}
+
+		name, err := Unescape(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("mtree: line %d: %w", start, err)
+		}
+		e := &Entry{Keywords: make(map[string]string), Line: start}
+		for k, v := range defaults {
+			e.Keywords[k] = v
+		}
+		for _, f := range fields[1:] {
+			k, v, err := keyword(f)
+			if err != nil {
+				return nil, fmt.Errorf("mtree: line %d: %w", start, err)
+			}
+			e.Keywords[k] = v
+		}
+		full := strings.Contains(name, "/")
+		if full {
+			e.Path = cleanPath(name)
+		} else {
+			e.Path = cleanPath(path.Join(cwd, name))
+		}
+		if old, ok := byPath[e.Path]; ok {
+			for k, v := range e.Keywords {
+				old.Keywords[k] = v
+			}
+			old.Line = e.Line
+			e = old
+		} else {
+			byPath[e.Path] = e
+		}
+		if !full && e.Path != "." && e.Keywords["type"] == "dir" {
+			cwd = e.Path
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("mtree: %w", err)
+	}
+
+	spec := &Spec{Entries: make([]*Entry, 0, len(byPath))}
+	for _, e := range byPath {
+		spec.Entries = append(spec.Entries, e)
+	}
+	sort.Slice(spec.Entries, func(i, j int) bool { return spec.Entries[i].Path < spec.Entries[j].Path })
+	return spec, nil
+}
+
+// keyword splits and unescapes a keyword=value field.
+func keyword(f string) (string, string, error) {
+	k, v, ok := strings.Cut(f, "=")
+	if !ok {
+		return "", "", fmt.Errorf("keyword %q has no value", f)
+	}
+	v, err := Unescape(v)
+	return k, v, err
+}
+
+// Unescape decodes the backslash escapes of a path or value of a
+// specification: a backslash and three octal digits, and the C escapes
+// vis(3) writes.
+func Unescape(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			c, _ := strconv.ParseUint(s[i+1:i+4], 8, 8)
+			b.WriteByte(byte(c))
+			i += 3
+			continue
+		}
+		if i+1 == len(s) {
+			return "", fmt.Errorf("%q ends in a backslash", s)
+		}
+		i++
+		switch s[i] {
+		case 's':
+			b.WriteByte(' ')
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case '\\', '#', '=', '*', '?', '[', ']':
+			b.WriteByte(s[i])
+		default:
+			return "", fmt.Errorf("%q has an unknown escape \\%c", s, s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+func isOctal(c byte) bool { return '0' <= c && c <= '7' }
+
+// cleanPath spells a path of the specification as a path of an image,
+// without a leading "/" or "./".
+func cleanPath(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// types maps the type keyword to tar entry types.
+var types = map[string]byte{
+	"file":  tar.TypeReg,
+	"dir":   tar.TypeDir,
+	"link":  tar.TypeSymlink,
+	"char":  tar.TypeChar,
+	"block": tar.TypeBlock,
+	"fifo":  tar.TypeFifo,
+}
+
+// Type returns the tar type of the entry's type keyword, or 0 if it has
+// none.
+func (e *Entry) Type() (byte, error) {
+	t, ok := e.Keywords["type"]
+	if !ok {
+		return 0, nil
+	}
+	tf, ok := types[t]
+	if !ok {
+		return 0, e.errorf("unsupported type %q", t)
+	}
+	return tf, nil
+}
+
+// Header returns a header for the entry, for creating it where there is
+// nothing to apply it to. The entry must give its type; regular files
+// can't be created, having no content.
+func (e *Entry) Header() (*tar.Header, error) {
+	t, err := e.Type()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case 0:
+		return nil, e.errorf("has no type")
+	case tar.TypeReg:
+		return nil, e.errorf("is a file, which a specification can't give the content of")
+	}
+	hdr := &tar.Header{Typeflag: t, Name: e.Path, Mode: 0o755, ModTime: time.Unix(0, 0)}
+	switch t {
+	case tar.TypeChar, tar.TypeBlock:
+		if _, ok := e.Keywords["device"]; !ok {
+			return nil, e.errorf("is a device without a device keyword")
+		}
+		hdr.Mode = 0o600
+	case tar.TypeFifo:
+		hdr.Mode = 0o644
+	case tar.TypeSymlink:
+		if _, ok := e.Keywords["link"]; !ok {
+			return nil, e.errorf("is a link without a link keyword")
+		}
+		hdr.Mode = 0o777
+	}
+	return hdr, e.Apply(hdr)
+}
+
+// Apply overrides the metadata of hdr with the entry's mode, uid, gid,
+// time, and xattr.<name> keywords, the last base64-encoded as go-mtree
+// writes them, and with its link or device keyword for a symlink or device.
+// If the entry gives a type, hdr must be of it.
+func (e *Entry) Apply(hdr *tar.Header) error {
+	t, err := e.Type()
+	if err != nil {
+		return err
+	}
+	ht := hdr.Typeflag
+	if ht == tar.TypeRegA {
+		ht = tar.TypeReg
+	}
+	if t != 0 && t != ht {
+		return e.errorf("has type %s, but the image has a different type", e.Keywords["type"])
+	}
+
+	for k, v := range e.Keywords {
+		switch k {
+		case "mode":
+			m, err := strconv.ParseUint(v, 8, 12)
+			if err != nil {
+				return e.errorf("mode %q is not octal; symbolic modes are not supported", v)
+			}
+			hdr.Mode = hdr.Mode&^0o7777 | int64(m)
+		case "uid", "gid":
+			id, err := strconv.Atoi(v)
+			if err != nil || id < 0 {
+				return e.errorf("bad %s %q", k, v)
+			}
+			if k == "uid" {
+				hdr.Uid = id
+			} else {
+				hdr.Gid = id
+			}
+		case "time":
+			var sec, nsec int64
+			s, frac, _ := strings.Cut(v, ".")
+			sec, err := strconv.ParseInt(s, 10, 64)
+			if err == nil && frac != "" {
+				nsec, err = strconv.ParseInt(frac, 10, 64)
+			}
+			if err != nil {
+				return e.errorf("bad time %q", v)
+			}
+			hdr.ModTime = time.Unix(sec, nsec)
+		case "link":
+			if ht == tar.TypeSymlink {
+				hdr.Linkname = v
+			}
+		case "device":
+			if ht != tar.TypeChar && ht != tar.TypeBlock {
+				continue
+			}
+			f := strings.Split(v, ",")
+			if len(f) != 3 {
+				return e.errorf("device %q is not format,major,minor", v)
+			}
+			major, err := strconv.ParseInt(f[1], 0, 64)
+			minor, merr := strconv.ParseInt(f[2], 0, 64)
+			if err != nil || merr != nil {
+				return e.errorf("bad device %q", v)
+			}
+			hdr.Devmajor, hdr.Devminor = major, minor
+		default:
+			name, ok := strings.CutPrefix(k, "xattr.")
+			if !ok {
+				continue
+			}
+			b, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return e.errorf("xattr %s is not base64", name)
+			}
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords["SCHILY.xattr."+name] = string(b)
+		}
+	}
+	return nil
+}
+
+func (e *Entry) errorf(format string, args ...any) error {
+	return fmt.Errorf("mtree: line %d: %q %s", e.Line, e.Path, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,141 @@
+// Package netboot lays out a kernel and initramfs for network boot, with
+// the iPXE and PXELINUX configuration that loads them, in a directory that
+// can be served as-is over TFTP or HTTP.
+//
+// A bundle for DHCP class c occupies
+//
+//	<dir>/<c>/vmlinuz
+//	<dir>/<c>/initrd.img       (or initrd.img.000, .001, ... when split)
+//	<dir>/<c>/boot.ipxe
+//	<dir>/pxelinux.cfg/<c>
+//
+// so that bundles for several classes can share one server root. The DHCP
+// server picks the bundle for a client, e.g. by handing out <c>/boot.ipxe as
+// the boot file name, or pxelinux.cfg/<c> in the PXELINUX configfile option
+// (209). The class "default" is what PXELINUX falls back to when no more
+// specific configuration file exists.
+package netboot
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultClass is the class of a bundle that names none.
+const DefaultClass = "default"
+
+// Bundle describes a netboot bundle.
+type Bundle struct {
+	// Class is the DHCP class the bundle serves. It names the bundle's
+	// directory and PXELINUX configuration file.
+	Class string
+	// Cmdline is the kernel command line.
+	Cmdline string
+	// BaseURL, if set, is the URL the bundle directory is served at over
+	// HTTP. iPXE then fetches the kernel and initramfs from it instead of
+	// relative to the script.
+	BaseURL string
+	// Initrds are the file names of the initramfs volumes in load order,
+	// relative to the bundle directory.
+	Initrds []string
+}
+
+func (b *Bundle) class() string {
+	if b.Class == "" {
+		return DefaultClass
+	}
+	return b.Class
+}
+
+// Dir returns the directory of the bundle below the server root.
+func (b *Bundle) Dir(root string) (string, error) {
+	if c := b.class(); c == "." || c == ".." || strings.ContainsAny(c, "/\\") {
+		return "", fmt.Errorf("netboot: invalid class %q", b.Class)
+	}
+	return filepath.Join(root, b.class()), nil
+}
+
+// IPXE returns the iPXE script that boots the bundle.
+func (b *Bundle) IPXE() []byte {
+	base := b.BaseURL
+	if base != "" && !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	var buf bytes.Buffer
+	buf.WriteString("#!ipxe\n")
+	fmt.Fprintf(&buf, "kernel %svmlinuz", base)
+	if b.Cmdline != "" {
+		fmt.Fprintf(&buf, " %s", b.Cmdline)
+	}
+	buf.WriteString("\n")
+	for _, initrd := range b.Initrds {
+		fmt.Fprintf(&buf, "initrd %s%s\n", base, initrd)
+	}
+	buf.WriteString("boot\n")
+	return buf.Bytes()
+}
+
+// PXELinux returns the PXELINUX configuration that boots the bundle. Paths
+// in it are relative to the server root.
+func (b *Bundle) PXELinux() []byte {
+	initrds := make([]string, len(b.Initrds))
+	for i, initrd := range b.Initrds {
+		initrds[i] = path.Join(b.class(), initrd)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("DEFAULT ember\n")
+	buf.WriteString("LABEL ember\n")
+	fmt.Fprintf(&buf, "  KERNEL %s\n", path.Join(b.class(), "vmlinuz"))
+	if len(initrds) > 0 {
+		fmt.Fprintf(&buf, "  INITRD %s\n", strings.Join(initrds, ","))
+	}
+	if b.Cmdline != "" {
+		fmt.Fprintf(&buf, "  APPEND %s\n", b.Cmdline)
+	}
+	return buf.Bytes()
+}
+
+// Write copies the kernel at kernel into the bundle below root and writes
+// its boot configuration. The initramfs volumes must already be in place.
+func (b *Bundle) Write(root, kernel string) error {
+	dir, err := b.Dir(root)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := copyFile(kernel, filepath.Join(dir, "vmlinuz")); err != nil {
+		return fmt.Errorf("netboot: copy kernel: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "boot.ipxe"), b.IPXE(), 0o644); err != nil {
+		return err
+	}
+	cfg := filepath.Join(root, "pxelinux.cfg")
+	if err := os.MkdirAll(cfg, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(cfg, b.class()), b.PXELinux(), 0o644)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,155 @@
+package oci
+
+import (
+	"bytes"
+	_ "crypto/sha256" // Register the digest algorithm used by OCI blobs.
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// layout is where the files of a layout are read from: a directory, or the
+// fs.FS given to OpenFS.
+type layout struct {
+	dir  string // if fsys is nil
+	fsys fs.FS
+}
+
+func dirLayout(dir string) layout { return layout{dir: dir} }
+
+// open opens the file of the layout with the slash-separated name.
+func (l layout) open(name string) (fs.File, error) {
+	if l.fsys == nil {
+		return os.Open(filepath.Join(l.dir, filepath.FromSlash(name)))
+	}
+	return l.fsys.Open(name)
+}
+
+// readFile reads the file of the layout with the slash-separated name.
+func (l layout) readFile(name string) ([]byte, error) {
+	if l.fsys == nil {
+		return os.ReadFile(filepath.Join(l.dir, filepath.FromSlash(name)))
+	}
+	return fs.ReadFile(l.fsys, name)
+}
+
+// openBlob opens the content addressed by desc. Blobs are normally files
+// under blobs/<alg>/<encoded>, but a descriptor may instead embed a small
+// blob in its data field; that copy is used when the file is absent, as
+// happens with layouts assembled by some artifact tooling.
+func openBlob(l layout, desc specs.Descriptor) (io.ReadCloser, error) {
+	f, err := l.open(blobName(desc))
+	if err == nil {
+		return f, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) || desc.Data == nil {
+		return nil, err
+	}
+	if err := verifyData(desc); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(desc.Data)), nil
+}
+
+// errMmapUnsupported is returned by mmapFile on platforms or for files
+// that cannot be memory-mapped.
+var errMmapUnsupported = errors.New("mmap not supported")
+
+// mapBlob is like openBlob but memory-maps the blob file where the platform
+// allows it, and the layout is a directory.
+func mapBlob(l layout, desc specs.Descriptor) (io.ReadCloser, error) {
+	if l.fsys != nil {
+		return openBlob(l, desc)
+	}
+	b, unmap, err := mmapFile(blobPath(l.dir, desc))
+	if errors.Is(err, errMmapUnsupported) || errors.Is(err, fs.ErrNotExist) {
+		return openBlob(l, desc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &mappedBlob{Reader: bytes.NewReader(b), unmap: unmap}, nil
+}
+
+// mappedBlob reads a memory-mapped blob. bytes.Reader implements
+// io.ByteReader and io.WriterTo, so neither gzip nor io.Copy add buffers of
+// their own on top of the mapping.
+type mappedBlob struct {
+	*bytes.Reader
+	unmap func() error
+}
+
+func (m *mappedBlob) Close() error {
+	if m.unmap == nil {
+		return nil
+	}
+	err := m.unmap()
+	m.unmap = nil
+	return err
+}
+
+// readAheadBlob is like openBlob but reads the blob file through a
+// readAhead of the given depth.
+func readAheadBlob(l layout, desc specs.Descriptor, depth int) (io.ReadCloser, error) {
+	rc, err := openBlob(l, desc)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := rc.(*os.File)
+	if !ok {
+		return rc, nil // embedded data, or a file of an fs.FS
+	}
+	ra, err := newReadAhead(f, depth)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return ra, nil
+}
+
+// readBlob reads the whole blob addressed by desc.
+func readBlob(l layout, desc specs.Descriptor) ([]byte, error) {
+	b, err := l.readFile(blobName(desc))
+	if err == nil {
+		return b, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) || desc.Data == nil {
+		return nil, err
+	}
+	if err := verifyData(desc); err != nil {
+		return nil, err
+	}
+	return desc.Data, nil
+}
+
+func blobPath(layoutDir string, desc specs.Descriptor) string {
+	return filepath.Join(layoutDir, filepath.FromSlash(blobName(desc)))
+}
+
+func blobName(desc specs.Descriptor) string {
+	return path.Join("blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+}
+
+// verifyData checks embedded data against the descriptor, as the image
+// spec requires before the data may be used.
+func verifyData(desc specs.Descriptor) error {
+	if int64(len(desc.Data)) != desc.Size {
+		return fmt.Errorf("blob %s: embedded data is %d bytes, descriptor says %d", desc.Digest, len(desc.Data), desc.Size)
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		return fmt.Errorf("blob %s: %w", desc.Digest, err)
+	}
+	if !desc.Digest.Algorithm().Available() {
+		return fmt.Errorf("blob %s: unsupported digest algorithm", desc.Digest)
+	}
+	if got := desc.Digest.Algorithm().FromBytes(desc.Data); got != desc.Digest {
+		return fmt.Errorf("blob %s: embedded data has digest %s", desc.Digest, got)
+	}
+	return nil
+}
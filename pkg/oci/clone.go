@@ -0,0 +1,51 @@
+package oci
+
+import "fmt"
+
+// Clone returns a new Reader over the same image, from its first entry,
+// with the options r was opened with. It shares what Open parsed, the
+// index, manifest, and config, which are read-only, and opens the layers
+// anew, so that several passes over an image can run in parallel, each with
+// a Reader of its own, without parsing the layout again. r may have been
+// read from; Clone does not use its position. A Reader and its clones must
+// not be used from several goroutines at once, but each can be used from
+// its own. Each clone must be closed as r must.
+func (r *Reader) Clone() (*Reader, error) {
+	return r.clone(r.opts)
+}
+
+// clone is Clone, with options o instead of r's.
+func (r *Reader) clone(o options) (*Reader, error) {
+	c := &Reader{
+		layout:    r.layout,
+		desc:      r.desc,
+		manifest:  r.manifest,
+		config:    r.config,
+		descs:     r.descs,
+		dirLayers: r.dirLayers,
+		layers:    make([]*layerReader, len(r.descs)),
+		progress:  newCounters(len(r.descs)),
+		pos:       -1,
+		opts:      o,
+	}
+	c.track()
+	for pos := range c.descs {
+		if pos < len(c.dirLayers) && c.dirLayers[pos] != nil {
+			c.layers[pos] = openDirLayer(c.dirLayers[pos], c.Warn, c.progress[pos])
+			continue
+		}
+		if c.skips(pos) {
+			continue
+		}
+		lr, err := openLayer(c.layout, c.descs[pos], &c.opts, c.progress[pos])
+		if err != nil {
+			if !c.opts.keepGoing {
+				c.Close()
+				return nil, err
+			}
+			c.fail(pos, "", fmt.Errorf("open layer: %w", err))
+		}
+		c.layers[pos] = lr
+	}
+	return c, nil
+}
@@ -0,0 +1,99 @@
+package oci_test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/oci"
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+// openFiles returns the number of files the process has open, or skips
+// the test where that can't be told.
+func openFiles(t *testing.T) int {
+	t.Helper()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("no /proc/self/fd")
+	}
+	return len(fds)
+}
+
+// Close closes the layers, read ahead or not, and the path sets spilled
+// under the memory limit, whether the Reader was read to its end, read
+// from in part, or not at all.
+func TestClose(t *testing.T) {
+	lower, upper := ocitest.NewLayer().Dir("d"), ocitest.NewLayer().Dir("d")
+	for i := 0; i < 500; i++ {
+		name := fmt.Sprintf("d/f%03d", i)
+		lower.File(name, "lower")
+		if i%2 == 0 {
+			upper.Whiteout(name)
+		}
+	}
+	dir := ocitest.Layout(t, ocitest.New(lower, upper, ocitest.NewLayer().File("top", "t")))
+	for _, tc := range []struct {
+		name    string
+		entries int // to read, or -1 for all
+		opts    []oci.Option
+	}{
+		{"unread", 0, nil},
+		{"in part", 300, []oci.Option{oci.WithMemoryLimit(1 << 10)}},
+		{"read ahead", 3, []oci.Option{oci.WithReadAhead(4)}},
+		{"to the end", -1, []oci.Option{oci.WithMemoryLimit(1 << 10), oci.WithHardLinks()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := openFiles(t)
+			r, err := oci.Open(dir, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i != tc.entries; i++ {
+				if _, err := r.Next(); err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if after := openFiles(t); after != before {
+				t.Errorf("%d files open after Close, %d before Open", after, before)
+			}
+			if _, err := r.Next(); err != io.EOF {
+				t.Errorf("Next() after Close = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+// A clone failing to open a layer closes those it opened, past the layers
+// the Reader skips.
+func TestCloneFailure(t *testing.T) {
+	img := ocitest.New(
+		ocitest.NewLayer().File("a", "base"),
+		ocitest.NewLayer().File("b", "foreign").MediaType("application/vnd.example.layer.v1.tar+bzip2"),
+	)
+	dir := ocitest.Layout(t, img)
+	r, err := oci.Open(dir, oci.WithSkipUnsupportedLayers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	base := r.Manifest().Layers[0].Digest
+	if err := os.Remove(filepath.Join(dir, "blobs", base.Algorithm().String(), base.Encoded())); err != nil {
+		t.Fatal(err)
+	}
+	before := openFiles(t)
+	if c, err := r.Clone(); err == nil {
+		c.Close()
+		t.Fatal("Clone() without the base layer's blob succeeded")
+	}
+	if after := openFiles(t); after != before {
+		t.Errorf("%d files open after the failed Clone, %d before", after, before)
+	}
+}
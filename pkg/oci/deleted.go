@@ -0,0 +1,98 @@
+package oci
+
+import (
+	"path"
+	"slices"
+
+	"github.com/hxtk/ember/internal/pathset"
+)
+
+// Deletion records an entry of a lower layer that a whiteout or opaque
+// marker of a layer above kept out of the merged view.
+type Deletion struct {
+	Path      string `json:"path"`
+	Layer     int    `json:"layer"`     // position of the entry's layer in the manifest, base first
+	DeletedBy int    `json:"deletedBy"` // position of the deleting layer
+	Marker    string `json:"marker"`    // the whiteout, opaque marker, or replacing entry responsible
+}
+
+// WithDeletions makes the Reader record every entry it drops because a
+// layer above deleted it, for example to check that a secret removed in a
+// later layer doesn't reach the output. Entries merely shadowed by an
+// upper layer's version of the same path are not deletions.
+//
+// The recorded entries are available from Deletions once reading is done.
+// They, and the markers of all layers read, count against WithMemoryLimit.
+func WithDeletions() Option {
+	return func(o *options) { o.deletions = true }
+}
+
+// Deletions returns the entries dropped so far by whiteouts and opaque
+// markers, in reading order. It is empty unless the Reader was opened
+// WithDeletions. The slice returned is in memory as a whole, whatever
+// WithMemoryLimit spilled.
+func (r *Reader) Deletions() []Deletion {
+	if r.deletions == nil {
+		return nil
+	}
+	return slices.Collect(r.deletions.All())
+}
+
+// A marker is a whiteout, an opaque marker or, with
+// WithTypeChangeReplacement, a non-directory entry: something that hides
+// paths of lower layers.
+// Its fields are exported for its codec only.
+type marker struct {
+	Name    string // the marker entry itself
+	Target  string // the path it applies to
+	Subtree bool   // whether it hides target's descendants only
+	Pos     int    // position of its layer in reading order
+}
+
+// mark records a marker of cur, if deletions are being recorded.
+func (r *Reader) mark(name, target string, subtree bool) {
+	if r.opts.deletions {
+		r.curMarkers.Append(marker{name, target, subtree, r.pos})
+	}
+}
+
+// recordDeletion records the entry name of cur, which is hidden, if one of
+// the markers of the layers above deleted it. The lowest such layer is
+// the one that deleted it; any above it re-deleted a path already gone.
+func (r *Reader) recordDeletion(name string) {
+	if !r.opts.deletions {
+		return
+	}
+	var by *marker
+	for p := name; ; p = path.Dir(p) {
+		if m, ok := r.markers.Get(p); ok && (p != name || !m.Subtree) && (by == nil || m.Pos > by.Pos) {
+			by = &m
+		}
+		if p == "." {
+			break
+		}
+	}
+	if by == nil {
+		return // shadowed, not deleted
+	}
+	r.deletions.Append(Deletion{
+		Path:      name,
+		Layer:     len(r.descs) - 1 - r.pos,
+		DeletedBy: len(r.descs) - 1 - by.Pos,
+		Marker:    by.Name,
+	})
+}
+
+// commitMarkers applies the markers of the layer just read to the layers
+// below it. A lower layer's marker for the same target replaces an upper
+// one, so that markers always name the lowest layer deleting a path.
+func (r *Reader) commitMarkers() {
+	if !r.opts.deletions || r.curMarkers.Len() == 0 {
+		return
+	}
+	for m := range r.curMarkers.All() {
+		r.markers.Put(m.Target, m)
+	}
+	r.curMarkers.Close()
+	r.curMarkers = pathset.NewLog(r.budget, pathset.JSON[marker]())
+}
@@ -0,0 +1,152 @@
+package oci
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hxtk/ember/internal/pathset"
+)
+
+// layerDirs is what a layer says about directories: the headers of the
+// directories it defines, and the paths its whiteouts and opaque markers
+// hide in the layers below it, with everything below them.
+type layerDirs struct {
+	dirs   *pathset.Map[*tar.Header]
+	hidden *pathset.Set
+}
+
+func newLayerDirs(b *pathset.Budget) *layerDirs {
+	return &layerDirs{dirs: pathset.NewMap(b, pathset.JSON[*tar.Header]()), hidden: pathset.New(b)}
+}
+
+// hides reports whether the layer hides p in the layers below it.
+func (l *layerDirs) hides(p string) bool {
+	for ; ; p = path.Dir(p) {
+		if l.hidden.Has(p) {
+			return true
+		}
+		if p == "." {
+			return false
+		}
+	}
+}
+
+// Close removes the temporary files of l.
+func (l *layerDirs) Close() error {
+	return errors.Join(l.dirs.Close(), l.hidden.Close())
+}
+
+// missingParents returns headers for the ancestors of name that haven't
+// been returned yet, outermost first, and marks them as returned.
+//
+// Layers don't have to include the parents of their entries, and within a
+// layer a directory may come after its contents, but the kernel only
+// creates an entry whose parent already exists. Each missing directory
+// gets the metadata of the topmost layer that defines it, as on an overlay
+// mount, or mode 0755 owned by root if no visible layer does.
+func (r *Reader) missingParents(name string) ([]*tar.Header, error) {
+	var missing []string
+	for d := path.Dir(name); d != "." && !r.hidden(r.seen, d); d = path.Dir(d) {
+		missing = append(missing, d)
+	}
+	if err := r.setErr(); err != nil {
+		return nil, err
+	}
+
+	var parents []*tar.Header
+	for i := len(missing) - 1; i >= 0; i-- {
+		d := missing[i]
+		hdr, err := r.definedDir(d)
+		if err != nil {
+			return nil, fmt.Errorf("parent directory of %q: %w", name, err)
+		}
+		r.seen.Put(d, returned)
+		parents = append(parents, hdr)
+	}
+	return parents, r.setErr()
+}
+
+// definedDir returns the header of directory d from the topmost layer, from
+// the current one down, that defines it and doesn't have it hidden by a
+// layer above.
+func (r *Reader) definedDir(d string) (*tar.Header, error) {
+	for p := r.pos; p < len(r.descs); p++ {
+		l, err := r.layerDirs(p)
+		if err != nil {
+			return nil, err
+		}
+		if hdr, ok := l.dirs.Get(d); ok {
+			h := *hdr
+			h.Name = d
+			return &h, nil
+		}
+		if l.hides(d) {
+			break
+		}
+	}
+	return &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     d,
+		Mode:     0o755,
+		ModTime:  time.Unix(0, 0),
+	}, nil
+}
+
+// layerDirs returns the directory information of the layer at pos,
+// reading the layer once to collect it. A layer that fails to read
+// contributes nothing if the Reader keeps going; the failure itself is
+// reported when the layer is merged.
+func (r *Reader) layerDirs(pos int) (*layerDirs, error) {
+	if l, ok := r.dirIndex[pos]; ok {
+		return l, nil
+	}
+	l, err := r.scanDirs(pos)
+	if err != nil {
+		if !r.opts.keepGoing {
+			return nil, err
+		}
+		l = newLayerDirs(r.budget)
+	}
+	if r.dirIndex == nil {
+		r.dirIndex = make(map[int]*layerDirs)
+	}
+	r.dirIndex[pos] = l
+	return l, nil
+}
+
+func (r *Reader) scanDirs(pos int) (*layerDirs, error) {
+	lr, err := r.openLayer(pos)
+	if err != nil {
+		return nil, err
+	}
+	defer lr.Close()
+
+	l := newLayerDirs(r.budget)
+	for {
+		hdr, err := lr.Next()
+		if err == io.EOF {
+			return l, nil
+		}
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		name := cleanPath(hdr.Name)
+		base := path.Base(name)
+		switch {
+		case base == ".wh..wh..opq":
+			l.hidden.Add(path.Dir(name))
+		case strings.HasPrefix(base, ".wh."):
+			l.hidden.Add(path.Join(path.Dir(name), strings.TrimPrefix(base, ".wh.")))
+		case hdr.Typeflag == tar.TypeDir:
+			if _, ok := l.dirs.Get(name); !ok {
+				l.dirs.Put(name, hdr)
+			}
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package oci
+
+import (
+	"archive/tar"
+	"io"
+	"iter"
+)
+
+// Entries returns an iterator over the entries Next returns, each with
+// the reader of its content, which is valid until the iteration advances.
+// The iteration stops at the end of the image or at the first error, which
+// Err then returns.
+//
+//	for hdr, content := range r.Entries() {
+//		...
+//	}
+//	if err := r.Err(); err != nil {
+//		...
+//	}
+func (r *Reader) Entries() iter.Seq2[*tar.Header, io.Reader] {
+	return func(yield func(*tar.Header, io.Reader) bool) {
+		for {
+			hdr, err := r.Next()
+			if err != nil {
+				if err != io.EOF {
+					r.iterErr = err
+				}
+				return
+			}
+			if !yield(hdr, r) {
+				return
+			}
+		}
+	}
+}
+
+// Err returns the error that stopped an iteration of Entries, or nil if it
+// reached the end of the image.
+func (r *Reader) Err() error {
+	return r.iterErr
+}
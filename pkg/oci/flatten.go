@@ -0,0 +1,117 @@
+package oci
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"maps"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// FlattenCreatedBy is the created_by of the history entry Flatten adds.
+const FlattenCreatedBy = "ember flatten"
+
+// Flatten writes the merged filesystem of r into w as a single-layer image
+// and returns the descriptor of its manifest, ready for AddManifest.
+//
+// The layer is a gzip-compressed tar of the merged view as a clone of r
+// opened WithHardLinks returns it, so whiteouts are already applied and
+// the hard links within a layer stay hard links, TypeLink entries after
+// the file they name. The config is r's with the one diff ID; the original
+// history entries are kept but marked empty, since their layers are gone,
+// and an entry recording the flattening is added. The manifest keeps r's
+// annotations, and the returned descriptor those of r's descriptor,
+// including its reference name. r itself is not read from.
+func Flatten(r *Reader, w *LayoutWriter) (specs.Descriptor, error) {
+	o := r.opts
+	o.hardLinks = true
+	c, err := r.clone(o)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	layer, diffID, err := writeFlatLayer(c, w)
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+
+	var config specs.Image
+	if c := r.Config(); c != nil {
+		config = *c
+	}
+	config.RootFS = specs.RootFS{Type: "layers", DiffIDs: []digest.Digest{diffID}}
+	history := make([]specs.History, 0, len(config.History)+1)
+	for _, h := range config.History {
+		h.EmptyLayer = true
+		history = append(history, h)
+	}
+	config.History = append(history, specs.History{
+		Created:   config.Created, // keep the output reproducible
+		CreatedBy: FlattenCreatedBy,
+		Comment:   fmt.Sprintf("flattened %d layers of %s", len(r.Manifest().Layers), r.Descriptor().Digest),
+	})
+	cdesc, err := w.WriteJSON(specs.MediaTypeImageConfig, config)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+
+	m := specs.Manifest{
+		MediaType:   specs.MediaTypeImageManifest,
+		Config:      cdesc,
+		Layers:      []specs.Descriptor{layer},
+		Annotations: maps.Clone(r.Manifest().Annotations),
+	}
+	m.SchemaVersion = 2
+	desc, err := w.WriteJSON(specs.MediaTypeImageManifest, m)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	desc.Annotations = maps.Clone(r.Descriptor().Annotations)
+	desc.Platform = r.Descriptor().Platform
+	return desc, nil
+}
+
+// writeFlatLayer writes the merged view of r, opened WithHardLinks, as a
+// layer blob and returns its descriptor and diff ID.
+func writeFlatLayer(r *Reader, w *LayoutWriter) (specs.Descriptor, digest.Digest, error) {
+	bw, err := w.NewBlob()
+	if err != nil {
+		return specs.Descriptor{}, "", err
+	}
+	defer bw.Close()
+	zw := gzip.NewWriter(bw)
+	diffID := digest.Canonical.Digester()
+	tw := tar.NewWriter(io.MultiWriter(zw, diffID.Hash()))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return specs.Descriptor{}, "", err
+		}
+		h := *hdr
+		h.Format = tar.FormatPAX // keep sub-second times, long names and xattrs
+		if err := tw.WriteHeader(&h); err != nil {
+			return specs.Descriptor{}, "", fmt.Errorf("write %s: %w", h.Name, err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			if _, err := io.Copy(tw, r); err != nil {
+				return specs.Descriptor{}, "", fmt.Errorf("copy %s: %w", h.Name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return specs.Descriptor{}, "", err
+	}
+	if err := zw.Close(); err != nil {
+		return specs.Descriptor{}, "", err
+	}
+	desc, err := bw.Commit(specs.MediaTypeImageLayerGzip)
+	return desc, diffID.Digest(), err
+}
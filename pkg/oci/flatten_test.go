@@ -0,0 +1,73 @@
+package oci_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/convert"
+	"github.com/hxtk/ember/pkg/cpio"
+	"github.com/hxtk/ember/pkg/oci"
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+// build converts the image of the layout dir into an archive, reading it
+// as ember build does.
+func build(t *testing.T, dir string) []byte {
+	t.Helper()
+	r, err := oci.Open(dir, oci.WithHardLinks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var buf bytes.Buffer
+	w := cpio.NewWriter(&buf)
+	if err := convert.Convert(r, w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// flatten flattens the image of the layout dir into a new layout, and
+// returns the new layout's directory.
+func flatten(t *testing.T, dir string, opts ...oci.Option) string {
+	t.Helper()
+	r, err := oci.Open(dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	out := filepath.Join(t.TempDir(), "flat")
+	w, err := oci.CreateLayout(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := oci.Flatten(r, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddManifest(desc); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// A flattened image builds to the same archive as the image, hard links
+// and all, however the Reader given to Flatten was opened.
+func TestFlattenBuildsTheSame(t *testing.T) {
+	dir := ocitest.Layout(t, ocitest.New(
+		base(),
+		busybox(),
+		ocitest.NewLayer().Whiteout("etc/motd").File("bin/busybox", "new").Hardlink("bin/true", "bin/busybox"),
+	))
+	want := build(t, dir)
+	for _, opts := range [][]oci.Option{nil, {oci.WithHardLinks()}} {
+		got := build(t, flatten(t, dir, opts...))
+		if d, err := cpio.Difference(bytes.NewReader(want), bytes.NewReader(got), cpio.EqualOptions{}); d != "" || err != nil {
+			t.Errorf("build of the flattened image differs: %s %v", d, err)
+		}
+	}
+}
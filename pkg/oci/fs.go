@@ -0,0 +1,260 @@
+package oci
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// FS is a random-access view of the merged filesystem of an image, for
+// browsing it rather than streaming it. NewFS builds it by reading the
+// image once; file contents are spooled to an unlinked temporary file, so
+// memory holds only the entries' metadata.
+//
+// FS implements fs.FS, fs.StatFS, fs.ReadDirFS, and fs.ReadLinkFS. Like
+// os.DirFS, Open and Stat follow symbolic links, including absolute ones,
+// which resolve against the image root. FileInfo.Sys returns the entry's
+// *tar.Header.
+type FS struct {
+	nodes map[string]*fsNode
+	spool *os.File
+}
+
+type fsNode struct {
+	hdr      *tar.Header
+	off      int64    // offset of the content in the spool
+	children []string // sorted base names, for directories
+}
+
+// maxSymlinks bounds how many symbolic links FS follows resolving a path.
+const maxSymlinks = 40
+
+// NewFS reads the rest of r into an FS. The caller must Close it to remove
+// the spool.
+func NewFS(r *Reader) (*FS, error) {
+	spool, err := os.CreateTemp("", "ember-fs-*")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(spool.Name()) // keep it only as long as it is open
+	f := &FS{nodes: make(map[string]*fsNode), spool: spool}
+	f.nodes["."] = &fsNode{hdr: &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     ".",
+		Mode:     0o755,
+		ModTime:  time.Unix(0, 0),
+	}}
+
+	var off int64
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			spool.Close()
+			return nil, err
+		}
+		n := &fsNode{hdr: hdr, off: off}
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			if _, err := io.CopyN(spool, r, hdr.Size); err != nil {
+				spool.Close()
+				return nil, err
+			}
+			off += hdr.Size
+		}
+		name := cleanPath(hdr.Name)
+		if name == "." {
+			if hdr.Typeflag == tar.TypeDir {
+				f.nodes["."].hdr = hdr
+			}
+			continue
+		}
+		f.nodes[name] = n
+	}
+	for name := range f.nodes {
+		if name == "." {
+			continue
+		}
+		if parent := f.nodes[path.Dir(name)]; parent != nil {
+			parent.children = append(parent.children, path.Base(name))
+		}
+	}
+	for _, n := range f.nodes {
+		slices.Sort(n.children)
+	}
+	return f, nil
+}
+
+// Close removes the spool.
+func (f *FS) Close() error {
+	return f.spool.Close()
+}
+
+// resolve returns the cleaned path and node that name refers to,
+// following symbolic links in its directories, and in its last element too
+// if follow is set.
+func (f *FS) resolve(op, name string, follow bool) (string, *fsNode, error) {
+	if !fs.ValidPath(name) {
+		return "", nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	links := 0
+	cur := "."
+	rest := name
+	for rest != "" && rest != "." {
+		elem, tail, _ := strings.Cut(rest, "/")
+		rest = tail
+		next := path.Join(cur, elem)
+		n := f.nodes[next]
+		if n == nil {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if n.hdr.Typeflag == tar.TypeSymlink && (rest != "" || follow) {
+			if links++; links > maxSymlinks {
+				return "", nil, &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+			}
+			// Resolve the target against the image root, so that neither
+			// an absolute target nor ".." can escape it.
+			target := n.hdr.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(cur, target)
+			}
+			rest = inRoot(path.Join(target, rest))
+			cur = "."
+			continue
+		}
+		if rest != "" && n.hdr.Typeflag != tar.TypeDir {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		cur = next
+	}
+	return cur, f.nodes[cur], nil
+}
+
+// inRoot cleans p as a path relative to the image root, dropping ".."
+// elements that would climb above it.
+func inRoot(p string) string {
+	if p = path.Clean("/" + p); p == "/" {
+		return "."
+	}
+	return p[1:]
+}
+
+// Open implements fs.FS.
+func (f *FS) Open(name string) (fs.File, error) {
+	p, n, err := f.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &fsFile{fs: f, name: p, node: n, r: io.NewSectionReader(f.spool, n.off, n.size())}, nil
+}
+
+// Stat implements fs.StatFS.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	_, n, err := f.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(), nil
+}
+
+// Lstat implements fs.ReadLinkFS. It doesn't follow a symbolic link in the
+// last element of name.
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	_, n, err := f.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(), nil
+}
+
+// ReadLink implements fs.ReadLinkFS.
+func (f *FS) ReadLink(name string) (string, error) {
+	_, n, err := f.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if n.hdr.Typeflag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return n.hdr.Linkname, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, n, err := f.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if n.hdr.Typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return f.entries(p, n), nil
+}
+
+func (f *FS) entries(p string, n *fsNode) []fs.DirEntry {
+	entries := make([]fs.DirEntry, 0, len(n.children))
+	for _, c := range n.children {
+		entries = append(entries, fs.FileInfoToDirEntry(f.nodes[path.Join(p, c)].info()))
+	}
+	return entries
+}
+
+func (n *fsNode) size() int64 {
+	if n.hdr.Typeflag == tar.TypeReg {
+		return n.hdr.Size
+	}
+	return 0
+}
+
+func (n *fsNode) info() fs.FileInfo {
+	return n.hdr.FileInfo()
+}
+
+// fsFile is an open file of an FS.
+type fsFile struct {
+	fs   *FS
+	name string
+	node *fsNode
+	r    *io.SectionReader
+	dir  []fs.DirEntry // unread entries, once ReadDir has started
+	read bool          // whether ReadDir has started
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.node.info(), nil }
+func (f *fsFile) Read(p []byte) (int, error) { return f.r.Read(p) }
+func (f *fsFile) Close() error               { return nil }
+
+// ReadAt implements io.ReaderAt, so files can be read concurrently.
+func (f *fsFile) ReadAt(p []byte, off int64) (int, error) { return f.r.ReadAt(p, off) }
+
+// Seek implements io.Seeker.
+func (f *fsFile) Seek(off int64, whence int) (int64, error) { return f.r.Seek(off, whence) }
+
+// ReadDir implements fs.ReadDirFile.
+func (f *fsFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.node.hdr.Typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+	}
+	if !f.read {
+		f.dir, f.read = f.fs.entries(f.name, f.node), true
+	}
+	if n <= 0 {
+		d := f.dir
+		f.dir = nil
+		return d, nil
+	}
+	if len(f.dir) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(f.dir))
+	d := f.dir[:n]
+	f.dir = f.dir[n:]
+	return d, nil
+}
@@ -0,0 +1,280 @@
+package oci
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LayoutReport is the result of checking the blobs of a layout against the
+// manifests reachable from its index.json.
+type LayoutReport struct {
+	Referenced int // distinct blobs reachable from index.json
+
+	Missing      []specs.Descriptor // reachable blobs the layout lacks
+	Corrupt      []BlobError        // reachable blobs with the wrong size or content
+	Unreferenced []UnreferencedBlob // blobs no reachable manifest lists
+	Temporary    []string           // leftovers of interrupted writes
+}
+
+// BlobError is a problem with a reachable blob.
+type BlobError struct {
+	Desc specs.Descriptor
+	Err  error
+}
+
+func (e BlobError) Error() string { return e.Err.Error() }
+
+// UnreferencedBlob is a blob file that no reachable manifest lists.
+type UnreferencedBlob struct {
+	Digest digest.Digest
+	Size   int64
+}
+
+// OK reports whether every reachable blob is present and intact.
+// Unreferenced blobs and temporary files are garbage rather than damage.
+func (r *LayoutReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Corrupt) == 0
+}
+
+// complete reports whether every reachable index and manifest could be
+// read, so that the unreferenced blobs are known to be unreachable.
+func (r *LayoutReport) complete() bool {
+	for _, d := range r.Missing {
+		if listsBlobs(d.MediaType) {
+			return false
+		}
+	}
+	for _, e := range r.Corrupt {
+		if listsBlobs(e.Desc.MediaType) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckLayout checks the layout at dir: every blob reachable from its
+// index.json, through nested indexes, manifests, and their configs and
+// layers, must be present with the size its descriptor gives, and blobs
+// that nothing reaches are listed as unreferenced. Indexes and manifests
+// are always checked against their digests, since they are read anyway;
+// other blobs are too if digests is set, which reads the whole layout.
+//
+// Blobs embedded in their descriptor, and non-distributable layers or
+// layers with URLs, may be absent without being missing.
+//
+// OCI and Docker schema 2 manifests and indexes are followed; other
+// artifacts are treated as opaque blobs.
+func CheckLayout(dir string, digests bool) (*LayoutReport, error) {
+	idx, err := loadIndex(dirLayout(dir))
+	if err != nil {
+		return nil, fmt.Errorf("read index.json: %w", err)
+	}
+	c := &layoutChecker{dir: dir, digests: digests, seen: make(map[digest.Digest]bool)}
+	for _, d := range idx.Manifests {
+		c.check(d)
+	}
+	if err := c.sweep(); err != nil {
+		return nil, err
+	}
+	c.r.Referenced = len(c.seen)
+	return &c.r, nil
+}
+
+type layoutChecker struct {
+	dir     string
+	digests bool
+	seen    map[digest.Digest]bool
+	r       LayoutReport
+}
+
+// listsBlobs reports whether blobs of the media type reference other blobs.
+func listsBlobs(mediaType string) bool {
+	switch mediaType {
+	case specs.MediaTypeImageIndex, specs.MediaTypeImageManifest,
+		"application/vnd.docker.distribution.manifest.list.v2+json",
+		"application/vnd.docker.distribution.manifest.v2+json":
+		return true
+	}
+	return false
+}
+
+// blobRefs holds the references of an index or manifest, whichever it is.
+type blobRefs struct {
+	Config    *specs.Descriptor  `json:"config"`
+	Layers    []specs.Descriptor `json:"layers"`
+	Manifests []specs.Descriptor `json:"manifests"`
+}
+
+func (c *layoutChecker) check(d specs.Descriptor) {
+	if err := d.Digest.Validate(); err != nil {
+		c.r.Corrupt = append(c.r.Corrupt, BlobError{d, fmt.Errorf("blob %s: %w", d.Digest, err)})
+		return
+	}
+	if c.seen[d.Digest] {
+		return
+	}
+	c.seen[d.Digest] = true
+
+	fi, err := os.Stat(blobPath(c.dir, d))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if d.Data != nil {
+			if err := verifyData(d); err != nil {
+				c.r.Corrupt = append(c.r.Corrupt, BlobError{d, err})
+				return
+			}
+		} else if len(d.URLs) == 0 && !nonDistributable(d.MediaType) {
+			c.r.Missing = append(c.r.Missing, d)
+			return
+		}
+		if !listsBlobs(d.MediaType) {
+			return
+		}
+	case err != nil:
+		c.r.Corrupt = append(c.r.Corrupt, BlobError{d, err})
+		return
+	case fi.Size() != d.Size:
+		c.r.Corrupt = append(c.r.Corrupt, BlobError{d, fmt.Errorf("blob %s: size is %d bytes, descriptor says %d", d.Digest, fi.Size(), d.Size)})
+		return
+	}
+
+	if !listsBlobs(d.MediaType) {
+		if c.digests {
+			if err := c.verify(d); err != nil {
+				c.r.Corrupt = append(c.r.Corrupt, BlobError{d, err})
+			}
+		}
+		return
+	}
+	b, err := readBlob(dirLayout(c.dir), d)
+	if err == nil && d.Digest.Algorithm().Available() && d.Digest.Algorithm().FromBytes(b) != d.Digest {
+		err = fmt.Errorf("blob %s: %w, content has digest %s", d.Digest, ErrDigestMismatch, d.Digest.Algorithm().FromBytes(b))
+	}
+	var refs blobRefs
+	if err == nil {
+		if err = json.Unmarshal(b, &refs); err != nil {
+			err = fmt.Errorf("blob %s: %w", d.Digest, err)
+		}
+	}
+	if err != nil {
+		c.r.Corrupt = append(c.r.Corrupt, BlobError{d, err})
+		return
+	}
+	if refs.Config != nil {
+		c.check(*refs.Config)
+	}
+	for _, l := range refs.Layers {
+		c.check(l)
+	}
+	for _, m := range refs.Manifests {
+		c.check(m)
+	}
+}
+
+// verify reads the blob of d and checks it against its digest.
+func (c *layoutChecker) verify(d specs.Descriptor) error {
+	f, err := os.Open(blobPath(c.dir, d))
+	if err != nil {
+		return err
+	}
+	v, err := newVerifyingReader(f, d)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	defer v.Close()
+	return v.finish()
+}
+
+// sweep lists the blob files that check didn't reach and the temporary
+// files of unfinished blob and index writes.
+func (c *layoutChecker) sweep() error {
+	if err := c.temporary(c.dir, ".index-"); err != nil {
+		return err
+	}
+	blobs := filepath.Join(c.dir, "blobs")
+	if err := c.temporary(blobs, ".tmp-"); err != nil {
+		return err
+	}
+	algs, err := os.ReadDir(blobs)
+	if err != nil {
+		return err
+	}
+	for _, alg := range algs {
+		if !alg.IsDir() {
+			continue
+		}
+		ents, err := os.ReadDir(filepath.Join(blobs, alg.Name()))
+		if err != nil {
+			return err
+		}
+		for _, e := range ents {
+			d := digest.NewDigestFromEncoded(digest.Algorithm(alg.Name()), e.Name())
+			if c.seen[d] || !e.Type().IsRegular() {
+				continue
+			}
+			fi, err := e.Info()
+			if err != nil {
+				return err
+			}
+			c.r.Unreferenced = append(c.r.Unreferenced, UnreferencedBlob{d, fi.Size()})
+		}
+	}
+	sort.Slice(c.r.Unreferenced, func(i, j int) bool { return c.r.Unreferenced[i].Digest < c.r.Unreferenced[j].Digest })
+	return nil
+}
+
+func (c *layoutChecker) temporary(dir, prefix string) error {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range ents {
+		if strings.HasPrefix(e.Name(), prefix) {
+			c.r.Temporary = append(c.r.Temporary, filepath.Join(dir, e.Name()))
+		}
+	}
+	return nil
+}
+
+// GCLayout removes the unreferenced blobs and temporary files that
+// CheckLayout finds in the layout at dir and returns its report, without
+// removing anything if dryRun is set. It refuses to run when an index or
+// manifest reachable from index.json is missing or unreadable, since the
+// blobs that one lists would look unreferenced.
+//
+// Nothing may write to the layout while GCLayout runs: blobs that are
+// being added, and the temporary files they are spooled to, would be
+// removed.
+func GCLayout(dir string, dryRun bool) (*LayoutReport, error) {
+	r, err := CheckLayout(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	if !r.complete() {
+		return r, errors.New("layout has missing or unreadable manifests; not collecting garbage")
+	}
+	if dryRun {
+		return r, nil
+	}
+	for _, b := range r.Unreferenced {
+		if err := os.Remove(blobPath(dir, specs.Descriptor{Digest: b.Digest})); err != nil {
+			return r, err
+		}
+	}
+	for _, p := range r.Temporary {
+		if err := os.Remove(p); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,393 @@
+package oci
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/hxtk/ember/internal/pathset"
+)
+
+// maxLinkDepth bounds how many hard-link hops resolveLink follows. Tar
+// writers never chain links, but hand-built layers might, and a cycle must
+// not hang the reader.
+const maxLinkDepth = 16
+
+// nlinkRecord is the PAX record giving the link count of an entry, as star
+// writes it.
+const nlinkRecord = "SCHILY.nlink"
+
+// WithHardLinks makes the Reader return a hard link to a file of the same
+// layer as a TypeLink entry naming the file as the Reader returned it,
+// rather than as a copy of the file, so that consumers can give the names
+// one inode and store the content once. The first name of such an inode,
+// which carries its content, comes before its links and has a SCHILY.nlink
+// PAX record counting its names in the merged view. When the file itself
+// is hidden by an upper layer, its first visible link takes its place.
+//
+// Links to files of lower layers still come back as copies, as their
+// targets come after them. Knowing the link counts up front takes a pass
+// over the headers of each layer before it is merged.
+func WithHardLinks() Option {
+	return func(o *options) { o.hardLinks = true }
+}
+
+// linkIndex is what a pass over the headers of a layer tells of its hard
+// links: the links by name, and the files of the layer they resolve to.
+type linkIndex struct {
+	roots   *pathset.Map[string]   // link -> the file it resolves to, "" for a cycle
+	targets *pathset.Map[[]string] // file -> links resolving to it, in layer order
+	linked  bool                   // whether targets has any
+
+	// groups are the inodes started in the merge, by file, WithHardLinks.
+	groups *pathset.Map[*tar.Header]
+
+	// Without WithHardLinks, the content of the files is copied to spool
+	// for the links to read, by file, in layer order.
+	spool  *os.File
+	copies *pathset.Map[[]linkCopy]
+}
+
+// linkCopy is a version of a file whose content a link reads from spool.
+// Its fields are exported for its codec only.
+type linkCopy struct {
+	Ord int // the entry's position in its layer, from 1
+	Hdr *tar.Header
+	Off int64
+}
+
+func newLinkIndex(b *pathset.Budget) *linkIndex {
+	return &linkIndex{
+		roots:   pathset.NewMap(b, pathset.Strings),
+		targets: pathset.NewMap(b, pathset.JSON[[]string]()),
+		groups:  pathset.NewMap(b, pathset.JSON[*tar.Header]()),
+		copies:  pathset.NewMap(b, pathset.JSON[[]linkCopy]()),
+	}
+}
+
+func (x *linkIndex) close() {
+	if x == nil {
+		return
+	}
+	if x.spool != nil {
+		x.spool.Close()
+	}
+	x.roots.Close()
+	x.targets.Close()
+	x.groups.Close()
+	x.copies.Close()
+}
+
+// indexLinks reads the headers of the layer at pos, in reading order, for
+// its hard links and, if copies is set, copies the content of the files
+// they resolve to into a spool. It is done once a layer, rather than once
+// a link, since a layer such as busybox's holds hundreds of links.
+func (r *Reader) indexLinks(pos int, copies bool) (*linkIndex, error) {
+	x := newLinkIndex(r.budget)
+	if pos < len(r.dirLayers) && r.dirLayers[pos] != nil {
+		return x, nil // directories are written without hard links
+	}
+	lr, err := r.openLayer(pos)
+	if err != nil {
+		x.close()
+		return nil, err
+	}
+	links := pathset.NewMap(r.budget, pathset.Strings)
+	defer links.Close()
+	order := pathset.NewLog(r.budget, pathset.Strings)
+	defer order.Close()
+	for {
+		hdr, err := lr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			lr.Close()
+			x.close()
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			name := cleanPath(hdr.Name)
+			links.Put(name, cleanPath(hdr.Linkname))
+			order.Append(name)
+		}
+	}
+	lr.Close()
+
+	for name := range order.All() {
+		root, _ := links.Get(name)
+		for depth := 0; root != ""; depth++ {
+			next, ok := links.Get(root)
+			if !ok {
+				break
+			}
+			if depth == maxLinkDepth {
+				root = ""
+				break
+			}
+			root = next
+		}
+		x.roots.Put(name, root)
+		if root != "" {
+			t, _ := x.targets.Get(root)
+			x.targets.Put(root, append(t, name))
+			x.linked = true
+		}
+	}
+	if err := r.setErr(); err != nil {
+		x.close()
+		return nil, err
+	}
+	if copies && x.linked {
+		if err := x.copyTargets(r, pos); err != nil {
+			x.close()
+			return nil, err
+		}
+	}
+	return x, nil
+}
+
+// copyTargets copies the content of the files of the layer at pos that
+// links resolve to into a spool.
+func (x *linkIndex) copyTargets(r *Reader, pos int) error {
+	spool, err := os.CreateTemp("", "ember-links-*")
+	if err != nil {
+		return err
+	}
+	os.Remove(spool.Name()) // keep it only as long as it is open
+	x.spool = spool
+
+	lr, err := r.openLayer(pos)
+	if err != nil {
+		return err
+	}
+	defer lr.Close()
+	var off int64
+	for ord := 1; ; ord++ {
+		hdr, err := lr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanPath(hdr.Name)
+		if _, ok := x.targets.Get(name); !ok || hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		n, err := io.Copy(spool, lr)
+		if err != nil {
+			return fmt.Errorf("copy %s for its hard links: %w", name, err)
+		}
+		hdr.Size = n
+		c, _ := x.copies.Get(name)
+		x.copies.Put(name, append(c, linkCopy{Ord: ord, Hdr: hdr, Off: off}))
+		off += n
+	}
+}
+
+// copyOf returns the version of file that the link at ord reads: the last
+// one before it.
+func (x *linkIndex) copyOf(file string, ord int) (linkCopy, bool) {
+	var found linkCopy
+	copies, _ := x.copies.Get(file)
+	for _, c := range copies {
+		if c.Ord >= ord {
+			break
+		}
+		found = c
+	}
+	return found, found.Hdr != nil
+}
+
+// linksOf returns the index of the hard links of the current layer,
+// indexing it if it hasn't been.
+func (r *Reader) linksOf() (*linkIndex, error) {
+	if r.links == nil {
+		x, err := r.indexLinks(r.pos, !r.opts.hardLinks)
+		if err != nil {
+			return nil, err
+		}
+		r.links = x
+	}
+	return r.links, nil
+}
+
+// carrier returns the first visible link of the file name, of the current
+// layer, that is hidden itself, for it to take the file's place, or "".
+func (r *Reader) carrier(name string, hdr *tar.Header) string {
+	if !r.opts.hardLinks || r.links == nil || hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		return ""
+	}
+	if _, ok := r.links.groups.Get(name); ok {
+		return ""
+	}
+	targets, _ := r.links.targets.Get(name)
+	for _, l := range targets {
+		if r.visible(l) {
+			return l
+		}
+	}
+	return ""
+}
+
+// startInode gives the file of the current layer returned as name, which
+// is root as the layer names it, the link count of its names, if links of
+// the layer resolve to it, and remembers it for them.
+func (r *Reader) startInode(root, name string, hdr *tar.Header) {
+	if !r.opts.hardLinks || r.links == nil || hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		return
+	}
+	n := 1
+	targets, _ := r.links.targets.Get(root)
+	for _, l := range targets {
+		if l != name && r.visible(l) {
+			n++
+		}
+	}
+	if n == 1 {
+		return
+	}
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = make(map[string]string)
+	}
+	hdr.PAXRecords[nlinkRecord] = strconv.Itoa(n)
+	hdr.Format = tar.FormatPAX // the only one of the record
+	h := *hdr
+	h.Name = name
+	h.PAXRecords = maps.Clone(hdr.PAXRecords)
+	r.links.groups.Put(root, &h)
+}
+
+// visible reports whether the entry name of the current layer is to be
+// returned, as far as the layers above tell.
+func (r *Reader) visible(name string) bool {
+	return !r.hiddenByOpaque(name) && !r.hidden(r.seen, name)
+}
+
+// resolveLink turns the hard link name -> linkname, found in the current
+// layer, into a regular entry carrying the target's metadata and content,
+// or WithHardLinks, into a TypeLink entry naming the target as returned.
+//
+// The target is the version of linkname that existed when the layer was
+// applied: the current layer's own copy if it has one, otherwise the copy
+// in the nearest lower layer that isn't hidden by a whiteout or opaque
+// marker. That version may since have been replaced or deleted by an upper
+// layer, so the content is never shared with whatever the merged view
+// shows at linkname. Targets in the current layer are found in its link
+// index; those of lower layers, which overlayfs copies up along with the
+// link, so that image builders rarely write them, are searched for.
+func (r *Reader) resolveLink(name, linkname string) (*tar.Header, error) {
+	x, err := r.linksOf()
+	if err != nil {
+		return nil, fmt.Errorf("hardlink %q -> %q: %w", name, linkname, err)
+	}
+	root, ok := x.roots.Get(name)
+	if ok && root == "" {
+		return nil, fmt.Errorf("hardlink %q -> %q: too many levels of links", name, linkname)
+	}
+	if g, ok := x.groups.Get(root); ok {
+		h := *g
+		h.Name, h.Typeflag, h.Linkname, h.Size = name, tar.TypeLink, g.Name, 0
+		h.PAXRecords = maps.Clone(g.PAXRecords)
+		r.linkRoot = root
+		return &h, nil
+	}
+	if c, ok := x.copyOf(root, r.entries); ok {
+		h := *c.Hdr
+		h.Name = name
+		r.link = io.NopCloser(io.NewSectionReader(x.spool, c.Off, c.Hdr.Size))
+		return &h, nil
+	}
+
+	target, pos := cleanPath(linkname), r.pos
+	for depth := 0; depth < maxLinkDepth; depth++ {
+		hdr, lr, p, err := r.findTarget(pos, target)
+		if err != nil {
+			return nil, fmt.Errorf("hardlink %q -> %q: %w", name, linkname, err)
+		}
+		if hdr.Typeflag != tar.TypeLink {
+			h := *hdr
+			h.Name = name
+			r.link = lr
+			return &h, nil
+		}
+		lr.Close()
+		target, pos = cleanPath(hdr.Linkname), p
+	}
+	return nil, fmt.Errorf("hardlink %q -> %q: too many levels of links", name, linkname)
+}
+
+// CopyLink makes the current entry, a hard link returned WithHardLinks,
+// read as a copy of the file it links to, and returns the header of that
+// version of the file, for a consumer that left the file itself out.
+func (r *Reader) CopyLink() (*tar.Header, error) {
+	if r.linkRoot == "" {
+		return nil, errors.New("oci: the current entry is not a hard link")
+	}
+	hdr, lr, _, err := r.findTarget(r.pos, r.linkRoot)
+	if err != nil {
+		return nil, fmt.Errorf("hardlink %q: %w", r.entry, err)
+	}
+	if r.link != nil {
+		r.link.Close()
+	}
+	r.link, r.linkRoot, r.remaining = lr, "", hdr.Size
+	return hdr, nil
+}
+
+// findTarget searches layers from pos downward for target and returns its
+// header, the layer it was found in positioned at the entry's content, and
+// that layer's position.
+func (r *Reader) findTarget(pos int, target string) (*tar.Header, *layerReader, int, error) {
+	for p := pos; p < len(r.descs); p++ {
+		lr, err := r.openLayer(p)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		hidden := false
+		for {
+			hdr, err := lr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				lr.Close()
+				return nil, nil, 0, err
+			}
+
+			name := cleanPath(hdr.Name)
+			if name == target {
+				return hdr, lr, p, nil
+			}
+
+			// A whiteout or opaque marker in this layer hides the target
+			// in every layer below it, but not this layer's own copy, which
+			// may still appear later in the stream.
+			base := path.Base(name)
+			var covered string
+			if base == ".wh..wh..opq" {
+				covered = path.Dir(name)
+			} else if after, ok := strings.CutPrefix(base, ".wh."); ok {
+				covered = path.Join(path.Dir(name), after)
+			} else {
+				continue
+			}
+			if target == covered || strings.HasPrefix(target, covered+"/") || covered == "." {
+				hidden = true
+			}
+		}
+		lr.Close()
+		if hidden {
+			break
+		}
+	}
+	return nil, nil, 0, errors.New("target not found")
+}
@@ -0,0 +1,145 @@
+package oci_test
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/oci"
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+// readAll reads the merged view of img, opened with opts, as one line per
+// entry: the name, the type and what the type makes of the rest, such as
+// the content of a regular file.
+func readAll(t *testing.T, img *ocitest.Image, opts ...oci.Option) []string {
+	t.Helper()
+	r, err := oci.Open(ocitest.Layout(t, img), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var entries []string
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: %v", hdr.Name, err)
+		}
+		entries = append(entries, describe(hdr, b))
+	}
+}
+
+func describe(hdr *tar.Header, content []byte) string {
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return hdr.Name + "/"
+	case tar.TypeSymlink:
+		return hdr.Name + " -> " + hdr.Linkname
+	case tar.TypeLink:
+		return fmt.Sprintf("%s => %s nlink=%s", hdr.Name, hdr.Linkname, hdr.PAXRecords["SCHILY.nlink"])
+	case tar.TypeReg:
+		s := fmt.Sprintf("%s %q", hdr.Name, content)
+		if n := hdr.PAXRecords["SCHILY.nlink"]; n != "" {
+			s += " nlink=" + n
+		}
+		return s
+	}
+	return fmt.Sprintf("%s type %c", hdr.Name, hdr.Typeflag)
+}
+
+func checkEntries(t *testing.T, got, want []string) {
+	t.Helper()
+	if !slices.Equal(got, want) {
+		t.Errorf("got entries\n\t%s\nwant\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+}
+
+func busybox() *ocitest.Layer {
+	return ocitest.NewLayer().
+		Dir("bin").
+		File("bin/busybox", "BB").
+		Hardlink("bin/sh", "bin/busybox").
+		Hardlink("bin/ls", "bin/busybox").
+		Hardlink("bin/cat", "bin/sh") // a chain, resolving to busybox too
+}
+
+func TestHardLinkCopies(t *testing.T) {
+	checkEntries(t, readAll(t, ocitest.New(busybox())), []string{
+		`bin/`,
+		`bin/busybox "BB"`,
+		`bin/sh "BB"`,
+		`bin/ls "BB"`,
+		`bin/cat "BB"`,
+	})
+}
+
+func TestHardLinksShareInode(t *testing.T) {
+	checkEntries(t, readAll(t, ocitest.New(busybox()), oci.WithHardLinks()), []string{
+		`bin/`,
+		`bin/busybox "BB" nlink=4`,
+		`bin/sh => bin/busybox nlink=4`,
+		`bin/ls => bin/busybox nlink=4`,
+		`bin/cat => bin/busybox nlink=4`,
+	})
+}
+
+// An upper layer replacing the file leaves its links with the old content.
+func hiddenTarget() *ocitest.Image {
+	return ocitest.New(
+		busybox(),
+		ocitest.NewLayer().File("bin/busybox", "new").Whiteout("bin/ls"),
+	)
+}
+
+func TestHardLinkHiddenTargetCopies(t *testing.T) {
+	checkEntries(t, readAll(t, hiddenTarget()), []string{
+		`bin/`,
+		`bin/busybox "new"`,
+		`bin/sh "BB"`,
+		`bin/cat "BB"`,
+	})
+}
+
+func TestHardLinksHiddenTargetShareInode(t *testing.T) {
+	checkEntries(t, readAll(t, hiddenTarget(), oci.WithHardLinks()), []string{
+		`bin/`,
+		`bin/busybox "new"`,
+		`bin/sh "BB" nlink=2`,
+		`bin/cat => bin/sh nlink=2`,
+	})
+}
+
+// A link to a file of a lower layer is a copy: the file comes after it.
+func TestHardLinkToLowerLayer(t *testing.T) {
+	img := ocitest.New(
+		ocitest.NewLayer().File("a", "A"),
+		ocitest.NewLayer().Hardlink("b", "a"),
+	)
+	want := []string{`b "A"`, `a "A"`}
+	checkEntries(t, readAll(t, img), want)
+	checkEntries(t, readAll(t, img, oci.WithHardLinks()), want)
+}
+
+func TestHardLinkCycle(t *testing.T) {
+	img := ocitest.New(ocitest.NewLayer().Hardlink("a", "b").Hardlink("b", "a"))
+	for _, opts := range [][]oci.Option{nil, {oci.WithHardLinks()}} {
+		r, err := oci.Open(ocitest.Layout(t, img), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if _, err := r.Next(); err == nil || !strings.Contains(err.Error(), "too many levels of links") {
+			t.Errorf("Next() = %v, want too many levels of links", err)
+		}
+	}
+}
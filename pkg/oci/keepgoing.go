@@ -0,0 +1,81 @@
+package oci
+
+import (
+	"fmt"
+	"io"
+)
+
+// LayerFailure records a layer that could not be read completely by a
+// Reader opened WithKeepGoing.
+type LayerFailure struct {
+	Index   int    `json:"index"`           // position of the layer in the manifest, base first
+	Digest  string `json:"digest"`          // digest of the layer blob
+	Entries int    `json:"entries"`         // entries read from the layer before the failure
+	Entry   string `json:"entry,omitempty"` // entry whose content was cut short, if any
+	Error   string `json:"error"`
+}
+
+// WithKeepGoing makes the Reader skip the rest of a layer that fails to
+// open or read, such as a corrupt or missing blob, instead of failing. The
+// merged view then lacks whatever the layer would have contributed, and
+// lower layers' versions of those paths may show through. An entry whose
+// content fails midway is padded with zeros to its recorded size, so that
+// consumers that already wrote its header stay consistent.
+//
+// The failures are available from Failures once reading is done.
+func WithKeepGoing() Option {
+	return func(o *options) { o.keepGoing = true }
+}
+
+// Failures returns the layer failures tolerated so far in keep-going mode.
+func (r *Reader) Failures() []LayerFailure {
+	return r.failures
+}
+
+// fail records the failure of the layer at pos, in reading order.
+func (r *Reader) fail(pos int, entry string, err error) {
+	r.failures = append(r.failures, LayerFailure{
+		Index:   len(r.descs) - 1 - pos,
+		Digest:  r.descs[pos].Digest.String(),
+		Entries: r.entries,
+		Entry:   entry,
+		Error:   err.Error(),
+	})
+}
+
+// failCur abandons the current layer after err, if the Reader keeps going.
+// It reports whether it did.
+func (r *Reader) failCur(entry string, err error) bool {
+	if !r.opts.keepGoing {
+		return false
+	}
+	r.fail(r.pos, entry, err)
+	r.cur.Close()
+	r.cur = nil
+	r.finishLayer()
+	return true
+}
+
+// zeros pads out the content of an entry cut short by a layer failure.
+type zeros struct{ n int64 }
+
+func (z *zeros) Read(p []byte) (int, error) {
+	if z.n == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > z.n {
+		p = p[:z.n]
+	}
+	clear(p)
+	z.n -= int64(len(p))
+	return len(p), nil
+}
+
+func (r *Reader) readFailed(n int, err error) (int, error) {
+	name := r.entry
+	if !r.failCur(name, fmt.Errorf("read %s: %w", name, err)) {
+		return n, err
+	}
+	r.pad = &zeros{r.remaining - int64(n)}
+	return n, nil
+}
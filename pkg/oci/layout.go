@@ -0,0 +1,174 @@
+package oci
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LayoutWriter adds blobs and manifests to an OCI image layout directory.
+type LayoutWriter struct {
+	dir string
+}
+
+// CreateLayout returns a LayoutWriter for the layout at dir, creating the
+// directory and its oci-layout file if needed. An existing layout keeps
+// its blobs and manifests.
+func CreateLayout(dir string) (*LayoutWriter, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", string(digest.Canonical)), 0o755); err != nil {
+		return nil, err
+	}
+	p := filepath.Join(dir, specs.ImageLayoutFile)
+	if _, err := os.Stat(p); errors.Is(err, fs.ErrNotExist) {
+		b, err := json.Marshal(specs.ImageLayout{Version: specs.ImageLayoutVersion})
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(p, b, 0o644); err != nil {
+			return nil, err
+		}
+	}
+	return &LayoutWriter{dir: dir}, nil
+}
+
+// Dir returns the layout directory.
+func (w *LayoutWriter) Dir() string {
+	return w.dir
+}
+
+// NewBlob starts writing a blob. Its content is spooled to a temporary file
+// in the layout until Commit moves it into place under its digest.
+func (w *LayoutWriter) NewBlob() (*BlobWriter, error) {
+	f, err := os.CreateTemp(filepath.Join(w.dir, "blobs"), ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	return &BlobWriter{dir: w.dir, f: f, digester: digest.Canonical.Digester()}, nil
+}
+
+// WriteJSON writes v as a JSON blob of the given media type.
+func (w *LayoutWriter) WriteJSON(mediaType string, v any) (specs.Descriptor, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	bw, err := w.NewBlob()
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	defer bw.Close()
+	if _, err := bw.Write(b); err != nil {
+		return specs.Descriptor{}, err
+	}
+	return bw.Commit(mediaType)
+}
+
+// AddManifest lists desc in the layout's index.json. A manifest already
+// listed under the same reference name (the
+// org.opencontainers.image.ref.name annotation) or with the same digest is
+// replaced. The index is replaced atomically.
+func (w *LayoutWriter) AddManifest(desc specs.Descriptor) error {
+	idx, err := loadIndex(dirLayout(w.dir))
+	if errors.Is(err, fs.ErrNotExist) {
+		idx = &specs.Index{MediaType: specs.MediaTypeImageIndex}
+		idx.SchemaVersion = 2
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("read index.json: %w", err)
+	}
+	ref := desc.Annotations[specs.AnnotationRefName]
+	kept := idx.Manifests[:0]
+	for _, m := range idx.Manifests {
+		if m.Digest == desc.Digest || (ref != "" && m.Annotations[specs.AnnotationRefName] == ref) {
+			continue
+		}
+		kept = append(kept, m)
+	}
+	idx.Manifests = append(kept, desc)
+	return w.WriteIndex(idx)
+}
+
+// WriteIndex replaces the layout's index.json with idx.
+func (w *LayoutWriter) WriteIndex(idx *specs.Index) error {
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(w.dir, ".index-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(w.dir, "index.json"))
+}
+
+// BlobWriter writes one blob into a layout.
+type BlobWriter struct {
+	dir      string
+	f        *os.File
+	digester digest.Digester
+	size     int64
+	done     bool
+}
+
+func (b *BlobWriter) Write(p []byte) (int, error) {
+	n, err := b.f.Write(p)
+	b.digester.Hash().Write(p[:n])
+	b.size += int64(n)
+	return n, err
+}
+
+// Commit finishes the blob and returns its descriptor.
+func (b *BlobWriter) Commit(mediaType string) (specs.Descriptor, error) {
+	if b.done {
+		return specs.Descriptor{}, errors.New("oci: blob already committed or closed")
+	}
+	b.done = true
+	desc := specs.Descriptor{MediaType: mediaType, Digest: b.digester.Digest(), Size: b.size}
+	if err := b.f.Chmod(0o644); err != nil {
+		b.discard()
+		return specs.Descriptor{}, err
+	}
+	if err := b.f.Close(); err != nil {
+		os.Remove(b.f.Name())
+		return specs.Descriptor{}, err
+	}
+	if err := os.Rename(b.f.Name(), blobPath(b.dir, desc)); err != nil {
+		os.Remove(b.f.Name())
+		return specs.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// Close discards the blob unless it has been committed.
+func (b *BlobWriter) Close() error {
+	if b.done {
+		return nil
+	}
+	b.done = true
+	return b.discard()
+}
+
+func (b *BlobWriter) discard() error {
+	err := b.f.Close()
+	os.Remove(b.f.Name())
+	return err
+}
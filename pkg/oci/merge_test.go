@@ -0,0 +1,278 @@
+package oci_test
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/oci"
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+func base() *ocitest.Layer {
+	return ocitest.NewLayer().
+		Dir("etc").
+		File("etc/hostname", "base").
+		File("etc/motd", "hello").
+		Dir("opt").
+		Dir("opt/app").
+		File("opt/app/bin", "v1").
+		File("opt/app/lib", "v1")
+}
+
+// Upper layers come first, after the parents they need, and shadow the
+// same paths below them.
+func TestMergeShadows(t *testing.T) {
+	img := ocitest.New(base(), ocitest.NewLayer().File("etc/hostname", "upper"))
+	checkEntries(t, readAll(t, img), []string{
+		`etc/`,
+		`etc/hostname "upper"`,
+		`etc/motd "hello"`,
+		`opt/`,
+		`opt/app/`,
+		`opt/app/bin "v1"`,
+		`opt/app/lib "v1"`,
+	})
+}
+
+// A whiteout deletes a file, or a directory and all below it, from the
+// layers below, but not what its own layer adds back.
+func TestMergeWhiteouts(t *testing.T) {
+	img := ocitest.New(base(), ocitest.NewLayer().
+		Whiteout("etc/motd").
+		Whiteout("opt/app").
+		File("opt/app/bin", "v2"))
+	checkEntries(t, readAll(t, img), []string{
+		`opt/`,
+		`opt/app/`,
+		`opt/app/bin "v2"`,
+		`etc/`,
+		`etc/hostname "base"`,
+	})
+}
+
+// An opaque directory hides what the layers below have in it, but keeps
+// the directory and what its own layer has.
+func TestMergeOpaque(t *testing.T) {
+	img := ocitest.New(base(), ocitest.NewLayer().
+		Dir("opt/app").
+		Opaque("opt/app").
+		File("opt/app/lib", "v2"))
+	checkEntries(t, readAll(t, img), []string{
+		`opt/`,
+		`opt/app/`,
+		`opt/app/lib "v2"`,
+		`etc/`,
+		`etc/hostname "base"`,
+		`etc/motd "hello"`,
+	})
+}
+
+// A whiteout of a lower layer doesn't reach an upper one.
+func TestMergeWhiteoutBelow(t *testing.T) {
+	img := ocitest.New(
+		ocitest.NewLayer().File("a", "1"),
+		ocitest.NewLayer().Whiteout("a"),
+		ocitest.NewLayer().File("a", "3"),
+	)
+	checkEntries(t, readAll(t, img), []string{`a "3"`})
+}
+
+// Parents an entry needs that its layer doesn't have come first, with the
+// metadata of a lower layer's.
+func TestMergeMissingParents(t *testing.T) {
+	img := ocitest.New(base(), ocitest.NewLayer().File("opt/app/share/doc", "d"))
+	checkEntries(t, readAll(t, img), []string{
+		`opt/`,
+		`opt/app/`,
+		`opt/app/share/`,
+		`opt/app/share/doc "d"`,
+		`etc/`,
+		`etc/hostname "base"`,
+		`etc/motd "hello"`,
+		`opt/app/bin "v1"`,
+		`opt/app/lib "v1"`,
+	})
+}
+
+// WithDeletions records what whiteouts and opaque markers dropped, by the
+// lowest layer deleting it, and not what was only shadowed.
+func TestDeletions(t *testing.T) {
+	img := ocitest.New(
+		base(),
+		ocitest.NewLayer().
+			File("etc/hostname", "shadowed").
+			Whiteout("etc/motd").
+			Dir("opt/app").
+			Opaque("opt/app"),
+		ocitest.NewLayer().Whiteout("opt/app"), // deleting again what layer 1 did
+	)
+	r, err := oci.Open(ocitest.Layout(t, img), oci.WithDeletions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := r.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []oci.Deletion{
+		{Path: "opt/app", Layer: 1, DeletedBy: 2, Marker: "opt/.wh.app"},
+		{Path: "etc/motd", Layer: 0, DeletedBy: 1, Marker: "etc/.wh.motd"},
+		{Path: "opt/app/bin", Layer: 0, DeletedBy: 1, Marker: "opt/app/.wh..wh..opq"},
+		{Path: "opt/app/lib", Layer: 0, DeletedBy: 1, Marker: "opt/app/.wh..wh..opq"},
+	}
+	if got := r.Deletions(); !slices.Equal(got, want) {
+		t.Errorf("Deletions() = %+v, want %+v", got, want)
+	}
+}
+
+// A file replacing a directory shadows the directory itself only, by the
+// OCI rules; overlayfs, WithTypeChangeReplacement, hides what is below it
+// too.
+func typeChange() *ocitest.Image {
+	return ocitest.New(base(), ocitest.NewLayer().File("opt/app", "now a file"))
+}
+
+func TestMergeTypeChange(t *testing.T) {
+	checkEntries(t, readAll(t, typeChange()), []string{
+		`opt/`,
+		`opt/app "now a file"`,
+		`etc/`,
+		`etc/hostname "base"`,
+		`etc/motd "hello"`,
+		`opt/app/bin "v1"`,
+		`opt/app/lib "v1"`,
+	})
+}
+
+func TestMergeTypeChangeReplacement(t *testing.T) {
+	checkEntries(t, readAll(t, typeChange(), oci.WithTypeChangeReplacement()), []string{
+		`opt/`,
+		`opt/app "now a file"`,
+		`etc/`,
+		`etc/hostname "base"`,
+		`etc/motd "hello"`,
+	})
+}
+
+// A symlink replacing a directory, as in a /lib -> usr/lib merge, hides
+// the directory's old content the same way.
+func TestMergeSymlinkReplacement(t *testing.T) {
+	img := ocitest.New(base(), ocitest.NewLayer().Symlink("opt/app", "/usr/lib/app"))
+	checkEntries(t, readAll(t, img, oci.WithTypeChangeReplacement()), []string{
+		`opt/`,
+		`opt/app -> /usr/lib/app`,
+		`etc/`,
+		`etc/hostname "base"`,
+		`etc/motd "hello"`,
+	})
+}
+
+// A directory replacing a directory is no type change: the lower one's
+// content stays.
+func TestMergeDirectoryReplacement(t *testing.T) {
+	img := ocitest.New(base(), ocitest.NewLayer().Dir("opt/app").File("opt/app/new", "v2"))
+	checkEntries(t, readAll(t, img, oci.WithTypeChangeReplacement()), []string{
+		`opt/`,
+		`opt/app/`,
+		`opt/app/new "v2"`,
+		`etc/`,
+		`etc/hostname "base"`,
+		`etc/motd "hello"`,
+		`opt/app/bin "v1"`,
+		`opt/app/lib "v1"`,
+	})
+}
+
+// manyPaths is an image with enough of each kind of thing the Reader
+// tracks to make a small memory limit spill: shadowed files, whiteouts,
+// opaque directories, directories that only a lower layer defines, type
+// changes, and hard links.
+func manyPaths() *ocitest.Image {
+	lower, upper := ocitest.NewLayer().Dir("d").File("d/busybox", "BB"), ocitest.NewLayer().Dir("d").File("d/busybox", "BB2")
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("d/f%04d", i)
+		lower.File(name, "lower")
+		switch i % 3 {
+		case 0:
+			upper.File(name, "upper")
+		case 1:
+			upper.Whiteout(name)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		dir := fmt.Sprintf("o/%03d", i)
+		lower.Dir(dir, ocitest.Mode(0o700)).File(dir+"/old", "lower")
+		switch i % 4 {
+		case 0:
+			upper.Opaque(dir).File(dir+"/new", "upper")
+		case 1:
+			upper.File(dir, "now a file")
+		case 2:
+			upper.File(dir+"/new", "upper") // under the lower layer's directory
+		}
+		upper.Hardlink(fmt.Sprintf("d/l%03d", i), "d/busybox")
+	}
+	return ocitest.New(lower, upper)
+}
+
+// Spilling what the Reader tracks to disk changes nothing of the merge,
+// down to the metadata of missing parents and the link counts.
+func TestMergeUnderMemoryLimit(t *testing.T) {
+	img := manyPaths()
+	for _, opts := range [][]oci.Option{
+		nil,
+		{oci.WithHardLinks()},
+		{oci.WithTypeChangeReplacement()},
+	} {
+		checkEntries(t, readAll(t, img, append(opts, oci.WithMemoryLimit(1<<10))...), readAll(t, img, opts...))
+	}
+
+	r, err := oci.Open(ocitest.Layout(t, img), oci.WithMemoryLimit(1<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == "o/002" && hdr.Mode != 0o700 {
+			t.Errorf("missing parent o/002 has mode %o, want the lower layer's 700", hdr.Mode)
+		}
+	}
+}
+
+// Deletions are the same whatever spilled, and whatever markers did.
+func TestDeletionsUnderMemoryLimit(t *testing.T) {
+	deletions := func(opts ...oci.Option) []oci.Deletion {
+		r, err := oci.Open(ocitest.Layout(t, manyPaths()), append(opts, oci.WithDeletions(), oci.WithTypeChangeReplacement())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		for {
+			if _, err := r.Next(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return r.Deletions()
+	}
+	want := deletions()
+	if len(want) != 667+100 {
+		t.Fatalf("%d deletions, want the whited out files and the files under opaque directories and files", len(want))
+	}
+	if got := deletions(oci.WithMemoryLimit(1 << 10)); !slices.Equal(got, want) {
+		t.Errorf("Deletions() under a memory limit differ: got %d, want %d", len(got), len(want))
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package oci
+
+func mmapFile(name string) ([]byte, func() error, error) {
+	return nil, nil, errMmapUnsupported
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package oci
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the file name read-only and returns its contents and the
+// function that unmaps them.
+func mmapFile(name string) ([]byte, func() error, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.Size() == 0 {
+		return nil, func() error { return nil }, nil
+	}
+	if int64(int(fi.Size())) != fi.Size() {
+		return nil, nil, errMmapUnsupported
+	}
+	b, err := syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, func() error { return syscall.Munmap(b) }, nil
+}
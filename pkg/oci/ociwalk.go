@@ -7,6 +7,15 @@
 //   - Correct handling of layer order and whiteouts
 //   - Deterministic behavior suitable for reproducible builds
 //
+// Memory use is independent of file sizes: entries are streamed and only
+// decompressor and tar state is buffered per open layer. It grows with the
+// number of paths: those already seen, needed to let upper layers shadow
+// lower ones, the whiteouts and opaque directories, the hard links of the
+// layer being read, indexed to resolve them, the directories of the layers
+// searched for the metadata of missing parents, and WithDeletions, the
+// markers and deletions. WithMemoryLimit bounds all of those together by
+// spilling them to disk.
+//
 // Non-goals (by design, but extensible):
 //   - Applying permissions/ownership to a real filesystem
 //   - Handling non-tar layer media types
@@ -15,77 +24,283 @@ package oci
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"io/fs"
 	"path"
-	"path/filepath"
 	"sort"
 	"strings"
 
+	"github.com/hxtk/ember/internal/pathset"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// ErrUnsupportedMediaType is wrapped by the errors for layers and
+// manifests of media types Reader can't read.
+var ErrUnsupportedMediaType = errors.New("unsupported media type")
+
 // Reader behaves similarly to archive/tar.Reader, but iterates over the
 // merged filesystem view of an OCI image reference.
 //
 // Usage:
 //
 //	r, _ := ociwalk.Open(layoutDir, "example.com/foo:latest")
+//	defer r.Close()
 //	for {
 //	    hdr, err := r.Next()
 //	    if err == io.EOF { break }
 //	    if err != nil { return err }
 //	    io.Copy(dst, r)
 //	}
+//
+// or, with Entries:
+//
+//	for hdr, content := range r.Entries() {
+//	    io.Copy(dst, content)
+//	}
+//	if err := r.Err(); err != nil { return err }
+//
+// Hard links are resolved against the merged view: a link entry is returned
+// as a regular file carrying its target's metadata and content, so consumers
+// never see a TypeLink header whose target lives in another layer or was
+// shadowed by an upper one. WithHardLinks returns links to files of their
+// own layer as TypeLink entries instead.
+//
+// Sparse files in the PAX GNU formats, including 1.0, whose sparse map
+// leads the entry's data, come back expanded: the header carries the
+// logical size and the content reads with the holes filled with zeros, as
+// archive/tar presents them.
 type Reader struct {
+	layout    layout
+	desc      specs.Descriptor   // descriptor of the selected manifest
+	manifest  *specs.Manifest    // selected manifest
+	config    *specs.Image       // image config, nil for artifacts
+	descs     []specs.Descriptor // layer descriptors in read order (top first)
+	dirLayers []fs.FS            // directories on top of the image, see Overlay
+
 	layers []*layerReader
-	seen   map[string]struct{}
-	opaque map[string]struct{}
 
-	cur *layerReader
+	// seen holds the paths already returned or deleted by a whiteout, and
+	// opaque those whose descendants are hidden, by opaque markers,
+	// whiteouts, and WithTypeChangeReplacement, non-directories. Each maps
+	// to the position of the layer that hides them in the layers after it,
+	// or returned for the paths returned. A layer's whiteouts hide the
+	// contents of lower layers only, not its own. budget bounds them and
+	// the rest of what grows with the paths of the image, see
+	// WithMemoryLimit.
+	budget *pathset.Budget
+	seen   *pathset.Map[int]
+	opaque *pathset.Map[int]
+
+	progress []*layerCounters // by position in descs
+
+	cur  *layerReader
+	pos  int           // index into descs of cur
+	link io.ReadCloser // content source for a resolved hard link
+
+	// linkRoot is the file the current entry, a hard link WithHardLinks,
+	// resolves to, as its layer names it, for CopyLink.
+	linkRoot string
+
+	links *linkIndex // of cur, see resolveLink
+
+	// parents are missing parent directories to return before held, the
+	// entry of cur that needs them. dirIndex caches the directories of the
+	// layers searched for their metadata, by position.
+	parents  []*tar.Header
+	held     *tar.Header
+	dirIndex map[int]*layerDirs
+
+	// Deletion tracking state, see WithDeletions.
+	deletions  *pathset.Log[Deletion]
+	markers    *pathset.Map[marker] // of the layers above cur, by target
+	curMarkers *pathset.Log[marker]
+
+	opts options
+
+	// Keep-going state: the failures so far, and the current entry and
+	// layer progress that a failure is reported against.
+	failures  []LayerFailure
+	entries   int    // entries read from cur
+	entry     string // name of the current entry
+	remaining int64  // content bytes of the current entry not yet read
+	pad       *zeros // replaces the content of an entry cut short
+
+	warnings warnings
+	iterErr  error // see Entries
 }
 
-// Open opens an OCI layout directory and returns a Reader over the given reference.
-func Open(layoutDir string) (*Reader, error) {
-	idx, err := loadIndex(layoutDir)
-	if err != nil {
-		return nil, err
+// Open opens an OCI layout directory and returns a Reader over the image
+// selected by opts, by default the first image manifest in the index.
+func Open(layoutDir string, opts ...Option) (*Reader, error) {
+	return open(dirLayout(layoutDir), opts)
+}
+
+// OpenFS is like Open, but reads the layout from fsys, whose root holds
+// index.json and blobs, such as the members of an archive of a layout.
+// WithMmap has no effect.
+func OpenFS(fsys fs.FS, opts ...Option) (*Reader, error) {
+	return open(layout{fsys: fsys}, opts)
+}
+
+func open(l layout, opts []Option) (*Reader, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
 	}
+	o.fitReadAhead()
 
-	manifestDesc, err := findManifest(idx)
+	idx, err := loadIndex(l)
 	if err != nil {
 		return nil, err
 	}
 
-	manifest, err := loadManifest(layoutDir, manifestDesc)
+	selected, err := selectManifest(l, idx, &o)
 	if err != nil {
 		return nil, err
 	}
+	manifest := selected.manifest
+	config := selected.config
+	if config == nil && manifest.Config.MediaType == specs.MediaTypeImageConfig {
+		if config, err = loadConfig(l, manifest.Config); err != nil {
+			return nil, err
+		}
+	}
+	if o.verifyDiffIDs {
+		if o.diffIDs, err = layerDiffIDs(manifest, config); err != nil {
+			return nil, err
+		}
+	}
 
 	// Layers are applied from base -> top, but read in reverse so that
 	// topmost entries win.
+	var descs []specs.Descriptor
 	var layers []*layerReader
+	var failed []error
+	progress := newCounters(len(manifest.Layers))
 	for i := len(manifest.Layers) - 1; i >= 0; i-- {
-		lr, err := openLayer(layoutDir, manifest.Layers[i])
-		if err != nil {
+		var lr *layerReader
+		var err error
+		if !skipsLayer(&o, manifest.Layers[i]) {
+			lr, err = openLayer(l, manifest.Layers[i], &o, progress[len(descs)])
+		}
+		if err != nil && !o.keepGoing {
 			return nil, err
 		}
-		layers = append(layers, lr)
+		descs = append(descs, manifest.Layers[i])
+		layers = append(layers, lr) // nil if skipped or it failed to open
+		failed = append(failed, err)
+	}
+
+	r := &Reader{
+		layout:   l,
+		desc:     selected.desc,
+		manifest: manifest,
+		config:   config,
+		descs:    descs,
+		layers:   layers,
+		progress: progress,
+		pos:      -1,
+		opts:     o,
+	}
+	r.track()
+	for pos, err := range failed {
+		if err != nil {
+			r.fail(pos, "", fmt.Errorf("open layer: %w", err))
+		}
+	}
+	for pos, lr := range layers {
+		if lr != nil && lr.mislabeled != "" {
+			r.Warn(Warning{Kind: WarnMislabeledLayer, Name: descs[pos].Digest.String(), Detail: lr.mislabeled})
+		}
+		if r.skips(pos) {
+			r.Warn(Warning{Kind: WarnSkippedLayer, Name: descs[pos].Digest.String(), Detail: "unsupported media type " + descs[pos].MediaType})
+		}
+	}
+	return r, nil
+}
+
+// Close closes the layers r has open, with their read-ahead, and removes
+// the temporary files of WithMemoryLimit and WithHardLinks. r can't be
+// read from afterwards.
+func (r *Reader) Close() error {
+	var closers multiCloser
+	if r.link != nil {
+		closers = append(closers, r.link)
+	}
+	if r.cur != nil {
+		closers = append(closers, r.cur)
+	}
+	for _, l := range r.layers {
+		if l != nil { // skipped, or failed to open
+			closers = append(closers, l)
+		}
 	}
+	closers = append(closers, r.seen, r.opaque)
+	if r.opts.deletions {
+		closers = append(closers, r.deletions, r.markers, r.curMarkers)
+	}
+	for _, l := range r.dirIndex {
+		closers = append(closers, l)
+	}
+	r.links.close()
+	r.link, r.cur, r.layers, r.links, r.dirIndex = nil, nil, nil, nil, nil
+	return closers.Close()
+}
+
+// Descriptor returns the descriptor of the manifest being read.
+func (r *Reader) Descriptor() specs.Descriptor {
+	return r.desc
+}
+
+// Manifest returns the manifest being read. Callers must not modify it.
+func (r *Reader) Manifest() *specs.Manifest {
+	return r.manifest
+}
+
+// Config returns the image configuration, or nil if the manifest is an
+// artifact without an image config. Callers must not modify it.
+func (r *Reader) Config() *specs.Image {
+	return r.config
+}
 
-	return &Reader{
-		layers: layers,
-		seen:   make(map[string]struct{}),
-		opaque: make(map[string]struct{}),
-	}, nil
+// Layer returns the position in the manifest, base first, of the layer
+// being read: that of the current entry, or of the entry that a missing
+// parent directory was returned for. An Overlay directory is above the
+// manifest's layers.
+func (r *Reader) Layer() int {
+	return len(r.descs) - 1 - r.pos
 }
 
 // Next advances to the next visible file entry.
 func (r *Reader) Next() (*tar.Header, error) {
+	hdr, err := r.next()
+	if err != nil {
+		r.warnings.finish()
+	}
+	return hdr, err
+}
+
+func (r *Reader) next() (*tar.Header, error) {
+	if len(r.parents) > 0 {
+		hdr := r.parents[0]
+		r.parents = r.parents[1:]
+		r.pad = &zeros{} // no content; cur is positioned at held's
+		return hdr, nil
+	}
+	if hdr := r.held; hdr != nil {
+		r.held, r.pad = nil, nil
+		r.entry, r.remaining = hdr.Name, hdr.Size
+		return hdr, nil
+	}
+	if r.link != nil {
+		r.link.Close()
+		r.link = nil
+	}
+	r.linkRoot, r.pad = "", nil
 	for {
 		if r.cur == nil {
 			if len(r.layers) == 0 {
@@ -93,60 +308,211 @@ func (r *Reader) Next() (*tar.Header, error) {
 			}
 			r.cur = r.layers[0]
 			r.layers = r.layers[1:]
+			r.pos++
+			r.entries = 0
+			if r.cur == nil {
+				continue // skipped, or failed to open and already recorded
+			}
+			r.progress[r.pos].begin()
+			r.cur.begin()
+			if r.opts.hardLinks {
+				x, err := r.indexLinks(r.pos, false)
+				if err != nil {
+					if !r.failCur("", fmt.Errorf("index hard links: %w", err)) {
+						return nil, err
+					}
+					continue
+				}
+				r.links = x
+			}
 		}
 
 		hdr, err := r.cur.Next()
 		if err == io.EOF {
 			r.cur.Close()
 			r.cur = nil
+			r.progress[r.pos].finish()
+			r.finishLayer()
 			continue
 		}
 		if err != nil {
+			if r.failCur("", err) {
+				continue
+			}
 			return nil, err
 		}
+		r.entries++
+
+		// archive/tar folds GNU longname/longlink (L/K) records and PAX
+		// extended headers into the entry they describe, but it surfaces
+		// PAX global headers as entries of their own. None of these are
+		// files, so never let them reach the caller.
+		switch hdr.Typeflag {
+		case tar.TypeXGlobalHeader, tar.TypeXHeader,
+			tar.TypeGNULongName, tar.TypeGNULongLink:
+			continue
+		}
 
 		name := cleanPath(hdr.Name)
 
 		// Opaque directory whiteout handling (.wh..wh..opq)
 		if path.Base(name) == ".wh..wh..opq" {
-			dir := path.Dir(name)
-			r.opaque[dir] = struct{}{}
+			r.hideBelow(r.opaque, path.Dir(name))
+			r.mark(name, path.Dir(name), true)
 			continue
 		}
 
-		// Whiteout handling (.wh.<name>)
+		// Whiteout handling (.wh.<name>). Deleting a directory deletes
+		// everything below it too.
 		base := path.Base(name)
 		if after, ok := strings.CutPrefix(base, ".wh."); ok {
 			target := path.Join(path.Dir(name), after)
-			r.seen[target] = struct{}{}
+			r.hideBelow(r.seen, target)
+			r.hideBelow(r.opaque, target)
+			r.mark(name, target, false)
 			continue
 		}
 
-		// Suppress entries hidden by opaque directories
-		for d := range r.opaque {
-			if name == d || strings.HasPrefix(name, d+"/") {
-				goto skip
-			}
+		// Overlayfs stops merging a directory at the first layer where its
+		// path isn't a directory, so a non-directory hides what lower
+		// layers have below its path, whether it is visible or itself
+		// replaced by a directory from above.
+		if r.opts.typeChanges && hdr.Typeflag != tar.TypeDir {
+			r.hideBelow(r.opaque, name)
+			r.mark(name, name, true)
 		}
 
-		if _, ok := r.seen[name]; ok {
-			continue
+		if !r.visible(name) {
+			if err := r.setErr(); err != nil {
+				return nil, err
+			}
+			r.recordDeletion(name)
+			carrier := r.carrier(name, hdr)
+			if carrier == "" {
+				continue
+			}
+			name = carrier // first visible link of a hidden file
 		}
 
-		r.seen[name] = struct{}{}
+		r.seen.Put(name, returned)
+		if err := r.setErr(); err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			hdr, err = r.resolveLink(name, hdr.Linkname)
+			if err != nil {
+				if r.opts.keepGoing {
+					r.fail(r.pos, name, err)
+					continue
+				}
+				return nil, err
+			}
+		} else {
+			r.startInode(cleanPath(hdr.Name), name, hdr)
+		}
 		hdr.Name = name
+
+		parents, err := r.missingParents(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(parents) > 0 {
+			r.parents, r.held = parents, hdr
+			return r.next()
+		}
+		r.entry, r.remaining = name, hdr.Size
 		return hdr, nil
-	skip:
-		continue
 	}
 }
 
+// finishLayer drops what was kept of the layer just read for its own
+// entries, and applies its markers to the layers below it.
+func (r *Reader) finishLayer() {
+	if l, ok := r.dirIndex[r.pos]; ok {
+		l.Close()
+		delete(r.dirIndex, r.pos) // only searched from the current layer down
+	}
+	r.links.close()
+	r.links = nil
+	r.commitMarkers()
+}
+
+// returned is the position recorded in seen for the paths returned, which
+// hide even the later entries of their own layer.
+const returned = -1
+
+// track starts tracking the paths of the merged view, under a budget of
+// what WithMemoryLimit leaves of its limit.
+func (r *Reader) track() {
+	r.budget = r.opts.newBudget()
+	r.seen = pathset.NewMap(r.budget, pathset.Ints)
+	r.opaque = pathset.NewMap(r.budget, pathset.Ints)
+	if r.opts.deletions {
+		r.deletions = pathset.NewLog(r.budget, pathset.JSON[Deletion]())
+		r.markers = pathset.NewMap(r.budget, pathset.JSON[marker]())
+		r.curMarkers = pathset.NewLog(r.budget, pathset.JSON[marker]())
+	}
+}
+
+// hideBelow records in m that the current layer hides p in the layers
+// below it, unless a layer above, or an entry returned, already does.
+func (r *Reader) hideBelow(m *pathset.Map[int], p string) {
+	if _, ok := m.Get(p); !ok {
+		m.Put(p, r.pos)
+	}
+}
+
+// hidden reports whether m has p hidden in the current layer.
+func (r *Reader) hidden(m *pathset.Map[int], p string) bool {
+	pos, ok := m.Get(p)
+	return ok && pos < r.pos
+}
+
+// hiddenByOpaque reports whether an opaque directory of a higher layer
+// hides name.
+func (r *Reader) hiddenByOpaque(name string) bool {
+	if name == "." {
+		return false
+	}
+	for d := path.Dir(name); ; d = path.Dir(d) {
+		if r.hidden(r.opaque, d) {
+			return true
+		}
+		if d == "." {
+			return false
+		}
+	}
+}
+
+// setErr reports a failure of the tracked paths to spill to or read from
+// their temporary files.
+func (r *Reader) setErr() error {
+	if err := r.budget.Err(); err != nil {
+		return fmt.Errorf("track merged paths: %w", err)
+	}
+	return nil
+}
+
 // Read reads from the current file entry.
 func (r *Reader) Read(p []byte) (int, error) {
-	if r.cur == nil {
+	if r.pad != nil {
+		return r.pad.Read(p)
+	}
+	var n int
+	var err error
+	switch {
+	case r.link != nil:
+		n, err = r.link.Read(p)
+	case r.cur != nil:
+		n, err = r.cur.Read(p)
+	default:
 		return 0, io.EOF
 	}
-	return r.cur.Read(p)
+	if err != nil && err != io.EOF && r.cur != nil {
+		return r.readFailed(n, err)
+	}
+	r.remaining -= int64(n)
+	return n, err
 }
 
 // --- Internal helpers ---
@@ -154,36 +520,118 @@ func (r *Reader) Read(p []byte) (int, error) {
 type layerReader struct {
 	closer io.Closer
 	tr     *tar.Reader
+	verify *verifyingReader // nil unless verifying
+	diffID *verifyingReader // nil unless verifying diff IDs
+	count  *layerCounters   // nil for the side reads of hard links and directories
+	ahead  *readAhead       // nil unless reading ahead, see begin
+
+	mislabeled string // how the content disagrees with the media type, if it does
 }
 
-func openLayer(layoutDir string, desc specs.Descriptor) (*layerReader, error) {
-	if desc.MediaType != specs.MediaTypeImageLayerGzip &&
-		desc.MediaType != specs.MediaTypeImageLayer {
-		return nil, fmt.Errorf("unsupported layer media type: %s", desc.MediaType)
+// tarMediaTypes maps the media types of tar layers to their compression.
+// Besides the OCI layer types, it has the generic and Docker types that
+// pipelines publishing a root filesystem as an artifact use.
+var tarMediaTypes = map[string]Compression{
+	specs.MediaTypeImageLayer:                           Uncompressed,
+	specs.MediaTypeImageLayerGzip:                       Gzip,
+	specs.MediaTypeImageLayerZstd:                       Zstd,
+	specs.MediaTypeImageLayerNonDistributable:           Uncompressed,
+	specs.MediaTypeImageLayerNonDistributableGzip:       Gzip,
+	specs.MediaTypeImageLayerNonDistributableZstd:       Zstd,
+	"application/vnd.docker.image.rootfs.diff.tar.gzip": Gzip,
+	"application/x-tar":                                 Uncompressed,
+	"application/tar":                                   Uncompressed,
+	"application/tar+gzip":                              Gzip,
+	"application/x-gtar":                                Uncompressed,
+}
+
+// openLayer opens the layer of desc, counting what is read of it in count
+// unless that is nil. A layer read ahead starts reading ahead once begun.
+func openLayer(l layout, desc specs.Descriptor, o *options, count *layerCounters) (*layerReader, error) {
+	c, ok := tarMediaTypes[desc.MediaType]
+	if !ok {
+		return nil, fmt.Errorf("%w for a layer: %s", ErrUnsupportedMediaType, desc.MediaType)
 	}
 
-	blobPath := filepath.Join(layoutDir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
-	f, err := os.Open(blobPath)
+	var f io.ReadCloser
+	var err error
+	switch {
+	case o.mmap:
+		f, err = mapBlob(l, desc)
+	case o.readAhead > 0:
+		f, err = readAheadBlob(l, desc, o.readAhead)
+	default:
+		f, err = openBlob(l, desc)
+	}
 	if err != nil {
 		return nil, err
 	}
+	ahead, _ := f.(*readAhead)
+	if count != nil {
+		f = countingReader{f, &count.read}
+	}
+	var v *verifyingReader
+	if o.verify {
+		if v, err = newVerifyingReader(f, desc); err != nil {
+			f.Close()
+			return nil, err
+		}
+		f = v
+	}
 
-	var r io.Reader = f
-	if desc.MediaType == specs.MediaTypeImageLayerGzip {
-		gz, err := gzip.NewReader(f)
-		if err != nil {
+	// r is the uncompressed tar; closing it leaves f to be closed.
+	br := bufio.NewReader(f)
+	actual := c.sniff(br)
+	r, err := actual.reader(br)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var dv *verifyingReader
+	if diffID, ok := o.diffIDs[desc.Digest]; ok {
+		if dv, err = newDiffIDReader(r, desc.Digest, diffID); err != nil {
 			f.Close()
 			return nil, err
 		}
-		r = gz
-		return &layerReader{closer: multiCloser{gz, f}, tr: tar.NewReader(r)}, nil
+		r = dv
+	}
+	if count != nil {
+		r = countingReader{r, &count.uncompressed}
 	}
 
-	return &layerReader{closer: f, tr: tar.NewReader(r)}, nil
+	lr := &layerReader{closer: multiCloser{r, f}, tr: tar.NewReader(r), verify: v, diffID: dv, count: count, ahead: ahead}
+	if actual != c {
+		lr.mislabeled = fmt.Sprintf("labeled %s, read as %s", c.describe(), actual.describe())
+	}
+	return lr, nil
+}
+
+// begin starts reading the layer ahead, if it is read ahead, once it is
+// about to be read through.
+func (l *layerReader) begin() {
+	if l.ahead != nil {
+		l.ahead.start()
+	}
 }
 
 func (l *layerReader) Next() (*tar.Header, error) {
-	return l.tr.Next()
+	hdr, err := l.tr.Next()
+	if err == nil && l.count != nil {
+		l.count.entries.Add(1)
+	}
+	if err == io.EOF {
+		// Check the uncompressed content first: draining it also makes gzip
+		// check its trailer.
+		for _, v := range []*verifyingReader{l.diffID, l.verify} {
+			if v == nil {
+				continue
+			}
+			if verr := v.finish(); verr != nil {
+				return nil, verr
+			}
+		}
+	}
+	return hdr, err
 }
 
 func (l *layerReader) Read(p []byte) (int, error) {
@@ -196,8 +644,8 @@ func (l *layerReader) Close() error {
 
 // --- OCI parsing ---
 
-func loadIndex(layoutDir string) (*specs.Index, error) {
-	b, err := os.ReadFile(filepath.Join(layoutDir, "index.json"))
+func loadIndex(l layout) (*specs.Index, error) {
+	b, err := l.readFile("index.json")
 	if err != nil {
 		return nil, err
 	}
@@ -208,19 +656,11 @@ func loadIndex(layoutDir string) (*specs.Index, error) {
 	return &idx, nil
 }
 
-func findManifest(idx *specs.Index) (specs.Descriptor, error) {
-	for _, m := range idx.Manifests {
-		return m, nil
-	}
-	return specs.Descriptor{}, fmt.Errorf("no manifests in index")
-}
-
-func loadManifest(layoutDir string, desc specs.Descriptor) (*specs.Manifest, error) {
+func loadManifest(l layout, desc specs.Descriptor) (*specs.Manifest, error) {
 	if desc.MediaType != specs.MediaTypeImageManifest {
-		return nil, errors.New("descriptor is not an image manifest")
+		return nil, fmt.Errorf("%w for an image manifest: %s", ErrUnsupportedMediaType, desc.MediaType)
 	}
-	blobPath := filepath.Join(layoutDir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
-	b, err := os.ReadFile(blobPath)
+	b, err := readBlob(l, desc)
 	if err != nil {
 		return nil, err
 	}
@@ -231,6 +671,18 @@ func loadManifest(layoutDir string, desc specs.Descriptor) (*specs.Manifest, err
 	return &m, nil
 }
 
+func loadConfig(l layout, desc specs.Descriptor) (*specs.Image, error) {
+	b, err := readBlob(l, desc)
+	if err != nil {
+		return nil, err
+	}
+	var c specs.Image
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", desc.Digest, err)
+	}
+	return &c, nil
+}
+
 // --- Utilities ---
 
 func cleanPath(p string) string {
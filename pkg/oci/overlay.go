@@ -0,0 +1,126 @@
+package oci
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Overlay puts the files of dir on top of the image base as one more layer,
+// so that local changes can be tried out without rebuilding the image.
+// Files in dir replace the image's files at the same paths and directories
+// merge with the image's, and files following the OCI whiteout convention,
+// .wh.<name> and .wh..wh..opq, delete or hide the image's files as in any
+// other layer.
+//
+// Entries from dir are owned by root and keep their mode, modification
+// time, and symlink targets. base must not have been read from yet. It is
+// returned as the merged Reader, so overlays can be chained, the last one
+// ending up on top.
+func Overlay(base *Reader, dir fs.FS) (*Reader, error) {
+	if base.pos != -1 {
+		return nil, errors.New("oci: overlay on a Reader already read from")
+	}
+	count := new(layerCounters)
+	lr := openDirLayer(dir, base.Warn, count)
+	base.descs = append([]specs.Descriptor{{MediaType: specs.MediaTypeImageLayer}}, base.descs...)
+	base.progress = append([]*layerCounters{count}, base.progress...)
+	base.layers = append([]*layerReader{lr}, base.layers...)
+	base.dirLayers = append([]fs.FS{dir}, base.dirLayers...)
+	return base, nil
+}
+
+// openLayer opens the layer at pos in reading order, to be read through
+// at once.
+func (r *Reader) openLayer(pos int) (*layerReader, error) {
+	if pos < len(r.dirLayers) && r.dirLayers[pos] != nil {
+		return openDirLayer(r.dirLayers[pos], nil, nil), nil
+	}
+	if r.skips(pos) {
+		return emptyLayer(), nil
+	}
+	lr, err := openLayer(r.layout, r.descs[pos], &r.opts, nil)
+	if err == nil {
+		lr.begin()
+	}
+	return lr, err
+}
+
+// openDirLayer returns a layer reading dir as a tar stream, written on the
+// fly by a goroutine that stops when the layer is closed. If warn is set,
+// it is told of what the stream leaves out of dir; if count is, of what is
+// read of it.
+func openDirLayer(dir fs.FS, warn func(Warning), count *layerCounters) *layerReader {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeDirTar(pw, dir, warn))
+	}()
+	var r io.ReadCloser = pr
+	if count != nil {
+		r = countingReader{countingReader{pr, &count.read}, &count.uncompressed}
+	}
+	return &layerReader{closer: r, tr: tar.NewReader(r), count: count}
+}
+
+func writeDirTar(w io.Writer, dir fs.FS, warn func(Warning)) error {
+	if warn == nil {
+		warn = func(Warning) {}
+	}
+	tw := tar.NewWriter(w)
+	err := fs.WalkDir(dir, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSocket != 0 {
+			// tar can't hold sockets, and they're useless at boot
+			warn(Warning{Kind: WarnSkippedSocket, Name: name})
+			return nil
+		}
+		var link string
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if link, err = fs.ReadLink(dir, name); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		hdr.ModTime = fi.ModTime().Truncate(time.Second)
+		if !hdr.ModTime.Equal(fi.ModTime()) {
+			warn(Warning{Kind: WarnTruncatedTimestamp, Name: name, Detail: "to whole seconds"})
+		}
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := dir.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
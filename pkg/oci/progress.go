@@ -0,0 +1,104 @@
+package oci
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// LayerProgress is how far a Reader has got through one layer.
+type LayerProgress struct {
+	Index  int           `json:"index"`  // position in the manifest, base first
+	Digest digest.Digest `json:"digest"` // empty for an Overlay directory
+	Size   int64         `json:"size"`   // of the blob, as its descriptor says
+
+	// MediaType is the layer's media type, as its descriptor says; Skipped
+	// reports whether the Reader left the layer out because it can't
+	// decode it, see WithSkipUnsupportedLayers.
+	MediaType string `json:"mediaType"`
+	Skipped   bool   `json:"skipped,omitempty"`
+
+	Read         int64 `json:"read"`         // bytes of the blob read
+	Uncompressed int64 `json:"uncompressed"` // bytes of tar stream decompressed from them
+	Entries      int64 `json:"entries"`      // tar entries read, whiteouts included
+
+	// Duration is the time from the first read of the layer until the
+	// last; Done reports whether the layer was read to the end.
+	Duration time.Duration `json:"duration"`
+	Done     bool          `json:"done"`
+}
+
+// layerCounters are updated as a layer is read and read by LayerProgress,
+// possibly from another goroutine.
+type layerCounters struct {
+	read, uncompressed, entries atomic.Int64
+	start, end                  atomic.Int64 // Unix nanoseconds
+	done                        atomic.Bool
+}
+
+func newCounters(n int) []*layerCounters {
+	c := make([]*layerCounters, n)
+	for i := range c {
+		c[i] = new(layerCounters)
+	}
+	return c
+}
+
+// begin notes that reading of the layer has started.
+func (c *layerCounters) begin() {
+	now := time.Now().UnixNano()
+	c.start.Store(now)
+	c.end.Store(now)
+}
+
+// finish notes that the layer has been read to the end.
+func (c *layerCounters) finish() {
+	c.end.Store(time.Now().UnixNano())
+	c.done.Store(true)
+}
+
+// LayerProgress returns the progress of each layer, base first, as far as
+// the Reader has got. Layers that failed with WithKeepGoing, or were
+// skipped, stay not done.
+// It may be called while another goroutine reads from the Reader, for
+// example to draw a progress bar.
+func (r *Reader) LayerProgress() []LayerProgress {
+	p := make([]LayerProgress, len(r.descs))
+	for i := range p {
+		pos := len(r.descs) - 1 - i
+		c := r.progress[pos]
+		p[i] = LayerProgress{
+			Index:        i,
+			Digest:       r.descs[pos].Digest,
+			Size:         r.descs[pos].Size,
+			MediaType:    r.descs[pos].MediaType,
+			Skipped:      r.skips(pos),
+			Read:         c.read.Load(),
+			Uncompressed: c.uncompressed.Load(),
+			Entries:      c.entries.Load(),
+			Done:         c.done.Load(),
+		}
+		if start := c.start.Load(); start != 0 {
+			end := c.end.Load()
+			if !p[i].Done {
+				end = time.Now().UnixNano()
+			}
+			p[i].Duration = time.Duration(end - start)
+		}
+	}
+	return p
+}
+
+// countingReader counts the bytes read through it into n.
+type countingReader struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
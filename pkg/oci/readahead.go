@@ -0,0 +1,140 @@
+package oci
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// readAheadBlock is the size of each read issued by a readAhead.
+const readAheadBlock = 1 << 20
+
+var readAheadPool = sync.Pool{
+	New: func() any { return make([]byte, readAheadBlock) },
+}
+
+// readAhead reads a file sequentially while keeping up to depth positioned
+// reads (pread) of the blocks ahead in flight, so that decompression of one
+// block overlaps with I/O on the next ones. This hides the per-request
+// latency of spinning disks and network filesystems, where a plain
+// sequential reader leaves the device idle while the consumer works.
+//
+// It reads ahead only once started, so that a Reader, which opens every
+// layer up front, holds blocks of the current layer alone; until then it
+// reads what is asked of it, such as the start of the layer to tell its
+// compression, and no more.
+type readAhead struct {
+	f       *os.File
+	size    int64
+	queue   chan chan readResult // pending blocks in file order
+	done    chan struct{}
+	started bool
+	once    sync.Once
+
+	pos int64  // read position before start
+	buf []byte // block being consumed
+	off int    // read position in buf
+	err error
+}
+
+type readResult struct {
+	buf []byte
+	n   int
+	err error
+}
+
+func newReadAhead(f *os.File, depth int) (*readAhead, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &readAhead{
+		f:     f,
+		size:  fi.Size(),
+		queue: make(chan chan readResult, depth),
+		done:  make(chan struct{}),
+	}, nil
+}
+
+// start starts reading ahead of what has been read so far.
+func (r *readAhead) start() {
+	if !r.started {
+		r.started = true
+		go r.fetch(r.pos)
+	}
+}
+
+// fetch issues the block reads in order from off, blocking while depth of
+// them are queued and not yet consumed.
+func (r *readAhead) fetch(off int64) {
+	defer close(r.queue)
+	for ; off < r.size; off += readAheadBlock {
+		ch := make(chan readResult, 1)
+		select {
+		case r.queue <- ch:
+		case <-r.done:
+			return
+		}
+		go func(off int64) {
+			buf := readAheadPool.Get().([]byte)
+			n, err := r.f.ReadAt(buf, off)
+			if err == io.EOF && n > 0 {
+				err = nil
+			}
+			ch <- readResult{buf, n, err}
+		}(off)
+	}
+}
+
+func (r *readAhead) Read(p []byte) (int, error) {
+	if !r.started {
+		n, err := r.f.ReadAt(p, r.pos)
+		r.pos += int64(n)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+	for r.buf == nil || r.off == len(r.buf) {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.buf != nil {
+			readAheadPool.Put(r.buf[:cap(r.buf)])
+			r.buf = nil
+		}
+		ch, ok := <-r.queue
+		if !ok {
+			r.err = io.EOF
+			continue
+		}
+		res := <-ch
+		if res.err != nil {
+			readAheadPool.Put(res.buf)
+			r.err = res.err
+			continue
+		}
+		r.buf, r.off = res.buf[:res.n], 0
+	}
+	n := copy(p, r.buf[r.off:])
+	r.off += n
+	return n, nil
+}
+
+// Close stops reading ahead, waits for the reads in flight to return
+// their blocks to the pool, and closes the file.
+func (r *readAhead) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+		if r.started {
+			for ch := range r.queue {
+				readAheadPool.Put((<-ch).buf)
+			}
+		}
+		if r.buf != nil {
+			readAheadPool.Put(r.buf[:cap(r.buf)])
+			r.buf = nil
+		}
+	})
+	return r.f.Close()
+}
@@ -0,0 +1,131 @@
+package oci
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+// Only the layer being read reads ahead, and read ahead, a layer reads the
+// same as it does plainly, past the start read to tell its compression.
+func TestReadAheadOfCurrentLayer(t *testing.T) {
+	rng := rand.New(rand.NewChaCha8([32]byte{}))
+	noise := make([]byte, 3*readAheadBlock+123) // compresses to several blocks
+	for i := range noise {
+		noise[i] = byte(rng.Uint32())
+	}
+	dir := ocitest.Layout(t, ocitest.New(
+		ocitest.NewLayer().File("base", string(noise)),
+		ocitest.NewLayer().File("middle", "m"),
+		ocitest.NewLayer().Uncompressed().File("top", string(noise[:readAheadBlock+1])),
+	))
+	r, err := Open(dir, WithReadAhead(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// started reports which of the current layer and those after it have
+	// started reading ahead.
+	started := func() string {
+		var s []byte
+		for _, l := range append([]*layerReader{r.cur}, r.layers...) {
+			switch {
+			case l == nil:
+			case l.ahead.started:
+				s = append(s, 'y')
+			default:
+				s = append(s, 'n')
+			}
+		}
+		return string(s)
+	}
+	if s := started(); s != "nnn" {
+		t.Errorf("read ahead started %s after Open, want none", s)
+	}
+	for _, want := range []struct {
+		name    string
+		content []byte
+		started string
+	}{
+		{"top", noise[:readAheadBlock+1], "ynn"},
+		{"middle", []byte("m"), "yn"},
+		{"base", noise, "y"},
+	} {
+		hdr, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != want.name {
+			t.Fatalf("Next() = %s, want %s", hdr.Name, want.name)
+		}
+		if s := started(); s != want.started {
+			t.Errorf("read ahead started %s reading %s, want %s", s, hdr.Name, want.started)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, want.content) {
+			t.Errorf("%s: read %d bytes differing from the %d stored", hdr.Name, len(b), len(want.content))
+		}
+	}
+}
+
+// Closing a readAhead with reads in flight returns their blocks to the
+// pool rather than leaving them to the reads.
+func TestReadAheadClose(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "blob")
+	if err := os.WriteFile(name, make([]byte, 8*readAheadBlock), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra, err := newReadAhead(f, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra.start()
+	if _, err := io.ReadFull(ra, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ra.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-ra.queue; ok {
+		t.Error("blocks still queued after Close")
+	}
+	if ra.buf != nil {
+		t.Error("the block being consumed was kept after Close")
+	}
+}
+
+// WithMemoryLimit cuts the read-ahead to a quarter of it, and turns it off
+// if not even one read fits.
+func TestReadAheadUnderMemoryLimit(t *testing.T) {
+	for _, tc := range []struct {
+		limit int64
+		depth int
+	}{
+		{0, 8},
+		{64 * readAheadBlock, 8},
+		{16 * readAheadBlock, 3},
+		{4 * readAheadBlock, 0},
+		{1 << 10, 0},
+	} {
+		o := options{memoryLimit: tc.limit, readAhead: 8}
+		o.fitReadAhead()
+		if o.readAhead != tc.depth {
+			t.Errorf("read-ahead under a limit of %d = %d, want %d", tc.limit, o.readAhead, tc.depth)
+		}
+		if tc.limit > 0 && (o.readAhead+1)*readAheadBlock > int(tc.limit)/4 && o.readAhead > 0 {
+			t.Errorf("read-ahead of %d takes more than a quarter of %d", o.readAhead, tc.limit)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hxtk/ember/internal/pathset"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Option configures Open.
+type Option func(*options)
+
+type options struct {
+	artifactType string
+	labels       map[string]string
+	platform     *specs.Platform
+	mmap         bool
+	readAhead    int
+	verify       bool
+	memoryLimit  int64
+	keepGoing    bool
+	typeChanges  bool
+	deletions    bool
+
+	skipUnsupported bool
+	hardLinks       bool
+
+	verifyDiffIDs bool
+	diffIDs       map[digest.Digest]digest.Digest // layer blob -> diff ID
+}
+
+// WithArtifactType selects the first manifest whose artifact type is t
+// instead of the first image. Use it for layouts that publish a root
+// filesystem as an OCI artifact.
+func WithArtifactType(t string) Option {
+	return func(o *options) { o.artifactType = t }
+}
+
+// WithLabel selects the first manifest whose image config carries the
+// label key=value. It may be given several times; all labels must match.
+// This suits pipelines that tag image variants with labels rather than
+// reference annotations.
+func WithLabel(key, value string) Option {
+	return func(o *options) {
+		if o.labels == nil {
+			o.labels = make(map[string]string)
+		}
+		o.labels[key] = value
+	}
+}
+
+// WithPlatform selects the first image for platform p, as the platform of
+// its descriptor in the index says or, if that has none, its image config.
+// An empty variant matches any; arm64 images without one are taken to be
+// v8.
+func WithPlatform(p specs.Platform) Option {
+	return func(o *options) { o.platform = &p }
+}
+
+// ParsePlatform parses a platform written os/architecture[/variant], such
+// as linux/arm64 or linux/arm/v7.
+func ParsePlatform(s string) (specs.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return specs.Platform{}, fmt.Errorf("want os/architecture[/variant], got %q", s)
+	}
+	p := specs.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// PlatformString formats p as ParsePlatform reads it.
+func PlatformString(p specs.Platform) string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// WithMmap memory-maps layer blobs instead of reading them through file
+// descriptors. Decompression then reads straight from the page cache, with
+// no intermediate buffer or read syscalls, which lowers peak memory and CPU
+// for very large layers. On platforms without mmap it has no effect.
+func WithMmap() Option {
+	return func(o *options) { o.mmap = true }
+}
+
+// WithReadAhead keeps up to depth reads of 1 MiB ahead of the decompressor
+// in flight for the layer blob being read, overlapping I/O with
+// decompression. It helps on high-latency storage such as spinning disks
+// and network filesystems. A depth of 0 reads blobs plainly.
+func WithReadAhead(depth int) Option {
+	return func(o *options) { o.readAhead = depth }
+}
+
+// WithVerify checks every layer blob against the size and digest in its
+// descriptor as it is read. Reading a layer to the end fails with an error
+// naming the blob if it doesn't match. Digests are computed
+// concurrently with decompression, using the hashes set by RegisterHash.
+func WithVerify() Option {
+	return func(o *options) { o.verify = true }
+}
+
+// WithDiffIDVerify checks the decompressed content of every layer against
+// its diff ID in the image config as it is read, catching layers that were
+// recompressed or swapped for others in a hand-edited layout, which blob
+// digest checks (see WithVerify) pass when the descriptors were updated to
+// match. Reading a layer to the end fails with an error naming the layer
+// if it doesn't match, and Open fails if there is no image config or it
+// lists a different number of layers than the manifest.
+func WithDiffIDVerify() Option {
+	return func(o *options) { o.verifyDiffIDs = true }
+}
+
+// layerDiffIDs maps the layer blobs of manifest to their diff IDs in config.
+func layerDiffIDs(manifest *specs.Manifest, config *specs.Image) (map[digest.Digest]digest.Digest, error) {
+	if config == nil {
+		return nil, fmt.Errorf("verify diff IDs: manifest has no image config")
+	}
+	diffIDs := config.RootFS.DiffIDs
+	if len(diffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("verify diff IDs: config lists %d diff IDs for %d layers", len(diffIDs), len(manifest.Layers))
+	}
+	m := make(map[digest.Digest]digest.Digest, len(diffIDs))
+	for i, l := range manifest.Layers {
+		if prev, ok := m[l.Digest]; ok && prev != diffIDs[i] {
+			return nil, fmt.Errorf("verify diff IDs: layer %s has diff IDs %s and %s", l.Digest, prev, diffIDs[i])
+		}
+		m[l.Digest] = diffIDs[i]
+	}
+	return m, nil
+}
+
+// WithMemoryLimit bounds the memory the Reader uses for what grows with
+// the number of files in the image, the package documentation lists what,
+// to about n bytes. Beyond it, paths spill to sorted runs and lists in
+// unlinked temporary files, leaving about 2 bytes per path in memory for
+// Bloom filters and run indexes. The buffers of WithReadAhead count
+// against n too: its depth is cut to fit a quarter of n, or read-ahead is
+// turned off if not even one read does. Not counted are the fixed costs of
+// each open layer, chiefly its decompressor's window of up to 128 MiB for
+// zstd. A clone has its own n to use. A limit of 0 keeps all paths in
+// memory.
+func WithMemoryLimit(n int64) Option {
+	return func(o *options) { o.memoryLimit = n }
+}
+
+// fitReadAhead cuts the read-ahead depth so that its buffers, in flight and
+// the one being read, take at most a quarter of the memory limit.
+func (o *options) fitReadAhead() {
+	if o.memoryLimit > 0 && o.readAhead > 0 {
+		o.readAhead = max(0, min(o.readAhead, int(o.memoryLimit/4/readAheadBlock)-1))
+	}
+}
+
+// newBudget returns the budget for the paths of a Reader: the memory limit
+// less the read-ahead buffers.
+func (o *options) newBudget() *pathset.Budget {
+	limit := o.memoryLimit
+	if limit > 0 && o.readAhead > 0 {
+		limit -= int64(o.readAhead+1) * readAheadBlock
+	}
+	return pathset.NewBudget(limit)
+}
+
+// WithTypeChangeReplacement merges layers the way overlayfs does when a
+// path changes type between them: a file, symlink, or other
+// non-directory in an upper layer replaces a lower-layer directory at the
+// same path together with everything below it, instead of the lower
+// directory's children showing up underneath it. This also applies when
+// the non-directory is itself replaced by a directory from a layer above.
+//
+// Without it, such stale children are kept, which matches tools that
+// apply layers by extracting them in order without removing replaced
+// directories.
+func WithTypeChangeReplacement() Option {
+	return func(o *options) { o.typeChanges = true }
+}
+
+// candidate is a manifest found while walking an index.
+type candidate struct {
+	desc     specs.Descriptor
+	manifest *specs.Manifest
+	config   *specs.Image // set if loaded during selection
+}
+
+// selectManifest walks idx, descending into nested indexes, and returns the
+// first manifest accepted by the options. By default that is the first
+// image: manifests describing artifacts, such as signatures or SBOMs
+// attached to an image through their subject, are skipped rather than
+// mistaken for the image itself. Only if there is no image does the first
+// root filesystem artifact (see rootfsArtifact) stand in for it.
+func selectManifest(l layout, idx *specs.Index, o *options) (*candidate, error) {
+	var found, rootfs *candidate
+	var walk func(idx *specs.Index, depth int) error
+	walk = func(idx *specs.Index, depth int) error {
+		if depth > 8 {
+			return fmt.Errorf("image indexes nested too deeply")
+		}
+		for _, desc := range idx.Manifests {
+			switch desc.MediaType {
+			case specs.MediaTypeImageIndex:
+				b, err := readBlob(l, desc)
+				if err != nil {
+					return err
+				}
+				var nested specs.Index
+				if err := json.Unmarshal(b, &nested); err != nil {
+					return fmt.Errorf("parse index %s: %w", desc.Digest, err)
+				}
+				if err := walk(&nested, depth+1); err != nil || found != nil {
+					return err
+				}
+			case specs.MediaTypeImageManifest:
+				m, err := loadManifest(l, desc)
+				if err != nil {
+					return err
+				}
+				if rootfs == nil && rootfsArtifact(m) {
+					rootfs = &candidate{desc: desc, manifest: m}
+				}
+				if artifactType(desc, m) != o.artifactType {
+					continue
+				}
+				config, ok, err := matchLabels(l, m, o.labels)
+				if err == nil && ok && o.platform != nil {
+					config, ok, err = matchPlatform(l, desc, m, config, o.platform)
+				}
+				if err != nil {
+					return err
+				}
+				if ok {
+					found = &candidate{desc: desc, manifest: m, config: config}
+					return nil
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := walk(idx, 0); err != nil {
+		return nil, err
+	}
+	if found != nil {
+		return found, nil
+	}
+	if rootfs != nil && o.artifactType == "" && len(o.labels) == 0 && o.platform == nil {
+		return rootfs, nil
+	}
+	if len(o.labels) > 0 {
+		var want []string
+		for k, v := range o.labels {
+			want = append(want, k+"="+v)
+		}
+		sort.Strings(want)
+		return nil, fmt.Errorf("no manifest with labels %s in index", strings.Join(want, ","))
+	}
+	if o.artifactType != "" {
+		return nil, fmt.Errorf("no manifest with artifact type %q in index", o.artifactType)
+	}
+	if o.platform != nil {
+		return nil, fmt.Errorf("no image for platform %s in index", PlatformString(*o.platform))
+	}
+	if len(idx.Manifests) == 0 {
+		return nil, fmt.Errorf("no manifests in index")
+	}
+	return nil, fmt.Errorf("no image manifest in index")
+}
+
+// matchLabels reports whether the config of m has every label in want,
+// returning the config if it had to be loaded. The config is only loaded
+// when there are labels to match.
+func matchLabels(l layout, m *specs.Manifest, want map[string]string) (*specs.Image, bool, error) {
+	if len(want) == 0 {
+		return nil, true, nil
+	}
+	if m.Config.MediaType != specs.MediaTypeImageConfig {
+		return nil, false, nil
+	}
+	config, err := loadConfig(l, m.Config)
+	if err != nil {
+		return nil, false, err
+	}
+	for k, v := range want {
+		if got, ok := config.Config.Labels[k]; !ok || got != v {
+			return nil, false, nil
+		}
+	}
+	return config, true, nil
+}
+
+// matchPlatform reports whether the manifest m, of descriptor desc, is for
+// the platform want, returning its config if it had to be loaded; config is
+// the one already loaded, if any. Manifests of no known platform do not
+// match.
+func matchPlatform(l layout, desc specs.Descriptor, m *specs.Manifest, config *specs.Image, want *specs.Platform) (*specs.Image, bool, error) {
+	got := desc.Platform
+	if got == nil {
+		if config == nil {
+			if m.Config.MediaType != specs.MediaTypeImageConfig {
+				return nil, false, nil
+			}
+			var err error
+			if config, err = loadConfig(l, m.Config); err != nil {
+				return nil, false, err
+			}
+		}
+		got = &config.Platform
+	}
+	return config, platformMatches(*got, *want), nil
+}
+
+// platformMatches reports whether got satisfies want.
+func platformMatches(got, want specs.Platform) bool {
+	if got.OS != want.OS || got.Architecture != want.Architecture {
+		return false
+	}
+	variant := func(p specs.Platform) string {
+		if p.Variant == "" && p.Architecture == "arm64" {
+			return "v8"
+		}
+		return p.Variant
+	}
+	return want.Variant == "" || variant(got) == variant(want)
+}
+
+// rootfsArtifact reports whether m is an artifact carrying a single root
+// filesystem tar without a real image config, as some pipelines publish
+// instead of an image: its config is missing, the empty descriptor, or
+// ORAS's placeholder, its one layer is a tar, and it isn't attached to
+// another manifest through a subject.
+func rootfsArtifact(m *specs.Manifest) bool {
+	switch m.Config.MediaType {
+	case "", specs.MediaTypeEmptyJSON, "application/vnd.unknown.config.v1+json":
+	default:
+		return false
+	}
+	if m.Subject != nil || len(m.Layers) != 1 {
+		return false
+	}
+	_, ok := tarMediaTypes[m.Layers[0].MediaType]
+	return ok
+}
+
+// artifactType returns the artifact type of a manifest, or "" for an image.
+// Per the image spec, the type is the artifactType field when set, and
+// otherwise the config media type unless that is the image config.
+func artifactType(desc specs.Descriptor, m *specs.Manifest) string {
+	switch {
+	case desc.ArtifactType != "":
+		return desc.ArtifactType
+	case m.ArtifactType != "":
+		return m.ArtifactType
+	case m.Config.MediaType != specs.MediaTypeImageConfig:
+		return m.Config.MediaType
+	}
+	return ""
+}
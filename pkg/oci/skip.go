@@ -0,0 +1,68 @@
+package oci
+
+import (
+	"archive/tar"
+	"io"
+	"strings"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// SkippedLayer records a layer that a Reader opened
+// WithSkipUnsupportedLayers left out.
+type SkippedLayer struct {
+	Index     int    `json:"index"`  // position of the layer in the manifest, base first
+	Digest    string `json:"digest"` // digest of the layer blob
+	MediaType string `json:"mediaType"`
+}
+
+// WithSkipUnsupportedLayers makes the Reader leave out layers of a media
+// type it can't decode, such as foreign or bzip2-compressed layers,
+// instead of failing to open the image, so that what can be read of an
+// exotic image can still be examined. The merged view lacks whatever those
+// layers would have contributed, including their whiteouts, so files they
+// delete or replace show through from the layers below.
+//
+// Each skipped layer is reported with a WarnSkippedLayer warning, and all
+// of them are available from Skipped.
+func WithSkipUnsupportedLayers() Option {
+	return func(o *options) { o.skipUnsupported = true }
+}
+
+// Skipped returns the layers left out WithSkipUnsupportedLayers, base
+// first.
+func (r *Reader) Skipped() []SkippedLayer {
+	var skipped []SkippedLayer
+	for pos := len(r.descs) - 1; pos >= 0; pos-- {
+		if r.skips(pos) {
+			skipped = append(skipped, SkippedLayer{
+				Index:     len(r.descs) - 1 - pos,
+				Digest:    r.descs[pos].Digest.String(),
+				MediaType: r.descs[pos].MediaType,
+			})
+		}
+	}
+	return skipped
+}
+
+// skips reports whether the Reader leaves out the layer at pos, in reading
+// order.
+func (r *Reader) skips(pos int) bool {
+	if pos < len(r.dirLayers) && r.dirLayers[pos] != nil {
+		return false
+	}
+	return skipsLayer(&r.opts, r.descs[pos])
+}
+
+// skipsLayer reports whether o leaves out the layer of desc.
+func skipsLayer(o *options, desc specs.Descriptor) bool {
+	_, ok := tarMediaTypes[desc.MediaType]
+	return o.skipUnsupported && !ok
+}
+
+// emptyLayer stands in for a skipped layer where the Reader searches the
+// layers, for hard link targets and directory metadata.
+func emptyLayer() *layerReader {
+	r := io.NopCloser(strings.NewReader(""))
+	return &layerReader{closer: r, tr: tar.NewReader(r)}
+}
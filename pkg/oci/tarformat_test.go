@@ -0,0 +1,75 @@
+package oci_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/oci"
+	"github.com/hxtk/ember/pkg/ocitest"
+)
+
+// Names and link targets over the 100 bytes of a ustar header, which GNU
+// tar writes as longname and longlink records, merge like any other.
+func TestMergeGNULongNames(t *testing.T) {
+	dir := strings.Repeat("d", 60) + "/" + strings.Repeat("e", 60)
+	long, gone := dir+"/"+strings.Repeat("f", 60), dir+"/"+strings.Repeat("g", 60)
+	gnu := ocitest.Format(tar.FormatGNU)
+	lower := ocitest.NewLayer().
+		Dir(strings.Repeat("d", 60), gnu).
+		Dir(dir, gnu).
+		File(long, "lower", gnu).
+		File(gone, "lower", gnu)
+	upper := ocitest.NewLayer().
+		File(long, "upper", gnu).
+		Entry(&tar.Header{Typeflag: tar.TypeReg, Name: dir + "/.wh." + strings.Repeat("g", 60), Format: tar.FormatGNU}, nil).
+		Symlink(dir+"/sym", long, gnu).
+		Hardlink(dir+"/hard", long, gnu)
+	for _, l := range []*ocitest.Layer{lower, upper} {
+		b, err := l.Tar()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(b, []byte("././@LongLink")) {
+			t.Fatal("layer has no GNU long name records")
+		}
+	}
+
+	img := ocitest.New(lower, upper)
+	checkEntries(t, readAll(t, img), []string{
+		strings.Repeat("d", 60) + "/",
+		dir + "/",
+		long + ` "upper"`,
+		dir + "/sym -> " + long,
+		dir + "/hard " + `"upper"`,
+	})
+	checkEntries(t, readAll(t, img, oci.WithHardLinks()), []string{
+		strings.Repeat("d", 60) + "/",
+		dir + "/",
+		long + ` "upper" nlink=2`,
+		dir + "/sym -> " + long,
+		dir + "/hard => " + long + " nlink=2",
+	})
+}
+
+// A PAX global header between entries is no entry of the merged view.
+func TestMergeSkipsPAXGlobalHeaders(t *testing.T) {
+	global := &tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": "built by a tool"}}
+	img := ocitest.New(ocitest.NewLayer().
+		Entry(global, nil).
+		Dir("etc").
+		Entry(global, nil).
+		File("etc/hostname", "host"))
+	b, err := img.Layers[0].Tar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("pax_global_header")) {
+		t.Fatal("layer has no PAX global header")
+	}
+	checkEntries(t, readAll(t, img), []string{
+		`etc/`,
+		`etc/hostname "host"`,
+	})
+}
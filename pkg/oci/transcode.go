@@ -0,0 +1,304 @@
+package oci
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hxtk/ember/pkg/zstd"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Compression is the compression of a layer blob.
+type Compression string
+
+const (
+	Uncompressed Compression = "none"
+	Gzip         Compression = "gzip"
+	Zstd         Compression = "zstd"
+)
+
+// reader returns the decompressed content of r. Closing it doesn't close r.
+func (c Compression) reader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		return io.NopCloser(zstd.NewReader(r)), nil
+	}
+	return io.NopCloser(r), nil
+}
+
+// sniff returns the compression of the content of br as its first bytes
+// give it, or c, that of the media type, if they don't tell. Hand-assembled
+// layouts mislabel layers, mostly uncompressed ones as gzip.
+func (c Compression) sniff(br *bufio.Reader) Compression {
+	head, _ := br.Peek(262)
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return Gzip
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return Zstd
+	case len(head) == 262 && string(head[257:262]) == "ustar":
+		return Uncompressed
+	}
+	return c
+}
+
+// describe names c for humans.
+func (c Compression) describe() string {
+	if c == Uncompressed {
+		return "uncompressed"
+	}
+	return string(c)
+}
+
+// writer returns a writer compressing to w at level; 0 selects the
+// format's default level. Closing it doesn't close w.
+func (c Compression) writer(w io.Writer, level int) (io.WriteCloser, error) {
+	switch c {
+	case Gzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case Zstd:
+		if level == 0 {
+			level = zstd.DefaultLevel
+		}
+		return zstd.NewWriterLevel(w, level)
+	case Uncompressed:
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", c)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// layerMediaType returns the OCI media type of a tar layer compressed with c.
+func (c Compression) layerMediaType() string {
+	switch c {
+	case Gzip:
+		return specs.MediaTypeImageLayerGzip
+	case Zstd:
+		return specs.MediaTypeImageLayerZstd
+	}
+	return specs.MediaTypeImageLayer
+}
+
+// Transcode rewrites the layers of every image in the layout at src with
+// compression c at level (0 for the format's default), writing the new
+// blobs into w, and returns the index listing the rewritten images for
+// w.WriteIndex. w may be the layout at src itself; blobs that are no
+// longer referenced are left for garbage collection.
+//
+// Layers are decompressed and re-compressed, so their diff IDs and the
+// image configs stay the same while the manifests, and indexes listing
+// them, get new digests. Layer blobs are checked against their digests
+// while being read. Non-distributable layers, which may live outside the
+// layout, and manifests other than OCI image manifests and indexes are
+// kept as they are.
+func Transcode(src string, w *LayoutWriter, c Compression, level int) (*specs.Index, error) {
+	if _, err := c.writer(io.Discard, level); err != nil {
+		return nil, err
+	}
+	idx, err := loadIndex(dirLayout(src))
+	if err != nil {
+		return nil, fmt.Errorf("read index.json: %w", err)
+	}
+	t := &transcoder{src: src, w: w, c: c, level: level, done: make(map[string]specs.Descriptor)}
+	if t.same, err = sameDir(src, w.Dir()); err != nil {
+		return nil, err
+	}
+	out := *idx
+	if out.Manifests, err = t.descriptors(idx.Manifests); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func sameDir(a, b string) (bool, error) {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(fa, fb), nil
+}
+
+type transcoder struct {
+	src   string
+	w     *LayoutWriter
+	c     Compression
+	level int
+	same  bool // whether w writes to the layout at src
+
+	done map[string]specs.Descriptor // rewritten blobs by old digest
+}
+
+// descriptors rewrites the manifests that descs list.
+func (t *transcoder) descriptors(descs []specs.Descriptor) ([]specs.Descriptor, error) {
+	out := make([]specs.Descriptor, len(descs))
+	for i, d := range descs {
+		nd, err := t.manifest(d)
+		if err != nil {
+			return nil, fmt.Errorf("manifest %s: %w", d.Digest, err)
+		}
+		out[i] = nd
+	}
+	return out, nil
+}
+
+// manifest rewrites the manifest or index d and returns its new descriptor.
+func (t *transcoder) manifest(d specs.Descriptor) (specs.Descriptor, error) {
+	if nd, ok := t.done[d.Digest.String()]; ok {
+		return withDigest(d, nd), nil
+	}
+	var v any
+	switch d.MediaType {
+	case specs.MediaTypeImageManifest:
+		m, err := loadManifest(dirLayout(t.src), d)
+		if err != nil {
+			return specs.Descriptor{}, err
+		}
+		if err := t.copyBlob(m.Config); err != nil {
+			return specs.Descriptor{}, err
+		}
+		layers := make([]specs.Descriptor, len(m.Layers))
+		for i, l := range m.Layers {
+			if layers[i], err = t.layer(l); err != nil {
+				return specs.Descriptor{}, fmt.Errorf("layer %s: %w", l.Digest, err)
+			}
+		}
+		m.Layers = layers
+		v = m
+	case specs.MediaTypeImageIndex:
+		b, err := readBlob(dirLayout(t.src), d)
+		if err != nil {
+			return specs.Descriptor{}, err
+		}
+		var idx specs.Index
+		if err := json.Unmarshal(b, &idx); err != nil {
+			return specs.Descriptor{}, err
+		}
+		if idx.Manifests, err = t.descriptors(idx.Manifests); err != nil {
+			return specs.Descriptor{}, err
+		}
+		v = &idx
+	default:
+		return d, t.copyBlob(d)
+	}
+	nd, err := t.w.WriteJSON(d.MediaType, v)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	t.done[d.Digest.String()] = nd
+	return withDigest(d, nd), nil
+}
+
+// withDigest returns d pointing at the blob of nd instead.
+func withDigest(d, nd specs.Descriptor) specs.Descriptor {
+	d.MediaType, d.Digest, d.Size, d.Data = nd.MediaType, nd.Digest, nd.Size, nil
+	return d
+}
+
+// layer re-compresses the layer l and returns its new descriptor.
+func (t *transcoder) layer(l specs.Descriptor) (specs.Descriptor, error) {
+	c, ok := tarMediaTypes[l.MediaType]
+	if !ok || len(l.URLs) > 0 || nonDistributable(l.MediaType) {
+		return l, t.copyBlob(l)
+	}
+	if nd, ok := t.done[l.Digest.String()]; ok {
+		return withDigest(l, nd), nil
+	}
+
+	f, err := openBlob(dirLayout(t.src), l)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	v, err := newVerifyingReader(f, l)
+	if err != nil {
+		f.Close()
+		return specs.Descriptor{}, err
+	}
+	defer v.Close()
+	br := bufio.NewReader(v)
+	r, err := c.sniff(br).reader(br)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	defer r.Close()
+
+	bw, err := t.w.NewBlob()
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	defer bw.Close()
+	zw, err := t.c.writer(bw, t.level)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	if _, err := io.Copy(zw, r); err != nil {
+		return specs.Descriptor{}, err
+	}
+	if err := v.finish(); err != nil {
+		return specs.Descriptor{}, err
+	}
+	if err := zw.Close(); err != nil {
+		return specs.Descriptor{}, err
+	}
+	nd, err := bw.Commit(t.c.layerMediaType())
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	t.done[l.Digest.String()] = nd
+	return withDigest(l, nd), nil
+}
+
+func nonDistributable(mediaType string) bool {
+	switch mediaType {
+	case specs.MediaTypeImageLayerNonDistributable, specs.MediaTypeImageLayerNonDistributableGzip, specs.MediaTypeImageLayerNonDistributableZstd:
+		return true
+	}
+	return false
+}
+
+// copyBlob copies the blob of d into the output layout if that is another
+// layout, checking it against its digest.
+func (t *transcoder) copyBlob(d specs.Descriptor) error {
+	if t.same {
+		return nil
+	}
+	f, err := openBlob(dirLayout(t.src), d)
+	if err != nil {
+		return err
+	}
+	v, err := newVerifyingReader(f, d)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	defer v.Close()
+	bw, err := t.w.NewBlob()
+	if err != nil {
+		return err
+	}
+	defer bw.Close()
+	if _, err := io.Copy(bw, v); err != nil {
+		return err
+	}
+	if err := v.finish(); err != nil {
+		return err
+	}
+	_, err = bw.Commit(d.MediaType)
+	return err
+}
@@ -0,0 +1,183 @@
+package oci
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrDigestMismatch is wrapped by the errors for content that doesn't
+// match the digest it was verified against.
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+var (
+	hashMu    sync.RWMutex
+	hashPools = make(map[digest.Algorithm]*sync.Pool)
+)
+
+// RegisterHash makes blob verification compute digests of algorithm alg
+// with hashes from newHash, for example to plug in an accelerated SHA-256
+// implementation. crypto/sha256 already uses the SHA-NI and ARMv8 SHA
+// instructions where available, so this mainly matters on CPUs where a
+// vectorised implementation is faster. Call it before opening readers.
+func RegisterHash(alg digest.Algorithm, newHash func() hash.Hash) {
+	hashMu.Lock()
+	defer hashMu.Unlock()
+	hashPools[alg] = &sync.Pool{New: func() any { return newHash() }}
+}
+
+// hashPool returns the pool of hashes for alg. Pooling keeps verification
+// of many small blobs from allocating a hash state for each.
+func hashPool(alg digest.Algorithm) (*sync.Pool, error) {
+	hashMu.RLock()
+	p := hashPools[alg]
+	hashMu.RUnlock()
+	if p != nil {
+		return p, nil
+	}
+	if !alg.Available() {
+		return nil, fmt.Errorf("unsupported digest algorithm %q", alg)
+	}
+	hashMu.Lock()
+	defer hashMu.Unlock()
+	if p = hashPools[alg]; p == nil {
+		p = &sync.Pool{New: func() any { return alg.Hash() }}
+		hashPools[alg] = p
+	}
+	return p, nil
+}
+
+// verifyChunk is the size of the chunks handed to the hashing goroutine.
+const verifyChunk = 64 << 10
+
+var verifyBufPool = sync.Pool{
+	New: func() any { return make([]byte, verifyChunk) },
+}
+
+// verifyingReader checks a blob against its descriptor, or decompressed
+// layer content against its diff ID, while it is read.
+// Hashing runs on its own goroutine, fed copies of the data read, so that
+// it overlaps decompression instead of adding to it.
+//
+// The check happens once the blob has been read to the end; finish drains
+// what the consumer didn't read, such as padding after a tar archive's end
+// marker, so that the whole blob is covered.
+type verifyingReader struct {
+	r      io.ReadCloser
+	name   string // what is verified, for errors
+	digest digest.Digest
+	size   int64 // expected size, or -1 if unknown
+	n      int64
+
+	chunks chan []byte
+	sum    chan digest.Digest
+	done   bool
+	err    error
+}
+
+func newVerifyingReader(r io.ReadCloser, desc specs.Descriptor) (*verifyingReader, error) {
+	return newDigestReader(r, "blob "+desc.Digest.String(), desc.Digest, desc.Size)
+}
+
+// newDiffIDReader checks the decompressed content r of the layer blob
+// against diffID, the digest of the uncompressed tar that the image config
+// lists for it.
+func newDiffIDReader(r io.ReadCloser, blob, diffID digest.Digest) (*verifyingReader, error) {
+	return newDigestReader(r, fmt.Sprintf("layer %s with diff ID %s", blob, diffID), diffID, -1)
+}
+
+func newDigestReader(r io.ReadCloser, name string, d digest.Digest, size int64) (*verifyingReader, error) {
+	if err := d.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	pool, err := hashPool(d.Algorithm())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	v := &verifyingReader{
+		r:      r,
+		name:   name,
+		digest: d,
+		size:   size,
+		chunks: make(chan []byte, 8),
+		sum:    make(chan digest.Digest, 1),
+	}
+	go func() {
+		h := pool.Get().(hash.Hash)
+		h.Reset()
+		for c := range v.chunks {
+			h.Write(c)
+			verifyBufPool.Put(c[:cap(c)])
+		}
+		v.sum <- digest.NewDigest(d.Algorithm(), h)
+		pool.Put(h)
+	}()
+	return v, nil
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.done {
+		return 0, v.err
+	}
+	n, err := v.r.Read(p)
+	v.n += int64(n)
+	for b := p[:n]; len(b) > 0; {
+		c := verifyBufPool.Get().([]byte)
+		m := copy(c, b)
+		v.chunks <- c[:m]
+		b = b[m:]
+	}
+	if err == io.EOF {
+		if verr := v.check(); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+// check completes the digest and compares it, and the size if known, against
+// the expected ones.
+func (v *verifyingReader) check() error {
+	if !v.done {
+		v.done = true
+		close(v.chunks)
+		got := <-v.sum
+		switch {
+		case v.size >= 0 && v.n != v.size:
+			v.err = fmt.Errorf("%s: size is %d bytes, descriptor says %d", v.name, v.n, v.size)
+		case got != v.digest:
+			v.err = fmt.Errorf("%s: %w, content has digest %s", v.name, ErrDigestMismatch, got)
+		default:
+			v.err = io.EOF
+		}
+	}
+	if v.err == io.EOF {
+		return nil
+	}
+	return v.err
+}
+
+// finish reads the rest of the content and verifies it.
+func (v *verifyingReader) finish() error {
+	if _, err := io.Copy(io.Discard, v); err != nil {
+		return err
+	}
+	return v.check()
+}
+
+// Close closes the content without verifying it unless it was read to the
+// end.
+func (v *verifyingReader) Close() error {
+	if !v.done {
+		v.done = true
+		v.err = io.ErrClosedPipe
+		close(v.chunks)
+		<-v.sum
+	}
+	return v.r.Close()
+}
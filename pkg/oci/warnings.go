@@ -0,0 +1,142 @@
+package oci
+
+import (
+	"fmt"
+	"sync"
+)
+
+// WarningKind says what a Warning is about.
+type WarningKind int
+
+const (
+	// WarnLostXattr is an extended attribute that the output can't hold.
+	WarnLostXattr WarningKind = iota + 1
+	// WarnSkippedSocket is a socket left out, as tar and initramfs have no
+	// use for one.
+	WarnSkippedSocket
+	// WarnTruncatedTimestamp is a modification time cut to what the output
+	// can hold, such as whole seconds.
+	WarnTruncatedTimestamp
+	// WarnMislabeledLayer is a layer whose content is not compressed as its
+	// media type says, which is read as it is instead. Its Name is the
+	// layer's digest.
+	WarnMislabeledLayer
+	// WarnSkippedLayer is a layer of an unsupported media type left out
+	// WithSkipUnsupportedLayers. Its Name is the layer's digest.
+	WarnSkippedLayer
+)
+
+func (k WarningKind) String() string {
+	switch k {
+	case WarnLostXattr:
+		return "lost xattr"
+	case WarnSkippedSocket:
+		return "skipped socket"
+	case WarnTruncatedTimestamp:
+		return "truncated timestamp"
+	case WarnMislabeledLayer:
+		return "mislabeled layer"
+	case WarnSkippedLayer:
+		return "skipped layer"
+	}
+	return fmt.Sprintf("warning %d", int(k))
+}
+
+// Warning reports an entry that didn't make it into the output intact.
+type Warning struct {
+	Kind   WarningKind
+	Name   string // the entry, as the Reader names it
+	Detail string // what was lost, such as the name of the xattr
+}
+
+func (w Warning) String() string {
+	if w.Detail == "" {
+		return fmt.Sprintf("%s: %s", w.Name, w.Kind)
+	}
+	return fmt.Sprintf("%s: %s: %s", w.Name, w.Kind, w.Detail)
+}
+
+// Warnings returns a channel of the warnings about the entries read, for
+// callers that enforce a policy on what may be lost, such as failing a
+// build that would drop a security.capability xattr. It carries both the
+// Reader's own warnings, such as sockets an Overlay directory leaves out,
+// and those of consumers that give them to Warn, such as conversion to
+// cpio, which has no room for xattrs or sub-second times.
+//
+// Warnings are queued without bound until received, so the channel can be
+// drained while reading or afterwards. It is closed once Next has returned
+// an error, io.EOF included, and the queued warnings have been received.
+// Every call returns the same channel.
+func (r *Reader) Warnings() <-chan Warning {
+	return r.warnings.channel()
+}
+
+// Warn adds w to the warnings of r. Consumers of the entries call it for
+// what they lose, before their next call to Next; warnings given after
+// Next returned an error are dropped.
+func (r *Reader) Warn(w Warning) {
+	r.warnings.add(w)
+}
+
+// warnings queues warnings for the channel of Reader.Warnings.
+type warnings struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue []Warning
+	done  bool
+	ch    chan Warning
+}
+
+func (q *warnings) add(w Warning) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.done {
+		return
+	}
+	q.queue = append(q.queue, w)
+	if q.cond != nil {
+		q.cond.Signal()
+	}
+}
+
+// finish closes the channel once the queue is drained.
+func (q *warnings) finish() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.done = true
+	if q.cond != nil {
+		q.cond.Signal()
+	}
+}
+
+// channel returns the channel of the queue, starting the goroutine that
+// feeds it on first use.
+func (q *warnings) channel() <-chan Warning {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.ch == nil {
+		q.ch = make(chan Warning)
+		q.cond = sync.NewCond(&q.mu)
+		go q.feed()
+	}
+	return q.ch
+}
+
+func (q *warnings) feed() {
+	q.mu.Lock()
+	for {
+		for len(q.queue) == 0 && !q.done {
+			q.cond.Wait()
+		}
+		if len(q.queue) == 0 {
+			q.mu.Unlock()
+			close(q.ch)
+			return
+		}
+		w := q.queue[0]
+		q.queue = q.queue[1:]
+		q.mu.Unlock()
+		q.ch <- w
+		q.mu.Lock()
+	}
+}
@@ -0,0 +1,537 @@
+// Package ocitest builds OCI image layouts programmatically so tests can
+// exercise layer merge semantics without committing binary fixtures.
+//
+// Layers are described entry by entry and serialized in memory. The
+// resulting layout can be materialized into a directory (for oci.Open) or
+// inspected as an fs.FS.
+//
+// Usage:
+//
+//	img := ocitest.New(
+//	    ocitest.NewLayer().
+//	        Dir("etc").
+//	        File("etc/hostname", "base\n"),
+//	    ocitest.NewLayer().
+//	        Whiteout("etc/hostname").
+//	        Opaque("var/cache"),
+//	)
+//	dir := ocitest.Layout(t, img)
+package ocitest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	_ "crypto/sha256" // Register the digest algorithm of the blobs.
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Epoch is the modification time given to entries that don't set one, so
+// generated layouts are byte-for-byte reproducible.
+var Epoch = time.Unix(0, 0).UTC()
+
+// EntryOption customizes a single layer entry.
+type EntryOption func(*tar.Header)
+
+// Mode sets the permission bits of an entry.
+func Mode(mode int64) EntryOption {
+	return func(h *tar.Header) { h.Mode = mode }
+}
+
+// Owner sets the numeric owner of an entry.
+func Owner(uid, gid int) EntryOption {
+	return func(h *tar.Header) { h.Uid, h.Gid = uid, gid }
+}
+
+// ModTime sets the modification time of an entry.
+func ModTime(t time.Time) EntryOption {
+	return func(h *tar.Header) { h.ModTime = t }
+}
+
+// Format forces the tar format used to encode an entry, e.g. tar.FormatGNU
+// to produce GNU longname/longlink records for names over 100 bytes.
+func Format(f tar.Format) EntryOption {
+	return func(h *tar.Header) { h.Format = f }
+}
+
+// Xattr attaches an extended attribute to an entry as a SCHILY.xattr PAX
+// record.
+func Xattr(name, value string) EntryOption {
+	return func(h *tar.Header) {
+		if h.PAXRecords == nil {
+			h.PAXRecords = make(map[string]string)
+		}
+		h.PAXRecords["SCHILY.xattr."+name] = value
+		h.Format = tar.FormatPAX
+	}
+}
+
+// Layer is an ordered list of tar entries making up one image layer.
+type Layer struct {
+	entries   []entry
+	gzip      bool
+	mediaType string // of the descriptor, if not the one gzip implies
+	err       error
+}
+
+type entry struct {
+	hdr  *tar.Header
+	body []byte
+
+	// sparse holds the data fragments of a PAX 1.0 sparse file. When set,
+	// the entry is serialized by hand because archive/tar cannot write
+	// sparse files.
+	sparse []Fragment
+}
+
+// Fragment is a run of data in a sparse file. Any bytes not covered by a
+// fragment are holes.
+type Fragment struct {
+	Offset int64
+	Data   []byte
+}
+
+// NewLayer returns an empty gzip-compressed layer.
+func NewLayer() *Layer {
+	return &Layer{gzip: true}
+}
+
+// Uncompressed marks the layer to be stored with the plain tar media type.
+func (l *Layer) Uncompressed() *Layer {
+	l.gzip = false
+	return l
+}
+
+// MediaType sets the media type the manifest gives the layer, such as one
+// a reader doesn't support, instead of the one its compression implies.
+func (l *Layer) MediaType(t string) *Layer {
+	l.mediaType = t
+	return l
+}
+
+// Dir adds a directory entry.
+func (l *Layer) Dir(name string, opts ...EntryOption) *Layer {
+	return l.add(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0o755,
+	}, nil, opts)
+}
+
+// File adds a regular file entry with the given content.
+func (l *Layer) File(name, content string, opts ...EntryOption) *Layer {
+	return l.add(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     int64(len(content)),
+	}, []byte(content), opts)
+}
+
+// Symlink adds a symbolic link pointing at target.
+func (l *Layer) Symlink(name, target string, opts ...EntryOption) *Layer {
+	return l.add(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     name,
+		Linkname: target,
+		Mode:     0o777,
+	}, nil, opts)
+}
+
+// Hardlink adds a hard link to target, which may live in this layer or in
+// a lower one.
+func (l *Layer) Hardlink(name, target string, opts ...EntryOption) *Layer {
+	return l.add(&tar.Header{
+		Typeflag: tar.TypeLink,
+		Name:     name,
+		Linkname: target,
+		Mode:     0o644,
+	}, nil, opts)
+}
+
+// CharDevice adds a character device node.
+func (l *Layer) CharDevice(name string, major, minor int64, opts ...EntryOption) *Layer {
+	return l.add(&tar.Header{
+		Typeflag: tar.TypeChar,
+		Name:     name,
+		Mode:     0o600,
+		Devmajor: major,
+		Devminor: minor,
+	}, nil, opts)
+}
+
+// BlockDevice adds a block device node.
+func (l *Layer) BlockDevice(name string, major, minor int64, opts ...EntryOption) *Layer {
+	return l.add(&tar.Header{
+		Typeflag: tar.TypeBlock,
+		Name:     name,
+		Mode:     0o600,
+		Devmajor: major,
+		Devminor: minor,
+	}, nil, opts)
+}
+
+// Fifo adds a named pipe.
+func (l *Layer) Fifo(name string, opts ...EntryOption) *Layer {
+	return l.add(&tar.Header{
+		Typeflag: tar.TypeFifo,
+		Name:     name,
+		Mode:     0o644,
+	}, nil, opts)
+}
+
+// Whiteout adds a whiteout marker deleting name from lower layers.
+func (l *Layer) Whiteout(name string) *Layer {
+	return l.add(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join(path.Dir(name), ".wh."+path.Base(name)),
+		Mode:     0o644,
+	}, nil, nil)
+}
+
+// Opaque adds an opaque-directory marker hiding everything below dir in
+// lower layers.
+func (l *Layer) Opaque(dir string) *Layer {
+	return l.add(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join(dir, ".wh..wh..opq"),
+		Mode:     0o644,
+	}, nil, nil)
+}
+
+// Sparse adds a regular file of logical size size, encoded with the PAX
+// GNU sparse 1.0 format. Bytes outside of frags read back as zeros.
+func (l *Layer) Sparse(name string, size int64, frags []Fragment, opts ...EntryOption) *Layer {
+	frags = append([]Fragment(nil), frags...)
+	sort.Slice(frags, func(i, j int) bool { return frags[i].Offset < frags[j].Offset })
+	var end int64
+	for _, f := range frags {
+		if f.Offset < end || f.Offset+int64(len(f.Data)) > size {
+			l.fail(fmt.Errorf("sparse %q: fragment at %d overlaps or exceeds size", name, f.Offset))
+			return l
+		}
+		end = f.Offset + int64(len(f.Data))
+	}
+	l.add(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     size,
+	}, nil, opts)
+	if l.err == nil {
+		l.entries[len(l.entries)-1].sparse = frags
+	}
+	return l
+}
+
+// Entry adds an arbitrary tar entry. It is an escape hatch for header
+// shapes the other builders don't cover.
+func (l *Layer) Entry(hdr *tar.Header, body []byte) *Layer {
+	h := *hdr
+	l.entries = append(l.entries, entry{hdr: &h, body: body})
+	return l
+}
+
+func (l *Layer) add(hdr *tar.Header, body []byte, opts []EntryOption) *Layer {
+	hdr.ModTime = Epoch
+	for _, opt := range opts {
+		opt(hdr)
+	}
+	l.entries = append(l.entries, entry{hdr: hdr, body: body})
+	return l
+}
+
+func (l *Layer) fail(err error) {
+	if l.err == nil {
+		l.err = err
+	}
+}
+
+// Tar serializes the layer as an uncompressed tar stream.
+func (l *Layer) Tar() ([]byte, error) {
+	if l.err != nil {
+		return nil, l.err
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range l.entries {
+		if e.sparse != nil {
+			if err := tw.Flush(); err != nil {
+				return nil, err
+			}
+			if err := writeSparse(&buf, e.hdr, e.sparse); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := tw.WriteHeader(e.hdr); err != nil {
+			return nil, fmt.Errorf("write header %q: %w", e.hdr.Name, err)
+		}
+		if _, err := tw.Write(e.body); err != nil {
+			return nil, fmt.Errorf("write body %q: %w", e.hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Image is an ordered stack of layers, base first.
+type Image struct {
+	Layers []*Layer
+
+	// Annotations are added to the manifest descriptor in index.json.
+	// By default the descriptor is tagged "latest".
+	Annotations map[string]string
+
+	// Config is the image configuration. RootFS is filled in from the
+	// layers when the layout is built.
+	Config specs.Image
+}
+
+// New returns an image built from layers, base first.
+func New(layers ...*Layer) *Image {
+	return &Image{
+		Layers: layers,
+		Annotations: map[string]string{
+			specs.AnnotationRefName: "latest",
+		},
+		Config: specs.Image{
+			Platform: specs.Platform{
+				Architecture: "amd64",
+				OS:           "linux",
+			},
+		},
+	}
+}
+
+// FS builds the OCI layout in memory.
+func (img *Image) FS() (fstest.MapFS, error) {
+	files := fstest.MapFS{
+		specs.ImageLayoutFile: &fstest.MapFile{
+			Data: []byte(`{"imageLayoutVersion":"` + specs.ImageLayoutVersion + `"}`),
+			Mode: 0o644,
+		},
+	}
+	addBlob := func(mediaType string, b []byte) specs.Descriptor {
+		d := digest.FromBytes(b)
+		files[path.Join("blobs", d.Algorithm().String(), d.Encoded())] = &fstest.MapFile{Data: b, Mode: 0o644}
+		return specs.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(b))}
+	}
+
+	config := img.Config
+	config.RootFS = specs.RootFS{Type: "layers"}
+	manifest := specs.Manifest{MediaType: specs.MediaTypeImageManifest}
+	manifest.SchemaVersion = 2
+	for i, l := range img.Layers {
+		raw, err := l.Tar()
+		if err != nil {
+			return nil, fmt.Errorf("layer %d: %w", i, err)
+		}
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digest.FromBytes(raw))
+		mediaType, blob := specs.MediaTypeImageLayer, raw
+		if l.gzip {
+			var gz bytes.Buffer
+			zw := gzip.NewWriter(&gz)
+			if _, err := zw.Write(raw); err != nil {
+				return nil, err
+			}
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+			mediaType, blob = specs.MediaTypeImageLayerGzip, gz.Bytes()
+		}
+		if l.mediaType != "" {
+			mediaType = l.mediaType
+		}
+		manifest.Layers = append(manifest.Layers, addBlob(mediaType, blob))
+	}
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Config = addBlob(specs.MediaTypeImageConfig, b)
+
+	if b, err = json.Marshal(manifest); err != nil {
+		return nil, err
+	}
+	desc := addBlob(specs.MediaTypeImageManifest, b)
+	desc.Annotations = img.Annotations
+
+	idx := specs.Index{MediaType: specs.MediaTypeImageIndex, Manifests: []specs.Descriptor{desc}}
+	idx.SchemaVersion = 2
+	if b, err = json.Marshal(idx); err != nil {
+		return nil, err
+	}
+	files["index.json"] = &fstest.MapFile{Data: b, Mode: 0o644}
+	return files, nil
+}
+
+// Write materializes the OCI layout into dir, creating it if needed.
+func (img *Image) Write(dir string) error {
+	files, err := img.FS()
+	if err != nil {
+		return err
+	}
+	return fs.WalkDir(files, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		if d.IsDir() {
+			return os.MkdirAll(dst, 0o755)
+		}
+		return os.WriteFile(dst, files[name].Data, 0o644)
+	})
+}
+
+// Layout writes img into a fresh temporary directory and returns its path.
+// The test fails immediately if the layout can't be built.
+func Layout(tb testing.TB, img *Image) string {
+	tb.Helper()
+	dir := tb.TempDir()
+	if err := img.Write(dir); err != nil {
+		tb.Fatalf("ocitest: write layout: %v", err)
+	}
+	return dir
+}
+
+// writeSparse emits hdr as a PAX GNU sparse 1.0 entry: an extended header
+// carrying the real name and size, followed by a data section that starts
+// with the block-padded sparse map and continues with the packed fragments.
+func writeSparse(buf *bytes.Buffer, hdr *tar.Header, frags []Fragment) error {
+	var sparseMap []byte
+	sparseMap = strconv.AppendInt(sparseMap, int64(len(frags)), 10)
+	sparseMap = append(sparseMap, '\n')
+	var dataLen int64
+	for _, f := range frags {
+		sparseMap = strconv.AppendInt(sparseMap, f.Offset, 10)
+		sparseMap = append(sparseMap, '\n')
+		sparseMap = strconv.AppendInt(sparseMap, int64(len(f.Data)), 10)
+		sparseMap = append(sparseMap, '\n')
+		dataLen += int64(len(f.Data))
+	}
+	sparseMap = append(sparseMap, make([]byte, padding(int64(len(sparseMap))))...)
+	size := int64(len(sparseMap)) + dataLen
+
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     hdr.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(hdr.Size, 10),
+	}
+	for k, v := range hdr.PAXRecords {
+		records[k] = v
+	}
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pax []byte
+	for _, k := range keys {
+		pax = append(pax, paxRecord(k, records[k])...)
+	}
+
+	dir, file := path.Split(hdr.Name)
+	if err := writeRawHeader(buf, &tar.Header{
+		Typeflag: tar.TypeXHeader,
+		Name:     path.Join(dir, "PaxHeaders.0", file),
+		Mode:     0o644,
+		Size:     int64(len(pax)),
+		ModTime:  hdr.ModTime,
+	}); err != nil {
+		return err
+	}
+	writePadded(buf, pax)
+
+	stub := *hdr
+	stub.Name = path.Join(dir, "GNUSparseFile.0", file)
+	stub.Size = size
+	if err := writeRawHeader(buf, &stub); err != nil {
+		return err
+	}
+	body := append([]byte(nil), sparseMap...)
+	for _, f := range frags {
+		body = append(body, f.Data...)
+	}
+	writePadded(buf, body)
+	return nil
+}
+
+// writeRawHeader encodes a single USTAR header block. Names must fit the
+// 100-byte name field; fixtures needing longer names should use Entry.
+func writeRawHeader(buf *bytes.Buffer, hdr *tar.Header) error {
+	if len(hdr.Name) > 100 {
+		return fmt.Errorf("raw header %q: name too long", hdr.Name)
+	}
+	var blk [512]byte
+	copy(blk[0:100], hdr.Name)
+	octal(blk[100:108], hdr.Mode)
+	octal(blk[108:116], int64(hdr.Uid))
+	octal(blk[116:124], int64(hdr.Gid))
+	octal(blk[124:136], hdr.Size)
+	octal(blk[136:148], hdr.ModTime.Unix())
+	blk[156] = hdr.Typeflag
+	copy(blk[157:257], hdr.Linkname)
+	copy(blk[257:265], "ustar\x0000")
+	copy(blk[265:297], hdr.Uname)
+	copy(blk[297:329], hdr.Gname)
+	octal(blk[329:337], hdr.Devmajor)
+	octal(blk[337:345], hdr.Devminor)
+
+	copy(blk[148:156], "        ")
+	var sum int64
+	for _, c := range blk {
+		sum += int64(c)
+	}
+	octal(blk[148:155], sum)
+	blk[155] = ' '
+	buf.Write(blk[:])
+	return nil
+}
+
+func octal(dst []byte, v int64) {
+	s := strconv.FormatInt(v, 8)
+	n := len(dst) - 1 // Leave room for the NUL terminator
+	for len(s) < n {
+		s = "0" + s
+	}
+	copy(dst, s)
+}
+
+func paxRecord(k, v string) string {
+	const sep = 3 // ' ', '=', and '\n'
+	size := len(k) + len(v) + sep
+	size += len(strconv.Itoa(size))
+	rec := strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	if len(rec) != size {
+		size = len(rec)
+		rec = strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	}
+	return rec
+}
+
+func writePadded(buf *bytes.Buffer, b []byte) {
+	buf.Write(b)
+	buf.Write(make([]byte, padding(int64(len(b)))))
+}
+
+func padding(n int64) int64 {
+	return -n & 511
+}
@@ -0,0 +1,65 @@
+package ocitest_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/ocitest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TestLayout builds a layout importing nothing but ocitest, which must
+// register the digest algorithm of its blobs itself.
+func TestLayout(t *testing.T) {
+	img := ocitest.New(
+		ocitest.NewLayer().Dir("etc").File("etc/hostname", "base\n"),
+		ocitest.NewLayer().Uncompressed().Whiteout("etc/hostname"),
+	)
+	dir := ocitest.Layout(t, img)
+
+	var idx specs.Index
+	readJSON(t, dir, "index.json", &idx)
+	if len(idx.Manifests) != 1 {
+		t.Fatalf("index.json has %d manifests, want 1", len(idx.Manifests))
+	}
+	var manifest specs.Manifest
+	readJSON(t, dir, blobPath(idx.Manifests[0]), &manifest)
+	if len(manifest.Layers) != 2 {
+		t.Fatalf("manifest has %d layers, want 2", len(manifest.Layers))
+	}
+	for i, want := range []string{specs.MediaTypeImageLayerGzip, specs.MediaTypeImageLayer} {
+		desc := manifest.Layers[i]
+		if desc.MediaType != want {
+			t.Errorf("layer %d has media type %s, want %s", i, desc.MediaType, want)
+		}
+		fi, err := os.Stat(filepath.Join(dir, blobPath(desc)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != desc.Size {
+			t.Errorf("layer %d blob has %d bytes, its descriptor says %d", i, fi.Size(), desc.Size)
+		}
+	}
+	var config specs.Image
+	readJSON(t, dir, blobPath(manifest.Config), &config)
+	if len(config.RootFS.DiffIDs) != 2 {
+		t.Errorf("config has %d diff IDs, want 2", len(config.RootFS.DiffIDs))
+	}
+}
+
+func blobPath(desc specs.Descriptor) string {
+	return filepath.Join("blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+}
+
+func readJSON(t *testing.T, dir, name string, v any) {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+}
@@ -0,0 +1,104 @@
+// Package pkgdb reads the databases in which distribution package managers
+// record the packages installed in a root filesystem.
+package pkgdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// Package managers.
+const (
+	APK  = "apk"
+	Dpkg = "dpkg"
+	RPM  = "rpm"
+)
+
+// ErrUnsupported is returned by Parse for databases this package recognises
+// but cannot read, such as rpm's BerkeleyDB and SQLite databases.
+var ErrUnsupported = errors.New("unsupported package database")
+
+// Package is an installed package.
+type Package struct {
+	Manager string `json:"manager"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Manager returns the package manager whose database is at the slash-
+// separated path name in a root filesystem, or "" if name is not a package
+// database. The status.d directory of dpkg is the form distroless images
+// use.
+func Manager(name string) string {
+	switch name = strings.TrimPrefix(path.Clean("/"+name), "/"); {
+	case name == "lib/apk/db/installed":
+		return APK
+	case name == "var/lib/dpkg/status",
+		path.Dir(name) == "var/lib/dpkg/status.d" && !strings.Contains(path.Base(name), "."):
+		return Dpkg
+	case name == "var/lib/rpm/Packages", name == "var/lib/rpm/Packages.db",
+		name == "var/lib/rpm/rpmdb.sqlite", name == "usr/lib/sysimage/rpm/rpmdb.sqlite":
+		return RPM
+	}
+	return ""
+}
+
+// Parse reads the packages recorded in the database of manager read from
+// r.
+func Parse(manager string, r io.Reader) ([]Package, error) {
+	switch manager {
+	case APK:
+		return parseStanzas(r, APK, "P", "V", "")
+	case Dpkg:
+		return parseStanzas(r, Dpkg, "Package", "Version", "Status")
+	}
+	return nil, fmt.Errorf("%s: %w", manager, ErrUnsupported)
+}
+
+// parseStanzas parses the blank-line separated stanzas of key:value lines
+// that apk and dpkg use. If status is set, only packages whose status
+// field ends in "installed" count, as dpkg keeps removed packages'
+// records.
+func parseStanzas(r io.Reader, manager, name, version, status string) ([]Package, error) {
+	var pkgs []Package
+	var cur Package
+	installed := status == ""
+	flush := func() {
+		if cur.Name != "" && installed {
+			cur.Manager = manager
+			pkgs = append(pkgs, cur)
+		}
+		cur, installed = Package{}, status == ""
+	}
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			continue // continuation of a multi-line field
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case key == name:
+			cur.Name = value
+		case key == version:
+			cur.Version = value
+		case status != "" && key == status:
+			installed = strings.HasSuffix(value, " installed")
+		}
+	}
+	flush()
+	return pkgs, s.Err()
+}
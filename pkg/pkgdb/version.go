@@ -0,0 +1,193 @@
+package pkgdb
+
+import (
+	"strconv"
+	"strings"
+)
+
+// CompareVersions compares two versions of a package of manager, returning
+// a negative number if a is older than b, zero if they are the same, and a
+// positive number if a is newer. rpm versions are compared like dpkg ones
+// without epochs, which agrees with rpm for the common cases.
+func CompareVersions(manager, a, b string) int {
+	if manager == APK {
+		return compareAPK(a, b)
+	}
+	return compareDpkg(a, b)
+}
+
+// compareDpkg implements dpkg's comparison of [epoch:]upstream[-revision]
+// versions.
+func compareDpkg(a, b string) int {
+	ea, ua, ra := splitDpkg(a)
+	eb, ub, rb := splitDpkg(b)
+	if ea != eb {
+		if ea < eb {
+			return -1
+		}
+		return 1
+	}
+	if c := verrevcmp(ua, ub); c != 0 {
+		return c
+	}
+	return verrevcmp(ra, rb)
+}
+
+func splitDpkg(v string) (epoch int, upstream, revision string) {
+	if e, rest, ok := strings.Cut(v, ":"); ok {
+		epoch, _ = strconv.Atoi(e)
+		v = rest
+	}
+	if i := strings.LastIndexByte(v, '-'); i >= 0 {
+		return epoch, v[:i], v[i+1:]
+	}
+	return epoch, v, ""
+}
+
+// verrevcmp compares alternating runs of non-digits, in which letters sort
+// before other characters and ~ before everything, even the end, and runs
+// of digits, compared numerically.
+func verrevcmp(a, b string) int {
+	at := func(s string, i int) byte {
+		if i < len(s) {
+			return s[i]
+		}
+		return 0
+	}
+	order := func(c byte) int {
+		switch {
+		case c == 0, isDigit(c):
+			return 0
+		case isLetter(c):
+			return int(c)
+		case c == '~':
+			return -1
+		}
+		return int(c) + 256
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for (i < len(a) && !isDigit(a[i])) || (j < len(b) && !isDigit(b[j])) {
+			if ac, bc := order(at(a, i)), order(at(b, j)); ac != bc {
+				return ac - bc
+			}
+			i, j = i+1, j+1
+		}
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		firstDiff := 0
+		for i < len(a) && isDigit(a[i]) && j < len(b) && isDigit(b[j]) {
+			if firstDiff == 0 {
+				firstDiff = int(a[i]) - int(b[j])
+			}
+			i, j = i+1, j+1
+		}
+		if i < len(a) && isDigit(a[i]) {
+			return 1
+		}
+		if j < len(b) && isDigit(b[j]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return firstDiff
+		}
+	}
+	return 0
+}
+
+// apkVersion is a parsed apk version:
+// digit{.digit}[letter]{_suffix[digits]}[~hash][-rN].
+type apkVersion struct {
+	nums     []string
+	letter   byte
+	suffixes []apkSuffix
+	revision int
+}
+
+type apkSuffix struct {
+	rank int // see apkSuffixRank
+	num  int
+}
+
+// apkSuffixRank orders the pre-release suffixes before a plain version
+// (rank 0) and the post-release ones after it.
+var apkSuffixRank = map[string]int{
+	"alpha": -4, "beta": -3, "pre": -2, "rc": -1,
+	"cvs": 1, "svn": 2, "git": 3, "hg": 4, "p": 5,
+}
+
+func parseAPK(v string) apkVersion {
+	var p apkVersion
+	if i := strings.LastIndex(v, "-r"); i >= 0 {
+		p.revision, _ = strconv.Atoi(v[i+2:])
+		v = v[:i]
+	}
+	if i := strings.IndexByte(v, '~'); i >= 0 {
+		v = v[:i]
+	}
+	main, suffixes, _ := strings.Cut(v, "_")
+	if n := len(main); n > 0 && isLetter(main[n-1]) {
+		p.letter = main[n-1]
+		main = main[:n-1]
+	}
+	p.nums = strings.Split(main, ".")
+	if suffixes != "" {
+		for _, s := range strings.Split(suffixes, "_") {
+			name := strings.TrimRightFunc(s, func(r rune) bool { return r >= '0' && r <= '9' })
+			num, _ := strconv.Atoi(s[len(name):])
+			p.suffixes = append(p.suffixes, apkSuffix{apkSuffixRank[name], num})
+		}
+	}
+	return p
+}
+
+// compareAPK implements apk's version ordering.
+func compareAPK(a, b string) int {
+	pa, pb := parseAPK(a), parseAPK(b)
+	for i := 0; i < len(pa.nums) || i < len(pb.nums); i++ {
+		if i >= len(pa.nums) {
+			return -1
+		}
+		if i >= len(pb.nums) {
+			return 1
+		}
+		if c := compareDigits(pa.nums[i], pb.nums[i]); c != 0 {
+			return c
+		}
+	}
+	if pa.letter != pb.letter {
+		return int(pa.letter) - int(pb.letter)
+	}
+	for i := 0; i < len(pa.suffixes) || i < len(pb.suffixes); i++ {
+		var sa, sb apkSuffix
+		if i < len(pa.suffixes) {
+			sa = pa.suffixes[i]
+		}
+		if i < len(pb.suffixes) {
+			sb = pb.suffixes[i]
+		}
+		if sa.rank != sb.rank {
+			return sa.rank - sb.rank
+		}
+		if sa.num != sb.num {
+			return sa.num - sb.num
+		}
+	}
+	return pa.revision - pb.revision
+}
+
+// compareDigits compares two runs of decimal digits numerically.
+func compareDigits(a, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
@@ -0,0 +1,222 @@
+// Package qemuboot smoke-tests an initramfs by booting it under QEMU and
+// checking what the kernel and init print on the serial console against a
+// Script.
+package qemuboot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErrFailed is wrapped by the error of a boot that did not pass its
+// script.
+var ErrFailed = errors.New("boot test failed")
+
+// Machine is how QEMU emulates one architecture.
+type Machine struct {
+	QEMU    string   // the system emulator
+	Args    []string // selecting the machine and CPU
+	Console string   // the console= of its first serial port
+}
+
+// machines are the QEMU machines for GOARCH values.
+var machines = map[string]Machine{
+	"386":     {QEMU: "qemu-system-i386", Args: []string{"-machine", "accel=kvm:tcg"}, Console: "ttyS0"},
+	"amd64":   {QEMU: "qemu-system-x86_64", Args: []string{"-machine", "accel=kvm:tcg"}, Console: "ttyS0"},
+	"arm":     {QEMU: "qemu-system-arm", Args: []string{"-machine", "virt", "-cpu", "max"}, Console: "ttyAMA0"},
+	"arm64":   {QEMU: "qemu-system-aarch64", Args: []string{"-machine", "virt", "-cpu", "max"}, Console: "ttyAMA0"},
+	"riscv64": {QEMU: "qemu-system-riscv64", Args: []string{"-machine", "virt"}, Console: "ttyS0"},
+}
+
+// MachineFor returns the machine emulating arch, a GOARCH value.
+func MachineFor(arch string) (Machine, error) {
+	m, ok := machines[arch]
+	if !ok {
+		return Machine{}, fmt.Errorf("no QEMU machine is known for architecture %q", arch)
+	}
+	return m, nil
+}
+
+// Config describes a boot.
+type Config struct {
+	Machine Machine
+	Kernel  string
+	Initrd  string
+	Memory  string   // as QEMU's -m takes it, such as 512M
+	Cmdline string   // appended to the console and panic arguments Boot sets
+	Args    []string // more QEMU arguments
+
+	// Console, if not nil, is sent everything the serial console prints.
+	Console io.Writer
+}
+
+// Boot boots the kernel and initrd of cfg and runs script against the
+// serial console, stopping QEMU once the script passes or fails. The
+// kernel is told to write to the serial console, to print informational
+// messages, and to reboot at once if it panics, which makes QEMU exit. An
+// error wrapping ErrFailed reports a boot that did not pass; others, that
+// QEMU could not be run.
+func Boot(cfg Config, script *Script) error {
+	if _, err := exec.LookPath(cfg.Machine.QEMU); err != nil {
+		return fmt.Errorf("%w; install QEMU or name the emulator to run", err)
+	}
+	cmdline := "console=" + cfg.Machine.Console + " panic=-1 loglevel=7"
+	if cfg.Cmdline != "" {
+		cmdline += " " + cfg.Cmdline
+	}
+	args := append([]string{}, cfg.Machine.Args...)
+	args = append(args,
+		"-kernel", cfg.Kernel,
+		"-initrd", cfg.Initrd,
+		"-append", cmdline,
+		"-display", "none",
+		"-monitor", "none",
+		"-serial", "stdio",
+		"-no-reboot",
+	)
+	if cfg.Memory != "" {
+		args = append(args, "-m", cfg.Memory)
+	}
+	args = append(args, cfg.Args...)
+
+	cmd := exec.Command(cfg.Machine.QEMU, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = time.Second
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	con := &console{out: make(chan []byte), fails: script.fails, w: cfg.Console}
+	go con.read(stdout)
+
+	err = con.run(script.steps, stdin)
+	_ = cmd.Process.Kill()
+	waitErr := cmd.Wait()
+	for range con.out {
+		// Wait has closed stdout, ending read.
+	}
+	if errors.Is(err, errExited) {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" && waitErr != nil {
+			msg = waitErr.Error()
+		}
+		if msg != "" {
+			return fmt.Errorf("%w: %v: %s", ErrFailed, err, msg)
+		}
+		return fmt.Errorf("%w: %v", ErrFailed, err)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFailed, err)
+	}
+	return nil
+}
+
+// errExited reports that QEMU exited before the script was done.
+var errExited = errors.New("QEMU exited")
+
+// console is the serial console of a running boot.
+type console struct {
+	out   chan []byte // what QEMU prints, closed when it exits
+	fails []*regexp.Regexp
+	w     io.Writer
+
+	buf  []byte // everything printed
+	pos  int    // where the next expect looks from
+	line int    // start of the line fail patterns have yet to see
+}
+
+func (c *console) read(r io.Reader) {
+	defer close(c.out)
+	for {
+		b := make([]byte, 4096)
+		n, err := r.Read(b)
+		if n > 0 {
+			c.out <- b[:n]
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// run performs steps, typing at in.
+func (c *console) run(steps []step, in io.Writer) error {
+	for _, st := range steps {
+		switch {
+		case st.send != "":
+			if _, err := io.WriteString(in, st.send); err != nil {
+				return fmt.Errorf("%s: %w", st, err)
+			}
+		case st.expect != nil:
+			deadline := time.After(st.timeout)
+			for {
+				if loc := st.expect.FindIndex(c.buf[c.pos:]); loc != nil {
+					c.pos += loc[1]
+					break
+				}
+				if err := c.next(deadline); err != nil {
+					return fmt.Errorf("%s: %w", st, err)
+				}
+			}
+		default:
+			deadline := time.After(st.wait)
+			for {
+				err := c.next(deadline)
+				if errors.Is(err, errTimeout) {
+					break
+				}
+				if err != nil {
+					return fmt.Errorf("%s: %w", st, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// errTimeout reports that the deadline of a step passed.
+var errTimeout = errors.New("timed out")
+
+// next waits for more console output until deadline, checking each line
+// it completes against the fail patterns.
+func (c *console) next(deadline <-chan time.Time) error {
+	select {
+	case b, ok := <-c.out:
+		if !ok {
+			return errExited
+		}
+		if c.w != nil {
+			c.w.Write(b)
+		}
+		c.buf = append(c.buf, b...)
+		for {
+			i := bytes.IndexByte(c.buf[c.line:], '\n')
+			if i < 0 {
+				return nil
+			}
+			line := bytes.TrimRight(c.buf[c.line:c.line+i], "\r")
+			c.line += i + 1
+			for _, re := range c.fails {
+				if re.Match(line) {
+					return fmt.Errorf("the console printed %q", line)
+				}
+			}
+		}
+	case <-deadline:
+		return errTimeout
+	}
+}
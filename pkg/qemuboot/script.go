@@ -0,0 +1,114 @@
+package qemuboot
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Script says what a boot must print on the serial console to pass. It
+// is read one step per line:
+//
+//	expect <regexp>    wait until the console prints a match
+//	send <text>        type text and a newline at the console
+//	wait <duration>    let the boot run on for the duration
+//	timeout <duration> bound each later expect, 60s by default
+//	fail <regexp>      fail as soon as a console line matches (anywhere)
+//
+// Blank lines and lines starting with # are skipped. The text of send may
+// be a Go string literal, for control characters or leading spaces. The
+// boot passes once every step is done.
+type Script struct {
+	steps []step
+	fails []*regexp.Regexp
+}
+
+type step struct {
+	line    int
+	expect  *regexp.Regexp
+	send    string
+	wait    time.Duration
+	timeout time.Duration // for expect
+}
+
+// defaultTimeout is how long an expect waits unless the script says.
+const defaultTimeout = 60 * time.Second
+
+// DefaultScript passes once the kernel has run init and the system has
+// stayed up for five seconds, neither panicking, as it does when init
+// exits, nor failing to start init. It needs the kernel to print
+// informational messages, as loglevel=7 has it do.
+const DefaultScript = `fail Kernel panic
+fail Failed to execute
+expect Run \S+ as init process
+wait 5s
+`
+
+// ParseScript reads a Script from r.
+func ParseScript(r io.Reader) (*Script, error) {
+	s := &Script{}
+	timeout := defaultTimeout
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+		var err error
+		switch verb {
+		case "expect", "fail":
+			var re *regexp.Regexp
+			if re, err = regexp.Compile(arg); err != nil {
+				break
+			}
+			if verb == "fail" {
+				s.fails = append(s.fails, re)
+			} else {
+				s.steps = append(s.steps, step{line: n, expect: re, timeout: timeout})
+			}
+		case "send":
+			if strings.HasPrefix(arg, `"`) {
+				if arg, err = strconv.Unquote(arg); err != nil {
+					break
+				}
+			}
+			s.steps = append(s.steps, step{line: n, send: arg + "\n"})
+		case "wait", "timeout":
+			var d time.Duration
+			if d, err = time.ParseDuration(arg); err != nil {
+				break
+			}
+			if verb == "timeout" {
+				timeout = d
+			} else {
+				s.steps = append(s.steps, step{line: n, wait: d})
+			}
+		default:
+			err = fmt.Errorf("unknown step %q", verb)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// String describes the step for errors.
+func (st step) String() string {
+	switch {
+	case st.expect != nil:
+		return fmt.Sprintf("line %d: expect %s", st.line, st.expect)
+	case st.send != "":
+		return fmt.Sprintf("line %d: send %q", st.line, strings.TrimSuffix(st.send, "\n"))
+	}
+	return fmt.Sprintf("line %d: wait %s", st.line, st.wait)
+}
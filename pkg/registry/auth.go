@@ -0,0 +1,226 @@
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Login is a username and password for a registry.
+type Login struct {
+	Username, Password string
+}
+
+// Credentials maps registry hosts to logins.
+type Credentials map[string]Login
+
+// Lookup returns the login for registry, which may be given as a host or
+// as a URL like the https://index.docker.io/v1/ that docker uses for
+// Docker Hub.
+func (c Credentials) Lookup(registry string) (Login, bool) {
+	l, ok := c[credentialKey(registry)]
+	return l, ok
+}
+
+func credentialKey(s string) string {
+	if u, err := url.Parse(s); err == nil && u.Host != "" {
+		s = u.Host
+	}
+	switch s {
+	case DockerHub, "index.docker.io", "registry-1.docker.io":
+		return DockerHub
+	}
+	return s
+}
+
+// LoadCredentials reads the logins stored by docker login and podman
+// login: $DOCKER_CONFIG/config.json (by default ~/.docker/config.json), and
+// $REGISTRY_AUTH_FILE (by default $XDG_RUNTIME_DIR/containers/auth.json),
+// which takes precedence. Missing files hold no logins. Logins kept by
+// credential helpers are not supported.
+func LoadCredentials() (Credentials, error) {
+	var files []string
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		files = append(files, filepath.Join(dir, "config.json"))
+	} else if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".docker", "config.json"))
+	}
+	if f := os.Getenv("REGISTRY_AUTH_FILE"); f != "" {
+		files = append(files, f)
+	} else if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		files = append(files, filepath.Join(dir, "containers", "auth.json"))
+	}
+
+	creds := make(Credentials)
+	for _, name := range files {
+		if err := readAuthFile(name, creds); err != nil {
+			return nil, err
+		}
+	}
+	return creds, nil
+}
+
+// ReadAuthFile adds the logins in name, a docker config.json or podman
+// auth.json, to c, replacing those for the same registries.
+func (c Credentials) ReadAuthFile(name string) error {
+	if _, err := os.Stat(name); err != nil {
+		return err
+	}
+	return readAuthFile(name, c)
+}
+
+func readAuthFile(name string, creds Credentials) error {
+	b, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var cfg struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	for host, a := range cfg.Auths {
+		l := Login{a.Username, a.Password}
+		if a.Auth != "" {
+			dec, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return fmt.Errorf("%s: login for %s: %w", name, host, err)
+			}
+			l.Username, l.Password, _ = strings.Cut(string(dec), ":")
+		}
+		if l.Username != "" || l.Password != "" {
+			creds[credentialKey(host)] = l
+		}
+	}
+	return nil
+}
+
+// authorizer obtains and caches the Authorization headers of a client.
+type authorizer struct {
+	mu      sync.Mutex
+	headers map[string]string // by host and scope
+}
+
+func (a *authorizer) get(key string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.headers[key]
+}
+
+func (a *authorizer) set(key, header string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.headers == nil {
+		a.headers = make(map[string]string)
+	}
+	a.headers[key] = header
+}
+
+// challenge is a parsed WWW-Authenticate header.
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+// parseChallenge parses the first challenge of a WWW-Authenticate header,
+// e.g. Bearer realm="https://auth.example.com/token",service="example".
+func parseChallenge(h string) (challenge, bool) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(h), " ")
+	if scheme == "" {
+		return challenge{}, false
+	}
+	c := challenge{scheme: strings.ToLower(scheme), params: make(map[string]string)}
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		k, v, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		k = strings.ToLower(strings.TrimSpace(k))
+		if strings.HasPrefix(v, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(v) && v[i] != '"'; i++ {
+				if v[i] == '\\' && i+1 < len(v) {
+					i++
+				}
+				b.WriteByte(v[i])
+			}
+			c.params[k] = b.String()
+			v = v[min(i+1, len(v)):]
+		} else {
+			end := strings.IndexByte(v, ',')
+			if end < 0 {
+				end = len(v)
+			}
+			c.params[k] = strings.TrimSpace(v[:end])
+			v = v[end:]
+		}
+		rest = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(v), ","))
+	}
+	return c, true
+}
+
+// token fetches a bearer token as the challenge directs, authenticating
+// with login if there is one.
+func (c *Client) token(ctx context.Context, ch challenge, scope string, login Login, hasLogin bool) (string, error) {
+	realm := ch.params["realm"]
+	if realm == "" {
+		return "", errors.New("bearer challenge without realm")
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("token realm: %w", err)
+	}
+	q := u.Query()
+	if s := ch.params["service"]; s != "" {
+		q.Set("service", s)
+	}
+	q.Set("scope", scope)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if hasLogin {
+		req.SetBasicAuth(login.Username, login.Password)
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token from %s: %s", u.Host, resp.Status)
+	}
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", fmt.Errorf("token from %s: %w", u.Host, err)
+	}
+	if tok.Token == "" {
+		tok.Token = tok.AccessToken
+	}
+	if tok.Token == "" {
+		return "", fmt.Errorf("token from %s: empty token", u.Host)
+	}
+	return tok.Token, nil
+}
@@ -0,0 +1,338 @@
+// Package registry is a client for the OCI distribution API that container
+// registries serve. It covers what copying images needs: fetching and
+// pushing manifests and blobs by digest or tag, with the basic and bearer
+// token authentication that registries ask for.
+package registry
+
+import (
+	"bytes"
+	"context"
+	_ "crypto/sha256" // Register the digest algorithm of manifests.
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrNotFound is wrapped by the errors for manifests and blobs the
+// registry doesn't have.
+var ErrNotFound = errors.New("not found")
+
+// ErrDigestMismatch is wrapped by the errors for manifests whose content
+// doesn't have the digest they were fetched by.
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+// Docker schema 2 media types, which registries still serve for many
+// images.
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// IsManifest reports whether content of the media type is an index or
+// manifest, stored under the manifests endpoint rather than as a blob.
+func IsManifest(mediaType string) bool {
+	switch mediaType {
+	case specs.MediaTypeImageIndex, specs.MediaTypeImageManifest, MediaTypeDockerManifest, MediaTypeDockerManifestList:
+		return true
+	}
+	return false
+}
+
+var manifestAccept = strings.Join([]string{
+	specs.MediaTypeImageIndex,
+	specs.MediaTypeImageManifest,
+	MediaTypeDockerManifestList,
+	MediaTypeDockerManifest,
+}, ", ")
+
+// maxManifestSize bounds the manifests Manifest reads, as registries do.
+const maxManifestSize = 4 << 20
+
+// Client talks to registries. The zero value is ready to use for
+// anonymous access over HTTPS.
+type Client struct {
+	// HTTP sends the requests; nil means http.DefaultClient.
+	HTTP *http.Client
+	// Credentials are the logins used for registries that ask for one.
+	Credentials Credentials
+	// PlainHTTP makes the client speak HTTP instead of HTTPS, for local
+	// test registries.
+	PlainHTTP bool
+	// Limit, if not nil, caps the rate at which blobs are fetched.
+	Limit *Limiter
+	// Retry says how requests that fail in ways that may pass are
+	// retried.
+	Retry RetryPolicy
+
+	auth authorizer
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTP != nil {
+		return c.HTTP
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) url(ref Reference, suffix string) string {
+	scheme := "https"
+	if c.PlainHTTP {
+		scheme = "http"
+	}
+	return scheme + "://" + ref.host() + "/v2/" + ref.Repository + "/" + suffix
+}
+
+// do sends req for the repository of ref, authenticating as the registry
+// asks and trying again once if it does, and retrying as c.Retry says. Requests whose body can't be replayed
+// are not retried, so a push should first make a request that can be.
+func (c *Client) do(req *http.Request, ref Reference, push bool) (*http.Response, error) {
+	scope := "repository:" + ref.Repository + ":pull"
+	if push {
+		scope += ",push"
+	}
+	// Credentials are only for the registry itself, not for other hosts
+	// that it may send uploads to.
+	if req.URL.Host != ref.host() {
+		return c.send(req)
+	}
+	key := ref.host() + " " + scope
+	if h := c.auth.get(key); h != "" {
+		req.Header.Set("Authorization", h)
+	}
+	resp, err := c.send(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	ch, ok := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	if !ok || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+	resp.Body.Close()
+	login, hasLogin := c.Credentials.Lookup(ref.Registry)
+	var h string
+	switch ch.scheme {
+	case "bearer":
+		tok, err := c.token(req.Context(), ch, scope, login, hasLogin)
+		if err != nil {
+			return nil, fmt.Errorf("authenticate to %s: %w", ref.Registry, err)
+		}
+		h = "Bearer " + tok
+	case "basic":
+		if !hasLogin {
+			return nil, fmt.Errorf("%s requires a login", ref.Registry)
+		}
+		r := http.Request{Header: make(http.Header)}
+		r.SetBasicAuth(login.Username, login.Password)
+		h = r.Header.Get("Authorization")
+	default:
+		return nil, fmt.Errorf("%s: unsupported authentication scheme %q", ref.Registry, ch.scheme)
+	}
+	c.auth.set(key, h)
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set("Authorization", h)
+	return c.send(retry)
+}
+
+// responseError describes an unexpected response, with the messages of
+// the distribution API error body if it has one.
+func responseError(resp *http.Response) error {
+	defer resp.Body.Close()
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var msgs []string
+	if json.Unmarshal(b, &body) == nil {
+		for _, e := range body.Errors {
+			msgs = append(msgs, strings.TrimSpace(e.Code+": "+e.Message))
+		}
+	}
+	msg := fmt.Sprintf("%s %s: %s", resp.Request.Method, resp.Request.URL.Redacted(), resp.Status)
+	if len(msgs) > 0 {
+		msg += " (" + strings.Join(msgs, "; ") + ")"
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", msg, ErrNotFound)
+	}
+	return errors.New(msg)
+}
+
+// Manifest fetches the manifest or index that ref names and returns its
+// content and descriptor. The content is checked against the digest of
+// ref if it has one.
+func (c *Client) Manifest(ctx context.Context, ref Reference) ([]byte, specs.Descriptor, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url(ref, "manifests/"+ref.manifestRef()), nil)
+	if err != nil {
+		return nil, specs.Descriptor{}, err
+	}
+	req.Header.Set("Accept", manifestAccept)
+	resp, err := c.do(req, ref, false)
+	if err != nil {
+		return nil, specs.Descriptor{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, specs.Descriptor{}, responseError(resp)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, specs.Descriptor{}, err
+	}
+	if len(b) > maxManifestSize {
+		return nil, specs.Descriptor{}, fmt.Errorf("manifest %s is larger than %d bytes", ref, maxManifestSize)
+	}
+
+	desc := specs.Descriptor{Size: int64(len(b))}
+	desc.MediaType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !IsManifest(desc.MediaType) {
+		var m struct {
+			MediaType string `json:"mediaType"`
+		}
+		if json.Unmarshal(b, &m) == nil && m.MediaType != "" {
+			desc.MediaType = m.MediaType
+		}
+	}
+	alg := digest.Canonical
+	if ref.Digest != "" {
+		alg = ref.Digest.Algorithm()
+		if !alg.Available() {
+			return nil, specs.Descriptor{}, fmt.Errorf("manifest %s: unsupported digest algorithm", ref)
+		}
+	}
+	desc.Digest = alg.FromBytes(b)
+	if ref.Digest != "" && desc.Digest != ref.Digest {
+		return nil, specs.Descriptor{}, fmt.Errorf("manifest %s: %w, content has digest %s", ref, ErrDigestMismatch, desc.Digest)
+	}
+	return b, desc, nil
+}
+
+// PutManifest pushes the manifest or index b, described by desc, to the
+// repository of ref, under the tag of ref if it has one and otherwise
+// only by digest.
+func (c *Client) PutManifest(ctx context.Context, ref Reference, desc specs.Descriptor, b []byte) error {
+	target := desc.Digest.String()
+	if ref.Tag != "" {
+		target = ref.Tag
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.url(ref, "manifests/"+target), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", desc.MediaType)
+	resp, err := c.do(req, ref, true)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	resp.Body.Close()
+	if d := resp.Header.Get("Docker-Content-Digest"); d != "" && d != desc.Digest.String() {
+		return fmt.Errorf("manifest %s: registry stored it as %s", desc.Digest, d)
+	}
+	return nil
+}
+
+// Exists reports whether the repository of ref has the manifest or blob
+// that desc describes.
+func (c *Client) Exists(ctx context.Context, ref Reference, desc specs.Descriptor) (bool, error) {
+	kind := "blobs/"
+	if IsManifest(desc.MediaType) {
+		kind = "manifests/"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.url(ref, kind+desc.Digest.String()), nil)
+	if err != nil {
+		return false, err
+	}
+	if kind == "manifests/" {
+		req.Header.Set("Accept", manifestAccept)
+	}
+	resp, err := c.do(req, ref, false)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("HEAD %s: %s", resp.Request.URL.Redacted(), resp.Status)
+}
+
+// Blob opens the blob that desc describes in the repository of ref. The
+// caller checks the content against the digest.
+func (c *Client) Blob(ctx context.Context, ref Reference, desc specs.Descriptor) (io.ReadCloser, error) {
+	ctx, cancel := c.blobTimeout(ctx)
+	body, err := c.fetchBlob(ctx, ref, desc, 0)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	var rc io.ReadCloser = &resumingReader{c: c, ctx: ctx, cancel: cancel, ref: ref, desc: desc, body: body, attempt: 1}
+	if c.Limit != nil {
+		rc = c.Limit.reader(ctx, rc)
+	}
+	return rc, nil
+}
+
+// PushBlob uploads the desc.Size bytes of r as the blob desc describes to
+// the repository of ref, in a single request. The registry checks the
+// content against the digest.
+func (c *Client) PushBlob(ctx context.Context, ref Reference, desc specs.Descriptor, r io.Reader) error {
+	ctx, cancel := c.blobTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url(ref, "blobs/uploads/"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, ref, true)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return responseError(resp)
+	}
+	resp.Body.Close()
+	loc, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("blob upload location: %w", err)
+	}
+	q := loc.Query()
+	q.Set("digest", desc.Digest.String())
+	loc.RawQuery = q.Encode()
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodPut, loc.String(), io.LimitReader(r, desc.Size))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = desc.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = c.do(req, ref, true)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,427 @@
+package registry_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hxtk/ember/pkg/registry"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeRegistry serves the distribution API for one repository from
+// memory, asking for a login or a bearer token if auth says so, and
+// sending blob fetches and uploads to a storage host of its own if
+// redirect is set.
+type fakeRegistry struct {
+	srv, tokens, storage *httptest.Server
+	storageURL           string // of storage, by another host name
+	auth                 string // "", "basic", or "bearer"
+	redirect             bool
+
+	// before, if not nil, sees each request to the registry first and
+	// may answer it itself.
+	before func(w http.ResponseWriter, r *http.Request) bool
+
+	mu        sync.Mutex
+	manifests map[string][]byte // by tag and digest
+	blobs     map[digest.Digest][]byte
+	seen      []string // requests to the registry: method, path, and authorization
+	scopes    []string // asked for from the token server
+	stored    []string // authorization headers the storage host got
+}
+
+const (
+	repo     = "team/app"
+	user     = "ci"
+	password = "s3cret"
+	token    = "good-token"
+)
+
+func newFakeRegistry(t *testing.T, auth string, redirect bool) *fakeRegistry {
+	f := &fakeRegistry{auth: auth, redirect: redirect, manifests: make(map[string][]byte), blobs: make(map[digest.Digest][]byte)}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	f.tokens = httptest.NewServer(http.HandlerFunc(f.serveToken))
+	f.storage = httptest.NewServer(http.HandlerFunc(f.serveStorage))
+	f.storageURL = strings.Replace(f.storage.URL, "127.0.0.1", "localhost", 1)
+	t.Cleanup(func() {
+		f.srv.Close()
+		f.tokens.Close()
+		f.storage.Close()
+	})
+	return f
+}
+
+// client returns a client of the registry logged in with login, if not
+// empty.
+func (f *fakeRegistry) client(login ...string) *registry.Client {
+	c := &registry.Client{PlainHTTP: true}
+	if len(login) == 2 {
+		c.Credentials = registry.Credentials{f.host(): {Username: login[0], Password: login[1]}}
+	}
+	return c
+}
+
+func (f *fakeRegistry) host() string { return f.srv.Listener.Addr().String() }
+
+func (f *fakeRegistry) ref(tag string) registry.Reference {
+	return registry.Reference{Registry: f.host(), Repository: repo, Tag: tag}
+}
+
+func (f *fakeRegistry) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.seen = append(f.seen, r.Method+" "+r.URL.Path+" "+r.Header.Get("Authorization"))
+	f.mu.Unlock()
+	if f.before != nil && f.before(w, r) {
+		return
+	}
+	switch f.auth {
+	case "basic":
+		if u, p, ok := r.BasicAuth(); !ok || u != user || p != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+	case "bearer":
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake registry"`, f.tokens.URL))
+			http.Error(w, `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`, http.StatusUnauthorized)
+			return
+		}
+	}
+
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v2/"+repo+"/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch kind, name, _ := strings.Cut(rest, "/"); {
+	case kind == "manifests" && r.Method == http.MethodPut:
+		b, _ := io.ReadAll(r.Body)
+		d := digest.FromBytes(b)
+		f.manifests[name], f.manifests[d.String()] = b, b
+		w.Header().Set("Docker-Content-Digest", d.String())
+		w.WriteHeader(http.StatusCreated)
+	case kind == "manifests":
+		b, ok := f.manifests[name]
+		if !ok {
+			http.Error(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", specs.MediaTypeImageManifest)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(b).String())
+		w.Write(b)
+	case kind == "blobs" && name == "uploads/" && r.Method == http.MethodPost:
+		loc := "/v2/" + repo + "/blobs/uploads/1?state=x"
+		if f.redirect {
+			loc = f.storageURL + "/upload?state=x"
+		}
+		w.Header().Set("Location", loc)
+		w.WriteHeader(http.StatusAccepted)
+	case kind == "blobs" && r.Method == http.MethodPut:
+		f.upload(w, r)
+	case kind == "blobs":
+		d := digest.Digest(name)
+		b, ok := f.blobs[d]
+		if !ok {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		if f.redirect && r.Method == http.MethodGet {
+			http.Redirect(w, r, f.storageURL+"/blobs/"+d.String(), http.StatusTemporaryRedirect)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// upload stores the blob of a PUT if it has the digest of its query.
+// f.mu is held.
+func (f *fakeRegistry) upload(w http.ResponseWriter, r *http.Request) {
+	b, _ := io.ReadAll(r.Body)
+	d := digest.Digest(r.URL.Query().Get("digest"))
+	if digest.FromBytes(b) != d || r.URL.Query().Get("state") != "x" {
+		http.Error(w, `{"errors":[{"code":"DIGEST_INVALID","message":"digest did not match"}]}`, http.StatusBadRequest)
+		return
+	}
+	f.blobs[d] = b
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeRegistry) serveToken(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.scopes = append(f.scopes, r.URL.Query().Get("service")+" "+r.URL.Query().Get("scope"))
+	if u, p, ok := r.BasicAuth(); !ok || u != user || p != password {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": token})
+}
+
+func (f *fakeRegistry) serveStorage(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stored = append(f.stored, r.Header.Get("Authorization"))
+	switch {
+	case r.Method == http.MethodPut && r.URL.Path == "/upload":
+		f.upload(w, r)
+	case r.Method == http.MethodGet:
+		b, ok := f.blobs[digest.Digest(strings.TrimPrefix(r.URL.Path, "/blobs/"))]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// push pushes a blob and a manifest listing it as tag, and returns the
+// descriptors of the two.
+func push(t *testing.T, c *registry.Client, ref registry.Reference, content string) (blob, manifest specs.Descriptor) {
+	t.Helper()
+	ctx := context.Background()
+	blob = specs.Descriptor{MediaType: specs.MediaTypeImageLayer, Digest: digest.FromString(content), Size: int64(len(content))}
+	if err := c.PushBlob(ctx, ref, blob, strings.NewReader(content)); err != nil {
+		t.Fatalf("PushBlob() = %v", err)
+	}
+	m := specs.Manifest{MediaType: specs.MediaTypeImageManifest, Config: blob, Layers: []specs.Descriptor{blob}}
+	m.SchemaVersion = 2
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest = specs.Descriptor{MediaType: specs.MediaTypeImageManifest, Digest: digest.FromBytes(b), Size: int64(len(b))}
+	if err := c.PutManifest(ctx, ref, manifest, b); err != nil {
+		t.Fatalf("PutManifest() = %v", err)
+	}
+	return blob, manifest
+}
+
+// pull fetches the manifest of ref and the blob it lists, checking both.
+func pull(t *testing.T, c *registry.Client, ref registry.Reference, blob, manifest specs.Descriptor, content string) {
+	t.Helper()
+	ctx := context.Background()
+	b, desc, err := c.Manifest(ctx, ref)
+	if err != nil {
+		t.Fatalf("Manifest() = %v", err)
+	}
+	if desc.Digest != manifest.Digest || desc.Size != int64(len(b)) || desc.MediaType != specs.MediaTypeImageManifest {
+		t.Errorf("Manifest() = %+v, want %+v", desc, manifest)
+	}
+	for _, d := range []specs.Descriptor{blob, manifest} {
+		if ok, err := c.Exists(ctx, ref, d); err != nil || !ok {
+			t.Errorf("Exists(%s) = %v, %v, want true", d.Digest, ok, err)
+		}
+	}
+	rc, err := c.Blob(ctx, ref, blob)
+	if err != nil {
+		t.Fatalf("Blob() = %v", err)
+	}
+	defer rc.Close()
+	if got, err := io.ReadAll(rc); err != nil || string(got) != content {
+		t.Errorf("Blob() read %q, %v, want %q", got, err, content)
+	}
+}
+
+// A push and a pull succeed anonymously, with a login, and with a token
+// for the scope of each, which is asked for once and then reused.
+func TestPushPull(t *testing.T) {
+	for _, auth := range []string{"", "basic", "bearer"} {
+		t.Run(auth, func(t *testing.T) {
+			f := newFakeRegistry(t, auth, false)
+			c := f.client(user, password)
+			blob, manifest := push(t, c, f.ref("v1"), "layer")
+			pull(t, c, f.ref("v1"), blob, manifest, "layer")
+			byDigest := f.ref("")
+			byDigest.Digest = manifest.Digest
+			pull(t, c, byDigest, blob, manifest, "layer")
+
+			if ok, err := c.Exists(context.Background(), f.ref(""), specs.Descriptor{Digest: digest.FromString("missing")}); err != nil || ok {
+				t.Errorf("Exists() of a missing blob = %v, %v, want false", ok, err)
+			}
+			_, _, err := c.Manifest(context.Background(), f.ref("v2"))
+			if !errors.Is(err, registry.ErrNotFound) || !strings.Contains(err.Error(), "MANIFEST_UNKNOWN: manifest unknown") {
+				t.Errorf("Manifest() of a missing tag = %v, want ErrNotFound with the registry's message", err)
+			}
+			if auth == "bearer" {
+				service := "fake registry "
+				want := []string{service + "repository:team/app:pull,push", service + "repository:team/app:pull"}
+				if strings.Join(f.scopes, "\n") != strings.Join(want, "\n") {
+					t.Errorf("token server was asked for\n%s\nwant\n%s", strings.Join(f.scopes, "\n"), strings.Join(want, "\n"))
+				}
+			}
+		})
+	}
+}
+
+// Without the right login, a registry that asks for one can't be used.
+func TestAuthFailures(t *testing.T) {
+	for _, tc := range []struct {
+		auth  string
+		login []string
+		want  string
+	}{
+		{"basic", nil, "requires a login"},
+		{"basic", []string{user, "wrong"}, "401 Unauthorized"},
+		{"bearer", nil, "authenticate to 127.0.0.1"},
+		{"bearer", []string{user, "wrong"}, "401 Unauthorized"},
+	} {
+		t.Run(fmt.Sprint(tc.auth, tc.login), func(t *testing.T) {
+			f := newFakeRegistry(t, tc.auth, false)
+			_, _, err := f.client(tc.login...).Manifest(context.Background(), f.ref("v1"))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Manifest() = %v, want an error: %s", err, tc.want)
+			}
+		})
+	}
+
+	// An unknown scheme is an error of its own.
+	f := newFakeRegistry(t, "", false)
+	f.before = func(w http.ResponseWriter, r *http.Request) bool {
+		w.Header().Set("WWW-Authenticate", `Negotiate`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return true
+	}
+	if _, _, err := f.client().Manifest(context.Background(), f.ref("v1")); err == nil || !strings.Contains(err.Error(), `unsupported authentication scheme "negotiate"`) {
+		t.Errorf("Manifest() = %v, want an unsupported scheme error", err)
+	}
+}
+
+// Blobs fetched from and pushed to another host, where the registry
+// redirects them, get there without the registry's credentials.
+func TestRedirects(t *testing.T) {
+	for _, auth := range []string{"basic", "bearer"} {
+		t.Run(auth, func(t *testing.T) {
+			f := newFakeRegistry(t, auth, true)
+			c := f.client(user, password)
+			blob, manifest := push(t, c, f.ref("v1"), "redirected layer")
+			pull(t, c, f.ref("v1"), blob, manifest, "redirected layer")
+			if len(f.stored) != 2 {
+				t.Fatalf("storage host got %d requests, want the upload and the fetch", len(f.stored))
+			}
+			for _, h := range f.stored {
+				if h != "" {
+					t.Errorf("storage host got Authorization %q, want none", h)
+				}
+			}
+		})
+	}
+}
+
+// A manifest fetched by digest must have it.
+func TestManifestDigestMismatch(t *testing.T) {
+	f := newFakeRegistry(t, "", false)
+	ref := f.ref("")
+	ref.Digest = digest.FromString("other")
+	f.manifests[ref.Digest.String()] = []byte(`{"schemaVersion":2}`)
+	if _, _, err := f.client().Manifest(context.Background(), ref); !errors.Is(err, registry.ErrDigestMismatch) {
+		t.Errorf("Manifest() = %v, want ErrDigestMismatch", err)
+	}
+}
+
+// A registry that rejects an upload fails the push with its message.
+func TestPushBlobRejected(t *testing.T) {
+	f := newFakeRegistry(t, "", false)
+	desc := specs.Descriptor{MediaType: specs.MediaTypeImageLayer, Digest: digest.FromString("claimed"), Size: 6}
+	err := f.client().PushBlob(context.Background(), f.ref(""), desc, strings.NewReader("actual"))
+	if err == nil || !strings.Contains(err.Error(), "DIGEST_INVALID: digest did not match") {
+		t.Errorf("PushBlob() = %v, want the registry's rejection", err)
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	d := digest.FromString("x")
+	for _, tc := range []struct {
+		s    string
+		want registry.Reference
+	}{
+		{"alpine", registry.Reference{Registry: "docker.io", Repository: "library/alpine"}},
+		{"alpine:3.20", registry.Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "3.20"}},
+		{"hxtk/ember@" + d.String(), registry.Reference{Registry: "docker.io", Repository: "hxtk/ember", Digest: d}},
+		{"ghcr.io/hxtk/ember:v1@" + d.String(), registry.Reference{Registry: "ghcr.io", Repository: "hxtk/ember", Tag: "v1", Digest: d}},
+		{"localhost/app", registry.Reference{Registry: "localhost", Repository: "app"}},
+		{"localhost:5000/team/app:latest", registry.Reference{Registry: "localhost:5000", Repository: "team/app", Tag: "latest"}},
+	} {
+		got, err := registry.ParseReference(tc.s)
+		if err != nil || got != tc.want {
+			t.Errorf("ParseReference(%q) = %+v, %v, want %+v", tc.s, got, err, tc.want)
+		}
+		if again, err := registry.ParseReference(got.String()); err != nil || again != got {
+			t.Errorf("ParseReference(%q) = %+v, %v, want the reference back", got.String(), again, err)
+		}
+	}
+	for _, s := range []string{"Alpine", "alpine:", "alpine:-x", "alpine@sha256:abc", "ghcr.io/team//app"} {
+		if _, err := registry.ParseReference(s); err == nil {
+			t.Errorf("ParseReference(%q) = nil error", s)
+		}
+	}
+}
+
+// Logins are read from docker and podman auth files, podman's taking
+// precedence, and looked up by host however the registry is spelled.
+func TestLoadCredentials(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	write("docker/config.json", `{"auths": {
+		"https://index.docker.io/v1/": {"auth": "aHViOmh1YnBhc3M="},
+		"ghcr.io": {"auth": "ZG9ja2VyOmQ="},
+		"quay.io": {"username": "q", "password": "qp"}
+	}}`)
+	t.Setenv("DOCKER_CONFIG", filepath.Join(dir, "docker"))
+	t.Setenv("REGISTRY_AUTH_FILE", write("auth.json", `{"auths": {"ghcr.io": {"auth": "cG9kbWFuOnA6Yw=="}}}`))
+	creds, err := registry.LoadCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		registry string
+		want     registry.Login
+	}{
+		{"docker.io", registry.Login{Username: "hub", Password: "hubpass"}},
+		{"registry-1.docker.io", registry.Login{Username: "hub", Password: "hubpass"}},
+		{"ghcr.io", registry.Login{Username: "podman", Password: "p:c"}},
+		{"https://quay.io/v2/", registry.Login{Username: "q", Password: "qp"}},
+	} {
+		if got, ok := creds.Lookup(tc.registry); !ok || got != tc.want {
+			t.Errorf("Lookup(%s) = %+v, %v, want %+v", tc.registry, got, ok, tc.want)
+		}
+	}
+	if _, ok := creds.Lookup("example.com"); ok {
+		t.Error("Lookup(example.com) found a login")
+	}
+
+	if err := creds.ReadAuthFile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("ReadAuthFile() of a missing file = nil error")
+	}
+	if err := creds.ReadAuthFile(write("bad.json", `{"auths": {"x.io": {"auth": "%%%"}}}`)); err == nil || !strings.Contains(err.Error(), "login for x.io") {
+		t.Errorf("ReadAuthFile() of a bad login = %v, want an error", err)
+	}
+}
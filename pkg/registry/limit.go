@@ -0,0 +1,80 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter caps the rate at which blobs are fetched with a token bucket
+// refilled at a fixed number of bytes per second and holding at most a
+// second's worth, so that a pull doesn't saturate a shared uplink. Blobs
+// fetched at the same time share the rate, as do the clients sharing a
+// Limiter.
+type Limiter struct {
+	rate float64 // bytes per second
+	max  float64 // tokens the bucket holds
+
+	mu     sync.Mutex
+	tokens float64 // may go below zero, for bytes read ahead of the rate
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter of bytesPerSecond, which must be positive.
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	r := float64(bytesPerSecond)
+	return &Limiter{rate: r, max: r, tokens: r, last: time.Now()}
+}
+
+// limitChunk bounds the reads of a limited blob, so that waits stay short
+// and the rate is shared fairly among blobs.
+const limitChunk = 32 << 10
+
+// take accounts for n bytes read and waits until the bucket is no longer
+// in debt for them, or ctx is done.
+func (l *Limiter) take(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.max, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedReader reads a blob at the rate of its Limiter.
+type limitedReader struct {
+	io.ReadCloser
+	ctx   context.Context
+	l     *Limiter
+	chunk int
+}
+
+func (l *Limiter) reader(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	return &limitedReader{ReadCloser: rc, ctx: ctx, l: l, chunk: max(1, min(limitChunk, int(l.max)))}
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := r.l.take(r.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
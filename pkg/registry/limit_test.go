@@ -0,0 +1,80 @@
+package registry_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hxtk/ember/pkg/registry"
+)
+
+func random(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// A limited fetch reads a burst of a second's worth and then keeps to the
+// rate, which blobs fetched together and clients of the same Limiter
+// share.
+func TestLimit(t *testing.T) {
+	const rate = 1 << 20
+	f := newFakeRegistry(t, "", false)
+	content := string(random(1, rate/2))
+	blob, _ := push(t, f.client(), f.ref("v1"), content)
+
+	limit := registry.NewLimiter(rate)
+	clients := []*registry.Client{{PlainHTTP: true, Limit: limit}, {PlainHTTP: true, Limit: limit}}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rc, err := clients[i%2].Blob(context.Background(), f.ref(""), blob)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer rc.Close()
+			if b, err := io.ReadAll(rc); err != nil || string(b) != content {
+				t.Errorf("Blob() read %d bytes, %v, want the blob", len(b), err)
+			}
+		}()
+	}
+	wg.Wait()
+	// 2 MiB at 1 MiB a second, after the first 1 MiB at once.
+	if d := time.Since(start); d < 900*time.Millisecond || d > 5*time.Second {
+		t.Errorf("limited fetches took %v, want about a second", d)
+	}
+}
+
+// A limited fetch that is waiting stops when its context is done.
+func TestLimitCanceled(t *testing.T) {
+	f := newFakeRegistry(t, "", false)
+	content := string(random(2, 64<<10))
+	blob, _ := push(t, f.client(), f.ref("v1"), content)
+
+	c := &registry.Client{PlainHTTP: true, Limit: registry.NewLimiter(16 << 10)}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	rc, err := c.Blob(ctx, f.ref(""), blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	start := time.Now()
+	var got bytes.Buffer
+	_, err = io.Copy(&got, rc)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 2*time.Second {
+		t.Errorf("Copy() = %v after %v, want the deadline", err, time.Since(start))
+	}
+	if got.Len() >= len(content) {
+		t.Errorf("read the whole blob of %d bytes at 16 KiB a second", got.Len())
+	}
+}
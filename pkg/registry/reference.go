@@ -0,0 +1,97 @@
+package registry
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// DockerHub is the registry of references that don't name one.
+const DockerHub = "docker.io"
+
+// Reference names an image in a registry, by tag, digest, or both, as in
+// registry.example.com/team/app:v1 or alpine@sha256:....
+type Reference struct {
+	Registry   string // host[:port]
+	Repository string
+	Tag        string // empty if not given
+	Digest     digest.Digest
+}
+
+var (
+	repositoryRE = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagRE        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+// ValidTag reports whether s can be used as a tag.
+func ValidTag(s string) bool { return tagRE.MatchString(s) }
+
+// ParseReference parses s like docker does: the first path component is
+// the registry if it contains a dot or colon or is localhost, and names
+// without one are on Docker Hub, where single-component repositories are
+// under library/.
+func ParseReference(s string) (Reference, error) {
+	var ref Reference
+	name := s
+	if n, d, ok := strings.Cut(name, "@"); ok {
+		ref.Digest = digest.Digest(d)
+		if err := ref.Digest.Validate(); err != nil {
+			return Reference{}, fmt.Errorf("reference %q: %w", s, err)
+		}
+		name = n
+	}
+	if i := strings.LastIndexByte(name, ':'); i > strings.LastIndexByte(name, '/') {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+		if !ValidTag(ref.Tag) {
+			return Reference{}, fmt.Errorf("reference %q: invalid tag %q", s, ref.Tag)
+		}
+	}
+	host, rest, ok := strings.Cut(name, "/")
+	if ok && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		ref.Registry, ref.Repository = host, rest
+	} else {
+		ref.Registry, ref.Repository = DockerHub, name
+	}
+	if ref.Registry == DockerHub && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+	if !repositoryRE.MatchString(ref.Repository) {
+		return Reference{}, fmt.Errorf("reference %q: invalid repository name %q", s, ref.Repository)
+	}
+	return ref, nil
+}
+
+// String formats the reference in the form ParseReference accepts.
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest.String()
+	}
+	return s
+}
+
+// manifestRef returns what the manifest of the reference is fetched by:
+// its digest if it has one, otherwise its tag, defaulting to latest.
+func (r Reference) manifestRef() string {
+	switch {
+	case r.Digest != "":
+		return r.Digest.String()
+	case r.Tag != "":
+		return r.Tag
+	}
+	return "latest"
+}
+
+// host returns the host the registry API is served from.
+func (r Reference) host() string {
+	if r.Registry == DockerHub {
+		return "registry-1.docker.io"
+	}
+	return r.Registry
+}
@@ -0,0 +1,221 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// RetryPolicy says how a Client retries requests that fail in ways that
+// may pass: network errors, and responses of 408 Request Timeout, 429 Too
+// Many Requests, and 5xx other than 501. Requests are retried only if
+// their body can be replayed, which the single PUT of a blob push can't; a
+// blob fetch cut off part way resumes where it stopped.
+type RetryPolicy struct {
+	// Attempts is how many times a request is tried; 0 means 3, and 1
+	// means no retries. A resumed fetch that made progress starts over.
+	Attempts int
+	// MinBackoff is the wait before the first retry, 500ms if 0. Each
+	// retry waits twice as long as the one before, at most MaxBackoff,
+	// 30s if 0, with up to half of it taken off at random so that clients
+	// don't retry in step. A Retry-After header of the registry is
+	// honoured up to MaxBackoff.
+	MinBackoff, MaxBackoff time.Duration
+	// BlobTimeout, if not 0, bounds the whole fetch or push of each blob,
+	// retries included.
+	BlobTimeout time.Duration
+}
+
+func (p RetryPolicy) attempts() int {
+	if p.Attempts <= 0 {
+		return 3
+	}
+	return p.Attempts
+}
+
+// backoff returns how long to wait after the try attempt, counted from 1,
+// failed with resp, which may be nil.
+func (p RetryPolicy) backoff(attempt int, resp *http.Response) time.Duration {
+	lo, hi := p.MinBackoff, p.MaxBackoff
+	if lo <= 0 {
+		lo = 500 * time.Millisecond
+	}
+	if hi <= 0 {
+		hi = 30 * time.Second
+	}
+	if resp != nil {
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+			return min(hi, time.Duration(s)*time.Second)
+		}
+	}
+	d := lo
+	for i := 1; i < attempt && d < hi; i++ {
+		d *= 2
+	}
+	d = min(d, hi)
+	return d - rand.N(d/2+1)
+}
+
+// retryable reports whether a request that got resp and err may succeed
+// if tried again.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented:
+		return false
+	}
+	return resp.StatusCode >= 500
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// send sends req, retrying as the policy says.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := c.httpClient().Do(req)
+		if attempt >= c.Retry.attempts() || !retryable(resp, err) || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		if serr := sleep(req.Context(), c.Retry.backoff(attempt, resp)); serr != nil {
+			if err == nil {
+				err = fmt.Errorf("%s %s: %s", req.Method, req.URL.Redacted(), resp.Status)
+			}
+			return nil, fmt.Errorf("%w (gave up retrying: %v)", err, serr)
+		}
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		req = retry
+	}
+}
+
+// blobTimeout returns ctx bounded by the policy's BlobTimeout.
+func (c *Client) blobTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.Retry.BlobTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.Retry.BlobTimeout)
+}
+
+// fetchBlob requests the blob desc describes from offset off on.
+func (c *Client) fetchBlob(ctx context.Context, ref Reference, desc specs.Descriptor, off int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url(ref, "blobs/"+desc.Digest.String()), nil)
+	if err != nil {
+		return nil, err
+	}
+	if off > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	}
+	resp, err := c.do(req, ref, false)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case off > 0 && resp.StatusCode == http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", off)) {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: resumed at the wrong offset: %s", resp.Request.URL.Redacted(), resp.Header.Get("Content-Range"))
+		}
+	case resp.StatusCode == http.StatusOK:
+		// A registry that ignores the range sends everything again.
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	default:
+		return nil, responseError(resp)
+	}
+	return resp.Body, nil
+}
+
+// resumingReader reads a blob, fetching the rest again when the
+// connection breaks.
+type resumingReader struct {
+	c      *Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	ref    Reference
+	desc   specs.Descriptor
+
+	body    io.ReadCloser
+	off     int64 // bytes read
+	attempt int   // tries since the last progress
+	err     error // that ended the fetch
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	for {
+		n, err := r.body.Read(p)
+		r.off += int64(n)
+		if n > 0 {
+			r.attempt = 1
+		}
+		if r.desc.Size > 0 && r.off >= r.desc.Size {
+			if err != nil {
+				err = io.EOF
+			}
+			return n, err
+		}
+		if err == io.EOF && r.desc.Size > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if r.attempt >= r.c.Retry.attempts() || !retryable(nil, err) || r.ctx.Err() != nil ||
+			sleep(r.ctx, r.c.Retry.backoff(r.attempt, nil)) != nil {
+			r.err = err
+			return n, err
+		}
+		r.attempt++
+		r.body.Close()
+		body, ferr := r.c.fetchBlob(r.ctx, r.ref, r.desc, r.off)
+		if ferr != nil {
+			r.body = io.NopCloser(strings.NewReader(""))
+			r.err = fmt.Errorf("%w; resuming at byte %d: %v", err, r.off, ferr)
+			return n, r.err
+		}
+		r.body = body
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *resumingReader) Close() error {
+	err := r.body.Close()
+	r.cancel()
+	return err
+}
@@ -0,0 +1,236 @@
+package registry_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hxtk/ember/pkg/registry"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// failing makes the registry answer the first n requests for which match
+// is true with status and header, and returns the number of such requests
+// it got.
+func failing(f *fakeRegistry, n int, status int, header http.Header, match func(r *http.Request) bool) func() int {
+	var mu sync.Mutex
+	seen := 0
+	f.before = func(w http.ResponseWriter, r *http.Request) bool {
+		if !match(r) {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		seen++
+		if seen > n {
+			return false
+		}
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		http.Error(w, "", status)
+		return true
+	}
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return seen
+	}
+}
+
+func manifests(r *http.Request) bool { return strings.Contains(r.URL.Path, "/manifests/") }
+
+func TestRetry(t *testing.T) {
+	fast := registry.RetryPolicy{MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	for _, tc := range []struct {
+		name     string
+		policy   registry.RetryPolicy
+		fail     int
+		status   int
+		header   http.Header
+		requests int
+		want     string // error, if any
+	}{
+		{"unavailable", fast, 2, http.StatusServiceUnavailable, nil, 3, ""},
+		{"too many requests", fast, 1, http.StatusTooManyRequests, nil, 2, ""},
+		{"timeout", fast, 1, http.StatusRequestTimeout, nil, 2, ""},
+		{"gives up", fast, 3, http.StatusBadGateway, nil, 3, "502 Bad Gateway"},
+		{"attempts", registry.RetryPolicy{Attempts: 5, MinBackoff: time.Millisecond}, 4, http.StatusInternalServerError, nil, 5, ""},
+		{"no retries", registry.RetryPolicy{Attempts: 1}, 1, http.StatusServiceUnavailable, nil, 1, "503 Service Unavailable"},
+		{"not implemented", fast, 1, http.StatusNotImplemented, nil, 1, "501 Not Implemented"},
+		{"forbidden", fast, 1, http.StatusForbidden, nil, 1, "403 Forbidden"},
+		// Retry-After takes the place of the backoff, up to MaxBackoff.
+		{"retry after", registry.RetryPolicy{MinBackoff: time.Hour}, 1, http.StatusTooManyRequests, http.Header{"Retry-After": {"0"}}, 2, ""},
+		{"retry after capped", registry.RetryPolicy{MaxBackoff: time.Millisecond}, 2, http.StatusServiceUnavailable, http.Header{"Retry-After": {"3600"}}, 3, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeRegistry(t, "", false)
+			_, manifest := push(t, f.client(), f.ref("v1"), "layer")
+			requests := failing(f, tc.fail, tc.status, tc.header, manifests)
+			c := f.client()
+			c.Retry = tc.policy
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			_, desc, err := c.Manifest(ctx, f.ref("v1"))
+			if tc.want == "" && (err != nil || desc.Digest != manifest.Digest) {
+				t.Errorf("Manifest() = %v, want the manifest", err)
+			}
+			if tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+				t.Errorf("Manifest() = %v, want an error: %s", err, tc.want)
+			}
+			if got := requests(); got != tc.requests {
+				t.Errorf("registry got %d requests, want %d", got, tc.requests)
+			}
+		})
+	}
+}
+
+// A retry that would outlast the context gives up with the failure.
+func TestRetryGivesUp(t *testing.T) {
+	f := newFakeRegistry(t, "", false)
+	failing(f, 1, http.StatusServiceUnavailable, nil, manifests)
+	c := f.client()
+	c.Retry.MinBackoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err := c.Manifest(ctx, f.ref("v1"))
+	if err == nil || !strings.Contains(err.Error(), "503 Service Unavailable (gave up retrying: context deadline exceeded)") {
+		t.Errorf("Manifest() = %v, want it to give up", err)
+	}
+}
+
+// The PUT of a blob push can't be replayed and isn't retried, but the
+// POST before it is.
+func TestRetryPush(t *testing.T) {
+	f := newFakeRegistry(t, "", false)
+	posts := failing(f, 1, http.StatusServiceUnavailable, nil, func(r *http.Request) bool { return r.Method == http.MethodPost })
+	c := f.client()
+	c.Retry.MinBackoff = time.Millisecond
+	push(t, c, f.ref("v1"), "layer")
+	if posts() != 2 {
+		t.Errorf("registry got %d upload POSTs, want 2", posts())
+	}
+
+	puts := failing(f, 1, http.StatusServiceUnavailable, nil, func(r *http.Request) bool {
+		return r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/blobs/")
+	})
+	desc := specs.Descriptor{MediaType: specs.MediaTypeImageLayer, Digest: digest.FromString("foo"), Size: 3}
+	err := c.PushBlob(context.Background(), f.ref(""), desc, strings.NewReader("foo"))
+	if err == nil || !strings.Contains(err.Error(), "503 Service Unavailable") || puts() != 1 {
+		t.Errorf("PushBlob() = %v after %d PUTs, want the failure of the one", err, puts())
+	}
+}
+
+// cutting makes the first n fetches of a blob send half of what they were
+// asked for and then break the connection, and returns the Range headers
+// of the fetches.
+func cutting(f *fakeRegistry, content string, n int) func() []string {
+	var mu sync.Mutex
+	var ranges []string
+	f.before = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodGet || !strings.Contains(r.URL.Path, "/blobs/") {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) > n {
+			return false
+		}
+		off := 0
+		if rng := r.Header.Get("Range"); rng != "" {
+			off, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, len(content)-1, len(content)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)-off))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		}
+		io.WriteString(w, content[off:off+(len(content)-off)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), ranges...)
+	}
+}
+
+// A fetch cut off resumes where it stopped, as often as it makes progress.
+func TestResume(t *testing.T) {
+	f := newFakeRegistry(t, "", false)
+	content := string(random(3, 64<<10))
+	blob, _ := push(t, f.client(), f.ref("v1"), content)
+	ranges := cutting(f, content, 3)
+	c := f.client()
+	c.Retry = registry.RetryPolicy{Attempts: 2, MinBackoff: time.Millisecond}
+	rc, err := c.Blob(context.Background(), f.ref(""), blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if b, err := io.ReadAll(rc); err != nil || string(b) != content {
+		t.Errorf("Blob() read %d bytes, %v, want the blob", len(b), err)
+	}
+	want := []string{"", "bytes=32768-", "bytes=49152-", "bytes=57344-"}
+	if got := ranges(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("fetches asked for ranges %q, want %q", got, want)
+	}
+}
+
+// A registry that ignores the range sends the blob again, and the part
+// already read is skipped; one that resumes at another offset fails the
+// read.
+func TestResumeIgnoredRange(t *testing.T) {
+	f := newFakeRegistry(t, "", false)
+	content := string(random(4, 64<<10))
+	blob, _ := push(t, f.client(), f.ref("v1"), content)
+	c := f.client()
+	c.Retry.MinBackoff = time.Millisecond
+
+	ranges := cutting(f, content, 1)
+	cut := f.before
+	f.before = func(w http.ResponseWriter, r *http.Request) bool {
+		r.Header.Del("Range")
+		return cut(w, r)
+	}
+	rc, err := c.Blob(context.Background(), f.ref(""), blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(rc); err != nil || string(b) != content {
+		t.Errorf("Blob() read %d bytes, %v, want the blob", len(b), err)
+	}
+	rc.Close()
+	if got := ranges(); len(got) != 2 {
+		t.Errorf("blob was fetched %d times, want 2", len(got))
+	}
+
+	cutting(f, content, 1)
+	cut = f.before
+	f.before = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("Range") == "" {
+			return cut(w, r)
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		io.WriteString(w, content)
+		return true
+	}
+	rc, err = c.Blob(context.Background(), f.ref(""), blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if _, err := io.ReadAll(rc); err == nil || !strings.Contains(err.Error(), "resuming at byte 32768") || !strings.Contains(err.Error(), "resumed at the wrong offset: bytes 0-") {
+		t.Errorf("read = %v, want the resumed fetch rejected", err)
+	}
+}
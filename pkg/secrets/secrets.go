@@ -0,0 +1,104 @@
+// Package secrets detects likely secrets, such as private keys and cloud
+// credentials, in file contents, so they can be kept out of boot images.
+package secrets
+
+import (
+	"errors"
+	"io"
+	"regexp"
+)
+
+// Matcher detects one kind of secret.
+type Matcher interface {
+	// Name identifies the kind of secret in findings.
+	Name() string
+
+	// Match reports whether data, the content of the file at name or a
+	// window of it, contains a secret. Windows overlap by Overlap bytes,
+	// so secrets shorter than that are always seen whole.
+	Match(name string, data []byte) bool
+}
+
+// Pattern is a Matcher for content matching a regular expression, in files
+// whose path matches another one.
+type Pattern struct {
+	Rule    string
+	Path    *regexp.Regexp // nil matches every path
+	Content *regexp.Regexp
+}
+
+// Name implements Matcher.
+func (p *Pattern) Name() string { return p.Rule }
+
+// Match implements Matcher.
+func (p *Pattern) Match(name string, data []byte) bool {
+	if p.Path != nil && !p.Path.MatchString(name) {
+		return false
+	}
+	return p.Content.Match(data)
+}
+
+// Builtin returns the built-in matchers: PEM and OpenSSH private keys, AWS
+// access keys and secret keys, and npm auth tokens in .npmrc files.
+func Builtin() []Matcher {
+	return []Matcher{
+		&Pattern{
+			Rule:    "private-key",
+			Content: regexp.MustCompile(`-----BEGIN (?:[A-Z0-9]+ )*PRIVATE KEY(?: BLOCK)?-----`),
+		},
+		&Pattern{
+			Rule:    "aws-access-key-id",
+			Content: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+		},
+		&Pattern{
+			Rule:    "aws-secret-access-key",
+			Content: regexp.MustCompile(`(?i)aws_secret_access_key["']?\s*[=:]\s*["']?[A-Za-z0-9/+]{40}\b`),
+		},
+		&Pattern{
+			Rule:    "npm-token",
+			Path:    regexp.MustCompile(`(?:^|/)\.npmrc$`),
+			Content: regexp.MustCompile(`(?m)^\s*(?:\S+:)?_(?:authToken|auth|password)\s*=\s*\S`),
+		},
+	}
+}
+
+// Finding is a likely secret.
+type Finding struct {
+	Path string `json:"path"`
+	Rule string `json:"rule"`
+}
+
+// Window and Overlap are the sizes of the pieces of content Scan passes to
+// matchers and of their overlap.
+const (
+	Window  = 1 << 20
+	Overlap = 4 << 10
+)
+
+// Scan reads the content of the file at name from r and returns a finding
+// for every matcher that matches it.
+func Scan(name string, r io.Reader, matchers []Matcher) ([]Finding, error) {
+	var findings []Finding
+	found := make([]bool, len(matchers))
+	buf := make([]byte, Window+Overlap)
+	n := 0 // bytes in buf, the first of them carried over
+	for {
+		m, err := io.ReadFull(r, buf[n:])
+		n += m
+		if m > 0 {
+			for i, mt := range matchers {
+				if !found[i] && mt.Match(name, buf[:n]) {
+					found[i] = true
+					findings = append(findings, Finding{Path: name, Rule: mt.Name()})
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return findings, nil
+		}
+		if err != nil {
+			return findings, err
+		}
+		n = copy(buf, buf[n-Overlap:n])
+	}
+}
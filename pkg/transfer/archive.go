@@ -0,0 +1,150 @@
+package transfer
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/hxtk/ember/pkg/zstd"
+)
+
+// Archive is the files of a tar archive of a layout, such as oci-archive
+// names, as an fs.FS that oci.OpenFS reads an image from. The archive may
+// be compressed with gzip or zstd: a layout is read out of order, so it is
+// then decompressed once, as it is opened, into a temporary file that is
+// gone when the Archive is closed. Only regular files are served.
+type Archive struct {
+	name    string // of the archive, for errors
+	f       *os.File
+	spool   string // name of the decompressed copy f is, or empty
+	entries map[string]archiveEntry
+}
+
+type archiveEntry struct {
+	hdr *tar.Header
+	off int64 // of the content in f
+}
+
+// OpenArchive opens the tar archive file, compressed or not, and indexes
+// its members.
+func OpenArchive(file string) (*Archive, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	a := &Archive{name: file, f: f, entries: make(map[string]archiveEntry)}
+	if err := a.decompress(); err != nil {
+		a.Close()
+		return nil, err
+	}
+	if err := a.index(); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// decompress replaces a.f with a temporary file of its decompressed content
+// if it is compressed.
+func (a *Archive) decompress() error {
+	var b [6]byte
+	n, _ := a.f.ReadAt(b[:], 0)
+	head := b[:n]
+	br := bufio.NewReader(a.f)
+	var zr io.Reader
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("%s: %w", a.name, err)
+		}
+		zr = gz
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr = zstd.NewReader(br)
+	case bytes.HasPrefix(head, []byte{0xfd, '7', 'z', 'X', 'Z', 0}):
+		return fmt.Errorf("%s: xz-compressed archives are not supported; decompress it first, e.g. with xz -d", a.name)
+	default:
+		return nil
+	}
+
+	spool, err := os.CreateTemp("", "ember-archive-*")
+	if err != nil {
+		return err
+	}
+	src := a.f
+	defer src.Close()
+	a.f, a.spool = spool, spool.Name()
+	// Unlinked now where the platform allows it, so that nothing is left
+	// behind if the process dies; Close removes it otherwise.
+	if os.Remove(a.spool) == nil {
+		a.spool = ""
+	}
+	if _, err := io.Copy(spool, zr); err != nil {
+		return fmt.Errorf("%s: decompress: %w", a.name, err)
+	}
+	_, err = spool.Seek(0, io.SeekStart)
+	return err
+}
+
+func (a *Archive) index() error {
+	tr := tar.NewReader(a.f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if len(a.entries) == 0 {
+				return fmt.Errorf("%s is not a tar archive of an OCI layout: %w", a.name, err)
+			}
+			return fmt.Errorf("%s: %w", a.name, err)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		off, err := a.f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		a.entries[path.Clean(strings.TrimPrefix(hdr.Name, "/"))] = archiveEntry{hdr, off}
+	}
+	return nil
+}
+
+// Open opens the member of the archive with the slash-separated name.
+func (a *Archive) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	e, ok := a.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: a.name + ":" + name, Err: fs.ErrNotExist}
+	}
+	return &archiveFile{io.NewSectionReader(a.f, e.off, e.hdr.Size), e.hdr}, nil
+}
+
+// Close closes the archive, and removes its decompressed copy.
+func (a *Archive) Close() error {
+	err := a.f.Close()
+	if a.spool != "" {
+		err = errors.Join(err, os.Remove(a.spool))
+	}
+	return err
+}
+
+type archiveFile struct {
+	*io.SectionReader
+	hdr *tar.Header
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) { return f.hdr.FileInfo(), nil }
+
+func (f *archiveFile) Close() error { return nil }
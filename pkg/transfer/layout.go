@@ -0,0 +1,289 @@
+package transfer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/hxtk/ember/pkg/oci"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// layoutSource reads an image from a layout, in a directory or an archive.
+type layoutSource struct {
+	name  string // of the layout, for errors
+	ref   string // ref.name of the image, or empty
+	open  func(name string) (io.ReadCloser, error)
+	close func() error
+}
+
+// blobName returns the slash-separated path of a blob in a layout.
+func blobName(d digest.Digest) string {
+	return path.Join("blobs", d.Algorithm().String(), d.Encoded())
+}
+
+func (s *layoutSource) Root(ctx context.Context) ([]byte, specs.Descriptor, error) {
+	r, err := s.open(specs.ImageIndexFile)
+	if err != nil {
+		return nil, specs.Descriptor{}, fmt.Errorf("%s: %w", s.name, err)
+	}
+	defer r.Close()
+	var idx specs.Index
+	if err := json.NewDecoder(r).Decode(&idx); err != nil {
+		return nil, specs.Descriptor{}, fmt.Errorf("%s: read index.json: %w", s.name, err)
+	}
+
+	var root *specs.Descriptor
+	for i, m := range idx.Manifests {
+		if s.ref == "" || m.Annotations[specs.AnnotationRefName] == s.ref {
+			root = &idx.Manifests[i]
+			break
+		}
+	}
+	switch {
+	case root == nil && s.ref != "":
+		return nil, specs.Descriptor{}, fmt.Errorf("%s: no image is named %q", s.name, s.ref)
+	case root == nil:
+		return nil, specs.Descriptor{}, fmt.Errorf("%s: the layout has no images", s.name)
+	case s.ref == "" && len(idx.Manifests) > 1:
+		return nil, specs.Descriptor{}, fmt.Errorf("%s: the layout has %d images; name one with :<ref>", s.name, len(idx.Manifests))
+	}
+
+	c := &copier{src: s}
+	b, err := c.read(ctx, *root)
+	if err != nil {
+		return nil, specs.Descriptor{}, err
+	}
+	return b, *root, nil
+}
+
+func (s *layoutSource) Open(ctx context.Context, desc specs.Descriptor) (io.ReadCloser, error) {
+	r, err := s.open(blobName(desc.Digest))
+	if errors.Is(err, fs.ErrNotExist) && desc.Data != nil {
+		return io.NopCloser(bytes.NewReader(desc.Data)), nil
+	}
+	return r, err
+}
+
+func (s *layoutSource) Close() error {
+	if s.close == nil {
+		return nil
+	}
+	return s.close()
+}
+
+func openLayoutSource(dir, ref string) (Source, error) {
+	if fi, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not an OCI layout directory", dir)
+	}
+	return &layoutSource{
+		name: dir,
+		ref:  ref,
+		open: func(name string) (io.ReadCloser, error) { return os.Open(filepath.Join(dir, filepath.FromSlash(name))) },
+	}, nil
+}
+
+// openArchiveSource reads an image from a tar archive of a layout,
+// compressed or not.
+func openArchiveSource(file, ref string) (Source, error) {
+	a, err := OpenArchive(file)
+	if err != nil {
+		return nil, err
+	}
+	return &layoutSource{
+		name:  file,
+		ref:   ref,
+		open:  func(name string) (io.ReadCloser, error) { return a.Open(name) },
+		close: a.Close,
+	}, nil
+}
+
+// refDescriptor returns desc, the root of a copy, tagged with ref in the
+// annotations if the destination name gives a ref, and otherwise with
+// whatever ref.name it had at the source.
+func refDescriptor(desc specs.Descriptor, ref string) specs.Descriptor {
+	if ref == "" {
+		return desc
+	}
+	desc.Annotations = maps.Clone(desc.Annotations)
+	if desc.Annotations == nil {
+		desc.Annotations = make(map[string]string)
+	}
+	desc.Annotations[specs.AnnotationRefName] = ref
+	return desc
+}
+
+// layoutDestination writes an image into a layout directory, next to the
+// images it already has.
+type layoutDestination struct {
+	w   *oci.LayoutWriter
+	ref string
+}
+
+func (d *layoutDestination) Has(ctx context.Context, desc specs.Descriptor) (bool, error) {
+	fi, err := os.Stat(filepath.Join(d.w.Dir(), filepath.FromSlash(blobName(desc.Digest))))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return fi.Size() == desc.Size, nil
+}
+
+func (d *layoutDestination) Put(ctx context.Context, desc specs.Descriptor, r io.Reader) error {
+	bw, err := d.w.NewBlob()
+	if err != nil {
+		return err
+	}
+	defer bw.Close()
+	if _, err := io.Copy(bw, r); err != nil {
+		return err
+	}
+	got, err := bw.Commit(desc.MediaType)
+	if err != nil {
+		return err
+	}
+	if got.Digest != desc.Digest {
+		return fmt.Errorf("layouts only store %s digests", got.Digest.Algorithm())
+	}
+	return nil
+}
+
+func (d *layoutDestination) PutRoot(ctx context.Context, desc specs.Descriptor, b []byte) error {
+	if err := d.Put(ctx, desc, bytes.NewReader(b)); err != nil {
+		return err
+	}
+	return d.w.AddManifest(refDescriptor(desc, d.ref))
+}
+
+func (d *layoutDestination) Close() error { return nil }
+
+// archiveDestination writes a tar archive of a layout holding the image.
+// The archive is written to a temporary file that replaces file when it is
+// complete.
+type archiveDestination struct {
+	file string
+	ref  string
+	f    *os.File
+	tw   *tar.Writer
+	dirs map[string]bool
+	has  map[digest.Digest]bool
+	root *specs.Descriptor
+	err  error
+}
+
+// archiveTime is the modification time of archive entries, fixed so that
+// copying the same image gives the same archive.
+var archiveTime = time.Unix(0, 0)
+
+func createArchiveDestination(file, ref string) (Destination, error) {
+	f, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	d := &archiveDestination{file: file, ref: ref, f: f, tw: tar.NewWriter(f), dirs: make(map[string]bool), has: make(map[digest.Digest]bool)}
+	layout, err := json.Marshal(specs.ImageLayout{Version: specs.ImageLayoutVersion})
+	if err == nil {
+		err = d.write(specs.ImageLayoutFile, bytes.NewReader(layout), int64(len(layout)))
+	}
+	if err != nil {
+		d.abort()
+		return nil, err
+	}
+	return d, nil
+}
+
+// write adds a file to the archive, after the directories above it.
+func (d *archiveDestination) write(name string, r io.Reader, size int64) error {
+	if d.err != nil {
+		return d.err
+	}
+	var dirs []string
+	for dir := path.Dir(name); dir != "." && !d.dirs[dir]; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d.dirs[dirs[i]] = true
+		hdr := &tar.Header{Typeflag: tar.TypeDir, Name: dirs[i] + "/", Mode: 0o755, ModTime: archiveTime, Format: tar.FormatPAX}
+		if d.err = d.tw.WriteHeader(hdr); d.err != nil {
+			return d.err
+		}
+	}
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0o644, ModTime: archiveTime, Format: tar.FormatPAX}
+	if d.err = d.tw.WriteHeader(hdr); d.err != nil {
+		return d.err
+	}
+	_, d.err = io.Copy(d.tw, r)
+	return d.err
+}
+
+func (d *archiveDestination) Has(ctx context.Context, desc specs.Descriptor) (bool, error) {
+	return d.has[desc.Digest], nil
+}
+
+func (d *archiveDestination) Put(ctx context.Context, desc specs.Descriptor, r io.Reader) error {
+	if err := d.write(blobName(desc.Digest), r, desc.Size); err != nil {
+		return err
+	}
+	d.has[desc.Digest] = true
+	return nil
+}
+
+func (d *archiveDestination) PutRoot(ctx context.Context, desc specs.Descriptor, b []byte) error {
+	if err := d.Put(ctx, desc, bytes.NewReader(b)); err != nil {
+		return err
+	}
+	root := refDescriptor(desc, d.ref)
+	d.root = &root
+	return nil
+}
+
+func (d *archiveDestination) Close() error {
+	if d.root == nil && d.err == nil {
+		d.err = errors.New("no image was copied")
+	}
+	if d.err != nil {
+		d.abort()
+		return d.err
+	}
+	idx := specs.Index{MediaType: specs.MediaTypeImageIndex, Manifests: []specs.Descriptor{*d.root}}
+	idx.SchemaVersion = 2
+	b, err := json.Marshal(idx)
+	if err == nil {
+		err = d.write(specs.ImageIndexFile, bytes.NewReader(b), int64(len(b)))
+	}
+	if err == nil {
+		err = d.tw.Close()
+	}
+	if err == nil {
+		err = d.f.Chmod(0o644)
+	}
+	if err != nil {
+		d.abort()
+		return err
+	}
+	if err := d.f.Close(); err != nil {
+		os.Remove(d.f.Name())
+		return err
+	}
+	return os.Rename(d.f.Name(), d.file)
+}
+
+func (d *archiveDestination) abort() {
+	d.f.Close()
+	os.Remove(d.f.Name())
+}
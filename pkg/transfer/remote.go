@@ -0,0 +1,191 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/hxtk/ember/pkg/oci"
+	"github.com/hxtk/ember/pkg/registry"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// OpenSource opens the image called name, in the forms the package
+// documentation lists. c is used for images in registries.
+func OpenSource(name string, c *registry.Client) (Source, error) {
+	n, err := parseName(name)
+	if err != nil {
+		return nil, err
+	}
+	switch n.transport {
+	case "docker":
+		return &remoteSource{c: c, ref: n.remote}, nil
+	case "oci-archive":
+		return openArchiveSource(n.path, n.ref)
+	}
+	return openLayoutSource(n.path, n.ref)
+}
+
+// OpenDestination opens name, in the forms the package documentation
+// lists, to copy an image to. A layout directory is created if needed and
+// keeps the images it has; an archive is replaced. c is used for
+// registries.
+func OpenDestination(name string, c *registry.Client) (Destination, error) {
+	n, err := parseName(name)
+	if err != nil {
+		return nil, err
+	}
+	switch n.transport {
+	case "docker":
+		return &remoteDestination{c: c, ref: n.remote}, nil
+	case "oci-archive":
+		return createArchiveDestination(n.path, n.ref)
+	}
+	w, err := oci.CreateLayout(n.path)
+	if err != nil {
+		return nil, err
+	}
+	return &layoutDestination{w: w, ref: n.ref}, nil
+}
+
+// LocalPath returns the file or directory that name, in the forms the
+// package documentation lists, is stored at, or "" for a registry image.
+func LocalPath(name string) string {
+	n, err := parseName(name)
+	if err != nil {
+		return ""
+	}
+	return n.path
+}
+
+// Repository returns what name, in the forms the package documentation
+// lists, is an image of: the registry host and repository of a registry
+// image, or the file or directory of another.
+func Repository(name string) (string, error) {
+	n, err := parseName(name)
+	if err != nil {
+		return "", err
+	}
+	if n.transport == "docker" {
+		return n.remote.Registry + "/" + n.remote.Repository, nil
+	}
+	return n.path, nil
+}
+
+// Retag returns the name of the image tagged tag in the repository or
+// layout of the image called name.
+func Retag(name, tag string) (string, error) {
+	n, err := parseName(name)
+	if err != nil {
+		return "", err
+	}
+	if n.transport == "docker" {
+		n.remote.Tag, n.remote.Digest = tag, ""
+		return "docker://" + n.remote.String(), nil
+	}
+	return n.transport + ":" + n.path + ":" + tag, nil
+}
+
+// imageName is a parsed image name.
+type imageName struct {
+	transport string             // docker, oci, or oci-archive
+	remote    registry.Reference // for docker
+	path, ref string             // for oci and oci-archive
+}
+
+func parseName(name string) (imageName, error) {
+	if s, ok := strings.CutPrefix(name, "docker://"); ok {
+		r, err := registry.ParseReference(s)
+		if err != nil {
+			return imageName{}, err
+		}
+		return imageName{transport: "docker", remote: r}, nil
+	}
+	for _, t := range []string{"oci", "oci-archive"} {
+		if s, ok := strings.CutPrefix(name, t+":"); ok {
+			p, ref, _ := strings.Cut(s, ":")
+			if p == "" {
+				return imageName{}, fmt.Errorf("image name %q has no path", name)
+			}
+			return imageName{transport: t, path: p, ref: ref}, nil
+		}
+	}
+	return imageName{transport: "oci", path: name}, nil
+}
+
+// remoteSource reads an image from a registry.
+type remoteSource struct {
+	c   *registry.Client
+	ref registry.Reference
+}
+
+func (s *remoteSource) Root(ctx context.Context) ([]byte, specs.Descriptor, error) {
+	ref := s.ref
+	b, desc, err := s.c.Manifest(ctx, ref)
+	if err != nil {
+		return nil, specs.Descriptor{}, err
+	}
+	if ref.Tag != "" {
+		desc.Annotations = map[string]string{specs.AnnotationRefName: ref.Tag}
+	}
+	return b, desc, nil
+}
+
+func (s *remoteSource) Open(ctx context.Context, desc specs.Descriptor) (io.ReadCloser, error) {
+	ref := s.ref
+	if !registry.IsManifest(desc.MediaType) {
+		return s.c.Blob(ctx, ref, desc)
+	}
+	ref.Tag, ref.Digest = "", desc.Digest
+	b, _, err := s.c.Manifest(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *remoteSource) Close() error { return nil }
+
+// remoteDestination pushes an image to a registry.
+type remoteDestination struct {
+	c   *registry.Client
+	ref registry.Reference
+}
+
+func (d *remoteDestination) Has(ctx context.Context, desc specs.Descriptor) (bool, error) {
+	return d.c.Exists(ctx, d.ref, desc)
+}
+
+func (d *remoteDestination) Put(ctx context.Context, desc specs.Descriptor, r io.Reader) error {
+	if !registry.IsManifest(desc.MediaType) {
+		return d.c.PushBlob(ctx, d.ref, desc, r)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	ref := d.ref
+	ref.Tag = ""
+	return d.c.PutManifest(ctx, ref, desc, b)
+}
+
+// PutRoot pushes the root under the tag of the destination reference, or
+// else the tag it had at the source, or else latest. A destination named
+// by digest must name the root's.
+func (d *remoteDestination) PutRoot(ctx context.Context, desc specs.Descriptor, b []byte) error {
+	ref := d.ref
+	if ref.Digest != "" && ref.Digest != desc.Digest {
+		return fmt.Errorf("destination %s names another digest", ref)
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+		if t := desc.Annotations[specs.AnnotationRefName]; registry.ValidTag(t) {
+			ref.Tag = t
+		}
+	}
+	return d.c.PutManifest(ctx, ref, desc, b)
+}
+
+func (d *remoteDestination) Close() error { return nil }
@@ -0,0 +1,297 @@
+// Package transfer copies images between OCI layouts, layout archives, and
+// registries without changing them: manifests are copied byte for byte, so
+// an image keeps its digest wherever it goes.
+//
+// Images are named like skopeo names them:
+//
+//	oci:<dir>[:<ref>]           an OCI image layout directory
+//	oci-archive:<file>[:<ref>]  a tar archive of an OCI image layout
+//	docker://<reference>        an image in a registry
+//
+// where <ref> is the org.opencontainers.image.ref.name annotation that
+// tags an image in a layout. A name without a transport is a layout
+// directory. An archive may be compressed with gzip or zstd.
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/hxtk/ember/pkg/oci"
+	"github.com/hxtk/ember/pkg/registry"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Source is an image to copy from.
+type Source interface {
+	// Root returns the content and descriptor of the image's manifest or
+	// index. A tag the image has at the source is given as the descriptor's
+	// ref.name annotation.
+	Root(ctx context.Context) ([]byte, specs.Descriptor, error)
+	// Open opens a blob, or a manifest that the root lists.
+	Open(ctx context.Context, desc specs.Descriptor) (io.ReadCloser, error)
+	Close() error
+}
+
+// Destination is where an image is copied to.
+type Destination interface {
+	// Has reports whether the destination already has a blob or manifest.
+	Has(ctx context.Context, desc specs.Descriptor) (bool, error)
+	// Put stores a blob, or a manifest the root lists, read from r. Reading
+	// r to the end fails if the content doesn't match desc, and Put must
+	// then not store it.
+	Put(ctx context.Context, desc specs.Descriptor, r io.Reader) error
+	// PutRoot stores the manifest or index of the image, after everything
+	// it references, and tags it as the destination name says, or with the
+	// tag in the ref.name annotation of desc if the name gives none.
+	PutRoot(ctx context.Context, desc specs.Descriptor, b []byte) error
+	// Close finishes the destination. The copy is incomplete unless Close
+	// succeeds.
+	Close() error
+}
+
+// Copy copies the image of src, with everything it references, to dst and
+// returns the descriptor of its root manifest or index. Blobs the
+// destination already has are skipped, and all content is checked against
+// its digest on the way. Non-distributable layers and layers with URLs are
+// not copied, since they are meant to be fetched from elsewhere.
+func Copy(ctx context.Context, dst Destination, src Source) (specs.Descriptor, error) {
+	b, root, err := src.Root(ctx)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	c := &copier{dst: dst, src: src, done: make(map[digest.Digest]bool)}
+	if err := c.children(ctx, root, b); err != nil {
+		return specs.Descriptor{}, err
+	}
+	if err := dst.PutRoot(ctx, root, b); err != nil {
+		return specs.Descriptor{}, fmt.Errorf("manifest %s: %w", root.Digest, err)
+	}
+	return root, nil
+}
+
+// Missing returns how many bytes of the image of src, with everything it
+// references, dst doesn't have yet, as their descriptors give them: about
+// what Copy would store there. Only manifests are read from src.
+func Missing(ctx context.Context, dst Destination, src Source) (int64, error) {
+	b, root, err := src.Root(ctx)
+	if err != nil {
+		return 0, err
+	}
+	c := &copier{dst: dst, src: src, done: make(map[digest.Digest]bool)}
+	n, err := c.missing(ctx, root, b)
+	return n + int64(len(b)), err
+}
+
+// missing returns the bytes of what the manifest or index b lists that
+// the destination lacks.
+func (c *copier) missing(ctx context.Context, desc specs.Descriptor, b []byte) (int64, error) {
+	descs, err := references(desc, b)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, d := range descs {
+		if c.skip(d) {
+			continue
+		}
+		c.done[d.Digest] = true
+		if registry.IsManifest(d.MediaType) {
+			child, err := c.read(ctx, d)
+			if err != nil {
+				return 0, err
+			}
+			m, err := c.missing(ctx, d, child)
+			if err != nil {
+				return 0, err
+			}
+			n += m
+		}
+		ok, err := c.dst.Has(ctx, d)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			n += d.Size
+		}
+	}
+	return n, nil
+}
+
+type copier struct {
+	dst  Destination
+	src  Source
+	done map[digest.Digest]bool
+}
+
+// children copies what the manifest or index b lists.
+func (c *copier) children(ctx context.Context, desc specs.Descriptor, b []byte) error {
+	descs, err := references(desc, b)
+	if err != nil {
+		return err
+	}
+	for _, d := range descs {
+		if err := c.copy(ctx, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// references returns the descriptors of what the manifest or index b
+// lists.
+func references(desc specs.Descriptor, b []byte) ([]specs.Descriptor, error) {
+	var refs struct {
+		Config    *specs.Descriptor  `json:"config"`
+		Layers    []specs.Descriptor `json:"layers"`
+		Manifests []specs.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(b, &refs); err != nil {
+		return nil, fmt.Errorf("manifest %s: %w", desc.Digest, err)
+	}
+	var descs []specs.Descriptor
+	if refs.Config != nil {
+		descs = append(descs, *refs.Config)
+	}
+	descs = append(descs, refs.Layers...)
+	descs = append(descs, refs.Manifests...)
+	return descs, nil
+}
+
+// skip reports whether desc is not to be copied: because it already was,
+// or because it is meant to be fetched from elsewhere.
+func (c *copier) skip(desc specs.Descriptor) bool {
+	return c.done[desc.Digest] || len(desc.URLs) > 0 || nonDistributable(desc.MediaType)
+}
+
+func (c *copier) copy(ctx context.Context, desc specs.Descriptor) error {
+	if c.skip(desc) {
+		return nil
+	}
+	c.done[desc.Digest] = true
+	if err := desc.Digest.Validate(); err != nil {
+		return fmt.Errorf("blob %s: %w", desc.Digest, err)
+	}
+
+	if registry.IsManifest(desc.MediaType) {
+		b, err := c.read(ctx, desc)
+		if err != nil {
+			return err
+		}
+		if err := c.children(ctx, desc, b); err != nil {
+			return err
+		}
+		if ok, err := c.dst.Has(ctx, desc); err != nil || ok {
+			return err
+		}
+		if err := c.dst.Put(ctx, desc, bytes.NewReader(b)); err != nil {
+			return fmt.Errorf("manifest %s: %w", desc.Digest, err)
+		}
+		return nil
+	}
+
+	if ok, err := c.dst.Has(ctx, desc); err != nil || ok {
+		return err
+	}
+	r, err := c.src.Open(ctx, desc)
+	if err != nil {
+		return fmt.Errorf("blob %s: %w", desc.Digest, err)
+	}
+	defer r.Close()
+	v := newVerifier(r, desc)
+	if err := c.dst.Put(ctx, desc, v); err != nil {
+		return fmt.Errorf("blob %s: %w", desc.Digest, err)
+	}
+	return v.check()
+}
+
+// read reads and checks a manifest.
+func (c *copier) read(ctx context.Context, desc specs.Descriptor) ([]byte, error) {
+	r, err := c.src.Open(ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("manifest %s: %w", desc.Digest, err)
+	}
+	defer r.Close()
+	v := newVerifier(r, desc)
+	b, err := io.ReadAll(v)
+	if err == nil {
+		err = v.check()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func nonDistributable(mediaType string) bool {
+	switch mediaType {
+	case specs.MediaTypeImageLayerNonDistributable, specs.MediaTypeImageLayerNonDistributableGzip, specs.MediaTypeImageLayerNonDistributableZstd,
+		"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip":
+		return true
+	}
+	return false
+}
+
+// verifier checks content against its descriptor as it is read. Reading
+// fails at the end of the content if it doesn't match, and check reports
+// whether all of it was read and matched.
+type verifier struct {
+	r    io.Reader
+	desc specs.Descriptor
+	h    hash.Hash
+	n    int64
+	err  error // io.EOF once the content has been read and matched
+}
+
+func newVerifier(r io.Reader, desc specs.Descriptor) *verifier {
+	v := &verifier{r: io.LimitReader(r, desc.Size+1), desc: desc}
+	if desc.Digest.Algorithm().Available() {
+		v.h = desc.Digest.Algorithm().Hash()
+	} else {
+		v.err = fmt.Errorf("blob %s: unsupported digest algorithm", desc.Digest)
+	}
+	return v
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	v.n += int64(n)
+	switch {
+	case v.n > v.desc.Size:
+		v.err = fmt.Errorf("blob %s: content is larger than the %d bytes its descriptor gives", v.desc.Digest, v.desc.Size)
+		return 0, v.err
+	case err == io.EOF && v.n < v.desc.Size:
+		v.err = fmt.Errorf("blob %s: content ends after %d of %d bytes", v.desc.Digest, v.n, v.desc.Size)
+		return n, v.err
+	case err == io.EOF:
+		if d := digest.NewDigest(v.desc.Digest.Algorithm(), v.h); d != v.desc.Digest {
+			v.err = fmt.Errorf("blob %s: %w, content has digest %s", v.desc.Digest, oci.ErrDigestMismatch, d)
+			return n, v.err
+		}
+		v.err = io.EOF
+	case err != nil:
+		v.err = err
+	}
+	return n, err
+}
+
+func (v *verifier) check() error {
+	if v.err == nil {
+		// The destination stopped at the size of the content; the source
+		// must end there too.
+		io.Copy(io.Discard, v)
+	}
+	if v.err == io.EOF {
+		return nil
+	}
+	return v.err
+}
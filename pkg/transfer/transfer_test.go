@@ -0,0 +1,333 @@
+package transfer_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/oci"
+	"github.com/hxtk/ember/pkg/ocitest"
+	"github.com/hxtk/ember/pkg/transfer"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func image() *ocitest.Image {
+	return ocitest.New(
+		ocitest.NewLayer().Dir("etc").File("etc/hostname", "base"),
+		ocitest.NewLayer().Uncompressed().File("etc/motd", "hello"),
+	)
+}
+
+func blobPath(dir string, desc specs.Descriptor) string {
+	return filepath.Join(dir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+}
+
+func readJSON(t *testing.T, name string, v any) {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+}
+
+// manifest returns the descriptor of the one image of the layout dir and
+// its manifest.
+func manifest(t *testing.T, dir string) (specs.Descriptor, specs.Manifest) {
+	t.Helper()
+	var idx specs.Index
+	readJSON(t, filepath.Join(dir, "index.json"), &idx)
+	if len(idx.Manifests) != 1 {
+		t.Fatalf("%s has %d images, want 1", dir, len(idx.Manifests))
+	}
+	var m specs.Manifest
+	readJSON(t, blobPath(dir, idx.Manifests[0]), &m)
+	return idx.Manifests[0], m
+}
+
+func copyImage(t *testing.T, dst, src string) (specs.Descriptor, error) {
+	t.Helper()
+	s, err := transfer.OpenSource(src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	d, err := transfer.OpenDestination(dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := transfer.Copy(context.Background(), d, s)
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return desc, err
+}
+
+// entries reads the names of the merged view of the one image of the
+// layout fsys.
+func entries(t *testing.T, fsys fs.FS) []string {
+	t.Helper()
+	r, err := oci.OpenFS(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var names []string
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+// Copies keep the digest of the image, to a layout directory or through an
+// archive, and the tag the destination gives or else the source's.
+func TestCopy(t *testing.T) {
+	src := ocitest.Layout(t, image())
+	want, _ := manifest(t, src)
+	archive := filepath.Join(t.TempDir(), "image.tar")
+	dst := filepath.Join(t.TempDir(), "layout")
+	for _, tc := range []struct {
+		dst, src, ref string
+	}{
+		{"oci:" + dst + ":v1", "oci:" + src + ":latest", "v1"},
+		{"oci-archive:" + archive, src, "latest"},
+		{filepath.Join(t.TempDir(), "copy"), "oci-archive:" + archive + ":latest", "latest"},
+	} {
+		got, err := copyImage(t, tc.dst, tc.src)
+		if err != nil {
+			t.Fatalf("Copy(%s, %s) = %v", tc.dst, tc.src, err)
+		}
+		if got.Digest != want.Digest || got.Size != want.Size {
+			t.Errorf("Copy(%s, %s) = %s, want the digest of the source %s", tc.dst, tc.src, got.Digest, want.Digest)
+		}
+		if path := transfer.LocalPath(tc.dst); path != archive {
+			if ref := rootRef(t, path); ref != tc.ref {
+				t.Errorf("%s has the image tagged %q, want %q", tc.dst, ref, tc.ref)
+			}
+		}
+	}
+	if got, want := entries(t, os.DirFS(dst)), entries(t, os.DirFS(src)); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("copied image has %q, want %q", got, want)
+	}
+
+	// A layout keeps the images it has.
+	other := ocitest.Layout(t, ocitest.New(ocitest.NewLayer().File("other", "x")))
+	if _, err := copyImage(t, "oci:"+dst+":v2", other); err != nil {
+		t.Fatal(err)
+	}
+	var idx specs.Index
+	readJSON(t, filepath.Join(dst, "index.json"), &idx)
+	if len(idx.Manifests) != 2 {
+		t.Errorf("layout has %d images after copying another, want 2", len(idx.Manifests))
+	}
+	if _, err := copyImage(t, filepath.Join(t.TempDir(), "x"), dst); err == nil || !strings.Contains(err.Error(), "the layout has 2 images; name one") {
+		t.Errorf("Copy() of a layout of two images = %v, want an error", err)
+	}
+	if _, err := copyImage(t, filepath.Join(t.TempDir(), "x"), "oci:"+dst+":v3"); err == nil || !strings.Contains(err.Error(), `no image is named "v3"`) {
+		t.Errorf("Copy() of a missing tag = %v, want an error", err)
+	}
+}
+
+// rootRef returns the ref.name of the one image in the layout dir.
+func rootRef(t *testing.T, dir string) string {
+	t.Helper()
+	desc, _ := manifest(t, dir)
+	return desc.Annotations[specs.AnnotationRefName]
+}
+
+// A blob whose content doesn't have the digest or size of its descriptor
+// fails the copy, and is not stored.
+func TestCopyRejectsContent(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		tamper func(b []byte) []byte
+		want   string
+	}{
+		{"digest", func(b []byte) []byte { b[len(b)-1] ^= 0xff; return b }, "digest mismatch"},
+		{"longer", func(b []byte) []byte { return append(b, 0) }, "content is larger than the"},
+		{"shorter", func(b []byte) []byte { return b[:len(b)-1] }, "content ends after"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := ocitest.Layout(t, image())
+			_, m := manifest(t, src)
+			layer := m.Layers[1]
+			b, err := os.ReadFile(blobPath(src, layer))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(blobPath(src, layer), tc.tamper(b), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			dst := filepath.Join(t.TempDir(), "layout")
+			_, err = copyImage(t, dst, src)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("Copy() = %v, want an error: %s", err, tc.want)
+			}
+			if tc.name == "digest" && !errors.Is(err, oci.ErrDigestMismatch) {
+				t.Errorf("Copy() = %v, want oci.ErrDigestMismatch", err)
+			}
+			if _, err := os.Stat(blobPath(dst, layer)); !os.IsNotExist(err) {
+				t.Errorf("the destination stored the bad blob: %v", err)
+			}
+			if _, err := os.Stat(blobPath(dst, m.Config)); err != nil {
+				t.Errorf("the destination lacks the config copied before the bad blob: %v", err)
+			}
+
+			archive := filepath.Join(t.TempDir(), "image.tar")
+			if _, err := copyImage(t, "oci-archive:"+archive, src); err == nil {
+				t.Error("Copy() to an archive = nil error")
+			}
+			if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(archive), "*")); len(matches) != 0 {
+				t.Errorf("a failed copy to an archive left %q", matches)
+			}
+		})
+	}
+}
+
+// A manifest is checked against the descriptor of the index too.
+func TestCopyRejectsManifest(t *testing.T) {
+	src := ocitest.Layout(t, image())
+	desc, _ := manifest(t, src)
+	b, err := os.ReadFile(blobPath(src, desc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blobPath(src, desc), bytes.Replace(b, []byte(`"schemaVersion":2`), []byte(`"schemaVersion":3`), 1), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := copyImage(t, filepath.Join(t.TempDir(), "layout"), src); !errors.Is(err, oci.ErrDigestMismatch) {
+		t.Errorf("Copy() = %v, want oci.ErrDigestMismatch", err)
+	}
+}
+
+// Missing counts what the destination lacks, which a copy leaves nothing
+// of but the root.
+func TestMissing(t *testing.T) {
+	src := ocitest.Layout(t, image())
+	desc, m := manifest(t, src)
+	dst := filepath.Join(t.TempDir(), "layout")
+	missing := func() int64 {
+		s, err := transfer.OpenSource(src, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		d, err := transfer.OpenDestination(dst, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		n, err := transfer.Missing(context.Background(), d, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	want := desc.Size + m.Config.Size + m.Layers[0].Size + m.Layers[1].Size
+	if got := missing(); got != want {
+		t.Errorf("Missing() = %d, want %d", got, want)
+	}
+	if _, err := copyImage(t, dst, src); err != nil {
+		t.Fatal(err)
+	}
+	if got := missing(); got != desc.Size {
+		t.Errorf("Missing() after a copy = %d, want the root's %d", got, desc.Size)
+	}
+}
+
+// Archives are read compressed with gzip, but not xz, and must be tar
+// archives.
+func TestOpenArchive(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "image.tar")
+	if _, err := copyImage(t, "oci-archive:"+plain, ocitest.Layout(t, image())); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(b)
+	zw.Close()
+	compressed := filepath.Join(dir, "image.tar.gz")
+	if err := os.WriteFile(compressed, gz.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := transfer.OpenArchive(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := a.Open("oci-layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout, _ := io.ReadAll(f)
+	if !strings.Contains(string(layout), specs.ImageLayoutVersion) {
+		t.Errorf("oci-layout of the decompressed archive is %q", layout)
+	}
+	if _, err := a.Open("blobs"); err == nil {
+		t.Error("Open() of a directory of the archive = nil error, want only files served")
+	}
+	if got := entries(t, a); len(got) != 3 {
+		t.Errorf("image of the compressed archive has %q", got)
+	}
+	if err := a.Close(); err != nil {
+		t.Error(err)
+	}
+
+	for name, content := range map[string]string{
+		"image.tar.xz": "\xfd7zXZ\x00rest",
+		"notes.txt":    strings.Repeat("not a tar archive\n", 40),
+	} {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := transfer.OpenArchive(file); err == nil {
+			t.Errorf("OpenArchive(%s) = nil error", name)
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	for _, tc := range []struct {
+		name, local, repo, retag string
+	}{
+		{"oci:/srv/layout:v1", "/srv/layout", "/srv/layout", "oci:/srv/layout:v2"},
+		{"oci-archive:image.tar", "image.tar", "image.tar", "oci-archive:image.tar:v2"},
+		{"layout", "layout", "layout", "oci:layout:v2"},
+		{"docker://ghcr.io/hxtk/ember:v1", "", "ghcr.io/hxtk/ember", "docker://ghcr.io/hxtk/ember:v2"},
+	} {
+		if got := transfer.LocalPath(tc.name); got != tc.local {
+			t.Errorf("LocalPath(%q) = %q, want %q", tc.name, got, tc.local)
+		}
+		if got, err := transfer.Repository(tc.name); err != nil || got != tc.repo {
+			t.Errorf("Repository(%q) = %q, %v, want %q", tc.name, got, err, tc.repo)
+		}
+		if got, err := transfer.Retag(tc.name, "v2"); err != nil || got != tc.retag {
+			t.Errorf("Retag(%q) = %q, %v, want %q", tc.name, got, err, tc.retag)
+		}
+	}
+	if _, err := transfer.OpenSource("oci:", nil); err == nil || !strings.Contains(err.Error(), "has no path") {
+		t.Errorf("OpenSource(oci:) = %v, want an error", err)
+	}
+}
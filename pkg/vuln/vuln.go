@@ -0,0 +1,85 @@
+// Package vuln matches installed packages against a list of known
+// vulnerabilities.
+package vuln
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/hxtk/ember/pkg/pkgdb"
+)
+
+// Advisory describes the versions of a package affected by a
+// vulnerability. A version is affected if it is older than Fixed or one of
+// Versions; an advisory with neither affects every version.
+//
+// A vulnerability list is a JSON array of advisories, for example:
+//
+//	[
+//	  {"id": "CVE-2023-0286", "manager": "apk", "package": "libcrypto3", "fixed": "3.0.8-r0"},
+//	  {"id": "CVE-2024-3094", "package": "xz-utils", "versions": ["5.6.0-0.1", "5.6.1-1"]}
+//	]
+type Advisory struct {
+	ID       string   `json:"id"`
+	Manager  string   `json:"manager,omitempty"` // apk, dpkg, or rpm; empty matches any
+	Package  string   `json:"package"`
+	Fixed    string   `json:"fixed,omitempty"`
+	Versions []string `json:"versions,omitempty"`
+}
+
+// Read reads a vulnerability list.
+func Read(r io.Reader) ([]Advisory, error) {
+	var advs []Advisory
+	if err := json.NewDecoder(r).Decode(&advs); err != nil {
+		return nil, fmt.Errorf("parse vulnerability list: %w", err)
+	}
+	for i, a := range advs {
+		if a.ID == "" || a.Package == "" {
+			return nil, fmt.Errorf("parse vulnerability list: advisory %d lacks an id or package", i)
+		}
+	}
+	return advs, nil
+}
+
+// Match is an installed package affected by an advisory.
+type Match struct {
+	Advisory string        `json:"advisory"`
+	Package  pkgdb.Package `json:"package"`
+}
+
+// Affects reports whether a affects p.
+func (a *Advisory) Affects(p pkgdb.Package) bool {
+	if a.Package != p.Name || a.Manager != "" && a.Manager != p.Manager {
+		return false
+	}
+	if a.Fixed == "" && len(a.Versions) == 0 {
+		return true
+	}
+	if a.Fixed != "" && pkgdb.CompareVersions(p.Manager, p.Version, a.Fixed) < 0 {
+		return true
+	}
+	for _, v := range a.Versions {
+		if pkgdb.CompareVersions(p.Manager, p.Version, v) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns the packages affected by advisories.
+func Check(pkgs []pkgdb.Package, advs []Advisory) []Match {
+	byName := make(map[string][]*Advisory)
+	for i := range advs {
+		byName[advs[i].Package] = append(byName[advs[i].Package], &advs[i])
+	}
+	var matches []Match
+	for _, p := range pkgs {
+		for _, a := range byName[p.Name] {
+			if a.Affects(p) {
+				matches = append(matches, Match{Advisory: a.ID, Package: p})
+			}
+		}
+	}
+	return matches
+}
@@ -0,0 +1,136 @@
+package xz
+
+import "encoding/binary"
+
+// BCJ is a branch/call/jump filter, which converts the relative addresses
+// of calls and jumps in machine code to absolute ones, so that the calls of
+// a function look alike to the match finder wherever they are.
+type BCJ byte
+
+// The BCJ filters, by their filter IDs.
+const (
+	BCJNone  BCJ = 0
+	BCJX86   BCJ = 0x04
+	BCJARM64 BCJ = 0x0A
+)
+
+func (f BCJ) String() string {
+	switch f {
+	case BCJNone:
+		return "none"
+	case BCJX86:
+		return "x86"
+	case BCJARM64:
+		return "arm64"
+	}
+	return "unknown"
+}
+
+// bcjEncoder converts the addresses of buffered input in place.
+type bcjEncoder interface {
+	// encode converts b, whose first byte is at pos in the input, and
+	// returns how much of b is done; the rest has to wait for more input,
+	// or is passed through as is at the end of it.
+	encode(pos uint32, b []byte) int
+}
+
+func newBCJEncoder(f BCJ) bcjEncoder {
+	switch f {
+	case BCJX86:
+		return &x86Encoder{prevPos: ^uint32(0) - 4}
+	case BCJARM64:
+		return arm64Encoder{}
+	}
+	return nil
+}
+
+// x86Encoder converts the targets of E8 (call) and E9 (jmp) instructions,
+// skipping those that are unlikely to be instructions, as xz does.
+type x86Encoder struct {
+	prevMask uint32
+	prevPos  uint32
+}
+
+var (
+	x86AllowedMask = [8]bool{true, true, true, false, true, false, false, false}
+	x86MaskBit     = [8]uint32{0, 1, 2, 2, 3, 3, 3, 3}
+)
+
+// x86MSByte reports whether b is a plausible top byte of a near target.
+func x86MSByte(b byte) bool { return b == 0 || b == 0xFF }
+
+func (e *x86Encoder) encode(pos uint32, b []byte) int {
+	if len(b) < 5 {
+		return 0
+	}
+	if pos-e.prevPos > 5 {
+		e.prevPos = pos - 5
+	}
+	i := 0
+	for ; i <= len(b)-5; i++ {
+		if b[i] != 0xE8 && b[i] != 0xE9 {
+			continue
+		}
+		offset := pos + uint32(i) - e.prevPos
+		e.prevPos = pos + uint32(i)
+		if offset > 5 {
+			e.prevMask = 0
+		} else {
+			for range offset {
+				e.prevMask = e.prevMask & 0x77 << 1
+			}
+		}
+		top := b[i+4]
+		if !x86MSByte(top) || !x86AllowedMask[e.prevMask>>1&7] || e.prevMask>>1 >= 0x10 {
+			e.prevMask |= 1
+			if x86MSByte(top) {
+				e.prevMask |= 0x10
+			}
+			continue
+		}
+		src := binary.LittleEndian.Uint32(b[i+1:])
+		var dest uint32
+		for {
+			dest = src + pos + uint32(i) + 5
+			if e.prevMask == 0 {
+				break
+			}
+			n := x86MaskBit[e.prevMask>>1] * 8
+			if !x86MSByte(byte(dest >> (24 - n))) {
+				break
+			}
+			src = dest ^ (1<<(32-n) - 1)
+		}
+		dest = dest&0x00FFFFFF | -(dest>>24&1)<<24 // sign-extended from bit 24
+		binary.LittleEndian.PutUint32(b[i+1:], dest)
+		i += 4
+		e.prevMask = 0
+	}
+	return i
+}
+
+// arm64Encoder converts the targets of BL and ADRP instructions.
+type arm64Encoder struct{}
+
+func (arm64Encoder) encode(pos uint32, b []byte) int {
+	i := 0
+	for ; i+4 <= len(b); i += 4 {
+		pc := pos + uint32(i)
+		ins := binary.LittleEndian.Uint32(b[i:])
+		switch {
+		case ins>>26 == 0x25: // BL
+			ins = 0x94000000 | (ins+pc>>2)&0x03FFFFFF
+		case ins&0x9F000000 == 0x90000000: // ADRP
+			src := ins>>29&3 | ins>>3&0x001FFFFC
+			if (src+0x00020000)&0x001C0000 != 0 {
+				continue // beyond +-512 MiB, left alone as xz does
+			}
+			dest := src + pc>>12
+			ins = ins&0x9000001F | (dest&3)<<29 | (dest&0x0003FFFC)<<3 | -(dest&0x00020000)&0x00E00000
+		default:
+			continue
+		}
+		binary.LittleEndian.PutUint32(b[i:], ins)
+	}
+	return i
+}
@@ -0,0 +1,483 @@
+package xz
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// The literal context and position bits xz uses by default; LZMA2 needs
+// lc+lp <= 4.
+const (
+	lc = 3
+	lp = 0
+	pb = 2
+
+	// props is the LZMA properties byte for lc, lp, and pb.
+	props = (pb*5+lp)*9 + lc
+)
+
+const (
+	numStates    = 12
+	posStates    = 1 << pb
+	minMatchLen  = 2
+	maxMatchLen  = 273
+	lenToPosBits = 2 // log2 of the number of length states for distances
+
+	endPosModelIndex = 14
+	numFullDistances = 1 << (endPosModelIndex >> 1)
+	alignBits        = 4
+
+	// hashLen is the length of the prefix the match finder hashes, and
+	// the shortest match other than a repeat that the encoder emits.
+	hashLen = 4
+)
+
+// lenEncoder codes match lengths from minMatchLen to maxMatchLen.
+type lenEncoder struct {
+	choice, choice2 prob
+	low             [posStates][1 << 3]prob
+	mid             [posStates][1 << 3]prob
+	high            [1 << 8]prob
+}
+
+func (e *lenEncoder) reset() {
+	e.choice, e.choice2 = probInit, probInit
+	for i := range e.low {
+		initProbs(e.low[i][:])
+		initProbs(e.mid[i][:])
+	}
+	initProbs(e.high[:])
+}
+
+func (e *lenEncoder) encode(rc *rangeEncoder, n, posState uint32) {
+	n -= minMatchLen
+	switch {
+	case n < 8:
+		rc.bit(&e.choice, 0)
+		rc.tree(e.low[posState][:], 3, n)
+	case n < 16:
+		rc.bit(&e.choice, 1)
+		rc.bit(&e.choice2, 0)
+		rc.tree(e.mid[posState][:], 3, n-8)
+	default:
+		rc.bit(&e.choice, 1)
+		rc.bit(&e.choice2, 1)
+		rc.tree(e.high[:], 8, n-16)
+	}
+}
+
+// model is the adaptive state of LZMA that a state reset restores.
+type model struct {
+	isMatch    [numStates][posStates]prob
+	isRep      [numStates]prob
+	isRepG0    [numStates]prob
+	isRepG1    [numStates]prob
+	isRepG2    [numStates]prob
+	isRep0Long [numStates][posStates]prob
+	literal    [0x300 << (lc + lp)]prob
+	posSlot    [1 << lenToPosBits][1 << 6]prob
+	posSpecial [numFullDistances - endPosModelIndex + 1]prob // from 1, as trees are
+	align      [1 << alignBits]prob
+	len        lenEncoder
+	repLen     lenEncoder
+
+	state uint32
+	reps  [4]uint32 // zero-based distances of the last four matches
+}
+
+func (m *model) reset() {
+	for i := range m.isMatch {
+		initProbs(m.isMatch[i][:])
+		initProbs(m.isRep0Long[i][:])
+	}
+	initProbs(m.isRep[:])
+	initProbs(m.isRepG0[:])
+	initProbs(m.isRepG1[:])
+	initProbs(m.isRepG2[:])
+	initProbs(m.literal[:])
+	for i := range m.posSlot {
+		initProbs(m.posSlot[i][:])
+	}
+	initProbs(m.posSpecial[:])
+	initProbs(m.align[:])
+	m.len.reset()
+	m.repLen.reset()
+	m.state = 0
+	m.reps = [4]uint32{}
+}
+
+// level tunes the match finder.
+type level struct {
+	dictSize int // the default, as xz's presets have it
+	depth    int // hash chain candidates tried per position
+	niceLen  int // length at which a match is taken without looking further
+}
+
+var levels = [MaxLevel + 1]level{
+	1: {1 << 20, 2, 16},
+	2: {2 << 20, 4, 24},
+	3: {4 << 20, 8, 32},
+	4: {4 << 20, 16, 48},
+	5: {8 << 20, 24, 64},
+	6: {8 << 20, 32, 96},
+	7: {16 << 20, 64, 128},
+	8: {32 << 20, 128, 192},
+	9: {64 << 20, 256, maxMatchLen},
+}
+
+// Limits of LZMA2 chunks.
+const (
+	maxChunkInput        = 1 << 21 // uncompressed bytes of an LZMA chunk
+	maxChunkOutput       = 1 << 16 // compressed bytes of an LZMA chunk
+	maxUncompressedChunk = 1 << 16 // bytes of an uncompressed chunk
+
+	// maxSymbolBytes bounds what one literal or match adds to the range
+	// coder's output.
+	maxSymbolBytes = 64
+)
+
+// lzma2Encoder compresses to a stream of LZMA2 chunks.
+type lzma2Encoder struct {
+	lv       level
+	dictSize int
+	m        model
+	rc       rangeEncoder
+
+	// buf holds up to dictSize bytes of history followed by the input
+	// not yet encoded, which starts at buf[pending]. base is the
+	// position of buf[0] in the whole input.
+	buf     []byte
+	base    int
+	pending int
+	next    int // position of the next byte to add to the hash chains
+
+	hashLog uint
+	head    []uint32 // by hash: position+1 of the latest occurrence
+	chain   []uint32 // by position modulo len(chain): the previous one
+
+	needDictReset  bool
+	needProps      bool
+	needStateReset bool
+}
+
+func newLZMA2Encoder(lv level, dictSize int) *lzma2Encoder {
+	chain := 1 << bits.Len(uint(dictSize-1))
+	hashLog := uint(min(max(bits.Len(uint(dictSize))-2, 16), 22))
+	e := &lzma2Encoder{
+		lv:            lv,
+		dictSize:      dictSize,
+		hashLog:       hashLog,
+		head:          make([]uint32, 1<<hashLog),
+		chain:         make([]uint32, chain),
+		needDictReset: true,
+		needProps:     true,
+	}
+	e.m.reset()
+	return e
+}
+
+// buffered returns the number of bytes of input not yet encoded.
+func (e *lzma2Encoder) buffered() int { return len(e.buf) - e.pending }
+
+// chunk encodes input from buf[pending] as one chunk, not using input past
+// buf[end], and appends it to out.
+func (e *lzma2Encoder) chunk(out []byte, end int) []byte {
+	if e.needDictReset || e.needProps || e.needStateReset {
+		e.m.reset()
+	}
+	start := e.pending
+	e.rc.reset()
+	for e.pending < end && e.pending-start < maxChunkInput && e.rc.size()+maxSymbolBytes <= maxChunkOutput {
+		e.symbol(end, maxChunkInput-(e.pending-start))
+	}
+	e.rc.flush()
+	n, data := e.pending-start, e.rc.out
+	if len(data) >= n {
+		// Stored is smaller. The model has moved on from what the
+		// decoder has, so the next LZMA chunk resets it.
+		for i := start; i < e.pending; i += maxUncompressedChunk {
+			piece := e.buf[i:min(i+maxUncompressedChunk, e.pending)]
+			control := byte(2)
+			if e.needDictReset {
+				control, e.needDictReset = 1, false
+			}
+			out = append(out, control, byte((len(piece)-1)>>8), byte(len(piece)-1))
+			out = append(out, piece...)
+		}
+		e.needStateReset = true
+	} else {
+		var reset byte
+		switch {
+		case e.needDictReset:
+			reset = 3
+		case e.needProps:
+			reset = 2
+		case e.needStateReset:
+			reset = 1
+		}
+		out = append(out, 0x80|reset<<5|byte((n-1)>>16), byte((n-1)>>8), byte(n-1),
+			byte((len(data)-1)>>8), byte(len(data)-1))
+		if reset >= 2 {
+			out = append(out, props)
+		}
+		out = append(out, data...)
+		e.needDictReset, e.needProps, e.needStateReset = false, false, false
+	}
+	e.compact()
+	return out
+}
+
+// compact drops the history beyond the dictionary.
+func (e *lzma2Encoder) compact() {
+	if e.pending <= e.dictSize+max(e.dictSize, maxChunkInput) {
+		return
+	}
+	drop := e.pending - e.dictSize
+	n := copy(e.buf, e.buf[drop:])
+	e.buf = e.buf[:n]
+	e.base += drop
+	e.pending -= drop
+}
+
+func (e *lzma2Encoder) hash(i int) uint32 {
+	return binary.LittleEndian.Uint32(e.buf[i:]) * 2654435761 >> (32 - e.hashLog)
+}
+
+// insertTo adds the positions before buffer index i to the hash chains.
+func (e *lzma2Encoder) insertTo(i int) {
+	mask := len(e.chain) - 1
+	e.next = max(e.next, e.base)
+	for ; e.next < e.base+i && e.next-e.base+hashLen <= len(e.buf); e.next++ {
+		h := e.hash(e.next - e.base)
+		e.chain[e.next&mask] = e.head[h]
+		e.head[h] = uint32(e.next + 1)
+	}
+}
+
+// find returns the longest match for buffer index i of at most limit
+// bytes, if one of at least hashLen bytes is found.
+func (e *lzma2Encoder) find(i, limit int) (length, dist int) {
+	if limit < hashLen || i+hashLen > len(e.buf) {
+		return 0, 0
+	}
+	e.insertTo(i)
+	pos := e.base + i
+	mask := len(e.chain) - 1
+	best := hashLen - 1
+	cand := e.head[e.hash(i)]
+	for d := e.lv.depth; d > 0 && cand != 0; d-- {
+		d := int(uint32(pos+1) - cand)
+		if d <= 0 || d > e.dictSize || d > i {
+			break
+		}
+		j := i - d
+		if e.buf[j+best] == e.buf[i+best] {
+			if n := matchLen(e.buf[j:], e.buf[i:i+limit]); n > best {
+				best, length, dist = n, n, d
+				if n == limit || n >= e.lv.niceLen {
+					return length, dist
+				}
+			}
+		}
+		cand = e.chain[(pos-d)&mask]
+	}
+	return length, dist
+}
+
+// matchLen returns the length of the common prefix of a and b, with
+// len(a) >= len(b).
+func matchLen(a, b []byte) int {
+	n := 0
+	for len(b)-n >= 8 {
+		if x := binary.LittleEndian.Uint64(a[n:]) ^ binary.LittleEndian.Uint64(b[n:]); x != 0 {
+			return n + bits.TrailingZeros64(x)/8
+		}
+		n += 8
+	}
+	for n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// repMatch returns the longest match at buffer index i of at most limit
+// bytes with one of the repeated distances, and which.
+func (e *lzma2Encoder) repMatch(i, limit int) (length, rep int) {
+	for r, d := range e.m.reps {
+		dist := int(d) + 1
+		if dist > i || limit < minMatchLen {
+			continue
+		}
+		if n := matchLen(e.buf[i-dist:], e.buf[i:i+limit]); n > length {
+			length, rep = n, r
+		}
+	}
+	return length, rep
+}
+
+// farther reports whether dist is so much larger than near that a match
+// one byte longer at dist doesn't pay for coding it.
+func farther(near, dist int) bool {
+	return dist>>7 > near
+}
+
+// symbol encodes a literal or a match at buf[pending], of at most room
+// bytes and not reaching past buf[end].
+func (e *lzma2Encoder) symbol(end, room int) {
+	i := e.pending
+	limit := min(end-i, maxMatchLen, room)
+	repLen, rep := e.repMatch(i, limit)
+	if repLen >= e.lv.niceLen {
+		e.encodeRep(rep, repLen)
+		return
+	}
+	mainLen, mainDist := e.find(i, limit)
+	if mainLen >= e.lv.niceLen {
+		e.encodeMatch(mainDist, mainLen)
+		return
+	}
+	if mainLen == hashLen && mainDist > 1<<14 {
+		mainLen = 0 // not worth its distance
+	}
+	if repLen >= minMatchLen && (repLen+1 >= mainLen ||
+		repLen+2 >= mainLen && mainDist >= 1<<9 ||
+		repLen+3 >= mainLen && mainDist >= 1<<15) {
+		e.encodeRep(rep, repLen)
+		return
+	}
+	if mainLen < hashLen {
+		e.encodeLiteral()
+		return
+	}
+	// Emit a literal instead if a better match starts at the next byte.
+	if next := i + 1; next < end {
+		nextLimit := min(end-next, maxMatchLen, room-1)
+		if n, d := e.find(next, nextLimit); n >= hashLen &&
+			(n >= mainLen && d < mainDist ||
+				n == mainLen+1 && !farther(mainDist, d) ||
+				n > mainLen+1 ||
+				n+1 >= mainLen && mainLen >= 3 && farther(d, mainDist)) {
+			e.encodeLiteral()
+			return
+		}
+		for _, r := range e.m.reps {
+			dist := int(r) + 1
+			if dist <= next && matchLen(e.buf[next-dist:], e.buf[next:next+nextLimit]) >= max(mainLen-1, minMatchLen) {
+				e.encodeLiteral()
+				return
+			}
+		}
+	}
+	e.encodeMatch(mainDist, mainLen)
+}
+
+func (e *lzma2Encoder) posState() uint32 {
+	return uint32(e.base+e.pending) & (posStates - 1)
+}
+
+func (e *lzma2Encoder) encodeLiteral() {
+	m, i := &e.m, e.pending
+	ps := e.posState()
+	e.rc.bit(&m.isMatch[m.state][ps], 0)
+	var prev byte
+	if i > 0 {
+		prev = e.buf[i-1]
+	}
+	pos := uint32(e.base + i)
+	litState := (pos&(1<<lp-1))<<lc + uint32(prev)>>(8-lc)
+	probs := m.literal[0x300*litState : 0x300*(litState+1)]
+	sym := uint32(e.buf[i]) | 0x100
+	if m.state < 7 {
+		for sym < 0x10000 {
+			e.rc.bit(&probs[sym>>8], sym>>7&1)
+			sym <<= 1
+		}
+	} else {
+		match := uint32(e.buf[i-int(m.reps[0])-1])
+		offs := uint32(0x100)
+		for sym < 0x10000 {
+			match <<= 1
+			e.rc.bit(&probs[offs+match&offs+sym>>8], sym>>7&1)
+			sym <<= 1
+			offs &^= match ^ sym
+		}
+	}
+	switch {
+	case m.state < 4:
+		m.state = 0
+	case m.state < 10:
+		m.state -= 3
+	default:
+		m.state -= 6
+	}
+	e.pending++
+}
+
+func (e *lzma2Encoder) encodeMatch(dist, n int) {
+	m := &e.m
+	ps := e.posState()
+	e.rc.bit(&m.isMatch[m.state][ps], 1)
+	e.rc.bit(&m.isRep[m.state], 0)
+	m.len.encode(&e.rc, uint32(n), ps)
+
+	d := uint32(dist - 1)
+	slot := posSlot(d)
+	e.rc.tree(m.posSlot[min(n-minMatchLen, 1<<lenToPosBits-1)][:], 6, slot)
+	if slot >= 4 {
+		footer := uint(slot>>1 - 1)
+		base := (2 | slot&1) << footer
+		reduced := d - base
+		if slot < endPosModelIndex {
+			e.rc.reverseTree(m.posSpecial[base-slot:], footer, reduced)
+		} else {
+			e.rc.direct(reduced>>alignBits, footer-alignBits)
+			e.rc.reverseTree(m.align[:], alignBits, reduced&(1<<alignBits-1))
+		}
+	}
+	m.reps = [4]uint32{d, m.reps[0], m.reps[1], m.reps[2]}
+	if m.state < 7 {
+		m.state = 7
+	} else {
+		m.state = 10
+	}
+	e.pending += n
+}
+
+func (e *lzma2Encoder) encodeRep(rep, n int) {
+	m := &e.m
+	ps := e.posState()
+	e.rc.bit(&m.isMatch[m.state][ps], 1)
+	e.rc.bit(&m.isRep[m.state], 1)
+	if rep == 0 {
+		e.rc.bit(&m.isRepG0[m.state], 0)
+		e.rc.bit(&m.isRep0Long[m.state][ps], 1)
+	} else {
+		e.rc.bit(&m.isRepG0[m.state], 1)
+		if rep == 1 {
+			e.rc.bit(&m.isRepG1[m.state], 0)
+		} else {
+			e.rc.bit(&m.isRepG1[m.state], 1)
+			e.rc.bit(&m.isRepG2[m.state], uint32(rep-2))
+		}
+		d := m.reps[rep]
+		copy(m.reps[1:rep+1], m.reps[:rep])
+		m.reps[0] = d
+	}
+	m.repLen.encode(&e.rc, uint32(n), ps)
+	if m.state < 7 {
+		m.state = 8
+	} else {
+		m.state = 11
+	}
+	e.pending += n
+}
+
+// posSlot returns the slot of the zero-based distance d: its two most
+// significant bits and their position.
+func posSlot(d uint32) uint32 {
+	if d < 4 {
+		return d
+	}
+	n := uint32(bits.Len32(d) - 1)
+	return 2*n + d>>(n-1)&1
+}
@@ -0,0 +1,116 @@
+package xz
+
+// prob is the probability, in 1/2048ths, that the next bit of a context is
+// 0, as the range coder adapts it.
+type prob uint16
+
+const (
+	probBits = 11
+	probInit = 1 << probBits / 2
+	moveBits = 5
+)
+
+func initProbs(ps []prob) {
+	for i := range ps {
+		ps[i] = probInit
+	}
+}
+
+// rangeEncoder is the binary arithmetic coder of LZMA.
+type rangeEncoder struct {
+	low       uint64
+	rng       uint32
+	cache     byte
+	cacheSize int
+	out       []byte
+}
+
+func (rc *rangeEncoder) reset() {
+	rc.low, rc.rng = 0, 0xFFFFFFFF
+	rc.cache, rc.cacheSize = 0, 1
+	rc.out = rc.out[:0]
+}
+
+// shiftLow moves the top byte of low out, holding back runs of 0xFF bytes
+// that a carry may still change.
+func (rc *rangeEncoder) shiftLow() {
+	if uint32(rc.low) < 0xFF000000 || rc.low >= 1<<32 {
+		carry := byte(rc.low >> 32)
+		b := rc.cache
+		for ; rc.cacheSize > 0; rc.cacheSize-- {
+			rc.out = append(rc.out, b+carry)
+			b = 0xFF
+		}
+		rc.cache = byte(rc.low >> 24)
+	}
+	rc.cacheSize++
+	rc.low = rc.low & 0x00FFFFFF << 8
+}
+
+func (rc *rangeEncoder) normalize() {
+	for rc.rng < 1<<24 {
+		rc.rng <<= 8
+		rc.shiftLow()
+	}
+}
+
+// bit encodes bit in the context p and adapts p.
+func (rc *rangeEncoder) bit(p *prob, bit uint32) {
+	bound := rc.rng >> probBits * uint32(*p)
+	if bit == 0 {
+		rc.rng = bound
+		*p += (1<<probBits - *p) >> moveBits
+	} else {
+		rc.low += uint64(bound)
+		rc.rng -= bound
+		*p -= *p >> moveBits
+	}
+	rc.normalize()
+}
+
+// direct encodes the low n bits of v with fixed probabilities of 1/2.
+func (rc *rangeEncoder) direct(v uint32, n uint) {
+	for n > 0 {
+		n--
+		rc.rng >>= 1
+		if v>>n&1 != 0 {
+			rc.low += uint64(rc.rng)
+		}
+		rc.normalize()
+	}
+}
+
+// tree encodes the low n bits of v, most significant first, each in the
+// context of the bits before it.
+func (rc *rangeEncoder) tree(ps []prob, n uint, v uint32) {
+	m := uint32(1)
+	for n > 0 {
+		n--
+		b := v >> n & 1
+		rc.bit(&ps[m], b)
+		m = m<<1 | b
+	}
+}
+
+// reverseTree is tree with the bits least significant first.
+func (rc *rangeEncoder) reverseTree(ps []prob, n uint, v uint32) {
+	m := uint32(1)
+	for ; n > 0; n-- {
+		b := v & 1
+		rc.bit(&ps[m], b)
+		m = m<<1 | b
+		v >>= 1
+	}
+}
+
+// flush writes out what remains of low.
+func (rc *rangeEncoder) flush() {
+	for i := 0; i < 5; i++ {
+		rc.shiftLow()
+	}
+}
+
+// size bounds the bytes the encoder holds once flushed.
+func (rc *rangeEncoder) size() int {
+	return len(rc.out) + rc.cacheSize + 5
+}
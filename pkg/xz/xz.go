@@ -0,0 +1,327 @@
+// Package xz writes xz-compressed data (the .xz file format 1.2.0).
+//
+// The Writer produces a single block of LZMA2, optionally behind a BCJ
+// filter, that xz, liblzma, and the Linux kernel's decompressor read. The
+// LZMA encoder is a hash-chain match finder with greedy parsing and a
+// one-byte lookahead, much like xz's fast mode; its output is somewhat
+// larger than xz's at the same level. There is no decoder.
+package xz
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+)
+
+// Compression levels accepted by WriterConfig, as those of xz.
+const (
+	MinLevel     = 1
+	MaxLevel     = 9
+	DefaultLevel = 6
+)
+
+// Limits of WriterConfig.DictSize.
+const (
+	MinDictSize = 4 << 10
+	MaxDictSize = 1536 << 20
+)
+
+// Check is the integrity check stored after the block, by its ID.
+type Check byte
+
+// The checks of the format.
+const (
+	CheckNone   Check = 0x00
+	CheckCRC32  Check = 0x01
+	CheckCRC64  Check = 0x04
+	CheckSHA256 Check = 0x0A
+)
+
+func (c Check) String() string {
+	switch c {
+	case CheckNone:
+		return "none"
+	case CheckCRC32:
+		return "crc32"
+	case CheckCRC64:
+		return "crc64"
+	case CheckSHA256:
+		return "sha256"
+	}
+	return "unknown"
+}
+
+// newHash returns the hash of c, or nil for CheckNone.
+func (c Check) newHash() (hash.Hash, error) {
+	switch c {
+	case CheckNone:
+		return nil, nil
+	case CheckCRC32:
+		return crc32.NewIEEE(), nil
+	case CheckCRC64:
+		return crc64.New(crc64.MakeTable(crc64.ECMA)), nil
+	case CheckSHA256:
+		return sha256.New(), nil
+	}
+	return nil, fmt.Errorf("xz: unknown check %#x", byte(c))
+}
+
+// WriterConfig configures a Writer.
+type WriterConfig struct {
+	// Level is from MinLevel (fastest) to MaxLevel (smallest), or 0 for
+	// DefaultLevel.
+	Level int
+	// DictSize is the LZMA2 dictionary size, which is also the memory a
+	// decompressor needs for it, or 0 for the level's, 1 MiB to 64 MiB.
+	DictSize int
+	// Check is the integrity check; the zero value is CheckNone.
+	Check Check
+	// BCJ is the filter applied before LZMA2, if any.
+	BCJ BCJ
+}
+
+// KernelConfig is the configuration the kernel's documentation recommends
+// for an initramfs, the equivalent of xz --check=crc32 --lzma2=dict=1MiB:
+// the kernel's decompressor doesn't know the other checks, and allocates
+// the dictionary while the kernel boots.
+var KernelConfig = WriterConfig{DictSize: 1 << 20, Check: CheckCRC32}
+
+var (
+	streamMagic = []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}
+	footerMagic = []byte{'Y', 'Z'}
+)
+
+// filterLZMA2 is the filter ID of LZMA2.
+const filterLZMA2 = 0x21
+
+// Writer compresses data into a single xz stream. Its output depends only
+// on the input and the configuration.
+type Writer struct {
+	w   io.Writer
+	cfg WriterConfig
+	err error
+
+	started bool
+	closed  bool
+
+	enc    *lzma2Encoder
+	check  hash.Hash
+	bcj    bcjEncoder
+	raw    []byte // input the BCJ filter holds back
+	bcjPos uint32 // position in the input of raw[0]
+
+	headerSize int   // of the block header
+	size       int64 // uncompressed bytes
+	csize      int64 // compressed bytes of the block
+	out        []byte
+}
+
+// NewWriter returns a Writer compressing to w at DefaultLevel, with a
+// CRC64 check, as xz does by default.
+func NewWriter(w io.Writer) *Writer {
+	z, _ := NewWriterConfig(w, WriterConfig{Check: CheckCRC64})
+	return z
+}
+
+// NewWriterConfig returns a Writer compressing to w as cfg says.
+func NewWriterConfig(w io.Writer, cfg WriterConfig) (*Writer, error) {
+	if cfg.Level == 0 {
+		cfg.Level = DefaultLevel
+	}
+	if cfg.Level < MinLevel || cfg.Level > MaxLevel {
+		return nil, fmt.Errorf("xz: invalid compression level %d, want %d to %d", cfg.Level, MinLevel, MaxLevel)
+	}
+	lv := levels[cfg.Level]
+	if cfg.DictSize == 0 {
+		cfg.DictSize = lv.dictSize
+	}
+	if cfg.DictSize < MinDictSize || cfg.DictSize > MaxDictSize {
+		return nil, fmt.Errorf("xz: invalid dictionary size %d, want %d to %d", cfg.DictSize, MinDictSize, MaxDictSize)
+	}
+	switch cfg.BCJ {
+	case BCJNone, BCJX86, BCJARM64:
+	default:
+		return nil, fmt.Errorf("xz: unknown BCJ filter %#x", byte(cfg.BCJ))
+	}
+	check, err := cfg.Check.newHash()
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:     w,
+		cfg:   cfg,
+		enc:   newLZMA2Encoder(lv, cfg.DictSize),
+		check: check,
+		bcj:   newBCJEncoder(cfg.BCJ),
+	}, nil
+}
+
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.closed {
+		return 0, errors.New("xz: write to closed Writer")
+	}
+	if z.err != nil {
+		return 0, z.err
+	}
+	if !z.started {
+		if z.err = z.start(); z.err != nil {
+			return 0, z.err
+		}
+	}
+	if z.check != nil {
+		z.check.Write(p)
+	}
+	z.size += int64(len(p))
+	if z.bcj != nil {
+		z.raw = append(z.raw, p...)
+		n := z.bcj.encode(z.bcjPos, z.raw)
+		z.enc.buf = append(z.enc.buf, z.raw[:n]...)
+		z.raw = z.raw[:copy(z.raw, z.raw[n:])]
+		z.bcjPos += uint32(n)
+	} else {
+		z.enc.buf = append(z.enc.buf, p...)
+	}
+	// Leave room for the match finder to look ahead of a chunk.
+	for z.enc.buffered() >= maxChunkInput+maxMatchLen {
+		if z.err = z.chunk(); z.err != nil {
+			return 0, z.err
+		}
+	}
+	return len(p), nil
+}
+
+// Close compresses the remaining input and ends the stream. It does not
+// close the underlying writer.
+func (z *Writer) Close() error {
+	if z.closed {
+		return z.err
+	}
+	z.closed = true
+	if z.err != nil {
+		return z.err
+	}
+	if z.started {
+		z.err = z.endBlock()
+	}
+	if z.err == nil {
+		z.err = z.end()
+	}
+	return z.err
+}
+
+// start writes the stream header and the block header.
+func (z *Writer) start() error {
+	z.started = true
+	hdr := z.streamFlags()
+	hdr = binary.LittleEndian.AppendUint32(hdr, crc32.ChecksumIEEE(hdr))
+	hdr = append(append([]byte{}, streamMagic...), hdr...)
+
+	// Neither size is known ahead, so the block header leaves them out.
+	block := []byte{0, 0}
+	if z.bcj != nil {
+		block[1]++
+		block = append(block, byte(z.cfg.BCJ), 0)
+	}
+	block = append(block, filterLZMA2, 1, dictSizeByte(z.cfg.DictSize))
+	for len(block)%4 != 0 {
+		block = append(block, 0)
+	}
+	block[0] = byte((len(block)+4)/4 - 1)
+	block = binary.LittleEndian.AppendUint32(block, crc32.ChecksumIEEE(block))
+	z.headerSize = len(block)
+
+	_, err := z.w.Write(append(hdr, block...))
+	return err
+}
+
+func (z *Writer) streamFlags() []byte {
+	return []byte{0, byte(z.cfg.Check)}
+}
+
+// chunk encodes and writes one LZMA2 chunk of the buffered input.
+func (z *Writer) chunk() error {
+	z.out = z.enc.chunk(z.out[:0], len(z.enc.buf))
+	z.csize += int64(len(z.out))
+	_, err := z.w.Write(z.out)
+	return err
+}
+
+// endBlock writes the rest of the input, the end of the LZMA2 data, the
+// block padding, and the check.
+func (z *Writer) endBlock() error {
+	if len(z.raw) > 0 {
+		// What the filter held back is too short to convert.
+		z.enc.buf = append(z.enc.buf, z.raw...)
+		z.raw = z.raw[:0]
+	}
+	for z.enc.buffered() > 0 {
+		if err := z.chunk(); err != nil {
+			return err
+		}
+	}
+	tail := []byte{0} // end of LZMA2
+	z.csize++
+	for n := z.csize; n%4 != 0; n++ {
+		tail = append(tail, 0)
+	}
+	switch z.cfg.Check {
+	case CheckCRC32:
+		tail = binary.LittleEndian.AppendUint32(tail, z.check.(hash.Hash32).Sum32())
+	case CheckCRC64:
+		tail = binary.LittleEndian.AppendUint64(tail, z.check.(hash.Hash64).Sum64())
+	case CheckSHA256:
+		tail = z.check.Sum(tail)
+	}
+	_, err := z.w.Write(tail)
+	return err
+}
+
+// end writes the index and the stream footer, and the stream header if
+// there was no input.
+func (z *Writer) end() error {
+	var out []byte
+	if !z.started {
+		out = append(out, streamMagic...)
+		flags := z.streamFlags()
+		out = append(out, flags...)
+		out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(flags))
+	}
+
+	index := []byte{0}
+	if z.started {
+		checkSize := map[Check]int64{CheckNone: 0, CheckCRC32: 4, CheckCRC64: 8, CheckSHA256: 32}[z.cfg.Check]
+		index = binary.AppendUvarint(index, 1)
+		index = binary.AppendUvarint(index, uint64(int64(z.headerSize)+z.csize+checkSize))
+		index = binary.AppendUvarint(index, uint64(z.size))
+	} else {
+		index = binary.AppendUvarint(index, 0)
+	}
+	for len(index)%4 != 0 {
+		index = append(index, 0)
+	}
+	index = binary.LittleEndian.AppendUint32(index, crc32.ChecksumIEEE(index))
+	out = append(out, index...)
+
+	footer := binary.LittleEndian.AppendUint32(nil, uint32(len(index)/4-1))
+	footer = append(footer, z.streamFlags()...)
+	out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(footer))
+	out = append(out, footer...)
+	out = append(out, footerMagic...)
+	_, err := z.w.Write(out)
+	return err
+}
+
+// dictSizeByte encodes the smallest dictionary size of LZMA2's properties
+// that holds n bytes: 2 or 3 times a power of two, from 4 KiB.
+func dictSizeByte(n int) byte {
+	var b byte
+	for (2|int(b&1))<<(b/2+11) < n {
+		b++
+	}
+	return b
+}
@@ -0,0 +1,93 @@
+package xz_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/xz"
+)
+
+// inputs are what the round trips compress: nothing, text, runs that
+// compress well, noise that doesn't, and a mix, with x86 calls for BCJ to
+// convert, spanning several LZMA2 chunks.
+func inputs() map[string][]byte {
+	rng := rand.New(rand.NewChaCha8([32]byte{}))
+	noise := make([]byte, 200<<10)
+	for i := range noise {
+		noise[i] = byte(rng.Uint32())
+	}
+	var mixed bytes.Buffer
+	for i := 0; mixed.Len() < 1<<20; i++ {
+		fmt.Fprintf(&mixed, "line %d of a file that repeats itself\n", i%700)
+		mixed.Write([]byte{0xe8, byte(i), byte(i >> 8), 0, 0}) // call rel32
+		mixed.Write(noise[i%1000 : i%1000+i%37])
+	}
+	return map[string][]byte{
+		"empty": nil,
+		"text":  []byte("an initramfs holds the files the kernel needs to mount the root\n"),
+		"runs":  bytes.Repeat([]byte{'a'}, 300<<10),
+		"noise": noise,
+		"mixed": mixed.Bytes(),
+	}
+}
+
+// The Writer has no reader to round-trip with, so xz reads what it writes.
+func TestRoundTrip(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz is not installed")
+	}
+	configs := map[string]xz.WriterConfig{
+		"default": {Check: xz.CheckCRC64},
+		"kernel":  xz.KernelConfig,
+		"fastest": {Level: xz.MinLevel, Check: xz.CheckCRC32},
+		"sha256":  {Level: xz.MaxLevel, DictSize: xz.MinDictSize, Check: xz.CheckSHA256},
+		"x86":     {Check: xz.CheckNone, BCJ: xz.BCJX86},
+		"arm64":   {Check: xz.CheckCRC32, BCJ: xz.BCJARM64},
+	}
+	for name, b := range inputs() {
+		for cname, cfg := range configs {
+			t.Run(name+"/"+cname, func(t *testing.T) {
+				var buf bytes.Buffer
+				z, err := xz.NewWriterConfig(&buf, cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := z.Write(b); err != nil {
+					t.Fatal(err)
+				}
+				if err := z.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				cmd := exec.Command("xz", "-d", "-c")
+				cmd.Stdin = &buf
+				var stderr strings.Builder
+				cmd.Stderr = &stderr
+				got, err := cmd.Output()
+				if err != nil {
+					t.Fatalf("xz -d: %v: %s", err, stderr.String())
+				}
+				if !bytes.Equal(got, b) {
+					t.Errorf("xz -d gave %d bytes differing from the %d compressed", len(got), len(b))
+				}
+			})
+		}
+	}
+}
+
+func TestWriterConfigRejectsInvalid(t *testing.T) {
+	for _, cfg := range []xz.WriterConfig{
+		{Level: xz.MaxLevel + 1},
+		{DictSize: xz.MinDictSize - 1},
+		{Check: 0x02},
+		{BCJ: 0x7f},
+	} {
+		if _, err := xz.NewWriterConfig(new(bytes.Buffer), cfg); err == nil {
+			t.Errorf("NewWriterConfig(%+v) succeeded", cfg)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// bitsAt returns the n bits (n <= 56) of b starting at bit lo, counting
+// from the least significant bit of b[0]. Bits beyond b read as zero.
+func bitsAt(b []byte, lo int, n uint) uint64 {
+	if n == 0 {
+		return 0
+	}
+	i, sh := lo>>3, uint(lo&7)
+	var v uint64
+	if i+8 <= len(b) {
+		v = binary.LittleEndian.Uint64(b[i:])
+	} else {
+		for j := 0; j < 8 && i+j < len(b); j++ {
+			v |= uint64(b[i+j]) << (8 * j)
+		}
+	}
+	return v >> sh & (1<<n - 1)
+}
+
+// backReader reads a bitstream backwards: the stream ends with a 1 bit
+// marking its end, and the bits before it are read from the last towards
+// the first, as zstd's FSE and Huffman encoders write them. Reading past
+// the start yields zeros and leaves pos negative.
+type backReader struct {
+	b   []byte
+	pos int // number of unread bits
+}
+
+func newBackReader(b []byte) (*backReader, error) {
+	if len(b) == 0 || b[len(b)-1] == 0 {
+		return nil, errCorrupt
+	}
+	return &backReader{b: b, pos: (len(b)-1)*8 + bits.Len8(b[len(b)-1]) - 1}, nil
+}
+
+func (r *backReader) peek(n uint) uint64 {
+	lo := r.pos - int(n)
+	if lo >= 0 {
+		return bitsAt(r.b, lo, n)
+	}
+	if r.pos <= 0 {
+		return 0
+	}
+	return bitsAt(r.b, 0, uint(r.pos)) << uint(-lo)
+}
+
+func (r *backReader) read(n uint) uint64 {
+	v := r.peek(n)
+	r.pos -= int(n)
+	return v
+}
+
+// bitWriter writes a bitstream least significant bit first.
+type bitWriter struct {
+	out []byte
+	acc uint64
+	n   uint
+}
+
+// add appends the low n bits (n <= 32) of v.
+func (w *bitWriter) add(v uint64, n uint) {
+	w.acc |= (v & (1<<n - 1)) << w.n
+	w.n += n
+	for w.n >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.n -= 8
+	}
+}
+
+// close ends the stream with the end marker a backReader looks for.
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc, w.n = 0, 0
+	}
+	return w.out
+}
+
+// highBit returns the index of the highest set bit of v, which must not be
+// zero.
+func highBit(v uint32) uint {
+	return uint(bits.Len32(v)) - 1
+}
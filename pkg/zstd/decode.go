@@ -0,0 +1,490 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Reader decompresses a stream of zstd frames. Skippable frames are
+// skipped, and frames are checked against their content checksum and
+// size when they carry one.
+type Reader struct {
+	r   io.Reader
+	err error
+
+	hist []byte // the frame's output, at least a window's worth of it
+	out  int    // offset in hist of the first byte not yet returned
+
+	inFrame  bool
+	window   int
+	checksum bool
+	size     int64 // content size from the frame header, or -1
+	total    int64 // bytes decoded in the frame
+	xxh      xxh64
+
+	reps        [3]int
+	huff        *huffTable
+	ll, of, ml  *fseTable
+	block, lits []byte
+}
+
+// NewReader returns a Reader decompressing r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+func (z *Reader) Read(p []byte) (int, error) {
+	for z.out == len(z.hist) {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.next()
+	}
+	n := copy(p, z.hist[z.out:])
+	z.out += n
+	return n, nil
+}
+
+// next decodes the next block, starting a new frame if needed.
+func (z *Reader) next() error {
+	if !z.inFrame {
+		return z.frameHeader()
+	}
+
+	var h [3]byte
+	if _, err := io.ReadFull(z.r, h[:]); err != nil {
+		return unexpected(err)
+	}
+	v := uint32(h[0]) | uint32(h[1])<<8 | uint32(h[2])<<16
+	last, typ, size := v&1 != 0, (v>>1)&3, int(v>>3)
+
+	// Keep only a window of history once everything is returned.
+	if keep := z.window; len(z.hist) > 2*keep+maxBlockSize {
+		n := copy(z.hist, z.hist[len(z.hist)-keep:])
+		z.hist = z.hist[:n]
+		z.out = n
+	}
+	start := len(z.hist)
+
+	maxSize := min(z.window, maxBlockSize)
+	switch typ {
+	case blockRaw:
+		if size > maxSize {
+			return errCorrupt
+		}
+		z.hist = append(z.hist, make([]byte, size)...)
+		if _, err := io.ReadFull(z.r, z.hist[start:]); err != nil {
+			return unexpected(err)
+		}
+	case blockRLE:
+		if size > maxSize {
+			return errCorrupt
+		}
+		var b [1]byte
+		if _, err := io.ReadFull(z.r, b[:]); err != nil {
+			return unexpected(err)
+		}
+		for i := 0; i < size; i++ {
+			z.hist = append(z.hist, b[0])
+		}
+	case blockCompressed:
+		if size > maxSize {
+			return errCorrupt
+		}
+		if cap(z.block) < size {
+			z.block = make([]byte, size)
+		}
+		z.block = z.block[:size]
+		if _, err := io.ReadFull(z.r, z.block); err != nil {
+			return unexpected(err)
+		}
+		if err := z.decompressBlock(z.block); err != nil {
+			return err
+		}
+		if len(z.hist)-start > maxSize {
+			return errCorrupt
+		}
+	default:
+		return errCorrupt
+	}
+	z.total += int64(len(z.hist) - start)
+	if z.checksum {
+		z.xxh.Write(z.hist[start:])
+	}
+
+	if last {
+		z.inFrame = false
+		if z.size >= 0 && z.total != z.size {
+			return fmt.Errorf("zstd: frame has %d bytes, header says %d", z.total, z.size)
+		}
+		if z.checksum {
+			var b [4]byte
+			if _, err := io.ReadFull(z.r, b[:]); err != nil {
+				return unexpected(err)
+			}
+			if binary.LittleEndian.Uint32(b[:]) != uint32(z.xxh.sum()) {
+				return errors.New("zstd: content checksum mismatch")
+			}
+		}
+	}
+	return nil
+}
+
+// frameHeader reads the header of the next frame, skipping skippable
+// frames. It returns io.EOF at the end of the input.
+func (z *Reader) frameHeader() error {
+	var b [14]byte
+	n, err := io.ReadFull(z.r, b[:4])
+	if n == 0 && err == io.EOF {
+		return io.EOF
+	}
+	if err != nil {
+		return unexpected(err)
+	}
+	magic := binary.LittleEndian.Uint32(b[:])
+	if magic&skippableMagicMask == skippableMagic {
+		if _, err := io.ReadFull(z.r, b[:4]); err != nil {
+			return unexpected(err)
+		}
+		n := int64(binary.LittleEndian.Uint32(b[:]))
+		if _, err := io.CopyN(io.Discard, z.r, n); err != nil {
+			return unexpected(err)
+		}
+		return nil
+	}
+	if magic != frameMagic {
+		return errors.New("zstd: invalid frame magic")
+	}
+	if _, err := io.ReadFull(z.r, b[:1]); err != nil {
+		return unexpected(err)
+	}
+	desc := b[0]
+	fcsFlag, single, dictFlag := desc>>6, desc&0x20 != 0, desc&3
+	if desc&0x08 != 0 {
+		return errCorrupt
+	}
+	fcsLen := [4]int{0, 2, 4, 8}[fcsFlag]
+	if fcsFlag == 0 && single {
+		fcsLen = 1
+	}
+	dictLen := [4]int{0, 1, 2, 4}[dictFlag]
+	hlen := fcsLen + dictLen
+	if !single {
+		hlen++
+	}
+	h := b[:hlen]
+	if _, err := io.ReadFull(z.r, h); err != nil {
+		return unexpected(err)
+	}
+	window := 0
+	if !single {
+		exp, mant := uint(h[0]>>3), int(h[0]&7)
+		base := 1 << (10 + exp)
+		window = base + base/8*mant
+		h = h[1:]
+	}
+	var dict uint32
+	for i := dictLen - 1; i >= 0; i-- {
+		dict = dict<<8 | uint32(h[i])
+	}
+	if dict != 0 {
+		return errors.New("zstd: frames needing a dictionary are not supported")
+	}
+	h = h[dictLen:]
+	z.size = -1
+	if fcsLen > 0 {
+		var size uint64
+		for i := fcsLen - 1; i >= 0; i-- {
+			size = size<<8 | uint64(h[i])
+		}
+		if fcsLen == 2 {
+			size += 256
+		}
+		z.size = int64(size)
+		if single {
+			window = int(min(size, maxWindowSize+1))
+		}
+	}
+	if window > maxWindowSize {
+		return fmt.Errorf("zstd: window of %d bytes is too large", window)
+	}
+
+	z.inFrame = true
+	z.window = max(window, 1)
+	z.checksum = desc&0x04 != 0
+	z.xxh.reset()
+	z.total = 0
+	z.hist, z.out = z.hist[:0], 0
+	z.reps = [3]int{1, 4, 8}
+	z.huff, z.ll, z.of, z.ml = nil, nil, nil, nil
+	return nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// decompressBlock decodes a compressed block, appending to z.hist.
+func (z *Reader) decompressBlock(b []byte) error {
+	n, err := z.literals(b)
+	if err != nil {
+		return err
+	}
+	return z.sequences(b[n:])
+}
+
+// literals decodes the literals section at the start of b into z.lits and
+// returns its size.
+func (z *Reader) literals(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, errCorrupt
+	}
+	typ, sf := b[0]&3, (b[0]>>2)&3
+	if typ == litRaw || typ == litRLE {
+		var size, hlen int
+		switch sf {
+		case 0, 2:
+			size, hlen = int(b[0]>>3), 1
+		case 1:
+			if len(b) < 2 {
+				return 0, errCorrupt
+			}
+			size, hlen = int(b[0]>>4)|int(b[1])<<4, 2
+		case 3:
+			if len(b) < 3 {
+				return 0, errCorrupt
+			}
+			size, hlen = int(b[0]>>4)|int(b[1])<<4|int(b[2])<<12, 3
+		}
+		if size > maxBlockSize {
+			return 0, errCorrupt
+		}
+		if typ == litRaw {
+			if hlen+size > len(b) {
+				return 0, errCorrupt
+			}
+			z.lits = append(z.lits[:0], b[hlen:hlen+size]...)
+			return hlen + size, nil
+		}
+		if hlen+1 > len(b) {
+			return 0, errCorrupt
+		}
+		z.lits = z.lits[:0]
+		for i := 0; i < size; i++ {
+			z.lits = append(z.lits, b[hlen])
+		}
+		return hlen + 1, nil
+	}
+
+	// Huffman-coded literals.
+	var hlen, bitsPer int
+	streams := 4
+	switch sf {
+	case 0:
+		hlen, bitsPer, streams = 3, 10, 1
+	case 1:
+		hlen, bitsPer = 3, 10
+	case 2:
+		hlen, bitsPer = 4, 14
+	case 3:
+		hlen, bitsPer = 5, 18
+	}
+	if len(b) < hlen {
+		return 0, errCorrupt
+	}
+	var v uint64
+	for i := hlen - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	v >>= 4
+	mask := uint64(1)<<bitsPer - 1
+	regen, comp := int(v&mask), int(v>>bitsPer&mask)
+	if regen > maxBlockSize || hlen+comp > len(b) {
+		return 0, errCorrupt
+	}
+	src := b[hlen : hlen+comp]
+	if typ == litCompressed {
+		t, n, err := readHuffTable(src)
+		if err != nil {
+			return 0, err
+		}
+		z.huff = t
+		src = src[n:]
+	} else if z.huff == nil {
+		return 0, errCorrupt
+	}
+	if cap(z.lits) < regen {
+		z.lits = make([]byte, regen)
+	}
+	z.lits = z.lits[:regen]
+	var err error
+	if streams == 1 {
+		err = z.huff.decode(z.lits, src)
+	} else {
+		err = z.huff.decode4(z.lits, src)
+	}
+	return hlen + comp, err
+}
+
+var (
+	llPredefined = newFSETable(llDefault, llDefaultLog)
+	mlPredefined = newFSETable(mlDefault, mlDefaultLog)
+	ofPredefined = newFSETable(ofDefault, ofDefaultLog)
+)
+
+// sequences decodes the sequences section b and executes the sequences,
+// appending the block's output to z.hist.
+func (z *Reader) sequences(b []byte) error {
+	if len(b) == 0 {
+		return errCorrupt
+	}
+	nseq := int(b[0])
+	switch {
+	case nseq == 0:
+		z.hist = append(z.hist, z.lits...)
+		return nil
+	case nseq < 128:
+		b = b[1:]
+	case nseq < 255:
+		if len(b) < 2 {
+			return errCorrupt
+		}
+		nseq = (nseq-128)<<8 | int(b[1])
+		b = b[2:]
+	default:
+		if len(b) < 3 {
+			return errCorrupt
+		}
+		nseq = int(b[1]) | int(b[2])<<8 + 0x7F00
+		b = b[3:]
+	}
+	if len(b) == 0 {
+		return errCorrupt
+	}
+	modes := b[0]
+	if modes&3 != 0 {
+		return errCorrupt
+	}
+	b = b[1:]
+	var err error
+	if z.ll, b, err = readSeqTable(b, modes>>6, z.ll, llPredefined, llMaxSymbol, llMaxLog); err != nil {
+		return err
+	}
+	if z.of, b, err = readSeqTable(b, modes>>4&3, z.of, ofPredefined, ofMaxSymbol, ofMaxLog); err != nil {
+		return err
+	}
+	if z.ml, b, err = readSeqTable(b, modes>>2&3, z.ml, mlPredefined, mlMaxSymbol, mlMaxLog); err != nil {
+		return err
+	}
+
+	br, err := newBackReader(b)
+	if err != nil {
+		return err
+	}
+	ll, of, ml := br.read(z.ll.log), br.read(z.of.log), br.read(z.ml.log)
+	lits := z.lits
+	for i := 0; i < nseq; i++ {
+		lle, ofe, mle := z.ll.e[ll], z.of.e[of], z.ml.e[ml]
+		if lle.sym > llMaxSymbol || mle.sym > mlMaxSymbol || ofe.sym > ofMaxSymbol {
+			return errCorrupt
+		}
+		ofVal := 1<<ofe.sym + int(br.read(uint(ofe.sym)))
+		matchLen := int(mlBase[mle.sym]) + int(br.read(uint(mlBits[mle.sym])))
+		litLen := int(llBase[lle.sym]) + int(br.read(uint(llBits[lle.sym])))
+		if br.pos < 0 {
+			return errCorrupt
+		}
+		offset := z.offset(ofVal, litLen == 0)
+
+		if litLen > len(lits) {
+			return errCorrupt
+		}
+		z.hist = append(z.hist, lits[:litLen]...)
+		lits = lits[litLen:]
+		src := len(z.hist) - offset
+		if offset <= 0 || src < 0 || offset > z.window {
+			return errCorrupt
+		}
+		if offset >= matchLen {
+			z.hist = append(z.hist, z.hist[src:src+matchLen]...)
+		} else {
+			for j := 0; j < matchLen; j++ {
+				z.hist = append(z.hist, z.hist[src+j])
+			}
+		}
+
+		if i < nseq-1 {
+			ll = uint64(lle.base) + br.read(uint(lle.nbBits))
+			ml = uint64(mle.base) + br.read(uint(mle.nbBits))
+			of = uint64(ofe.base) + br.read(uint(ofe.nbBits))
+		}
+	}
+	if br.pos != 0 {
+		return errCorrupt
+	}
+	z.hist = append(z.hist, lits...)
+	return nil
+}
+
+// offset turns an offset value into a match offset, updating the repeat
+// offsets.
+func (z *Reader) offset(v int, ll0 bool) int {
+	if v > 3 {
+		z.reps[2], z.reps[1], z.reps[0] = z.reps[1], z.reps[0], v-3
+		return v - 3
+	}
+	return updateReps(&z.reps, v, ll0)
+}
+
+// updateReps resolves the repeat offset value v (1 to 3) and updates reps
+// the way decoders must.
+func updateReps(reps *[3]int, v int, ll0 bool) int {
+	idx := v - 1
+	if ll0 {
+		idx++
+	}
+	var off int
+	switch idx {
+	case 0:
+		return reps[0]
+	case 3:
+		off = reps[0] - 1
+	default:
+		off = reps[idx]
+	}
+	if idx != 1 {
+		reps[2] = reps[1]
+	}
+	reps[1], reps[0] = reps[0], off
+	return off
+}
+
+// readSeqTable reads the decoding table of a sequence code in the given
+// mode from the start of b, and returns it and the rest of b.
+func readSeqTable(b []byte, mode byte, prev, predefined *fseTable, maxSym int, maxLog uint) (*fseTable, []byte, error) {
+	switch mode {
+	case modePredefined:
+		return predefined, b, nil
+	case modeRLE:
+		if len(b) == 0 || int(b[0]) > maxSym {
+			return nil, nil, errCorrupt
+		}
+		return rleTable(b[0]), b[1:], nil
+	case modeFSE:
+		norm, log, n, err := readNCount(b, maxSym, maxLog)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newFSETable(norm, log), b[n:], nil
+	default:
+		if prev == nil {
+			return nil, nil, errCorrupt
+		}
+		return prev, b, nil
+	}
+}
@@ -0,0 +1,96 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// dictMagic starts a dictionary in the format zstd --train writes.
+const dictMagic = 0xEC30A437
+
+// Dict is a compression dictionary: content that the frames compressed
+// with it refer back to as if it came before them, which pays off for
+// small inputs resembling it. Decompressing such a frame takes the same
+// dictionary.
+type Dict struct {
+	id      uint32
+	content []byte
+	reps    [3]int
+}
+
+// ParseDict parses a dictionary as zstd --train writes it, with its ID,
+// entropy tables, and repeat offsets, or, like the reference tools, takes
+// b as raw content if it doesn't start with the dictionary magic. The
+// entropy tables are checked but not used: the Writer describes its own
+// in every block.
+func ParseDict(b []byte) (*Dict, error) {
+	if len(b) < 8 || binary.LittleEndian.Uint32(b) != dictMagic {
+		if len(b) == 0 {
+			return nil, errors.New("zstd: empty dictionary")
+		}
+		return &Dict{content: b, reps: [3]int{1, 4, 8}}, nil
+	}
+	d := &Dict{id: binary.LittleEndian.Uint32(b[4:])}
+	if d.id == 0 {
+		return nil, errors.New("zstd: dictionary ID 0 is reserved for raw content")
+	}
+	rest := b[8:]
+	_, n, err := readHuffTable(rest)
+	if err != nil {
+		return nil, fmt.Errorf("zstd: dictionary literals table: %w", err)
+	}
+	rest = rest[n:]
+	for _, t := range []struct {
+		name   string
+		maxSym int
+		maxLog uint
+	}{
+		{"offsets", ofMaxSymbol, ofMaxLog},
+		{"match lengths", mlMaxSymbol, mlMaxLog},
+		{"literal lengths", llMaxSymbol, llMaxLog},
+	} {
+		_, _, n, err := readNCount(rest, t.maxSym, t.maxLog)
+		if err != nil {
+			return nil, fmt.Errorf("zstd: dictionary %s table: %w", t.name, err)
+		}
+		rest = rest[n:]
+	}
+	if len(rest) < 12 {
+		return nil, fmt.Errorf("zstd: dictionary ends before its repeat offsets: %w", io.ErrUnexpectedEOF)
+	}
+	d.content = rest[12:]
+	for i := range d.reps {
+		r := int(binary.LittleEndian.Uint32(rest[4*i:]))
+		if r == 0 || r > len(d.content) {
+			return nil, fmt.Errorf("zstd: dictionary repeat offset %d is out of its content", r)
+		}
+		d.reps[i] = r
+	}
+	return d, nil
+}
+
+// ID returns the ID of d, which the frames compressed with it carry, or 0
+// for raw content.
+func (d *Dict) ID() uint32 { return d.id }
+
+// NewWriterDict returns a Writer compressing to w at level with the
+// dictionary d.
+func NewWriterDict(w io.Writer, level int, d *Dict) (*Writer, error) {
+	z, err := NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	// Only the last window's worth of the content is in reach; it is put
+	// before the input, which it can then be matched against.
+	content := d.content
+	if window := 1 << z.p.windowLog; len(content) > window {
+		content = content[len(content)-window:]
+	}
+	z.buf = append(z.buf, content...)
+	z.pending = len(z.buf)
+	z.reps = d.reps
+	z.dictID = d.id
+	return z, nil
+}
@@ -0,0 +1,119 @@
+package zstd_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/zstd"
+)
+
+// samples are small files alike enough for a dictionary to pay off.
+func samples() [][]byte {
+	var s [][]byte
+	for i := 0; i < 400; i++ {
+		s = append(s, []byte(fmt.Sprintf(`{"name": "package-%d", "version": "1.%d.%d", "license": "Apache-2.0", "description": "a package of the base image, number %d"}`+"\n", i, i%17, i%5, i)))
+	}
+	return s
+}
+
+// train writes a dictionary of samples with zstd --train to dir.
+func train(t *testing.T, dir string) string {
+	t.Helper()
+	var names []string
+	for i, b := range samples() {
+		name := filepath.Join(dir, fmt.Sprintf("sample%d", i))
+		if err := os.WriteFile(name, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	dict := filepath.Join(dir, "dict")
+	out, err := exec.Command("zstd", append([]string{"-q", "--train", "--maxdict=4096", "-o", dict}, names...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("zstd --train: %v: %s", err, out)
+	}
+	return dict
+}
+
+func compressDict(t *testing.T, b []byte, d *zstd.Dict) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	z, err := zstd.NewWriterDict(&buf, zstd.DefaultLevel, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := z.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// The reference decoder reads what NewWriterDict writes with a trained
+// dictionary and with raw content, given the same dictionary.
+func TestDictReferenceDecoder(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd is not installed")
+	}
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "raw")
+	if err := os.WriteFile(raw, bytes.Join(samples()[:50], nil), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	input := []byte(`{"name": "package-1000", "version": "1.3.0", "license": "Apache-2.0", "description": "a package of the base image, number 1000"}` + "\n")
+
+	for name, file := range map[string]string{"trained": train(t, dir), "raw": raw} {
+		t.Run(name, func(t *testing.T) {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := zstd.ParseDict(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (d.ID() != 0) != (name == "trained") {
+				t.Errorf("ID() = %d", d.ID())
+			}
+			z := compressDict(t, input, d)
+			if plain := compress(t, input, zstd.DefaultLevel); len(z) >= len(plain) {
+				t.Errorf("compressed to %d bytes with the dictionary, %d without", len(z), len(plain))
+			}
+
+			cmd := exec.Command("zstd", "-d", "-c", "-D", file)
+			cmd.Stdin = bytes.NewReader(z)
+			var stderr strings.Builder
+			cmd.Stderr = &stderr
+			got, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("zstd -d -D: %v: %s", err, stderr.String())
+			}
+			if !bytes.Equal(got, input) {
+				t.Errorf("zstd -d -D gave %q, want %q", got, input)
+			}
+		})
+	}
+}
+
+func TestParseDictRejects(t *testing.T) {
+	header := func(id uint32) []byte {
+		return binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, 0xEC30A437), id)
+	}
+	for name, b := range map[string][]byte{
+		"empty":       nil,
+		"reserved ID": append(header(0), make([]byte, 64)...),
+		"truncated":   append(header(7), 0x80),
+	} {
+		if _, err := zstd.ParseDict(b); err == nil {
+			t.Errorf("ParseDict of the %s dictionary succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,552 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+// Compression levels accepted by NewWriterLevel.
+const (
+	MinLevel     = 1
+	MaxLevel     = 19
+	DefaultLevel = 3
+)
+
+// params tune the match finder for a level.
+type params struct {
+	windowLog uint
+	hashLog   uint
+	depth     int  // hash chain candidates tried per position
+	lazy      bool // whether to try a longer match one byte later
+}
+
+var levels = [MaxLevel + 1]params{
+	1:  {19, 16, 2, false},
+	2:  {20, 17, 3, false},
+	3:  {21, 17, 4, true},
+	4:  {21, 18, 8, true},
+	5:  {21, 18, 16, true},
+	6:  {22, 19, 24, true},
+	7:  {22, 19, 32, true},
+	8:  {22, 19, 48, true},
+	9:  {22, 20, 64, true},
+	10: {22, 20, 96, true},
+	11: {22, 20, 128, true},
+	12: {22, 20, 160, true},
+	13: {23, 20, 192, true},
+	14: {23, 20, 256, true},
+	15: {23, 20, 320, true},
+	16: {23, 20, 384, true},
+	17: {23, 20, 512, true},
+	18: {23, 20, 768, true},
+	19: {23, 20, 1024, true},
+}
+
+// minMatch is the shortest match the encoder emits.
+const minMatch = 4
+
+// Writer compresses data into a single zstd frame with a content
+// checksum. Its output depends only on the input and the level.
+type Writer struct {
+	w   io.Writer
+	p   params
+	err error
+
+	started bool
+	closed  bool
+
+	// buf holds the window of history followed by input not yet
+	// compressed, which starts at buf[pending]. base is the position of
+	// buf[0] in the whole input.
+	buf     []byte
+	base    int
+	pending int
+	next    int // position of the next byte to add to the hash chains
+
+	head  []uint32 // by hash: position+1 of the latest occurrence
+	chain []uint32 // by position modulo the window: the previous one
+
+	reps   [3]int
+	xxh    xxh64
+	out    []byte
+	dictID uint32 // of the dictionary of NewWriterDict, if any
+}
+
+// NewWriter returns a Writer compressing to w at DefaultLevel.
+func NewWriter(w io.Writer) *Writer {
+	z, _ := NewWriterLevel(w, DefaultLevel)
+	return z
+}
+
+// NewWriterLevel returns a Writer compressing to w at level, from
+// MinLevel (fastest) to MaxLevel (smallest).
+func NewWriterLevel(w io.Writer, level int) (*Writer, error) {
+	if level < MinLevel || level > MaxLevel {
+		return nil, fmt.Errorf("zstd: invalid compression level %d, want %d to %d", level, MinLevel, MaxLevel)
+	}
+	p := levels[level]
+	z := &Writer{
+		w:     w,
+		p:     p,
+		head:  make([]uint32, 1<<p.hashLog),
+		chain: make([]uint32, 1<<p.windowLog),
+		reps:  [3]int{1, 4, 8},
+	}
+	z.xxh.reset()
+	return z, nil
+}
+
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.closed {
+		return 0, errors.New("zstd: write to closed Writer")
+	}
+	if z.err != nil {
+		return 0, z.err
+	}
+	z.xxh.Write(p)
+	z.buf = append(z.buf, p...)
+	for len(z.buf)-z.pending > maxBlockSize {
+		if z.err = z.block(z.pending+maxBlockSize, false); z.err != nil {
+			return 0, z.err
+		}
+	}
+	return len(p), nil
+}
+
+// Close compresses the remaining input and ends the frame. It does not
+// close the underlying writer.
+func (z *Writer) Close() error {
+	if z.closed {
+		return z.err
+	}
+	z.closed = true
+	if z.err != nil {
+		return z.err
+	}
+	if z.err = z.block(len(z.buf), true); z.err != nil {
+		return z.err
+	}
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], uint32(z.xxh.sum()))
+	_, z.err = z.w.Write(sum[:])
+	return z.err
+}
+
+// block compresses buf[pending:end] as one block and writes it.
+func (z *Writer) block(end int, last bool) error {
+	z.out = z.out[:0]
+	if !z.started {
+		z.started = true
+		z.out = binary.LittleEndian.AppendUint32(z.out, frameMagic)
+		switch {
+		case z.dictID == 0:
+			z.out = append(z.out, 0x04, byte(z.p.windowLog-10)<<3) // checksum, window size
+		case z.dictID < 1<<8:
+			z.out = append(z.out, 0x05, byte(z.p.windowLog-10)<<3, byte(z.dictID))
+		case z.dictID < 1<<16:
+			z.out = append(z.out, 0x06, byte(z.p.windowLog-10)<<3)
+			z.out = binary.LittleEndian.AppendUint16(z.out, uint16(z.dictID))
+		default:
+			z.out = append(z.out, 0x07, byte(z.p.windowLog-10)<<3)
+			z.out = binary.LittleEndian.AppendUint32(z.out, z.dictID)
+		}
+	}
+
+	src := z.buf[z.pending:end]
+	var lastBit uint32
+	if last {
+		lastBit = 1
+	}
+	switch {
+	case len(src) > 0 && allSame(src):
+		z.out = appendBlockHeader(z.out, lastBit|blockRLE<<1, len(src))
+		z.out = append(z.out, src[0])
+	default:
+		reps := z.reps
+		lits, seqs := z.parse(z.pending, end, &reps)
+		hdr := len(z.out)
+		z.out = appendBlockHeader(z.out, 0, 0)
+		z.out = encodeLiterals(z.out, lits)
+		z.out = encodeSequences(z.out, seqs)
+		if n := len(z.out) - hdr - 3; n < len(src) {
+			putBlockHeader(z.out[hdr:], lastBit|blockCompressed<<1, n)
+			z.reps = reps
+		} else {
+			z.out = appendBlockHeader(z.out[:hdr], lastBit|blockRaw<<1, len(src))
+			z.out = append(z.out, src...)
+		}
+	}
+	if _, err := z.w.Write(z.out); err != nil {
+		return err
+	}
+
+	z.pending = end
+	if window := 1 << z.p.windowLog; z.pending > window+maxBlockSize {
+		drop := z.pending - window
+		n := copy(z.buf, z.buf[drop:])
+		z.buf = z.buf[:n]
+		z.base += drop
+		z.pending -= drop
+	}
+	return nil
+}
+
+func appendBlockHeader(out []byte, flags uint32, size int) []byte {
+	v := flags | uint32(size)<<3
+	return append(out, byte(v), byte(v>>8), byte(v>>16))
+}
+
+func putBlockHeader(b []byte, flags uint32, size int) {
+	v := flags | uint32(size)<<3
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+func allSame(b []byte) bool {
+	for _, c := range b[1:] {
+		if c != b[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// seq is a sequence: litLen literals, then matchLen bytes copied from
+// earlier output, with the offset coded as offVal (1 to 3 for a repeat
+// offset, the offset + 3 otherwise).
+type seq struct {
+	litLen, matchLen, offVal uint32
+}
+
+func (z *Writer) hash(i int) uint32 {
+	return binary.LittleEndian.Uint32(z.buf[i:]) * 2654435761 >> (32 - z.p.hashLog)
+}
+
+// insertTo adds the positions before buffer index i to the hash chains.
+func (z *Writer) insertTo(i int) {
+	mask := 1<<z.p.windowLog - 1
+	z.next = max(z.next, z.base)
+	for ; z.next < z.base+i && z.next-z.base+minMatch <= len(z.buf); z.next++ {
+		h := z.hash(z.next - z.base)
+		z.chain[z.next&mask] = z.head[h]
+		z.head[h] = uint32(z.next + 1)
+	}
+}
+
+// find returns the longest match for buffer index i that ends by end, if
+// one of at least minMatch bytes is found.
+func (z *Writer) find(i, end int) (length, offset int) {
+	pos := z.base + i
+	mask := 1<<z.p.windowLog - 1
+	window := 1 << z.p.windowLog
+	best, bestOff := minMatch-1, 0
+	cand := z.head[z.hash(i)]
+	for d := z.p.depth; d > 0 && cand != 0; d-- {
+		dist := int(uint32(pos+1) - cand)
+		if dist <= 0 || dist >= window || dist > i {
+			break
+		}
+		j := i - dist
+		if z.buf[j+best] == z.buf[i+best] {
+			if n := matchLen(z.buf[j:], z.buf[i:end]); n > best {
+				best, bestOff = n, dist
+				if i+n == end {
+					break
+				}
+			}
+		}
+		cand = z.chain[(pos-dist)&mask]
+	}
+	if bestOff == 0 {
+		return 0, 0
+	}
+	return best, bestOff
+}
+
+// matchLen returns the length of the common prefix of a and b, with
+// len(a) >= len(b).
+func matchLen(a, b []byte) int {
+	n := 0
+	for len(b)-n >= 8 {
+		if x := binary.LittleEndian.Uint64(a[n:]) ^ binary.LittleEndian.Uint64(b[n:]); x != 0 {
+			return n + bits.TrailingZeros64(x)/8
+		}
+		n += 8
+	}
+	for n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// parse finds the sequences of buf[start:end]. It returns the literals and
+// sequences, updating reps as the decoder will.
+func (z *Writer) parse(start, end int, reps *[3]int) ([]byte, []seq) {
+	var lits []byte
+	var seqs []seq
+	anchor := start
+	for i := start; i+minMatch <= end; {
+		z.insertTo(i)
+		ml, off := z.find(i, end)
+		if r := reps[0]; i-anchor > 0 && r <= i && r < 1<<z.p.windowLog {
+			if n := matchLen(z.buf[i-r:], z.buf[i:end]); n >= minMatch && n >= ml {
+				ml, off = n, r
+			}
+		}
+		if ml == 0 {
+			// Step faster through data that doesn't compress.
+			i += 1 + (i-anchor)>>8
+			continue
+		}
+		if z.p.lazy {
+			for i+1+minMatch <= end {
+				z.insertTo(i + 1)
+				ml2, off2 := z.find(i+1, end)
+				if ml2 == 0 || ml2*4-int(highBit(uint32(off2+1))) <= ml*4-int(highBit(uint32(off+1)))+4 {
+					break
+				}
+				i, ml, off = i+1, ml2, off2
+			}
+		}
+
+		litLen := i - anchor
+		lits = append(lits, z.buf[anchor:i]...)
+		seqs = append(seqs, seq{litLen: uint32(litLen), matchLen: uint32(ml), offVal: uint32(encodeOffset(off, litLen == 0, reps))})
+		i += ml
+		anchor = i
+	}
+	lits = append(lits, z.buf[anchor:end]...)
+	return lits, seqs
+}
+
+// encodeOffset returns the offset value coding off and updates reps.
+func encodeOffset(off int, ll0 bool, reps *[3]int) int {
+	for v := 1; v <= 3; v++ {
+		r := *reps
+		if updateReps(&r, v, ll0) == off {
+			*reps = r
+			return v
+		}
+	}
+	reps[2], reps[1], reps[0] = reps[1], reps[0], off
+	return off + 3
+}
+
+// encodeLiterals appends the literals section for lits to out.
+func encodeLiterals(out, lits []byte) []byte {
+	n := len(lits)
+	raw := func() []byte {
+		out = appendLiteralsHeader(out, litRaw, n)
+		return append(out, lits...)
+	}
+	switch {
+	case n > 1 && allSame(lits):
+		out = appendLiteralsHeader(out, litRLE, n)
+		return append(out, lits[0])
+	case n < 64:
+		return raw()
+	}
+
+	var counts [256]int
+	for _, c := range lits {
+		counts[c]++
+	}
+	code, ok := newHuffCode(&counts)
+	if !ok {
+		return raw()
+	}
+	body, ok := code.writeTable(nil)
+	if !ok {
+		return raw()
+	}
+	streams := 4
+	if n < 256 {
+		streams = 1
+		body = code.encode(body, lits)
+	} else {
+		jump := len(body)
+		body = append(body, 0, 0, 0, 0, 0, 0)
+		seg := (n + 3) / 4
+		for i := 0; i < 4; i++ {
+			s := len(body)
+			body = code.encode(body, lits[i*seg:min((i+1)*seg, n)])
+			if i < 3 {
+				if len(body)-s > 0xFFFF {
+					return raw()
+				}
+				binary.LittleEndian.PutUint16(body[jump+2*i:], uint16(len(body)-s))
+			}
+		}
+	}
+
+	var hdr []byte
+	comp := len(body)
+	switch size := max(n, comp); {
+	case streams == 1 && size <= 1023:
+		hdr = putUint(uint64(litCompressed)|uint64(n)<<4|uint64(comp)<<14, 3)
+	case streams == 4 && size <= 1023:
+		hdr = putUint(uint64(litCompressed)|1<<2|uint64(n)<<4|uint64(comp)<<14, 3)
+	case streams == 4 && size <= 16383:
+		hdr = putUint(uint64(litCompressed)|2<<2|uint64(n)<<4|uint64(comp)<<18, 4)
+	case streams == 4 && size <= 262143:
+		hdr = putUint(uint64(litCompressed)|3<<2|uint64(n)<<4|uint64(comp)<<22, 5)
+	default:
+		return raw()
+	}
+	if len(hdr)+comp >= n+3 {
+		return raw()
+	}
+	out = append(out, hdr...)
+	return append(out, body...)
+}
+
+func putUint(v uint64, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(v >> (8 * i))
+	}
+	return b
+}
+
+// appendLiteralsHeader appends the header of a raw or RLE literals section.
+func appendLiteralsHeader(out []byte, typ byte, n int) []byte {
+	switch {
+	case n < 32:
+		return append(out, typ|byte(n)<<3)
+	case n < 4096:
+		return append(out, typ|1<<2|byte(n)<<4, byte(n>>4))
+	default:
+		return append(out, typ|3<<2|byte(n)<<4, byte(n>>4), byte(n>>12))
+	}
+}
+
+// seqCodes holds the codes and extra bits of a sequence.
+type seqCodes struct {
+	ll, ml, of       uint8
+	llExtra, mlExtra uint32
+	ofExtra          uint32
+	llNbits, mlNbits uint8
+}
+
+func codeFor(base []uint32, v uint32) uint8 {
+	return uint8(sort.Search(len(base), func(i int) bool { return base[i] > v }) - 1)
+}
+
+// encodeSequences appends the sequences section for seqs to out.
+func encodeSequences(out []byte, seqs []seq) []byte {
+	n := len(seqs)
+	switch {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7F00:
+		out = append(out, byte(n>>8+128), byte(n))
+	default:
+		out = append(out, 255, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+	if n == 0 {
+		return out
+	}
+
+	codes := make([]seqCodes, n)
+	ll, ml, of := make([]uint8, n), make([]uint8, n), make([]uint8, n)
+	for i, s := range seqs {
+		c := &codes[i]
+		c.ll = codeFor(llBase[:], s.litLen)
+		c.llExtra, c.llNbits = s.litLen-llBase[c.ll], llBits[c.ll]
+		c.ml = codeFor(mlBase[:], s.matchLen)
+		c.mlExtra, c.mlNbits = s.matchLen-mlBase[c.ml], mlBits[c.ml]
+		c.of = uint8(highBit(s.offVal))
+		c.ofExtra = s.offVal - 1<<c.of
+		ll[i], ml[i], of[i] = c.ll, c.ml, c.of
+	}
+
+	modes := len(out)
+	out = append(out, 0)
+	var llEnc, ofEnc, mlEnc *fseEncoder
+	var m byte
+	m, out, llEnc = chooseTable(out, ll, llMaxLog, llDefault, llDefaultLog)
+	out[modes] |= m << 6
+	m, out, ofEnc = chooseTable(out, of, ofMaxLog, ofDefault, ofDefaultLog)
+	out[modes] |= m << 4
+	m, out, mlEnc = chooseTable(out, ml, mlMaxLog, mlDefault, mlDefaultLog)
+	out[modes] |= m << 2
+
+	w := bitWriter{out: out}
+	var llS, ofS, mlS fseState
+	last := codes[n-1]
+	initState(&mlS, mlEnc, last.ml)
+	initState(&ofS, ofEnc, last.of)
+	initState(&llS, llEnc, last.ll)
+	w.add(uint64(last.llExtra), uint(last.llNbits))
+	w.add(uint64(last.mlExtra), uint(last.mlNbits))
+	w.add(uint64(last.ofExtra), uint(last.of))
+	for i := n - 2; i >= 0; i-- {
+		c := codes[i]
+		encodeState(&w, &ofS, c.of)
+		encodeState(&w, &mlS, c.ml)
+		encodeState(&w, &llS, c.ll)
+		w.add(uint64(c.llExtra), uint(c.llNbits))
+		w.add(uint64(c.mlExtra), uint(c.mlNbits))
+		w.add(uint64(c.ofExtra), uint(c.of))
+	}
+	flushState(&w, &mlS)
+	flushState(&w, &ofS)
+	flushState(&w, &llS)
+	return w.close()
+}
+
+// A nil encoder stands for RLE mode, where states take no bits.
+func initState(s *fseState, e *fseEncoder, sym uint8) {
+	if e != nil {
+		s.init(e, sym)
+	}
+}
+
+func encodeState(w *bitWriter, s *fseState, sym uint8) {
+	if s.e != nil {
+		s.encode(w, sym)
+	}
+}
+
+func flushState(w *bitWriter, s *fseState) {
+	if s.e != nil {
+		s.flush(w)
+	}
+}
+
+// chooseTable picks how to code a sequence code: RLE if it takes a single
+// value, the predefined table for few sequences, and otherwise a table
+// fitted to this block. It appends the table description to out.
+func chooseTable(out []byte, codes []uint8, maxLog uint, predefined []int16, predefinedLog uint) (byte, []byte, *fseEncoder) {
+	counts := make([]int, 256)
+	maxSym := 0
+	for _, c := range codes {
+		counts[c]++
+		maxSym = max(maxSym, int(c))
+	}
+	distinct := 0
+	for _, c := range counts {
+		if c > 0 {
+			distinct++
+		}
+	}
+	if distinct == 1 {
+		return modeRLE, append(out, codes[0]), nil
+	}
+	if len(codes) >= 64 {
+		log := optimalLog(len(codes), maxSym, maxLog)
+		if norm, ok := normalize(counts[:maxSym+1], len(codes), log); ok {
+			return modeFSE, writeNCount(out, norm, log), newFSEEncoder(norm, log)
+		}
+	}
+	return modePredefined, out, predefinedEncoders[&predefined[0]]
+}
+
+var predefinedEncoders = map[*int16]*fseEncoder{
+	&llDefault[0]: newFSEEncoder(llDefault, llDefaultLog),
+	&mlDefault[0]: newFSEEncoder(mlDefault, mlDefaultLog),
+	&ofDefault[0]: newFSEEncoder(ofDefault, ofDefaultLog),
+}
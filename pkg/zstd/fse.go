@@ -0,0 +1,326 @@
+package zstd
+
+// Finite State Entropy coding, used for the sequence codes and for the
+// weights of Huffman trees.
+
+// fseEntry is a state of an FSE decoding table.
+type fseEntry struct {
+	sym    uint8
+	nbBits uint8
+	base   uint16 // next state before adding the bits read
+}
+
+type fseTable struct {
+	log uint
+	e   []fseEntry
+}
+
+// tableStep is the step by which symbols are spread over a table.
+func tableStep(size int) int {
+	return size>>1 + size>>3 + 3
+}
+
+// spread lays out the symbols of norm over a table of 1<<log states, the
+// way both encoder and decoder do. Symbols of probability "less than one"
+// (-1) take the last states.
+func spread(norm []int16, log uint) []uint8 {
+	size := 1 << log
+	syms := make([]uint8, size)
+	high := size - 1
+	for s, n := range norm {
+		if n == -1 {
+			syms[high] = uint8(s)
+			high--
+		}
+	}
+	pos, step, mask := 0, tableStep(size), size-1
+	for s, n := range norm {
+		for i := 0; i < int(n); i++ {
+			syms[pos] = uint8(s)
+			pos = (pos + step) & mask
+			for pos > high {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+	return syms
+}
+
+// newFSETable builds the decoding table of a normalized distribution.
+func newFSETable(norm []int16, log uint) *fseTable {
+	size := 1 << log
+	syms := spread(norm, log)
+	next := make([]uint32, len(norm))
+	for s, n := range norm {
+		if n == -1 {
+			next[s] = 1
+		} else {
+			next[s] = uint32(n)
+		}
+	}
+	t := &fseTable{log: log, e: make([]fseEntry, size)}
+	for i, s := range syms {
+		x := next[s]
+		next[s]++
+		nb := log - highBit(x)
+		t.e[i] = fseEntry{sym: s, nbBits: uint8(nb), base: uint16(x<<nb) - uint16(size)}
+	}
+	return t
+}
+
+// rleTable is the decoding table of a single symbol repeated.
+func rleTable(sym uint8) *fseTable {
+	return &fseTable{log: 0, e: []fseEntry{{sym: sym}}}
+}
+
+// readNCount reads an FSE table description from the start of b: the
+// accuracy log and the normalized probabilities of symbols up to maxSym.
+// It returns the distribution, its log, and the number of bytes used.
+func readNCount(b []byte, maxSym int, maxLog uint) ([]int16, uint, int, error) {
+	if len(b) == 0 {
+		return nil, 0, 0, errCorrupt
+	}
+	pos := 0
+	read := func(n uint) int {
+		v := bitsAt(b, pos, n)
+		pos += int(n)
+		return int(v)
+	}
+	log := uint(read(4)) + 5
+	if log > maxLog {
+		return nil, 0, 0, errCorrupt
+	}
+	var norm []int16
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbBits := log + 1
+	for remaining > 1 {
+		if len(norm) > maxSym {
+			return nil, 0, 0, errCorrupt
+		}
+		max := 2*threshold - 1 - remaining
+		var count int
+		if v := int(bitsAt(b, pos, nbBits-1)); v < max {
+			count = v
+			pos += int(nbBits) - 1
+		} else {
+			count = read(nbBits)
+			if count >= threshold {
+				count -= max
+			}
+		}
+		count--
+		if count < 0 {
+			remaining--
+		} else {
+			remaining -= count
+		}
+		norm = append(norm, int16(count))
+		if count == 0 {
+			// Runs of zeros follow as 2-bit repeat counts, 3 meaning
+			// that another count follows.
+			for {
+				r := read(2)
+				for i := 0; i < r; i++ {
+					norm = append(norm, 0)
+				}
+				if r != 3 {
+					break
+				}
+			}
+		}
+		if remaining < threshold {
+			if remaining <= 1 {
+				break
+			}
+			nbBits = highBit(uint32(remaining)) + 1
+			threshold = 1 << (nbBits - 1)
+		}
+	}
+	n := (pos + 7) / 8
+	if remaining != 1 || len(norm) > maxSym+1 || n > len(b) {
+		return nil, 0, 0, errCorrupt
+	}
+	return norm, log, n, nil
+}
+
+// fseEncoder holds the encoding tables of a distribution.
+type fseEncoder struct {
+	log    uint
+	states []uint16
+	tt     []symbolTransform
+}
+
+type symbolTransform struct {
+	deltaFindState int32
+	deltaNbBits    uint32
+}
+
+func newFSEEncoder(norm []int16, log uint) *fseEncoder {
+	size := 1 << log
+	syms := spread(norm, log)
+	cumul := make([]int, len(norm)+1)
+	for s, n := range norm {
+		if n == -1 {
+			n = 1
+		}
+		cumul[s+1] = cumul[s] + int(n)
+	}
+	e := &fseEncoder{log: log, states: make([]uint16, size), tt: make([]symbolTransform, len(norm))}
+	for i, s := range syms {
+		e.states[cumul[s]] = uint16(size + i)
+		cumul[s]++
+	}
+	total := 0
+	for s, n := range norm {
+		switch n {
+		case 0:
+		case -1, 1:
+			e.tt[s] = symbolTransform{deltaFindState: int32(total - 1), deltaNbBits: uint32(log<<16) - uint32(size)}
+			total++
+		default:
+			maxBits := log - highBit(uint32(n-1))
+			e.tt[s] = symbolTransform{deltaFindState: int32(total - int(n)), deltaNbBits: uint32(maxBits<<16) - uint32(int(n)<<maxBits)}
+			total += int(n)
+		}
+	}
+	return e
+}
+
+// fseState is the state of an encoder.
+type fseState struct {
+	e     *fseEncoder
+	value uint32
+}
+
+// init starts encoding with sym, the last symbol of the input.
+func (s *fseState) init(e *fseEncoder, sym uint8) {
+	s.e = e
+	tt := e.tt[sym]
+	nb := (tt.deltaNbBits + 1<<15) >> 16
+	v := nb<<16 - tt.deltaNbBits
+	s.value = uint32(e.states[int32(v>>nb)+tt.deltaFindState])
+}
+
+func (s *fseState) encode(w *bitWriter, sym uint8) {
+	tt := s.e.tt[sym]
+	nb := (s.value + tt.deltaNbBits) >> 16
+	w.add(uint64(s.value), uint(nb))
+	s.value = uint32(s.e.states[int32(s.value>>nb)+tt.deltaFindState])
+}
+
+// flush writes the final state, which the decoder reads first.
+func (s *fseState) flush(w *bitWriter) {
+	w.add(uint64(s.value), s.e.log)
+}
+
+// optimalLog picks the accuracy log for coding n symbols of values up to
+// maxSym, like the reference encoder.
+func optimalLog(n int, maxSym int, maxLog uint) uint {
+	log := maxLog
+	if n > 1 {
+		if l := highBit(uint32(n-1)) - 2; l < log {
+			log = l
+		}
+	}
+	if min := highBit(uint32(maxSym)) + 2; log < min {
+		log = min
+	}
+	if log < 5 {
+		log = 5
+	}
+	if log > maxLog {
+		log = maxLog
+	}
+	return log
+}
+
+// normalize scales counts to sum to 1<<log, keeping every present symbol
+// at least 1. It reports false if the distribution can't be represented.
+func normalize(counts []int, total int, log uint) ([]int16, bool) {
+	size := 1 << log
+	norm := make([]int16, len(counts))
+	sum, largest := 0, -1
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+		n := c * size / total
+		if n < 1 {
+			n = 1
+		}
+		norm[s] = int16(n)
+		sum += n
+		if largest < 0 || c > counts[largest] {
+			largest = s
+		}
+	}
+	if largest < 0 {
+		return nil, false
+	}
+	n := int(norm[largest]) + size - sum
+	if n < 1 {
+		return nil, false
+	}
+	norm[largest] = int16(n)
+	// Trim trailing absent symbols: the description ends at the last one.
+	last := len(norm) - 1
+	for last > 0 && norm[last] == 0 {
+		last--
+	}
+	return norm[:last+1], true
+}
+
+// writeNCount appends the table description of norm to out.
+func writeNCount(out []byte, norm []int16, log uint) []byte {
+	var w bitWriter
+	w.out = out
+	w.add(uint64(log-5), 4)
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbBits := log + 1
+	prev0 := false
+	for s := 0; s < len(norm) && remaining > 1; {
+		if prev0 {
+			start := s
+			for s < len(norm) && norm[s] == 0 {
+				s++
+			}
+			for s >= start+24 {
+				start += 24
+				w.add(0xFFFF, 16)
+			}
+			for s >= start+3 {
+				start += 3
+				w.add(3, 2)
+			}
+			w.add(uint64(s-start), 2)
+		}
+		count := int(norm[s])
+		s++
+		max := 2*threshold - 1 - remaining
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		count++
+		if count >= threshold {
+			count += max
+		}
+		n := nbBits
+		if count < max {
+			n--
+		}
+		w.add(uint64(count), n)
+		prev0 = count == 1
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+	return w.out
+}
@@ -0,0 +1,382 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// maxHuffBits is the longest Huffman code zstd allows.
+const maxHuffBits = 11
+
+// huffTable decodes a Huffman-coded literals stream.
+type huffTable struct {
+	maxBits uint
+	e       []huffEntry // indexed by the next maxBits bits
+}
+
+type huffEntry struct {
+	sym uint8
+	nb  uint8
+}
+
+// readHuffTable reads a Huffman tree description from the start of b and
+// returns the decoding table and the number of bytes used.
+func readHuffTable(b []byte) (*huffTable, int, error) {
+	if len(b) == 0 {
+		return nil, 0, errCorrupt
+	}
+	var weights []uint8
+	n := int(b[0])
+	if n < 128 {
+		// The weights are FSE-coded with two interleaved states.
+		if 1+n > len(b) {
+			return nil, 0, errCorrupt
+		}
+		src := b[1 : 1+n]
+		norm, log, used, err := readNCount(src, maxHuffBits+1, 6)
+		if err != nil {
+			return nil, 0, err
+		}
+		t := newFSETable(norm, log)
+		br, err := newBackReader(src[used:])
+		if err != nil {
+			return nil, 0, err
+		}
+		s := [2]uint64{br.read(log), br.read(log)}
+		for i := 0; ; i ^= 1 {
+			if len(weights) >= 255 {
+				return nil, 0, errCorrupt
+			}
+			e := t.e[s[i]]
+			weights = append(weights, e.sym)
+			s[i] = uint64(e.base) + br.read(uint(e.nbBits))
+			if br.pos < 0 {
+				weights = append(weights, t.e[s[i^1]].sym)
+				break
+			}
+		}
+		n++
+	} else {
+		// The weights are stored directly, two per byte.
+		count := n - 127
+		n = 1 + (count+1)/2
+		if n > len(b) {
+			return nil, 0, errCorrupt
+		}
+		for i := 0; i < count; i++ {
+			w := b[1+i/2]
+			if i%2 == 0 {
+				w >>= 4
+			}
+			weights = append(weights, w&15)
+		}
+	}
+	t, err := newHuffTable(weights)
+	return t, n, err
+}
+
+// newHuffTable builds the decoding table for the given weights of all
+// symbols but the last, whose weight is implied.
+func newHuffTable(weights []uint8) (*huffTable, error) {
+	sum := 0
+	for _, w := range weights {
+		if w > maxHuffBits {
+			return nil, errCorrupt
+		}
+		if w > 0 {
+			sum += 1 << (w - 1)
+		}
+	}
+	if sum == 0 || len(weights) > 255 {
+		return nil, errCorrupt
+	}
+	maxBits := highBit(uint32(sum)) + 1
+	rest := 1<<maxBits - sum
+	if maxBits > maxHuffBits || rest&(rest-1) != 0 {
+		return nil, errCorrupt
+	}
+	weights = append(weights, uint8(highBit(uint32(rest))+1))
+
+	start := rankStarts(weights, maxBits)
+	t := &huffTable{maxBits: maxBits, e: make([]huffEntry, 1<<maxBits)}
+	for s, w := range weights {
+		if w == 0 {
+			continue
+		}
+		n := 1 << (w - 1)
+		e := huffEntry{sym: uint8(s), nb: uint8(maxBits + 1 - uint(w))}
+		for i := start[w]; i < start[w]+n; i++ {
+			t.e[i] = e
+		}
+		start[w] += n
+	}
+	return t, nil
+}
+
+// rankStarts returns where the codes of each weight start in a table of
+// 1<<maxBits entries: the longest codes, of weight 1, come first.
+func rankStarts(weights []uint8, maxBits uint) [maxHuffBits + 2]int {
+	var count, start [maxHuffBits + 2]int
+	for _, w := range weights {
+		count[w]++
+	}
+	next := 0
+	for w := 1; w <= int(maxBits); w++ {
+		start[w] = next
+		next += count[w] << (w - 1)
+	}
+	return start
+}
+
+// decode fills dst with the symbols of one stream.
+func (t *huffTable) decode(dst, src []byte) error {
+	br, err := newBackReader(src)
+	if err != nil {
+		return err
+	}
+	for i := range dst {
+		e := t.e[br.peek(t.maxBits)]
+		dst[i] = e.sym
+		br.pos -= int(e.nb)
+	}
+	if br.pos != 0 {
+		return errCorrupt
+	}
+	return nil
+}
+
+// decode4 fills dst from four streams preceded by their jump table.
+func (t *huffTable) decode4(dst, src []byte) error {
+	if len(src) < 10 || len(dst) < 6 {
+		return errCorrupt
+	}
+	var sizes [4]int
+	rest := len(src) - 6
+	for i := 0; i < 3; i++ {
+		sizes[i] = int(binary.LittleEndian.Uint16(src[2*i:]))
+		rest -= sizes[i]
+	}
+	if rest < 1 {
+		return errCorrupt
+	}
+	sizes[3] = rest
+	seg := (len(dst) + 3) / 4
+	if 3*seg > len(dst) {
+		return errCorrupt
+	}
+	src = src[6:]
+	for i, n := range sizes {
+		d := dst[i*seg:]
+		if i < 3 {
+			d = d[:seg]
+		}
+		if err := t.decode(d, src[:n]); err != nil {
+			return err
+		}
+		src = src[n:]
+	}
+	return nil
+}
+
+// huffCode is a Huffman code for compressing literals.
+type huffCode struct {
+	lens    [256]uint8
+	codes   [256]uint16
+	maxBits uint
+	last    int // the highest symbol coded, whose weight is implied
+}
+
+// newHuffCode builds a length-limited code for the symbol counts. It
+// reports false if fewer than two symbols occur.
+func newHuffCode(counts *[256]int) (*huffCode, bool) {
+	c := &huffCode{last: -1}
+	var present []int
+	for s, n := range counts {
+		if n > 0 {
+			present = append(present, s)
+			c.last = s
+		}
+	}
+	if len(present) < 2 {
+		return nil, false
+	}
+	freq := make([]int, len(present))
+	for i, s := range present {
+		freq[i] = counts[s]
+	}
+	for {
+		lens := huffLengths(freq)
+		longest := 0
+		for _, l := range lens {
+			longest = max(longest, l)
+		}
+		if longest <= maxHuffBits {
+			for i, s := range present {
+				c.lens[s] = uint8(lens[i])
+			}
+			c.maxBits = uint(longest)
+			break
+		}
+		// Flatten the distribution until the code fits.
+		for i := range freq {
+			freq[i] = (freq[i] + 1) / 2
+		}
+	}
+
+	weights := c.weights()
+	start := rankStarts(weights, c.maxBits)
+	for s, w := range weights {
+		if w > 0 {
+			c.codes[s] = uint16(start[w] >> (w - 1))
+			start[w] += 1 << (w - 1)
+		}
+	}
+	return c, true
+}
+
+// weights returns the weights of symbols 0 through c.last.
+func (c *huffCode) weights() []uint8 {
+	w := make([]uint8, c.last+1)
+	for s := range w {
+		if c.lens[s] > 0 {
+			w[s] = uint8(c.maxBits + 1 - uint(c.lens[s]))
+		}
+	}
+	return w
+}
+
+// huffLengths returns the Huffman code lengths for freq, using the
+// two-queue construction over the frequencies in ascending order.
+func huffLengths(freq []int) []int {
+	n := len(freq)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return freq[order[a]] < freq[order[b]] })
+
+	// Nodes 0..n-1 are the leaves in ascending order, n.. the internal
+	// nodes in order of creation, which is also ascending.
+	weight := make([]int, 2*n-1)
+	parent := make([]int, 2*n-1)
+	for i, o := range order {
+		weight[i] = freq[o]
+	}
+	leaf, node := 0, n
+	pick := func(next int) int {
+		if leaf < n && (node >= next || weight[leaf] <= weight[node]) {
+			leaf++
+			return leaf - 1
+		}
+		node++
+		return node - 1
+	}
+	for next := n; next < 2*n-1; next++ {
+		a := pick(next)
+		b := pick(next)
+		weight[next] = weight[a] + weight[b]
+		parent[a], parent[b] = next, next
+	}
+	depth := make([]int, 2*n-1)
+	for i := 2*n - 3; i >= 0; i-- {
+		depth[i] = depth[parent[i]] + 1
+	}
+	lens := make([]int, n)
+	for i, o := range order {
+		lens[o] = depth[i]
+	}
+	return lens
+}
+
+// encode appends one stream coding src to out.
+func (c *huffCode) encode(out, src []byte) []byte {
+	w := bitWriter{out: out}
+	for i := len(src) - 1; i >= 0; i-- {
+		s := src[i]
+		w.add(uint64(c.codes[s]), uint(c.lens[s]))
+	}
+	return w.close()
+}
+
+// writeTable appends the tree description to out, preferring FSE-coded
+// weights when they are smaller. It reports false if the weights can't be
+// described.
+func (c *huffCode) writeTable(out []byte) ([]byte, bool) {
+	weights := c.weights()[:c.last]
+	var direct []byte
+	if len(weights) <= 128 {
+		direct = append(direct, byte(127+len(weights)))
+		for i := 0; i < len(weights); i += 2 {
+			b := weights[i] << 4
+			if i+1 < len(weights) {
+				b |= weights[i+1]
+			}
+			direct = append(direct, b)
+		}
+	}
+	if fse := fseWeights(weights); fse != nil && (direct == nil || len(fse) < len(direct)) {
+		return append(out, fse...), true
+	}
+	if direct == nil {
+		return out, false
+	}
+	return append(out, direct...), true
+}
+
+// fseWeights FSE-codes the weights, or returns nil if that fails or can't
+// be read back.
+func fseWeights(weights []uint8) []byte {
+	if len(weights) < 2 {
+		return nil
+	}
+	counts := make([]int, maxHuffBits+1)
+	for _, w := range weights {
+		counts[w]++
+	}
+	log := optimalLog(len(weights), maxHuffBits, 6)
+	norm, ok := normalize(counts, len(weights), log)
+	if !ok {
+		return nil
+	}
+	out := writeNCount([]byte{0}, norm, log)
+	enc := newFSEEncoder(norm, log)
+	var s [2]fseState
+	n := len(weights)
+	w := bitWriter{out: out}
+	s[(n-1)%2].init(enc, weights[n-1])
+	s[(n-2)%2].init(enc, weights[n-2])
+	for i := n - 3; i >= 0; i-- {
+		s[i%2].encode(&w, weights[i])
+	}
+	s[1].flush(&w)
+	s[0].flush(&w)
+	out = w.close()
+	if len(out)-1 >= 128 {
+		return nil
+	}
+	out[0] = byte(len(out) - 1)
+
+	// The stream must decode to exactly the weights: a dominant weight can
+	// leave states that take no bits, which makes the end ambiguous.
+	t, _, err := readHuffTable(out)
+	if err != nil {
+		return nil
+	}
+	want, _ := newHuffTable(weights)
+	if want == nil || t.maxBits != want.maxBits || !equalEntries(t.e, want.e) {
+		return nil
+	}
+	return out
+}
+
+func equalEntries(a, b []huffEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
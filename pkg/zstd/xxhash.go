@@ -0,0 +1,94 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// xxh64 computes the XXH64 hash with seed 0, which frames use as their
+// content checksum.
+type xxh64 struct {
+	v     [4]uint64
+	buf   [32]byte
+	nbuf  int
+	total uint64
+}
+
+// The primes are variables so that arithmetic on them wraps.
+var (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func (h *xxh64) reset() {
+	*h = xxh64{}
+	h.v = [4]uint64{xxPrime1 + xxPrime2, xxPrime2, 0, -xxPrime1}
+}
+
+func xxRound(acc, lane uint64) uint64 {
+	return bits.RotateLeft64(acc+lane*xxPrime2, 31) * xxPrime1
+}
+
+func (h *xxh64) Write(p []byte) (int, error) {
+	n := len(p)
+	h.total += uint64(n)
+	if h.nbuf > 0 {
+		c := copy(h.buf[h.nbuf:], p)
+		h.nbuf += c
+		p = p[c:]
+		if h.nbuf < 32 {
+			return n, nil
+		}
+		h.stripe(h.buf[:])
+		h.nbuf = 0
+	}
+	for len(p) >= 32 {
+		h.stripe(p)
+		p = p[32:]
+	}
+	h.nbuf = copy(h.buf[:], p)
+	return n, nil
+}
+
+func (h *xxh64) stripe(p []byte) {
+	for i := range h.v {
+		h.v[i] = xxRound(h.v[i], binary.LittleEndian.Uint64(p[8*i:]))
+	}
+}
+
+func (h *xxh64) sum() uint64 {
+	var acc uint64
+	if h.total >= 32 {
+		v := h.v
+		acc = bits.RotateLeft64(v[0], 1) + bits.RotateLeft64(v[1], 7) + bits.RotateLeft64(v[2], 12) + bits.RotateLeft64(v[3], 18)
+		for _, x := range v {
+			acc = (acc^xxRound(0, x))*xxPrime1 + xxPrime4
+		}
+	} else {
+		acc = xxPrime5
+	}
+	acc += h.total
+	p := h.buf[:h.nbuf]
+	for ; len(p) >= 8; p = p[8:] {
+		acc ^= xxRound(0, binary.LittleEndian.Uint64(p))
+		acc = bits.RotateLeft64(acc, 27)*xxPrime1 + xxPrime4
+	}
+	if len(p) >= 4 {
+		acc ^= uint64(binary.LittleEndian.Uint32(p)) * xxPrime1
+		acc = bits.RotateLeft64(acc, 23)*xxPrime2 + xxPrime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		acc ^= uint64(b) * xxPrime5
+		acc = bits.RotateLeft64(acc, 11) * xxPrime1
+	}
+	acc ^= acc >> 33
+	acc *= xxPrime2
+	acc ^= acc >> 29
+	acc *= xxPrime3
+	acc ^= acc >> 32
+	return acc
+}
@@ -0,0 +1,107 @@
+// Package zstd reads and writes Zstandard-compressed data (RFC 8878).
+//
+// The decoder handles every frame the reference implementation produces
+// except those needing a dictionary. The encoder is a compact LZ77 with
+// Huffman-coded literals and FSE-coded sequences; it is considerably slower
+// than the reference implementation at the same level, with output of
+// comparable size that any decoder reads. It can compress with a
+// dictionary, see NewWriterDict.
+package zstd
+
+import "errors"
+
+// Frame and block format constants.
+const (
+	frameMagic         = 0xFD2FB528
+	skippableMagicMask = 0xFFFFFFF0
+	skippableMagic     = 0x184D2A50
+
+	maxBlockSize = 128 << 10
+
+	blockRaw        = 0
+	blockRLE        = 1
+	blockCompressed = 2
+)
+
+// maxWindowSize bounds the history the decoder keeps: 128 MiB, above
+// which the reference implementation refuses windows too unless told
+// otherwise with --long.
+const maxWindowSize = 1 << 27
+
+var errCorrupt = errors.New("zstd: corrupt input")
+
+// Literals and match-length codes: the baseline value and number of extra
+// bits of each code.
+var (
+	llBase = [36]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	llBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	mlBase = [53]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	mlBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+)
+
+// The predefined distributions of the sequence codes.
+var (
+	llDefault = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+	mlDefault = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+	ofDefault = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+)
+
+const (
+	llDefaultLog = 6
+	mlDefaultLog = 6
+	ofDefaultLog = 5
+
+	llMaxLog = 9
+	mlMaxLog = 9
+	ofMaxLog = 8
+
+	llMaxSymbol = 35
+	mlMaxSymbol = 52
+	ofMaxSymbol = 31
+)
+
+// Sequence section compression modes.
+const (
+	modePredefined = 0
+	modeRLE        = 1
+	modeFSE        = 2
+	modeRepeat     = 3
+)
+
+// Literals section block types.
+const (
+	litRaw        = 0
+	litRLE        = 1
+	litCompressed = 2
+	litTreeless   = 3
+)
@@ -0,0 +1,112 @@
+package zstd_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/hxtk/ember/pkg/zstd"
+)
+
+// inputs are what the round trips compress: nothing, text, runs that
+// compress well, noise that doesn't, and a mix spanning several blocks.
+func inputs() map[string][]byte {
+	rng := rand.New(rand.NewChaCha8([32]byte{}))
+	noise := make([]byte, 200<<10)
+	for i := range noise {
+		noise[i] = byte(rng.Uint32())
+	}
+	var mixed bytes.Buffer
+	for i := 0; mixed.Len() < 1<<20; i++ {
+		fmt.Fprintf(&mixed, "line %d of a file that repeats itself\n", i%700)
+		mixed.Write(noise[i%1000 : i%1000+i%37])
+	}
+	return map[string][]byte{
+		"empty": nil,
+		"text":  []byte("an initramfs holds the files the kernel needs to mount the root\n"),
+		"runs":  bytes.Repeat([]byte{'a'}, 300<<10),
+		"noise": noise,
+		"mixed": mixed.Bytes(),
+	}
+}
+
+func compress(t *testing.T, b []byte, level int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	z, err := zstd.NewWriterLevel(&buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := z.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, b := range inputs() {
+		for _, level := range []int{zstd.MinLevel, zstd.DefaultLevel, 9, zstd.MaxLevel} {
+			t.Run(fmt.Sprintf("%s/level=%d", name, level), func(t *testing.T) {
+				got, err := io.ReadAll(zstd.NewReader(bytes.NewReader(compress(t, b, level))))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, b) {
+					t.Errorf("decompressed %d bytes differing from the %d compressed", len(got), len(b))
+				}
+			})
+		}
+	}
+}
+
+// The reference implementation reads what the Writer writes.
+func TestReferenceDecoder(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd is not installed")
+	}
+	for name, b := range inputs() {
+		t.Run(name, func(t *testing.T) {
+			cmd := exec.Command("zstd", "-d", "-c")
+			cmd.Stdin = bytes.NewReader(compress(t, b, zstd.DefaultLevel))
+			var stderr strings.Builder
+			cmd.Stderr = &stderr
+			got, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("zstd -d: %v: %s", err, stderr.String())
+			}
+			if !bytes.Equal(got, b) {
+				t.Errorf("zstd -d gave %d bytes differing from the %d compressed", len(got), len(b))
+			}
+		})
+	}
+}
+
+func TestReaderRejectsCorrupt(t *testing.T) {
+	z := compress(t, inputs()["mixed"], zstd.DefaultLevel)
+	z[len(z)/2] ^= 0xff
+	if _, err := io.ReadAll(zstd.NewReader(bytes.NewReader(z))); err == nil {
+		t.Error("read of a corrupt frame succeeded")
+	}
+}
+
+// Windows over 128 MiB are refused, as the reference decoder does, rather
+// than kept in memory.
+func TestReaderRejectsLargeWindow(t *testing.T) {
+	for _, tc := range []struct {
+		log  int
+		fail bool
+	}{{27, false}, {28, true}} {
+		frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, byte(tc.log-10) << 3, 0x01, 0x00, 0x00} // an empty last raw block
+		_, err := io.ReadAll(zstd.NewReader(bytes.NewReader(frame)))
+		if (err != nil) != tc.fail {
+			t.Errorf("window of 1<<%d: err = %v, want failure %v", tc.log, err, tc.fail)
+		}
+	}
+}